@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+)
+
+// APIKey prints a new key for the control API and the control_keys entry
+// that takes it, with only its hash.
+func APIKey(args []string) {
+	flags := flag.NewFlagSet("api-key", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n  %s api-key [-name NAME] [-scopes read,ports,admin] [-rate N]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	name := flags.String("name", "default", "name of the key in the logs")
+	scopes := flags.String("scopes", control.ScopeRead, "comma-separated scopes: read, ports or admin")
+	rate := flags.Int("rate", 0, "requests per minute, 0 for no limit")
+	flags.Parse(args)
+
+	key, hash, err := control.NewKey()
+	if err != nil {
+		logger.Fatalf("failed to generate a key: %v", err)
+	}
+	fmt.Printf("# API key, for the Authorization: Bearer header, not stored anywhere:\n# %s\n", key)
+	fmt.Printf("[[server.control_keys]] # or client.control_keys\nname = %q\nhash = %q\nscopes = [", *name, hash)
+	for i, scope := range splitList(*scopes) {
+		if i > 0 {
+			fmt.Print(", ")
+		}
+		fmt.Printf("%q", scope)
+	}
+	fmt.Printf("]\nrate = %d\n", *rate)
+}
@@ -0,0 +1,51 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+)
+
+// Attack prints the state of the attack mode of a running server, or
+// switches it:
+//
+//	backhaul attack -c server.toml       print it
+//	backhaul attack -c server.toml on    guard the public ports until switched off
+//	backhaul attack -c server.toml auto  guard them while the accept rate spikes
+func Attack(args []string) {
+	flags := flag.NewFlagSet("attack", flag.ExitOnError)
+	configPath := flags.String("c", "", "configuration file of the server, to find its control_socket")
+	socket := flags.String("s", "", "path of the control socket, instead of -c")
+	profile := flags.String("p", "", "named profile of the configuration file")
+	flags.Parse(args)
+
+	path := controlSocket("attack", *configPath, *profile, *socket)
+
+	var state control.Attack
+	var err error
+	switch flags.NArg() {
+	case 0:
+		err = control.Get(path, "/attack", &state)
+	case 1:
+		err = control.Put(path, "/attack?mode="+url.QueryEscape(flags.Arg(0)), &state)
+	default:
+		logger.Fatalf("Usage: %s attack -c /path/to/config.toml [on|off|auto]", os.Args[0])
+	}
+	if err != nil {
+		logger.Fatalf("attack failed: %v", err)
+	}
+
+	fmt.Printf("Mode:         %s\n", state.Mode)
+	if state.Active {
+		fmt.Printf("Under attack: since %s (%s)\n", state.Since.Format(time.DateTime), time.Since(state.Since).Round(time.Second))
+	} else {
+		fmt.Println("Under attack: no")
+	}
+	fmt.Printf("Connections:  %d/s\n", state.Rate)
+	fmt.Printf("SYN cookies:  %d/s\n", state.SynCookies)
+	fmt.Printf("Refused:      %d\n", state.Refused)
+}
@@ -0,0 +1,330 @@
+package cmd
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"runtime"
+	"slices"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/client"
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/netem"
+	"github.com/sahmadiut/backhaul/internal/server"
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// benchReady is how long the tunnel may take to come up before the benchmark
+// gives up.
+const benchReady = 15 * time.Second
+
+// benchTimeout is how long a round trip may take before it counts as failed.
+const benchTimeout = 5 * time.Second
+
+// benchResult is what "backhaul bench" measured, printed as JSON with -json.
+type benchResult struct {
+	Transport   string  `json:"transport"`
+	Profile     string  `json:"profile,omitempty"`
+	Conns       int     `json:"conns"`
+	Size        int     `json:"size"`
+	Seconds     float64 `json:"seconds"`
+	RoundTrips  int     `json:"round_trips"`
+	Mbps        float64 `json:"mbps"` // each way
+	P50         float64 `json:"p50_ms"`
+	P99         float64 `json:"p99_ms"`
+	AllocsPerRT float64 `json:"allocs_per_round_trip"`
+	BytesPerRT  float64 `json:"alloc_bytes_per_round_trip"`
+	Errors      int     `json:"errors"` // round trips that failed
+	Cuts        int     `json:"cuts"`
+}
+
+// Bench runs a server and a client over the loopback interface in this
+// process, with an echo target behind them, and drives connections through
+// the tunnel to measure it. The tunnel can run over a simulated path with
+// latency, loss, a rate limit and cuts.
+func Bench(args []string) {
+	flags := flag.NewFlagSet("bench", flag.ExitOnError)
+	transport := flags.String("transport", string(config.TCPMUX), "transport to measure: tcp, tcpmux or ws")
+	profile := flags.String("profile", "", "tuning profile of the server and client: latency, throughput or balanced")
+	conns := flags.Int("conns", 16, "concurrent connections")
+	size := flags.Int("size", 1024, "bytes each connection sends and reads back per round trip")
+	duration := flags.Duration("duration", 10*time.Second, "how long to measure")
+	latency := flags.Duration("latency", 0, "latency added to the path between client and server, each way")
+	loss := flags.Float64("loss", 0, "percent of writes on the path lost and sent again")
+	rate := flags.Float64("rate", 0, "Mbit/s the path carries each way, 0 for no limit")
+	cut := flags.Duration("cut", 0, "interval to cut all connections of the path at, to measure reconnects")
+	asJSON := flags.Bool("json", false, "print the result as JSON, on the last line")
+	logLevel := flags.String("log-level", "warn", "log level of the server and client")
+	flags.Parse(args)
+
+	switch config.TransportType(*transport) {
+	case config.TCP, config.TCPMUX, config.WS:
+	default:
+		logger.Fatalf("bench supports the tcp, tcpmux and ws transports, not %q", *transport)
+	}
+	if *conns <= 0 || *size <= 0 || *duration <= 0 {
+		logger.Fatalf("-conns, -size and -duration must be positive")
+	}
+	if *loss < 0 || *loss > 100 {
+		logger.Fatalf("-loss must be between 0 and 100")
+	}
+	path := netem.Conditions{Latency: *latency, Loss: *loss / 100, Rate: int64(*rate * 1e6 / 8)}
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logger.Fatalf("failed to start the echo target: %v", err)
+	}
+	defer target.Close()
+	go echo(target)
+
+	// bound here so nothing else takes the ports, the server picks them up
+	bindAddr, publicAddr := bindLoopback(), bindLoopback()
+	_, publicPort, _ := net.SplitHostPort(publicAddr)
+	cfg := config.Config{
+		Server: config.ServerConfig{
+			BindAddr:  bindAddr,
+			Transport: config.TransportType(*transport),
+			Token:     randomToken(),
+			Ports:     []string{fmt.Sprintf("%s=%d", publicPort, target.Addr().(*net.TCPAddr).Port)},
+			PortsAddr: "127.0.0.1",
+			LogLevel:  *logLevel,
+			Profile:   *profile,
+		},
+	}
+	cfg.Client = config.ClientConfig{
+		RemoteAddr: cfg.Server.BindAddr,
+		Transport:  cfg.Server.Transport,
+		Token:      cfg.Server.Token,
+		LogLevel:   *logLevel,
+		Profile:    *profile,
+		NoPersist:  "the client is part of a benchmark",
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	// the client reaches the server over the simulated path
+	var link *netem.Link
+	if !path.IsZero() || *cut > 0 {
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			logger.Fatalf("failed to start the simulated path: %v", err)
+		}
+		link = netem.NewLink(listener, bindAddr, path)
+		go link.Run(ctx)
+		cfg.Client.RemoteAddr = listener.Addr().String()
+	}
+	applyDefaults(&cfg)
+
+	srv := server.NewServer(&cfg.Server, ctx)
+	go srv.Start()
+	defer srv.Stop()
+	clnt := client.NewClient(&cfg.Client, ctx)
+	go clnt.Start()
+	defer clnt.Stop()
+
+	if err := waitForTunnel(publicAddr, benchReady); err != nil {
+		logger.Fatalf("the tunnel didn't come up within %s: %v", benchReady, err)
+	}
+	if !*asJSON {
+		fmt.Printf("measuring %s with %d connections of %d bytes for %s...\n", *transport, *conns, *size, *duration)
+	}
+
+	var cuts atomic.Int64
+	if *cut > 0 {
+		go func() {
+			ticker := time.NewTicker(*cut)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ticker.C:
+					link.Cut()
+					cuts.Add(1)
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+
+	result := runBench(publicAddr, *conns, *size, *duration)
+	result.Cuts = int(cuts.Load())
+	result.Transport = *transport
+	result.Profile = *profile
+
+	if *asJSON {
+		if err := json.NewEncoder(os.Stdout).Encode(result); err != nil {
+			logger.Fatalf("failed to print the result: %v", err)
+		}
+		return
+	}
+	fmt.Printf("Round trips:  %d (%.0f/s)\n", result.RoundTrips, float64(result.RoundTrips)/result.Seconds)
+	fmt.Printf("Throughput:   %.1f Mbit/s each way\n", result.Mbps)
+	fmt.Printf("Latency:      p50 %.3f ms, p99 %.3f ms\n", result.P50, result.P99)
+	fmt.Printf("Allocations:  %.1f per round trip, %.0f bytes\n", result.AllocsPerRT, result.BytesPerRT)
+	if result.Cuts > 0 {
+		fmt.Printf("Cuts:         %d\n", result.Cuts)
+	}
+	if result.Errors > 0 {
+		fmt.Printf("Errors:       %d round trips failed\n", result.Errors)
+	}
+}
+
+// runBench has conns connections to address send size bytes and read them
+// back until duration is over. The allocations are those of the whole
+// process, the connections driving the tunnel included.
+func runBench(address string, conns, size int, duration time.Duration) benchResult {
+	var (
+		mu        sync.Mutex
+		latencies []time.Duration
+		failed    int
+		wg        sync.WaitGroup
+	)
+
+	var before, after runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&before)
+	start := time.Now()
+	deadline := start.Add(duration)
+
+	for i := 0; i < conns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			own, errs := roundTrips(address, size, deadline)
+			mu.Lock()
+			defer mu.Unlock()
+			latencies = append(latencies, own...)
+			failed += errs
+		}()
+	}
+	wg.Wait()
+	elapsed := time.Since(start)
+	runtime.ReadMemStats(&after)
+
+	result := benchResult{
+		Conns:      conns,
+		Size:       size,
+		Seconds:    elapsed.Seconds(),
+		RoundTrips: len(latencies),
+		Errors:     failed,
+	}
+	if len(latencies) == 0 {
+		return result
+	}
+	slices.Sort(latencies)
+	rts := float64(len(latencies))
+	result.Mbps = rts * float64(size) * 8 / elapsed.Seconds() / 1e6
+	result.P50 = float64(latencies[len(latencies)/2].Microseconds()) / 1000
+	result.P99 = float64(latencies[len(latencies)*99/100].Microseconds()) / 1000
+	result.AllocsPerRT = float64(after.Mallocs-before.Mallocs) / rts
+	result.BytesPerRT = float64(after.TotalAlloc-before.TotalAlloc) / rts
+	return result
+}
+
+// roundTrips sends size bytes over a connection to address and reads them
+// back until deadline, and returns how long each round trip took and how many
+// failed. A connection that failed is dialed again.
+func roundTrips(address string, size int, deadline time.Time) ([]time.Duration, int) {
+	out, in := make([]byte, size), make([]byte, size)
+	var latencies []time.Duration
+	failed := 0
+	for time.Now().Before(deadline) {
+		own, err := roundTripsOn(address, out, in, deadline)
+		latencies = append(latencies, own...)
+		if err != nil {
+			failed++
+			time.Sleep(100 * time.Millisecond) // while the tunnel reconnects
+		}
+	}
+	return latencies, failed
+}
+
+// roundTripsOn does the round trips of roundTrips over one connection, until
+// it fails.
+func roundTripsOn(address string, out, in []byte, deadline time.Time) ([]time.Duration, error) {
+	conn, err := net.DialTimeout("tcp", address, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var latencies []time.Duration
+	for time.Now().Before(deadline) {
+		start := time.Now()
+		conn.SetDeadline(start.Add(benchTimeout)) // a cut may leave it hanging
+		if _, err := conn.Write(out); err != nil {
+			return latencies, err
+		}
+		if _, err := io.ReadFull(conn, in); err != nil {
+			return latencies, err
+		}
+		latencies = append(latencies, time.Since(start))
+	}
+	return latencies, nil
+}
+
+// waitForTunnel tries a round trip through address until one works or
+// timeout is over.
+func waitForTunnel(address string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := probe(address)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return err
+		}
+		time.Sleep(200 * time.Millisecond)
+	}
+}
+
+// probe sends a byte through address and reads it back.
+func probe(address string) error {
+	conn, err := net.DialTimeout("tcp", address, time.Second)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(time.Second))
+
+	if _, err := conn.Write([]byte{0}); err != nil {
+		return err
+	}
+	_, err = io.ReadFull(conn, make([]byte, 1))
+	return err
+}
+
+// echo writes back whatever the connections to listener send.
+func echo(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			io.Copy(conn, conn)
+		}()
+	}
+}
+
+// bindLoopback binds a free port of the loopback interface and registers the
+// listener for the server to take, returning its address.
+func bindLoopback() string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		logger.Fatalf("failed to bind a port: %v", err)
+	}
+	address := listener.Addr().String()
+	utils.AddListener(address, listener.(*net.TCPListener))
+	return address
+}
@@ -0,0 +1,86 @@
+package cmd
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"testing"
+
+	"github.com/sahmadiut/backhaul/internal/client"
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/netem"
+	"github.com/sahmadiut/backhaul/internal/server"
+)
+
+// TestTunnel runs a server and a client of each transport over a simulated
+// path, echoes through the tunnel, cuts the path and echoes again once the
+// client reconnected.
+func TestTunnel(t *testing.T) {
+	for _, transport := range []config.TransportType{config.TCP, config.TCPMUX, config.WS} {
+		t.Run(string(transport), func(t *testing.T) {
+			publicAddr, link := startTunnel(t, transport)
+			if err := waitForTunnel(publicAddr, benchReady); err != nil {
+				t.Fatalf("the tunnel didn't come up within %s: %v", benchReady, err)
+			}
+
+			if cut := link.Cut(); cut == 0 {
+				t.Fatalf("no connection of the path to cut")
+			}
+			if err := waitForTunnel(publicAddr, benchReady); err != nil {
+				t.Fatalf("the tunnel didn't recover from the cut within %s: %v", benchReady, err)
+			}
+		})
+	}
+}
+
+// startTunnel starts an echo target, and a server and client of transport
+// over a link, stopped with the test. It returns the public address of the
+// tunnel and the link.
+func startTunnel(t *testing.T, transport config.TransportType) (string, *netem.Link) {
+	t.Helper()
+	ctx, cancel := context.WithCancel(context.Background())
+	t.Cleanup(cancel)
+
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the echo target: %v", err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go echo(target)
+
+	bindAddr, publicAddr := bindLoopback(), bindLoopback()
+	_, publicPort, _ := net.SplitHostPort(publicAddr)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to start the simulated path: %v", err)
+	}
+	link := netem.NewLink(listener, bindAddr, netem.Conditions{})
+	go link.Run(ctx)
+
+	cfg := config.Config{
+		Server: config.ServerConfig{
+			BindAddr:  bindAddr,
+			Transport: transport,
+			Token:     randomToken(),
+			Ports:     []string{fmt.Sprintf("%s=%d", publicPort, target.Addr().(*net.TCPAddr).Port)},
+			PortsAddr: "127.0.0.1",
+			LogLevel:  "warn",
+		},
+	}
+	cfg.Client = config.ClientConfig{
+		RemoteAddr: listener.Addr().String(),
+		Transport:  transport,
+		Token:      cfg.Server.Token,
+		LogLevel:   "warn",
+		NoPersist:  "the client is part of a test",
+	}
+	applyDefaults(&cfg)
+
+	srv := server.NewServer(&cfg.Server, ctx)
+	go srv.Start()
+	t.Cleanup(srv.Stop)
+	clnt := client.NewClient(&cfg.Client, ctx)
+	go clnt.Start()
+	t.Cleanup(clnt.Stop)
+	return publicAddr, link
+}
@@ -2,6 +2,7 @@ package cmd
 
 import (
 	"context"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
@@ -10,25 +11,126 @@ import (
 	"github.com/sahmadiut/backhaul/internal/client"
 	"github.com/sahmadiut/backhaul/internal/config"
 	"github.com/sahmadiut/backhaul/internal/server"
+	"github.com/sahmadiut/backhaul/internal/update"
 	"github.com/sahmadiut/backhaul/internal/utils"
-
-	"github.com/BurntSushi/toml"
 )
 
 var (
 	logger = utils.NewLogger("info")
 )
 
-func Run(configPath string) {
+func Run(configPath, profile string, ov *Overrides) {
+	run(configPath, profile, ov, false)
+}
+
+// Role runs a server or client set up by flags, with an optional config file
+// underneath, e.g. "backhaul client --remote x:3080 --token t --transport ws".
+func Role(role string, args []string) {
+	flags := flag.NewFlagSet(role, flag.ExitOnError)
+	configPath := flags.String("c", "", "path to the configuration file (TOML, YAML or JSON, optional)")
+	profile := flags.String("p", "", "named profile of the configuration file")
+	ov := RegisterFlags(flags, role)
+	flags.Parse(args)
+
+	run(*configPath, *profile, ov, false)
+}
+
+// Upgrade starts a new instance that takes over the listening sockets of the
+// running one through its upgrade socket. The old instance then drains.
+func Upgrade(args []string) {
+	flags := flag.NewFlagSet("upgrade", flag.ExitOnError)
+	configPath := flags.String("c", "", "path to the configuration file (TOML, YAML or JSON)")
+	profile := flags.String("p", "", "named profile of the configuration file")
+	flags.Parse(args)
+
+	if *configPath == "" {
+		logger.Fatalf("Usage: %s upgrade -c /path/to/config.toml [-p profile]", os.Args[0])
+	}
+
+	run(*configPath, *profile, nil, true)
+}
+
+func run(configPath, profile string, ov *Overrides, upgrade bool) {
+	names := instanceNames(configPath, profile)
+	if len(names) > 1 {
+		if upgrade {
+			logger.Fatalf("upgrade needs a single tunnel per process, pick one profile with -p")
+		}
+		serveAll(configPath, names, ov)
+		return
+	}
+	if len(names) == 1 {
+		profile = names[0]
+	}
+
+	cfg := prepare(configPath, profile, ov)
+	if cfg.Relay.Upstream.RemoteAddr != "" || cfg.Relay.Downstream.BindAddr != "" {
+		if upgrade {
+			logger.Fatalf("upgrade needs a single tunnel per process, it can't replace a relay")
+		}
+		serveConfigs(relayConfigs(cfg), []string{relayUpstream, relayDownstream})
+		return
+	}
+	serve(cfg, upgrade)
+}
+
+// prepare builds the effective configuration from the file and the flags.
+func prepare(configPath, profile string, ov *Overrides) config.Config {
 	// Load and parse the configuration file
-	cfg, err := loadConfig(configPath)
-	if err != nil {
-		logger.Fatalf("failed to load configuration: %v", err)
+	var cfg config.Config
+	if configPath != "" {
+		var err error
+		if cfg, err = loadConfig(configPath, profile); err != nil {
+			logger.Fatalf("failed to load configuration: %v", err)
+		}
+		cfg.Client.ConfigPath = configPath
 	}
 
+	// Command-line flags take precedence over the file
+	ov.apply(&cfg)
+
 	// Apply default values to the configuration
 	applyDefaults(&cfg)
 
+	// the transports only read the ports once a client connects
+	if cfg.Server.BindAddr != "" {
+		if _, err := utils.ParsePorts(cfg.Server.Ports, cfg.Server.Forward); err != nil {
+			logger.Fatalf("invalid ports: %v", err)
+		}
+	}
+
+	// the same once more for a reload of the client
+	if configPath != "" {
+		cfg.Client.Reload = func() (config.ClientConfig, error) {
+			reloaded, err := loadConfig(configPath, profile)
+			if err != nil {
+				return config.ClientConfig{}, err
+			}
+			ov.apply(&reloaded)
+			applyDefaults(&reloaded)
+			return reloaded.Client, nil
+		}
+	}
+
+	return cfg
+}
+
+// serve runs the server or client until a shutdown signal arrives.
+func serve(cfg config.Config, upgrade bool) {
+	// Take over the listeners of the running instance
+	if upgrade {
+		if cfg.Server.UpgradeSocket == "" {
+			logger.Fatalf("upgrade needs upgrade_socket in the server configuration")
+		}
+		count, err := utils.ReceiveHandoff(cfg.Server.UpgradeSocket)
+		if err != nil {
+			logger.Fatalf("failed to take over listeners from %s: %v", cfg.Server.UpgradeSocket, err)
+		}
+		logger.Infof("took over %d listeners from the running instance", count)
+	}
+
+	useActivationListeners()
+
 	// Create a context for graceful shutdown handling
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
@@ -42,31 +144,94 @@ func Run(configPath string) {
 		srv := server.NewServer(&cfg.Server, ctx) // server
 		go srv.Start()
 
+		// Hand the listeners over to a new instance on upgrade
+		var handoff <-chan struct{}
+		if cfg.Server.UpgradeSocket != "" {
+			var err error
+			if handoff, err = utils.ServeHandoff(cfg.Server.UpgradeSocket, logger); err != nil {
+				logger.Errorf("failed to listen on upgrade socket %s: %v", cfg.Server.UpgradeSocket, err)
+			}
+		}
+
 		// Wait for shutdown signal
-		<-sigChan
-		srv.Stop()
-		time.Sleep(1 * time.Second)
-		logger.Println("shutting down server...")
+		select {
+		case <-sigChan:
+			srv.Stop()
+			time.Sleep(1 * time.Second)
+			if relays := utils.ActiveRelays(); relays > 0 {
+				logger.Infof("waiting up to %ds for %d connections to finish, send the signal again to stop now", cfg.Server.SessionDrain, relays)
+				drain(time.Duration(cfg.Server.SessionDrain)*time.Second, sigChan)
+			}
+			logger.Println("shutting down server...")
+
+		case <-handoff:
+			logger.Info("listeners handed over to the new instance, draining...")
+			srv.Stop()
+			utils.CloseListeners()
+			drain(time.Duration(cfg.Server.DrainTimeout)*time.Second, sigChan)
+			logger.Println("shutting down server...")
+		}
 
 	} else if cfg.Client.RemoteAddr != "" {
 		clnt := client.NewClient(&cfg.Client, ctx) // client
 		go clnt.Start()
 
+		// Replace the binary with a signed release and run that one
+		var updated <-chan struct{}
+		if cfg.Client.UpdateURL != "" {
+			updater, err := update.New(cfg.Client.UpdateURL, cfg.Client.UpdateKey, time.Duration(cfg.Client.UpdateInterval)*time.Minute, logger)
+			if err != nil {
+				logger.Fatalf("%v", err)
+			}
+			go updater.Run(ctx)
+			updated = updater.Done()
+		}
+
 		// Wait for shutdown signal
-		<-sigChan
-		clnt.Stop()
-		time.Sleep(1 * time.Second)
-		logger.Println("shutting down client...")
+		select {
+		case <-sigChan:
+			clnt.Stop()
+			time.Sleep(1 * time.Second)
+			logger.Println("shutting down client...")
+
+		case <-updated:
+			clnt.Stop()
+			time.Sleep(1 * time.Second)
+			logger.Println("restarting client into the new release...")
+			if err := update.Exec(cfg.Client.ClientID); err != nil {
+				logger.Fatalf("failed to run the new release: %v", err)
+			}
+		}
 	} else {
 		logger.Fatalf("neither server nor client configuration is properly set.")
 	}
 }
 
-// loadConfig loads and parses the TOML configuration file.
-func loadConfig(configPath string) (config.Config, error) {
-	var cfg config.Config
-	if _, err := toml.DecodeFile(configPath, &cfg); err != nil {
-		return cfg, err
+// useActivationListeners picks up listeners passed by systemd socket
+// activation.
+func useActivationListeners() {
+	if count, err := utils.RegisterActivationListeners(); err != nil {
+		logger.Fatalf("failed to use socket activation listeners: %v", err)
+	} else if count > 0 {
+		logger.Infof("using %d listeners from socket activation", count)
+	}
+}
+
+// drain waits until all relayed connections are closed, the timeout passes or
+// another signal arrives.
+func drain(timeout time.Duration, sigChan <-chan os.Signal) {
+	ticker := time.NewTicker(1 * time.Second)
+	defer ticker.Stop()
+
+	deadline := time.After(timeout)
+	for utils.ActiveRelays() > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			logger.Warnf("drain timeout reached, closing %d active connections", utils.ActiveRelays())
+			return
+		case <-sigChan:
+			return
+		}
 	}
-	return cfg, nil
 }
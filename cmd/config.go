@@ -0,0 +1,203 @@
+package cmd
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+
+	"github.com/BurntSushi/toml"
+)
+
+// loadConfig loads and parses the configuration file. TOML, YAML and JSON
+// files are accepted, picked by extension, and share the same schema. The
+// named profile, if any, is applied and the files it includes are merged in.
+func loadConfig(configPath, profile string) (config.Config, error) {
+	cfg, md, unknown, err := loadFile(configPath, profile)
+	if err != nil {
+		return cfg, err
+	}
+	if err := checkUnknown(configPath, unknown, cfg.StrictConfig); err != nil {
+		return cfg, err
+	}
+	if len(cfg.Include) > 0 {
+		if err := mergeIncludes(&cfg, md, configPath); err != nil {
+			return cfg, err
+		}
+	}
+	if profile == "" && md.IsDefined("profiles") && cfg.Server.BindAddr == "" && cfg.Client.RemoteAddr == "" {
+		return cfg, fmt.Errorf("%s: no server or client outside of profiles, %s with -p", configPath, profileNames(md))
+	}
+	return cfg, nil
+}
+
+// loadFile parses one configuration file, with the named profile applied and
+// its environment variables and secret files resolved, and returns the keys
+// it set along with the unknown ones.
+func loadFile(configPath, profile string) (config.Config, toml.MetaData, []string, error) {
+	var cfg config.Config
+
+	data, err := os.ReadFile(configPath)
+	if err != nil {
+		return cfg, toml.MetaData{}, nil, err
+	}
+
+	// YAML and JSON are converted to TOML so every format goes through the
+	// same decoder, with the key lines taken from the original file
+	var doc string
+	var lines map[string]int
+	format := config.FileFormat(configPath)
+	switch format {
+	case config.FormatYAML:
+		doc, lines, err = yamlToTOML(data)
+	case config.FormatJSON:
+		doc, lines, err = jsonToTOML(data)
+	default:
+		doc, lines = string(data), keyLines(data)
+	}
+	if err != nil {
+		return cfg, toml.MetaData{}, nil, fmt.Errorf("%s: %v", configPath, err)
+	}
+
+	md, err := toml.Decode(doc, &cfg)
+	if err != nil {
+		var perr toml.ParseError
+		if format == config.FormatTOML && errors.As(err, &perr) {
+			return cfg, md, nil, fmt.Errorf("%s: %s", configPath, perr.ErrorWithPosition())
+		}
+		return cfg, md, nil, typeError(configPath, err, lines, data)
+	}
+	if err := applyNamedProfile(&cfg, md, profile, configPath); err != nil {
+		return cfg, md, nil, err
+	}
+	if err := resolveRefs(reflect.ValueOf(&cfg).Elem(), "", configPath, lines); err != nil {
+		return cfg, md, nil, err
+	}
+	return cfg, md, unknownKeys(md, lines), nil
+}
+
+// checkUnknown warns about the unknown keys of a file, or fails with
+// strict_config.
+func checkUnknown(configPath string, unknown []string, strict bool) error {
+	if len(unknown) == 0 {
+		return nil
+	}
+
+	if strict {
+		for _, msg := range unknown {
+			logger.Errorf("%s:%s", configPath, msg)
+		}
+		return fmt.Errorf("%d unknown key(s) in %s with strict_config enabled", len(unknown), configPath)
+	}
+
+	for _, msg := range unknown {
+		logger.Warnf("%s:%s, ignoring it", configPath, msg)
+	}
+	return nil
+}
+
+// unknownKeys reports every key in the file that does not map to a config
+// field, with the line it is defined on. Keys inside an unknown table are
+// reported once through the table.
+func unknownKeys(md toml.MetaData, lines map[string]int) []string {
+	undecoded := md.Undecoded()
+	if len(undecoded) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]bool, len(undecoded))
+	for _, key := range undecoded {
+		seen[key.String()] = true
+	}
+
+	// converted YAML and JSON documents come out in a different order
+	sort.SliceStable(undecoded, func(i, j int) bool {
+		return lines[undecoded[i].String()] < lines[undecoded[j].String()]
+	})
+
+	var msgs []string
+	for _, key := range undecoded {
+		if len(key) > 1 && seen[key[:len(key)-1].String()] {
+			continue
+		}
+		name := key.String()
+		msgs = append(msgs, fmt.Sprintf("%d: unknown key %q", lines[name], name))
+	}
+	return msgs
+}
+
+// keyLines maps the full name of every key and table header in a TOML
+// document to the line it appears on. It only needs to be good enough to
+// point at typos, so values spanning several lines are not tracked.
+func keyLines(data []byte) map[string]int {
+	lines := make(map[string]int)
+	table := ""
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			end := strings.LastIndexByte(line, ']')
+			if end < 0 {
+				continue
+			}
+			table = normalizeKey(strings.Trim(line[:end+1], "[]"))
+			if _, ok := lines[table]; !ok {
+				lines[table] = n
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		name := normalizeKey(line[:eq])
+		if table != "" {
+			name = table + "." + name
+		}
+		if _, ok := lines[name]; !ok {
+			lines[name] = n
+		}
+	}
+	return lines
+}
+
+// normalizeKey strips whitespace and quotes around the parts of a dotted key.
+func normalizeKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+var errLastKey = regexp.MustCompile(`(?s)^toml: (?:line \d+ )?\(last key "([^"]*)"\): (.*)$`)
+
+// typeError points a decoding error, usually a value of the wrong type, at
+// the line of the original file and quotes that line.
+func typeError(configPath string, err error, lines map[string]int, data []byte) error {
+	m := errLastKey.FindStringSubmatch(err.Error())
+	if m == nil {
+		return fmt.Errorf("%s: %v", configPath, err)
+	}
+	key, msg := m[1], m[2]
+
+	n := lines[key]
+	src := bytes.Split(data, []byte("\n"))
+	if n < 1 || n > len(src) {
+		return fmt.Errorf("%s: %s: %s", configPath, key, msg)
+	}
+	return fmt.Errorf("%s:%d: %s: %s\n\n%5d | %s", configPath, n, key, msg, n, bytes.TrimRight(src[n-1], "\r"))
+}
@@ -1,7 +1,15 @@
 package cmd
 
 import (
+	"math"
+	"net"
+	"runtime"
+	"strconv"
+	"strings"
+
 	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/tun"
+	"github.com/sahmadiut/backhaul/internal/utils"
 
 	"github.com/sirupsen/logrus"
 )
@@ -11,20 +19,42 @@ const ( // Default values
 	defaultToken          = "sahmadiut"
 	defaultChannelSize    = 2048
 	defaultRetryInterval  = 1 // only for client
+	defaultDialTimeout    = 5 // seconds, only for client
+	defaultHandshake      = 5 // seconds, only for client
 	defaultConnectionPool = 8
 	defaultLogLevel       = "info"
 	defaultMuxSession     = 1
+	defaultScaleStreams   = 64  // streams per mux session
+	defaultScaleMbps      = 200 // Mbit/s per mux session
 	defaultKeepAlive      = 20
+	maxKeepaliveJitter    = 50 // percent
+	minTunMTU             = 576
+	maxTopSources         = 100 // source addresses shown per public port
 	// related to smux
 	defaultMuxVersion       = 1
 	defaultMaxFrameSize     = 32768   // 32KB
 	defaultMaxReceiveBuffer = 4194304 // 4MB
 	defaultMaxStreamBuffer  = 65536   // 256KB
 	defaultSnifferLog       = "backhaul.json"
+	defaultSnifferLogSize   = 10 // MB
+	defaultSnifferLogAge    = 24 // hours
+	defaultSnifferLogKeep   = 30 // days
+	defaultSnifferHistory   = 7  // days
 	deafultHeartbeat        = 20 // 20 seconds
+	defaultStickyRouting    = config.StickyNone
+	defaultOverflowTimeout  = 2  // seconds, only for the block policy
+	defaultDrainTimeout     = 60 // seconds, only after an upgrade
+	defaultSessionDrain     = 10 // seconds
+	defaultInfluxInterval   = 10 // seconds
+	defaultUpdateInterval   = 60 // minutes
+	defaultPPROFPort        = 6060
+	defaultPPROFDumpDir     = "."
 )
 
 func applyDefaults(cfg *config.Config) {
+	// Profile, only fills in what the config leaves unset
+	applyProfile(cfg)
+
 	// Transport
 	switch cfg.Server.Transport {
 	case config.TCP, config.TCPMUX, config.WS, config.WSS: // valid values
@@ -73,6 +103,17 @@ func applyDefaults(cfg *config.Config) {
 		cfg.Client.RetryInterval = defaultRetryInterval
 	}
 
+	// Client timeouts
+	if cfg.Client.DialTimeout <= 0 {
+		cfg.Client.DialTimeout = defaultDialTimeout
+	}
+	if cfg.Client.HandshakeTimeout <= 0 {
+		cfg.Client.HandshakeTimeout = defaultHandshake
+	}
+	if cfg.Client.ReadTimeout < 0 {
+		cfg.Client.ReadTimeout = 0
+	}
+
 	// Connection pool
 	if cfg.Server.ConnectionPool <= 0 {
 		cfg.Server.ConnectionPool = defaultConnectionPool
@@ -87,6 +128,18 @@ func applyDefaults(cfg *config.Config) {
 	}
 
 	// PPROF default is false if not valid value found
+	if cfg.Server.PPROFPort <= 0 {
+		cfg.Server.PPROFPort = defaultPPROFPort
+	}
+	if cfg.Client.PPROFPort <= 0 {
+		cfg.Client.PPROFPort = defaultPPROFPort
+	}
+	if cfg.Server.PPROFDumpDir == "" {
+		cfg.Server.PPROFDumpDir = defaultPPROFDumpDir
+	}
+	if cfg.Client.PPROFDumpDir == "" {
+		cfg.Client.PPROFDumpDir = defaultPPROFDumpDir
+	}
 
 	// keep alive
 	if cfg.Server.Keepalive <= 0 {
@@ -95,6 +148,12 @@ func applyDefaults(cfg *config.Config) {
 	if cfg.Client.Keepalive <= 0 {
 		cfg.Client.Keepalive = defaultKeepAlive
 	}
+	cfg.Server.KeepaliveMode = keepaliveMode(cfg.Server.KeepaliveMode, "server")
+	cfg.Client.KeepaliveMode = keepaliveMode(cfg.Client.KeepaliveMode, "client")
+	cfg.Server.KeepaliveJitter = keepaliveJitter(cfg.Server.KeepaliveJitter, "server")
+	cfg.Client.KeepaliveJitter = keepaliveJitter(cfg.Client.KeepaliveJitter, "client")
+	cfg.Server.PingInterval = max(cfg.Server.PingInterval, 0)
+	cfg.Client.PingInterval = max(cfg.Client.PingInterval, 0)
 
 	// Mux version
 	if cfg.Server.MuxVersion <= 0 || cfg.Server.MuxVersion > 2 {
@@ -133,9 +192,366 @@ func applyDefaults(cfg *config.Config) {
 	if cfg.Client.SnifferLog == "" {
 		cfg.Client.SnifferLog = defaultSnifferLog
 	}
+	for _, value := range []struct {
+		setting *int
+		def     int
+	}{
+		{&cfg.Server.SnifferLogSize, defaultSnifferLogSize},
+		{&cfg.Server.SnifferLogAge, defaultSnifferLogAge},
+		{&cfg.Server.SnifferLogKeep, defaultSnifferLogKeep},
+		{&cfg.Server.SnifferHistory, defaultSnifferHistory},
+		{&cfg.Client.SnifferLogSize, defaultSnifferLogSize},
+		{&cfg.Client.SnifferLogAge, defaultSnifferLogAge},
+		{&cfg.Client.SnifferLogKeep, defaultSnifferLogKeep},
+		{&cfg.Client.SnifferHistory, defaultSnifferHistory},
+	} {
+		if *value.setting == 0 {
+			*value.setting = value.def
+		}
+	}
 	// Heartbeat
 	if cfg.Server.Heartbeat < 1 { // Minimum accepted interval is 1 second
 		cfg.Server.Heartbeat = deafultHeartbeat
 	}
 
+	// Sticky routing
+	switch cfg.Server.StickyRouting {
+	case config.StickyNone, config.StickySourceIP, config.StickyPort: // valid values
+	case "":
+		cfg.Server.StickyRouting = defaultStickyRouting
+	default:
+		logger.Warnf("invalid sticky_routing value '%s', defaulting to '%s'", cfg.Server.StickyRouting, defaultStickyRouting)
+		cfg.Server.StickyRouting = defaultStickyRouting
+	}
+
+	// Pool policy
+	switch cfg.Server.PoolPolicy {
+	case config.PoolFixed, config.PoolOnDemand, config.PoolAdaptive: // valid values
+	case "":
+		cfg.Server.PoolPolicy = config.PoolFixed
+	default:
+		logger.Warnf("invalid pool_policy value '%s', defaulting to '%s'", cfg.Server.PoolPolicy, config.PoolFixed)
+		cfg.Server.PoolPolicy = config.PoolFixed
+	}
+	if cfg.Server.PoolPolicy != config.PoolFixed && cfg.Server.Transport != config.TCP {
+		logger.Warnf("pool_policy is only supported by tcp, ignoring it")
+		cfg.Server.PoolPolicy = config.PoolFixed
+	}
+
+	// Masquerade, the other transports don't speak HTTP on the tunnel port
+	if cfg.Server.Masquerade != "" && cfg.Server.Transport != config.WS && cfg.Server.Transport != config.WSS {
+		logger.Warnf("masquerade is only supported by ws and wss, ignoring it")
+		cfg.Server.Masquerade = ""
+	}
+	if cfg.Server.Fallback != "" && cfg.Server.Transport != config.WS && cfg.Server.Transport != config.WSS {
+		logger.Warnf("fallback is only supported by ws and wss, ignoring it")
+		cfg.Server.Fallback = ""
+	}
+
+	// Overflow policy, keep the previous behaviour of each transport by default
+	switch cfg.Server.OverflowPolicy {
+	case config.OverflowDrop, config.OverflowBlock, config.OverflowDropOldest, config.OverflowReject, config.OverflowGrow: // valid values
+	case "":
+		cfg.Server.OverflowPolicy = config.OverflowDrop
+		if cfg.Server.Transport == config.TCPMUX {
+			cfg.Server.OverflowPolicy = config.OverflowBlock
+		}
+	default:
+		logger.Warnf("invalid overflow_policy value '%s', defaulting to '%s'", cfg.Server.OverflowPolicy, config.OverflowDrop)
+		cfg.Server.OverflowPolicy = config.OverflowDrop
+	}
+	if cfg.Server.OverflowTimeout <= 0 {
+		cfg.Server.OverflowTimeout = defaultOverflowTimeout
+	}
+	if cfg.Server.FirstByteTimeout < 0 {
+		logger.Warnf("invalid first_byte_timeout %d, turning it off", cfg.Server.FirstByteTimeout)
+		cfg.Server.FirstByteTimeout = 0
+	}
+
+	// Influx push interval
+	if cfg.Server.InfluxInterval <= 0 {
+		cfg.Server.InfluxInterval = defaultInfluxInterval
+	}
+	if cfg.Client.InfluxInterval <= 0 {
+		cfg.Client.InfluxInterval = defaultInfluxInterval
+	}
+	if cfg.Client.UpdateInterval <= 0 {
+		cfg.Client.UpdateInterval = defaultUpdateInterval
+	}
+
+	// Drain timeout
+	if cfg.Server.DrainTimeout <= 0 {
+		cfg.Server.DrainTimeout = defaultDrainTimeout
+	}
+	if cfg.Server.SessionDrain <= 0 {
+		cfg.Server.SessionDrain = defaultSessionDrain
+	}
+
+	// Port options, forward tables set the protocol, expect and sni of their ports
+	for _, forward := range cfg.Server.Forward {
+		if forward.Proto == "" && forward.Expect == "" && len(forward.SNI) == 0 {
+			continue
+		}
+		mappings, _ := utils.ParseForward(forward) // reported by the transport
+		for _, mapping := range mappings {
+			port := strconv.Itoa(mapping.LocalPort)
+			opts := cfg.Server.PortOptions[port]
+			if forward.Proto != "" {
+				if opts.Protocol != "" && opts.Protocol != forward.Proto {
+					logger.Warnf("port %s has protocol '%s' in port_options and proto '%s' in its forward table, using '%s'", port, opts.Protocol, forward.Proto, opts.Protocol)
+				} else {
+					opts.Protocol = forward.Proto
+				}
+			}
+			if forward.Expect != "" {
+				if opts.Expect != "" && opts.Expect != forward.Expect {
+					logger.Warnf("port %s has expect '%s' in port_options and '%s' in its forward table, using '%s'", port, opts.Expect, forward.Expect, opts.Expect)
+				} else {
+					opts.Expect = forward.Expect
+				}
+			}
+			if len(forward.SNI) > 0 {
+				if len(opts.SNI) > 0 {
+					logger.Warnf("port %s has sni in port_options and in its forward table, using the one of port_options", port)
+				} else {
+					opts.SNI = forward.SNI
+				}
+			}
+			if cfg.Server.PortOptions == nil {
+				cfg.Server.PortOptions = make(map[string]config.PortOptions)
+			}
+			cfg.Server.PortOptions[port] = opts
+		}
+	}
+	for port, opts := range cfg.Server.PortOptions {
+		switch opts.Protocol {
+		case config.ProtoTCP, config.ProtoHTTP: // valid values
+		case "":
+			opts.Protocol = config.ProtoTCP
+		default:
+			logger.Warnf("invalid protocol value '%s' for port %s, defaulting to '%s'", opts.Protocol, port, config.ProtoTCP)
+			opts.Protocol = config.ProtoTCP
+		}
+		switch opts.Schedule {
+		case "", config.ScheduleLatency, config.ScheduleBulk: // valid values
+		default:
+			logger.Warnf("invalid schedule value '%s' for port %s, ignoring it", opts.Schedule, port)
+			opts.Schedule = ""
+		}
+		if opts.Schedule != "" && cfg.Server.Transport != config.TCPMUX {
+			logger.Warnf("schedule is only supported by tcpmux, ignoring it for port %s", port)
+			opts.Schedule = ""
+		}
+		switch opts.Expect {
+		case "", config.ExpectSSH, config.ExpectTLS, config.ExpectHTTP, config.ExpectRDP: // valid values
+		default:
+			logger.Warnf("invalid expect value '%s' for port %s, ignoring it", opts.Expect, port)
+			opts.Expect = ""
+		}
+		if len(opts.SNI) > 0 {
+			switch opts.Expect {
+			case "":
+				opts.Expect = config.ExpectTLS
+			case config.ExpectTLS:
+			default:
+				logger.Warnf("sni only applies to expect 'tls', ignoring it for port %s", port)
+				opts.SNI = nil
+			}
+		}
+		if opts.FirstByteTimeout < -1 {
+			logger.Warnf("invalid first_byte_timeout %d for port %s, using the one of the server", opts.FirstByteTimeout, port)
+			opts.FirstByteTimeout = 0
+		}
+		for i, name := range opts.SNI {
+			opts.SNI[i] = strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+		}
+		if opts.ErrorPage != "" && opts.Protocol != config.ProtoHTTP {
+			logger.Warnf("error_page is only supported on http ports, ignoring it for port %s", port)
+			opts.ErrorPage = ""
+		}
+		cfg.Server.PortOptions[port] = opts
+	}
+
+	// Transparent proxy, getting where a connection was headed takes netfilter
+	if cfg.Server.TransparentAddr != "" && runtime.GOOS != "linux" {
+		logger.Warnf("transparent_addr is only supported on Linux, ignoring it")
+		cfg.Server.TransparentAddr = ""
+	}
+
+	// Attack mode
+	switch cfg.Server.UnderAttack {
+	case config.AttackOff, config.AttackOn, config.AttackAuto: // valid values
+	case "":
+		cfg.Server.UnderAttack = config.AttackOff
+	default:
+		logger.Warnf("invalid under_attack value '%s', defaulting to '%s'", cfg.Server.UnderAttack, config.AttackOff)
+		cfg.Server.UnderAttack = config.AttackOff
+	}
+
+	// Anomaly detection
+	switch cfg.Server.Anomaly {
+	case config.AnomalyOff, config.AnomalyAlert, config.AnomalyLimit: // valid values
+	case "":
+		cfg.Server.Anomaly = config.AnomalyOff
+	default:
+		logger.Warnf("invalid anomaly value '%s', defaulting to '%s'", cfg.Server.Anomaly, config.AnomalyOff)
+		cfg.Server.Anomaly = config.AnomalyOff
+	}
+	if cfg.Server.AnomalyFactor != 0 && cfg.Server.AnomalyFactor <= 1 {
+		logger.Warnf("anomaly_factor must be over 1, defaulting to 5")
+		cfg.Server.AnomalyFactor = 0
+	}
+
+	// Top sources by traffic of public ports
+	if cfg.Server.TopSources < 0 {
+		logger.Warnf("invalid top_sources value '%d', defaulting to 0", cfg.Server.TopSources)
+		cfg.Server.TopSources = 0
+	}
+	if cfg.Server.TopSources > maxTopSources {
+		logger.Warnf("top_sources can't be over %d, using %d", maxTopSources, maxTopSources)
+		cfg.Server.TopSources = maxTopSources
+	}
+
+	// Tarpit of banned addresses
+	if cfg.Server.TarpitSlots < 0 {
+		logger.Warnf("invalid tarpit_slots value '%d', defaulting to 0", cfg.Server.TarpitSlots)
+		cfg.Server.TarpitSlots = 0
+	}
+	if cfg.Server.TarpitSlots > 0 && cfg.Server.AuthAttempts < 0 {
+		logger.Warnf("tarpit_slots has no effect with auth_attempts < 0, which bans no address")
+	}
+
+	// Kernel filter, the SYN rate only applies in it
+	if cfg.Server.SynRate < 0 {
+		logger.Warnf("invalid syn_rate value '%d', defaulting to 0", cfg.Server.SynRate)
+		cfg.Server.SynRate = 0
+	}
+	if cfg.Server.SynRate > 0 && !cfg.Server.KernelFilter {
+		logger.Warnf("syn_rate needs kernel_filter, ignoring it")
+		cfg.Server.SynRate = 0
+	}
+
+	// TUN mode, the packets go over target port 8
+	cfg.Server.TunMTU = tunMTU(cfg.Server.TunMTU, "server")
+	cfg.Client.TunMTU = tunMTU(cfg.Client.TunMTU, "client")
+
+	// DNS forwarding, the queries go over target port 9
+	if cfg.Server.DNSUpstream != "" && !cfg.Server.DNSForward {
+		logger.Warnf("dns_upstream needs dns_forward, ignoring it")
+		cfg.Server.DNSUpstream = ""
+	}
+
+	// Exit node, the connections go over target port 11
+	if len(cfg.Server.ExitAllowed) > 0 && !cfg.Server.ExitNode {
+		logger.Warnf("exit_allowed needs exit_node, ignoring it")
+	}
+	proxied := cfg.Client.SocksBind != "" || cfg.Client.HTTPProxyBind != ""
+	if (cfg.Client.ProxyUser != "" || len(cfg.Client.ProxyAllowedIPs) > 0) && !proxied {
+		logger.Warnf("proxy_user and proxy_allowed_ips need socks_bind or http_proxy_bind, ignoring them")
+	}
+	if cfg.Client.ProxyPass != "" && cfg.Client.ProxyUser == "" {
+		logger.Warnf("proxy_pass has no effect without proxy_user")
+	}
+	for _, bind := range []string{cfg.Client.SocksBind, cfg.Client.HTTPProxyBind} {
+		if bind == "" || cfg.Client.ProxyUser != "" || len(cfg.Client.ProxyAllowedIPs) > 0 {
+			continue
+		}
+		host, _, _ := net.SplitHostPort(bind)
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			logger.Warnf("proxy listener %s takes connections from the network without proxy_user or proxy_allowed_ips, anyone reaching it goes out through the server", bind)
+		}
+	}
+
+	// Streams per mux session
+	if cfg.Server.MuxMaxStreams < 0 {
+		logger.Warnf("invalid mux_max_streams %d, not limiting the streams", cfg.Server.MuxMaxStreams)
+		cfg.Server.MuxMaxStreams = 0
+	}
+	if cfg.Server.MuxMaxStreams > 0 && cfg.Server.Transport != config.TCPMUX {
+		logger.Warnf("mux_max_streams is only supported by tcpmux, ignoring it")
+		cfg.Server.MuxMaxStreams = 0
+	}
+
+	// Adaptive mux sessions, mux_session stays the minimum
+	if cfg.Server.MuxSessionMax > cfg.Server.MuxSession && cfg.Server.Transport != config.TCPMUX {
+		logger.Warnf("mux_session_max is only supported by tcpmux, ignoring it")
+		cfg.Server.MuxSessionMax = 0
+	}
+	if cfg.Server.MuxSessionMax > cfg.Server.MuxSession && cfg.Server.StickyRouting != config.StickyNone {
+		logger.Warnf("mux_session_max needs sticky_routing = \"none\", ignoring it")
+		cfg.Server.MuxSessionMax = 0
+	}
+	if cfg.Server.MuxSessionMax > math.MaxUint16 { // slots are sent as 16 bits
+		cfg.Server.MuxSessionMax = math.MaxUint16
+	}
+	if cfg.Server.MuxSessionMax < cfg.Server.MuxSession {
+		cfg.Server.MuxSessionMax = cfg.Server.MuxSession
+	}
+	if cfg.Server.MuxScaleStreams <= 0 {
+		cfg.Server.MuxScaleStreams = defaultScaleStreams
+	}
+	if cfg.Server.MuxScaleMbps <= 0 {
+		cfg.Server.MuxScaleMbps = defaultScaleMbps
+	}
+
+	// Paths, each needs a mux session of its own
+	if len(cfg.Client.Paths) > 0 && cfg.Client.Transport != config.TCPMUX {
+		logger.Warnf("paths are only supported by tcpmux, ignoring them")
+		cfg.Client.Paths = nil
+	}
+	if len(cfg.Client.Paths) > cfg.Client.MuxSession {
+		logger.Infof("mux_session %d is smaller than the %d paths, opening one session per path", cfg.Client.MuxSession, len(cfg.Client.Paths))
+		cfg.Client.MuxSession = len(cfg.Client.Paths)
+	}
+
+	// Dedicated mux sessions, at least one session must stay shared
+	dedicated := 0
+	for _, opts := range cfg.Server.PortOptions {
+		if opts.DedicatedSession {
+			dedicated++
+		}
+	}
+	if dedicated > 0 && (cfg.Server.Transport != config.TCPMUX || dedicated >= cfg.Server.MuxSession) {
+		if cfg.Server.Transport == config.TCPMUX {
+			logger.Warnf("mux_session %d is too small for %d dedicated sessions, ignoring dedicated_session", cfg.Server.MuxSession, dedicated)
+		} else {
+			logger.Warnf("dedicated_session is only supported by tcpmux, ignoring it")
+		}
+		for port, opts := range cfg.Server.PortOptions {
+			opts.DedicatedSession = false
+			cfg.Server.PortOptions[port] = opts
+		}
+	}
+
+}
+
+func keepaliveMode(mode, role string) string {
+	switch mode {
+	case config.KeepaliveTCP, config.KeepalivePing, config.KeepaliveBoth:
+		return mode
+	case "":
+		return config.KeepaliveBoth
+	default:
+		logger.Warnf("invalid keepalive_mode value '%s' for %s, defaulting to '%s'", mode, role, config.KeepaliveBoth)
+		return config.KeepaliveBoth
+	}
+}
+
+func keepaliveJitter(jitter int, role string) int {
+	if jitter < 0 || jitter > maxKeepaliveJitter {
+		logger.Warnf("keepalive_jitter %d for %s is not between 0 and %d, clamping it", jitter, role, maxKeepaliveJitter)
+		return min(max(jitter, 0), maxKeepaliveJitter)
+	}
+	return jitter
+}
+
+func tunMTU(mtu int, role string) int {
+	if mtu == 0 {
+		return tun.DefaultMTU
+	}
+	if mtu < minTunMTU || mtu > math.MaxUint16 {
+		logger.Warnf("tun_mtu %d for %s is not between %d and %d, defaulting to %d", mtu, role, minTunMTU, math.MaxUint16, tun.DefaultMTU)
+		return tun.DefaultMTU
+	}
+	return mtu
 }
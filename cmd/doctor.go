@@ -0,0 +1,26 @@
+package cmd
+
+import (
+	"flag"
+	"os"
+
+	"github.com/sahmadiut/backhaul/internal/doctor"
+)
+
+// Doctor checks a configuration against the network and prints a report.
+// It exits with status 1 when a check fails.
+func Doctor(args []string) {
+	flags := flag.NewFlagSet("doctor", flag.ExitOnError)
+	configPath := flags.String("c", "", "path to the configuration file (TOML, YAML or JSON)")
+	profile := flags.String("p", "", "named profile of the configuration file")
+	flags.Parse(args)
+
+	if *configPath == "" {
+		logger.Fatalf("Usage: %s doctor -c /path/to/config.toml", os.Args[0])
+	}
+
+	cfg := prepare(*configPath, *profile, nil)
+	if report := doctor.Run(&cfg, os.Stdout); report.Failed() {
+		os.Exit(1)
+	}
+}
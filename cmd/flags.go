@@ -0,0 +1,106 @@
+package cmd
+
+import (
+	"flag"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+)
+
+// Roles picked on the command line.
+const (
+	roleServer = "server"
+	roleClient = "client"
+)
+
+// Overrides holds the config values given on the command line. They take
+// precedence over the config file.
+type Overrides struct {
+	role       string // empty when the role comes from the config file
+	BindAddr   string
+	RemoteAddr string
+	Token      string
+	Transport  string
+	Ports      string
+	Chaos      string
+}
+
+// RegisterFlags adds the override flags to a flag set. role limits them to
+// the flags that make sense for a server or client, empty registers all.
+func RegisterFlags(flags *flag.FlagSet, role string) *Overrides {
+	ov := &Overrides{role: role}
+
+	if role != roleClient {
+		flags.StringVar(&ov.BindAddr, "bind-addr", "", "address and port for the server to listen on")
+		flags.StringVar(&ov.Ports, "ports", "", "comma separated port mappings, e.g. \"443=5201,8080\"")
+		flags.StringVar(&ov.Chaos, "chaos", "", "break the tunnel on purpose to test recovery, e.g. \"drop=0.5,delay=200ms,corrupt=0.1\", never in production")
+	}
+	if role != roleServer {
+		flags.StringVar(&ov.RemoteAddr, "remote", "", "address and port of the server to connect to")
+	}
+	flags.StringVar(&ov.Token, "token", "", "authentication token")
+	flags.StringVar(&ov.Transport, "transport", "", "transport protocol (tcp, tcpmux, ws or wss)")
+
+	return ov
+}
+
+// apply writes the overrides into the config, to the section of the given
+// role or, without one, to the section the config file sets up.
+func (ov *Overrides) apply(cfg *config.Config) {
+	if ov == nil {
+		return
+	}
+
+	if ov.BindAddr != "" {
+		cfg.Server.BindAddr = ov.BindAddr
+	}
+	if ov.RemoteAddr != "" {
+		cfg.Client.RemoteAddr = ov.RemoteAddr
+	}
+
+	switch ov.role {
+	case roleServer:
+		cfg.Client = config.ClientConfig{}
+	case roleClient:
+		cfg.Server = config.ServerConfig{}
+	}
+
+	if cfg.Server.BindAddr != "" {
+		if ov.Token != "" {
+			cfg.Server.Token = ov.Token
+		}
+		if ov.Transport != "" {
+			cfg.Server.Transport = config.TransportType(ov.Transport)
+		}
+		if ov.Ports != "" {
+			cfg.Server.Ports = splitList(ov.Ports)
+			cfg.Server.Forward = nil // replaced along with the ports
+		}
+		cfg.Server.Chaos = ov.Chaos
+		return
+	}
+
+	if ov.Token != "" {
+		cfg.Client.Token = ov.Token
+	}
+	if ov.Transport != "" {
+		cfg.Client.Transport = config.TransportType(ov.Transport)
+	}
+	if ov.Ports != "" {
+		logger.Warnf("--ports only applies to the server, ignoring it")
+	}
+	if ov.Chaos != "" {
+		logger.Warnf("--chaos only applies to the server, ignoring it")
+	}
+}
+
+// splitList splits a comma separated flag value, dropping empty entries.
+func splitList(value string) []string {
+	var list []string
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			list = append(list, item)
+		}
+	}
+	return list
+}
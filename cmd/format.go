@@ -0,0 +1,157 @@
+package cmd
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// yamlToTOML converts a YAML document to TOML and maps every key to the line
+// it is defined on.
+func yamlToTOML(data []byte) (string, map[string]int, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return "", nil, err
+	}
+
+	doc := make(map[string]any)
+	lines := make(map[string]int)
+	if len(root.Content) > 0 {
+		if err := root.Content[0].Decode(&doc); err != nil {
+			return "", nil, err
+		}
+		yamlKeyLines(root.Content[0], "", lines)
+	}
+
+	out, err := encodeTOML(doc)
+	return out, lines, err
+}
+
+func yamlKeyLines(node *yaml.Node, prefix string, lines map[string]int) {
+	if node.Kind != yaml.MappingNode {
+		return
+	}
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		name := prefix + node.Content[i].Value
+		lines[name] = node.Content[i].Line
+		yamlKeyLines(node.Content[i+1], name+".", lines)
+	}
+}
+
+// jsonToTOML converts a JSON document to TOML and maps every key to the line
+// it is defined on.
+func jsonToTOML(data []byte) (string, map[string]int, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	doc := make(map[string]any)
+	if err := dec.Decode(&doc); err != nil {
+		var serr *json.SyntaxError
+		if errors.As(err, &serr) {
+			return "", nil, fmt.Errorf("line %d: %v", lineAt(data, serr.Offset), err)
+		}
+		return "", nil, err
+	}
+
+	lines := make(map[string]int)
+	jsonKeyLines(json.NewDecoder(bytes.NewReader(data)), data, "", lines)
+
+	out, err := encodeTOML(doc)
+	return out, lines, err
+}
+
+func jsonKeyLines(dec *json.Decoder, data []byte, prefix string, lines map[string]int) error {
+	tok, err := dec.Token()
+	if err != nil {
+		return err
+	}
+
+	switch tok {
+	case json.Delim('{'):
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return err
+			}
+			name := prefix + fmt.Sprint(key)
+			lines[name] = lineAt(data, dec.InputOffset())
+			if err := jsonKeyLines(dec, data, name+".", lines); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+
+	case json.Delim('['):
+		// keys inside arrays are not part of the schema
+		for dec.More() {
+			if err := jsonKeyLines(dec, data, prefix+"[].", lines); err != nil {
+				return err
+			}
+		}
+		_, err = dec.Token()
+	}
+	return err
+}
+
+func lineAt(data []byte, offset int64) int {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	return bytes.Count(data[:offset], []byte("\n")) + 1
+}
+
+// encodeTOML writes a decoded YAML or JSON document as TOML.
+func encodeTOML(doc map[string]any) (string, error) {
+	var buf bytes.Buffer
+	if err := toml.NewEncoder(&buf).Encode(normalize(doc)); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// normalize turns the values YAML and JSON decode into something the TOML
+// encoder accepts: string map keys, plain numbers and no nulls.
+func normalize(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			if value != nil {
+				out[key] = normalize(value)
+			}
+		}
+		return out
+
+	case map[any]any:
+		out := make(map[string]any, len(v))
+		for key, value := range v {
+			if value != nil {
+				out[fmt.Sprint(key)] = normalize(value)
+			}
+		}
+		return out
+
+	case []any:
+		out := make([]any, 0, len(v))
+		for _, value := range v {
+			if value != nil {
+				out = append(out, normalize(value))
+			}
+		}
+		return out
+
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n
+		}
+		f, _ := v.Float64()
+		return f
+
+	default:
+		return v
+	}
+}
@@ -0,0 +1,76 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"net/url"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+)
+
+// Forwarder lists or changes the forwarder entries of a running client:
+//
+//	backhaul forwarder -c client.toml                   list them
+//	backhaul forwarder -c client.toml 8080=10.0.0.5:80  point 8080 to a new target
+//	backhaul forwarder -c client.toml -delete 8080      remove the entry of 8080
+//
+// The list has a row for each target, with its weight, health and the
+// connections it relays.
+//
+// With -drain, connections still relayed to the old target are closed once
+// the duration has passed.
+func Forwarder(args []string) {
+	flags := flag.NewFlagSet("forwarder", flag.ExitOnError)
+	configPath := flags.String("c", "", "configuration file of the client, to find its control_socket")
+	socket := flags.String("s", "", "path of the control socket, instead of -c")
+	profile := flags.String("p", "", "named profile of the configuration file")
+	remove := flags.Int("delete", 0, "remove the entry of this port")
+	persist := flags.Bool("persist", false, "also write the change to the config file of the client")
+	drain := flags.String("drain", "", "close connections to the old target after this long, e.g. 30s (default: let them end)")
+	flags.Parse(args)
+
+	path := controlSocket("forwarder", *configPath, *profile, *socket)
+
+	query := url.Values{}
+	if *persist {
+		query.Set("persist", "true")
+	}
+	if *drain != "" {
+		query.Set("drain", *drain)
+	}
+
+	var forwards []control.Forward
+	var err error
+	switch {
+	case *remove > 0:
+		err = control.Delete(path, fmt.Sprintf("/forwarder/%d?%s", *remove, query.Encode()), &forwards)
+	case flags.NArg() == 1:
+		port, target, ok := strings.Cut(flags.Arg(0), "=")
+		if !ok {
+			logger.Fatalf("Usage: %s forwarder -c /path/to/config.toml [-persist] PORT=TARGET", os.Args[0])
+		}
+		query.Set("target", strings.TrimSpace(target))
+		err = control.Put(path, fmt.Sprintf("/forwarder/%s?%s", strings.TrimSpace(port), query.Encode()), &forwards)
+	default:
+		err = control.Get(path, "/forwarder", &forwards)
+	}
+	if err != nil {
+		logger.Fatalf("forwarder request to %s failed: %v", path, err)
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+	fmt.Fprintln(w, "PORT\tTARGET\tWEIGHT\tSTATE\tCONNECTIONS\tDRAINING")
+	for _, f := range forwards {
+		for _, b := range f.Backends {
+			state := b.State
+			if b.Error != "" {
+				state += " (" + b.Error + ")"
+			}
+			fmt.Fprintf(w, "%d\t%s\t%d\t%s\t%d\t%d\n", f.Port, b.Target, b.Weight, state, b.Connections, f.Draining)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package cmd
+
+import (
+	"fmt"
+	"path/filepath"
+	"reflect"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/BurntSushi/toml"
+)
+
+// mergeIncludes merges the files matched by the include globs into cfg, in
+// the order of the globs and by name within each. Lists such as ports are
+// appended to and tables such as port_options merged, but a setting or table
+// entry set in two files is an error, and so is a port in the ports or the
+// forwarder of two files.
+func mergeIncludes(cfg *config.Config, md toml.MetaData, configPath string) error {
+	origin := make(map[string]string) // file each setting comes from
+	for _, key := range md.Keys() {
+		origin[key.String()] = configPath
+	}
+	owners := make(map[string]string) // file each port comes from
+	if err := claimPorts(cfg, configPath, owners); err != nil {
+		return err
+	}
+
+	seen := map[string]bool{filepath.Clean(configPath): true}
+	for _, pattern := range cfg.Include {
+		if !filepath.IsAbs(pattern) {
+			pattern = filepath.Join(filepath.Dir(configPath), pattern)
+		}
+		files, err := filepath.Glob(pattern) // sorted, and none is fine
+		if err != nil {
+			return fmt.Errorf("%s: include %q: %v", configPath, pattern, err)
+		}
+
+		for _, file := range files {
+			if seen[file] {
+				continue
+			}
+			seen[file] = true
+
+			inc, incMD, unknown, err := loadFile(file, "")
+			if err != nil {
+				return err
+			}
+			if incMD.IsDefined("profiles") {
+				return fmt.Errorf("%s: profiles can only be set in %s", file, configPath)
+			}
+			if err := checkUnknown(file, unknown, cfg.StrictConfig); err != nil {
+				return err
+			}
+			if len(inc.Include) > 0 {
+				return fmt.Errorf("%s: included files can't include others", file)
+			}
+			if err := claimPorts(&inc, file, owners); err != nil {
+				return err
+			}
+			if err := mergeTable(reflect.ValueOf(cfg).Elem(), reflect.ValueOf(&inc).Elem(), incMD, nil, file, origin); err != nil {
+				return err
+			}
+			if len(inc.Client.Forwarder) > 0 {
+				cfg.Client.NoPersist = "some forwarder entries come from included files"
+			}
+		}
+	}
+	return nil
+}
+
+// mergeTable merges the settings of the table at key that an included file
+// set into dst.
+func mergeTable(dst, src reflect.Value, md toml.MetaData, key toml.Key, file string, origin map[string]string) error {
+	for i := 0; i < dst.NumField(); i++ {
+		name, _, _ := strings.Cut(dst.Type().Field(i).Tag.Get("toml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		fieldKey := append(slices.Clone(key), name)
+		if !md.IsDefined(fieldKey...) {
+			continue
+		}
+
+		d, s := dst.Field(i), src.Field(i)
+		switch d.Kind() {
+		case reflect.Struct:
+			if err := mergeTable(d, s, md, fieldKey, file, origin); err != nil {
+				return err
+			}
+
+		case reflect.Slice:
+			d.Set(reflect.AppendSlice(d, s))
+
+		case reflect.Map:
+			if d.IsNil() {
+				d.Set(reflect.MakeMap(d.Type()))
+			}
+			entries := s.MapRange()
+			for entries.Next() {
+				entryKey := append(slices.Clone(fieldKey), fmt.Sprint(entries.Key())).String()
+				if prev, ok := origin[entryKey]; ok {
+					return fmt.Errorf("%s: %s is set in %s already", file, entryKey, prev)
+				}
+				origin[entryKey] = file
+				d.SetMapIndex(entries.Key(), entries.Value())
+			}
+
+		default:
+			if prev, ok := origin[fieldKey.String()]; ok {
+				return fmt.Errorf("%s: %s is set in %s already", file, fieldKey, prev)
+			}
+			origin[fieldKey.String()] = file
+			d.Set(s)
+		}
+	}
+	return nil
+}
+
+// claimPorts records the public ports of the server and the forwarder ports
+// of the client that file lists, and fails on one another file listed.
+// Entries that don't parse are left to the server and client to report.
+func claimPorts(cfg *config.Config, file string, owners map[string]string) error {
+	claim := func(what string, port int) error {
+		key := what + " " + strconv.Itoa(port)
+		if prev, ok := owners[key]; ok && prev != file {
+			return fmt.Errorf("%s: port %d is in the %s of %s already", file, port, what, prev)
+		}
+		owners[key] = file
+		return nil
+	}
+
+	for _, entry := range cfg.Server.Ports {
+		mappings, _ := utils.ParsePortMapping(entry)
+		for _, mapping := range mappings {
+			if err := claim("ports", mapping.LocalPort); err != nil {
+				return err
+			}
+		}
+	}
+	for _, forward := range cfg.Server.Forward {
+		mappings, _ := utils.ParseForward(forward)
+		for _, mapping := range mappings {
+			if err := claim("ports", mapping.LocalPort); err != nil {
+				return err
+			}
+		}
+	}
+	for _, entry := range cfg.Client.Forwarder {
+		local, _, _ := strings.Cut(entry, "=")
+		if port, err := strconv.Atoi(strings.TrimSpace(local)); err == nil {
+			if err := claim("forwarder", port); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
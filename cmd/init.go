@@ -0,0 +1,215 @@
+package cmd
+
+import (
+	"bufio"
+	"crypto/tls"
+	"flag"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// Init asks a few questions and writes a working config file, so users do
+// not have to start from a copied one.
+func Init(args []string) {
+	flags := flag.NewFlagSet("init", flag.ExitOnError)
+	output := flags.String("o", "config.toml", "path of the configuration file to write")
+	flags.Parse(args)
+
+	p := &prompter{in: bufio.NewReader(os.Stdin), out: os.Stdout}
+
+	if _, err := os.Stat(*output); err == nil {
+		if !p.confirm(fmt.Sprintf("%s already exists, overwrite it?", *output), false) {
+			return
+		}
+	}
+
+	doc, err := p.interview(filepath.Dir(*output))
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+
+	if err := os.WriteFile(*output, []byte(doc), 0600); err != nil {
+		logger.Fatalf("failed to write %s: %v", *output, err)
+	}
+
+	// read it back the way a normal start would
+	if _, err := loadConfig(*output, ""); err != nil {
+		logger.Fatalf("generated config is invalid: %v", err)
+	}
+
+	fmt.Fprintf(p.out, "\nwrote %s, start it with:\n\n  %s -c %s\n", *output, os.Args[0], *output)
+}
+
+// prompter reads answers from the terminal.
+type prompter struct {
+	in  *bufio.Reader
+	out io.Writer
+}
+
+// ask prints a question and returns the answer, or def for an empty one.
+// check, when set, is repeated until the answer passes.
+func (p *prompter) ask(question, def string, check func(string) error) string {
+	for {
+		if def != "" {
+			fmt.Fprintf(p.out, "%s [%s]: ", question, def)
+		} else {
+			fmt.Fprintf(p.out, "%s: ", question)
+		}
+
+		line, err := p.in.ReadString('\n')
+		if err != nil && line == "" {
+			logger.Fatalf("no answer for %q", question)
+		}
+		answer := strings.TrimSpace(line)
+		if answer == "" {
+			answer = def
+		}
+
+		if check == nil {
+			return answer
+		}
+		if err := check(answer); err != nil {
+			fmt.Fprintf(p.out, "  %v\n", err)
+			continue
+		}
+		return answer
+	}
+}
+
+func (p *prompter) choose(question string, choices []string) string {
+	return p.ask(fmt.Sprintf("%s (%s)", question, strings.Join(choices, "/")), choices[0], func(answer string) error {
+		for _, choice := range choices {
+			if answer == choice {
+				return nil
+			}
+		}
+		return fmt.Errorf("pick one of %s", strings.Join(choices, ", "))
+	})
+}
+
+func (p *prompter) confirm(question string, def bool) bool {
+	choices := []string{"n", "y"}
+	if def {
+		choices = []string{"y", "n"}
+	}
+	return p.choose(question, choices) == "y"
+}
+
+// interview asks for the settings and returns the config file contents.
+// Generated certificates are stored in dir.
+func (p *prompter) interview(dir string) (string, error) {
+	var b strings.Builder
+	b.WriteString("strict_config = true\n\n")
+
+	role := p.choose("role of this machine", []string{roleServer, roleClient})
+	transport := p.choose("transport", []string{string(config.TCP), string(config.TCPMUX), string(config.WS), string(config.WSS)})
+
+	if role == roleServer {
+		bindAddr := p.ask("address to listen on for the tunnel", "0.0.0.0:3080", checkHostPort)
+		token := p.ask("token, the client needs the same one", randomToken(), checkNotEmpty)
+		ports := p.ask("ports to forward, comma separated (e.g. 443=5201,8080,[2000:2010])", "", checkPorts)
+
+		b.WriteString("[server]\n")
+		fmt.Fprintf(&b, "bind_addr = %q\n", bindAddr)
+		fmt.Fprintf(&b, "transport = %q\n", transport)
+		fmt.Fprintf(&b, "token = %q\n", token)
+
+		if transport == string(config.WSS) {
+			cert, key, err := p.tls(dir)
+			if err != nil {
+				return "", err
+			}
+			fmt.Fprintf(&b, "tls_cert = %q\n", cert)
+			fmt.Fprintf(&b, "tls_key = %q\n", key)
+		}
+
+		b.WriteString("ports = [\n")
+		for _, port := range splitList(ports) {
+			fmt.Fprintf(&b, "    %q,\n", port)
+		}
+		b.WriteString("]\n")
+		return b.String(), nil
+	}
+
+	remoteAddr := p.ask("address of the server", "", checkHostPort)
+	token := p.ask("token, as set on the server", "", checkNotEmpty)
+
+	b.WriteString("[client]\n")
+	fmt.Fprintf(&b, "remote_addr = %q\n", remoteAddr)
+	fmt.Fprintf(&b, "transport = %q\n", transport)
+	fmt.Fprintf(&b, "token = %q\n", token)
+	return b.String(), nil
+}
+
+// tls asks for the certificate of a wss server, generating a self-signed one
+// on request.
+func (p *prompter) tls(dir string) (string, string, error) {
+	mode := p.choose("TLS certificate", []string{"self-signed", "files"})
+
+	if mode == "files" {
+		cert := p.ask("path of the certificate (PEM)", "", checkNotEmpty)
+		key := p.ask("path of the private key (PEM)", "", checkNotEmpty)
+		if _, err := tls.LoadX509KeyPair(cert, key); err != nil {
+			return "", "", fmt.Errorf("failed to load the certificate: %v", err)
+		}
+		return cert, key, nil
+	}
+
+	host := p.ask("host name or IP for the certificate", "localhost", checkNotEmpty)
+	cert, key := filepath.Join(dir, "server.crt"), filepath.Join(dir, "server.key")
+	if err := selfSigned(host, cert, key); err != nil {
+		return "", "", fmt.Errorf("failed to generate a certificate: %v", err)
+	}
+	fmt.Fprintf(p.out, "  wrote %s and %s\n", cert, key)
+
+	// store absolute paths, the service may run from another directory
+	if abs, err := filepath.Abs(cert); err == nil {
+		cert = abs
+	}
+	if abs, err := filepath.Abs(key); err == nil {
+		key = abs
+	}
+	return cert, key, nil
+}
+
+// selfSigned writes a self-signed certificate for host, valid for 10 years.
+func selfSigned(host, certFile, keyFile string) error {
+	certPEM, keyPEM, err := utils.SelfSigned(host)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(certFile, certPEM, 0644); err != nil {
+		return err
+	}
+	return os.WriteFile(keyFile, keyPEM, 0600)
+}
+
+func checkNotEmpty(answer string) error {
+	if answer == "" {
+		return fmt.Errorf("an answer is required")
+	}
+	return nil
+}
+
+func checkHostPort(answer string) error {
+	if _, _, err := net.SplitHostPort(answer); err != nil {
+		return fmt.Errorf("expected host:port, %v", err)
+	}
+	return nil
+}
+
+func checkPorts(answer string) error {
+	ports := splitList(answer)
+	if len(ports) == 0 {
+		return fmt.Errorf("at least one port is required")
+	}
+	_, err := utils.ParsePortMappings(ports)
+	return err
+}
@@ -0,0 +1,118 @@
+package cmd
+
+import (
+	"context"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/client"
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/server"
+)
+
+// instanceNames returns the profiles to run: the ones listed with -p, or all
+// of them when the file sets up no server or client outside of profiles.
+func instanceNames(configPath, profile string) []string {
+	if names := splitList(profile); len(names) > 0 || configPath == "" {
+		return names
+	}
+
+	cfg, md, _, err := loadFile(configPath, "")
+	if err != nil || cfg.Server.BindAddr != "" || cfg.Client.RemoteAddr != "" {
+		return nil // reported when it is loaded for real
+	}
+	return profileList(md)
+}
+
+// serveAll runs the tunnels of several profiles in this process until a
+// shutdown signal arrives. Each has its own transport and restarts on its
+// own, they share the log, the metrics and the web dashboard.
+func serveAll(configPath string, names []string, ov *Overrides) {
+	cfgs := make([]config.Config, len(names))
+	for i, name := range names {
+		cfgs[i] = prepare(configPath, name, ov)
+	}
+	serveConfigs(cfgs, names)
+}
+
+// serveConfigs runs a tunnel for each of cfgs, named by names, until a
+// shutdown signal arrives.
+func serveConfigs(cfgs []config.Config, names []string) {
+	for i, name := range names {
+		cfgs[i].Server.Instance = name
+		cfgs[i].Client.Instance = name
+	}
+	shareResources(cfgs, names)
+
+	useActivationListeners()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	sigChan := make(chan os.Signal, 1)
+	signal.Notify(sigChan, os.Interrupt, syscall.SIGTERM)
+
+	var stops []func()
+	for i := range cfgs {
+		cfg := &cfgs[i]
+		switch {
+		case cfg.Server.BindAddr != "":
+			srv := server.NewServer(&cfg.Server, ctx)
+			go srv.Start()
+			stops = append(stops, srv.Stop)
+		case cfg.Client.RemoteAddr != "":
+			clnt := client.NewClient(&cfg.Client, ctx)
+			go clnt.Start()
+			stops = append(stops, clnt.Stop)
+		default:
+			logger.Fatalf("%s sets up neither a server nor a client", names[i])
+		}
+	}
+	logger.Infof("running %d tunnels: %s", len(names), strings.Join(names, ", "))
+
+	<-sigChan
+	for _, stop := range stops {
+		stop()
+	}
+	time.Sleep(1 * time.Second)
+	logger.Println("shutting down...")
+}
+
+// shareResources checks that the tunnels don't take the same control socket
+// or upgrade socket, and serves a web dashboard port only once, the metrics
+// behind it cover all tunnels anyway.
+func shareResources(cfgs []config.Config, names []string) {
+	sockets := make(map[string]string)
+	webPorts := make(map[int]string)
+	for i := range cfgs {
+		server, client := &cfgs[i].Server, &cfgs[i].Client
+		if server.UpgradeSocket != "" {
+			logger.Fatalf("profile %s: upgrade_socket needs a single tunnel per process", names[i])
+		}
+		if client.UpdateURL != "" {
+			logger.Fatalf("profile %s: update_url needs a single tunnel per process", names[i])
+		}
+
+		socket, webPort := client.ControlSocket, &client.WebPort
+		if server.BindAddr != "" {
+			socket, webPort = server.ControlSocket, &server.WebPort
+		}
+		if socket != "" {
+			if prev, ok := sockets[socket]; ok {
+				logger.Fatalf("profiles %s and %s use the same control_socket %s", prev, names[i], socket)
+			}
+			sockets[socket] = names[i]
+		}
+		if *webPort > 0 {
+			if prev, ok := webPorts[*webPort]; ok {
+				logger.Infof("profile %s shares the web dashboard of %s on port %d", names[i], prev, *webPort)
+				*webPort = 0
+				continue
+			}
+			webPorts[*webPort] = names[i]
+		}
+	}
+}
@@ -0,0 +1,81 @@
+package cmd
+
+import (
+	"fmt"
+	"reflect"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+
+	"github.com/BurntSushi/toml"
+)
+
+// applyNamedProfile replaces the server and client settings of cfg with the
+// ones profile sets in the profiles table, and drops the other profiles.
+func applyNamedProfile(cfg *config.Config, md toml.MetaData, profile, configPath string) error {
+	profiles := cfg.Profiles
+	cfg.Profiles = nil
+	if profile == "" {
+		return nil
+	}
+
+	named, ok := profiles[profile]
+	if !ok {
+		return fmt.Errorf("%s: no profile %q, %s", configPath, profile, profileNames(md))
+	}
+	key := toml.Key{"profiles", profile}
+	overlayTable(reflect.ValueOf(&cfg.Server).Elem(), reflect.ValueOf(&named.Server).Elem(), md, append(slices.Clone(key), "server"))
+	overlayTable(reflect.ValueOf(&cfg.Client).Elem(), reflect.ValueOf(&named.Client).Elem(), md, append(slices.Clone(key), "client"))
+	cfg.Client.NoPersist = fmt.Sprintf("the client runs profile %s", profile)
+	return nil
+}
+
+// overlayTable sets the settings of the table at key that md defines in dst.
+// Lists are replaced, and tables such as port_options merged entry by entry.
+func overlayTable(dst, src reflect.Value, md toml.MetaData, key toml.Key) {
+	for i := 0; i < dst.NumField(); i++ {
+		name, _, _ := strings.Cut(dst.Type().Field(i).Tag.Get("toml"), ",")
+		if name == "" || name == "-" {
+			continue
+		}
+		if !md.IsDefined(append(slices.Clone(key), name)...) {
+			continue
+		}
+
+		d, s := dst.Field(i), src.Field(i)
+		if d.Kind() != reflect.Map {
+			d.Set(s)
+			continue
+		}
+		if d.IsNil() {
+			d.Set(reflect.MakeMap(d.Type()))
+		}
+		entries := s.MapRange()
+		for entries.Next() {
+			d.SetMapIndex(entries.Key(), entries.Value())
+		}
+	}
+}
+
+// profileList returns the names of the profiles a file defines, in order.
+func profileList(md toml.MetaData) []string {
+	var names []string
+	for _, key := range md.Keys() {
+		if len(key) >= 2 && key[0] == "profiles" && !slices.Contains(names, key[1]) {
+			names = append(names, key[1])
+		}
+	}
+	return names
+}
+
+// profileNames lists the profiles a file defines, for errors.
+func profileNames(md toml.MetaData) string {
+	names := profileList(md)
+	if len(names) == 0 {
+		return "the file has no profiles"
+	}
+	sort.Strings(names)
+	return "pick one of " + strings.Join(names, ", ")
+}
@@ -0,0 +1,37 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sahmadiut/backhaul/internal/noise"
+)
+
+// NoiseKey prints a new key pair for noise_private_key, or the public key of
+// an existing private key, like "wg genkey" and "wg pubkey".
+func NoiseKey(args []string) {
+	flags := flag.NewFlagSet("noise-key", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n  %s noise-key\n  %s noise-key -pub <private key>\n\n", os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+	private := flags.String("pub", "", "print the public key of this private key")
+	flags.Parse(args)
+
+	if *private != "" {
+		public, err := noise.PublicKey(*private)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		fmt.Println(public)
+		return
+	}
+
+	newPrivate, public, err := noise.GenerateKey()
+	if err != nil {
+		logger.Fatalf("failed to generate a key: %v", err)
+	}
+	fmt.Printf("noise_private_key = %q\n", newPrivate)
+	fmt.Printf("# public key, for noise_peers on the server or noise_server_key on the client:\n# %s\n", public)
+}
@@ -0,0 +1,124 @@
+package cmd
+
+import (
+	"github.com/sahmadiut/backhaul/internal/config"
+)
+
+// Performance profiles, picked with `profile`.
+const (
+	profileLatency    = "latency"
+	profileThroughput = "throughput"
+	profileBalanced   = "balanced"
+)
+
+// profile is a coherent set of tuning knobs. They only fill in the settings
+// the config leaves unset, so single knobs can still be overridden. Their
+// keepalive and ping intervals stay well below the 60 seconds after which
+// consumer routers may forget an idle connection.
+type profile struct {
+	muxVersion     int
+	frameSize      int
+	receiveBuffer  int
+	streamBuffer   int
+	keepalive      int // seconds
+	pingInterval   int // seconds
+	jitter         int // percent
+	nodelay        bool
+	channelSize    int // server only
+	connectionPool int // server only
+	heartbeat      int // seconds, server only
+}
+
+var profiles = map[string]profile{
+	// small frames and buffers so no stream waits behind a bulk transfer,
+	// more pooled connections and quick detection of a dead tunnel
+	profileLatency: {
+		muxVersion:     2,
+		frameSize:      16384,   // 16KB
+		receiveBuffer:  2097152, // 2MB
+		streamBuffer:   65536,   // 64KB
+		keepalive:      10,
+		pingInterval:   10,
+		jitter:         10,
+		nodelay:        true,
+		channelSize:    2048,
+		connectionPool: 16,
+		heartbeat:      10,
+	},
+	// large windows so a single stream can fill a long fat pipe
+	profileThroughput: {
+		muxVersion:     2,
+		frameSize:      65535,    // 64KB, the smux maximum
+		receiveBuffer:  16777216, // 16MB
+		streamBuffer:   4194304,  // 4MB
+		keepalive:      40,
+		pingInterval:   30,
+		jitter:         20,
+		channelSize:    4096,
+		connectionPool: 8,
+		heartbeat:      40,
+	},
+	profileBalanced: {
+		muxVersion:     2,
+		frameSize:      32768,   // 32KB
+		receiveBuffer:  4194304, // 4MB
+		streamBuffer:   1048576, // 1MB
+		keepalive:      20,
+		pingInterval:   15,
+		jitter:         20,
+		nodelay:        true,
+		channelSize:    2048,
+		connectionPool: 8,
+		heartbeat:      20,
+	},
+}
+
+// applyProfile fills in the settings of the profiles picked by the server and
+// the client, before the defaults are applied.
+func applyProfile(cfg *config.Config) {
+	if p, ok := lookupProfile(cfg.Server.Profile, "server"); ok {
+		s := &cfg.Server
+		setDefault(&s.MuxVersion, p.muxVersion)
+		setDefault(&s.MaxFrameSize, p.frameSize)
+		setDefault(&s.MaxReceiveBuffer, p.receiveBuffer)
+		setDefault(&s.MaxStreamBuffer, p.streamBuffer)
+		s.MaxStreamBuffer = min(s.MaxStreamBuffer, s.MaxReceiveBuffer) // smux rejects larger ones
+		setDefault(&s.Keepalive, p.keepalive)
+		setDefault(&s.PingInterval, p.pingInterval)
+		setDefault(&s.KeepaliveJitter, p.jitter)
+		setDefault(&s.ChannelSize, p.channelSize)
+		setDefault(&s.ConnectionPool, p.connectionPool)
+		setDefault(&s.Heartbeat, p.heartbeat)
+		s.Nodelay = s.Nodelay || p.nodelay
+	}
+
+	if p, ok := lookupProfile(cfg.Client.Profile, "client"); ok {
+		c := &cfg.Client
+		setDefault(&c.MuxVersion, p.muxVersion)
+		setDefault(&c.MaxFrameSize, p.frameSize)
+		setDefault(&c.MaxReceiveBuffer, p.receiveBuffer)
+		setDefault(&c.MaxStreamBuffer, p.streamBuffer)
+		c.MaxStreamBuffer = min(c.MaxStreamBuffer, c.MaxReceiveBuffer) // smux rejects larger ones
+		setDefault(&c.Keepalive, p.keepalive)
+		setDefault(&c.PingInterval, p.pingInterval)
+		setDefault(&c.KeepaliveJitter, p.jitter)
+		c.Nodelay = c.Nodelay || p.nodelay
+	}
+}
+
+func lookupProfile(name, role string) (profile, bool) {
+	if name == "" {
+		return profile{}, false
+	}
+	p, ok := profiles[name]
+	if !ok {
+		logger.Warnf("invalid profile value '%s' for %s, ignoring it", name, role)
+	}
+	return p, ok
+}
+
+func setDefault(v *int, value int) {
+	if *v <= 0 {
+		*v = value
+	}
+}
@@ -0,0 +1,70 @@
+package cmd
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/protocol"
+)
+
+// Protocol prints the wire protocol of this build, as Markdown or JSON.
+func Protocol(args []string) {
+	flags := flag.NewFlagSet("protocol", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the definition as JSON instead of Markdown")
+	flags.Parse(args)
+
+	definition := protocol.Define()
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		if err := encoder.Encode(definition); err != nil {
+			logger.Fatalf("%v", err)
+		}
+		return
+	}
+	if err := protocol.WriteMarkdown(os.Stdout, definition); err != nil {
+		logger.Fatalf("%v", err)
+	}
+}
+
+// Conformance checks a server against the wire protocol as a client would
+// and prints a report. It exits with status 1 when a check fails.
+func Conformance(args []string) {
+	flags := flag.NewFlagSet("conformance", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n  %s conformance -transport tcp -addr server:3080 -token secret [-public server:443]\n\n", os.Args[0])
+		flags.PrintDefaults()
+	}
+	var t protocol.Target
+	flags.StringVar(&t.Transport, "transport", "tcp", "transport of the server: tcp, tcpmux, ws or wss")
+	flags.StringVar(&t.Addr, "addr", "", "bind_addr of the server, host:port")
+	flags.StringVar(&t.Token, "token", "", "token of the server")
+	flags.StringVar(&t.Public, "public", "", "a port the server forwards, host:port, to check a connection through the tunnel")
+	flags.IntVar(&t.MuxVersion, "mux-version", 1, "mux_version of a tcpmux server")
+	flags.IntVar(&t.Sessions, "sessions", 1, "mux_session of a tcpmux server")
+	flags.DurationVar(&t.Heartbeat, "wait", 45*time.Second, "how long to wait for a heartbeat, more than the heartbeat of the server")
+	asJSON := flags.Bool("json", false, "print the results as JSON")
+	flags.Parse(args)
+
+	if t.Addr == "" || t.Token == "" {
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	out := os.Stdout
+	if *asJSON {
+		out = nil
+	}
+	report := protocol.Check(t, out)
+	if *asJSON {
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		encoder.Encode(report)
+	}
+	if report.Failed() {
+		os.Exit(1)
+	}
+}
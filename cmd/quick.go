@@ -0,0 +1,65 @@
+package cmd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/BurntSushi/toml"
+)
+
+// Quick runs a throwaway server or client configured only by flags, like
+// "ssh -R". It prints the generated config so it can be saved for later.
+func Quick(args []string) {
+	flags := flag.NewFlagSet("quick", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n  %s quick --bind-addr :3080 --ports 443=5201\n  %s quick --remote x.x.x.x:3080 --token t\n\n", os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+	ov := RegisterFlags(flags, "")
+	flags.Parse(args)
+
+	switch {
+	case ov.BindAddr != "" && ov.RemoteAddr != "":
+		logger.Fatalf("quick runs either a server (--bind-addr) or a client (--remote), not both")
+
+	case ov.BindAddr != "":
+		ov.role = roleServer
+		if ov.Token == "" {
+			ov.Token = randomToken()
+			logger.Infof("generated token %s, pass it to the client with --token", ov.Token)
+		}
+
+	case ov.RemoteAddr != "":
+		ov.role = roleClient
+
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+
+	cfg := prepare("", "", ov)
+
+	// print only the section in use, the other one is empty
+	section := map[string]any{"server": cfg.Server}
+	if ov.role == roleClient {
+		section = map[string]any{"client": cfg.Client}
+	}
+	fmt.Println("# effective configuration, press Ctrl-C to stop")
+	if err := toml.NewEncoder(os.Stdout).Encode(section); err != nil {
+		logger.Fatalf("failed to print configuration: %v", err)
+	}
+	fmt.Println()
+
+	serve(cfg, false)
+}
+
+func randomToken() string {
+	buf := make([]byte, 16)
+	if _, err := rand.Read(buf); err != nil {
+		logger.Fatalf("failed to generate a token: %v", err)
+	}
+	return hex.EncodeToString(buf)
+}
@@ -0,0 +1,126 @@
+package cmd
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strings"
+)
+
+// envRef is a reference to an environment variable in a config value,
+// ${NAME} or ${NAME:-default}.
+var envRef = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)(:-[^}]*)?\}`)
+
+// filePrefix marks a value read from a file, like "file:/run/secrets/token".
+const filePrefix = "file:"
+
+// resolveRefs expands the environment variables in every string value of a
+// decoded config file, then replaces the values starting with "file:" with
+// the contents of the file, relative to the config file. key names the value
+// in errors, pointed at the line of the file with lines.
+func resolveRefs(v reflect.Value, key, configPath string, lines map[string]int) error {
+	switch v.Kind() {
+	case reflect.Struct:
+		for i := 0; i < v.NumField(); i++ {
+			name, _, _ := strings.Cut(v.Type().Field(i).Tag.Get("toml"), ",")
+			if name == "" || name == "-" {
+				continue
+			}
+			if key != "" {
+				name = key + "." + name
+			}
+			if err := resolveRefs(v.Field(i), name, configPath, lines); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Slice:
+		for i := 0; i < v.Len(); i++ {
+			if err := resolveRefs(v.Index(i), key, configPath, lines); err != nil {
+				return err
+			}
+		}
+
+	case reflect.Map:
+		entries := v.MapRange()
+		for entries.Next() {
+			value := reflect.New(v.Type().Elem()).Elem()
+			value.Set(entries.Value())
+			if err := resolveRefs(value, key+"."+fmt.Sprint(entries.Key()), configPath, lines); err != nil {
+				return err
+			}
+			v.SetMapIndex(entries.Key(), value)
+		}
+
+	case reflect.Interface:
+		// strings among the ports of allowed_ports
+		if s, ok := v.Interface().(string); ok {
+			resolved, err := resolveValue(s, configPath)
+			if err != nil {
+				return refError(configPath, key, lines, err)
+			}
+			v.Set(reflect.ValueOf(resolved))
+		}
+
+	case reflect.String:
+		resolved, err := resolveValue(v.String(), configPath)
+		if err != nil {
+			return refError(configPath, key, lines, err)
+		}
+		v.SetString(resolved)
+	}
+	return nil
+}
+
+// resolveValue expands the environment variables in a value and reads it
+// from a file if it starts with "file:". Variables that aren't set are an
+// error unless they have a default.
+func resolveValue(value, configPath string) (string, error) {
+	var missing string
+	value = envRef.ReplaceAllStringFunc(value, func(ref string) string {
+		m := envRef.FindStringSubmatch(ref)
+		if env, ok := os.LookupEnv(m[1]); ok && (env != "" || m[2] == "") {
+			return env
+		}
+		if m[2] != "" {
+			return strings.TrimPrefix(m[2], ":-")
+		}
+		if missing == "" {
+			missing = m[1]
+		}
+		return ref
+	})
+	if missing != "" {
+		return "", fmt.Errorf("environment variable %s is not set", missing)
+	}
+
+	path, ok := strings.CutPrefix(value, filePrefix)
+	if !ok {
+		return value, nil
+	}
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(filepath.Dir(configPath), path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// refError points an error resolving the value of key at its line.
+func refError(configPath, key string, lines map[string]int, err error) error {
+	for name := key; name != ""; {
+		if n, ok := lines[name]; ok {
+			return fmt.Errorf("%s:%d: %s: %v", configPath, n, key, err)
+		}
+		i := strings.LastIndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[:i]
+	}
+	return fmt.Errorf("%s: %s: %v", configPath, key, err)
+}
@@ -0,0 +1,41 @@
+package cmd
+
+import (
+	"github.com/sahmadiut/backhaul/internal/config"
+)
+
+// Names of the two sides of a relay in the log.
+const (
+	relayUpstream   = "upstream"
+	relayDownstream = "downstream"
+)
+
+// relayConfigs splits the relay of cfg into the client to the server before
+// it and the server for the next hop, with their defaults applied.
+func relayConfigs(cfg config.Config) []config.Config {
+	relay := cfg.Relay
+	switch {
+	case cfg.Server.BindAddr != "" || cfg.Client.RemoteAddr != "":
+		logger.Fatalf("relay can't be combined with a server or client, run them as profiles instead")
+	case relay.Upstream.RemoteAddr == "":
+		logger.Fatalf("relay needs remote_addr in relay.upstream, the server before this node")
+	case relay.Downstream.BindAddr == "":
+		logger.Fatalf("relay needs bind_addr in relay.downstream, where the next hop connects")
+	case len(relay.Downstream.Ports) == 0 && len(relay.Downstream.Forward) == 0:
+		logger.Fatalf("relay needs ports in relay.downstream, the ports the upstream server has this node dial")
+	}
+
+	// the upstream client dials the public ports of the downstream server,
+	// which nobody else needs to reach
+	if relay.Downstream.PortsAddr == "" {
+		relay.Downstream.PortsAddr = "127.0.0.1"
+	}
+	relay.Upstream.ConfigPath = cfg.Client.ConfigPath
+	relay.Upstream.NoPersist = "the client is the upstream side of a relay"
+
+	up := config.Config{Client: relay.Upstream}
+	down := config.Config{Server: relay.Downstream}
+	applyDefaults(&up)
+	applyDefaults(&down)
+	return []config.Config{up, down}
+}
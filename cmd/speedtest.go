@@ -0,0 +1,32 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// Speedtest asks a running server to measure its tunnel and prints the
+// result.
+func Speedtest(args []string) {
+	flags := flag.NewFlagSet("speedtest", flag.ExitOnError)
+	configPath := flags.String("c", "", "configuration file of the server, to find its control_socket")
+	socket := flags.String("s", "", "path of the control socket, instead of -c")
+	profile := flags.String("p", "", "named profile of the configuration file")
+	size := flags.Int("size", 16, "megabytes to send in each direction")
+	flags.Parse(args)
+
+	path := controlSocket("speedtest", *configPath, *profile, *socket)
+
+	fmt.Printf("running a %d MB speedtest through the tunnel...\n", *size)
+	var result utils.SpeedtestResult
+	if err := control.Post(path, fmt.Sprintf("/speedtest?size=%d", *size), &result); err != nil {
+		logger.Fatalf("speedtest failed: %v", err)
+	}
+
+	fmt.Printf("Latency:   %.2f ms\n", result.Latency)
+	fmt.Printf("Upload:    %.1f Mbit/s (server to client)\n", result.Upload)
+	fmt.Printf("Download:  %.1f Mbit/s (client to server)\n", result.Download)
+}
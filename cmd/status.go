@@ -0,0 +1,217 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/cluster"
+	"github.com/sahmadiut/backhaul/internal/control"
+)
+
+// Status prints the state of a running instance, asked through its control
+// API. what is "status", "sessions", "paths", "ports" or "cluster".
+func Status(what string, args []string) {
+	flags := flag.NewFlagSet(what, flag.ExitOnError)
+	configPath := flags.String("c", "", "configuration file of the instance, to find its control_socket")
+	socket := flags.String("s", "", "path of the control socket, instead of -c")
+	profile := flags.String("p", "", "named profile of the configuration file")
+	flags.Parse(args)
+
+	path := controlSocket(what, *configPath, *profile, *socket)
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 0, 2, ' ', 0)
+	defer w.Flush()
+
+	var err error
+	switch what {
+	case "status":
+		err = printStatus(w, path)
+	case "sessions":
+		err = printSessions(w, path)
+	case "paths":
+		err = printPaths(w, path)
+	case "ports":
+		err = printPorts(w, path)
+	case "cluster":
+		err = printCluster(w, path)
+	}
+	if err != nil {
+		logger.Fatalf("failed to query %s: %v", path, err)
+	}
+}
+
+// controlSocket returns the control socket given with -s, or the one set in
+// the config file given with -c and the profile given with -p.
+func controlSocket(what, configPath, profile, socket string) string {
+	if socket == "" && configPath != "" {
+		cfg, err := loadConfig(configPath, profile)
+		if err != nil {
+			logger.Fatalf("failed to load configuration: %v", err)
+		}
+		socket = cfg.Server.ControlSocket
+		if cfg.Server.BindAddr == "" {
+			socket = cfg.Client.ControlSocket
+		}
+		if socket == "" {
+			logger.Fatalf("control_socket is not set in %s", configPath)
+		}
+	}
+	if socket == "" {
+		logger.Fatalf("Usage: %s %s -c /path/to/config.toml | -s /path/to/control.sock", os.Args[0], what)
+	}
+	return socket
+}
+
+func printStatus(w *tabwriter.Writer, socket string) error {
+	var status control.Status
+	if err := control.Get(socket, "/status", &status); err != nil {
+		return err
+	}
+
+	tunnel := status.Tunnel
+	if tunnel == "" {
+		tunnel = "-"
+	}
+	fmt.Fprintf(w, "Role:\t%s\n", status.Role)
+	fmt.Fprintf(w, "Transport:\t%s\n", status.Transport)
+	fmt.Fprintf(w, "Address:\t%s\n", status.Addr)
+	fmt.Fprintf(w, "Tunnel:\t%s\n", tunnel)
+	fmt.Fprintf(w, "Uptime:\t%s\n", time.Since(status.Started).Round(time.Second))
+	fmt.Fprintf(w, "Sessions:\t%d\n", status.Sessions)
+	fmt.Fprintf(w, "Connections:\t%d\n", status.Connections)
+	return nil
+}
+
+func printSessions(w *tabwriter.Writer, socket string) error {
+	var sessions []control.Session
+	if err := control.Get(socket, "/sessions", &sessions); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "ID\tREMOTE\tSTREAMS\tPOOL\tRELAYS\tCLIENT\tCONNECTS/H\tRTT\tMBIT/S")
+	for _, session := range sessions {
+		connects := "-" // older clients send no ID, clients list none
+		if session.Client != "" {
+			connects = strconv.Itoa(session.Connects)
+		}
+		if session.Flapping {
+			connects += " (flapping)"
+		}
+		relays := "-" // reported by the clients of servers
+		if session.Relays > 0 {
+			relays = strconv.FormatInt(session.Relays, 10)
+		}
+		rtt, mbps := "-", "-" // measured for port schedules, the round trip also over the control stream
+		if session.RTT > 0 {
+			rtt = fmt.Sprintf("%.1f ms", session.RTT)
+		}
+		if session.Mbps > 0 {
+			mbps = fmt.Sprintf("%.1f", session.Mbps)
+		}
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\t%s\t%s\t%s\t%s\n", session.ID, session.RemoteAddr, session.Streams, session.Pool, relays, session.Client, connects, rtt, mbps)
+	}
+	return nil
+}
+
+func printPaths(w *tabwriter.Writer, socket string) error {
+	var paths []control.Path
+	if err := control.Get(socket, "/paths", &paths); err != nil {
+		return err
+	}
+	if len(paths) == 0 {
+		fmt.Fprintln(w, "No paths, the client dials over the default route.")
+		return nil
+	}
+
+	fmt.Fprintln(w, "LOCAL\tREMOTE\tSTATE\tSESSIONS\tTRAFFIC\tMBIT/S\tERROR")
+	for _, path := range paths {
+		errText := path.Error
+		if errText == "" {
+			errText = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%s\t%.1f\t%s\n", path.Local, path.Remote, path.State, path.Sessions, readableBytes(path.Bytes), path.Mbps, errText)
+	}
+	return nil
+}
+
+func printPorts(w *tabwriter.Writer, socket string) error {
+	var ports []control.Port
+	if err := control.Get(socket, "/ports", &ports); err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "PORT\tNAME\tTARGET\tACTIVE\tTOTAL\tTRAFFIC")
+	for _, port := range ports {
+		name, target := port.Name, port.Target
+		if name == "" {
+			name = "-"
+		}
+		if target == "" {
+			target = "-"
+		}
+		fmt.Fprintf(w, "%d\t%s\t%s\t%d\t%d\t%s\n", port.Port, name, target, port.Active, port.Total, readableBytes(port.Bytes))
+	}
+	return nil
+}
+
+func printCluster(w *tabwriter.Writer, socket string) error {
+	var nodes []control.ClusterNode
+	if err := control.Get(socket, "/cluster", &nodes); err != nil {
+		return err
+	}
+	if len(nodes) == 0 {
+		fmt.Fprintln(w, "Clustering is off, cluster_peers is not set.")
+		return nil
+	}
+
+	fmt.Fprintln(w, "NAME\tROLE\tCLIENTS\tUPDATED")
+	for _, node := range nodes {
+		name, role := node.Name, "standby"
+		if node.Self {
+			name += " (this)"
+		}
+		switch {
+		case node.Down:
+			role = "down"
+		case node.Active:
+			role = "active"
+		}
+		clients := make([]string, 0, len(node.Clients))
+		for id := range node.Clients {
+			clients = append(clients, id)
+		}
+		sort.Strings(clients)
+		list := strings.Join(clients, ",")
+		if list == "" {
+			list = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s ago\n", name, role, list, time.Since(node.Updated).Round(time.Second))
+	}
+
+	fmt.Fprintln(w)
+	fmt.Fprintln(w, "PORT\tTARGET\tACTIVE\tTOTAL\tTRAFFIC")
+	for _, port := range cluster.Totals(nodes) {
+		fmt.Fprintf(w, "%d\t%s\t%d\t%d\t%s\n", port.Port, port.Target, port.Active, port.Total, readableBytes(port.Bytes))
+	}
+	return nil
+}
+
+// readableBytes formats a byte count like the web UI does.
+func readableBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.2f %cB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,58 @@
+package cmd
+
+import (
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/sahmadiut/backhaul/internal/update"
+)
+
+// UpdateKey writes a new key for signing release manifests and prints the
+// update_key of the clients, or signs a manifest with an existing key.
+func UpdateKey(args []string) {
+	flags := flag.NewFlagSet("update-key", flag.ExitOnError)
+	flags.Usage = func() {
+		fmt.Fprintf(flags.Output(), "Usage:\n  %s update-key -new release.key\n  %s update-key -key release.key -sign manifest.json\n\n", os.Args[0], os.Args[0])
+		flags.PrintDefaults()
+	}
+	newKey := flags.String("new", "", "write a new private key to this file")
+	keyFile := flags.String("key", "", "file with the private key to sign with")
+	manifest := flags.String("sign", "", "manifest to sign, the signature is written next to it with .sig appended")
+	flags.Parse(args)
+
+	switch {
+	case *newKey != "":
+		private, public, err := update.GenerateKey()
+		if err != nil {
+			logger.Fatalf("failed to generate a key: %v", err)
+		}
+		if err := os.WriteFile(*newKey, []byte(private+"\n"), 0o600); err != nil {
+			logger.Fatalf("%v", err)
+		}
+		fmt.Printf("# private key written to %s, keep it where releases are signed\n", *newKey)
+		fmt.Printf("update_key = %q\n", public)
+
+	case *manifest != "" && *keyFile != "":
+		private, err := os.ReadFile(*keyFile)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		data, err := os.ReadFile(*manifest)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		signature, err := update.Sign(string(private), data)
+		if err != nil {
+			logger.Fatalf("%v", err)
+		}
+		if err := os.WriteFile(*manifest+".sig", []byte(signature+"\n"), 0o644); err != nil {
+			logger.Fatalf("%v", err)
+		}
+		fmt.Printf("signed %s, serve %s.sig next to it\n", *manifest, *manifest)
+
+	default:
+		flags.Usage()
+		os.Exit(2)
+	}
+}
@@ -0,0 +1,156 @@
+// Package chaos breaks the tunnel of a server on purpose, so operators can
+// check that their monitoring notices and the client recovers before they
+// rely on it. It drops tunnel connections, delays what is written to them and
+// corrupts heartbeats at the rates given with the --chaos flag, and is off
+// otherwise.
+package chaos
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/netem"
+
+	"github.com/sirupsen/logrus"
+)
+
+// corrupted is sent instead of a heartbeat, no client expects it.
+const corrupted = "chaos"
+
+// Chaos is what the --chaos flag asks for. A nil Chaos does nothing.
+type Chaos struct {
+	Drop    float64       // drops of each tunnel connection per minute, on average
+	Delay   time.Duration // longest delay added to a write to a tunnel connection
+	Corrupt float64       // share of heartbeats sent corrupted, 0 to 1
+
+	logger *logrus.Logger
+}
+
+// Parse reads a --chaos value like "drop=0.5,delay=200ms,corrupt=0.1", nil
+// for an empty one.
+func Parse(spec string, logger *logrus.Logger) (*Chaos, error) {
+	if strings.TrimSpace(spec) == "" {
+		return nil, nil
+	}
+
+	c := &Chaos{logger: logger}
+	for _, item := range strings.Split(spec, ",") {
+		key, value, ok := strings.Cut(strings.TrimSpace(item), "=")
+		if !ok {
+			return nil, fmt.Errorf("chaos %q: want key=value", item)
+		}
+		var err error
+		switch key {
+		case "drop":
+			c.Drop, err = strconv.ParseFloat(value, 64)
+			if err == nil && c.Drop < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "delay":
+			c.Delay, err = time.ParseDuration(value)
+			if err == nil && c.Delay < 0 {
+				err = fmt.Errorf("must not be negative")
+			}
+		case "corrupt":
+			c.Corrupt, err = strconv.ParseFloat(value, 64)
+			if err == nil && (c.Corrupt < 0 || c.Corrupt > 1) {
+				err = fmt.Errorf("must be between 0 and 1")
+			}
+		default:
+			return nil, fmt.Errorf("chaos %q: unknown, want drop, delay or corrupt", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("chaos %s=%s: %v", key, value, err)
+		}
+	}
+	return c, nil
+}
+
+// String describes the chaos for the log.
+func (c *Chaos) String() string {
+	return fmt.Sprintf("%.2g drops per minute, delays up to %s, %.0f%% of heartbeats corrupted", c.Drop, c.Delay, c.Corrupt*100)
+}
+
+// Heartbeat returns the heartbeat signal to send, corrupted now and then.
+func (c *Chaos) Heartbeat(sig string) string {
+	if c == nil || c.Corrupt <= 0 || rand.Float64() >= c.Corrupt {
+		return sig
+	}
+	c.logger.Warnf("chaos: sending a corrupted heartbeat")
+	return corrupted
+}
+
+// Conn returns a tunnel connection that is dropped and delayed now and then,
+// conn itself with a nil Chaos.
+func (c *Chaos) Conn(conn net.Conn) net.Conn {
+	if c == nil {
+		return conn
+	}
+	w := &chaosConn{Conn: netem.Wrap(conn, netem.Conditions{Jitter: c.Delay}), raw: conn, done: make(chan struct{})}
+	if c.Drop > 0 {
+		go c.drop(w)
+	}
+	return w
+}
+
+// Listener returns a listener whose connections are those of Conn.
+func (c *Chaos) Listener(listener net.Listener) net.Listener {
+	if c == nil {
+		return listener
+	}
+	return &chaosListener{Listener: listener, chaos: c}
+}
+
+// drop closes conn abruptly at Drop times a minute on average, until it is
+// closed otherwise.
+func (c *Chaos) drop(conn *chaosConn) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if rand.Float64() < c.Drop/60 {
+				c.logger.Warnf("chaos: dropping tunnel connection from %s", conn.RemoteAddr().String())
+				conn.raw.Close()
+				return
+			}
+		case <-conn.done:
+			return
+		}
+	}
+}
+
+type chaosConn struct {
+	net.Conn
+	raw  net.Conn // under the delays, for the drops
+	done chan struct{}
+	once sync.Once
+}
+
+func (c *chaosConn) Close() error {
+	c.once.Do(func() { close(c.done) })
+	return c.Conn.Close()
+}
+
+// NetConn returns the underlying connection.
+func (c *chaosConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+type chaosListener struct {
+	net.Listener
+	chaos *Chaos
+}
+
+func (l *chaosListener) Accept() (net.Conn, error) {
+	conn, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	return l.chaos.Conn(conn), nil
+}
@@ -2,24 +2,36 @@ package client
 
 import (
 	"context"
+	"os"
+	"sync"
 	"time"
 
 	"github.com/sahmadiut/backhaul/internal/client/transport"
 	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/noise"
+	"github.com/sahmadiut/backhaul/internal/profiling"
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/tun"
 	"github.com/sahmadiut/backhaul/internal/utils"
-
-	"net/http"
-	_ "net/http/pprof"
+	"github.com/sahmadiut/backhaul/internal/web"
 
 	"github.com/sirupsen/logrus"
 )
 
 // Client encapsulates the client configuration and state
 type Client struct {
-	config *config.ClientConfig
-	ctx    context.Context
-	cancel context.CancelFunc
-	logger *logrus.Logger
+	config         *config.ClientConfig
+	ctx            context.Context
+	cancel         context.CancelFunc
+	logger         *logrus.Logger
+	started        time.Time
+	forwarder      *transport.Forwarder
+	allowedTargets *utils.TargetACL
+	edit           sync.Mutex       // one change of the forwarder, and save, at a time
+	tunnel         transport.Tunnel // restarted by remote management
 }
 
 func NewClient(cfg *config.ClientConfig, parentCtx context.Context) *Client {
@@ -28,72 +40,260 @@ func NewClient(cfg *config.ClientConfig, parentCtx context.Context) *Client {
 		config: cfg,
 		ctx:    ctx,
 		cancel: cancel,
-		logger: utils.NewLogger(cfg.LogLevel),
+		logger: utils.NewNamedLogger(cfg.LogLevel, cfg.Instance),
 	}
 }
 
 // Run starts the client and begins dialing the tunnel server
 func (c *Client) Start() {
-	// for pprof
+	c.started = time.Now()
+
+	// pprof for debugging, only reachable from loopback
+	profiler := profiling.NewProfiler(c.config.PPROFPort, c.logger)
 	if c.config.PPROF {
-		go func() {
-			c.logger.Info("pprof started at port 6060")
-			http.ListenAndServe("0.0.0.0:6060", nil)
-		}()
+		if err := profiler.Enable(); err != nil {
+			c.logger.Errorf("failed to start pprof: %v", err)
+		}
+	}
+	go profiler.Run(c.ctx, c.config.PPROFDumpDir, c.config.PPROFHeapLimit, c.config.PPROFGoroutines)
+
+	// local control API, started once the transport is up
+	var ctrl *control.Server
+	if c.config.ControlSocket != "" || c.config.ControlAddr != "" {
+		ctrl = control.NewServer(c.config.ControlSocket, c.logger)
+		if c.config.ControlAddr != "" {
+			if err := ctrl.ListenTCP(c.config.ControlAddr, c.config.ControlKeys); err != nil {
+				c.logger.Fatalf("invalid control API keys: %v", err)
+			}
+		}
+		if c.config.AuditLog != "" {
+			if err := ctrl.AuditLog(c.config.AuditLog); err != nil {
+				c.logger.Fatalf("failed to open audit log: %v", err)
+			}
+		}
+		profiling.RegisterHandlers(ctrl, profiler)
+	}
+
+	// trace the tunnel lifecycle
+	if c.config.OTLPEndpoint != "" {
+		tracing.Init(c.ctx, c.config.OTLPEndpoint, "backhaul-client", c.logger)
 	}
 
+	// push metrics for users without Prometheus
+	if c.config.InfluxURL != "" {
+		exporter := web.NewInfluxExporter(c.config.InfluxURL, c.config.InfluxToken, time.Duration(c.config.InfluxInterval)*time.Second, "client", c.logger)
+		go exporter.Run(c.ctx)
+	}
+	web.SetLogRotation(web.LogRotation{
+		MaxSize:   int64(max(c.config.SnifferLogSize, 0)) << 20,
+		MaxAge:    time.Duration(max(c.config.SnifferLogAge, 0)) * time.Hour,
+		Retention: time.Duration(max(c.config.SnifferLogKeep, 0)) * 24 * time.Hour,
+	})
+	web.SetUsageHistory(time.Duration(max(c.config.SnifferHistory, 0)) * 24 * time.Hour)
+
 	c.logger.Infof("client with remote address %s started successfully", c.config.RemoteAddr)
 
+	if c.config.ClientID == "" {
+		// the random ID of the process that updated itself into this one
+		c.config.ClientID = os.Getenv(utils.ClientIDEnv)
+	}
+	if c.config.ClientID == "" {
+		c.config.ClientID = utils.NewClientID()
+	}
+	c.logger.Infof("client ID %s", c.config.ClientID)
+	web.RecordClient(c.config.ClientID)
+
+	utils.SetDNSTTL(time.Duration(c.config.DNSTTL) * time.Second)
+	targets := c.forwarderReader(c.config.Forwarder)
+	forwarder := transport.NewForwarder(targets, c.balanceReader(c.config.ForwarderOptions))
+	allowedTargets := c.allowedTargetsReader(c.config.AllowedTargets, targets)
+	c.forwarder, c.allowedTargets = forwarder, allowedTargets
+	forwarder.CheckHealth(c.ctx, c.logger)
+	targetTimeouts := c.targetTimeoutsReader(c.config.ForwarderOptions)
+
+	// route a subnet over the tunnel
+	var tunLink *tun.Link
+	if c.config.TunAddr != "" {
+		tunConfig, err := tun.ParseConfig(c.config.TunName, c.config.TunAddr, c.config.TunMTU, c.config.TunRoutes)
+		if err != nil {
+			c.logger.Fatalf("%v", err)
+		}
+		if tunLink, err = tun.Start(c.ctx, tunConfig, c.logger); err != nil {
+			c.logger.Fatalf("%v", err)
+		}
+	}
+
+	// resolve DNS queries on the network of the server
+	var dnsForwarder *dnsfwd.Forwarder
+	if c.config.DNSListen != "" {
+		var err error
+		if dnsForwarder, err = dnsfwd.Listen(c.ctx, c.config.DNSListen, c.logger); err != nil {
+			c.logger.Fatalf("failed to listen for DNS queries on %s: %v", c.config.DNSListen, err)
+		}
+	}
+
+	// reach the internet from the server
+	var proxy *exitnode.Proxy
+	if c.config.SocksBind != "" || c.config.HTTPProxyBind != "" {
+		var allowed *utils.TargetACL
+		if len(c.config.ProxyAllowedIPs) > 0 {
+			var err error
+			if allowed, err = utils.ParseTargetACL(c.config.ProxyAllowedIPs); err != nil {
+				c.logger.Fatalf("invalid proxy_allowed_ips: %v", err)
+			}
+		}
+		proxy = exitnode.NewProxy(c.ctx, c.config.ProxyUser, c.config.ProxyPass, allowed, c.logger)
+		if c.config.SocksBind != "" {
+			if err := proxy.ListenSocks(c.config.SocksBind); err != nil {
+				c.logger.Fatalf("failed to start the SOCKS5 listener on %s: %v", c.config.SocksBind, err)
+			}
+		}
+		if c.config.HTTPProxyBind != "" {
+			if err := proxy.ListenHTTP(c.config.HTTPProxyBind); err != nil {
+				c.logger.Fatalf("failed to start the HTTP proxy listener on %s: %v", c.config.HTTPProxyBind, err)
+			}
+		}
+	}
+
+	keepalive := utils.Keepalive{
+		Mode:   c.config.KeepaliveMode,
+		Period: time.Duration(c.config.Keepalive) * time.Second,
+		Ping:   time.Duration(c.config.PingInterval) * time.Second,
+		Jitter: float64(c.config.KeepaliveJitter) / 100,
+	}
+
+	// run the commands of the server
+	var manage transport.Manage
+	if c.config.RemoteManagement {
+		manage = c.manage
+	}
+
+	var tunnel transport.Tunnel
 	if c.config.Transport == config.TCP {
 		tcpConfig := &transport.TcpConfig{
-			RemoteAddr:    c.config.RemoteAddr,
-			Nodelay:       c.config.Nodelay,
-			KeepAlive:     time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval: time.Duration(c.config.RetryInterval) * time.Second,
-			Token:         c.config.Token,
-			Forwarder:     c.forwarderReader(c.config.Forwarder),
-			Sniffer:       c.config.Sniffer,
-			WebPort:       c.config.WebPort,
-			SnifferLog:    c.config.SnifferLog,
+			RemoteAddr:     c.config.RemoteAddr,
+			StandbyAddrs:   c.config.StandbyAddrs,
+			Nodelay:        c.config.Nodelay,
+			AutoNodelay:    c.config.AutoNodelay,
+			KeepAlive:      keepalive,
+			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
+			Token:          c.config.Token,
+			PlainToken:     c.config.PlainToken,
+			ClientID:       c.config.ClientID,
+			FlapThreshold:  c.config.FlapThreshold,
+			Forwarder:      forwarder,
+			Manage:         manage,
+			AllowedPorts:   c.allowedPortsReader(c.config.AllowedPorts),
+			AllowedTargets: allowedTargets,
+			TargetTimeouts: targetTimeouts,
+			Tun:            tunLink,
+			DNS:            dnsForwarder,
+			Proxy:          proxy,
+			DialTimeout:    seconds(c.config.DialTimeout),
+			Handshake:      seconds(c.config.HandshakeTimeout),
+			ReadTimeout:    seconds(c.config.ReadTimeout),
+			Sniffer:        c.config.Sniffer,
+			WebPort:        c.config.WebPort,
+			SnifferLog:     c.config.SnifferLog,
 		}
 		tcpClient := transport.NewTCPClient(c.ctx, tcpConfig, c.logger)
 		go tcpClient.ChannelDialer()
+		tunnel = tcpClient
 
 	} else if c.config.Transport == config.TCPMUX {
 		tcpMuxConfig := &transport.TcpMuxConfig{
 			RemoteAddr:       c.config.RemoteAddr,
+			StandbyAddrs:     c.config.StandbyAddrs,
+			Paths:            c.config.Paths,
 			Nodelay:          c.config.Nodelay,
-			KeepAlive:        time.Duration(c.config.Keepalive) * time.Second,
+			AutoNodelay:      c.config.AutoNodelay,
+			KeepAlive:        keepalive,
 			RetryInterval:    time.Duration(c.config.RetryInterval) * time.Second,
 			Token:            c.config.Token,
+			PlainToken:       c.config.PlainToken,
+			ClientID:         c.config.ClientID,
+			FlapThreshold:    c.config.FlapThreshold,
 			MuxSession:       c.config.MuxSession,
 			MuxVersion:       c.config.MuxVersion,
 			MaxFrameSize:     c.config.MaxFrameSize,
 			MaxReceiveBuffer: c.config.MaxReceiveBuffer,
 			MaxStreamBuffer:  c.config.MaxStreamBuffer,
-			Forwarder:        c.forwarderReader(c.config.Forwarder),
+			Forwarder:        forwarder,
+			Manage:           manage,
+			AllowedPorts:     c.allowedPortsReader(c.config.AllowedPorts),
+			AllowedTargets:   allowedTargets,
+			TargetTimeouts:   targetTimeouts,
+			Tun:              tunLink,
+			DNS:              dnsForwarder,
+			Proxy:            proxy,
+			DialTimeout:      seconds(c.config.DialTimeout),
+			Handshake:        seconds(c.config.HandshakeTimeout),
+			ReadTimeout:      seconds(c.config.ReadTimeout),
 			Sniffer:          c.config.Sniffer,
 			WebPort:          c.config.WebPort,
 			SnifferLog:       c.config.SnifferLog,
 		}
+		if c.config.MuxTLS {
+			tcpMuxConfig.TLSConfig = utils.PinnedTLSConfig(c.config.TLSPin)
+		}
+		if c.config.NoisePrivateKey != "" {
+			if c.config.MuxTLS {
+				c.logger.Fatalf("mux_tls and noise_private_key can't be used together")
+			}
+			key, err := noise.ParsePrivateKey(c.config.NoisePrivateKey)
+			if err != nil {
+				c.logger.Fatalf("invalid noise_private_key: %v", err)
+			}
+			serverKey, err := noise.ParsePublicKey(c.config.NoiseServerKey)
+			if err != nil {
+				c.logger.Fatalf("invalid noise_server_key: %v", err)
+			}
+			tcpMuxConfig.NoiseKey, tcpMuxConfig.NoiseServerKey = key, serverKey
+			public, _ := noise.PublicKey(c.config.NoisePrivateKey)
+			c.logger.Infof("noise public key of the client: %s", public)
+		}
 		tcpMuxClient := transport.NewMuxClient(c.ctx, tcpMuxConfig, c.logger)
 		go tcpMuxClient.MuxDialer()
+		tunnel = tcpMuxClient
 
 	} else if c.config.Transport == config.WS || c.config.Transport == config.WSS {
 		WsConfig := &transport.WsConfig{
-			RemoteAddr:    c.config.RemoteAddr,
-			Nodelay:       c.config.Nodelay,
-			KeepAlive:     time.Duration(c.config.Keepalive) * time.Second,
-			RetryInterval: time.Duration(c.config.RetryInterval) * time.Second,
-			Token:         c.config.Token,
-			Forwarder:     c.forwarderReader(c.config.Forwarder),
-			Sniffer:       c.config.Sniffer,
-			WebPort:       c.config.WebPort,
-			SnifferLog:    c.config.SnifferLog,
-			Mode:          c.config.Transport,
+			RemoteAddr:     c.config.RemoteAddr,
+			StandbyAddrs:   c.config.StandbyAddrs,
+			Nodelay:        c.config.Nodelay,
+			AutoNodelay:    c.config.AutoNodelay,
+			KeepAlive:      keepalive,
+			RetryInterval:  time.Duration(c.config.RetryInterval) * time.Second,
+			Token:          c.config.Token,
+			PlainToken:     c.config.PlainToken,
+			ClientID:       c.config.ClientID,
+			FlapThreshold:  c.config.FlapThreshold,
+			Forwarder:      forwarder,
+			Manage:         manage,
+			AllowedPorts:   c.allowedPortsReader(c.config.AllowedPorts),
+			AllowedTargets: allowedTargets,
+			TargetTimeouts: targetTimeouts,
+			Tun:            tunLink,
+			DNS:            dnsForwarder,
+			Proxy:          proxy,
+			DialTimeout:    seconds(c.config.DialTimeout),
+			Handshake:      seconds(c.config.HandshakeTimeout),
+			ReadTimeout:    seconds(c.config.ReadTimeout),
+			Sniffer:        c.config.Sniffer,
+			WebPort:        c.config.WebPort,
+			SnifferLog:     c.config.SnifferLog,
+			Mode:           c.config.Transport,
+			TLSPin:         c.config.TLSPin,
 		}
 		WsClient := transport.NewWSClient(c.ctx, WsConfig, c.logger)
 		go WsClient.ChannelDialer()
+		tunnel = WsClient
+	}
+
+	c.tunnel = tunnel
+	if ctrl != nil {
+		c.registerHandlers(ctrl, tunnel)
+		go ctrl.Run(c.ctx)
 	}
 
 	<-c.ctx.Done()
@@ -0,0 +1,277 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/client/transport"
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+)
+
+// registerHandlers adds the status endpoints to the control API:
+//
+//	GET /status    role, tunnel state and connection count
+//	GET /sessions  tunnel connections
+//	GET /paths     paths of a tcpmux client, with their health and throughput
+//	GET /ports     target ports that relayed anything or that the server forwards, with their counters
+//	GET /forwarder  forwarder entries
+//	PUT /forwarder/{port}?target=ADDR[,ADDR]  point port to new targets
+//	DELETE /forwarder/{port}           dial 127.0.0.1:port again
+//
+// Changes to the forwarder take effect for new connections, add persist=true
+// to also write them to the config file. Relays already set up stay on the
+// old target until they end, or until the drain=DURATION given with the
+// change has passed.
+func (c *Client) registerHandlers(ctrl *control.Server, tunnel transport.Tunnel) {
+	ctrl.Handle("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status := control.Status{
+			Role:        "client",
+			Transport:   string(c.config.Transport),
+			Addr:        c.config.RemoteAddr,
+			Started:     c.started,
+			Connections: utils.ActiveRelays(),
+		}
+		if tunnel != nil {
+			status.Tunnel = tunnel.TunnelStatus()
+			status.Sessions = len(tunnel.Sessions())
+		}
+		control.WriteJSON(w, status)
+	})
+
+	ctrl.Handle("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessions := []control.Session{}
+		if tunnel != nil {
+			sessions = append(sessions, tunnel.Sessions()...)
+		}
+		control.WriteJSON(w, sessions)
+	})
+
+	ctrl.Handle("GET /paths", func(w http.ResponseWriter, r *http.Request) {
+		paths := []control.Path{}
+		if tunnel != nil {
+			paths = append(paths, tunnel.Paths()...)
+		}
+		control.WriteJSON(w, paths)
+	})
+
+	ctrl.Handle("GET /ports", func(w http.ResponseWriter, r *http.Request) {
+		ports := []control.Port{}
+		stats := web.PortStats()
+		for port, stat := range stats {
+			ports = append(ports, control.Port{
+				Port:   port,
+				Active: stat.Active,
+				Total:  stat.Total,
+				Bytes:  stat.Bytes,
+			})
+		}
+		if tunnel != nil {
+			// the ports the server forwards, also before they relayed anything
+			names := make(map[int]string)
+			for _, port := range tunnel.Ports() {
+				names[port.Target] = port.Name
+				if _, ok := stats[port.Target]; !ok {
+					ports = append(ports, control.Port{Port: port.Target})
+				}
+			}
+			for i := range ports {
+				ports[i].Name = names[ports[i].Port]
+			}
+		}
+		sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+		control.WriteJSON(w, ports)
+	})
+
+	ctrl.Handle("GET /forwarder", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, c.forwards())
+	})
+
+	ctrl.HandleScope("PUT /forwarder/{port}", control.ScopePorts, func(w http.ResponseWriter, r *http.Request) {
+		c.edit.Lock()
+		defer c.edit.Unlock()
+
+		port, err := forwarderPort(r)
+		if err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		targets, err := c.parseTargets(r.URL.Query().Get("target"))
+		if err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		drain, err := drainDeadline(r)
+		if err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+
+		c.setForwarder(port, targets, drain)
+		control.Audit(r, "port %d now goes to %s", port, transport.FormatEntry(targets))
+		c.respondForwarder(w, r)
+	})
+
+	ctrl.HandleScope("DELETE /forwarder/{port}", control.ScopePorts, func(w http.ResponseWriter, r *http.Request) {
+		c.edit.Lock()
+		defer c.edit.Unlock()
+
+		port, err := forwarderPort(r)
+		if err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		drain, err := drainDeadline(r)
+		if err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		if err := c.deleteForwarder(port, drain); err != nil {
+			control.WriteError(w, http.StatusNotFound, err)
+			return
+		}
+		control.Audit(r, "port %d removed from the forwarder", port)
+		c.respondForwarder(w, r)
+	})
+}
+
+// forwards returns the forwarder entries sorted by port.
+func (c *Client) forwards() []control.Forward {
+	forwards := []control.Forward{}
+	for port, targets := range c.forwarder.Targets() {
+		forwards = append(forwards, control.Forward{
+			Port:     port,
+			Target:   transport.FormatEntry(targets),
+			Draining: c.forwarder.Draining(port),
+			Backends: c.forwarder.Backends(port),
+		})
+	}
+	sort.Slice(forwards, func(i, j int) bool { return forwards[i].Port < forwards[j].Port })
+	return forwards
+}
+
+func forwarderPort(r *http.Request) (int, error) {
+	port, err := strconv.Atoi(r.PathValue("port"))
+	if err != nil || port < 1 || port > 65535 {
+		return 0, fmt.Errorf("invalid port %q", r.PathValue("port"))
+	}
+	return port, nil
+}
+
+// drainDeadline returns the drain parameter of a forwarder change, negative
+// if relays on the old target may run until they end.
+func drainDeadline(r *http.Request) (time.Duration, error) {
+	return parseDrain(r.URL.Query().Get("drain"))
+}
+
+func parseDrain(value string) (time.Duration, error) {
+	if value == "" {
+		return -1, nil
+	}
+	drain, err := time.ParseDuration(value)
+	if err != nil || drain < 0 {
+		return 0, fmt.Errorf("invalid drain %q", value)
+	}
+	return drain, nil
+}
+
+// setForwarder points port to targets, the caller holds c.edit.
+func (c *Client) setForwarder(port int, targets []transport.Target, drain time.Duration) {
+	c.forwarder.Set(port, targets)
+	c.logger.Infof("forwarder: port %d now goes to %s", port, transport.FormatEntry(targets))
+	c.drain(port, drain)
+}
+
+// deleteForwarder removes the entry of port, the caller holds c.edit.
+func (c *Client) deleteForwarder(port int, drain time.Duration) error {
+	if !c.forwarder.Delete(port) {
+		return fmt.Errorf("port %d is not in the forwarder", port)
+	}
+	c.logger.Infof("forwarder: port %d removed", port)
+	c.drain(port, drain)
+	return nil
+}
+
+// drain closes the relays of port still on an old target after drain, unless
+// it is negative.
+func (c *Client) drain(port int, drain time.Duration) {
+	if drain < 0 {
+		return
+	}
+	if n := c.forwarder.Drain(port, drain); n > 0 {
+		c.logger.Infof("forwarder: closing %d connections of port %d to the old target in %v", n, port, drain)
+	}
+}
+
+// parseTargets validates a new forwarder entry, one target or several
+// separated by commas. With allowed_targets set they must be in there,
+// otherwise the allowlist follows the forwarder.
+func (c *Client) parseTargets(entry string) ([]transport.Target, error) {
+	targets, err := transport.ParseEntry(entry)
+	if err != nil {
+		return nil, err
+	}
+	for _, target := range targets {
+		host, port, err := net.SplitHostPort(target.Address)
+		if err != nil {
+			return nil, fmt.Errorf("invalid target %q: %v", target.Address, err)
+		}
+		if _, err := strconv.Atoi(port); err != nil || strings.Contains(host, "/") {
+			return nil, fmt.Errorf("invalid target %q", target.Address)
+		}
+		if len(c.config.AllowedTargets) > 0 {
+			if _, err := utils.ResolveTarget(target.Address, c.allowedTargets); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return targets, nil
+}
+
+// respondForwarder saves the forwarder entries if asked to and responds with
+// them.
+func (c *Client) respondForwarder(w http.ResponseWriter, r *http.Request) {
+	if status, err := c.forwarderChanged(r.URL.Query().Get("persist") == "true"); err != nil {
+		control.WriteError(w, status, err)
+		return
+	}
+	control.WriteJSON(w, c.forwards())
+}
+
+// forwarderChanged updates what depends on the forwarder entries and saves
+// them if persist is set. The status tells why they weren't saved.
+func (c *Client) forwarderChanged(persist bool) (int, error) {
+	if len(c.config.AllowedTargets) == 0 {
+		c.allowedTargets.Replace(c.allowedTargetsReader(nil, c.forwarder.Targets()))
+	}
+	if !persist {
+		return http.StatusOK, nil
+	}
+
+	if c.config.ConfigPath == "" {
+		return http.StatusBadRequest, errors.New("changed, but not saved: the client runs without a config file")
+	}
+	if c.config.NoPersist != "" {
+		return http.StatusBadRequest, fmt.Errorf("changed, but not saved: %s", c.config.NoPersist)
+	}
+
+	forwards := c.forwards()
+	entries := make([]string, 0, len(forwards))
+	for _, f := range forwards {
+		entries = append(entries, fmt.Sprintf("%d=%s", f.Port, f.Target))
+	}
+	if err := config.SaveForwarder(c.config.ConfigPath, entries); err != nil {
+		c.logger.Errorf("failed to save the forwarder: %v", err)
+		return http.StatusInternalServerError, fmt.Errorf("changed, but not saved: %v", err)
+	}
+	c.logger.Infof("forwarder saved to %s", c.config.ConfigPath)
+	return http.StatusOK, nil
+}
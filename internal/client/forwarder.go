@@ -1,30 +1,135 @@
 package client
 
 import (
+	"fmt"
+	"net"
 	"strconv"
 	"strings"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/client/transport"
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
 )
 
 // for both tcp and tcpmux
-func (c *Client) forwarderReader(config []string) map[int]string {
-	forwarder := make(map[int]string)
+func (c *Client) forwarderReader(config []string) map[int][]transport.Target {
+	forwarder, err := parseForwarder(config)
+	if err != nil {
+		c.logger.Fatalf("%v", err)
+	}
+	return forwarder
+}
+
+// parseForwarder parses the forwarder entries of the config, "port=target".
+func parseForwarder(config []string) (map[int][]transport.Target, error) {
+	forwarder := make(map[int][]transport.Target)
 	for _, portMapping := range config {
 		parts := strings.Split(portMapping, "=")
 		if len(parts) != 2 {
-			c.logger.Fatalf("invalid port mapping format: %s", portMapping)
-			continue
+			return nil, fmt.Errorf("invalid port mapping format: %s", portMapping)
 		}
 
 		localPortStr := strings.TrimSpace(parts[0])
 
 		localPort, err := strconv.Atoi(localPortStr)
 		if err != nil {
-			c.logger.Fatalf("invalid local port in mapping: %s", localPortStr)
-			continue
+			return nil, fmt.Errorf("invalid local port in mapping: %s", localPortStr)
+		}
+		targets, err := transport.ParseEntry(parts[1])
+		if err != nil {
+			return nil, fmt.Errorf("invalid targets in mapping %s: %v", portMapping, err)
 		}
-		remoteAddress := strings.TrimSpace(parts[1])
 
-		forwarder[localPort] = remoteAddress
+		forwarder[localPort] = targets
 	}
-	return forwarder
+	return forwarder, nil
+}
+
+// targetTimeoutsReader parses the per-port timeouts of forwarder_options.
+func (c *Client) targetTimeoutsReader(config map[string]config.ForwarderOptions) map[int]transport.TargetTimeouts {
+	timeouts := make(map[int]transport.TargetTimeouts)
+	for portStr, options := range config {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			c.logger.Fatalf("invalid port in forwarder_options: %s", portStr)
+		}
+		timeouts[port] = transport.TargetTimeouts{
+			Dial: seconds(options.DialTimeout),
+			Read: seconds(options.ReadTimeout),
+		}
+	}
+	return timeouts
+}
+
+// balanceReader parses how forwarder_options spread the connections of ports
+// with several targets and check their health.
+func (c *Client) balanceReader(config map[string]config.ForwarderOptions) map[int]transport.Balance {
+	balance := make(map[int]transport.Balance)
+	for portStr, options := range config {
+		port, err := strconv.Atoi(portStr)
+		if err != nil {
+			c.logger.Fatalf("invalid port in forwarder_options: %s", portStr)
+		}
+		switch options.Balance {
+		case "":
+			options.Balance = transport.BalanceRoundRobin
+		case transport.BalanceRoundRobin, transport.BalanceLeastConn:
+		default:
+			c.logger.Fatalf("invalid balance %q for port %d, use %q or %q", options.Balance, port, transport.BalanceRoundRobin, transport.BalanceLeastConn)
+		}
+		checkTimeout := seconds(options.DialTimeout)
+		if checkTimeout <= 0 {
+			checkTimeout = seconds(c.config.DialTimeout)
+		}
+		balance[port] = transport.Balance{
+			Mode:           options.Balance,
+			FailTimeout:    seconds(options.FailTimeout),
+			HealthInterval: seconds(options.HealthInterval),
+			HealthFails:    options.HealthFails,
+			CheckTimeout:   checkTimeout,
+		}
+	}
+	return balance
+}
+
+// seconds converts a timeout given in (fractional) seconds.
+func seconds(s float64) time.Duration {
+	return time.Duration(s * float64(time.Second))
+}
+
+// allowedPortsReader parses the ports the server may ask the client to dial,
+// nil means all ports are allowed.
+func (c *Client) allowedPortsReader(config []any) utils.PortRanges {
+	allowedPorts, err := utils.ParsePortRanges(config)
+	if err != nil {
+		c.logger.Fatalf("invalid allowed_ports: %v", err)
+	}
+	return allowedPorts
+}
+
+// targets allowed by default besides the forwarder targets
+var loopbackTargets = []string{"127.0.0.0/8", "::1"}
+
+// allowedTargetsReader builds the allowlist of addresses the client dials for
+// the server. Without allowed_targets, only loopback and the forwarder targets
+// are allowed.
+func (c *Client) allowedTargetsReader(config []string, forwarder map[int][]transport.Target) *utils.TargetACL {
+	entries := config
+	if len(entries) == 0 {
+		entries = append(entries, loopbackTargets...)
+		for _, targets := range forwarder {
+			for _, target := range targets {
+				if host, _, err := net.SplitHostPort(target.Address); err == nil && host != "" {
+					entries = append(entries, host)
+				}
+			}
+		}
+	}
+
+	allowedTargets, err := utils.ParseTargetACL(entries)
+	if err != nil {
+		c.logger.Fatalf("invalid allowed_targets: %v", err)
+	}
+	return allowedTargets
 }
@@ -0,0 +1,110 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+
+	"github.com/sirupsen/logrus"
+)
+
+// manage runs a command the server sent over the control channel, with
+// remote_management on.
+func (c *Client) manage(command control.ClientCommand) control.ClientResult {
+	var result control.ClientResult
+	var err error
+	switch command.Action {
+	case control.CommandForwarder:
+		err = c.manageForwarder(command)
+		result.Forwarder = c.forwards()
+	case control.CommandReload:
+		err = c.reload()
+		result.Forwarder = c.forwards()
+	case control.CommandLogLevel:
+		err = c.setLogLevel(command.Level)
+	case control.CommandRestart:
+		c.logger.Info("remote management: restarting the tunnel")
+		// once the result is sent back over the control channel
+		time.AfterFunc(time.Second, c.tunnel.Restart)
+	default:
+		err = fmt.Errorf("unknown command %q", command.Action)
+	}
+	if err != nil {
+		c.logger.Warnf("remote management: %s failed: %v", command.Action, err)
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// manageForwarder changes or deletes a forwarder entry like the control API
+// does.
+func (c *Client) manageForwarder(command control.ClientCommand) error {
+	if command.Port < 1 || command.Port > 65535 {
+		return fmt.Errorf("invalid port %d", command.Port)
+	}
+	drain, err := parseDrain(command.Drain)
+	if err != nil {
+		return err
+	}
+
+	c.edit.Lock()
+	defer c.edit.Unlock()
+	if command.Target == "" {
+		if err := c.deleteForwarder(command.Port, drain); err != nil {
+			return err
+		}
+	} else {
+		targets, err := c.parseTargets(command.Target)
+		if err != nil {
+			return err
+		}
+		c.setForwarder(command.Port, targets, drain)
+	}
+	_, err = c.forwarderChanged(command.Persist)
+	return err
+}
+
+// reload reads the config file again and applies its forwarder and
+// log_level. Other settings take effect when the client is started again.
+func (c *Client) reload() error {
+	if c.config.Reload == nil {
+		return errors.New("the client runs without a config file, or as the upstream side of a relay")
+	}
+	reloaded, err := c.config.Reload()
+	if err != nil {
+		return err
+	}
+	targets, err := parseForwarder(reloaded.Forwarder)
+	if err != nil {
+		return err
+	}
+
+	c.edit.Lock()
+	defer c.edit.Unlock()
+	for port := range c.forwarder.Targets() {
+		if _, ok := targets[port]; !ok {
+			c.forwarder.Delete(port)
+		}
+	}
+	for port, entry := range targets {
+		c.forwarder.Set(port, entry)
+	}
+	c.forwarderChanged(false)
+	c.logger.Infof("remote management: reloaded %s, %d forwarder entries", c.config.ConfigPath, len(targets))
+	return c.setLogLevel(reloaded.LogLevel)
+}
+
+// setLogLevel switches the log level of the client.
+func (c *Client) setLogLevel(name string) error {
+	level, err := logrus.ParseLevel(name)
+	if err != nil {
+		return err
+	}
+	if level != c.logger.GetLevel() {
+		c.logger.SetLevel(level)
+		c.logger.Infof("remote management: log level is %s now", level)
+	}
+	return nil
+}
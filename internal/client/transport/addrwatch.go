@@ -0,0 +1,63 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// addrInterval is how often a client checks that the local address of its
+// tunnel is still assigned.
+const addrInterval = 2 * time.Second
+
+// tunnelConn is a connection to the server, or a mux session over one.
+type tunnelConn interface {
+	LocalAddr() net.Addr
+	Close() error
+}
+
+// watchLocalAddr closes conn and calls restart as soon as the address conn
+// was dialed from is no longer assigned to an interface, e.g. after a DHCP
+// renew or a 4G reconnect. The connection would otherwise hang until a
+// heartbeat or keepalive times out. It checks every addrInterval until ctx is
+// done.
+func watchLocalAddr(ctx context.Context, conn tunnelConn, restart func(), logger *logrus.Logger) {
+	addr, ok := conn.LocalAddr().(*net.TCPAddr)
+	if !ok || addr.IP.IsLoopback() {
+		return
+	}
+
+	ticker := time.NewTicker(addrInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !assigned(addr.IP) {
+			logger.Warnf("local address %s of the tunnel is gone, reconnecting", addr.IP)
+			conn.Close()
+			go restart()
+			return
+		}
+	}
+}
+
+// assigned reports whether ip is an address of one of the interfaces, true
+// when they can't be listed so keepalives decide.
+func assigned(ip net.IP) bool {
+	addrs, err := net.InterfaceAddrs()
+	if err != nil {
+		return true
+	}
+	for _, addr := range addrs {
+		if ipNet, ok := addr.(*net.IPNet); ok && ipNet.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
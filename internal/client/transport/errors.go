@@ -0,0 +1,8 @@
+package transport
+
+import "errors"
+
+var (
+	errPortNotAllowed = errors.New("port is not in allowed_ports")
+	errInvalidToken   = errors.New("invalid token")
+)
@@ -0,0 +1,57 @@
+package transport
+
+import (
+	"sync"
+
+	"github.com/sirupsen/logrus"
+)
+
+// failoverAfter is how many tunnel dials in a row may fail before the client
+// moves on to the next server.
+const failoverAfter = 3
+
+// remotes is the server of a client and its standbys, taken in turn. The
+// client stays with a server as long as it can reach it, and never moves back
+// on its own while that one works.
+type remotes struct {
+	mu      sync.Mutex
+	addrs   []string
+	current int
+	fails   int // dials of the current server that failed in a row
+}
+
+func newRemotes(primary string, standby []string) *remotes {
+	return &remotes{addrs: append([]string{primary}, standby...)}
+}
+
+// addr returns the server to dial.
+func (r *remotes) addr() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addrs[r.current]
+}
+
+// failed records a failed tunnel dial and moves on to the next server after
+// failoverAfter failures in a row.
+func (r *remotes) failed(logger *logrus.Logger) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if len(r.addrs) < 2 {
+		return
+	}
+	r.fails++
+	if r.fails < failoverAfter {
+		return
+	}
+	from := r.addrs[r.current]
+	r.current = (r.current + 1) % len(r.addrs)
+	r.fails = 0
+	logger.Warnf("failed to reach %s %d times in a row, failing over to %s", from, failoverAfter, r.addrs[r.current])
+}
+
+// reached forgets the failures once the tunnel is up.
+func (r *remotes) reached() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.fails = 0
+}
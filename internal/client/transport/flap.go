@@ -0,0 +1,60 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// defaultFlapThreshold is how many restarts within an hour make the client
+// back off by default.
+const defaultFlapThreshold = 10
+
+// how long a restart waits before dialing again, doubling with each restart
+// past the flap threshold
+const (
+	restartDelay    = 2 * time.Second
+	maxRestartDelay = 5 * time.Minute
+)
+
+// flapDamper makes a client that keeps losing its tunnel wait longer before
+// each restart, so a flapping tunnel doesn't hammer the server.
+type flapDamper struct {
+	threshold int // negative to never back off
+
+	mu       sync.Mutex
+	restarts []time.Time // within the last hour
+}
+
+func newFlapDamper(threshold int) *flapDamper {
+	if threshold == 0 {
+		threshold = defaultFlapThreshold
+	}
+	return &flapDamper{threshold: threshold}
+}
+
+// restarted records a restart and returns how long to wait before dialing.
+func (d *flapDamper) restarted(logger *logrus.Logger) time.Duration {
+	now := time.Now()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	i := 0
+	for i < len(d.restarts) && now.Sub(d.restarts[i]) > time.Hour {
+		i++
+	}
+	d.restarts = append(d.restarts[i:], now)
+
+	n := len(d.restarts)
+	if d.threshold < 0 || n < d.threshold {
+		return restartDelay
+	}
+	delay := restartDelay
+	for i := d.threshold; i <= n && delay < maxRestartDelay; i++ {
+		delay *= 2
+	}
+	delay = min(delay, maxRestartDelay)
+	logger.Warnf("tunnel is flapping: %d restarts within the last hour, waiting %v before reconnecting", n, delay)
+	return delay
+}
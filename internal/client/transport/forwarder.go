@@ -0,0 +1,364 @@
+package transport
+
+import (
+	"fmt"
+	"net"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+)
+
+// How a forwarder entry with several targets spreads the connections.
+const (
+	BalanceRoundRobin = "round-robin" // each target in turn, as often as its weight
+	BalanceLeastConn  = "least-conn"  // the target relaying the fewest connections for its weight
+)
+
+// how long a target that refused a connection is skipped by default
+const defaultFailTimeout = 10 * time.Second
+
+// Balance configures the forwarder entry of a port with several targets.
+type Balance struct {
+	Mode           string
+	FailTimeout    time.Duration // how long a target that failed to connect is skipped
+	HealthInterval time.Duration // between active health checks, 0 for none
+	HealthFails    int           // failed checks in a row before a target is down
+	CheckTimeout   time.Duration // for a health check to connect
+}
+
+// Target is a target of a forwarder entry, written "10.0.0.2:80" or with a
+// weight "10.0.0.2:80*3".
+type Target struct {
+	Address string
+	Weight  int
+}
+
+func (t Target) String() string {
+	if t.Weight == 1 {
+		return t.Address
+	}
+	return fmt.Sprintf("%s*%d", t.Address, t.Weight)
+}
+
+// ParseEntry parses a forwarder entry, one target or several separated by
+// commas.
+func ParseEntry(entry string) ([]Target, error) {
+	var targets []Target
+	for _, part := range strings.Split(entry, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		target := Target{Address: part, Weight: 1}
+		if address, weight, ok := strings.Cut(part, "*"); ok {
+			w, err := strconv.Atoi(strings.TrimSpace(weight))
+			if err != nil || w < 1 {
+				return nil, fmt.Errorf("invalid weight in %q", part)
+			}
+			target = Target{Address: strings.TrimSpace(address), Weight: w}
+		}
+		targets = append(targets, target)
+	}
+	if len(targets) == 0 {
+		return nil, fmt.Errorf("no target in %q", entry)
+	}
+	return targets, nil
+}
+
+// FormatEntry is the reverse of ParseEntry.
+func FormatEntry(targets []Target) string {
+	parts := make([]string, len(targets))
+	for i, target := range targets {
+		parts[i] = target.String()
+	}
+	return strings.Join(parts, ",")
+}
+
+// health is what the forwarder knows about a target.
+type health struct {
+	failedUntil time.Time // refused a connection, tried last until then
+	fails       int       // health checks failed in a row
+	err         string    // of the last failed check
+}
+
+// Forwarder maps the ports the server asks for to the targets the client
+// dials. It can be changed while the client runs, relays already set up keep
+// their target until they end or are drained.
+type Forwarder struct {
+	mu      sync.RWMutex
+	targets map[int][]Target
+	balance map[int]Balance
+	current map[int]map[string]int      // smooth weighted round-robin state by port
+	health  map[string]*health          // by target address
+	relays  map[int]map[net.Conn]string // local connections by port, with the target they went to
+	dials   dialCounts
+}
+
+func NewForwarder(targets map[int][]Target, balance map[int]Balance) *Forwarder {
+	return &Forwarder{
+		targets: targets,
+		balance: balance,
+		current: make(map[int]map[string]int),
+		health:  make(map[string]*health),
+		relays:  make(map[int]map[net.Conn]string),
+	}
+}
+
+// targetsOf returns the targets of port, the caller holds f.mu.
+func (f *Forwarder) targetsOf(port int) []Target {
+	if targets, ok := f.targets[port]; ok {
+		return targets
+	}
+	return []Target{{Address: fmt.Sprintf("127.0.0.1:%d", port), Weight: 1}}
+}
+
+// healthOf returns the health of a target, the caller holds f.mu.
+func (f *Forwarder) healthOf(address string) health {
+	if h, ok := f.health[address]; ok {
+		return *h
+	}
+	return health{}
+}
+
+// state returns "up", "degraded" or "down" for address of port, the caller
+// holds f.mu. A target is degraded after a refused connection or a failed
+// health check, down after health_fails of them in a row.
+func (f *Forwarder) state(port int, address string, now time.Time) string {
+	h := f.healthOf(address)
+	fails := f.balance[port].HealthFails
+	if fails <= 0 {
+		fails = defaultHealthFails
+	}
+	switch {
+	case h.fails >= fails:
+		return "down"
+	case h.fails > 0 || now.Before(h.failedUntil):
+		return "degraded"
+	default:
+		return "up"
+	}
+}
+
+// Pick returns the targets to dial for port in the order to try them: the one
+// the balancing picks first, then the other healthy ones, then targets that
+// recently refused a connection or are down. It is 127.0.0.1:port unless the
+// forwarder maps port elsewhere.
+func (f *Forwarder) Pick(port int) []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	targets := f.targetsOf(port)
+	if len(targets) == 1 {
+		return []string{targets[0].Address}
+	}
+
+	// a target degraded by failed health checks gets half its share, one that
+	// refused a connection or is down none while others are left
+	now := time.Now()
+	weight := make(map[string]int)
+	var up, down []string
+	for _, target := range targets {
+		h := f.healthOf(target.Address)
+		switch state := f.state(port, target.Address, now); {
+		case state == "down" || now.Before(h.failedUntil):
+			down = append(down, target.Address)
+		case state == "degraded":
+			up = append(up, target.Address)
+			weight[target.Address] = target.Weight
+		default:
+			up = append(up, target.Address)
+			weight[target.Address] = 2 * target.Weight
+		}
+	}
+	if len(up) == 0 {
+		return down
+	}
+
+	// smooth weighted round-robin: the target furthest behind its share goes
+	// first, the others keep the configured order
+	current := f.current[port]
+	if current == nil {
+		current = make(map[string]int)
+		f.current[port] = current
+	}
+	best, total := 0, 0
+	for i, address := range up {
+		current[address] += weight[address]
+		total += weight[address]
+		if current[address] > current[up[best]] {
+			best = i
+		}
+	}
+	current[up[best]] -= total
+	first := up[best]
+	up = append([]string{first}, slices.Delete(up, best, best+1)...)
+
+	if f.balance[port].Mode == BalanceLeastConn {
+		active := make(map[string]int)
+		for _, address := range f.relays[port] {
+			active[address]++
+		}
+		// stable, so targets with as many connections for their weight still
+		// take turns
+		sort.SliceStable(up, func(i, j int) bool {
+			return active[up[i]]*weight[up[j]] < active[up[j]]*weight[up[i]]
+		})
+	}
+	return append(up, down...)
+}
+
+// Failed marks target of port as refusing connections, it is tried last
+// until the fail timeout of port has passed.
+func (f *Forwarder) Failed(port int, target string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	timeout := f.balance[port].FailTimeout
+	if timeout <= 0 {
+		timeout = defaultFailTimeout
+	}
+	f.healthFor(target).failedUntil = time.Now().Add(timeout)
+}
+
+// healthFor returns the health of a target to update, the caller holds f.mu.
+func (f *Forwarder) healthFor(address string) *health {
+	h, ok := f.health[address]
+	if !ok {
+		h = &health{}
+		f.health[address] = h
+	}
+	return h
+}
+
+// Set points port to targets.
+func (f *Forwarder) Set(port int, targets []Target) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.targets[port] = targets
+	delete(f.current, port)
+}
+
+// Delete removes the entry of port, reporting whether there was one.
+func (f *Forwarder) Delete(port int) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	_, ok := f.targets[port]
+	delete(f.targets, port)
+	delete(f.current, port)
+	return ok
+}
+
+// Targets returns a copy of the entries.
+func (f *Forwarder) Targets() map[int][]Target {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	targets := make(map[int][]Target, len(f.targets))
+	for port, t := range f.targets {
+		targets[port] = append([]Target(nil), t...)
+	}
+	return targets
+}
+
+// Backends returns the targets of port with their weight, state and the
+// connections they relay.
+func (f *Forwarder) Backends(port int) []control.Backend {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+
+	active := make(map[string]int)
+	for _, address := range f.relays[port] {
+		active[address]++
+	}
+	now := time.Now()
+	var backends []control.Backend
+	for _, target := range f.targetsOf(port) {
+		h := f.healthOf(target.Address)
+		backends = append(backends, control.Backend{
+			Target:      target.Address,
+			Weight:      target.Weight,
+			State:       f.state(port, target.Address, now),
+			Connections: active[target.Address],
+			Fails:       h.fails,
+			Error:       h.err,
+		})
+	}
+	return backends
+}
+
+// Track records conn as relaying port to target until the returned function
+// is called.
+func (f *Forwarder) Track(port int, target string, conn net.Conn) func() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.relays[port] == nil {
+		f.relays[port] = make(map[net.Conn]string)
+	}
+	f.relays[port][conn] = target
+
+	return func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		delete(f.relays[port], conn)
+		if len(f.relays[port]) == 0 {
+			delete(f.relays, port)
+		}
+	}
+}
+
+// onTarget reports whether address is one of the current targets of port, the
+// caller holds f.mu.
+func (f *Forwarder) onTarget(port int, address string) bool {
+	for _, target := range f.targetsOf(port) {
+		if target.Address == address {
+			return true
+		}
+	}
+	return false
+}
+
+// Draining returns the number of relays of port still on an older target.
+func (f *Forwarder) Draining(port int) int {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	n := 0
+	for _, address := range f.relays[port] {
+		if !f.onTarget(port, address) {
+			n++
+		}
+	}
+	return n
+}
+
+// Drain closes the relays of port that are not on one of its current targets
+// once after has passed, and returns how many there are now.
+func (f *Forwarder) Drain(port int, after time.Duration) int {
+	f.mu.RLock()
+	targets := f.targetsOf(port)
+	f.mu.RUnlock()
+
+	time.AfterFunc(after, func() {
+		f.mu.RLock()
+		var old []net.Conn
+		for conn, address := range f.relays[port] {
+			drained := true
+			for _, target := range targets {
+				if target.Address == address {
+					drained = false
+				}
+			}
+			if drained {
+				old = append(old, conn)
+			}
+		}
+		f.mu.RUnlock()
+
+		for _, conn := range old {
+			conn.Close()
+		}
+	})
+	return f.Draining(port)
+}
@@ -0,0 +1,82 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// failed health checks in a row before a target is down by default
+const defaultHealthFails = 3
+
+// CheckHealth connects to the targets of the ports with a health_interval
+// until ctx is done. A target that doesn't answer is degraded and gets less
+// traffic, after health_fails checks in a row it is down and gets none.
+func (f *Forwarder) CheckHealth(ctx context.Context, logger *logrus.Logger) {
+	for port, balance := range f.balance {
+		if balance.HealthInterval <= 0 {
+			continue
+		}
+		go func(port int, balance Balance) {
+			ticker := time.NewTicker(balance.HealthInterval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-ctx.Done():
+					return
+				case <-ticker.C:
+					f.checkPort(port, balance, logger)
+				}
+			}
+		}(port, balance)
+	}
+}
+
+// checkPort checks the targets of port at once and waits for the results.
+func (f *Forwarder) checkPort(port int, balance Balance, logger *logrus.Logger) {
+	f.mu.RLock()
+	targets := f.targetsOf(port)
+	f.mu.RUnlock()
+
+	var wg sync.WaitGroup
+	for _, target := range targets {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			conn, err := net.DialTimeout("tcp", address, balance.CheckTimeout)
+			if err == nil {
+				conn.Close()
+			}
+			f.checked(port, address, err, logger)
+		}(target.Address)
+	}
+	wg.Wait()
+}
+
+// checked records the result of a health check and logs when the state of
+// the target changes.
+func (f *Forwarder) checked(port int, address string, err error, logger *logrus.Logger) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	now := time.Now()
+	before := f.state(port, address, now)
+	h := f.healthFor(address)
+	if err != nil {
+		h.fails++
+		h.err = err.Error()
+	} else {
+		h.fails, h.err = 0, ""
+	}
+
+	if after := f.state(port, address, now); after != before {
+		if err != nil {
+			logger.Warnf("forwarder: target %s of port %d is %s: %v", address, port, after, err)
+		} else {
+			logger.Infof("forwarder: target %s of port %d is %s again", address, port, after)
+		}
+	}
+}
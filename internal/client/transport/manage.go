@@ -0,0 +1,18 @@
+package transport
+
+import (
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sirupsen/logrus"
+)
+
+// Manage runs a command the server sent with remote_management on.
+type Manage func(command control.ClientCommand) control.ClientResult
+
+// runCommand runs command with manage and sends the result back with reply.
+func runCommand(manage Manage, command control.ClientCommand, reply func(result control.ClientResult) error, logger *logrus.Logger) {
+	result := manage(command)
+	result.ID = command.ID
+	if err := reply(result); err != nil {
+		logger.Warnf("failed to answer command %d of the server: %v", command.ID, err)
+	}
+}
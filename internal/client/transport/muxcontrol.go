@@ -0,0 +1,107 @@
+package transport
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/xtaci/smux"
+)
+
+// runControlStream opens the control stream of session. It exchanges the
+// versions of both ends, answers the heartbeats of the server with the stats
+// of the client and keeps the ports the server forwards. A session whose
+// server sent nothing for utils.ControlMissed heartbeats is closed, so the
+// client reconnects even if TCP still takes it for alive. Older servers close
+// the stream right away.
+func (c *TcpMuxTransport) runControlStream(session *smux.Session) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "control stream", session)
+	stream, err := session.OpenStream()
+	if err != nil {
+		c.logger.Debugf("failed to open the control stream: %v", err)
+		return
+	}
+	ctrl := utils.NewControlStream(session, stream)
+	defer ctrl.Close()
+	if err := utils.SendBinaryInt(stream, utils.MuxControlStreamPort); err != nil {
+		c.logger.Debugf("failed to open the control stream: %v", err)
+		return
+	}
+
+	if err := ctrl.Write(utils.ControlVersion, []byte(utils.LocalVersion().Encode())); err != nil {
+		c.logger.Debugf("failed to send the version: %v", err)
+		return
+	}
+	if c.config.Manage != nil {
+		if err := ctrl.Write(utils.ControlManaged, nil); err != nil {
+			c.logger.Debugf("failed to offer remote management: %v", err)
+			return
+		}
+	}
+
+	var heartbeat time.Duration // unknown until the hello
+	for {
+		timeout := c.config.Handshake
+		if heartbeat > 0 {
+			timeout = utils.ControlMissed * heartbeat
+		}
+		stream.SetReadDeadline(time.Now().Add(timeout))
+		typ, payload, err := ctrl.Read()
+		if err != nil {
+			var netErr net.Error
+			if heartbeat > 0 && errors.As(err, &netErr) && netErr.Timeout() {
+				c.logger.Warnf("server sent no heartbeat for %v, closing the mux session", timeout)
+				session.Close()
+				return
+			}
+			c.logger.Debugf("control stream ended: %v", err)
+			return
+		}
+
+		switch typ {
+		case utils.ControlHello:
+			if heartbeat, err = utils.HelloHeartbeat(payload); err != nil {
+				c.logger.Debugf("invalid hello on the control stream: %v", err)
+				return
+			}
+		case utils.ControlVersion:
+			version, err := utils.ParseVersion(string(payload))
+			if err != nil {
+				c.logger.Debugf("invalid version on the control stream: %v", err)
+				continue
+			}
+			if err := checkServer(version, c.logger); err != nil {
+				session.Close()
+				return
+			}
+		case utils.ControlUpgrade:
+			c.logger.Errorf("the server refused this client: %s", payload)
+			session.Close()
+			return
+		case utils.ControlPing:
+			if err := ctrl.Write(utils.ControlPong, payload); err != nil {
+				return
+			}
+			ctrl.WriteJSON(utils.ControlStats, clientStats(c.config.Forwarder))
+		case utils.ControlCommand:
+			var command control.ClientCommand
+			if err := json.Unmarshal(payload, &command); err != nil || c.config.Manage == nil {
+				c.logger.Debugf("invalid command on the control stream: %v", err)
+				continue
+			}
+			go runCommand(c.config.Manage, command, func(result control.ClientResult) error {
+				return ctrl.WriteJSON(utils.ControlResult, result)
+			}, c.logger)
+		case utils.ControlPorts:
+			var ports []utils.ControlPort
+			if err := json.Unmarshal(payload, &ports); err != nil {
+				c.logger.Debugf("invalid ports on the control stream: %v", err)
+				continue
+			}
+			c.ports.Store(ports)
+		}
+	}
+}
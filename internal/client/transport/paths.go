@@ -0,0 +1,196 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	pathRetry  = 30 * time.Second // how long a path that failed is skipped
+	pathSample = 5 * time.Second  // how often the throughput of the paths is measured
+)
+
+// path is a way to the server, e.g. over one of two ISPs: the local address
+// the tunnel connections are dialed from, and the server to dial if it
+// differs from remote_addr.
+type path struct {
+	local  *net.TCPAddr
+	remote string
+
+	bytes atomic.Int64 // both ways
+
+	mu    sync.Mutex
+	down  time.Time // when the path last failed, zero while it works
+	fails int       // dials failed in a row
+	err   string    // of the last failed dial
+	last  int64     // bytes at the last sample
+	mbps  float64
+}
+
+// paths spreads the mux sessions of a client over its paths, session i on
+// path i modulo their number, and moves the sessions of a path that fails to
+// the others until it works again. The server spreads the streams over the
+// sessions, so traffic is striped over all paths that work.
+type paths struct {
+	list []*path
+}
+
+// newPaths parses the paths of the config, "LOCAL_IP" or
+// "LOCAL_IP=SERVER:PORT". It returns nil for none.
+func newPaths(specs []string) (*paths, error) {
+	if len(specs) == 0 {
+		return nil, nil
+	}
+	p := &paths{}
+	for _, spec := range specs {
+		local, remote, _ := strings.Cut(spec, "=")
+		ip := net.ParseIP(strings.TrimSpace(local))
+		if ip == nil {
+			return nil, fmt.Errorf("invalid path %q: %q is not an IP address", spec, local)
+		}
+		remote = strings.TrimSpace(remote)
+		if remote != "" {
+			if _, _, err := net.SplitHostPort(remote); err != nil {
+				return nil, fmt.Errorf("invalid path %q: %v", spec, err)
+			}
+		}
+		p.list = append(p.list, &path{local: &net.TCPAddr{IP: ip}, remote: remote})
+	}
+	return p, nil
+}
+
+// pick returns the path for session id: its own while that works, else the
+// next one that does. With all paths down it tries its own again.
+func (p *paths) pick(id int) *path {
+	own := id % len(p.list)
+	for i := range p.list {
+		candidate := p.list[(own+i)%len(p.list)]
+		if candidate.usable() {
+			return candidate
+		}
+	}
+	return p.list[own]
+}
+
+// usable reports whether the path works, or failed long enough ago to be
+// tried again.
+func (pa *path) usable() bool {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	return pa.down.IsZero() || time.Since(pa.down) > pathRetry
+}
+
+// addr returns the server to dial over the path.
+func (pa *path) addr(remote string) string {
+	if pa.remote != "" {
+		return pa.remote
+	}
+	return remote
+}
+
+func (pa *path) String() string {
+	return pa.local.IP.String()
+}
+
+// failed records a failed dial over the path, taking it out of use for
+// pathRetry.
+func (pa *path) failed(err error, logger *logrus.Logger) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if pa.down.IsZero() {
+		logger.Warnf("path %s is down, moving its sessions to the other paths: %v", pa, err)
+	}
+	pa.down = time.Now()
+	pa.fails++
+	pa.err = err.Error()
+}
+
+// reached puts the path back in use once a session was set up over it.
+func (pa *path) reached(logger *logrus.Logger) {
+	pa.mu.Lock()
+	defer pa.mu.Unlock()
+	if !pa.down.IsZero() {
+		logger.Infof("path %s is up again", pa)
+	}
+	pa.down, pa.fails, pa.err = time.Time{}, 0, ""
+}
+
+// count wraps a tunnel connection dialed over the path to count its traffic.
+func (pa *path) count(conn net.Conn) net.Conn {
+	return &pathConn{Conn: conn, path: pa}
+}
+
+// sample measures the throughput of the paths every pathSample until ctx is
+// done.
+func (p *paths) sample(ctx context.Context) {
+	ticker := time.NewTicker(pathSample)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, pa := range p.list {
+			bytes := pa.bytes.Load()
+			pa.mu.Lock()
+			pa.mbps = float64(bytes-pa.last) * 8 / pathSample.Seconds() / 1e6
+			pa.last = bytes
+			pa.mu.Unlock()
+		}
+	}
+}
+
+// status lists the paths for the control API with the number of open
+// sessions of each, remote being the server the paths without one of their
+// own dial.
+func (p *paths) status(remote string, sessions map[*path]int) []control.Path {
+	list := make([]control.Path, 0, len(p.list))
+	for _, pa := range p.list {
+		pa.mu.Lock()
+		state := "up"
+		if !pa.down.IsZero() {
+			state = "down"
+		}
+		list = append(list, control.Path{
+			Local:    pa.String(),
+			Remote:   pa.addr(remote),
+			State:    state,
+			Sessions: sessions[pa],
+			Fails:    pa.fails,
+			Error:    pa.err,
+			Bytes:    pa.bytes.Load(),
+			Mbps:     pa.mbps,
+		})
+		pa.mu.Unlock()
+	}
+	return list
+}
+
+// pathConn counts the traffic of a tunnel connection for its path.
+type pathConn struct {
+	net.Conn
+	path *path
+}
+
+func (c *pathConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.path.bytes.Add(int64(n))
+	return n, err
+}
+
+func (c *pathConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.path.bytes.Add(int64(n))
+	return n, err
+}
@@ -0,0 +1,36 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// speedtest answers a speedtest the server runs through the tunnel.
+func (c *TcpTransport) speedtest(conn net.Conn) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "speedtest", conn)
+	defer conn.Close()
+	if err := utils.ServeSpeedtest(conn); err != nil {
+		c.logger.Debugf("speedtest stream closed: %v", err)
+	}
+}
+
+// speedtest answers a speedtest the server runs through the tunnel.
+func (c *TcpMuxTransport) speedtest(conn net.Conn) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "speedtest", conn)
+	defer conn.Close()
+	if err := utils.ServeSpeedtest(conn); err != nil {
+		c.logger.Debugf("speedtest stream closed: %v", err)
+	}
+}
+
+// speedtest answers a speedtest the server runs through the tunnel.
+func (c *WsTransport) speedtest(conn *websocket.Conn) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "speedtest", conn)
+	defer conn.Close()
+	if err := utils.ServeSpeedtest(&utils.WSStream{Conn: conn}); err != nil {
+		c.logger.Debugf("speedtest stream closed: %v", err)
+	}
+}
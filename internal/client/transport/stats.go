@@ -0,0 +1,106 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/shirou/gopsutil/v4/cpu"
+	"github.com/shirou/gopsutil/v4/mem"
+)
+
+// dialCounts counts the dials to targets within the last minute, by second.
+type dialCounts struct {
+	mu      sync.Mutex
+	seconds [60]struct {
+		at           int64 // unix second the counts are of
+		dials, fails int64
+	}
+}
+
+// add counts a dial that failed or not.
+func (d *dialCounts) add(failed bool) {
+	now := time.Now().Unix()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	second := &d.seconds[now%int64(len(d.seconds))]
+	if second.at != now {
+		second.at, second.dials, second.fails = now, 0, 0
+	}
+	second.dials++
+	if failed {
+		second.fails++
+	}
+}
+
+// lastMinute returns the dials within the last minute and how many of them
+// failed.
+func (d *dialCounts) lastMinute() (dials, fails int64) {
+	now := time.Now().Unix()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, second := range d.seconds {
+		if now-second.at < int64(len(d.seconds)) {
+			dials += second.dials
+			fails += second.fails
+		}
+	}
+	return dials, fails
+}
+
+// states counts the targets of the forwarder entries, and of them those
+// degraded and down.
+func (f *Forwarder) states() (backends, degraded, down int) {
+	f.mu.RLock()
+	defer f.mu.RUnlock()
+	now := time.Now()
+	for port, targets := range f.targets {
+		for _, target := range targets {
+			backends++
+			switch f.state(port, target.Address, now) {
+			case "degraded":
+				degraded++
+			case "down":
+				down++
+			}
+		}
+	}
+	return backends, degraded, down
+}
+
+// the report of the last second, the control streams of all mux sessions
+// ask for it at once
+var lastStats struct {
+	sync.Mutex
+	at    time.Time
+	stats control.ClientStats
+}
+
+// clientStats returns what the client reports to the server with each
+// heartbeat, and shows it on the dashboard too.
+func clientStats(forwarder *Forwarder) control.ClientStats {
+	lastStats.Lock()
+	defer lastStats.Unlock()
+	if time.Since(lastStats.at) < time.Second {
+		return lastStats.stats
+	}
+
+	stats := control.ClientStats{Relays: utils.ActiveRelays(), Version: utils.Version}
+	if forwarder != nil {
+		stats.Backends, stats.Degraded, stats.Down = forwarder.states()
+		stats.Dials, stats.DialErrors = forwarder.dials.lastMinute()
+	}
+	// since the last call, the first one since boot
+	if percent, err := cpu.Percent(0, false); err == nil && len(percent) > 0 {
+		stats.CPU = percent[0]
+	}
+	if memory, err := mem.VirtualMemory(); err == nil {
+		stats.Memory = memory.UsedPercent
+	}
+	web.RecordClientStats(stats.String())
+
+	lastStats.at, lastStats.stats = time.Now(), stats
+	return stats
+}
@@ -0,0 +1,108 @@
+package transport
+
+import (
+	"sort"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/xtaci/smux"
+)
+
+// Tunnel is what the control API sees of a running transport.
+type Tunnel interface {
+	TunnelStatus() string
+	Sessions() []control.Session
+	Paths() []control.Path
+	Ports() []utils.ControlPort
+	Restart()
+}
+
+func (c *TcpTransport) TunnelStatus() string { return c.config.TunnelStatus.String() }
+
+// Sessions lists the control channel.
+func (c *TcpTransport) Sessions() []control.Session {
+	conn := c.control()
+	if conn == nil {
+		return nil
+	}
+	return []control.Session{{RemoteAddr: conn.RemoteAddr().String()}}
+}
+
+// Paths lists nothing, paths are only supported by tcpmux.
+func (c *TcpTransport) Paths() []control.Path { return nil }
+
+// Ports lists nothing, the server only sends them over tcpmux.
+func (c *TcpTransport) Ports() []utils.ControlPort { return nil }
+
+func (c *WsTransport) TunnelStatus() string { return c.config.TunnelStatus.String() }
+
+// Sessions lists the control channel.
+func (c *WsTransport) Sessions() []control.Session {
+	conn := c.controlChannel.Load()
+	if conn == nil {
+		return nil
+	}
+	return []control.Session{{RemoteAddr: conn.RemoteAddr().String()}}
+}
+
+// Paths lists nothing, paths are only supported by tcpmux.
+func (c *WsTransport) Paths() []control.Path { return nil }
+
+// Ports lists nothing, the server only sends them over tcpmux.
+func (c *WsTransport) Ports() []utils.ControlPort { return nil }
+
+func (c *TcpMuxTransport) TunnelStatus() string { return c.config.TunnelStatus.String() }
+
+// Sessions lists the open mux sessions with their stream counts, including
+// the extra ones the server asked for.
+func (c *TcpMuxTransport) Sessions() []control.Session {
+	var sessions []control.Session
+	add := func(id int, session *smux.Session) {
+		if session == nil || session.IsClosed() {
+			return
+		}
+		sessions = append(sessions, control.Session{
+			ID:         id,
+			RemoteAddr: session.RemoteAddr().String(),
+			Streams:    utils.Streams(session),
+		})
+	}
+
+	for id, session := range c.state().smuxSession {
+		add(id, session)
+	}
+	c.extraMu.Lock()
+	for id, session := range c.extra {
+		add(id, session)
+	}
+	c.extraMu.Unlock()
+
+	sort.SliceStable(sessions, func(i, j int) bool { return sessions[i].ID < sessions[j].ID })
+	return sessions
+}
+
+// Paths lists the paths with their health, traffic and open sessions, nil
+// without paths.
+func (c *TcpMuxTransport) Paths() []control.Path {
+	if c.paths == nil {
+		return nil
+	}
+	open := make(map[*path]int)
+	c.sessionPaths.Range(func(key, value any) bool {
+		if session := key.(*smux.Session); session.IsClosed() {
+			c.sessionPaths.Delete(session)
+		} else {
+			open[value.(*path)]++
+		}
+		return true
+	})
+	return c.paths.status(c.remotes.addr(), open)
+}
+
+// Ports lists the target ports the server forwards, as it sent them over
+// the control stream.
+func (c *TcpMuxTransport) Ports() []utils.ControlPort {
+	ports, _ := c.ports.Load().([]utils.ControlPort)
+	return ports
+}
@@ -0,0 +1,96 @@
+package transport
+
+import (
+	"net"
+	"strconv"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// TargetTimeouts overrides the client's dial and read timeouts for the targets
+// of a port, zero keeps the client's value.
+type TargetTimeouts struct {
+	Dial time.Duration
+	Read time.Duration
+}
+
+// targetTimeouts returns the dial and read timeouts for the target of port.
+func targetTimeouts(overrides map[int]TargetTimeouts, port int, dial, read time.Duration) (time.Duration, time.Duration) {
+	if t, ok := overrides[port]; ok {
+		if t.Dial > 0 {
+			dial = t.Dial
+		}
+		if t.Read > 0 {
+			read = t.Read
+		}
+	}
+	return dial, read
+}
+
+// describeStream puts what the server told about the public connection
+// behind a stream on its span and in the debug log. meta is nil with servers
+// that send none.
+func describeStream(span *tracing.Span, port uint16, meta *utils.StreamMeta, logger *logrus.Logger) {
+	if meta == nil {
+		return
+	}
+	span.SetAttr("visitor", meta.Src)
+	span.SetAttr("public_port", strconv.Itoa(meta.Dst))
+	public := "public port " + strconv.Itoa(meta.Dst)
+	if meta.Name != "" {
+		span.SetAttr("mapping", meta.Name)
+		public += " (" + meta.Name + ")"
+	}
+	if meta.To != "" {
+		span.SetAttr("destination", meta.To)
+		public += " headed to " + meta.To
+	}
+	logger.Debugf("stream for port %d from %s on %s, accepted by the server at %s", port, meta.Src, public, meta.Accepted.Format(time.RFC3339Nano))
+}
+
+// dialTarget dials the targets the forwarder picks for port until one
+// answers, and returns the connection with its target. Targets that don't
+// answer are marked as failed so the next connections try them last. A
+// connection the server took on transparent_addr goes where it was headed,
+// if allowed_targets lets it.
+func dialTarget(forwarder *Forwarder, port int, meta *utils.StreamMeta, allowed *utils.TargetACL, span *tracing.Span, logger *logrus.Logger, dial func(address string) (*net.TCPConn, error)) (*net.TCPConn, string, error) {
+	targets := forwarder.Pick(port)
+	redirected := meta != nil && meta.To != ""
+	if redirected {
+		targets = []string{meta.To}
+	}
+
+	var lastErr error
+	for _, target := range targets {
+		child := span.Child("dial_local", "target", target)
+		addresses, err := utils.ResolveTarget(target, allowed)
+		if err != nil {
+			logger.Warnf("refusing to dial %s: %v", target, err)
+			child.End(err)
+			lastErr = err
+			continue
+		}
+
+		// a host name may have several addresses, some gone since the lookup
+		for _, address := range addresses {
+			var conn *net.TCPConn
+			if conn, err = dial(address); err == nil {
+				child.End(nil)
+				forwarder.dials.add(false)
+				return conn, target, nil
+			}
+		}
+		forwarder.dials.add(true)
+		logger.Errorf("Failed to connect to local address %s: %v", target, err)
+		if !redirected {
+			forwarder.Failed(port, target)
+		}
+		utils.ExpireTarget(target)
+		child.End(err)
+		lastErr = err
+	}
+	return nil, "", lastErr
+}
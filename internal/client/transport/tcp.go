@@ -2,11 +2,20 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"io"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/tun"
 	"github.com/sahmadiut/backhaul/internal/utils"
 	"github.com/sahmadiut/backhaul/internal/web"
 
@@ -15,49 +24,97 @@ import (
 
 type TcpTransport struct {
 	config         *TcpConfig
-	ctx            context.Context
-	cancel         context.CancelFunc
+	current        atomic.Pointer[tcpState] // replaced by each Restart
 	logger         *logrus.Logger
-	controlChannel net.Conn
+	controlMu      sync.Mutex
+	controlChannel net.Conn // nil until connected, see control
 	timeout        time.Duration
 	restartMutex   sync.Mutex
+	flaps          *flapDamper
+	remotes        *remotes // remote_addr, then the standby_addrs
 	heartbeatSig   string
 	chanSignal     string
-	usageMonitor   *web.Usage
 }
-type TcpConfig struct {
-	RemoteAddr    string
-	Nodelay       bool
-	KeepAlive     time.Duration
-	RetryInterval time.Duration
-	Token         string
-	Forwarder     map[int]string
-	Sniffer       bool
-	WebPort       int
-	SnifferLog    string
-	TunnelStatus  string
+
+// tcpState is what a TcpTransport starts over with on Restart. It is replaced
+// whole, as the goroutines of the transport read it at any time.
+type tcpState struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	usageMonitor *web.Usage
 }
 
-func NewTCPClient(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
-	// Create a derived context from the parent context
+func newTCPState(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *tcpState {
 	ctx, cancel := context.WithCancel(parentCtx)
+	return &tcpState{
+		ctx:          ctx,
+		cancel:       cancel,
+		usageMonitor: web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+	}
+}
+
+type TcpConfig struct {
+	RemoteAddr     string
+	StandbyAddrs   []string // servers to fail over to
+	Nodelay        bool
+	AutoNodelay    bool
+	KeepAlive      utils.Keepalive
+	RetryInterval  time.Duration
+	Token          string
+	PlainToken     bool   // send the token itself instead of signing it
+	ClientID       string // sent to the server after the token
+	FlapThreshold  int    // restarts within an hour before waiting longer to reconnect
+	Forwarder      *Forwarder
+	Manage         Manage // runs the commands of the server, nil without remote_management
+	AllowedPorts   utils.PortRanges
+	AllowedTargets *utils.TargetACL
+	TargetTimeouts map[int]TargetTimeouts
+	Tun            *tun.Link         // takes the packets of a TUN device, nil without tun_addr
+	DNS            *dnsfwd.Forwarder // sends DNS queries to the server, nil without dns_listen
+	Proxy          *exitnode.Proxy   // takes tunnel connections for its proxy listeners, nil without socks_bind and http_proxy_bind
+	DialTimeout    time.Duration
+	Handshake      time.Duration
+	ReadTimeout    time.Duration
+	Sniffer        bool
+	WebPort        int
+	SnifferLog     string
+	TunnelStatus   web.Status
+}
 
+func NewTCPClient(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
 	// Initialize the TcpTransport struct
 	client := &TcpTransport{
-		config:         config,
-		ctx:            ctx,
-		cancel:         cancel,
-		logger:         logger,
-		controlChannel: nil,             // will be set when a control connection is established
-		timeout:        5 * time.Second, // Default timeout
-		heartbeatSig:   "0",             // Default heartbeat signal
-		chanSignal:     "1",             // Default channel signal
-		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		config:       config,
+		flaps:        newFlapDamper(config.FlapThreshold),
+		remotes:      newRemotes(config.RemoteAddr, config.StandbyAddrs),
+		logger:       logger,
+		timeout:      config.DialTimeout,
+		heartbeatSig: "0", // Default heartbeat signal
+		chanSignal:   "1", // Default channel signal
 	}
+	client.current.Store(newTCPState(parentCtx, config, logger))
 
 	return client
 }
 
+// state returns what the transport runs with since the last Restart.
+func (c *TcpTransport) state() *tcpState {
+	return c.current.Load()
+}
+
+// control returns the control channel, nil while there is none.
+func (c *TcpTransport) control() net.Conn {
+	c.controlMu.Lock()
+	defer c.controlMu.Unlock()
+	return c.controlChannel
+}
+
+func (c *TcpTransport) setControl(conn net.Conn) {
+	c.controlMu.Lock()
+	c.controlChannel = conn
+	c.controlMu.Unlock()
+}
+
 func (c *TcpTransport) Restart() {
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
@@ -66,20 +123,18 @@ func (c *TcpTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
-	if c.cancel != nil {
-		c.cancel()
-	}
+	c.state().cancel()
 
-	time.Sleep(2 * time.Second)
+	time.Sleep(c.flaps.restarted(c.logger))
 
-	ctx, cancel := context.WithCancel(context.Background())
-	c.ctx = ctx
-	c.cancel = cancel
-
-	// Re-initialize variables
-	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	// Re-initialize variables, the server drops a control channel only
+	// once it is closed
+	c.current.Store(newTCPState(context.Background(), c.config, c.logger))
+	if control := c.control(); control != nil {
+		control.Close()
+	}
+	c.setControl(nil)
+	c.config.TunnelStatus.Set("")
 
 	go c.ChannelDialer()
 
@@ -88,34 +143,42 @@ func (c *TcpTransport) Restart() {
 func (c *TcpTransport) ChannelDialer() {
 	// for  webui
 	if c.config.WebPort > 0 {
-		go c.usageMonitor.Monitor()
+		go c.state().usageMonitor.Monitor()
 	}
 
-	c.config.TunnelStatus = "Disconnected (TCP)"
+	c.config.TunnelStatus.Set("Disconnected (TCP)")
 
-	for c.controlChannel == nil {
+	for c.control() == nil {
 		select {
-		case <-c.ctx.Done():
+		case <-c.state().ctx.Done():
 			return
 		default:
 			c.logger.Info("trying to establish a new control channel connection")
-			tunnelTCPConn, err := c.tcpDialer(c.config.RemoteAddr, c.config.Nodelay)
+			remote := c.remotes.addr()
+			span := tracing.Start("connect", "remote", remote)
+			tunnelTCPConn, err := c.tcpDialer(remote, c.config.Nodelay, c.timeout)
 			if err != nil {
-				c.logger.Errorf("error dialing remote address %s: %v", c.config.RemoteAddr, err)
+				c.logger.Errorf("error dialing remote address %s: %v", remote, err)
+				c.remotes.failed(c.logger)
+				span.End(err)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
+			auth := span.Child("auth")
 
 			// Sending security token
-			err = utils.SendBinaryString(tunnelTCPConn, c.config.Token)
+			token, nonce := utils.HandshakeToken(c.config.Token, c.config.PlainToken)
+			err = utils.SendBinaryString(tunnelTCPConn, token)
 			if err != nil {
 				c.logger.Errorf("failed to send security token: %v", err)
 				tunnelTCPConn.Close()
+				auth.End(err)
+				span.End(err)
 				continue
 			}
 
 			// Set a read deadline for the token response
-			if err := tunnelTCPConn.SetReadDeadline(time.Now().Add(2 * time.Second)); err != nil {
+			if err := tunnelTCPConn.SetReadDeadline(time.Now().Add(c.config.Handshake)); err != nil {
 				c.logger.Errorf("failed to set read deadline: %v", err)
 			}
 
@@ -128,24 +191,60 @@ func (c *TcpTransport) ChannelDialer() {
 					c.logger.Errorf("Failed to receive control channel response: %v", err)
 				}
 				tunnelTCPConn.Close() // Close connection on error or timeout
+				c.remotes.failed(c.logger)
+				auth.End(err)
+				span.End(err)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
 
-			if message == c.config.Token {
-				c.controlChannel = tunnelTCPConn
+			// the token itself from servers that take it plain
+			want := c.config.Token
+			if nonce != "" {
+				want = utils.TokenReply(c.config.Token, nonce)
+			}
+			if message == want {
+				auth.End(nil)
+				span.End(nil)
+				c.setControl(tunnelTCPConn)
+				c.remotes.reached()
 				c.logger.Info("control channel established successfully")
 
-				c.config.TunnelStatus = "Connected (TCP)"
+				c.config.TunnelStatus.Set("Connected (TCP)")
 
 				// Resetting the deadline (removes any existing deadline)
 				tunnelTCPConn.SetReadDeadline(time.Time{})
+
+				// older servers never read it
+				if err := utils.SendBinaryString(tunnelTCPConn, utils.ClientIDMessage(c.config.ClientID)); err != nil {
+					c.logger.Warnf("failed to send the client ID: %v", err)
+				}
+				if err := utils.SendBinaryString(tunnelTCPConn, utils.VersionMessage(utils.LocalVersion())); err != nil {
+					c.logger.Warnf("failed to send the version: %v", err)
+				}
+				if err := utils.SendBinaryString(tunnelTCPConn, utils.AcksMessage); err != nil {
+					c.logger.Warnf("failed to ask for numbered channel signals: %v", err)
+				}
+				if err := utils.SendBinaryString(tunnelTCPConn, utils.MetaMessage); err != nil {
+					c.logger.Warnf("failed to ask for stream metadata: %v", err)
+				}
+				if err := utils.SendBinaryString(tunnelTCPConn, utils.StatsMessage); err != nil {
+					c.logger.Warnf("failed to offer stats reports: %v", err)
+				}
+				if c.config.Manage != nil {
+					if err := utils.SendBinaryString(tunnelTCPConn, utils.CommandsMessage); err != nil {
+						c.logger.Warnf("failed to offer remote management: %v", err)
+					}
+				}
 				go c.channelListener()
+				go watchLocalAddr(c.state().ctx, tunnelTCPConn, c.Restart, c.logger)
 
 				return
 			} else {
-				c.logger.Errorf("Invalid token received. Expected: %s, Received: %s. Retrying...", c.config.Token, message)
+				c.logger.Errorf("Invalid token received: %s. Retrying...", message)
 				tunnelTCPConn.Close() // Close connection if the token is invalid
+				auth.End(errInvalidToken)
+				span.End(errInvalidToken)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
@@ -155,23 +254,48 @@ func (c *TcpTransport) ChannelDialer() {
 
 // listen to the channel signals
 func (c *TcpTransport) channelListener() {
-	for c.controlChannel != nil {
+	for c.control() != nil {
 		select {
-		case <-c.ctx.Done():
+		case <-c.state().ctx.Done():
 			return
 		default:
-			msg, err := utils.ReceiveBinaryString(c.controlChannel)
+			msg, err := utils.ReceiveBinaryString(c.control())
 			if err != nil {
 				c.logger.Error("error receiving channel signal, restarting client")
 				go c.Restart()
 				return
 			}
-			switch msg {
+			if reason, ok := utils.ParseUpgrade(msg); ok {
+				c.logger.Errorf("the server refused this client: %s", reason)
+				go c.Restart()
+				return
+			}
+			if version, ok := utils.ParseVersionMessage(msg); ok {
+				if err := checkServer(version, c.logger); err != nil {
+					go c.Restart()
+					return
+				}
+				continue
+			}
+			if command, ok := utils.ParseCommand(msg); ok && c.config.Manage != nil {
+				conn := c.control()
+				go runCommand(c.config.Manage, command, func(result control.ClientResult) error {
+					return utils.SendBinaryString(conn, utils.ResultMessage(result))
+				}, c.logger)
+				continue
+			}
+			sig, seq := utils.ParseSignal(msg)
+			switch sig {
 			case c.chanSignal:
 				c.logger.Debug("channel signal received, initiating tunnel dialer")
-				go c.tunnelDialer()
+				go c.tunnelDialer(c.control(), seq)
 			case c.heartbeatSig:
 				c.logger.Debug("heartbeat signal received successfully")
+				if seq != 0 { // the server asks for the stats
+					if err := utils.SendBinaryString(c.control(), utils.ClientStatsMessage(clientStats(c.config.Forwarder))); err != nil {
+						c.logger.Debugf("failed to report stats: %v", err)
+					}
+				}
 			default:
 				c.logger.Errorf("unexpected response from channel: %s. Restarting client...", msg)
 				go c.Restart()
@@ -184,20 +308,27 @@ func (c *TcpTransport) channelListener() {
 
 }
 
-// Dialing to the tunnel server, chained functions, without retry
-func (c *TcpTransport) tunnelDialer() {
+// Dialing to the tunnel server, chained functions, without retry. The server
+// is told on control whether it worked if it numbered the signal with seq.
+func (c *TcpTransport) tunnelDialer(control net.Conn, seq uint64) {
 	select {
-	case <-c.ctx.Done():
+	case <-c.state().ctx.Done():
 		return
 	default:
-		if c.controlChannel == nil {
+		if control == nil {
 			c.logger.Warn("No control channel found, cannot initiate tunnel dialer")
 			return
 		}
-		c.logger.Debugf("Initiating new connection to tunnel server at %s", c.config.RemoteAddr)
+		remote := c.remotes.addr()
+		c.logger.Debugf("Initiating new connection to tunnel server at %s", remote)
 
 		// Dial to the tunnel server
-		tunnelTCPConn, err := c.tcpDialer(c.config.RemoteAddr, c.config.Nodelay)
+		tunnelTCPConn, err := c.tcpDialer(remote, c.config.Nodelay, c.timeout)
+		if seq != 0 {
+			if err := utils.SendBinaryString(control, utils.AckMessage(seq, err)); err != nil {
+				c.logger.Debugf("failed to acknowledge channel signal %d: %v", seq, err)
+			}
+		}
 		if err != nil {
 			c.logger.Error("failed to dial tunnel server: ", err)
 			return
@@ -207,57 +338,85 @@ func (c *TcpTransport) tunnelDialer() {
 }
 
 func (c *TcpTransport) handleTCPSession(tcpsession net.Conn) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "tunnel connection", tcpsession)
 	select {
-	case <-c.ctx.Done():
+	case <-c.state().ctx.Done():
 		return
 	default:
-		port, err := utils.ReceiveBinaryInt(tcpsession)
+		port, meta, err := utils.ReceiveStreamHeader(tcpsession)
+		if errors.Is(err, io.EOF) {
+			// the server closed it unused, e.g. its pool was idle
+			c.logger.Debugf("tunnel connection %s closed before use", tcpsession.RemoteAddr().String())
+			tcpsession.Close()
+			return
+		}
 		if err != nil {
 			c.logger.Errorf("Failed to receive port from tunnel connection %s: %v", tcpsession.RemoteAddr().String(), err)
 			tcpsession.Close()
 			return
 		}
-		go c.localDialer(tcpsession, port)
+		if port == utils.SpeedtestPort {
+			go c.speedtest(tcpsession)
+			return
+		}
+		if port == tun.Port && c.config.Tun != nil {
+			go c.config.Tun.Serve(tcpsession)
+			return
+		}
+		if port == dnsfwd.Port && c.config.DNS != nil {
+			go c.config.DNS.Serve(tcpsession)
+			return
+		}
+		if port == exitnode.Port && c.config.Proxy != nil {
+			c.config.Proxy.Serve(tcpsession)
+			return
+		}
+		go c.localDialer(tcpsession, port, meta)
 
 	}
 }
 
-func (c *TcpTransport) localDialer(tunnelConnection net.Conn, port uint16) {
+func (c *TcpTransport) localDialer(tunnelConnection net.Conn, port uint16, meta *utils.StreamMeta) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "local dial", tunnelConnection)
 	select {
-	case <-c.ctx.Done():
+	case <-c.state().ctx.Done():
 		return
 	default:
-		localAddress, ok := c.config.Forwarder[int(port)]
-		if !ok {
-			localAddress = fmt.Sprintf("127.0.0.1:%d", port)
+		span := tracing.Start("forward", "port", strconv.Itoa(int(port)))
+		describeStream(span, port, meta, c.logger)
+		if len(c.config.AllowedPorts) > 0 && !c.config.AllowedPorts.Contains(int(port)) {
+			c.logger.Warnf("refusing to dial port %d, it is not in allowed_ports", port)
+			tunnelConnection.Close()
+			span.End(errPortNotAllowed)
+			return
 		}
 
-		localConnection, err := c.tcpDialer(localAddress, c.config.Nodelay)
+		dialTimeout, readTimeout := targetTimeouts(c.config.TargetTimeouts, int(port), c.config.DialTimeout, c.config.ReadTimeout)
+		dialStart := time.Now()
+		localConnection, localAddress, err := dialTarget(c.config.Forwarder, int(port), meta, c.config.AllowedTargets, span, c.logger, func(address string) (*net.TCPConn, error) {
+			return c.tcpDialer(address, c.config.Nodelay, dialTimeout)
+		})
 		if err != nil {
-			c.logger.Errorf("Failed to connect to local address %s: %v", localAddress, err)
 			tunnelConnection.Close()
+			span.End(err)
 			return
 		}
+		localConn := utils.TimeDialed(utils.WithReadTimeout(localConnection, readTimeout), int(port), c.state().usageMonitor, dialStart)
 		c.logger.Debugf("connected to local address %s successfully", localAddress)
-		go utils.ConnectionHandler(localConnection, tunnelConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+		release := c.config.Forwarder.Track(int(port), localAddress, localConnection)
+		go span.Relay(func() string {
+			defer release()
+			return utils.ConnectionHandler(utils.AutoNodelay(localConn, c.config.AutoNodelay), utils.AutoNodelay(tunnelConnection, c.config.AutoNodelay), c.logger, c.state().usageMonitor, int(port), c.config.Sniffer)
+		})
 	}
 }
 
-func (c *TcpTransport) tcpDialer(address string, tcpnodelay bool) (*net.TCPConn, error) {
-	// Resolve the address to a TCP address
-	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
-	if err != nil {
-		return nil, err
-	}
-
+func (c *TcpTransport) tcpDialer(address string, tcpnodelay bool, timeout time.Duration) (*net.TCPConn, error) {
 	// options
-	dialer := &net.Dialer{
-		Timeout:   c.timeout,          // Set the connection timeout
-		KeepAlive: c.config.KeepAlive, // Set the keep-alive duration
-	}
+	dialer := c.config.KeepAlive.Dialer(timeout)
 
-	// Dial the TCP connection with a timeout
-	conn, err := dialer.Dial("tcp", tcpAddr.String())
+	// Dial the TCP connection with a timeout, racing the addresses of a host name
+	conn, err := utils.DialRace(dialer, address)
 	if err != nil {
 		return nil, err
 	}
@@ -2,11 +2,20 @@ package transport
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/tls"
 	"fmt"
 	"net"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/noise"
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/tun"
 	"github.com/sahmadiut/backhaul/internal/utils"
 	"github.com/sahmadiut/backhaul/internal/web"
 
@@ -16,23 +25,63 @@ import (
 
 type TcpMuxTransport struct {
 	config       *TcpMuxConfig
-	ctx          context.Context
-	cancel       context.CancelFunc
+	current      atomic.Pointer[tcpMuxState] // replaced by each Restart
 	logger       *logrus.Logger
-	smuxSession  []*smux.Session
+	extraMu      sync.Mutex
+	extra        map[int]*smux.Session // sessions the server asked for beyond mux_session, by its slot
 	restartMutex sync.Mutex
+	flaps        *flapDamper
+	remotes      *remotes     // remote_addr, then the standby_addrs
+	paths        *paths       // to spread the sessions over, nil for the default route
+	sessionPaths sync.Map     // *smux.Session -> *path it was dialed over
+	leaving      sync.Map     // *smux.Session the server is closing -> struct{}
+	ports        atomic.Value // []utils.ControlPort the server forwards, sent over the control stream
 	timeout      time.Duration
+}
+
+// tcpMuxState is what a TcpMuxTransport starts over with on Restart. It is
+// replaced whole, as the goroutines of the transport read it at any time.
+type tcpMuxState struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	smuxSession  []*smux.Session
 	usageMonitor *web.Usage
 }
 
+func newTcpMuxState(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *tcpMuxState {
+	ctx, cancel := context.WithCancel(parentCtx)
+	return &tcpMuxState{
+		ctx:          ctx,
+		cancel:       cancel,
+		smuxSession:  make([]*smux.Session, config.MuxSession),
+		usageMonitor: web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+	}
+}
+
 type TcpMuxConfig struct {
 	RemoteAddr       string
+	StandbyAddrs     []string // servers to fail over to
+	Paths            []string // local addresses, optionally =server, to spread the sessions over
 	Nodelay          bool
-	KeepAlive        time.Duration
+	AutoNodelay      bool
+	KeepAlive        utils.Keepalive
 	RetryInterval    time.Duration
 	Token            string
+	PlainToken       bool   // send the token itself instead of signing it
+	ClientID         string // sent to the server after the token
+	FlapThreshold    int    // restarts within an hour before waiting longer to reconnect
 	MuxSession       int
-	Forwarder        map[int]string
+	Forwarder        *Forwarder
+	Manage           Manage // runs the commands of the server, nil without remote_management
+	AllowedPorts     utils.PortRanges
+	AllowedTargets   *utils.TargetACL
+	TargetTimeouts   map[int]TargetTimeouts
+	Tun              *tun.Link         // takes the packets of a TUN device, nil without tun_addr
+	DNS              *dnsfwd.Forwarder // sends DNS queries to the server, nil without dns_listen
+	Proxy            *exitnode.Proxy   // takes tunnel connections for its proxy listeners, nil without socks_bind and http_proxy_bind
+	DialTimeout      time.Duration
+	Handshake        time.Duration
+	ReadTimeout      time.Duration
 	MuxVersion       int
 	MaxFrameSize     int
 	MaxReceiveBuffer int
@@ -40,27 +89,41 @@ type TcpMuxConfig struct {
 	Sniffer          bool
 	WebPort          int
 	SnifferLog       string
-	TunnelStatus     string
+	TunnelStatus     web.Status
+	TLSConfig        *tls.Config      // wraps tunnel connections, nil for plain TCP
+	NoiseKey         *ecdh.PrivateKey // secures tunnel connections with Noise_IK, nil for none
+	NoiseServerKey   *ecdh.PublicKey  // of the server, with NoiseKey
 }
 
 func NewMuxClient(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *TcpMuxTransport {
-	// Create a derived context from the parent context
-	ctx, cancel := context.WithCancel(parentCtx)
+	paths, err := newPaths(config.Paths)
+	if err != nil {
+		logger.Fatalf("%v", err)
+	}
+	if paths != nil {
+		go paths.sample(parentCtx)
+	}
 
 	// Initialize the TcpTransport struct
 	client := &TcpMuxTransport{
-		config:       config,
-		ctx:          ctx,
-		cancel:       cancel,
-		logger:       logger,
-		smuxSession:  make([]*smux.Session, config.MuxSession),
-		timeout:      5 * time.Second, // Default timeout
-		usageMonitor: web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		config:  config,
+		flaps:   newFlapDamper(config.FlapThreshold),
+		remotes: newRemotes(config.RemoteAddr, config.StandbyAddrs),
+		paths:   paths,
+		logger:  logger,
+		extra:   make(map[int]*smux.Session),
+		timeout: config.DialTimeout,
 	}
+	client.current.Store(newTcpMuxState(parentCtx, config, logger))
 
 	return client
 }
 
+// state returns what the transport runs with since the last restart.
+func (c *TcpMuxTransport) state() *tcpMuxState {
+	return c.current.Load()
+}
+
 func (c *TcpMuxTransport) Restart() {
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
@@ -69,20 +132,35 @@ func (c *TcpMuxTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
-	if c.cancel != nil {
-		c.cancel()
+	c.restart(c.flaps.restarted(c.logger))
+}
+
+// reconnect dials new sessions when the server is going away. Unlike a
+// Restart it doesn't count as a flap, and it does nothing while the client
+// reconnects already, as every session is told.
+func (c *TcpMuxTransport) reconnect() {
+	if !c.restartMutex.TryLock() {
+		return
 	}
+	defer c.restartMutex.Unlock()
 
-	time.Sleep(2 * time.Second)
+	c.logger.Info("server is going away, reconnecting...")
+	c.restart(restartDelay)
+}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	c.ctx = ctx
-	c.cancel = cancel
+// restart starts over after delay. The old sessions are left to the server
+// to close.
+func (c *TcpMuxTransport) restart(delay time.Duration) {
+	c.state().cancel()
+
+	time.Sleep(delay)
 
 	// Re-initialize variables
-	c.smuxSession = make([]*smux.Session, c.config.MuxSession)
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	c.current.Store(newTcpMuxState(context.Background(), c.config, c.logger))
+	c.extraMu.Lock()
+	c.extra = make(map[int]*smux.Session)
+	c.extraMu.Unlock()
+	c.config.TunnelStatus.Set("")
 
 	go c.MuxDialer()
 
@@ -91,109 +169,305 @@ func (c *TcpMuxTransport) Restart() {
 func (c *TcpMuxTransport) MuxDialer() {
 	// for  webui
 	if c.config.WebPort > 0 {
-		go c.usageMonitor.Monitor()
+		go c.state().usageMonitor.Monitor()
 	}
 
-	c.config.TunnelStatus = "Disconnected (TCPMux)"
+	c.config.TunnelStatus.Set("Disconnected (TCPMux)")
 
+	remote := c.remotes.addr()
 	for id := 0; id < c.config.MuxSession; id++ {
-	innerloop:
 		for {
 			select {
-			case <-c.ctx.Done():
+			case <-c.state().ctx.Done():
 				return
 			default:
-				c.logger.Debugf("initiating new mux session to address %s (session ID: %d)", c.config.RemoteAddr, id)
-				// Dial to the tunnel server
-				tunnelTCPConn, err := c.tcpDialer(c.config.RemoteAddr, c.config.Nodelay)
-				if err != nil {
-					c.logger.Errorf("failed to dial tunnel server at %s: %v", c.config.RemoteAddr, err)
-					time.Sleep(c.config.RetryInterval)
-					continue
-				}
-
-				// config fot smux
-				config := smux.Config{
-					Version:           c.config.MuxVersion, // Smux protocol version
-					KeepAliveInterval: 10 * time.Second,    // Shorter keep-alive interval to quickly detect dead peers
-					KeepAliveTimeout:  30 * time.Second,    // Aggressive timeout to handle unresponsive connections
-					MaxFrameSize:      c.config.MaxFrameSize,
-					MaxReceiveBuffer:  c.config.MaxReceiveBuffer,
-					MaxStreamBuffer:   c.config.MaxStreamBuffer,
-				}
-
-				// SMUX server
-				session, err := smux.Server(tunnelTCPConn, &config)
-				if err != nil {
-					c.logger.Errorf("failed to create mux session: %v", err)
-					continue
-				}
-				// auth
-				stream, err := session.OpenStream()
-				if err != nil {
-					c.logger.Errorf("unable to open a new mux stream for auth: %v", err)
-					session.Close()
-					continue
-				}
-
-				err = utils.SendBinaryString(stream, c.config.Token)
-				if err != nil {
-					c.logger.Errorf("Failed to send token: %v", err)
-					session.Close()
-					continue
-				}
-
-				msg, err := utils.ReceiveBinaryString(stream)
-				if err == nil && msg == "ok" {
-					c.smuxSession[id] = session
-					c.logger.Infof("Mux session established successfully (session ID: %d)", id)
-					go c.handleMUXStreams(id)
-					break innerloop
-				} else {
-					c.logger.Errorf("Failed to establish a new session. Token error or unexpected response: %v", err)
-				}
+			}
+
+			// all sessions go to the same server, start over on the new one
+			if id > 0 && c.remotes.addr() != remote {
+				go c.Restart()
+				return
+			}
 
+			session := c.dialSession(id)
+			if session == nil {
+				continue
 			}
+			c.state().smuxSession[id] = session
+			c.logger.Infof("Mux session established successfully (session ID: %d)", id)
+			go c.handleMUXStreams(id, session)
+			break
 		}
 	}
 
-	c.config.TunnelStatus = "Connected (TCPMux)"
+	c.config.TunnelStatus.Set("Connected (TCPMux)")
 }
 
-func (c *TcpMuxTransport) handleMUXStreams(id int) {
-	for {
-		select {
-		case <-c.ctx.Done():
-			return
-		default:
-			stream, err := c.smuxSession[id].AcceptStream()
-			if err != nil {
-				c.logger.Errorf("Failed to accept mux stream for session ID %d: %v", id, err)
-				c.logger.Info("attempting to restart client...")
-				go c.Restart()
-				return
+// dialSession dials the server and authenticates a new mux session, nil if
+// that failed.
+func (c *TcpMuxTransport) dialSession(id int) *smux.Session {
+	remote := c.remotes.addr()
+	var via *path // nil for the default route
+	var local *net.TCPAddr
+	if c.paths != nil {
+		via = c.paths.pick(id)
+		remote, local = via.addr(remote), via.local
+		c.logger.Debugf("initiating new mux session to address %s over path %s (session ID: %d)", remote, via, id)
+	} else {
+		c.logger.Debugf("initiating new mux session to address %s (session ID: %d)", remote, id)
+	}
+	span := tracing.Start("connect", "remote", remote, "session", strconv.Itoa(id))
+	// Dial to the tunnel server
+	tunnelTCPConn, err := c.tcpDialerFrom(local, remote, c.config.Nodelay, c.timeout)
+	if err != nil {
+		c.logger.Errorf("failed to dial tunnel server at %s: %v", remote, err)
+		if via != nil {
+			via.failed(err, c.logger)
+		}
+		// with paths, the server is only to blame when none of them works
+		if via == nil || !c.paths.pick(id).usable() {
+			c.remotes.failed(c.logger)
+		}
+		span.End(err)
+		time.Sleep(c.config.RetryInterval)
+		return nil
+	}
 
-			}
-			go c.handleTCPSession(stream)
+	var tunnelConn net.Conn = tunnelTCPConn
+	if c.config.TLSConfig != nil {
+		tlsConn := tls.Client(tunnelTCPConn, c.config.TLSConfig)
+		tlsConn.SetDeadline(time.Now().Add(c.config.Handshake))
+		if err := tlsConn.Handshake(); err != nil {
+			c.logger.Errorf("TLS handshake with %s failed: %v", remote, err)
+			tunnelTCPConn.Close()
+			span.End(err)
+			time.Sleep(c.config.RetryInterval)
+			return nil
 		}
+		tlsConn.SetDeadline(time.Time{})
+		tunnelConn = tlsConn
+	}
+	if c.config.NoiseKey != nil {
+		tunnelConn.SetDeadline(time.Now().Add(c.config.Handshake))
+		noiseConn, err := noise.Client(tunnelConn, c.config.NoiseKey, c.config.NoiseServerKey)
+		if err != nil {
+			c.logger.Errorf("noise handshake with %s failed: %v", remote, err)
+			tunnelTCPConn.Close()
+			span.End(err)
+			time.Sleep(c.config.RetryInterval)
+			return nil
+		}
+		tunnelConn.SetDeadline(time.Time{})
+		tunnelConn = noiseConn
+	}
+
+	// config fot smux
+	config := smux.Config{
+		Version:          c.config.MuxVersion, // Smux protocol version
+		MaxFrameSize:     c.config.MaxFrameSize,
+		MaxReceiveBuffer: c.config.MaxReceiveBuffer,
+		MaxStreamBuffer:  c.config.MaxStreamBuffer,
+	}
+	c.config.KeepAlive.Mux(&config)
+
+	if via != nil {
+		tunnelConn = via.count(tunnelConn)
+	}
+
+	// SMUX server
+	session, err := smux.Server(tunnelConn, &config)
+	if err != nil {
+		c.logger.Errorf("failed to create mux session: %v", err)
+		span.End(err)
+		return nil
+	}
+	// auth
+	auth := span.Child("auth")
+	stream, err := session.OpenStream()
+	if err != nil {
+		c.logger.Errorf("unable to open a new mux stream for auth: %v", err)
+		session.Close()
+		auth.End(err)
+		span.End(err)
+		return nil
+	}
+
+	stream.SetDeadline(time.Now().Add(c.config.Handshake))
+	token, nonce := utils.HandshakeToken(c.config.Token, c.config.PlainToken)
+	err = utils.SendBinaryString(stream, token)
+	if err != nil {
+		c.logger.Errorf("Failed to send token: %v", err)
+		session.Close()
+		auth.End(err)
+		span.End(err)
+		return nil
 	}
+
+	msg, err := utils.ReceiveBinaryString(stream)
+	want := "ok"
+	if nonce != "" {
+		want = utils.TokenReply(c.config.Token, nonce)
+	}
+	if err == nil && msg != want {
+		err = errInvalidToken
+	}
+	auth.End(err)
+	span.End(err)
+	if err != nil {
+		c.logger.Errorf("Failed to establish a new session. Token error or unexpected response: %v", err)
+		c.remotes.failed(c.logger)
+		session.Close()
+		return nil
+	}
+	stream.Close()
+	c.remotes.reached()
+	if via != nil {
+		via.reached(c.logger)
+		c.sessionPaths.Store(session, via)
+	}
+
+	c.sendClientID(session)
+	go c.runControlStream(session)
+	go watchLocalAddr(c.state().ctx, session, c.Restart, c.logger)
+	return session
 }
 
-func (c *TcpMuxTransport) tcpDialer(address string, tcpnodelay bool) (*net.TCPConn, error) {
-	// Resolve the address to a TCP address
-	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
+// sendClientID tells the server which client opened session and asks for
+// stream metadata, older servers close the stream unread.
+func (c *TcpMuxTransport) sendClientID(session *smux.Session) {
+	stream, err := session.OpenStream()
 	if err != nil {
-		return nil, err
+		c.logger.Warnf("failed to open a stream for the client ID: %v", err)
+		return
 	}
+	defer stream.Close()
 
+	if err := utils.SendBinaryInt(stream, utils.MuxClientIDPort); err != nil {
+		c.logger.Warnf("failed to send the client ID: %v", err)
+		return
+	}
+	if err := utils.SendBinaryString(stream, utils.ClientIDMessage(c.config.ClientID)); err != nil {
+		c.logger.Warnf("failed to send the client ID: %v", err)
+		return
+	}
+	if err := utils.SendBinaryString(stream, utils.MetaMessage); err != nil {
+		c.logger.Warnf("failed to ask for stream metadata: %v", err)
+	}
+}
+
+// addSession opens the extra session the server asked for over stream.
+func (c *TcpMuxTransport) addSession(stream net.Conn) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "mux session slot", stream)
+	slot, err := utils.ReceiveBinaryInt(stream)
+	stream.Close()
+	if err != nil {
+		c.logger.Warnf("failed to read the slot of an extra mux session: %v", err)
+		return
+	}
+	id := int(slot)
+
+	session := c.dialSession(id)
+	if session == nil {
+		return
+	}
+	c.extraMu.Lock()
+	c.extra[id] = session
+	c.extraMu.Unlock()
+	c.logger.Infof("extra mux session established at the server's request (session ID: %d)", id)
+	go c.handleMUXStreams(id, session)
+}
+
+// goingAway reconnects when the server says it closes session, and closes
+// session itself once its streams finished or the server's deadline passed.
+func (c *TcpMuxTransport) goingAway(session *smux.Session, stream net.Conn) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "mux session going away", stream)
+	drain, err := utils.ReceiveMuxGoAway(stream)
+	if err != nil {
+		c.logger.Warnf("failed to read how long a mux session going away drains: %v", err)
+		return
+	}
+	c.leaving.Store(session, struct{}{})
+	if streams := utils.Streams(session); streams > 0 {
+		c.logger.Infof("%d streams of a mux session going away get %v to finish", streams, drain)
+	}
+	go c.reconnect()
+
+	utils.DrainSession(session, drain)
+	session.Close()
+}
+
+// retiring lets the server close session for being idle without
+// reconnecting, the server asks for the session again once it needs it.
+func (c *TcpMuxTransport) retiring(session *smux.Session, stream net.Conn) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "mux session retiring", stream)
+	c.leaving.Store(session, struct{}{})
+	if err := utils.AckMuxRetire(stream); err != nil {
+		c.leaving.Delete(session)
+		c.logger.Debugf("failed to let the server retire an idle mux session: %v", err)
+		return
+	}
+	c.logger.Info("the server retires an idle mux session")
+}
+
+// removeExtra forgets an extra session, reporting whether it was one.
+func (c *TcpMuxTransport) removeExtra(id int, session *smux.Session) bool {
+	c.extraMu.Lock()
+	defer c.extraMu.Unlock()
+	if c.extra[id] != session {
+		return false
+	}
+	delete(c.extra, id)
+	return true
+}
+
+// handleMUXStreams accepts the streams the server opens on session until it
+// is closed, also after the client reconnected, as its relays may still
+// half-close or reset. Only losing a current session restarts the client.
+func (c *TcpMuxTransport) handleMUXStreams(id int, session *smux.Session) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "mux session", session)
+	ctx := c.state().ctx
+	for {
+		stream, err := session.AcceptStream()
+		if err == nil {
+			go c.handleTCPSession(session, stream)
+			continue
+		}
+
+		if _, leaving := c.leaving.LoadAndDelete(session); leaving {
+			c.removeExtra(id, session)
+			c.logger.Debugf("mux session %d closed after going away", id)
+			return
+		}
+		if c.removeExtra(id, session) {
+			// extra sessions are retired by the server when idle
+			c.logger.Infof("extra mux session %d closed", id)
+			return
+		}
+		if ctx.Err() != nil {
+			return // restarted already
+		}
+		c.logger.Errorf("Failed to accept mux stream for session ID %d: %v", id, err)
+		c.logger.Info("attempting to restart client...")
+		go c.Restart()
+		return
+	}
+}
+
+func (c *TcpMuxTransport) tcpDialer(address string, tcpnodelay bool, timeout time.Duration) (*net.TCPConn, error) {
+	return c.tcpDialerFrom(nil, address, tcpnodelay, timeout)
+}
+
+// tcpDialerFrom dials address from the local address of a path, or from any
+// with a nil local.
+func (c *TcpMuxTransport) tcpDialerFrom(local *net.TCPAddr, address string, tcpnodelay bool, timeout time.Duration) (*net.TCPConn, error) {
 	// options
-	dialer := &net.Dialer{
-		Timeout:   c.timeout,          // Set the connection timeout
-		KeepAlive: c.config.KeepAlive, // Set the keep-alive duration
+	dialer := c.config.KeepAlive.Dialer(timeout)
+	if local != nil {
+		dialer.LocalAddr = local
 	}
 
-	// Dial the TCP connection with a timeout
-	conn, err := dialer.Dial("tcp", tcpAddr.String())
+	// Dial the TCP connection with a timeout, racing the addresses of a host name
+	conn, err := utils.DialRace(dialer, address)
 	if err != nil {
 		return nil, err
 	}
@@ -217,40 +491,80 @@ func (c *TcpMuxTransport) tcpDialer(address string, tcpnodelay bool) (*net.TCPCo
 	return tcpConn, nil
 }
 
-func (c *TcpMuxTransport) handleTCPSession(tcpsession net.Conn) {
-	select {
-	case <-c.ctx.Done():
-		return
-	default:
-		port, err := utils.ReceiveBinaryInt(tcpsession)
+func (c *TcpMuxTransport) handleTCPSession(session *smux.Session, tcpsession *smux.Stream) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "mux stream", tcpsession)
+	port, meta, err := utils.ReceiveStreamHeader(tcpsession)
 
-		if err != nil {
-			c.logger.Tracef("Unable to get the port from the %s connection: %v", tcpsession.RemoteAddr().String(), err)
-			tcpsession.Close()
-			return
+	if err != nil {
+		c.logger.Tracef("Unable to get the port from the %s connection: %v", tcpsession.RemoteAddr().String(), err)
+		tcpsession.Close()
+		return
+	}
+	if port == utils.SpeedtestPort {
+		go c.speedtest(tcpsession)
+		return
+	}
+	if port == tun.Port && c.config.Tun != nil {
+		go c.config.Tun.Serve(utils.NewMuxStream(session, tcpsession))
+		return
+	}
+	if port == dnsfwd.Port && c.config.DNS != nil {
+		go c.config.DNS.Serve(utils.NewMuxStream(session, tcpsession))
+		return
+	}
+	if port == exitnode.Port && c.config.Proxy != nil {
+		c.config.Proxy.Serve(utils.NewMuxStream(session, tcpsession))
+		return
+	}
+	if port == utils.MuxScalePort {
+		go c.addSession(tcpsession)
+		return
+	}
+	if port == utils.MuxGoAwayPort {
+		go c.goingAway(session, tcpsession)
+		return
+	}
+	if port == utils.MuxRetirePort {
+		go c.retiring(session, tcpsession)
+		return
+	}
+	if utils.IsMuxControl(port) {
+		if err := utils.ReceiveMuxControl(session, port, tcpsession); err != nil {
+			c.logger.Debugf("failed to control a mux stream: %v", err)
 		}
-		go c.localDialer(tcpsession, port)
-
+		return
 	}
+	go c.localDialer(utils.NewMuxStream(session, tcpsession), port, meta)
 }
 
-func (c *TcpMuxTransport) localDialer(tunnelConnection net.Conn, port uint16) {
-	select {
-	case <-c.ctx.Done():
+// localDialer relays tunnelConnection to the target of port. It runs to the
+// end regardless of restarts.
+func (c *TcpMuxTransport) localDialer(tunnelConnection net.Conn, port uint16, meta *utils.StreamMeta) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "local dial", tunnelConnection)
+	span := tracing.Start("forward", "port", strconv.Itoa(int(port)))
+	describeStream(span, port, meta, c.logger)
+	if len(c.config.AllowedPorts) > 0 && !c.config.AllowedPorts.Contains(int(port)) {
+		c.logger.Warnf("refusing to dial port %d, it is not in allowed_ports", port)
+		tunnelConnection.Close()
+		span.End(errPortNotAllowed)
 		return
-	default:
-		localAddress, ok := c.config.Forwarder[int(port)]
-		if !ok {
-			localAddress = fmt.Sprintf("127.0.0.1:%d", port)
-		}
+	}
 
-		localConnection, err := c.tcpDialer(localAddress, c.config.Nodelay)
-		if err != nil {
-			c.logger.Errorf("Failed to connect to local address %s: %v", localAddress, err)
-			tunnelConnection.Close()
-			return
-		}
-		c.logger.Debugf("connected to local address %s successfully", localAddress)
-		go utils.ConnectionHandler(localConnection, tunnelConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	dialTimeout, readTimeout := targetTimeouts(c.config.TargetTimeouts, int(port), c.config.DialTimeout, c.config.ReadTimeout)
+	dialStart := time.Now()
+	localConnection, localAddress, err := dialTarget(c.config.Forwarder, int(port), meta, c.config.AllowedTargets, span, c.logger, func(address string) (*net.TCPConn, error) {
+		return c.tcpDialer(address, c.config.Nodelay, dialTimeout)
+	})
+	if err != nil {
+		tunnelConnection.Close()
+		span.End(err)
+		return
 	}
+	localConn := utils.TimeDialed(utils.WithReadTimeout(localConnection, readTimeout), int(port), c.state().usageMonitor, dialStart)
+	c.logger.Debugf("connected to local address %s successfully", localAddress)
+	release := c.config.Forwarder.Track(int(port), localAddress, localConnection)
+	go span.Relay(func() string {
+		defer release()
+		return utils.ConnectionHandler(utils.AutoNodelay(localConn, c.config.AutoNodelay), tunnelConnection, c.logger, c.state().usageMonitor, int(port), c.config.Sniffer)
+	})
 }
@@ -0,0 +1,25 @@
+package transport
+
+import (
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// checkServer logs the version a newer server sent back in the handshake and
+// the features it lacks. It returns an ErrUpgradeRequired error for a server
+// this client can't work with.
+func checkServer(version utils.PeerVersion, logger *logrus.Logger) error {
+	if err := version.Check("server"); err != nil {
+		logger.Errorf("%v", err)
+		return err
+	}
+	if missing := version.Missing(); len(missing) > 0 {
+		logger.Infof("server runs %s without %s, upgrade it to use them", version, strings.Join(missing, ", "))
+	} else {
+		logger.Debugf("server runs %s", version)
+	}
+	return nil
+}
@@ -2,15 +2,22 @@ package transport
 
 import (
 	"context"
-	"crypto/tls"
-	"encoding/binary"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/tun"
 	"github.com/sahmadiut/backhaul/internal/utils"
 	"github.com/sahmadiut/backhaul/internal/web"
 
@@ -20,50 +27,89 @@ import (
 
 type WsTransport struct {
 	config         *WsConfig
-	ctx            context.Context
-	cancel         context.CancelFunc
+	current        atomic.Pointer[wsState] // replaced by each Restart
 	logger         *logrus.Logger
-	controlChannel *websocket.Conn
+	controlChannel atomic.Pointer[websocket.Conn] // nil until connected
+	controlMu      sync.Mutex                     // one writer of acknowledgments at a time
 	timeout        time.Duration
 	restartMutex   sync.Mutex
+	flaps          *flapDamper
+	remotes        *remotes // remote_addr, then the standby_addrs
 	heartbeatSig   string
 	chanSignal     string
-	usageMonitor   *web.Usage
 }
-type WsConfig struct {
-	RemoteAddr    string
-	Nodelay       bool
-	KeepAlive     time.Duration
-	RetryInterval time.Duration
-	Token         string
-	Forwarder     map[int]string
-	Sniffer       bool
-	WebPort       int
-	SnifferLog    string
-	Mode          config.TransportType
-	TunnelStatus  string
+
+// wsState is what a WsTransport starts over with on Restart. It is replaced
+// whole, as the goroutines of the transport read it at any time.
+type wsState struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	usageMonitor *web.Usage
 }
 
-func NewWSClient(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *WsTransport {
-	// Create a derived context from the parent context
+func newWSState(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *wsState {
 	ctx, cancel := context.WithCancel(parentCtx)
+	return &wsState{
+		ctx:          ctx,
+		cancel:       cancel,
+		usageMonitor: web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+	}
+}
+
+type WsConfig struct {
+	RemoteAddr     string
+	StandbyAddrs   []string // servers to fail over to
+	Nodelay        bool
+	AutoNodelay    bool
+	KeepAlive      utils.Keepalive
+	RetryInterval  time.Duration
+	Token          string
+	PlainToken     bool   // send the token itself instead of signing it
+	ClientID       string // sent to the server with the token
+	FlapThreshold  int    // restarts within an hour before waiting longer to reconnect
+	Forwarder      *Forwarder
+	Manage         Manage // runs the commands of the server, nil without remote_management
+	AllowedPorts   utils.PortRanges
+	AllowedTargets *utils.TargetACL
+	TargetTimeouts map[int]TargetTimeouts
+	Tun            *tun.Link         // takes the packets of a TUN device, nil without tun_addr
+	DNS            *dnsfwd.Forwarder // sends DNS queries to the server, nil without dns_listen
+	Proxy          *exitnode.Proxy   // takes tunnel connections for its proxy listeners, nil without socks_bind and http_proxy_bind
+	DialTimeout    time.Duration
+	Handshake      time.Duration
+	ReadTimeout    time.Duration
+	Sniffer        bool
+	WebPort        int
+	SnifferLog     string
+	Mode           config.TransportType
+	TLSPin         string // SHA-256 fingerprint of the server certificate for wss, any when empty
+	TunnelStatus   web.Status
+}
 
+func NewWSClient(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *WsTransport {
 	// Initialize the TcpTransport struct
 	client := &WsTransport{
-		config:         config,
-		ctx:            ctx,
-		cancel:         cancel,
-		logger:         logger,
-		controlChannel: nil,             // will be set when a control connection is established
-		timeout:        5 * time.Second, // Default timeout
-		heartbeatSig:   "0",             // Default heartbeat signal
-		chanSignal:     "1",             // Default channel signal
-		usageMonitor:   web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		config:       config,
+		flaps:        newFlapDamper(config.FlapThreshold),
+		remotes:      newRemotes(config.RemoteAddr, config.StandbyAddrs),
+		logger:       logger,
+		timeout:      config.DialTimeout,
+		heartbeatSig: "0", // Default heartbeat signal
+		chanSignal:   "1", // Default channel signal
 	}
+	client.current.Store(newWSState(parentCtx, config, logger))
 
 	return client
 }
 
+// state returns what the transport runs with since the last Restart.
+func (c *WsTransport) state() *wsState {
+	return c.current.Load()
+}
+
+// Restart reconnects the control channel. The tunnel connections relaying
+// at the moment are left to finish, only the idle ones of the old control
+// channel are closed.
 func (c *WsTransport) Restart() {
 	if !c.restartMutex.TryLock() {
 		c.logger.Warn("client is already restarting")
@@ -72,20 +118,20 @@ func (c *WsTransport) Restart() {
 	defer c.restartMutex.Unlock()
 
 	c.logger.Info("restarting client...")
-	if c.cancel != nil {
-		c.cancel()
+	if relays := utils.ActiveRelays(); relays > 0 {
+		c.logger.Infof("%d connections keep relaying until they end", relays)
 	}
+	c.state().cancel()
 
-	time.Sleep(2 * time.Second)
+	time.Sleep(c.flaps.restarted(c.logger))
 
-	ctx, cancel := context.WithCancel(context.Background())
-	c.ctx = ctx
-	c.cancel = cancel
-
-	// Re-initialize variables
-	c.controlChannel = nil
-	c.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", c.config.WebPort), ctx, c.config.SnifferLog, c.config.Sniffer, &c.config.TunnelStatus, c.logger)
-	c.config.TunnelStatus = ""
+	// Re-initialize variables, the server drops a control channel only
+	// once it is closed
+	c.current.Store(newWSState(context.Background(), c.config, c.logger))
+	if control := c.controlChannel.Swap(nil); control != nil {
+		control.Close()
+	}
+	c.config.TunnelStatus.Set("")
 
 	go c.ChannelDialer()
 
@@ -94,54 +140,79 @@ func (c *WsTransport) Restart() {
 func (c *WsTransport) ChannelDialer() {
 	// for  webui
 	if c.config.WebPort > 0 {
-		go c.usageMonitor.Monitor()
+		go c.state().usageMonitor.Monitor()
 	}
 
-	c.config.TunnelStatus = "Disconnected (Websocket)"
+	c.config.TunnelStatus.Set("Disconnected (Websocket)")
 
+	ctx := c.state().ctx // of this control channel, replaced by Restart
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 			c.logger.Info("attempting to establish a new websocket control channel connection")
 
-			tunnelWSConn, err := c.wsDialer(c.config.RemoteAddr, "/channel")
+			remote := c.remotes.addr()
+			span := tracing.Start("connect", "remote", remote)
+			tunnelWSConn, err := c.wsDialer(remote, "/channel")
+			span.End(err)
 			if err != nil {
 				c.logger.Errorf("failed to dial websocket control channel: %v", err)
+				c.remotes.failed(c.logger)
 				time.Sleep(c.config.RetryInterval)
 				continue
 			}
-			c.controlChannel = tunnelWSConn
+			c.remotes.reached()
+			c.controlChannel.Store(tunnelWSConn)
 			c.logger.Info("websocket control channel established successfully")
 
-			c.config.TunnelStatus = "Connected (Websocket)"
+			c.config.TunnelStatus.Set("Connected (Websocket)")
 
-			go c.channelListener()
+			go c.channelListener(ctx, tunnelWSConn)
+			go watchLocalAddr(ctx, tunnelWSConn, c.Restart, c.logger)
 
 			return
 		}
 	}
 }
 
-func (c *WsTransport) channelListener() {
+// channelListener reads the signals of the control channel conn. Only its
+// failure restarts the client, tunnel connections failing are left to the
+// server to ask for again.
+func (c *WsTransport) channelListener(ctx context.Context, conn *websocket.Conn) {
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
-			_, msg, err := c.controlChannel.ReadMessage()
+			_, msg, err := conn.ReadMessage()
 			if err != nil {
 				c.logger.Errorf("error receiving channel signal: %v. Restarting client...", err)
 				go c.Restart()
 				return
 			}
 
-			message := string(msg)
+			if command, ok := utils.ParseCommand(string(msg)); ok && c.config.Manage != nil {
+				go runCommand(c.config.Manage, command, func(result control.ClientResult) error {
+					c.controlMu.Lock()
+					defer c.controlMu.Unlock()
+					return conn.WriteMessage(websocket.TextMessage, []byte(utils.ResultMessage(result)))
+				}, c.logger)
+				continue
+			}
+			message, seq := utils.ParseSignal(string(msg))
 			if message == c.chanSignal {
-				go c.tunnelDialer()
+				go c.tunnelDialer(ctx, conn, seq)
 			} else if message == c.heartbeatSig {
 				c.logger.Debug("heartbeat received successfully")
+				if seq != 0 { // the server asks for the stats
+					c.controlMu.Lock()
+					if err := conn.WriteMessage(websocket.TextMessage, []byte(utils.ClientStatsMessage(clientStats(c.config.Forwarder)))); err != nil {
+						c.logger.Debugf("failed to report stats: %v", err)
+					}
+					c.controlMu.Unlock()
+				}
 			} else {
 				c.logger.Errorf("unexpected response from control channel: %s. Restarting client...", message)
 				go c.Restart()
@@ -151,32 +222,42 @@ func (c *WsTransport) channelListener() {
 	}
 }
 
-func (c *WsTransport) tunnelDialer() {
+// tunnelDialer opens a tunnel connection and, if the server numbered the
+// signal with seq, tells it on control whether that worked.
+func (c *WsTransport) tunnelDialer(ctx context.Context, control *websocket.Conn, seq uint64) {
 	select {
-	case <-c.ctx.Done():
+	case <-ctx.Done():
 		return
 	default:
-		if c.controlChannel == nil {
-			c.logger.Warn("websocket control channel is nil, cannot dial tunnel. Restarting client...")
-			go c.Restart()
-			return
+		remote := c.remotes.addr()
+		c.logger.Debugf("initiating new websocket tunnel connection to address %s", remote)
+
+		tunnelWSConn, err := c.wsDialer(remote, "")
+		if seq != 0 {
+			c.controlMu.Lock()
+			if err := control.WriteMessage(websocket.TextMessage, []byte(utils.AckMessage(seq, err))); err != nil {
+				c.logger.Debugf("failed to acknowledge channel signal %d: %v", seq, err)
+			}
+			c.controlMu.Unlock()
 		}
-		c.logger.Debugf("initiating new websocket tunnel connection to address %s", c.config.RemoteAddr)
-
-		tunnelWSConn, err := c.wsDialer(c.config.RemoteAddr, "")
 		if err != nil {
 			c.logger.Errorf("failed to dial webSocket tunnel server: %v", err)
 			return
 		}
-		go c.handleWSSession(tunnelWSConn)
+		go c.handleWSSession(ctx, tunnelWSConn)
 	}
 }
 
-func (c *WsTransport) handleWSSession(wsSession *websocket.Conn) {
+// handleWSSession waits for the port to relay wsSession to. It is closed if
+// its control channel ends before, the server dropped it then.
+func (c *WsTransport) handleWSSession(ctx context.Context, wsSession *websocket.Conn) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "tunnel connection", wsSession)
+	idle := context.AfterFunc(ctx, func() { wsSession.Close() })
+	defer idle()
 loop:
 	for {
 		select {
-		case <-c.ctx.Done():
+		case <-ctx.Done():
 			return
 		default:
 			_, portBytes, err := wsSession.ReadMessage()
@@ -187,108 +268,166 @@ loop:
 				return
 			}
 
-			port := binary.BigEndian.Uint16(portBytes)
+			port, meta, err := utils.DecodeStreamHeader(portBytes)
+			if err != nil {
+				c.logger.Debugf("Unable to get port from websocket connection %s: %v", wsSession.RemoteAddr().String(), err)
+				wsSession.Close()
+				return
+			}
 			if port == 10 {
 				c.logger.Trace("Ping recieved from the server")
 				continue loop
 			}
-			go c.localDialer(wsSession, port)
+			if port == utils.SpeedtestPort {
+				if !idle() {
+					return
+				}
+				go c.speedtest(wsSession)
+				break loop
+			}
+			if port == tun.Port && c.config.Tun != nil {
+				if !idle() {
+					return
+				}
+				go c.config.Tun.Serve(&utils.WSStream{Conn: wsSession})
+				break loop
+			}
+			if port == dnsfwd.Port && c.config.DNS != nil {
+				if !idle() {
+					return
+				}
+				go c.config.DNS.Serve(&utils.WSStream{Conn: wsSession})
+				break loop
+			}
+			if port == exitnode.Port && c.config.Proxy != nil {
+				if !idle() {
+					return
+				}
+				c.config.Proxy.Serve(&utils.WSStream{Conn: wsSession})
+				break loop
+			}
+			if !idle() {
+				return // closed with its control channel
+			}
+			go c.localDialer(wsSession, port, meta)
 			break loop
 		}
 	}
 }
 
-func (c *WsTransport) localDialer(tunnelConnection *websocket.Conn, port uint16) {
-	select {
-	case <-c.ctx.Done():
+// localDialer relays tunnelConnection to the target of port. It runs to the
+// end regardless of the control channel.
+func (c *WsTransport) localDialer(tunnelConnection *websocket.Conn, port uint16, meta *utils.StreamMeta) {
+	defer utils.Recover(c.logger, c.state().usageMonitor, "local dial", tunnelConnection)
+	span := tracing.Start("forward", "port", strconv.Itoa(int(port)))
+	describeStream(span, port, meta, c.logger)
+	if len(c.config.AllowedPorts) > 0 && !c.config.AllowedPorts.Contains(int(port)) {
+		c.logger.Warnf("refusing to dial port %d, it is not in allowed_ports", port)
+		tunnelConnection.Close()
+		span.End(errPortNotAllowed)
 		return
-	default:
-		localAddress, ok := c.config.Forwarder[int(port)]
-		if !ok {
-			localAddress = fmt.Sprintf("127.0.0.1:%d", port)
-		}
+	}
 
-		localConnection, err := c.tcpDialer(localAddress, c.config.Nodelay)
-		if err != nil {
-			c.logger.Errorf("connecting to local address %s is not possible", localAddress)
-			tunnelConnection.Close()
-			return
-		}
-		c.logger.Debugf("connected to local address %s successfully", localAddress)
-		go utils.WSToTCPConnHandler(tunnelConnection, localConnection, c.logger, c.usageMonitor, int(port), c.config.Sniffer)
+	dialTimeout, readTimeout := targetTimeouts(c.config.TargetTimeouts, int(port), c.config.DialTimeout, c.config.ReadTimeout)
+	dialStart := time.Now()
+	localConnection, localAddress, err := dialTarget(c.config.Forwarder, int(port), meta, c.config.AllowedTargets, span, c.logger, func(address string) (*net.TCPConn, error) {
+		return c.tcpDialer(address, c.config.Nodelay, dialTimeout)
+	})
+	if err != nil {
+		tunnelConnection.Close()
+		span.End(err)
+		return
 	}
+	localConn := utils.TimeDialed(utils.WithReadTimeout(localConnection, readTimeout), int(port), c.state().usageMonitor, dialStart)
+	c.logger.Debugf("connected to local address %s successfully", localAddress)
+	release := c.config.Forwarder.Track(int(port), localAddress, localConnection)
+	go span.Relay(func() string {
+		defer release()
+		return utils.WSToTCPConnHandler(tunnelConnection, utils.AutoNodelay(localConn, c.config.AutoNodelay), c.logger, c.state().usageMonitor, int(port), c.config.Sniffer)
+	})
 }
 
 func (c *WsTransport) wsDialer(addr string, path string) (*websocket.Conn, error) {
-	// Create a TLS configuration that allows insecure connections
-	tlsConfig := &tls.Config{
-		InsecureSkipVerify: true, // Skip server certificate verification
-	}
+	// Any certificate unless the client pins it
+	tlsConfig := utils.PinnedTLSConfig(c.config.TLSPin)
 
 	// Setup headers with authorization
 	headers := http.Header{}
-	headers.Add("Authorization", fmt.Sprintf("Bearer %v", c.config.Token))
+	token, _ := utils.HandshakeToken(c.config.Token, c.config.PlainToken)
+	headers.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+	headers.Add(utils.ClientIDHeader, c.config.ClientID)
+	if path == "/channel" {
+		headers.Add(utils.AcksHeader, "1") // older servers ignore it
+		headers.Add(utils.MetaHeader, "1")
+		headers.Add(utils.StatsHeader, "1")
+		if c.config.Manage != nil {
+			headers.Add(utils.CommandsHeader, "1")
+		}
+		headers.Add(utils.VersionHeader, utils.LocalVersion().Encode())
+	}
 
 	var wsURL string
 	dialer := websocket.Dialer{}
 	if c.config.Mode == config.WS {
 		wsURL = fmt.Sprintf("ws://%s%s", addr, path)
 		dialer = websocket.Dialer{
-			HandshakeTimeout: c.timeout, // Set handshake timeout
+			HandshakeTimeout: c.config.Handshake, // Set handshake timeout
 			NetDial: func(_, addr string) (net.Conn, error) {
-				conn, err := net.Dial("tcp", addr)
+				conn, err := utils.DialRace(&net.Dialer{Timeout: c.timeout}, addr)
 				if err != nil {
 					return nil, err
 				}
-				tcpConn := conn.(*net.TCPConn)
-				tcpConn.SetKeepAlive(true)                     // Enable TCP keepalive
-				tcpConn.SetKeepAlivePeriod(c.config.KeepAlive) // Set keepalive period
-				return tcpConn, nil
+				c.config.KeepAlive.Apply(conn)
+				return conn, nil
 			},
 		}
 	} else {
 		wsURL = fmt.Sprintf("wss://%s%s", addr, path)
 		dialer = websocket.Dialer{
-			TLSClientConfig:  tlsConfig, // Pass the insecure TLS config here
-			HandshakeTimeout: c.timeout, // Set handshake timeout
+			TLSClientConfig:  tlsConfig,          // Pass the TLS config here
+			HandshakeTimeout: c.config.Handshake, // Set handshake timeout
 			NetDial: func(_, addr string) (net.Conn, error) {
-				conn, err := net.Dial("tcp", addr)
+				conn, err := utils.DialRace(&net.Dialer{Timeout: c.timeout}, addr)
 				if err != nil {
 					return nil, err
 				}
-				tcpConn := conn.(*net.TCPConn)
-				tcpConn.SetKeepAlive(true)                     // Enable TCP keepalive
-				tcpConn.SetKeepAlivePeriod(c.config.KeepAlive) // Set keepalive period
-				return tcpConn, nil
+				c.config.KeepAlive.Apply(conn)
+				return conn, nil
 			},
 		}
 	}
 
 	// Dial to the WebSocket server
-	tunnelWSConn, _, err := dialer.Dial(wsURL, headers)
+	tunnelWSConn, resp, err := dialer.Dial(wsURL, headers)
 	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUpgradeRequired {
+			reason, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			c.logger.Errorf("the server refused this client: %s", strings.TrimSpace(string(reason)))
+			return nil, err
+		}
 		c.logger.Errorf("Failed to dial websocket server %s: %v", wsURL, err)
 		return nil, err
 	}
 
+	// sent back by newer servers
+	if value := resp.Header.Get(utils.VersionHeader); value != "" {
+		if version, err := utils.ParseVersion(value); err == nil {
+			if err := checkServer(version, c.logger); err != nil {
+				tunnelWSConn.Close()
+				return nil, err
+			}
+		}
+	}
+
 	return tunnelWSConn, nil
 }
 
-func (c *WsTransport) tcpDialer(address string, tcpnodelay bool) (*net.TCPConn, error) {
-	// Resolve the address to a TCP address
-	tcpAddr, err := net.ResolveTCPAddr("tcp", address)
-	if err != nil {
-		return nil, err
-	}
-
+func (c *WsTransport) tcpDialer(address string, tcpnodelay bool, timeout time.Duration) (*net.TCPConn, error) {
 	// options
-	dialer := &net.Dialer{
-		Timeout:   c.timeout,          // Set the connection timeout
-		KeepAlive: c.config.KeepAlive, // Set the keep-alive duration
-	}
+	dialer := c.config.KeepAlive.Dialer(timeout)
 
-	// Dial the TCP connection with a timeout
-	conn, err := dialer.Dial("tcp", tcpAddr.String())
+	// Dial the TCP connection with a timeout, racing the addresses of a host name
+	conn, err := utils.DialRace(dialer, address)
 	if err != nil {
 		return nil, err
 	}
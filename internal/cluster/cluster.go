@@ -0,0 +1,281 @@
+// Package cluster shares the state of servers set up as active and standby
+// for the same clients. Every server pushes its state to its peers over HTTP
+// and gets theirs back, so each one knows which server holds the tunnel,
+// which clients are connected where, and the port counters of all of them.
+// Servers with a registry merge theirs. Clients fail over with standby_addrs. The last state of a server that went
+// down is kept, so its counters still count in the cluster totals. Behind a
+// load balancer, a server without a tunnel forwards its public connections to
+// a peer that has one.
+package cluster
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// DefaultInterval is how often the state is pushed to the peers by default.
+const DefaultInterval = 2 * time.Second
+
+// a peer not heard from for this many intervals counts as down
+const downAfter = 3
+
+const (
+	statePath   = "/cluster/state"
+	replyHeader = "X-Backhaul-Reply" // proves the peer knows the token as well
+	maxState    = 1 << 20
+)
+
+// Cluster is the view of one server on the cluster.
+type Cluster struct {
+	name     string
+	listen   string
+	peers    []string // addresses of the other servers
+	token    string
+	interval time.Duration
+	auth     *utils.TokenChecker
+	local    func() control.ClusterNode
+	accept   func(port int, conn net.Conn) error // takes connections forwarded by peers
+	known    func([]control.KnownClient)         // takes the registries of the peers
+	client   *http.Client
+	logger   *logrus.Logger
+
+	mu        sync.Mutex
+	nodes     map[string]control.ClusterNode // the peers by name, as last heard
+	heard     map[string]time.Time           // when each peer was last heard, by the clock of this server
+	addrs     map[string]string              // cluster_listen addresses of the peers by name
+	splitWith string                         // peer also holding the tunnel, warned about
+}
+
+// New returns the cluster of the server called name, which serves its state
+// on listen and pushes it to peers. local returns the current state of this
+// server.
+func New(name, listen string, peers []string, token string, interval time.Duration, local func() control.ClusterNode, logger *logrus.Logger) *Cluster {
+	if interval <= 0 {
+		interval = DefaultInterval
+	}
+	return &Cluster{
+		name:     name,
+		listen:   listen,
+		peers:    peers,
+		token:    token,
+		interval: interval,
+		auth:     utils.NewTokenChecker(token, utils.DefaultAuthSkew, true),
+		local:    local,
+		client:   &http.Client{Timeout: interval},
+		logger:   logger,
+		nodes:    make(map[string]control.ClusterNode),
+		heard:    make(map[string]time.Time),
+		addrs:    make(map[string]string),
+	}
+}
+
+// HandleRegistry makes the server merge the registries its peers share into
+// its own with merge. It is called before Run.
+func (c *Cluster) HandleRegistry(merge func([]control.KnownClient)) {
+	c.known = merge
+}
+
+// Run serves the state to the peers and pushes it to them every interval
+// until ctx is done.
+func (c *Cluster) Run(ctx context.Context) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("POST "+statePath, c.handleState)
+	mux.HandleFunc("POST "+forwardPath, c.handleForward)
+	server := &http.Server{Addr: c.listen, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+	go func() {
+		c.logger.Infof("cluster %s listening on %s, peers: %v", c.name, c.listen, c.peers)
+		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			c.logger.Errorf("cluster listener error: %v", err)
+		}
+	}()
+
+	ticker := time.NewTicker(c.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			for _, peer := range c.peers {
+				go func() {
+					if err := c.push(ctx, peer); err != nil {
+						c.logger.Debugf("failed to share state with cluster peer %s: %v", peer, err)
+					}
+				}()
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Nodes returns this server first, then the peers heard of by name.
+func (c *Cluster) Nodes() []control.ClusterNode {
+	self := c.state()
+	self.Self, self.Known = true, nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	nodes := []control.ClusterNode{self}
+	for name, node := range c.nodes {
+		node.Down = c.down(name)
+		nodes = append(nodes, node)
+	}
+	slices.SortFunc(nodes[1:], func(a, b control.ClusterNode) int { return strings.Compare(a.Name, b.Name) })
+	return nodes
+}
+
+// down reports whether the peer called name wasn't heard from lately, with
+// c.mu held.
+func (c *Cluster) down(name string) bool {
+	return time.Since(c.heard[name]) > downAfter*c.interval
+}
+
+// state returns the current state of this server.
+func (c *Cluster) state() control.ClusterNode {
+	node := c.local()
+	node.Name = c.name
+	node.Updated = time.Now()
+	return node
+}
+
+// push sends the state of this server to peer and keeps the one it answers
+// with.
+func (c *Cluster) push(ctx context.Context, peer string) error {
+	body, err := json.Marshal(c.state())
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "http://"+peer+statePath, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	token, nonce := utils.SignToken(c.token)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if resp.Header.Get(replyHeader) != utils.TokenReply(c.token, nonce) {
+		return errors.New("peer doesn't know the token")
+	}
+
+	var node control.ClusterNode
+	if err := json.NewDecoder(io.LimitReader(resp.Body, maxState)).Decode(&node); err != nil {
+		return err
+	}
+	c.merge(node)
+
+	c.mu.Lock()
+	c.addrs[node.Name] = peer
+	c.mu.Unlock()
+	return nil
+}
+
+// handleState takes the state a peer pushed and answers with this server's.
+func (c *Cluster) handleState(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	nonce, err := c.auth.Check(token)
+	if err != nil {
+		c.logger.Warnf("refused cluster state from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+
+	var node control.ClusterNode
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxState)).Decode(&node); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.merge(node)
+
+	w.Header().Set(replyHeader, utils.TokenReply(c.token, nonce))
+	control.WriteJSON(w, c.state())
+}
+
+// merge notes the peer as heard from now and keeps its state unless a newer
+// one is known, merges its registry, and warns when the peer holds the tunnel
+// along with this server.
+func (c *Cluster) merge(node control.ClusterNode) {
+	if node.Name == "" || node.Name == c.name {
+		return
+	}
+	active := c.local().Active
+	if c.known != nil && node.Known != nil {
+		c.known(node.Known)
+	}
+	node.Known = nil
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.heard[node.Name] = time.Now()
+	// Updated is taken by the clock of the peer, only compared to its own
+	if known, ok := c.nodes[node.Name]; ok && known.Updated.After(node.Updated) {
+		return
+	}
+	if _, ok := c.nodes[node.Name]; !ok {
+		c.logger.Infof("cluster peer %s joined", node.Name)
+	}
+	c.nodes[node.Name] = node
+
+	switch {
+	case active && node.Active && c.splitWith != node.Name:
+		c.splitWith = node.Name
+		c.logger.Warnf("cluster peer %s holds a tunnel as well, clients should only connect to one server at a time", node.Name)
+	case !(active && node.Active) && c.splitWith == node.Name:
+		c.splitWith = ""
+	}
+}
+
+// Totals sums up the port counters of all servers, the ones down with the
+// values they last shared and no active connections.
+func Totals(nodes []control.ClusterNode) []control.Port {
+	totals := make(map[int]control.Port)
+	for _, node := range nodes {
+		for port, stat := range node.Ports {
+			total := totals[port]
+			total.Port = port
+			total.Target = stat.Target
+			if !node.Down {
+				total.Active += stat.Active
+			}
+			total.Total += stat.Total
+			total.Bytes += stat.Bytes
+			totals[port] = total
+		}
+	}
+
+	ports := make([]control.Port, 0, len(totals))
+	for _, port := range totals {
+		ports = append(ports, port)
+	}
+	slices.SortFunc(ports, func(a, b control.Port) int { return a.Port - b.Port })
+	return ports
+}
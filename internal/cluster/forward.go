@@ -0,0 +1,223 @@
+package cluster
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// A public connection is forwarded to a peer over a connection of its own to
+// the peer's cluster_listen, upgraded from an HTTP request like a websocket.
+const (
+	forwardPath     = "/cluster/forward"
+	forwardProtocol = "backhaul-forward"
+	forwardTimeout  = 5 * time.Second // to dial the peer and upgrade
+)
+
+var errNoPeer = errors.New("no cluster peer holds a tunnel")
+
+// HandleForwards makes the server take the public connections its peers
+// forward, handing each one to accept with the port it came in on. It is
+// called before Run.
+func (c *Cluster) HandleForwards(accept func(port int, conn net.Conn) error) {
+	c.accept = accept
+}
+
+// Forward relays a public connection that came in on port to a peer holding
+// a tunnel, and returns once the connection ended. With several such peers,
+// each source address keeps going to the same one.
+func (c *Cluster) Forward(conn net.Conn, port int) error {
+	peer, err := c.pick(conn.RemoteAddr().String())
+	if err != nil {
+		return err
+	}
+	upstream, err := c.dialForward(peer, port, conn.RemoteAddr().String())
+	if err != nil {
+		return fmt.Errorf("failed to forward to %s: %v", peer, err)
+	}
+	c.logger.Debugf("forwarding connection from %s on port %d to cluster peer %s", conn.RemoteAddr().String(), port, peer)
+	relay(conn, upstream)
+	return nil
+}
+
+// pick returns the address of the peer to forward connections from source
+// to, by rendezvous hashing over the peers holding a tunnel, so a peer coming
+// or going only moves the sources it takes or took.
+func (c *Cluster) pick(source string) (string, error) {
+	host, _, err := net.SplitHostPort(source)
+	if err != nil {
+		host = source
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var best string
+	var bestScore uint64
+	for name, node := range c.nodes {
+		addr, ok := c.addrs[name]
+		if !ok || !node.Active || c.down(name) {
+			continue
+		}
+		h := fnv.New64a()
+		h.Write([]byte(name + "|" + host))
+		if score := h.Sum64(); best == "" || score > bestScore {
+			best, bestScore = addr, score
+		}
+	}
+	if best == "" {
+		return "", errNoPeer
+	}
+	return best, nil
+}
+
+// dialForward opens a forwarding connection to peer for a public connection
+// from source to port.
+func (c *Cluster) dialForward(peer string, port int, source string) (net.Conn, error) {
+	conn, err := net.DialTimeout("tcp", peer, forwardTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+
+	req, err := http.NewRequest(http.MethodPost, "http://"+peer+forwardPath+"?port="+strconv.Itoa(port), nil)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	token, nonce := utils.SignToken(c.token)
+	req.Header.Set("Authorization", "Bearer "+token)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", forwardProtocol)
+	req.Header.Set("X-Forwarded-For", source)
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	reader := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(reader, req)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	if resp.Header.Get(replyHeader) != utils.TokenReply(c.token, nonce) {
+		conn.Close()
+		return nil, errors.New("peer doesn't know the token")
+	}
+
+	conn.SetDeadline(time.Time{})
+	return &bufferedConn{Conn: conn, reader: reader}, nil
+}
+
+// handleForward takes a public connection a peer forwards and hands it to the
+// transport.
+func (c *Cluster) handleForward(w http.ResponseWriter, r *http.Request) {
+	token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	nonce, err := c.auth.Check(token)
+	if err != nil {
+		c.logger.Warnf("refused forwarded connection from %s: %v", r.RemoteAddr, err)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	port, err := strconv.Atoi(r.URL.Query().Get("port"))
+	if err != nil || !strings.EqualFold(r.Header.Get("Upgrade"), forwardProtocol) {
+		http.Error(w, "bad forward request", http.StatusBadRequest)
+		return
+	}
+	if c.accept == nil || !c.local().Active {
+		http.Error(w, "no tunnel", http.StatusServiceUnavailable)
+		return
+	}
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "can't take over the connection", http.StatusInternalServerError)
+		return
+	}
+
+	raw, buf, err := hijacker.Hijack()
+	if err != nil {
+		c.logger.Errorf("failed to take over forwarded connection from %s: %v", r.RemoteAddr, err)
+		return
+	}
+	fmt.Fprintf(buf, "HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: %s\r\n%s: %s\r\n\r\n",
+		forwardProtocol, replyHeader, utils.TokenReply(c.token, nonce))
+	if err := buf.Flush(); err != nil {
+		raw.Close()
+		return
+	}
+
+	conn := &forwardedConn{
+		Conn:   &bufferedConn{Conn: raw, reader: buf.Reader},
+		local:  &net.TCPAddr{IP: raw.LocalAddr().(*net.TCPAddr).IP, Port: port},
+		remote: raw.RemoteAddr(),
+	}
+	if source, err := net.ResolveTCPAddr("tcp", r.Header.Get("X-Forwarded-For")); err == nil {
+		conn.remote = source
+	}
+	if err := c.accept(port, conn); err != nil {
+		c.logger.Warnf("dropped connection forwarded by %s: %v", r.RemoteAddr, err)
+		conn.Close()
+	}
+}
+
+// bufferedConn reads what was buffered while upgrading first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
+
+func (c *bufferedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// forwardedConn is a public connection a peer accepted, with the addresses
+// of the original connection.
+type forwardedConn struct {
+	net.Conn
+	local, remote net.Addr
+}
+
+func (c *forwardedConn) LocalAddr() net.Addr  { return c.local }
+func (c *forwardedConn) RemoteAddr() net.Addr { return c.remote }
+
+func (c *forwardedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// relay copies between a and b until both directions ended, passing on half
+// closes.
+func relay(a, b net.Conn) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(a, b)
+		if !utils.CloseWrite(a) {
+			a.Close()
+		}
+		close(done)
+	}()
+	io.Copy(b, a)
+	if !utils.CloseWrite(b) {
+		b.Close()
+	}
+	<-done
+	a.Close()
+	b.Close()
+}
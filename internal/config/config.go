@@ -10,54 +10,337 @@ const (
 	WSS    TransportType = "wss"
 )
 
+// Application protocols a forwarded port can be labelled with.
+const (
+	ProtoTCP  = "tcp"
+	ProtoHTTP = "http"
+)
+
+// Protocols a port can expect its connections to start with, others are
+// dropped before they reach the tunnel.
+const (
+	ExpectSSH  = "ssh"  // "SSH-" version banner
+	ExpectTLS  = "tls"  // TLS handshake record
+	ExpectHTTP = "http" // HTTP request line, or the HTTP/2 preface
+	ExpectRDP  = "rdp"  // TPKT with an X.224 connection request
+)
+
+// Sticky routing strategies for picking a mux session.
+const (
+	StickyNone     = "none"      // random session per connection
+	StickySourceIP = "source_ip" // same visitor IP, same session
+	StickyPort     = "port"      // same local port, same session
+)
+
+// Schedules for picking a mux session, per port.
+const (
+	ScheduleLatency = "latency" // session with the lowest round trip
+	ScheduleBulk    = "bulk"    // sessions weighted by their throughput
+)
+
+// Pool policies of the tcp transport, how tunnel connections are supplied.
+const (
+	PoolFixed    = "fixed"     // keep connection_pool connections ready
+	PoolOnDemand = "on_demand" // ask for one per public connection
+	PoolAdaptive = "adaptive"  // keep as many ready as recently arrived per second
+)
+
+// Keepalive modes, how idle tunnel connections are kept alive.
+const (
+	KeepaliveTCP  = "tcp"  // TCP keepalive probes only
+	KeepalivePing = "ping" // application pings only
+	KeepaliveBoth = "both" // both
+)
+
+// Attack modes, when the public ports are guarded against floods.
+const (
+	AttackOff  = "off"  // never
+	AttackOn   = "on"   // always
+	AttackAuto = "auto" // while the accept rate spikes or the kernel sends SYN cookies
+)
+
+// Anomaly modes, what is done about a public port whose traffic spikes.
+const (
+	AnomalyOff   = "off"   // nothing, the rates aren't watched
+	AnomalyAlert = "alert" // log it and show it
+	AnomalyLimit = "limit" // also hold the port to its usual rates times anomaly_factor
+)
+
+// Overflow policies for a full accept channel.
+const (
+	OverflowDrop       = "drop"        // close the new connection
+	OverflowBlock      = "block"       // wait up to overflow_timeout, then close it
+	OverflowDropOldest = "drop_oldest" // close the oldest queued connection instead
+	OverflowReject     = "reject"      // close the new connection with a TCP RST
+	OverflowGrow       = "grow"        // keep extra connections in a spill buffer
+)
+
+// PortOptions holds the per-port settings, keyed by the local listen port.
+type PortOptions struct {
+	Protocol         string   `toml:"protocol"`           // "tcp" (default) or "http"
+	HTTPHost         string   `toml:"http_host"`          // replaces the Host header on http ports
+	ErrorPage        string   `toml:"error_page"`         // sent to visitors of http ports the tunnel can't serve
+	DedicatedSession bool     `toml:"dedicated_session"`  // reserve a mux session for this port, only for tcpmux
+	Schedule         string   `toml:"schedule"`           // "latency" or "bulk" to pick the mux session by its measurements
+	Expect           string   `toml:"expect"`             // "ssh", "tls", "http" or "rdp", drops connections that start otherwise
+	SNI              []string `toml:"sni"`                // server names TLS connections may ask for, "*.example.com" for subdomains, implies expect "tls"
+	FirstByteTimeout int      `toml:"first_byte_timeout"` // seconds, overrides the server's first_byte_timeout, -1 for none
+}
+
+// Forward is a public port of the server given as a [[server.forward]] table,
+// the structured form of a ports entry. Both can be used together.
+type Forward struct {
+	Name       string   `toml:"name"`        // shown by the control API and "backhaul status"
+	Listen     int      `toml:"listen"`      // public port
+	ListenEnd  int      `toml:"listen_end"`  // last public port of a range, 0 for a single port
+	Bind       string   `toml:"bind"`        // IP address to listen on, ports_addr by default
+	Proto      string   `toml:"proto"`       // "tcp" (default) or "http", the protocol of port_options
+	TargetPort int      `toml:"target_port"` // port the client dials, the public port by default
+	Expect     string   `toml:"expect"`      // the expect of port_options
+	SNI        []string `toml:"sni"`         // the sni of port_options
+}
+
+// Bandwidth is a bandwidth policy given as a [[server.bandwidth]] table: a
+// cap on the public ports listed during a time of day.
+type Bandwidth struct {
+	Name  string `toml:"name"`  // shown in the log
+	Ports []any  `toml:"ports"` // public ports and ranges, e.g. [443, "8000-8100"]
+	Mbps  int    `toml:"mbps"`  // Mbit/s the connections of the ports share, each way
+	From  string `toml:"from"`  // "18:00" local time, midnight when empty
+	To    string `toml:"to"`    // "24:00", before from for a time past midnight
+}
+
+// ForwarderOptions holds the per-port settings of the client, keyed by the port
+// the server asks it to dial.
+type ForwarderOptions struct {
+	DialTimeout float64 `toml:"dial_timeout"` // seconds, overrides the client's dial_timeout
+	ReadTimeout float64 `toml:"read_timeout"` // seconds, overrides the client's read_timeout
+	Balance     string  `toml:"balance"`      // "round-robin" or "least-conn", for several targets
+	FailTimeout float64 `toml:"fail_timeout"` // seconds a target that failed to connect is tried last
+
+	HealthInterval float64 `toml:"health_interval"` // seconds between health checks of the targets, 0 for none
+	HealthFails    int     `toml:"health_fails"`    // failed checks in a row before a target is down
+}
+
+// ControlKey is an API key for control_addr, see "backhaul api-key".
+type ControlKey struct {
+	Name   string   `toml:"name"`
+	Hash   string   `toml:"hash"`   // "sha256:..." of the key
+	Scopes []string `toml:"scopes"` // "read", "ports" and "admin"
+	Rate   int      `toml:"rate"`   // requests per minute, 0 for no limit
+}
+
 // ServerConfig represents the configuration for the server.
 type ServerConfig struct {
-	BindAddr         string        `toml:"bind_addr"`
-	Transport        TransportType `toml:"transport"`
-	Token            string        `toml:"token"`
-	Nodelay          bool          `toml:"nodelay"`
-	Keepalive        int           `toml:"keepalive_period"`
-	ChannelSize      int           `toml:"channel_size"`
-	LogLevel         string        `toml:"log_level"`
-	ConnectionPool   int           `toml:"connection_pool"`
-	Ports            []string      `toml:"ports"`
-	PPROF            bool          `toml:"pprof"`
-	MuxSession       int           `toml:"mux_session"`
-	MuxVersion       int           `toml:"mux_version"`
-	MaxFrameSize     int           `toml:"mux_framesize"`
-	MaxReceiveBuffer int           `toml:"mux_recievebuffer"`
-	MaxStreamBuffer  int           `toml:"mux_streambuffer"`
-	Sniffer          bool          `toml:"sniffer"`
-	WebPort          int           `toml:"web_port"`
-	SnifferLog       string        `toml:"sniffer_log"`
-	TLSCertFile      string        `toml:"tls_cert"`
-	TLSKeyFile       string        `toml:"tls_key"`
-	Heartbeat        int           `toml:"heartbeat"`
+	BindAddr         string                 `toml:"bind_addr"`
+	Transport        TransportType          `toml:"transport"`
+	Token            string                 `toml:"token"`
+	AuthSkew         int                    `toml:"auth_skew"`          // seconds the clock of a client may be off
+	RejectPlainToken bool                   `toml:"reject_plain_token"` // only accept clients that sign the token
+	FlapThreshold    int                    `toml:"flap_threshold"`     // connections of a client within an hour before it counts as flapping, negative for never
+	AuthAttempts     int                    `toml:"auth_attempts"`      // failed handshakes within auth_window before an address is banned, negative for no bans
+	AuthWindow       int                    `toml:"auth_window"`        // seconds
+	AuthBan          int                    `toml:"auth_ban"`           // seconds
+	TarpitSlots      int                    `toml:"tarpit_slots"`       // connections of banned addresses held open, 0 to close them
+	TarpitTime       int                    `toml:"tarpit_time"`        // seconds a connection is held
+	Nodelay          bool                   `toml:"nodelay"`
+	AutoNodelay      bool                   `toml:"auto_nodelay"` // switch TCP_NODELAY per relayed connection by its write sizes
+	Keepalive        int                    `toml:"keepalive_period"`
+	KeepaliveMode    string                 `toml:"keepalive_mode"`   // "tcp", "ping" or "both"
+	KeepaliveJitter  int                    `toml:"keepalive_jitter"` // percent keepalive intervals vary by
+	PingInterval     int                    `toml:"ping_interval"`    // seconds between pings on tunnel connections
+	ChannelSize      int                    `toml:"channel_size"`
+	LogLevel         string                 `toml:"log_level"`
+	ConnectionPool   int                    `toml:"connection_pool"`
+	PoolPolicy       string                 `toml:"pool_policy"` // "fixed", "on_demand" or "adaptive", only for tcp
+	Ports            []string               `toml:"ports"`
+	Forward          []Forward              `toml:"forward"`
+	PortsAddr        string                 `toml:"ports_addr"`       // host the public ports listen on, all addresses by default
+	TransparentAddr  string                 `toml:"transparent_addr"` // takes connections redirected by iptables and forwards each where it was headed
+	TunAddr          string                 `toml:"tun_addr"`         // address and subnet of a TUN device whose packets go to the client
+	TunName          string                 `toml:"tun_name"`         // of the TUN device, picked by the system when empty
+	TunMTU           int                    `toml:"tun_mtu"`          // of the TUN device
+	TunRoutes        []string               `toml:"tun_routes"`       // subnets behind the client routed into the TUN device
+	DNSForward       bool                   `toml:"dns_forward"`      // resolve the DNS queries of the client
+	DNSUpstream      string                 `toml:"dns_upstream"`     // resolver asked for them, the system one when empty
+	ExitNode         bool                   `toml:"exit_node"`        // dial the destinations of the proxy listeners of the client
+	ExitAllowed      []string               `toml:"exit_allowed"`     // IPs, CIDRs and host names the exit node dials, any but loopback, private and link-local when empty
+	KernelFilter     bool                   `toml:"kernel_filter"`    // drop floods of SYNs and banned addresses in the kernel
+	SynRate          int                    `toml:"syn_rate"`         // SYNs per second from an address with kernel_filter, 0 for no limit
+	UnderAttack      string                 `toml:"under_attack"`     // "off", "on" or "auto"
+	AttackRate       int                    `toml:"attack_rate"`      // public connections per second that start the auto mode
+	AttackMinBytes   int                    `toml:"attack_min_bytes"` // a public connection sends before it is forwarded under attack, negative for no check
+	AttackTimeout    int                    `toml:"attack_timeout"`   // seconds to send them
+	AttackIPLimit    int                    `toml:"attack_ip_limit"`  // public connections per address under attack, negative for no limit
+	Anomaly          string                 `toml:"anomaly"`          // "off", "alert" or "limit"
+	AnomalyFactor    float64                `toml:"anomaly_factor"`   // times its baseline the traffic of a port must reach to be an anomaly
+	Bandwidth        []Bandwidth            `toml:"bandwidth"`        // caps on the bandwidth of public ports by time of day
+	TopSources       int                    `toml:"top_sources"`      // source addresses by traffic kept per public port, 0 for none
+	GeoIPDB          string                 `toml:"geoip_db"`         // MaxMind DB file of the countries of addresses, e.g. GeoLite2-Country.mmdb
+	GeoIPASNDB       string                 `toml:"geoip_asn_db"`     // MaxMind DB file of their autonomous systems, e.g. GeoLite2-ASN.mmdb
+	PPROF            bool                   `toml:"pprof"`
+	MuxSession       int                    `toml:"mux_session"`
+	MuxSessionMax    int                    `toml:"mux_session_max"`
+	MuxScaleStreams  int                    `toml:"mux_scale_streams"`
+	MuxScaleMbps     int                    `toml:"mux_scale_mbps"`
+	MuxMaxStreams    int                    `toml:"mux_max_streams"` // streams a mux session carries at once, 0 for any
+	MuxVersion       int                    `toml:"mux_version"`
+	MaxFrameSize     int                    `toml:"mux_framesize"`
+	MaxReceiveBuffer int                    `toml:"mux_recievebuffer"`
+	MaxStreamBuffer  int                    `toml:"mux_streambuffer"`
+	Sniffer          bool                   `toml:"sniffer"`
+	WebPort          int                    `toml:"web_port"`
+	SnifferLog       string                 `toml:"sniffer_log"`
+	SnifferLogSize   int                    `toml:"sniffer_log_max_size"` // MB the sniffer log reaches before it is rotated, negative for no limit
+	SnifferLogAge    int                    `toml:"sniffer_log_max_age"`  // hours before it is rotated, negative for no limit
+	SnifferLogKeep   int                    `toml:"sniffer_log_keep"`     // days rotated sniffer logs are kept, negative for ever
+	SnifferHistory   int                    `toml:"sniffer_history_keep"` // days the 5-minute usage history is kept, negative for none
+	TLSCertFile      string                 `toml:"tls_cert"`
+	TLSKeyFile       string                 `toml:"tls_key"`
+	MuxTLS           bool                   `toml:"mux_tls"`           // wrap tcpmux tunnel connections in TLS
+	NoisePrivateKey  string                 `toml:"noise_private_key"` // secure tcpmux tunnel connections with Noise_IK instead
+	NoisePeers       []string               `toml:"noise_peers"`       // public keys of the clients let in
+	Heartbeat        int                    `toml:"heartbeat"`
+	PortOptions      map[string]PortOptions `toml:"port_options"`
+	StickyRouting    string                 `toml:"sticky_routing"`
+	OverflowPolicy   string                 `toml:"overflow_policy"`
+	OverflowTimeout  int                    `toml:"overflow_timeout"`
+	HoldTimeout      int                    `toml:"hold_timeout"`
+	FirstByteTimeout int                    `toml:"first_byte_timeout"` // seconds a public connection may take to send something, 0 for ever
+	IdleCull         int                    `toml:"idle_cull"`          // minutes without traffic before pooled connections and mux sessions are closed
+	WaitForTunnel    bool                   `toml:"wait_for_tunnel"`    // unbind the public ports while no tunnel is up
+	Masquerade       string                 `toml:"masquerade"`         // URL to proxy, or file or directory to serve, to requests on a ws tunnel port that don't come from a client
+	Fallback         string                 `toml:"fallback"`           // host:port of a decoy web server taking the requests on a ws tunnel port refused for their token
+	User             string                 `toml:"user"`
+	Group            string                 `toml:"group"`
+	UpgradeSocket    string                 `toml:"upgrade_socket"`
+	DrainTimeout     int                    `toml:"drain_timeout"`
+	SessionDrain     int                    `toml:"session_drain"`
+	InfluxURL        string                 `toml:"influx_url"`
+	InfluxToken      string                 `toml:"influx_token"`
+	InfluxInterval   int                    `toml:"influx_interval"`
+	OTLPEndpoint     string                 `toml:"otlp_endpoint"`
+	PPROFPort        int                    `toml:"pprof_port"`
+	PPROFDumpDir     string                 `toml:"pprof_dump_dir"`
+	PPROFHeapLimit   int                    `toml:"pprof_heap_limit"`
+	PPROFGoroutines  int                    `toml:"pprof_goroutine_limit"`
+	ControlSocket    string                 `toml:"control_socket"`
+	ControlAddr      string                 `toml:"control_addr"` // TCP address of the control API, for control_keys
+	ControlKeys      []ControlKey           `toml:"control_keys"`
+	AuditLog         string                 `toml:"audit_log"`        // file the control API appends its changes to
+	Registry         string                 `toml:"registry"`         // JSON file keeping the known clients with their ports and quotas
+	Profile          string                 `toml:"profile"`          // "latency", "throughput" or "balanced"
+	ClusterName      string                 `toml:"cluster_name"`     // of this server in the cluster, bind_addr by default
+	ClusterListen    string                 `toml:"cluster_listen"`   // address the peers push their state to
+	ClusterPeers     []string               `toml:"cluster_peers"`    // cluster_listen addresses of the other servers
+	ClusterInterval  int                    `toml:"cluster_interval"` // seconds
+	ClusterForward   bool                   `toml:"cluster_forward"`  // forward public connections to a peer holding a tunnel while this server has none
+	Instance         string                 `toml:"-"`                // profile name in the log when the process runs several tunnels
+	Chaos            string                 `toml:"-"`                // --chaos, breaks the tunnel on purpose
 }
 
 // ClientConfig represents the configuration for the client.
 type ClientConfig struct {
-	RemoteAddr       string        `toml:"remote_addr"`
-	Transport        TransportType `toml:"transport"`
-	Token            string        `toml:"token"`
-	RetryInterval    int           `toml:"retry_interval"`
-	Nodelay          bool          `toml:"nodelay"`
-	Keepalive        int           `toml:"keepalive_period"`
-	LogLevel         string        `toml:"log_level"`
-	Forwarder        []string      `toml:"forwarder"`
-	PPROF            bool          `toml:"pprof"`
-	MuxSession       int           `toml:"mux_session"`
-	MuxVersion       int           `toml:"mux_version"`
-	MaxFrameSize     int           `toml:"mux_framesize"`
-	MaxReceiveBuffer int           `toml:"mux_recievebuffer"`
-	MaxStreamBuffer  int           `toml:"mux_streambuffer"`
-	Sniffer          bool          `toml:"sniffer"`
-	WebPort          int           `toml:"web_port"`
-	SnifferLog       string        `toml:"sniffer_log"`
+	RemoteAddr       string                      `toml:"remote_addr"`
+	StandbyAddrs     []string                    `toml:"standby_addrs"` // servers to fail over to when remote_addr can't be reached
+	Paths            []string                    `toml:"paths"`         // local addresses, optionally =server, to spread the mux sessions over
+	Transport        TransportType               `toml:"transport"`
+	Token            string                      `toml:"token"`
+	PlainToken       bool                        `toml:"plain_token"` // send the token itself, for servers older than signed tokens
+	RetryInterval    int                         `toml:"retry_interval"`
+	Nodelay          bool                        `toml:"nodelay"`
+	AutoNodelay      bool                        `toml:"auto_nodelay"` // switch TCP_NODELAY per relayed connection by its write sizes
+	Keepalive        int                         `toml:"keepalive_period"`
+	KeepaliveMode    string                      `toml:"keepalive_mode"`   // "tcp", "ping" or "both"
+	KeepaliveJitter  int                         `toml:"keepalive_jitter"` // percent keepalive intervals vary by
+	PingInterval     int                         `toml:"ping_interval"`    // seconds between pings on tunnel connections
+	LogLevel         string                      `toml:"log_level"`
+	Forwarder        []string                    `toml:"forwarder"`
+	ForwarderOptions map[string]ForwarderOptions `toml:"forwarder_options"`
+	DialTimeout      float64                     `toml:"dial_timeout"`      // seconds, for the server and the targets
+	HandshakeTimeout float64                     `toml:"handshake_timeout"` // seconds
+	ReadTimeout      float64                     `toml:"read_timeout"`      // seconds without data from a target, 0 disables it
+	DNSTTL           int                         `toml:"dns_ttl"`           // seconds target host names are cached, 0 follows their records
+	ClientID         string                      `toml:"client_id"`         // sent to the server to tell this client apart, random when empty
+	FlapThreshold    int                         `toml:"flap_threshold"`    // restarts within an hour before waiting longer to reconnect, negative for never
+	PPROF            bool                        `toml:"pprof"`
+	MuxSession       int                         `toml:"mux_session"`
+	MuxVersion       int                         `toml:"mux_version"`
+	MaxFrameSize     int                         `toml:"mux_framesize"`
+	MaxReceiveBuffer int                         `toml:"mux_recievebuffer"`
+	MaxStreamBuffer  int                         `toml:"mux_streambuffer"`
+	MuxTLS           bool                        `toml:"mux_tls"`           // wrap tcpmux tunnel connections in TLS
+	TLSPin           string                      `toml:"tls_pin"`           // SHA-256 fingerprint of the server certificate, for mux_tls and wss
+	NoisePrivateKey  string                      `toml:"noise_private_key"` // secure tcpmux tunnel connections with Noise_IK instead
+	NoiseServerKey   string                      `toml:"noise_server_key"`  // public key of the server
+	Sniffer          bool                        `toml:"sniffer"`
+	WebPort          int                         `toml:"web_port"`
+	SnifferLog       string                      `toml:"sniffer_log"`
+	SnifferLogSize   int                         `toml:"sniffer_log_max_size"` // MB the sniffer log reaches before it is rotated, negative for no limit
+	SnifferLogAge    int                         `toml:"sniffer_log_max_age"`  // hours before it is rotated, negative for no limit
+	SnifferLogKeep   int                         `toml:"sniffer_log_keep"`     // days rotated sniffer logs are kept, negative for ever
+	SnifferHistory   int                         `toml:"sniffer_history_keep"` // days the 5-minute usage history is kept, negative for none
+	AllowedPorts     []any                       `toml:"allowed_ports"`
+	AllowedTargets   []string                    `toml:"allowed_targets"`
+	TunAddr          string                      `toml:"tun_addr"`        // address and subnet of a TUN device whose packets go to the server
+	TunName          string                      `toml:"tun_name"`        // of the TUN device, picked by the system when empty
+	TunMTU           int                         `toml:"tun_mtu"`         // of the TUN device
+	TunRoutes        []string                    `toml:"tun_routes"`      // subnets behind the server routed into the TUN device
+	DNSListen        string                      `toml:"dns_listen"`      // UDP and TCP address taking DNS queries resolved by the server
+	SocksBind        string                      `toml:"socks_bind"`      // SOCKS5 listener whose connections the server dials
+	HTTPProxyBind    string                      `toml:"http_proxy_bind"` // HTTP proxy listener whose connections the server dials
+	ProxyUser        string                      `toml:"proxy_user"`      // asked for by both listeners, with proxy_pass
+	ProxyPass        string                      `toml:"proxy_pass"`
+	ProxyAllowedIPs  []string                    `toml:"proxy_allowed_ips"` // addresses that may connect to them, any when empty
+	InfluxURL        string                      `toml:"influx_url"`
+	InfluxToken      string                      `toml:"influx_token"`
+	InfluxInterval   int                         `toml:"influx_interval"`
+	OTLPEndpoint     string                      `toml:"otlp_endpoint"`
+	PPROFPort        int                         `toml:"pprof_port"`
+	PPROFDumpDir     string                      `toml:"pprof_dump_dir"`
+	PPROFHeapLimit   int                         `toml:"pprof_heap_limit"`
+	PPROFGoroutines  int                         `toml:"pprof_goroutine_limit"`
+	ControlSocket    string                      `toml:"control_socket"`
+	ControlAddr      string                      `toml:"control_addr"` // TCP address of the control API, for control_keys
+	ControlKeys      []ControlKey                `toml:"control_keys"`
+	AuditLog         string                      `toml:"audit_log"`         // file the control API appends its changes to
+	Profile          string                      `toml:"profile"`           // "latency", "throughput" or "balanced"
+	RemoteManagement bool                        `toml:"remote_management"` // take forwarder changes, log levels, reloads and restarts from the server
+	UpdateURL        string                      `toml:"update_url"`        // signed release manifest the client updates itself from
+	UpdateKey        string                      `toml:"update_key"`        // ed25519 public key the manifest is signed with
+	UpdateInterval   int                         `toml:"update_interval"`   // minutes between checks of the manifest
+	ConfigPath       string                      `toml:"-"`                 // file the config was loaded from
+	NoPersist        string                      `toml:"-"`                 // why the forwarder can't be saved to ConfigPath, empty if it can
+	Instance         string                      `toml:"-"`                 // profile name in the log when the process runs several tunnels
+	Reload           Reloader                    `toml:"-"`                 // reads the config file again, nil without one
 }
 
+// Reloader returns the client config as the file has it now.
+type Reloader func() (ClientConfig, error)
+
 // Config represents the complete configuration, including both server and client settings.
 type Config struct {
+	StrictConfig bool         `toml:"strict_config"` // reject unknown keys instead of ignoring them
+	Include      []string     `toml:"include"`       // globs of files merged into this one, relative to it
+	Server       ServerConfig `toml:"server"`
+	Client       ClientConfig `toml:"client"`
+
+	Relay    RelayConfig             `toml:"relay"`
+	Profiles map[string]NamedProfile `toml:"profiles"` // picked with -p, over server and client
+}
+
+// RelayConfig sets up a node in the middle of a chain of tunnels. It runs a
+// client to the server before it and a server for the client of the next
+// hop, whose public ports the client dials. They listen on loopback unless
+// ports_addr says otherwise.
+type RelayConfig struct {
+	Upstream   ClientConfig `toml:"upstream"`   // to the entry server, like [client]
+	Downstream ServerConfig `toml:"downstream"` // for the next hop, like [server]
+}
+
+// NamedProfile is one of several tunnels set up in the same file. Its
+// settings replace the ones of the server and client tables.
+type NamedProfile struct {
 	Server ServerConfig `toml:"server"`
 	Client ClientConfig `toml:"client"`
 }
@@ -0,0 +1,247 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config file formats, detected by extension.
+const (
+	FormatTOML = "toml"
+	FormatYAML = "yaml"
+	FormatJSON = "json"
+)
+
+// FileFormat returns the format of a config file, TOML unless the extension
+// says otherwise.
+func FileFormat(path string) string {
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".json":
+		return FormatJSON
+	default:
+		return FormatTOML
+	}
+}
+
+// SaveForwarder writes the forwarder entries of the client back to the config
+// file at path. TOML and YAML files keep their comments, only the forwarder
+// lines change. JSON files are written anew with sorted keys.
+func SaveForwarder(path string, entries []string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	var out []byte
+	switch FileFormat(path) {
+	case FormatYAML:
+		out, err = setYAMLList(data, "client", "forwarder", entries)
+	case FormatJSON:
+		out, err = setJSONList(data, "client", "forwarder", entries)
+	default:
+		out, err = setTOMLArray(data, "client", "forwarder", entries)
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", path, err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	// replace the file in one step, a crash never leaves half of it behind
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, out, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// setTOMLArray sets key in table to an array of strings, replacing the lines
+// of its current value or adding it below the table header.
+func setTOMLArray(data []byte, table, key string, values []string) ([]byte, error) {
+	lines := strings.Split(string(data), "\n")
+
+	current, header := "", -1
+	start, end := -1, -1
+	for i := 0; i < len(lines) && start < 0; i++ {
+		line := strings.TrimSpace(lines[i])
+		if line == "" || line[0] == '#' {
+			continue
+		}
+
+		if line[0] == '[' {
+			if closing := strings.LastIndexByte(line, ']'); closing > 0 {
+				current = tomlKey(strings.Trim(line[:closing+1], "[]"))
+				if current == table && header < 0 {
+					header = i
+				}
+			}
+			continue
+		}
+
+		eq := strings.IndexByte(line, '=')
+		if eq < 0 {
+			continue
+		}
+		last := valueEnd(lines, i, line[eq+1:])
+		if current == table && tomlKey(line[:eq]) == key {
+			start, end = i, last
+		}
+		i = last // lines of a multi-line value are not keys or headers
+	}
+
+	var value []string
+	if start >= 0 {
+		indent := lines[start][:len(lines[start])-len(strings.TrimLeft(lines[start], " \t"))]
+		value = tomlArray(indent, key, values)
+		lines = append(lines[:start], append(value, lines[end+1:]...)...)
+	} else if header >= 0 {
+		value = tomlArray("", key, values)
+		lines = append(lines[:header+1], append(value, lines[header+1:]...)...)
+	} else {
+		return nil, fmt.Errorf("no [%s] table", table)
+	}
+	out := []byte(strings.Join(lines, "\n"))
+
+	// make sure the edit didn't break the file
+	var doc map[string]any
+	if _, err := toml.Decode(string(out), &doc); err != nil {
+		return nil, fmt.Errorf("failed to update %s.%s: %w", table, key, err)
+	}
+	return out, nil
+}
+
+// tomlKey strips whitespace and quotes around the parts of a dotted key.
+func tomlKey(key string) string {
+	parts := strings.Split(key, ".")
+	for i, part := range parts {
+		parts[i] = strings.Trim(strings.TrimSpace(part), `"'`)
+	}
+	return strings.Join(parts, ".")
+}
+
+// valueEnd returns the last line of the value that starts with rest on line
+// i, arrays and inline tables can span several lines.
+func valueEnd(lines []string, i int, rest string) int {
+	depth := bracketDepth(rest, 0)
+	for depth > 0 && i+1 < len(lines) {
+		i++
+		depth = bracketDepth(lines[i], depth)
+	}
+	return i
+}
+
+// bracketDepth adds the brackets opened and closed in s, outside of strings
+// and comments, to depth.
+func bracketDepth(s string, depth int) int {
+	var quote byte
+	for j := 0; j < len(s); j++ {
+		c := s[j]
+		switch {
+		case quote != 0:
+			if c == '\\' && quote == '"' {
+				j++
+			} else if c == quote {
+				quote = 0
+			}
+		case c == '"' || c == '\'':
+			quote = c
+		case c == '#':
+			return depth
+		case c == '[' || c == '{':
+			depth++
+		case c == ']' || c == '}':
+			depth--
+		}
+	}
+	return depth
+}
+
+// tomlArray formats key = [values] like the README does.
+func tomlArray(indent, key string, values []string) []string {
+	if len(values) == 0 {
+		return []string{indent + key + " = []"}
+	}
+	lines := []string{indent + key + " = ["}
+	for _, v := range values {
+		quoted, _ := json.Marshal(v) // a valid TOML basic string as well
+		lines = append(lines, indent+"   "+string(quoted)+",")
+	}
+	return append(lines, indent+"]")
+}
+
+// setYAMLList sets key in the table mapping to a list of strings.
+func setYAMLList(data []byte, table, key string, values []string) ([]byte, error) {
+	var root yaml.Node
+	if err := yaml.Unmarshal(data, &root); err != nil {
+		return nil, err
+	}
+	if len(root.Content) == 0 || root.Content[0].Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("no %s section", table)
+	}
+
+	section := yamlValue(root.Content[0], table)
+	if section == nil || section.Kind != yaml.MappingNode {
+		return nil, fmt.Errorf("no %s section", table)
+	}
+
+	list := &yaml.Node{Kind: yaml.SequenceNode, Tag: "!!seq"}
+	for _, v := range values {
+		list.Content = append(list.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: v})
+	}
+	if old := yamlValue(section, key); old != nil {
+		*old = *list
+	} else {
+		section.Content = append(section.Content, &yaml.Node{Kind: yaml.ScalarNode, Tag: "!!str", Value: key}, list)
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(2)
+	if err := enc.Encode(&root); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// yamlValue returns the value of key in a mapping node, nil if it is missing.
+func yamlValue(mapping *yaml.Node, key string) *yaml.Node {
+	for i := 0; i+1 < len(mapping.Content); i += 2 {
+		if mapping.Content[i].Value == key {
+			return mapping.Content[i+1]
+		}
+	}
+	return nil
+}
+
+// setJSONList sets key in the table object to a list of strings.
+func setJSONList(data []byte, table, key string, values []string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	var doc map[string]any
+	if err := dec.Decode(&doc); err != nil {
+		return nil, err
+	}
+	section, ok := doc[table].(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("no %s object", table)
+	}
+	section[key] = values
+
+	out, err := json.MarshalIndent(doc, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+	return append(out, '\n'), nil
+}
@@ -0,0 +1,126 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+)
+
+// AuditEntry is one line of the audit log, a call that changes something.
+type AuditEntry struct {
+	Time   time.Time `json:"time"`
+	Key    string    `json:"key"` // name of the API key, "socket" for the unix socket
+	Remote string    `json:"remote,omitempty"`
+	Method string    `json:"method"`
+	Path   string    `json:"path"`
+	Status int       `json:"status"`
+	Action string    `json:"action,omitempty"` // what changed, as told by the handler
+}
+
+type auditKey struct{}
+
+// Audit describes the change a request made for the audit log. Handlers of
+// routes that change something call it once the change is done.
+func Audit(r *http.Request, format string, args ...any) {
+	if action, ok := r.Context().Value(auditKey{}).(*string); ok {
+		*action = fmt.Sprintf(format, args...)
+	}
+}
+
+// AuditLog appends the calls that change something to the file at path, one
+// JSON object per line, instead of logging them. The file is only ever
+// appended to.
+func (s *Server) AuditLog(path string) error {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	s.auditFile = file
+	return nil
+}
+
+// record writes an entry to the audit log, or the log without one.
+func (s *Server) record(entry AuditEntry) {
+	if s.writeAudit(entry) {
+		return
+	}
+	if entry.Action != "" {
+		s.logger.Infof("control API: %s %s by %s: %d, %s", entry.Method, entry.Path, entry.Key, entry.Status, entry.Action)
+	} else {
+		s.logger.Infof("control API: %s %s by %s: %d", entry.Method, entry.Path, entry.Key, entry.Status)
+	}
+}
+
+// writeAudit appends an entry to the audit log, false without one.
+func (s *Server) writeAudit(entry AuditEntry) bool {
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	if s.auditFile == nil {
+		return false
+	}
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return true
+	}
+	if _, err := s.auditFile.Write(append(line, '\n')); err != nil {
+		s.logger.Errorf("failed to write audit log: %v", err)
+	}
+	return true
+}
+
+// statusRecorder keeps the status of a response for the audit log.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
+
+// audit records the calls that change something, with who made them.
+func (s *Server) audit(who string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !changes(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var action string
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(rec, r.WithContext(context.WithValue(r.Context(), auditKey{}, &action)))
+		s.record(newAuditEntry(r, who, rec.status, action))
+	})
+}
+
+func newAuditEntry(r *http.Request, who string, status int, action string) AuditEntry {
+	return AuditEntry{
+		Time:   time.Now(),
+		Key:    who,
+		Remote: r.RemoteAddr,
+		Method: r.Method,
+		Path:   r.URL.RequestURI(),
+		Status: status,
+		Action: action,
+	}
+}
+
+// changes reports whether a request may change something.
+func changes(r *http.Request) bool {
+	return r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+// closeAuditLog closes the audit log once the control API stopped.
+func (s *Server) closeAuditLog(ctx context.Context) {
+	<-ctx.Done()
+	if s.auditFile == nil {
+		return
+	}
+	s.auditMu.Lock()
+	defer s.auditMu.Unlock()
+	s.auditFile.Close()
+	s.auditFile = nil
+}
@@ -0,0 +1,159 @@
+package control
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+)
+
+// Scopes of API keys. A route needs the scope it was registered with, or
+// ScopeRead for GET and ScopeAdmin otherwise. ScopeAdmin allows everything.
+const (
+	ScopeRead  = "read"  // status, sessions, ports and other stats
+	ScopePorts = "ports" // change ports and their targets
+	ScopeAdmin = "admin" // everything, e.g. pprof and speedtests
+)
+
+const hashPrefix = "sha256:"
+
+// NewKey returns a new random API key and its hash for the config.
+func NewKey() (string, string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	key := "bh_" + hex.EncodeToString(b)
+	return key, HashKey(key), nil
+}
+
+// HashKey returns the hash of an API key as set in the config.
+func HashKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hashPrefix + hex.EncodeToString(sum[:])
+}
+
+// apiKey is a configured key with the state of its rate limit.
+type apiKey struct {
+	config.ControlKey
+	hash []byte
+
+	mu     sync.Mutex
+	tokens float64 // requests left, refilled at Rate per minute
+	last   time.Time
+}
+
+func newAPIKey(key config.ControlKey) (*apiKey, error) {
+	if key.Name == "" {
+		return nil, fmt.Errorf("API key without a name")
+	}
+	hash, err := hex.DecodeString(strings.TrimPrefix(key.Hash, hashPrefix))
+	if err != nil || !strings.HasPrefix(key.Hash, hashPrefix) || len(hash) != sha256.Size {
+		return nil, fmt.Errorf("API key %s: hash must be %q and 64 hex digits", key.Name, hashPrefix)
+	}
+	for _, scope := range key.Scopes {
+		if scope != ScopeRead && scope != ScopePorts && scope != ScopeAdmin {
+			return nil, fmt.Errorf("API key %s: unknown scope %q", key.Name, scope)
+		}
+	}
+	return &apiKey{ControlKey: key, hash: hash, tokens: float64(key.Rate), last: time.Now()}, nil
+}
+
+// allows reports whether the key may use a route that needs scope. Keys that
+// may change ports may read as well.
+func (k *apiKey) allows(scope string) bool {
+	switch {
+	case slices.Contains(k.Scopes, ScopeAdmin), slices.Contains(k.Scopes, scope):
+		return true
+	case scope == ScopeRead:
+		return slices.Contains(k.Scopes, ScopePorts)
+	}
+	return false
+}
+
+// take spends one request of the rate limit, false when there is none left.
+func (k *apiKey) take() bool {
+	if k.Rate <= 0 {
+		return true
+	}
+	k.mu.Lock()
+	defer k.mu.Unlock()
+
+	now := time.Now()
+	k.tokens = min(float64(k.Rate), k.tokens+now.Sub(k.last).Minutes()*float64(k.Rate))
+	k.last = now
+	if k.tokens < 1 {
+		return false
+	}
+	k.tokens--
+	return true
+}
+
+// lookupKey finds the key a request was made with, nil if it has none or an
+// unknown one.
+func (s *Server) lookupKey(r *http.Request) *apiKey {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		return nil
+	}
+	sum := sha256.Sum256([]byte(token))
+	for _, key := range s.keys {
+		if subtle.ConstantTimeCompare(sum[:], key.hash) == 1 {
+			return key
+		}
+	}
+	return nil
+}
+
+// scopeOf returns the scope a request needs.
+func (s *Server) scopeOf(r *http.Request) string {
+	_, pattern := s.mux.Handler(r)
+	if scope, ok := s.scopes[pattern]; ok {
+		return scope
+	}
+	if r.Method == http.MethodGet || r.Method == http.MethodHead {
+		return ScopeRead
+	}
+	return ScopeAdmin
+}
+
+// authorize lets requests to control_addr through with a key that has the
+// scope of the route and requests left, and audits the calls that change
+// something, refused or not.
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := s.lookupKey(r)
+		switch scope := s.scopeOf(r); {
+		case key == nil:
+			s.logger.Warnf("control API request %s %s from %s without a valid API key", r.Method, r.URL.Path, r.RemoteAddr)
+			s.refuse(w, r, "-", http.StatusUnauthorized, fmt.Errorf("missing or unknown API key"))
+			return
+		case !key.allows(scope):
+			s.logger.Warnf("API key %s may not %s %s, it needs the %s scope", key.Name, r.Method, r.URL.Path, scope)
+			s.refuse(w, r, key.Name, http.StatusForbidden, fmt.Errorf("API key %s lacks the %s scope", key.Name, scope))
+			return
+		case !key.take():
+			w.Header().Set("Retry-After", "60")
+			s.refuse(w, r, key.Name, http.StatusTooManyRequests, fmt.Errorf("API key %s is over its rate of %d requests per minute", key.Name, key.Rate))
+			return
+		}
+		s.audit(key.Name, next).ServeHTTP(w, r)
+	})
+}
+
+// refuse answers with an error, and adds it to the audit log if the request
+// would have changed something. The log has a warning already.
+func (s *Server) refuse(w http.ResponseWriter, r *http.Request, who string, status int, err error) {
+	WriteError(w, status, err)
+	if changes(r) {
+		s.writeAudit(newAuditEntry(r, who, status, ""))
+	}
+}
@@ -0,0 +1,28 @@
+package control
+
+// What a server can have a client with remote_management do.
+const (
+	CommandReload    = "reload"    // read the config file again
+	CommandForwarder = "forwarder" // change or delete a forwarder entry
+	CommandLogLevel  = "log-level" // switch the log level
+	CommandRestart   = "restart"   // reconnect the tunnel
+)
+
+// ClientCommand is a change a server pushes to a client over the control
+// channel, answered by a ClientResult with the same ID.
+type ClientCommand struct {
+	ID      uint64 `json:"id"`
+	Action  string `json:"action"`
+	Port    int    `json:"port,omitempty"`    // of the forwarder entry
+	Target  string `json:"target,omitempty"`  // new forwarder entry, empty to delete it
+	Drain   string `json:"drain,omitempty"`   // after which relays to the old target are closed
+	Persist bool   `json:"persist,omitempty"` // save the forwarder to the config file
+	Level   string `json:"level,omitempty"`   // new log level
+}
+
+// ClientResult is the answer of a client to a ClientCommand.
+type ClientResult struct {
+	ID        uint64    `json:"id"`
+	Error     string    `json:"error,omitempty"`
+	Forwarder []Forward `json:"forwarder,omitempty"` // entries after a change of the forwarder or a reload
+}
@@ -0,0 +1,128 @@
+// Package control serves the local control API, HTTP over a unix socket, used
+// to inspect and change a running instance. It can also be served over TCP to
+// requests with a scoped API key.
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Server is the control API of one instance.
+type Server struct {
+	path   string // unix socket, empty for none
+	addr   string // TCP address taking API keys, empty for none
+	keys   []*apiKey
+	mux    *http.ServeMux
+	scopes map[string]string // by pattern, for routes that need more than their method implies
+	logger *logrus.Logger
+
+	auditMu   sync.Mutex
+	auditFile *os.File // audit_log, nil to log the changes instead
+}
+
+func NewServer(path string, logger *logrus.Logger) *Server {
+	return &Server{
+		path:   path,
+		mux:    http.NewServeMux(),
+		scopes: make(map[string]string),
+		logger: logger,
+	}
+}
+
+// Handle registers a handler, patterns follow http.ServeMux (e.g. "GET /status").
+// API keys need ScopeRead for GET routes and ScopeAdmin for the others.
+func (s *Server) Handle(pattern string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// HandleScope registers a handler that API keys with scope may use.
+func (s *Server) HandleScope(pattern, scope string, handler http.HandlerFunc) {
+	s.scopes[pattern] = scope
+	s.mux.HandleFunc(pattern, handler)
+}
+
+// ListenTCP serves the control API on addr as well, to requests with one of
+// keys in their Authorization header.
+func (s *Server) ListenTCP(addr string, keys []config.ControlKey) error {
+	s.addr = addr
+	s.keys = nil
+	for _, key := range keys {
+		k, err := newAPIKey(key)
+		if err != nil {
+			return err
+		}
+		s.keys = append(s.keys, k)
+	}
+	if len(s.keys) == 0 {
+		return errors.New("control_addr needs at least one of control_keys")
+	}
+	return nil
+}
+
+// Run serves the control API until ctx is done. Only the owner of the process
+// can connect to the socket, control_addr takes API keys.
+func (s *Server) Run(ctx context.Context) {
+	go s.closeAuditLog(ctx)
+	if s.addr != "" {
+		go s.serve(ctx, "tcp", s.addr, s.authorize(s.mux))
+	}
+	if s.path == "" {
+		<-ctx.Done()
+		return
+	}
+
+	os.Remove(s.path) // stale socket of a process that didn't exit cleanly
+	s.serve(ctx, "unix", s.path, s.audit("socket", s.mux))
+}
+
+func (s *Server) serve(ctx context.Context, network, address string, handler http.Handler) {
+	listener, err := net.Listen(network, address)
+	if err != nil {
+		s.logger.Errorf("failed to listen on control %s %s: %v", network, address, err)
+		return
+	}
+	if network == "unix" {
+		if err := os.Chmod(address, 0600); err != nil {
+			s.logger.Errorf("failed to restrict control socket %s: %v", address, err)
+			listener.Close()
+			return
+		}
+	}
+
+	server := &http.Server{Handler: handler}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+		server.Shutdown(shutdownCtx)
+	}()
+
+	s.logger.Infof("control API listening on %s", address)
+	if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+		s.logger.Errorf("control API error: %v", err)
+	}
+}
+
+// WriteJSON writes v as the JSON response.
+func WriteJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// WriteError writes an error response with the given status.
+func WriteError(w http.ResponseWriter, status int, err error) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+}
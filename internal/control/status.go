@@ -0,0 +1,210 @@
+package control
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+// Status is the response of GET /status.
+type Status struct {
+	Role        string    `json:"role"`      // "server" or "client"
+	Transport   string    `json:"transport"` // tcp, tcpmux, ws or wss
+	Addr        string    `json:"addr"`      // bind address of a server, remote address of a client
+	Tunnel      string    `json:"tunnel"`    // e.g. "Connected (TCPMux)"
+	Started     time.Time `json:"started"`
+	Connections int64     `json:"connections"` // relayed right now
+	Sessions    int       `json:"sessions"`
+}
+
+// Session is a tunnel connection, listed by GET /sessions.
+type Session struct {
+	ID         int          `json:"id"`
+	RemoteAddr string       `json:"remote_addr"`
+	Streams    int          `json:"streams"`            // open streams, tcpmux only
+	Pool       int          `json:"pool"`               // idle pooled connections, tcp and ws servers only
+	Client     string       `json:"client,omitempty"`   // ID of the client, servers only
+	Connects   int          `json:"connects,omitempty"` // of the client within the last hour
+	Flapping   bool         `json:"flapping,omitempty"` // the client reconnects too often
+	Relays     int64        `json:"relays,omitempty"`   // open relays the client reported, servers only
+	RTT        float64      `json:"rtt,omitempty"`      // round trip in milliseconds, measured for port schedules or over the control stream
+	Mbps       float64      `json:"mbps,omitempty"`     // recent peak throughput, measured for port schedules only
+	Stats      *ClientStats `json:"stats,omitempty"`    // last report of the client, servers only
+	Version    string       `json:"version,omitempty"`  // of backhaul on the client, sent by newer clients to servers
+}
+
+// ClientStats is what a client reports of its end of the tunnel with each
+// heartbeat.
+type ClientStats struct {
+	Relays     int64     `json:"relays"`      // open relays, over all sessions
+	Backends   int       `json:"backends"`    // targets of the forwarder
+	Degraded   int       `json:"degraded"`    // of them failing health checks
+	Down       int       `json:"down"`        // of them taking no traffic
+	Dials      int64     `json:"dials"`       // to targets within the last minute
+	DialErrors int64     `json:"dial_errors"` // of them failed
+	CPU        float64   `json:"cpu"`         // percent of the host in use
+	Memory     float64   `json:"memory"`      // percent of the host in use
+	Version    string    `json:"version"`     // of backhaul, empty from older clients
+	Updated    time.Time `json:"updated"`     // when the server got it
+}
+
+// String sums the report up in a line, for the dashboard.
+func (s ClientStats) String() string {
+	summary := fmt.Sprintf("CPU %.1f%%, RAM %.1f%%, %d relays", s.CPU, s.Memory, s.Relays)
+	if s.Backends > 0 {
+		summary += fmt.Sprintf(", %d/%d backends up", s.Backends-s.Degraded-s.Down, s.Backends)
+	}
+	if s.Dials > 0 {
+		summary += fmt.Sprintf(", %d/%d dials failed in the last minute", s.DialErrors, s.Dials)
+	}
+	return summary
+}
+
+// KnownClient is a client in the registry of a server, listed by GET /clients.
+type KnownClient struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name,omitempty"`  // given by the operator
+	Ports     []string  `json:"ports,omitempty"` // ranges assigned to the client, written like the ports of the server
+	Quota     Quota     `json:"quota"`
+	FirstSeen time.Time `json:"first_seen"`          // zero until the client connects
+	LastSeen  time.Time `json:"last_seen"`           // last connect or report
+	Addr      string    `json:"addr,omitempty"`      // the client last connected from
+	Version   string    `json:"version,omitempty"`   // of backhaul, reported by newer clients
+	Changed   time.Time `json:"changed"`             // by the operator, the latest change wins in a cluster
+	Deleted   bool      `json:"deleted,omitempty"`   // by the operator, kept for the cluster peers and never listed
+	Connected bool      `json:"connected,omitempty"` // now, filled in by the API
+}
+
+// Quota is what a client of the registry may use, 0 for no limit.
+type Quota struct {
+	Connections int `json:"connections,omitempty"` // relays at once
+	Mbps        int `json:"mbps,omitempty"`
+	TrafficGB   int `json:"traffic_gb,omitempty"` // per month
+}
+
+// Port is a forwarded port, listed by GET /ports.
+type Port struct {
+	Port   int    `json:"port"`             // listen port of a server, target port of a client
+	Name   string `json:"name,omitempty"`   // of the forward table, sent to tcpmux clients over the control stream
+	Target string `json:"target,omitempty"` // port the client dials, server only
+	Active int64  `json:"active"`
+	Total  int64  `json:"total"`
+	Bytes  int64  `json:"bytes"` // only counted with the sniffer enabled
+}
+
+// Forward is a forwarder entry of a client, listed by GET /forwarder.
+type Forward struct {
+	Port     int       `json:"port"`
+	Target   string    `json:"target"`
+	Draining int       `json:"draining"` // relays still on an older target
+	Backends []Backend `json:"backends"`
+}
+
+// Backend is a target of a forwarder entry.
+type Backend struct {
+	Target      string `json:"target"`
+	Weight      int    `json:"weight"`
+	State       string `json:"state"` // "up", "degraded" or "down"
+	Connections int    `json:"connections"`
+	Fails       int    `json:"fails,omitempty"` // health checks failed in a row
+	Error       string `json:"error,omitempty"` // of the last failed health check
+}
+
+// Path is a network path of a client, listed by GET /paths.
+type Path struct {
+	Local    string  `json:"local"`  // address the client dials from
+	Remote   string  `json:"remote"` // server dialed over it
+	State    string  `json:"state"`  // "up" or "down"
+	Sessions int     `json:"sessions"`
+	Fails    int     `json:"fails,omitempty"` // dials failed in a row
+	Error    string  `json:"error,omitempty"` // of the last failed dial
+	Bytes    int64   `json:"bytes"`           // both ways, since the client started
+	Mbps     float64 `json:"mbps"`            // over the last few seconds
+}
+
+// ClusterNode is a server of a cluster, listed by GET /cluster.
+type ClusterNode struct {
+	Name    string         `json:"name"`              // cluster_name, the bind address by default
+	Self    bool           `json:"self,omitempty"`    // the server answering
+	Active  bool           `json:"active"`            // holds the tunnel, the others are standby
+	Clients map[string]int `json:"clients,omitempty"` // IDs of the connected clients, with their connects within the last hour
+	Ports   map[int]Port   `json:"ports,omitempty"`   // counters of this server, by listen port
+	Known   []KnownClient  `json:"known,omitempty"`   // the registry, shared with the peers only
+	Updated time.Time      `json:"updated"`           // when the state was taken
+	Down    bool           `json:"down,omitempty"`    // not heard from lately, its last state is shown
+}
+
+// Attack is the state of the attack mode, served by GET /attack.
+type Attack struct {
+	Mode       string    `json:"mode"` // "off", "on" or "auto"
+	Active     bool      `json:"active"`
+	Since      time.Time `json:"since"`       // when the attack started, zero if not under attack
+	Rate       int64     `json:"rate"`        // public connections in the last second
+	SynCookies uint64    `json:"syn_cookies"` // sent by the kernel in the last second
+	Refused    int64     `json:"refused"`     // public connections refused under attack
+}
+
+// Get queries the control API behind the socket at path and decodes the JSON
+// response into v.
+func Get(path, endpoint string, v any) error {
+	return do(path, http.MethodGet, endpoint, 5*time.Second, v)
+}
+
+// Post sends a request without body to the control API and decodes the JSON
+// response into v. Actions like speedtests take a while, so it waits longer.
+func Post(path, endpoint string, v any) error {
+	return do(path, http.MethodPost, endpoint, 5*time.Minute, v)
+}
+
+// Put and Delete change a setting of the running instance and decode the
+// JSON response into v.
+func Put(path, endpoint string, v any) error {
+	return do(path, http.MethodPut, endpoint, 5*time.Second, v)
+}
+
+func Delete(path, endpoint string, v any) error {
+	return do(path, http.MethodDelete, endpoint, 5*time.Second, v)
+}
+
+func do(path, method, endpoint string, timeout time.Duration, v any) error {
+	client := &http.Client{
+		Timeout: timeout,
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+				var d net.Dialer
+				return d.DialContext(ctx, "unix", path)
+			},
+		},
+	}
+
+	// the host is ignored, the request always goes to the socket
+	req, err := http.NewRequest(method, "http://backhaul"+endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Error string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && e.Error != "" {
+			return fmt.Errorf("%s %s: %s", method, endpoint, e.Error)
+		}
+		return fmt.Errorf("%s %s: %s", method, endpoint, resp.Status)
+	}
+	return json.Unmarshal(body, v)
+}
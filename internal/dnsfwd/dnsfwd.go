@@ -0,0 +1,84 @@
+// Package dnsfwd resolves the DNS queries of a client on the network of the
+// server, for names that only resolve there. Like the packets of package tun,
+// the queries go over one tunnel connection at a time: the server hands its
+// transport a connection as if a public connection came for Port, and the
+// client sends the queries of its local listener over the tunnel connections
+// for Port. Each message goes as its length in two bytes and the message, as
+// DNS over TCP does.
+package dnsfwd
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strings"
+	"time"
+)
+
+// Port is the target port the server resolves the queries of the client on,
+// next to tun.Port. Like the others up to utils.MaxReservedPort, no public
+// port can target it.
+const Port = 9
+
+// how long a query may take to be answered, by the upstream of the server or
+// over the tunnel
+const queryTimeout = 5 * time.Second
+
+// maxMessage is the largest DNS message, its length takes two bytes.
+const maxMessage = 0xffff
+
+// readMessage reads a message with its length in front.
+func readMessage(r *bufio.Reader, buf []byte) ([]byte, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return nil, err
+	}
+	n := binary.BigEndian.Uint16(size[:])
+	if _, err := io.ReadFull(r, buf[:n]); err != nil {
+		return nil, err
+	}
+	return buf[:n], nil
+}
+
+// frame returns msg with its length in front.
+func frame(msg []byte) []byte {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	return buf
+}
+
+// servfail returns the SERVFAIL answer to query, which holds at least a
+// header.
+func servfail(query []byte) []byte {
+	answer := append([]byte(nil), query...)
+	answer[2] |= 0x80                     // QR, a response
+	answer[3] = answer[3]&0x70 | 0x80 | 2 // RA, RCODE 2
+	return answer
+}
+
+// SystemUpstream returns the first nameserver of /etc/resolv.conf.
+func SystemUpstream() (string, error) {
+	data, err := os.ReadFile("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+// upstreamAddr adds port 53 to an upstream without a port.
+func upstreamAddr(upstream string) string {
+	if _, _, err := net.SplitHostPort(upstream); err != nil {
+		return net.JoinHostPort(strings.Trim(upstream, "[]"), "53")
+	}
+	return upstream
+}
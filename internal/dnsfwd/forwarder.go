@@ -0,0 +1,204 @@
+package dnsfwd
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// idleTimeout closes a TCP connection to the listener that sent no query for
+// this long, as DNS servers do.
+const idleTimeout = 10 * time.Second
+
+// Forwarder is the client end, it takes the queries of its UDP and TCP
+// listeners over the tunnel to the server. Queries are given their own IDs,
+// so those of different askers don't clash, and answered with SERVFAIL while
+// the server is not linked.
+type Forwarder struct {
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	active  io.ReadWriteCloser // the tunnel connection in use
+	nextID  uint16
+	pending map[uint16]*query
+
+	writeMu sync.Mutex // so the messages of concurrent queries don't mix
+}
+
+// query is a query waiting for its answer from the server.
+type query struct {
+	id    uint16 // the ID it was asked with
+	reply func([]byte)
+	timer *time.Timer
+}
+
+// Listen starts the UDP and TCP listeners of a forwarder on addr, which are
+// closed with ctx.
+func Listen(ctx context.Context, addr string, logger *logrus.Logger) (*Forwarder, error) {
+	packetConn, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		packetConn.Close()
+		return nil, err
+	}
+	context.AfterFunc(ctx, func() {
+		packetConn.Close()
+		listener.Close()
+	})
+
+	f := &Forwarder{logger: logger, pending: make(map[uint16]*query)}
+	go f.serveUDP(packetConn)
+	go f.serveTCP(listener)
+	logger.Infof("forwarding DNS queries on %s to the server", addr)
+	return f, nil
+}
+
+// Serve sends the queries over conn, a tunnel connection the server opened
+// for Port, until it breaks. It takes over from the connection before, which
+// the server gave up on.
+func (f *Forwarder) Serve(conn io.ReadWriteCloser) {
+	f.mu.Lock()
+	if f.active != nil {
+		f.active.Close()
+	}
+	f.active = conn
+	f.mu.Unlock()
+	f.logger.Info("DNS forwarder is linked to the server")
+
+	err := f.readAnswers(conn)
+	conn.Close()
+
+	f.mu.Lock()
+	if f.active == conn {
+		f.active = nil
+		f.logger.Infof("DNS forwarder lost the server: %v", err)
+	}
+	f.mu.Unlock()
+}
+
+func (f *Forwarder) readAnswers(conn io.Reader) error {
+	reader := bufio.NewReader(conn)
+	buf := make([]byte, maxMessage)
+	for {
+		answer, err := readMessage(reader, buf)
+		if err != nil {
+			return err
+		}
+		if len(answer) < 12 {
+			continue
+		}
+		id := binary.BigEndian.Uint16(answer)
+		f.mu.Lock()
+		q, ok := f.pending[id]
+		delete(f.pending, id)
+		f.mu.Unlock()
+		if !ok {
+			continue // answered too late
+		}
+		q.timer.Stop()
+		answer = append([]byte(nil), answer...)
+		binary.BigEndian.PutUint16(answer, q.id)
+		q.reply(answer)
+	}
+}
+
+// ask sends msg to the server with an ID of its own, and calls reply with
+// the answer, or a SERVFAIL if the server is not linked. Without an answer
+// in time, reply is not called and the asker tries again.
+func (f *Forwarder) ask(msg []byte, reply func([]byte)) {
+	if len(msg) < 12 {
+		return
+	}
+	f.mu.Lock()
+	conn := f.active
+	if conn == nil || len(f.pending) >= 0xffff {
+		f.mu.Unlock()
+		reply(servfail(msg))
+		return
+	}
+	for {
+		f.nextID++
+		if _, taken := f.pending[f.nextID]; !taken {
+			break
+		}
+	}
+	id := f.nextID
+	q := &query{id: binary.BigEndian.Uint16(msg), reply: reply}
+	q.timer = time.AfterFunc(queryTimeout, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if f.pending[id] == q {
+			delete(f.pending, id)
+		}
+	})
+	f.pending[id] = q
+	f.mu.Unlock()
+
+	framed := frame(msg)
+	binary.BigEndian.PutUint16(framed[2:], id)
+	f.writeMu.Lock()
+	_, err := conn.Write(framed)
+	f.writeMu.Unlock()
+	if err != nil {
+		f.logger.Debugf("failed to send a DNS query to the server: %v", err)
+		conn.Close()
+	}
+}
+
+func (f *Forwarder) serveUDP(conn net.PacketConn) {
+	buf := make([]byte, maxMessage)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.logger.Errorf("DNS forwarder stopped reading UDP queries: %v", err)
+			}
+			return
+		}
+		f.ask(append([]byte(nil), buf[:n]...), func(answer []byte) {
+			conn.WriteTo(answer, addr)
+		})
+	}
+}
+
+func (f *Forwarder) serveTCP(listener net.Listener) {
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				f.logger.Errorf("DNS forwarder stopped accepting TCP queries: %v", err)
+			}
+			return
+		}
+		go f.handleTCP(conn)
+	}
+}
+
+// handleTCP answers the queries of conn, which may ask several at once.
+func (f *Forwarder) handleTCP(conn net.Conn) {
+	defer conn.Close()
+	var mu sync.Mutex // of the writes to conn
+	reader := bufio.NewReader(conn)
+	for {
+		conn.SetReadDeadline(time.Now().Add(idleTimeout))
+		msg, err := readMessage(reader, make([]byte, maxMessage))
+		if err != nil {
+			return
+		}
+		f.ask(msg, func(answer []byte) {
+			mu.Lock()
+			defer mu.Unlock()
+			conn.Write(frame(answer))
+		})
+	}
+}
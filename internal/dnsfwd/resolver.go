@@ -0,0 +1,126 @@
+package dnsfwd
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maxInflight is how many queries of a client the server resolves at once,
+// the next ones wait.
+const maxInflight = 256
+
+// Resolver is the server end, it answers the queries of the client with its
+// upstream resolver.
+type Resolver struct {
+	upstream string
+	logger   *logrus.Logger
+	conns    chan net.Conn // taken by the server transport
+}
+
+// NewResolver returns a resolver asking upstream, a host with an optional
+// port, or the first nameserver of the system if empty.
+func NewResolver(upstream string, logger *logrus.Logger) (*Resolver, error) {
+	if upstream == "" {
+		var err error
+		if upstream, err = SystemUpstream(); err != nil {
+			return nil, err
+		}
+	}
+	return &Resolver{upstream: upstreamAddr(upstream), logger: logger, conns: make(chan net.Conn)}, nil
+}
+
+// Conns returns the channel the server transport takes the connections for
+// the queries from, like the queue of a public port.
+func (r *Resolver) Conns() chan net.Conn {
+	return r.conns
+}
+
+// Run hands the server transport a connection for the queries, and another
+// one whenever it ended, until ctx is done.
+func (r *Resolver) Run(ctx context.Context) {
+	r.logger.Infof("resolving the DNS queries of the client with %s", r.upstream)
+	utils.ServePipes(ctx, r.conns, 1, Port, nil, func(conn net.Conn, release func()) {
+		err := r.serve(conn)
+		if ctx.Err() == nil {
+			r.logger.Debugf("tunnel connection for the DNS queries ended: %v", err)
+		}
+	})
+}
+
+// serve answers the queries coming over conn until it breaks, each in its own
+// goroutine as answers may take a while.
+func (r *Resolver) serve(conn net.Conn) error {
+	defer conn.Close()
+	var mu sync.Mutex // of the writes to conn
+	inflight := make(chan struct{}, maxInflight)
+
+	reader := bufio.NewReader(conn)
+	for {
+		query, err := readMessage(reader, make([]byte, maxMessage))
+		if err != nil {
+			return err
+		}
+		if len(query) < 12 {
+			continue // not even a header
+		}
+		inflight <- struct{}{}
+		go func() {
+			defer func() { <-inflight }()
+			answer, err := r.exchange(query)
+			if err != nil {
+				r.logger.Debugf("failed to resolve a DNS query with %s: %v", r.upstream, err)
+				answer = servfail(query)
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			conn.Write(frame(answer))
+		}()
+	}
+}
+
+// exchange asks the upstream over UDP, and again over TCP if the answer was
+// truncated.
+func (r *Resolver) exchange(query []byte) ([]byte, error) {
+	conn, err := net.DialTimeout("udp", r.upstream, queryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(queryTimeout))
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxMessage)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// a stray answer to an earlier query is skipped
+		if n < 12 || buf[0] != query[0] || buf[1] != query[1] {
+			continue
+		}
+		if buf[2]&0x02 == 0 { // not truncated
+			return buf[:n], nil
+		}
+		break
+	}
+
+	tcpConn, err := net.DialTimeout("tcp", r.upstream, queryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer tcpConn.Close()
+	tcpConn.SetDeadline(time.Now().Add(queryTimeout))
+	if _, err := tcpConn.Write(frame(query)); err != nil {
+		return nil, err
+	}
+	return readMessage(bufio.NewReader(tcpConn), buf)
+}
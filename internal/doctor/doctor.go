@@ -0,0 +1,315 @@
+// Package doctor checks a configuration against the machine and the network
+// and prints a report, for "backhaul doctor".
+package doctor
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	dialTimeout   = 5 * time.Second
+	probes        = 3
+	echoPings     = 10
+	echoBytes     = 16 * 1024 * 1024
+	echoChunkSize = 32 * 1024
+)
+
+// Report collects the results of the checks.
+type Report struct {
+	w      io.Writer
+	failed bool
+}
+
+// Failed reports whether any check failed.
+func (r *Report) Failed() bool { return r.failed }
+
+func (r *Report) line(status, check, format string, args ...any) {
+	fmt.Fprintf(r.w, "[%-4s] %-12s %s\n", status, check, fmt.Sprintf(format, args...))
+}
+
+func (r *Report) ok(check, format string, args ...any)   { r.line("ok", check, format, args...) }
+func (r *Report) warn(check, format string, args ...any) { r.line("warn", check, format, args...) }
+func (r *Report) skip(check, format string, args ...any) { r.line("skip", check, format, args...) }
+
+func (r *Report) fail(check, format string, args ...any) {
+	r.failed = true
+	r.line("fail", check, format, args...)
+}
+
+// Run checks the configuration and writes the report to w.
+func Run(cfg *config.Config, w io.Writer) *Report {
+	r := &Report{w: w}
+	if cfg.Server.BindAddr != "" {
+		r.server(&cfg.Server)
+	} else {
+		r.client(&cfg.Client)
+	}
+	return r
+}
+
+func (r *Report) client(cfg *config.ClientConfig) {
+	r.ok("config", "client, %s transport to %s", cfg.Transport, cfg.RemoteAddr)
+
+	// the running client knows best whether the tunnel is up
+	running := r.controlStatus(cfg.ControlSocket)
+	connected := running != nil && strings.HasPrefix(running.Tunnel, "Connected")
+
+	host, _, err := net.SplitHostPort(cfg.RemoteAddr)
+	if err != nil {
+		r.fail("config", "invalid remote_addr %q: %v", cfg.RemoteAddr, err)
+		return
+	}
+	ips, err := net.LookupHost(host)
+	if err != nil {
+		r.fail("dns", "failed to resolve %s: %v", host, err)
+		return
+	}
+	r.ok("dns", "%s resolves to %s", host, strings.Join(ips, ", "))
+
+	// tcp servers put every connection from the client's address into the
+	// pool, so probing an established tcp tunnel would hand out dead ones
+	count := probes
+	if cfg.Transport == config.TCP {
+		if connected {
+			r.skip("reach", "tunnel is connected, not probing the tcp connection pool")
+			count = 0
+		} else {
+			count = 1
+		}
+	}
+	if count > 0 && !r.reach(cfg.RemoteAddr, count) {
+		return
+	}
+
+	if cfg.Transport == config.WSS {
+		r.certificate(cfg.RemoteAddr, host)
+	}
+
+	switch cfg.Transport {
+	case config.WS, config.WSS:
+		r.echo(cfg)
+	default:
+		switch {
+		case connected:
+			r.ok("handshake", "token accepted, the running client reports %q", running.Tunnel)
+		case running != nil:
+			r.fail("handshake", "the running client reports %q, check the token and the server log", running.Tunnel)
+		default:
+			r.skip("handshake", "only ws and wss can be tested directly, set control_socket to read the state of the running client")
+		}
+		r.skip("echo", "the echo stream is only offered by ws and wss servers")
+	}
+}
+
+func (r *Report) server(cfg *config.ServerConfig) {
+	r.ok("config", "server, %s transport on %s", cfg.Transport, cfg.BindAddr)
+
+	if _, err := utils.ParsePorts(cfg.Ports, cfg.Forward); err != nil {
+		r.fail("ports", "%v", err)
+	} else if len(cfg.Ports)+len(cfg.Forward) == 0 {
+		r.warn("ports", "no ports are forwarded")
+	} else {
+		r.ok("ports", "%d port mapping(s)", len(cfg.Ports)+len(cfg.Forward))
+	}
+
+	if running := r.controlStatus(cfg.ControlSocket); running != nil {
+		r.ok("listen", "the running server listens on %s", running.Addr)
+	} else if listener, err := net.Listen("tcp", cfg.BindAddr); err != nil {
+		r.fail("listen", "cannot listen on %s: %v", cfg.BindAddr, err)
+	} else {
+		listener.Close()
+		r.ok("listen", "%s is free", cfg.BindAddr)
+	}
+
+	if cfg.Transport == config.WSS {
+		pair, err := tls.LoadX509KeyPair(cfg.TLSCertFile, cfg.TLSKeyFile)
+		if err != nil {
+			r.fail("tls", "failed to load %s and %s: %v", cfg.TLSCertFile, cfg.TLSKeyFile, err)
+			return
+		}
+		leaf, err := x509.ParseCertificate(pair.Certificate[0])
+		if err != nil {
+			r.fail("tls", "failed to parse %s: %v", cfg.TLSCertFile, err)
+			return
+		}
+		r.expiry(leaf)
+	}
+}
+
+// controlStatus asks the running instance for its state, nil if there is
+// none to ask.
+func (r *Report) controlStatus(socket string) *control.Status {
+	if socket == "" {
+		r.skip("control", "control_socket is not set")
+		return nil
+	}
+
+	var status control.Status
+	if err := control.Get(socket, "/status", &status); err != nil {
+		r.warn("control", "no running instance on %s: %v", socket, err)
+		return nil
+	}
+	r.ok("control", "running for %s, tunnel %q, %d session(s), %d connection(s)",
+		time.Since(status.Started).Round(time.Second), status.Tunnel, status.Sessions, status.Connections)
+	return &status
+}
+
+// reach opens a few TCP connections to measure the connect time.
+func (r *Report) reach(addr string, count int) bool {
+	var times []time.Duration
+	for i := 0; i < count; i++ {
+		start := time.Now()
+		conn, err := net.DialTimeout("tcp", addr, dialTimeout)
+		if err != nil {
+			r.fail("reach", "cannot connect to %s: %v", addr, err)
+			return false
+		}
+		times = append(times, time.Since(start))
+		conn.Close()
+	}
+	r.ok("reach", "connected to %s, connect time %s", addr, stats(times))
+	return true
+}
+
+// certificate verifies the certificate chain of a wss server.
+func (r *Report) certificate(addr, host string) {
+	dialer := &net.Dialer{Timeout: dialTimeout}
+	conn, err := tls.DialWithDialer(dialer, "tcp", addr, &tls.Config{ServerName: host})
+	if err == nil {
+		state := conn.ConnectionState()
+		conn.Close()
+		r.ok("tls", "certificate chain verified, issued by %s", state.PeerCertificates[0].Issuer.CommonName)
+		r.expiry(state.PeerCertificates[0])
+		return
+	}
+
+	var verr *tls.CertificateVerificationError
+	if !errors.As(err, &verr) {
+		r.fail("tls", "TLS handshake with %s failed: %v", addr, err)
+		return
+	}
+	// the client does not verify the server, so this only matters to the user
+	r.warn("tls", "certificate is not trusted (%v), the client accepts it anyway", verr.Err)
+	if len(verr.UnverifiedCertificates) > 0 {
+		r.expiry(verr.UnverifiedCertificates[0])
+	}
+}
+
+func (r *Report) expiry(cert *x509.Certificate) {
+	left := time.Until(cert.NotAfter)
+	switch {
+	case left <= 0:
+		r.fail("tls", "certificate for %s expired on %s", cert.Subject.CommonName, cert.NotAfter.Format(time.DateOnly))
+	case left < 14*24*time.Hour:
+		r.warn("tls", "certificate for %s expires on %s", cert.Subject.CommonName, cert.NotAfter.Format(time.DateOnly))
+	default:
+		r.ok("tls", "certificate for %s valid until %s", cert.Subject.CommonName, cert.NotAfter.Format(time.DateOnly))
+	}
+}
+
+// echo authenticates against the server's echo stream, then measures the
+// round trip time and throughput through it.
+func (r *Report) echo(cfg *config.ClientConfig) {
+	scheme := "ws"
+	if cfg.Transport == config.WSS {
+		scheme = "wss"
+	}
+	dialer := websocket.Dialer{
+		HandshakeTimeout: dialTimeout,
+		TLSClientConfig:  &tls.Config{InsecureSkipVerify: true}, // like the client
+	}
+	headers := http.Header{}
+	token, _ := utils.HandshakeToken(cfg.Token, cfg.PlainToken)
+	headers.Add("Authorization", fmt.Sprintf("Bearer %v", token))
+
+	conn, resp, err := dialer.Dial(fmt.Sprintf("%s://%s%s", scheme, cfg.RemoteAddr, utils.DoctorPath), headers)
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUnauthorized {
+			r.fail("handshake", "token rejected by the server")
+		} else {
+			r.fail("handshake", "websocket handshake failed: %v", err)
+		}
+		return
+	}
+	defer conn.Close()
+	r.ok("handshake", "token accepted")
+
+	// round trip time
+	var times []time.Duration
+	for i := 0; i < echoPings; i++ {
+		ping := fmt.Sprintf("ping %d", i)
+		start := time.Now()
+		conn.SetReadDeadline(start.Add(dialTimeout))
+		if err := conn.WriteMessage(websocket.TextMessage, []byte(ping)); err != nil {
+			r.fail("echo", "failed to send: %v", err)
+			return
+		}
+		_, msg, err := conn.ReadMessage()
+		if err != nil || string(msg) != ping {
+			r.fail("echo", "no echo from the server, it may run an older version without the doctor endpoint")
+			return
+		}
+		times = append(times, time.Since(start))
+	}
+	r.ok("rtt", "%s over %d echoes", stats(times), echoPings)
+
+	// throughput, sending and receiving at the same time
+	conn.SetReadDeadline(time.Now().Add(utils.DoctorTimeout))
+	done := make(chan error, 1)
+	go func() {
+		var received int
+		for received < echoBytes {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				done <- err
+				return
+			}
+			received += len(msg)
+		}
+		done <- nil
+	}()
+
+	chunk := make([]byte, echoChunkSize)
+	start := time.Now()
+	for sent := 0; sent < echoBytes; sent += len(chunk) {
+		if err := conn.WriteMessage(websocket.BinaryMessage, chunk); err != nil {
+			r.fail("throughput", "failed to send: %v", err)
+			return
+		}
+	}
+	if err := <-done; err != nil {
+		r.fail("throughput", "echo stream broke: %v", err)
+		return
+	}
+	elapsed := time.Since(start)
+	r.ok("throughput", "%.1f Mbit/s each way (%d MB echoed in %s)",
+		float64(echoBytes)*8/elapsed.Seconds()/1e6, echoBytes>>20, elapsed.Round(time.Millisecond))
+}
+
+func stats(times []time.Duration) string {
+	lo, hi, sum := times[0], times[0], time.Duration(0)
+	for _, t := range times {
+		lo, hi = min(lo, t), max(hi, t)
+		sum += t
+	}
+	avg := sum / time.Duration(len(times))
+	return fmt.Sprintf("min/avg/max %s/%s/%s", round(lo), round(avg), round(hi))
+}
+
+func round(d time.Duration) time.Duration {
+	return d.Round(10 * time.Microsecond)
+}
@@ -0,0 +1,84 @@
+// Package exitnode lets the client reach the internet from the address of
+// the server, the other way round from the ports it forwards: connections
+// made to the SOCKS5 and HTTP proxy listeners of the client are dialed by the
+// server. As the server opens the tunnel connections, it keeps a few handed
+// to its transport as if public connections came for Port, which the client
+// holds until a proxy connection takes one. It then sends the destination,
+// the server dials it and answers how that went, and the two are relayed.
+package exitnode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// Port is the target port of the connections for the exit node, next to
+// dnsfwd.Port and the pings of ws on port 10. Like the others up to
+// utils.MaxReservedPort, no public port can target it.
+const Port = 11
+
+// idleConns is how many tunnel connections wait for a proxy connection, a
+// burst of more waits for the server to open new ones.
+const idleConns = 8
+
+// dialTimeout is how long the server tries to reach a destination.
+const dialTimeout = 10 * time.Second
+
+// replies of the server to a destination, the reply codes of SOCKS5
+const (
+	replySucceeded   = 0
+	replyFailure     = 1
+	replyNotAllowed  = 2
+	replyUnreachable = 4
+	replyRefused     = 5
+	replyCommand     = 7
+	replyAddressType = 8
+)
+
+// writeDestination sends the host:port to dial, with its length in front.
+func writeDestination(w io.Writer, dest string) error {
+	buf := make([]byte, 2+len(dest))
+	binary.BigEndian.PutUint16(buf, uint16(len(dest)))
+	copy(buf[2:], dest)
+	_, err := w.Write(buf)
+	return err
+}
+
+func readDestination(r *bufio.Reader) (string, error) {
+	var size [2]byte
+	if _, err := io.ReadFull(r, size[:]); err != nil {
+		return "", err
+	}
+	dest := make([]byte, binary.BigEndian.Uint16(size[:]))
+	if _, err := io.ReadFull(r, dest); err != nil {
+		return "", err
+	}
+	return string(dest), nil
+}
+
+// closeWriter is a connection that can be half-closed.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+// relay copies between a and b until b ends, and until a ends too if b can
+// be half-closed. Both are closed then.
+func relay(a, b io.ReadWriteCloser) {
+	done := make(chan struct{})
+	go func() {
+		io.Copy(b, a)
+		if w, ok := b.(closeWriter); ok && w.CloseWrite() == nil {
+			close(done)
+			return
+		}
+		b.Close()
+		a.Close()
+		close(done)
+	}()
+	io.Copy(a, b)
+	a.Close()
+	b.Close()
+	<-done
+}
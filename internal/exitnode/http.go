@@ -0,0 +1,102 @@
+package exitnode
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HTTP statuses of the SOCKS5 replies of the server
+var replyStatus = map[byte]int{
+	replyFailure:     http.StatusBadGateway,
+	replyNotAllowed:  http.StatusForbidden,
+	replyUnreachable: http.StatusGatewayTimeout,
+	replyRefused:     http.StatusBadGateway,
+}
+
+// handleHTTP serves a connection of the HTTP proxy listener: CONNECT, for
+// HTTPS and anything else, and plain http:// requests, each sent with
+// "Connection: close" as the next one on conn may be for another host.
+// With a user, the Proxy-Authorization of Basic authentication must match.
+func (p *Proxy) handleHTTP(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+	req, err := http.ReadRequest(reader)
+	if err != nil {
+		p.logger.Debugf("failed to read HTTP proxy request from %s: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+
+	if p.user != "" {
+		user, pass, ok := proxyAuth(req)
+		if !ok || !p.authorized(user, pass) {
+			p.logger.Debugf("HTTP proxy request from %s has a wrong username or password", conn.RemoteAddr().String())
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\nProxy-Authenticate: Basic realm=\"backhaul\"\r\nContent-Length: 0\r\nConnection: close\r\n\r\n"))
+			conn.Close()
+			return
+		}
+	}
+
+	dest := req.Host
+	if req.Method != http.MethodConnect {
+		if req.URL.Scheme != "http" || req.URL.Host == "" {
+			writeStatus(conn, http.StatusBadRequest)
+			conn.Close()
+			return
+		}
+		dest = req.URL.Host
+	}
+	if _, _, err := net.SplitHostPort(dest); err != nil {
+		port := "80"
+		if req.Method == http.MethodConnect {
+			port = "443"
+		}
+		dest = net.JoinHostPort(strings.Trim(dest, "[]"), port)
+	}
+
+	tunnel, reply := p.open(dest)
+	if reply != replySucceeded {
+		p.logger.Debugf("HTTP proxy connection from %s to %s failed with reply %d", conn.RemoteAddr().String(), dest, reply)
+		writeStatus(conn, replyStatus[reply])
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+
+	if req.Method == http.MethodConnect {
+		if _, err := conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n")); err != nil {
+			conn.Close()
+			tunnel.Close()
+			return
+		}
+	} else {
+		req.Header.Del("Proxy-Authorization")
+		req.Header.Del("Proxy-Connection")
+		req.Close = true
+		if err := req.Write(tunnel); err != nil {
+			conn.Close()
+			tunnel.Close()
+			return
+		}
+	}
+	relay(&bufferedConn{Conn: conn, reader: reader}, tunnel)
+}
+
+// proxyAuth returns the username and password of the Basic
+// Proxy-Authorization of req.
+func proxyAuth(req *http.Request) (string, string, bool) {
+	// http.Request.BasicAuth reads Authorization, the same format
+	fake := http.Request{Header: http.Header{"Authorization": req.Header.Values("Proxy-Authorization")}}
+	return fake.BasicAuth()
+}
+
+func writeStatus(conn net.Conn, status int) {
+	if status == 0 {
+		status = http.StatusBadGateway
+	}
+	fmt.Fprintf(conn, "HTTP/1.1 %d %s\r\nContent-Length: 0\r\nConnection: close\r\n\r\n", status, http.StatusText(status))
+}
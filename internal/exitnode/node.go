@@ -0,0 +1,145 @@
+package exitnode
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"syscall"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+var errNotAllowed = errors.New("not in exit_allowed")
+
+// Node is the server end, it dials the destinations of the client. With
+// allowed, only destinations in it are dialed. Without, any but loopback,
+// private and link-local addresses, so the client can't reach the services of
+// the server that only listen there, its networks or the metadata service of
+// its cloud.
+type Node struct {
+	allowed *utils.TargetACL // nil for any destination
+	logger  *logrus.Logger
+	usage   *web.Usage    // nil, the metrics are kept per process
+	conns   chan net.Conn // taken by the server transport
+}
+
+func NewNode(allowed *utils.TargetACL, logger *logrus.Logger) *Node {
+	return &Node{allowed: allowed, logger: logger, conns: make(chan net.Conn)}
+}
+
+// Conns returns the channel the server transport takes the connections for
+// the exit node from, like the queue of a public port.
+func (n *Node) Conns() chan net.Conn {
+	return n.conns
+}
+
+// Run keeps idleConns connections handed to the server transport, handing
+// another one whenever one got a destination or ended, until ctx is done.
+func (n *Node) Run(ctx context.Context) {
+	n.logger.Info("exit node is on, clients with socks_bind or http_proxy_bind reach the internet from this server")
+	utils.ServePipes(ctx, n.conns, idleConns, Port, nil, func(conn net.Conn, release func()) {
+		n.serve(ctx, conn, release)
+	})
+}
+
+// serve dials the destination that comes over conn and relays conn to it,
+// calling release once its slot can be taken by a new connection.
+func (n *Node) serve(ctx context.Context, conn net.Conn, release func()) {
+	reader := bufio.NewReader(conn)
+	dest, err := readDestination(reader)
+	if err != nil {
+		if ctx.Err() == nil {
+			n.logger.Debugf("tunnel connection for the exit node ended: %v", err)
+		}
+		return
+	}
+	release()
+
+	target, err := n.dial(dest)
+	reply := replyCode(err)
+	if _, werr := conn.Write([]byte{reply}); werr != nil || err != nil {
+		if err != nil {
+			n.logger.Debugf("exit node failed to reach %s: %v", dest, err)
+			n.usage.IncCounter("backhaul_exit_connections_total", "result", "failed")
+		}
+		conn.Close()
+		if target != nil {
+			target.Close()
+		}
+		return
+	}
+	n.logger.Debugf("exit node relaying to %s", dest)
+	n.usage.IncCounter("backhaul_exit_connections_total", "result", "ok")
+	// what the client sent after the destination may be buffered already
+	relay(&bufferedConn{Conn: conn, reader: reader}, target)
+}
+
+func (n *Node) dial(dest string) (net.Conn, error) {
+	destHost, _, err := net.SplitHostPort(dest)
+	if err != nil {
+		return nil, err
+	}
+	dialer := net.Dialer{
+		Timeout: dialTimeout,
+		// checks the address dest resolved to, so a name can't lead elsewhere
+		Control: func(network, address string, c syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			ip := net.ParseIP(host)
+			if ip == nil {
+				return errNotAllowed
+			}
+			if n.allowed != nil {
+				if !n.allowed.Allows(destHost, ip) {
+					return errNotAllowed
+				}
+			} else if internal(ip) {
+				return errNotAllowed
+			}
+			return nil
+		},
+	}
+	return dialer.Dial("tcp", dest)
+}
+
+// internal reports whether ip is only reachable from the server or its
+// networks, which the exit node doesn't dial unless exit_allowed lists it.
+func internal(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsUnspecified() || ip.IsPrivate() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast()
+}
+
+// replyCode returns the SOCKS5 reply to the client for a dial that ended
+// with err.
+func replyCode(err error) byte {
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case err == nil:
+		return replySucceeded
+	case errors.Is(err, errNotAllowed):
+		return replyNotAllowed
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return replyRefused
+	case errors.As(err, &dnsErr), errors.As(err, &netErr) && netErr.Timeout(),
+		errors.Is(err, syscall.EHOSTUNREACH), errors.Is(err, syscall.ENETUNREACH):
+		return replyUnreachable
+	default:
+		return replyFailure
+	}
+}
+
+// bufferedConn reads what its reader buffered first.
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.reader.Read(p)
+}
@@ -0,0 +1,141 @@
+package exitnode
+
+import (
+	"context"
+	"crypto/subtle"
+	"errors"
+	"io"
+	"net"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// handshakeTimeout is how long a proxy connection may take to ask for its
+// destination, and then to get a tunnel connection and the reply of the
+// server.
+const handshakeTimeout = 10 * time.Second
+
+// Proxy is the client end, the SOCKS5 and HTTP proxy listeners whose
+// connections are dialed by the server. With a user, the connections must
+// give it and its password. With allowed, only its addresses may connect.
+type Proxy struct {
+	ctx        context.Context
+	user, pass string
+	allowed    *utils.TargetACL // nil for any address
+	logger     *logrus.Logger
+	idle       chan io.ReadWriteCloser // tunnel connections the server opened for Port
+}
+
+// NewProxy returns a proxy whose listeners are closed with ctx.
+func NewProxy(ctx context.Context, user, pass string, allowed *utils.TargetACL, logger *logrus.Logger) *Proxy {
+	return &Proxy{
+		ctx:     ctx,
+		user:    user,
+		pass:    pass,
+		allowed: allowed,
+		logger:  logger,
+		idle:    make(chan io.ReadWriteCloser, idleConns),
+	}
+}
+
+// ListenSocks starts a SOCKS5 listener on addr.
+func (p *Proxy) ListenSocks(addr string) error {
+	return p.listen(addr, "SOCKS5", p.handleSocks)
+}
+
+// ListenHTTP starts an HTTP proxy listener on addr.
+func (p *Proxy) ListenHTTP(addr string) error {
+	return p.listen(addr, "HTTP proxy", p.handleHTTP)
+}
+
+func (p *Proxy) listen(addr, kind string, handle func(net.Conn)) error {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	context.AfterFunc(p.ctx, func() { listener.Close() })
+	p.logger.Infof("%s listener on %s goes out through the server", kind, listener.Addr().String())
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				if !errors.Is(err, net.ErrClosed) {
+					p.logger.Errorf("%s listener stopped accepting: %v", kind, err)
+				}
+				return
+			}
+			if !p.admits(conn) {
+				p.logger.Debugf("refused %s connection from %s, it is not in proxy_allowed_ips", kind, conn.RemoteAddr().String())
+				conn.Close()
+				continue
+			}
+			go handle(conn)
+		}
+	}()
+	return nil
+}
+
+// admits reports whether conn comes from an address in proxy_allowed_ips.
+func (p *Proxy) admits(conn net.Conn) bool {
+	if p.allowed == nil {
+		return true
+	}
+	addr, ok := conn.RemoteAddr().(*net.TCPAddr)
+	return ok && p.allowed.Allows("", addr.IP)
+}
+
+// authorized checks a username and password, in constant time.
+func (p *Proxy) authorized(user, pass string) bool {
+	return subtle.ConstantTimeCompare([]byte(user), []byte(p.user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(p.pass)) == 1
+}
+
+// Serve keeps conn, a tunnel connection the server opened for Port, until a
+// proxy connection takes it. Beyond what the server keeps open, the oldest
+// ones are left over from a tunnel before and closed.
+func (p *Proxy) Serve(conn io.ReadWriteCloser) {
+	for {
+		select {
+		case p.idle <- conn:
+			return
+		default:
+		}
+		select {
+		case old := <-p.idle:
+			old.Close()
+		default:
+		}
+	}
+}
+
+// open sends dest over an idle tunnel connection and returns it with the
+// reply of the server, a SOCKS5 reply code. A connection the server closed
+// meanwhile is skipped.
+func (p *Proxy) open(dest string) (io.ReadWriteCloser, byte) {
+	timeout := time.After(handshakeTimeout)
+	for {
+		var tunnel io.ReadWriteCloser
+		select {
+		case tunnel = <-p.idle:
+		case <-timeout:
+			p.logger.Warnf("no tunnel connection for the proxy connection to %s, is exit_node set on the server?", dest)
+			return nil, replyFailure
+		}
+		reply := make([]byte, 1)
+		if err := writeDestination(tunnel, dest); err != nil {
+			tunnel.Close()
+			continue
+		}
+		if _, err := io.ReadFull(tunnel, reply); err != nil {
+			tunnel.Close()
+			continue
+		}
+		if reply[0] != replySucceeded {
+			tunnel.Close()
+		}
+		return tunnel, reply[0]
+	}
+}
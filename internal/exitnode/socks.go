@@ -0,0 +1,138 @@
+package exitnode
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"strconv"
+	"time"
+)
+
+// handleSocks serves a connection of the SOCKS5 listener. It takes CONNECT
+// without authentication, or with the username and password of RFC 1929 if
+// the proxy has a user.
+func (p *Proxy) handleSocks(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(handshakeTimeout))
+	reader := bufio.NewReader(conn)
+	dest, err := p.socksHandshake(reader, conn)
+	if err != nil {
+		p.logger.Debugf("SOCKS5 handshake with %s failed: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return
+	}
+
+	tunnel, reply := p.open(dest)
+	conn.Write([]byte{5, reply, 0, 1, 0, 0, 0, 0, 0, 0}) // without the bound address, which is on the server
+	if reply != replySucceeded {
+		p.logger.Debugf("SOCKS5 connection from %s to %s failed with reply %d", conn.RemoteAddr().String(), dest, reply)
+		conn.Close()
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	relay(&bufferedConn{Conn: conn, reader: reader}, tunnel)
+}
+
+// socksHandshake reads the greeting and the request of a SOCKS5 connection,
+// and returns the destination it asks for.
+func (p *Proxy) socksHandshake(reader *bufio.Reader, conn net.Conn) (string, error) {
+	var head [2]byte
+	if _, err := io.ReadFull(reader, head[:]); err != nil {
+		return "", err
+	}
+	if head[0] != 5 {
+		return "", fmt.Errorf("not SOCKS5 but version %d", head[0])
+	}
+	methods := make([]byte, head[1])
+	if _, err := io.ReadFull(reader, methods); err != nil {
+		return "", err
+	}
+	method := byte(0) // no authentication
+	if p.user != "" {
+		method = 2 // username and password
+	}
+	if !slices.Contains(methods, method) {
+		conn.Write([]byte{5, 0xff})
+		return "", errors.New("no acceptable authentication method")
+	}
+	if _, err := conn.Write([]byte{5, method}); err != nil {
+		return "", err
+	}
+	if method == 2 {
+		if err := p.socksAuthenticate(reader, conn); err != nil {
+			return "", err
+		}
+	}
+
+	var req [4]byte
+	if _, err := io.ReadFull(reader, req[:]); err != nil {
+		return "", err
+	}
+	var host string
+	switch req[3] {
+	case 1, 4: // IPv4, IPv6
+		ip := make(net.IP, 4)
+		if req[3] == 4 {
+			ip = make(net.IP, 16)
+		}
+		if _, err := io.ReadFull(reader, ip); err != nil {
+			return "", err
+		}
+		host = ip.String()
+	case 3: // a domain name, resolved by the server
+		size, err := reader.ReadByte()
+		if err != nil {
+			return "", err
+		}
+		name := make([]byte, size)
+		if _, err := io.ReadFull(reader, name); err != nil {
+			return "", err
+		}
+		host = string(name)
+	default:
+		conn.Write([]byte{5, replyAddressType, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("unknown address type %d", req[3])
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(reader, port[:]); err != nil {
+		return "", err
+	}
+	if req[1] != 1 {
+		conn.Write([]byte{5, replyCommand, 0, 1, 0, 0, 0, 0, 0, 0})
+		return "", fmt.Errorf("command %d is not supported, only CONNECT", req[1])
+	}
+	return net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:])))), nil
+}
+
+// socksAuthenticate checks the username and password, RFC 1929.
+func (p *Proxy) socksAuthenticate(reader *bufio.Reader, conn net.Conn) error {
+	field := func() ([]byte, error) {
+		size, err := reader.ReadByte()
+		if err != nil {
+			return nil, err
+		}
+		b := make([]byte, size)
+		_, err = io.ReadFull(reader, b)
+		return b, err
+	}
+	if _, err := reader.ReadByte(); err != nil { // version of the subnegotiation
+		return err
+	}
+	user, err := field()
+	if err != nil {
+		return err
+	}
+	pass, err := field()
+	if err != nil {
+		return err
+	}
+	if !p.authorized(string(user), string(pass)) {
+		conn.Write([]byte{1, 1})
+		return errors.New("wrong username or password")
+	}
+	_, err = conn.Write([]byte{1, 0})
+	return err
+}
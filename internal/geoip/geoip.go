@@ -0,0 +1,89 @@
+// Package geoip looks up the country and the autonomous system of addresses
+// in MaxMind DB files, such as GeoLite2-Country or GeoLite2-City for the
+// country and GeoLite2-ASN for the autonomous system, or the DB-IP Lite ones
+// in the same format. The server uses it to break the traffic of its public
+// ports down by where it comes from.
+package geoip
+
+import (
+	"fmt"
+	"net"
+
+	"github.com/oschwald/maxminddb-golang"
+)
+
+// Location is what the databases know of an address, empty where they don't.
+type Location struct {
+	Country string // ISO 3166-1 code, e.g. "DE"
+	Name    string // of the country, in English
+	ASN     uint
+	Org     string // holding the autonomous system
+}
+
+// record holds the fields looked up, each database fills in those it has.
+type record struct {
+	Country struct {
+		ISOCode string            `maxminddb:"iso_code"`
+		Names   map[string]string `maxminddb:"names"`
+	} `maxminddb:"country"`
+	ASN uint   `maxminddb:"autonomous_system_number"`
+	Org string `maxminddb:"autonomous_system_organization"`
+}
+
+// DB is a set of MaxMind DB files looked up together. A nil DB knows no
+// address.
+type DB struct {
+	readers []*maxminddb.Reader
+}
+
+// Open opens the databases at paths, skipping empty paths. It returns nil
+// when all of them are empty.
+func Open(paths ...string) (*DB, error) {
+	db := &DB{}
+	for _, path := range paths {
+		if path == "" {
+			continue
+		}
+		reader, err := maxminddb.Open(path)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("%s: %w", path, err)
+		}
+		db.readers = append(db.readers, reader)
+	}
+	if len(db.readers) == 0 {
+		return nil, nil
+	}
+	return db, nil
+}
+
+// Lookup returns the location of ip, empty if no database has it.
+func (db *DB) Lookup(ip net.IP) Location {
+	var location Location
+	if db == nil || ip == nil {
+		return location
+	}
+	for _, reader := range db.readers {
+		var r record
+		if err := reader.Lookup(ip, &r); err != nil {
+			continue
+		}
+		if r.Country.ISOCode != "" {
+			location.Country, location.Name = r.Country.ISOCode, r.Country.Names["en"]
+		}
+		if r.ASN != 0 {
+			location.ASN, location.Org = r.ASN, r.Org
+		}
+	}
+	return location
+}
+
+// Close closes the databases.
+func (db *DB) Close() {
+	if db == nil {
+		return
+	}
+	for _, reader := range db.readers {
+		reader.Close()
+	}
+}
@@ -0,0 +1,108 @@
+package netem
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+)
+
+// Link relays the connections accepted by a listener to a target address
+// under the same conditions in both directions, like a network path between
+// them. The rate is shared by all connections going the same way.
+type Link struct {
+	listener net.Listener
+	target   string
+	cond     Conditions
+	up, down *shaper
+
+	mu    sync.Mutex
+	conns map[net.Conn]struct{} // both ends of the relayed connections
+}
+
+// NewLink returns a link from listener to target.
+func NewLink(listener net.Listener, target string, cond Conditions) *Link {
+	return &Link{
+		listener: listener,
+		target:   target,
+		cond:     cond,
+		up:       &shaper{rate: cond.Rate},
+		down:     &shaper{rate: cond.Rate},
+		conns:    make(map[net.Conn]struct{}),
+	}
+}
+
+// Run relays the connections until ctx is done.
+func (l *Link) Run(ctx context.Context) {
+	go func() {
+		<-ctx.Done()
+		l.listener.Close()
+		l.Cut()
+	}()
+
+	for {
+		in, err := l.listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			continue
+		}
+		go l.relay(in)
+	}
+}
+
+// Cut closes every connection relayed at the moment, as a path going down
+// would, and returns how many there were.
+func (l *Link) Cut() int {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	cut := len(l.conns) / 2
+	for conn := range l.conns {
+		conn.Close()
+		delete(l.conns, conn)
+	}
+	return cut
+}
+
+func (l *Link) relay(in net.Conn) {
+	out, err := net.Dial("tcp", l.target)
+	if err != nil {
+		in.Close()
+		return
+	}
+	l.track(in, out)
+	defer l.untrack(in, out)
+
+	done := make(chan struct{})
+	go func() {
+		pipe(wrap(out, l.cond, l.up), in)
+		close(done)
+	}()
+	pipe(wrap(in, l.cond, l.down), out)
+	<-done
+}
+
+// pipe copies from src to dst, then closes dst once the data arrived. That
+// ends the copy the other way as well.
+func pipe(dst, src net.Conn) {
+	io.Copy(dst, src)
+	dst.Close()
+}
+
+func (l *Link) track(conns ...net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range conns {
+		l.conns[conn] = struct{}{}
+	}
+}
+
+func (l *Link) untrack(conns ...net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, conn := range conns {
+		delete(l.conns, conn)
+	}
+}
@@ -0,0 +1,167 @@
+// Package netem simulates a network path between a client and a server:
+// latency, loss and a bandwidth limit on the connections relayed over a
+// Link, and cuts of all of them at once. It is used by "backhaul bench" to
+// exercise the tunnel under bad conditions, the reconnects and restarts
+// included, on a single machine.
+package netem
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"time"
+)
+
+// minRetransmit is the least a lost write is held back, the minimum
+// retransmission timeout of Linux.
+const minRetransmit = 200 * time.Millisecond
+
+// queued is how many writes may be in flight on a connection before Write
+// blocks.
+const queued = 256
+
+// Conditions of a simulated path, in one direction.
+type Conditions struct {
+	Latency time.Duration // added to every write
+	Jitter  time.Duration // longest random latency added on top
+	Loss    float64       // share of writes lost once and sent again, 0 to 1
+	Rate    int64         // bytes per second, 0 for no limit
+}
+
+// IsZero reports whether c leaves connections as they are.
+func (c Conditions) IsZero() bool {
+	return c.Latency <= 0 && c.Jitter <= 0 && c.Loss <= 0 && c.Rate <= 0
+}
+
+// retransmit returns how long a lost write is held back: a retransmission
+// timeout of at least twice the round trip.
+func (c Conditions) retransmit() time.Duration {
+	return max(minRetransmit, 4*c.Latency)
+}
+
+// shaper limits the writes of the connections sharing it to a rate.
+type shaper struct {
+	mu   sync.Mutex
+	rate int64
+	sent time.Time // when the last write left
+}
+
+// send returns when a write of n bytes at now has left, after the writes
+// before it.
+func (s *shaper) send(now time.Time, n int) time.Time {
+	if s == nil || s.rate <= 0 {
+		return now
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	start := now
+	if s.sent.After(now) {
+		start = s.sent
+	}
+	s.sent = start.Add(time.Duration(int64(n) * int64(time.Second) / s.rate))
+	return s.sent
+}
+
+type packet struct {
+	data []byte
+	at   time.Time // when it arrives
+}
+
+// conn delivers what is written to it in order, each write once its time on
+// the path has passed.
+type conn struct {
+	net.Conn
+	cond  Conditions
+	shape *shaper
+
+	mu     sync.Mutex
+	queue  chan packet
+	closed bool
+	last   time.Time // when the last write arrives, later ones can't overtake it
+
+	errMu sync.Mutex
+	err   error // of a delivery, returned by the next write
+}
+
+// Wrap returns conn with what is written to it delayed, lost and limited by
+// cond. Writes return at once and fail with the error of an earlier one. conn
+// is returned as is for zero conditions.
+func Wrap(c net.Conn, cond Conditions) net.Conn {
+	return wrap(c, cond, &shaper{rate: cond.Rate})
+}
+
+// wrap is Wrap with the rate shared by the connections of shape.
+func wrap(c net.Conn, cond Conditions, shape *shaper) net.Conn {
+	if cond.IsZero() {
+		return c
+	}
+	w := &conn{Conn: c, cond: cond, shape: shape, queue: make(chan packet, queued)}
+	go w.deliver()
+	return w
+}
+
+func (c *conn) Write(b []byte) (int, error) {
+	if err := c.failed(); err != nil {
+		return 0, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return 0, net.ErrClosed
+	}
+
+	at := c.shape.send(time.Now(), len(b)).Add(c.cond.Latency)
+	if c.cond.Jitter > 0 {
+		at = at.Add(time.Duration(rand.Int63n(int64(c.cond.Jitter))))
+	}
+	if c.cond.Loss > 0 && rand.Float64() < c.cond.Loss {
+		at = at.Add(c.cond.retransmit())
+	}
+	if at.Before(c.last) {
+		at = c.last // head-of-line blocking, as in TCP
+	}
+	c.last = at
+
+	c.queue <- packet{data: append([]byte(nil), b...), at: at}
+	return len(b), nil
+}
+
+func (c *conn) failed() error {
+	c.errMu.Lock()
+	defer c.errMu.Unlock()
+	return c.err
+}
+
+// deliver writes the packets to the connection in order, on time.
+func (c *conn) deliver() {
+	for p := range c.queue {
+		time.Sleep(time.Until(p.at))
+		if _, err := c.Conn.Write(p.data); err != nil {
+			c.errMu.Lock()
+			c.err = err
+			c.errMu.Unlock()
+			c.Conn.Close()
+			for range c.queue {
+				// drop the rest
+			}
+			return
+		}
+	}
+	c.Conn.Close()
+}
+
+// Close closes the connection once what was written has arrived.
+func (c *conn) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if !c.closed {
+		c.closed = true
+		close(c.queue)
+	}
+	return nil
+}
+
+// NetConn returns the underlying connection.
+func (c *conn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,202 @@
+package noise
+
+import (
+	"crypto/ecdh"
+	"crypto/rand"
+	"encoding/binary"
+	"net"
+	"sync"
+)
+
+// Conn is a connection secured by a Noise handshake. Every Write is sent as
+// one or more encrypted messages.
+type Conn struct {
+	net.Conn
+	send, recv *cipherState
+	peer       string // static public key of the other end
+
+	wmu  sync.Mutex
+	wbuf []byte
+
+	rbuf    []byte
+	pending []byte // decrypted, not read yet
+}
+
+func newConn(conn net.Conn, send, recv *cipherState, peer *ecdh.PublicKey) *Conn {
+	return &Conn{
+		Conn: conn,
+		send: send,
+		recv: recv,
+		peer: encodeKey(peer.Bytes()),
+		wbuf: make([]byte, 2+maxMessage),
+		rbuf: make([]byte, maxMessage),
+	}
+}
+
+// PeerKey returns the static public key of the other end, base64 encoded.
+func (c *Conn) PeerKey() string {
+	return c.peer
+}
+
+// NetConn returns the underlying connection.
+func (c *Conn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *Conn) Read(p []byte) (int, error) {
+	if len(c.pending) == 0 {
+		msg, err := readMessage(c.Conn, c.rbuf)
+		if err != nil {
+			return 0, err
+		}
+		if c.pending, err = c.recv.decrypt(msg[:0], nil, msg); err != nil {
+			return 0, err
+		}
+	}
+	n := copy(p, c.pending)
+	c.pending = c.pending[n:]
+	return n, nil
+}
+
+func (c *Conn) Write(p []byte) (int, error) {
+	c.wmu.Lock()
+	defer c.wmu.Unlock()
+
+	written := 0
+	for len(p) > 0 {
+		chunk := p[:min(len(p), maxMessage-tagLen)]
+		msg := c.send.encrypt(c.wbuf[2:2], nil, chunk)
+		binary.BigEndian.PutUint16(c.wbuf, uint16(len(msg)))
+		if _, err := c.Conn.Write(c.wbuf[:2+len(msg)]); err != nil {
+			return written, err
+		}
+		written += len(chunk)
+		p = p[len(chunk):]
+	}
+	return written, nil
+}
+
+// Client runs the handshake as the initiator with the private key of the
+// client and the public key of the server. The caller sets a deadline on conn
+// for it.
+func Client(conn net.Conn, private *ecdh.PrivateKey, server *ecdh.PublicKey) (*Conn, error) {
+	ss := newSymmetricState()
+	ss.mixHash(server.Bytes())
+
+	// -> e, es, s, ss
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	msg := append([]byte(nil), e.PublicKey().Bytes()...)
+	ss.mixHash(e.PublicKey().Bytes())
+	if err := mixDH(ss, e, server); err != nil {
+		return nil, err
+	}
+	msg = ss.encryptAndHash(msg, private.PublicKey().Bytes())
+	if err := mixDH(ss, private, server); err != nil {
+		return nil, err
+	}
+	msg = ss.encryptAndHash(msg, nil)
+	if err := writeMessage(conn, msg); err != nil {
+		return nil, err
+	}
+
+	// <- e, ee, se
+	msg, err = readMessage(conn, make([]byte, maxMessage))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < keyLen+tagLen {
+		return nil, errShort
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(msg[:keyLen])
+	if err := mixDH(ss, e, re); err != nil {
+		return nil, err
+	}
+	if err := mixDH(ss, private, re); err != nil {
+		return nil, err
+	}
+	if _, err := ss.decryptAndHash(msg[keyLen:]); err != nil {
+		return nil, err
+	}
+
+	send, recv := ss.split()
+	return newConn(conn, send, recv, server), nil
+}
+
+// Server runs the handshake as the responder with the private key of the
+// server, taking clients whose public key allowed accepts. The caller sets a
+// deadline on conn for it.
+func Server(conn net.Conn, private *ecdh.PrivateKey, allowed func(key string) bool) (*Conn, error) {
+	ss := newSymmetricState()
+	ss.mixHash(private.PublicKey().Bytes())
+
+	// -> e, es, s, ss
+	msg, err := readMessage(conn, make([]byte, maxMessage))
+	if err != nil {
+		return nil, err
+	}
+	if len(msg) < keyLen+keyLen+tagLen+tagLen {
+		return nil, errShort
+	}
+	re, err := ecdh.X25519().NewPublicKey(msg[:keyLen])
+	if err != nil {
+		return nil, err
+	}
+	ss.mixHash(msg[:keyLen])
+	if err := mixDH(ss, private, re); err != nil {
+		return nil, err
+	}
+	static, err := ss.decryptAndHash(msg[keyLen : 2*keyLen+tagLen])
+	if err != nil {
+		return nil, err
+	}
+	rs, err := ecdh.X25519().NewPublicKey(static)
+	if err != nil {
+		return nil, err
+	}
+	if err := mixDH(ss, private, rs); err != nil {
+		return nil, err
+	}
+	if _, err := ss.decryptAndHash(msg[2*keyLen+tagLen:]); err != nil {
+		return nil, err
+	}
+	if !allowed(encodeKey(rs.Bytes())) {
+		return nil, ErrUnknownPeer
+	}
+
+	// <- e, ee, se
+	e, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	msg = append([]byte(nil), e.PublicKey().Bytes()...)
+	ss.mixHash(e.PublicKey().Bytes())
+	if err := mixDH(ss, e, re); err != nil {
+		return nil, err
+	}
+	if err := mixDH(ss, e, rs); err != nil {
+		return nil, err
+	}
+	msg = ss.encryptAndHash(msg, nil)
+	if err := writeMessage(conn, msg); err != nil {
+		return nil, err
+	}
+
+	recv, send := ss.split()
+	return newConn(conn, send, recv, rs), nil
+}
+
+func mixDH(ss *symmetricState, priv *ecdh.PrivateKey, pub *ecdh.PublicKey) error {
+	shared, err := priv.ECDH(pub)
+	if err != nil {
+		return err
+	}
+	ss.mixKey(shared)
+	return nil
+}
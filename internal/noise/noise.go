@@ -0,0 +1,216 @@
+// Package noise secures tunnel connections with the Noise_IK handshake
+// (https://noiseprotocol.org/noise.html) over X25519, AES-GCM and SHA-256.
+// Both ends have a static key pair, like WireGuard: the client knows the
+// server's public key in advance, the server learns the client's during the
+// handshake and checks it against its allowed peers. The ephemeral keys give
+// forward secrecy.
+package noise
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+const (
+	protocolName = "Noise_IK_25519_AESGCM_SHA256"
+	prologue     = "backhaul"
+
+	keyLen = 32
+	tagLen = 16
+
+	// the largest Noise message, the tag included
+	maxMessage = 65535
+)
+
+var (
+	ErrUnknownPeer = errors.New("noise: unknown peer key")
+	errDecrypt     = errors.New("noise: message failed to decrypt")
+	errShort       = errors.New("noise: handshake message too short")
+)
+
+// GenerateKey returns a new private key and its public key, base64 encoded.
+func GenerateKey() (string, string, error) {
+	priv, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return encodeKey(priv.Bytes()), encodeKey(priv.PublicKey().Bytes()), nil
+}
+
+// PublicKey returns the public key of a base64 encoded private key.
+func PublicKey(private string) (string, error) {
+	priv, err := ParsePrivateKey(private)
+	if err != nil {
+		return "", err
+	}
+	return encodeKey(priv.PublicKey().Bytes()), nil
+}
+
+// ParsePrivateKey decodes a base64 encoded private key.
+func ParsePrivateKey(key string) (*ecdh.PrivateKey, error) {
+	b, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPrivateKey(b)
+}
+
+// ParsePublicKey decodes a base64 encoded public key.
+func ParsePublicKey(key string) (*ecdh.PublicKey, error) {
+	b, err := decodeKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return ecdh.X25519().NewPublicKey(b)
+}
+
+func encodeKey(b []byte) string {
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+func decodeKey(key string) ([]byte, error) {
+	b, err := base64.StdEncoding.DecodeString(key)
+	if err != nil {
+		return nil, fmt.Errorf("invalid key: %v", err)
+	}
+	if len(b) != keyLen {
+		return nil, fmt.Errorf("invalid key: %d bytes instead of %d", len(b), keyLen)
+	}
+	return b, nil
+}
+
+// cipherState encrypts with a key and a counting nonce.
+type cipherState struct {
+	aead  cipher.AEAD
+	nonce uint64
+}
+
+func newCipherState(key []byte) *cipherState {
+	block, _ := aes.NewCipher(key) // 32 bytes, can't fail
+	aead, _ := cipher.NewGCM(block)
+	return &cipherState{aead: aead}
+}
+
+func (c *cipherState) nonceBytes() []byte {
+	// 32 bits of zeros, then the counter big endian
+	nonce := make([]byte, 12)
+	binary.BigEndian.PutUint64(nonce[4:], c.nonce)
+	c.nonce++
+	return nonce
+}
+
+func (c *cipherState) encrypt(dst, ad, plaintext []byte) []byte {
+	return c.aead.Seal(dst, c.nonceBytes(), plaintext, ad)
+}
+
+func (c *cipherState) decrypt(dst, ad, ciphertext []byte) ([]byte, error) {
+	out, err := c.aead.Open(dst, c.nonceBytes(), ciphertext, ad)
+	if err != nil {
+		return nil, errDecrypt
+	}
+	return out, nil
+}
+
+// symmetricState is the chaining key and handshake hash of a handshake.
+type symmetricState struct {
+	ck     []byte
+	h      []byte
+	cipher *cipherState // nil until the first key is mixed in
+}
+
+func newSymmetricState() *symmetricState {
+	h := make([]byte, sha256.Size)
+	copy(h, protocolName) // shorter than the hash, so padded with zeros
+	s := &symmetricState{ck: append([]byte(nil), h...), h: h}
+	s.mixHash([]byte(prologue))
+	return s
+}
+
+func (s *symmetricState) mixHash(data []byte) {
+	sum := sha256.New()
+	sum.Write(s.h)
+	sum.Write(data)
+	s.h = sum.Sum(nil)
+}
+
+func (s *symmetricState) mixKey(ikm []byte) {
+	var key []byte
+	s.ck, key = hkdf(s.ck, ikm)
+	s.cipher = newCipherState(key)
+}
+
+func (s *symmetricState) encryptAndHash(dst, plaintext []byte) []byte {
+	if s.cipher == nil {
+		s.mixHash(plaintext)
+		return append(dst, plaintext...)
+	}
+	out := s.cipher.encrypt(dst, s.h, plaintext)
+	s.mixHash(out[len(dst):])
+	return out
+}
+
+func (s *symmetricState) decryptAndHash(ciphertext []byte) ([]byte, error) {
+	if s.cipher == nil {
+		s.mixHash(ciphertext)
+		return ciphertext, nil
+	}
+	out, err := s.cipher.decrypt(nil, s.h, ciphertext)
+	if err != nil {
+		return nil, err
+	}
+	s.mixHash(ciphertext)
+	return out, nil
+}
+
+// split returns the ciphers of the initiator and the responder.
+func (s *symmetricState) split() (*cipherState, *cipherState) {
+	k1, k2 := hkdf(s.ck, nil)
+	return newCipherState(k1), newCipherState(k2)
+}
+
+// hkdf derives two keys from the chaining key and ikm.
+func hkdf(ck, ikm []byte) ([]byte, []byte) {
+	mac := hmac.New(sha256.New, ck)
+	mac.Write(ikm)
+	temp := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write([]byte{1})
+	out1 := mac.Sum(nil)
+
+	mac = hmac.New(sha256.New, temp)
+	mac.Write(out1)
+	mac.Write([]byte{2})
+	out2 := mac.Sum(nil)
+	return out1, out2
+}
+
+// writeMessage and readMessage frame a message with its length, two bytes
+// big endian.
+func writeMessage(w io.Writer, msg []byte) error {
+	frame := make([]byte, 2, 2+len(msg))
+	binary.BigEndian.PutUint16(frame, uint16(len(msg)))
+	_, err := w.Write(append(frame, msg...))
+	return err
+}
+
+func readMessage(r io.Reader, buf []byte) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := buf[:binary.BigEndian.Uint16(length[:])]
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
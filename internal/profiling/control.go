@@ -0,0 +1,38 @@
+package profiling
+
+import (
+	"net/http"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+)
+
+// RegisterHandlers adds the pprof endpoints to the control API:
+//
+//	GET  /pprof          current state
+//	POST /pprof/enable   start serving pprof
+//	POST /pprof/disable  stop serving pprof
+func RegisterHandlers(ctrl *control.Server, p *Profiler) {
+	status := func(w http.ResponseWriter) {
+		control.WriteJSON(w, map[string]any{"enabled": p.Enabled(), "addr": p.Addr()})
+	}
+
+	ctrl.Handle("GET /pprof", func(w http.ResponseWriter, r *http.Request) {
+		status(w)
+	})
+	ctrl.Handle("POST /pprof/enable", func(w http.ResponseWriter, r *http.Request) {
+		if err := p.Enable(); err != nil {
+			control.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		control.Audit(r, "pprof enabled on %s", p.Addr())
+		status(w)
+	})
+	ctrl.Handle("POST /pprof/disable", func(w http.ResponseWriter, r *http.Request) {
+		if err := p.Disable(); err != nil {
+			control.WriteError(w, http.StatusInternalServerError, err)
+			return
+		}
+		control.Audit(r, "pprof disabled")
+		status(w)
+	})
+}
@@ -0,0 +1,144 @@
+// Package profiling serves pprof on a loopback port that can be switched on
+// and off at runtime, and dumps profiles when resource usage gets too high.
+package profiling
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/pprof"
+	"os"
+	"path/filepath"
+	"runtime"
+	rpprof "runtime/pprof"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	checkInterval = 30 * time.Second // how often the thresholds are checked
+	dumpCooldown  = 10 * time.Minute // minimum time between two dumps of a kind
+)
+
+// Profiler owns the pprof HTTP server.
+type Profiler struct {
+	addr   string
+	logger *logrus.Logger
+
+	mu     sync.Mutex
+	server *http.Server
+}
+
+// NewProfiler returns a profiler serving pprof on 127.0.0.1 at port once enabled.
+func NewProfiler(port int, logger *logrus.Logger) *Profiler {
+	return &Profiler{
+		addr:   fmt.Sprintf("127.0.0.1:%d", port),
+		logger: logger,
+	}
+}
+
+// Addr returns the address pprof is served on.
+func (p *Profiler) Addr() string {
+	return p.addr
+}
+
+// Enabled reports whether pprof is being served.
+func (p *Profiler) Enabled() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	return p.server != nil
+}
+
+// Enable starts serving pprof, it is a no-op if already enabled.
+func (p *Profiler) Enable() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server != nil {
+		return nil
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/debug/pprof/", pprof.Index)
+	mux.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	mux.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	mux.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	mux.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	server := &http.Server{Addr: p.addr, Handler: mux}
+	listener, err := net.Listen("tcp", p.addr)
+	if err != nil {
+		return err
+	}
+	go server.Serve(listener)
+
+	p.server = server
+	p.logger.Infof("pprof started at %s", p.addr)
+	return nil
+}
+
+// Disable stops serving pprof, it is a no-op if already disabled.
+func (p *Profiler) Disable() error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.server == nil {
+		return nil
+	}
+
+	err := p.server.Close()
+	p.server = nil
+	p.logger.Info("pprof stopped")
+	return err
+}
+
+// Run writes a heap profile to dir when the heap exceeds heapLimit MB and a
+// goroutine profile when there are more than goroutineLimit goroutines, until
+// ctx is done. Then it stops pprof. A zero limit disables the check.
+func (p *Profiler) Run(ctx context.Context, dir string, heapLimit, goroutineLimit int) {
+	ticker := time.NewTicker(checkInterval)
+	defer ticker.Stop()
+
+	var lastHeap, lastGoroutine time.Time
+	for {
+		select {
+		case now := <-ticker.C:
+			if heapLimit > 0 && now.Sub(lastHeap) > dumpCooldown {
+				var stats runtime.MemStats
+				runtime.ReadMemStats(&stats)
+				if stats.HeapAlloc > uint64(heapLimit)<<20 {
+					p.dump(dir, "heap", now)
+					lastHeap = now
+				}
+			}
+			if goroutineLimit > 0 && now.Sub(lastGoroutine) > dumpCooldown && runtime.NumGoroutine() > goroutineLimit {
+				p.dump(dir, "goroutine", now)
+				lastGoroutine = now
+			}
+
+		case <-ctx.Done():
+			p.Disable()
+			return
+		}
+	}
+}
+
+func (p *Profiler) dump(dir, profile string, now time.Time) {
+	path := filepath.Join(dir, fmt.Sprintf("%s-%s.pprof", profile, now.Format("20060102-150405")))
+	file, err := os.Create(path)
+	if err != nil {
+		p.logger.Errorf("failed to create %s profile: %v", profile, err)
+		return
+	}
+	defer file.Close()
+
+	if err := rpprof.Lookup(profile).WriteTo(file, 0); err != nil {
+		p.logger.Errorf("failed to write %s profile: %v", profile, err)
+		return
+	}
+	p.logger.Warnf("%s threshold exceeded, profile written to %s", profile, path)
+}
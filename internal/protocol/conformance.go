@@ -0,0 +1,298 @@
+package protocol
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+const (
+	dialTimeout    = 5 * time.Second
+	replyTimeout   = 5 * time.Second
+	forwardTimeout = 10 * time.Second
+
+	// conformanceID is the client ID the checks connect with.
+	conformanceID = "backhaul-conformance"
+)
+
+// Target is a server to check and how.
+type Target struct {
+	Transport  string // tcp, tcpmux, ws or wss
+	Addr       string // bind_addr of the server, host:port
+	Token      string
+	Public     string        // a port the server forwards, host:port, to check a connection through the tunnel
+	MuxVersion int           // smux version of a tcpmux server
+	Sessions   int           // mux_session of a tcpmux server, which forwards ports once all are up
+	Heartbeat  time.Duration // how long to wait for a heartbeat
+}
+
+// Result is the outcome of one check.
+type Result struct {
+	Check  string `json:"check"`
+	Status string `json:"status"` // ok, warn, skip or fail
+	Detail string `json:"detail"`
+}
+
+// Report collects the results of the checks, printing each to w if it isn't
+// nil.
+type Report struct {
+	Results []Result `json:"results"`
+	w       io.Writer
+}
+
+// Failed reports whether any check failed.
+func (r *Report) Failed() bool {
+	for _, result := range r.Results {
+		if result.Status == "fail" {
+			return true
+		}
+	}
+	return false
+}
+
+func (r *Report) line(status, check, format string, args ...any) {
+	result := Result{Check: check, Status: status, Detail: fmt.Sprintf(format, args...)}
+	r.Results = append(r.Results, result)
+	if r.w != nil {
+		fmt.Fprintf(r.w, "[%-4s] %-12s %s\n", result.Status, result.Check, result.Detail)
+	}
+}
+
+func (r *Report) ok(check, format string, args ...any)   { r.line("ok", check, format, args...) }
+func (r *Report) warn(check, format string, args ...any) { r.line("warn", check, format, args...) }
+func (r *Report) skip(check, format string, args ...any) { r.line("skip", check, format, args...) }
+func (r *Report) fail(check, format string, args ...any) { r.line("fail", check, format, args...) }
+
+// Check runs the checks of the protocol against the server of t as a client
+// would, and writes the report to w. It takes the place of the server's
+// client while it runs.
+func Check(t Target, w io.Writer) *Report {
+	r := &Report{w: w}
+	if t.Sessions <= 0 {
+		t.Sessions = 1
+	}
+	switch t.Transport {
+	case "tcp":
+		r.tcp(t)
+	case "tcpmux":
+		r.tcpmux(t)
+	case "ws", "wss":
+		r.ws(t)
+	default:
+		r.fail("config", "unknown transport %q, it must be tcp, tcpmux, ws or wss", t.Transport)
+	}
+	return r
+}
+
+// events are what the server sent while the checks wait for it.
+type events struct {
+	version   chan utils.PeerVersion
+	upgrade   chan string
+	heartbeat chan Result
+	ports     chan []utils.ControlPort
+	headers   chan header
+	ended     chan error
+}
+
+// header is the stream header of a tunnel connection.
+type header struct {
+	port uint16
+	meta *utils.StreamMeta
+}
+
+func newEvents() *events {
+	return &events{
+		version:   make(chan utils.PeerVersion, 1),
+		upgrade:   make(chan string, 1),
+		heartbeat: make(chan Result, 1),
+		ports:     make(chan []utils.ControlPort, 1),
+		headers:   make(chan header, 16),
+		ended:     make(chan error, 1),
+	}
+}
+
+// put hands v to whoever waits on ch, dropping it if nobody does.
+func put[T any](ch chan T, v T) {
+	select {
+	case ch <- v:
+	default:
+	}
+}
+
+// closer closes the connections the checks opened when they are done.
+type closer struct {
+	mu    sync.Mutex
+	conns []io.Closer
+}
+
+func (c *closer) add(conn io.Closer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conns = append(c.conns, conn)
+}
+
+func (c *closer) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for _, conn := range c.conns {
+		conn.Close()
+	}
+}
+
+// channel reads the control channel of a tcp or ws server: it answers the
+// version, the heartbeats and the channel signals as a client does, opening
+// tunnel connections with dial.
+func channel(recv func() (string, error), send func(string) error, dial func() error, ev *events) {
+	for {
+		msg, err := recv()
+		if err != nil {
+			put(ev.ended, err)
+			return
+		}
+		if reason, ok := utils.ParseUpgrade(msg); ok {
+			put(ev.upgrade, reason)
+			continue
+		}
+		if version, ok := utils.ParseVersionMessage(msg); ok {
+			put(ev.version, version)
+			continue
+		}
+		sig, seq := utils.ParseSignal(msg)
+		switch sig {
+		case channelSignal:
+			go func() {
+				err := dial()
+				if seq != 0 {
+					send(utils.AckMessage(seq, err))
+				}
+			}()
+		case heartbeatSignal:
+			if seq == 0 {
+				put(ev.heartbeat, Result{Status: "warn", Detail: "heartbeat received, but not numbered though the client offered stats"})
+				continue
+			}
+			if err := send(utils.ClientStatsMessage(conformanceStats())); err != nil {
+				put(ev.ended, err)
+				return
+			}
+			put(ev.heartbeat, Result{Status: "ok", Detail: fmt.Sprintf("numbered heartbeat %q received, stats sent", msg)})
+		default:
+			put(ev.ended, fmt.Errorf("unexpected message %q on the control channel", msg))
+			return
+		}
+	}
+}
+
+// conformanceStats is what the checks report when asked.
+func conformanceStats() control.ClientStats {
+	return control.ClientStats{Version: utils.Version}
+}
+
+// echo reads the stream header of a tunnel connection and sends everything
+// it reads after back, as a target would.
+func echo(conn net.Conn, ev *events) {
+	defer conn.Close()
+	port, meta, err := utils.ReceiveStreamHeader(conn)
+	if err != nil {
+		return
+	}
+	put(ev.headers, header{port, meta})
+	io.Copy(conn, conn)
+}
+
+// session runs what tcp, ws and tcpmux have in common once the handshake is
+// done: the version, a connection through the tunnel and the heartbeat.
+func (r *Report) session(t Target, ev *events) {
+	select {
+	case version := <-ev.version:
+		r.version(version)
+	case reason := <-ev.upgrade:
+		r.fail("version", "the server refused this client: %s", reason)
+		return
+	case err := <-ev.ended:
+		r.fail("version", "the server closed the control channel: %v", err)
+		return
+	case <-time.After(replyTimeout):
+		r.warn("version", "the server sent no version, it speaks protocol 0")
+	}
+
+	r.forward(t, ev)
+
+	select {
+	case result := <-ev.heartbeat:
+		r.line(result.Status, "heartbeat", "%s", result.Detail)
+	case reason := <-ev.upgrade:
+		r.fail("heartbeat", "the server refused this client: %s", reason)
+	case err := <-ev.ended:
+		r.fail("heartbeat", "the server closed the control channel: %v", err)
+	case <-time.After(t.Heartbeat):
+		r.fail("heartbeat", "no heartbeat within %v, raise -wait to the heartbeat of the server", t.Heartbeat)
+	}
+}
+
+// version checks the version the server sent.
+func (r *Report) version(version utils.PeerVersion) {
+	if err := version.Check("server"); err != nil {
+		r.fail("version", "%v", err)
+		return
+	}
+	r.ok("version", "server runs %s, features %s", version, strings.Join(version.Features, ", "))
+	if missing := version.Missing(); len(missing) > 0 {
+		r.warn("features", "the server lacks %s of this definition", strings.Join(missing, ", "))
+	}
+}
+
+// forward sends a message through the public port of the server and checks
+// it comes back from the tunnel connection it was handed to.
+func (r *Report) forward(t Target, ev *events) {
+	if t.Public == "" {
+		r.skip("forward", "set -public to a port the server forwards to check a connection through the tunnel")
+		return
+	}
+	conn, err := net.DialTimeout("tcp", t.Public, dialTimeout)
+	if err != nil {
+		r.fail("forward", "failed to connect to %s: %v", t.Public, err)
+		return
+	}
+	defer conn.Close()
+
+	nonce := make([]byte, 8)
+	rand.Read(nonce)
+	payload := []byte("backhaul conformance " + hex.EncodeToString(nonce) + "\n")
+	conn.SetDeadline(time.Now().Add(forwardTimeout))
+	if _, err := conn.Write(payload); err != nil {
+		r.fail("forward", "failed to send through %s: %v", t.Public, err)
+		return
+	}
+	got := make([]byte, len(payload))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		r.fail("forward", "nothing came back through %s within %v: %v", t.Public, forwardTimeout, err)
+		return
+	}
+	if !bytes.Equal(got, payload) {
+		r.fail("forward", "%q came back through %s instead of %q", got, t.Public, payload)
+		return
+	}
+
+	var h header
+	select {
+	case h = <-ev.headers:
+	default:
+		r.fail("forward", "the data came back without a stream header")
+		return
+	}
+	if h.meta == nil {
+		r.warn("forward", "%d bytes went through %s to target port %d, without metadata though the client asked for it", len(payload), t.Public, h.port)
+		return
+	}
+	r.ok("forward", "%d bytes went through %s to target port %d, from %s", len(payload), t.Public, h.port, h.meta.Src)
+}
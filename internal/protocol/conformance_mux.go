@@ -0,0 +1,223 @@
+package protocol
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/xtaci/smux"
+)
+
+// tcpmux checks a tcpmux server without TLS or noise, opening its
+// mux_session sessions so it forwards its ports.
+func (r *Report) tcpmux(t Target) {
+	var opened closer
+	defer opened.close()
+
+	session, reply, err := muxSession(t, t.Token+" but wrong")
+	if session == nil {
+		r.fail("reach", "failed to connect to %s: %v", t.Addr, err)
+		return
+	}
+	r.ok("reach", "connected to %s", t.Addr)
+	session.Close()
+	if err == nil {
+		r.fail("auth", "the server answered a wrong token with %q", reply)
+		return
+	}
+	r.ok("auth", "wrong token refused")
+
+	ev := newEvents()
+	for id := 0; id < t.Sessions; id++ {
+		session, reply, err := muxSession(t, t.Token)
+		if session != nil {
+			opened.add(session)
+		}
+		if err != nil {
+			if reply != "" {
+				r.fail("handshake", "the server answered the signed token of session %d with %q instead of the token reply", id, reply)
+			} else {
+				r.fail("handshake", "no answer to the token of session %d, check -token and -mux-version: %v", id, err)
+			}
+			return
+		}
+		if err := sendMuxClientID(session); err != nil {
+			r.fail("handshake", "failed to send the client ID on session %d: %v", id, err)
+			return
+		}
+		if id == 0 {
+			if err := controlStream(session, ev); err != nil {
+				r.fail("handshake", "failed to open the control stream: %v", err)
+				return
+			}
+		}
+		go acceptStreams(session, ev)
+	}
+	r.ok("handshake", "signed token accepted on %d sessions, the server proved it knows the token", t.Sessions)
+
+	r.session(t, ev)
+	select {
+	case ports := <-ev.ports:
+		var targets []string
+		for _, port := range ports {
+			targets = append(targets, fmt.Sprint(port.Target))
+		}
+		r.ok("ports", "the server forwards to the ports %s", strings.Join(targets, ", "))
+	default:
+		r.warn("ports", "the server sent no ports frame")
+	}
+}
+
+// muxSession opens a session and sends token. A session is returned if the
+// server was reached, err is set unless it answered with the token reply.
+func muxSession(t Target, token string) (*smux.Session, string, error) {
+	conn, err := net.DialTimeout("tcp", t.Addr, dialTimeout)
+	if err != nil {
+		return nil, "", err
+	}
+	config := smux.DefaultConfig()
+	if t.MuxVersion > 0 {
+		config.Version = t.MuxVersion
+	}
+	// the client is the smux server
+	session, err := smux.Server(conn, config)
+	if err != nil {
+		conn.Close()
+		return nil, "", err
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return session, "", err
+	}
+	defer stream.Close()
+
+	signed, nonce := utils.SignToken(token)
+	stream.SetDeadline(time.Now().Add(replyTimeout))
+	if err := utils.SendBinaryString(stream, signed); err != nil {
+		return session, "", err
+	}
+	reply, err := utils.ReceiveBinaryString(stream)
+	if err != nil {
+		return session, "", err
+	}
+	if reply != utils.TokenReply(token, nonce) {
+		return session, reply, fmt.Errorf("token refused with %q", reply)
+	}
+	return session, reply, nil
+}
+
+// sendMuxClientID sends the client ID and asks for stream metadata.
+func sendMuxClientID(session *smux.Session) error {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+	if err := utils.SendBinaryInt(stream, utils.MuxClientIDPort); err != nil {
+		return err
+	}
+	if err := utils.SendBinaryString(stream, utils.ClientIDMessage(conformanceID)); err != nil {
+		return err
+	}
+	return utils.SendBinaryString(stream, utils.MetaMessage)
+}
+
+// controlStream opens the control stream of session and answers its frames
+// as a client does.
+func controlStream(session *smux.Session, ev *events) error {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	if err := utils.SendBinaryInt(stream, utils.MuxControlStreamPort); err != nil {
+		stream.Close()
+		return err
+	}
+	ctrl := utils.NewControlStream(session, stream)
+	if err := ctrl.Write(utils.ControlVersion, []byte(utils.LocalVersion().Encode())); err != nil {
+		ctrl.Close()
+		return err
+	}
+
+	go func() {
+		defer ctrl.Close()
+		var heartbeat time.Duration
+		for {
+			typ, payload, err := ctrl.Read()
+			if err != nil {
+				put(ev.ended, err)
+				return
+			}
+			switch typ {
+			case utils.ControlHello:
+				if heartbeat, err = utils.HelloHeartbeat(payload); err != nil {
+					put(ev.ended, err)
+					return
+				}
+			case utils.ControlVersion:
+				version, err := utils.ParseVersion(string(payload))
+				if err != nil {
+					put(ev.ended, fmt.Errorf("invalid version frame: %w", err))
+					return
+				}
+				put(ev.version, version)
+			case utils.ControlUpgrade:
+				put(ev.upgrade, string(payload))
+			case utils.ControlPorts:
+				var ports []utils.ControlPort
+				if err := json.Unmarshal(payload, &ports); err != nil {
+					put(ev.ended, fmt.Errorf("invalid ports frame: %w", err))
+					return
+				}
+				put(ev.ports, ports)
+			case utils.ControlPing:
+				if err := ctrl.Write(utils.ControlPong, payload); err != nil {
+					put(ev.ended, err)
+					return
+				}
+				if err := ctrl.WriteJSON(utils.ControlStats, conformanceStats()); err != nil {
+					put(ev.ended, err)
+					return
+				}
+				if heartbeat == 0 {
+					put(ev.heartbeat, Result{Status: "warn", Detail: "ping answered with a pong and stats, but no hello came before it"})
+					continue
+				}
+				put(ev.heartbeat, Result{Status: "ok", Detail: fmt.Sprintf("ping answered with a pong and stats, hello says every %v", heartbeat)})
+			}
+		}
+	}()
+	return nil
+}
+
+// acceptStreams answers the streams the server opens on session: it echoes
+// the ones relaying public connections and lets the others go.
+func acceptStreams(session *smux.Session, ev *events) {
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer stream.Close()
+			port, meta, err := utils.ReceiveStreamHeader(stream)
+			if err != nil {
+				return
+			}
+			switch port {
+			case utils.MuxRetirePort:
+				stream.Write([]byte{1})
+				return
+			case utils.SpeedtestPort, utils.MuxScalePort, utils.MuxHalfClosePort, utils.MuxResetPort, utils.MuxGoAwayPort:
+				return
+			}
+			put(ev.headers, header{port, meta})
+			io.Copy(stream, stream)
+		}()
+	}
+}
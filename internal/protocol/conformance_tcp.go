@@ -0,0 +1,92 @@
+package protocol
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// tcp checks a tcp server. A wrong token goes first, while the server still
+// waits for a control channel.
+func (r *Report) tcp(t Target) {
+	var opened closer
+	defer opened.close()
+
+	conn, err := net.DialTimeout("tcp", t.Addr, dialTimeout)
+	if err != nil {
+		r.fail("reach", "failed to connect to %s: %v", t.Addr, err)
+		return
+	}
+	r.ok("reach", "connected to %s", t.Addr)
+	wrong, _ := utils.SignToken(t.Token + " but wrong")
+	conn.SetDeadline(time.Now().Add(replyTimeout))
+	if err := utils.SendBinaryString(conn, wrong); err != nil {
+		r.fail("auth", "failed to send a wrong token: %v", err)
+		conn.Close()
+		return
+	}
+	if msg, err := utils.ReceiveBinaryString(conn); err == nil {
+		r.fail("auth", "the server answered a wrong token with %q", msg)
+	} else {
+		r.ok("auth", "wrong token refused")
+	}
+	conn.Close()
+
+	conn, err = net.DialTimeout("tcp", t.Addr, dialTimeout)
+	if err != nil {
+		r.fail("handshake", "failed to connect to %s: %v", t.Addr, err)
+		return
+	}
+	opened.add(conn)
+	token, nonce := utils.SignToken(t.Token)
+	conn.SetDeadline(time.Now().Add(replyTimeout))
+	if err := utils.SendBinaryString(conn, token); err != nil {
+		r.fail("handshake", "failed to send the token: %v", err)
+		return
+	}
+	msg, err := utils.ReceiveBinaryString(conn)
+	switch {
+	case err != nil:
+		r.fail("handshake", "no answer to the token, check -token: %v", err)
+		return
+	case msg != utils.TokenReply(t.Token, nonce):
+		r.fail("handshake", "the server answered the signed token with %q instead of the token reply", msg)
+		return
+	}
+	conn.SetDeadline(time.Time{})
+	r.ok("handshake", "signed token accepted, the server proved it knows the token")
+
+	var mu sync.Mutex
+	send := func(msg string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return utils.SendBinaryString(conn, msg)
+	}
+	for _, msg := range []string{
+		utils.ClientIDMessage(conformanceID),
+		utils.VersionMessage(utils.LocalVersion()),
+		utils.AcksMessage,
+		utils.MetaMessage,
+		utils.StatsMessage,
+	} {
+		if err := send(msg); err != nil {
+			r.fail("handshake", "failed to send %q: %v", msg, err)
+			return
+		}
+	}
+
+	ev := newEvents()
+	dial := func() error {
+		tunnel, err := net.DialTimeout("tcp", t.Addr, dialTimeout)
+		if err != nil {
+			return err
+		}
+		opened.add(tunnel)
+		go echo(tunnel, ev)
+		return nil
+	}
+	go channel(func() (string, error) { return utils.ReceiveBinaryString(conn) }, send, dial, ev)
+	r.session(t, ev)
+}
@@ -0,0 +1,134 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// ws checks a ws or wss server.
+func (r *Report) ws(t Target) {
+	var opened closer
+	defer opened.close()
+
+	dialer := websocket.Dialer{HandshakeTimeout: replyTimeout, TLSClientConfig: utils.PinnedTLSConfig("")}
+	dial := func(path, token string, extra http.Header) (*websocket.Conn, *http.Response, error) {
+		headers := http.Header{}
+		headers.Set("Authorization", "Bearer "+token)
+		headers.Set(utils.ClientIDHeader, conformanceID)
+		for name, values := range extra {
+			headers[name] = values
+		}
+		return dialer.Dial(fmt.Sprintf("%s://%s%s", t.Transport, t.Addr, path), headers)
+	}
+
+	wrong, _ := utils.SignToken(t.Token + " but wrong")
+	conn, resp, err := dial("/channel", wrong, nil)
+	switch {
+	case err == nil:
+		conn.Close()
+		r.fail("auth", "the server took a wrong token")
+		return
+	case resp == nil:
+		r.fail("reach", "failed to connect to %s: %v", t.Addr, err)
+		return
+	case resp.StatusCode == http.StatusTooManyRequests:
+		r.ok("reach", "connected to %s", t.Addr)
+		r.fail("auth", "the server answered a wrong token with %s, this address is banned", resp.Status)
+		return
+	}
+	r.ok("reach", "connected to %s", t.Addr)
+	if resp.StatusCode != http.StatusUnauthorized {
+		r.ok("auth", "wrong token answered with %s instead of 401, by a fallback", resp.Status)
+	} else {
+		r.ok("auth", "wrong token refused with %s", resp.Status)
+	}
+
+	token, _ := utils.SignToken(t.Token)
+	conn, resp, err = dial("/channel", token, http.Header{
+		utils.AcksHeader:    {"1"},
+		utils.MetaHeader:    {"1"},
+		utils.StatsHeader:   {"1"},
+		utils.VersionHeader: {utils.LocalVersion().Encode()},
+	})
+	if err != nil {
+		if resp != nil && resp.StatusCode == http.StatusUpgradeRequired {
+			reason, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+			r.fail("handshake", "the server refused this client: %s", strings.TrimSpace(string(reason)))
+			return
+		}
+		r.fail("handshake", "failed to open the control channel, check -token: %v", err)
+		return
+	}
+	opened.add(conn)
+	r.ok("handshake", "signed token accepted, control channel open")
+
+	ev := newEvents()
+	if value := resp.Header.Get(utils.VersionHeader); value != "" {
+		version, err := utils.ParseVersion(value)
+		if err != nil {
+			r.fail("version", "invalid %s header %q: %v", utils.VersionHeader, value, err)
+			return
+		}
+		put(ev.version, version)
+	}
+
+	var mu sync.Mutex
+	send := func(msg string) error {
+		mu.Lock()
+		defer mu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, []byte(msg))
+	}
+	recv := func() (string, error) {
+		_, msg, err := conn.ReadMessage()
+		return string(msg), err
+	}
+	tunnel := func() error {
+		token, _ := utils.SignToken(t.Token)
+		tunnel, _, err := dial("/", token, nil)
+		if err != nil {
+			return err
+		}
+		opened.add(tunnel)
+		go echoWS(tunnel, ev)
+		return nil
+	}
+	go channel(recv, send, tunnel, ev)
+	r.session(t, ev)
+}
+
+// echoWS reads the stream header of a ws tunnel connection, skipping pings,
+// and sends every message after back.
+func echoWS(conn *websocket.Conn, ev *events) {
+	defer conn.Close()
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		port, meta, err := utils.DecodeStreamHeader(msg)
+		if err != nil {
+			return
+		}
+		if port == WSPingPort {
+			continue
+		}
+		put(ev.headers, header{port, meta})
+		break
+	}
+	for {
+		typ, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(typ, msg); err != nil {
+			return
+		}
+	}
+}
@@ -0,0 +1,66 @@
+package protocol
+
+import (
+	"fmt"
+	"io"
+	"strings"
+)
+
+// WriteMarkdown writes d as a Markdown document.
+func WriteMarkdown(w io.Writer, d Definition) error {
+	var b strings.Builder
+	fmt.Fprintf(&b, "# Backhaul wire protocol\n\n")
+	fmt.Fprintf(&b, "Protocol %d of Backhaul %s, working with peers of protocol %d or newer. Generated by `backhaul protocol`.\n\n", d.Protocol, d.Version, d.MinProtocol)
+	fmt.Fprintf(&b, "Peers without a version speak protocol 0 and announce no features. Each end ignores messages, frames and headers it doesn't know.\n\n")
+
+	fmt.Fprintf(&b, "## Features\n\n| Name | Description |\n|---|---|\n")
+	for _, f := range d.Features {
+		fmt.Fprintf(&b, "| `%s` | %s |\n", f.Name, cell(f.Description))
+	}
+
+	fmt.Fprintf(&b, "\n## Encodings\n\n| Name | Layout |\n|---|---|\n")
+	for _, e := range d.Encodings {
+		fmt.Fprintf(&b, "| %s | %s |\n", e.Name, cell(e.Layout))
+	}
+
+	fmt.Fprintf(&b, "\n## Transports\n")
+	for _, t := range d.Transports {
+		fmt.Fprintf(&b, "\n### %s\n\n", t.Name)
+		for i, step := range t.Steps {
+			fmt.Fprintf(&b, "%d. %s\n", i+1, step)
+		}
+	}
+
+	fmt.Fprintf(&b, "\n## Control channel messages\n\n| Name | From | Format | Feature | Description |\n|---|---|---|---|---|\n")
+	for _, m := range d.Messages {
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s | %s |\n", m.Name, m.From, cell(m.Format), m.Feature, cell(m.Description))
+	}
+	fmt.Fprintf(&b, "\nExamples:\n\n```\n")
+	for _, m := range d.Messages {
+		fmt.Fprintf(&b, "%s\n", m.Example)
+	}
+	fmt.Fprintf(&b, "```\n")
+
+	fmt.Fprintf(&b, "\n## WebSocket headers\n\n| Name | From | Value | Description |\n|---|---|---|---|\n")
+	for _, h := range d.Headers {
+		fmt.Fprintf(&b, "| `%s` | %s | %s | %s |\n", h.Name, h.From, cell(h.Value), cell(h.Description))
+	}
+
+	fmt.Fprintf(&b, "\n## Reserved ports\n\nStream headers with these ports don't carry a public connection. A server refuses to forward a public port to one.\n\n| Port | Name | From | Description |\n|---|---|---|---|\n")
+	for _, p := range d.Ports {
+		fmt.Fprintf(&b, "| %d | `%s` | %s | %s |\n", p.Port, p.Name, p.From, cell(p.Description))
+	}
+
+	fmt.Fprintf(&b, "\n## Control stream frames\n\n| Type | Name | From | Payload | Description |\n|---|---|---|---|---|\n")
+	for _, f := range d.Frames {
+		fmt.Fprintf(&b, "| %d | `%s` | %s | %s | %s |\n", f.Type, f.Name, f.From, cell(f.Payload), cell(f.Description))
+	}
+
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// cell escapes s for a table cell.
+func cell(s string) string {
+	return strings.ReplaceAll(s, "|", `\|`)
+}
@@ -0,0 +1,238 @@
+// Package protocol describes the wire protocol between clients and servers in
+// a form programs can read, for "backhaul protocol", and checks a server
+// against it, for "backhaul conformance". The definition is built from the
+// constants and encoders the transports use, so it follows them as they
+// change, and is meant for implementations of Backhaul in other languages.
+package protocol
+
+import (
+	"errors"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/tun"
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// the ends of a tunnel, who sends a message
+const (
+	Client = "client"
+	Server = "server"
+	Either = "either"
+)
+
+// WSPingPort is sent by ws servers on idle tunnel connections to keep them
+// alive. Clients skip it and wait for the next stream header.
+const WSPingPort = 10
+
+// the signals of the control channel of tcp and ws, before their number
+const (
+	channelSignal   = "1"
+	heartbeatSignal = "0"
+)
+
+// Definition is the wire protocol of this build.
+type Definition struct {
+	Version     string      `json:"version"` // of backhaul
+	Protocol    int         `json:"protocol"`
+	MinProtocol int         `json:"min_protocol"` // of the peers it works with
+	Features    []Feature   `json:"features"`
+	Encodings   []Encoding  `json:"encodings"`
+	Transports  []Transport `json:"transports"`
+	Messages    []Message   `json:"messages"` // of the control channel of tcp and ws
+	Headers     []Header    `json:"headers"`  // of the WebSocket handshakes
+	Ports       []Port      `json:"ports"`    // reserved stream header ports
+	Frames      []Frame     `json:"frames"`   // of the control stream of tcpmux
+}
+
+// Feature is one a peer may announce in its version.
+type Feature struct {
+	Name        string `json:"name"`
+	Description string `json:"description"`
+}
+
+// Encoding is how a kind of value is put on the wire.
+type Encoding struct {
+	Name   string `json:"name"`
+	Layout string `json:"layout"`
+}
+
+// Transport lists the steps of a tunnel over one transport, in order.
+type Transport struct {
+	Name  string   `json:"name"`
+	Steps []string `json:"steps"`
+}
+
+// Message is one of the control channel of tcp, sent as a string, and of ws,
+// sent as a text message.
+type Message struct {
+	Name        string `json:"name"`
+	From        string `json:"from"`
+	Format      string `json:"format"`
+	Example     string `json:"example"`
+	Feature     string `json:"feature,omitempty"` // announced with the message, if any
+	Description string `json:"description"`
+}
+
+// Header is one of the WebSocket handshakes.
+type Header struct {
+	Name        string `json:"name"`
+	From        string `json:"from"`
+	Value       string `json:"value"`
+	Description string `json:"description"`
+}
+
+// Port is a value of a stream header that stands for something else than a
+// target port.
+type Port struct {
+	Port        int    `json:"port"`
+	Name        string `json:"name"`
+	From        string `json:"from"`
+	Description string `json:"description"`
+}
+
+// Frame is one of the control stream of tcpmux.
+type Frame struct {
+	Type        int    `json:"type"`
+	Name        string `json:"name"`
+	From        string `json:"from"`
+	Payload     string `json:"payload"`
+	Description string `json:"description"`
+}
+
+// what the features of utils.Features are for
+var features = map[string]string{
+	"client-id":      "The client sends an ID that stays the same across its reconnects.",
+	"acks":           "Channel signals are numbered and the client acknowledges each, so the server knows a tunnel connection failed.",
+	"meta":           "Stream headers carry the address of the public connection.",
+	"stats":          "The client reports its stats when the heartbeat asks for them.",
+	"commands":       "The server sends commands to a client with remote_management.",
+	"control-stream": "tcpmux sessions carry heartbeats, versions and commands on a stream of their own.",
+}
+
+// Define returns the wire protocol of this build.
+func Define() Definition {
+	version := utils.LocalVersion()
+	d := Definition{
+		Version:     version.Version,
+		Protocol:    version.Protocol,
+		MinProtocol: version.MinProtocol,
+	}
+	for _, name := range version.Features {
+		d.Features = append(d.Features, Feature{Name: name, Description: features[name]})
+	}
+
+	d.Encodings = []Encoding{
+		{"port", "2-byte big-endian unsigned integer"},
+		{"string", "2-byte big-endian length, then that many bytes of UTF-8"},
+		{"stream header", "the target port, or port 7 (stream-meta) followed by the target port and the metadata as a string, URL query encoded with src, dst, ts in Unix milliseconds, and name and to if set"},
+		{"frame", "1-byte type, 2-byte big-endian payload length, then the payload"},
+		{"signed token", "\"v1 <unix time> <nonce> <mac>\", mac the hex HMAC-SHA256 of \"<unix time> <nonce>\" keyed by the token; each nonce is taken once within auth_skew of the server's clock"},
+		{"token reply", "\"ok <mac>\", mac the hex HMAC-SHA256 of \"ok <nonce>\" keyed by the token"},
+	}
+
+	d.Transports = []Transport{
+		{"tcp", []string{
+			"The client connects and sends the signed token as a string.",
+			"The server answers with the token reply, or closes the connection after a delay for a wrong token. This connection is the control channel.",
+			"The client sends its client-id and version messages, then acks, meta, stats and with remote_management commands. The server answers the version with its own, or with upgrade-required and closes the channel.",
+			"The server sends a heartbeat every heartbeat seconds, numbered if the client offered stats, which it then answers with its stats.",
+			"For each channel signal the client opens a new connection to the server, without a token, and acknowledges the signal if it was numbered. The server keeps the connection in its pool.",
+			"When a public connection arrives, the server sends the stream header on a pooled connection, then both relay raw bytes.",
+		}},
+		{"tcpmux", []string{
+			"The client connects, optionally over TLS or noise, and starts smux version mux_version as the smux server; the server is the smux client.",
+			"The client opens a stream and sends the signed token as a string. The server answers with the token reply, or with \"error\" after a delay and closes the session.",
+			"The client opens a stream, sends port 4 (client-id), its client-id message and the meta message as strings, and closes it.",
+			"The client opens a stream, sends port 12 (control-stream) and keeps it open for frames, its version frame first. The server sends hello, version and ports, then pings every heartbeat.",
+			"For each public connection the server opens a stream and sends the stream header, then both relay raw bytes. Streams with the ports 1 to 6 control the session or other streams.",
+			"The client opens mux_session sessions this way, the server forwards its ports once all are up.",
+		}},
+		{"ws", []string{
+			"The client opens a WebSocket on /channel with the headers below. The server answers 101 with its version, 401 for a wrong token after a delay, unless a fallback answers it, or 426 with the reason as the body. This WebSocket is the control channel.",
+			"Control channel messages are sent as text messages, the same as the strings of tcp.",
+			"For each channel signal the client opens a WebSocket on / with the Authorization and client ID headers, and acknowledges the signal if it was numbered.",
+			"When a public connection arrives, the server sends the stream header as one binary message, then both relay binary messages. Port 10 (ws-ping) arrives on idle tunnel connections and is skipped.",
+			"wss is ws over TLS.",
+		}},
+	}
+
+	d.Messages = []Message{
+		{"token", Client, "signed token, or the token itself", "v1 1760620800 9f2c... 51ab...", "",
+			"First message of tcp, the Authorization header of ws. Plain tokens are refused with reject_plain_token."},
+		{"token-reply", Server, "token reply, the token itself for a plain token", "ok 7d1e...", "",
+			"Proves the server knows the token; the client checks it before going on."},
+		{"client-id", Client, "\"client-id <id>\"", utils.ClientIDMessage("edge-1"), "client-id",
+			"Sent right after the token reply, the ID is client_id or a random UUID kept across reconnects."},
+		{"version", Either, "\"version <json>\"", utils.VersionMessage(version), "",
+			"The client sends its version after its ID, the server answers with its own."},
+		{"upgrade-required", Server, "\"upgrade-required <reason>\"", utils.UpgradeMessage(errExampleUpgrade), "",
+			"The server refuses a client whose protocol it doesn't work with, and closes the channel."},
+		{"acks", Client, "\"acks\"", utils.AcksMessage, "acks", "Asks for numbered channel signals."},
+		{"meta", Client, "\"meta\"", utils.MetaMessage, "meta", "Asks for the metadata in stream headers."},
+		{"stats", Client, "\"stats\"", utils.StatsMessage, "stats", "Offers stats reports."},
+		{"commands", Client, "\"commands\"", utils.CommandsMessage, "commands", "Takes commands, sent with remote_management only."},
+		{"channel-signal", Server, "\"1\", or \"1 <seq>\" to a client that sent acks", utils.SignalMessage(channelSignal, 7), "acks",
+			"Asks for one more tunnel connection."},
+		{"heartbeat", Server, "\"0\", or \"0 1\" to a client that sent stats", utils.HeartbeatMessage(heartbeatSignal, true), "stats",
+			"Sent every heartbeat seconds, a numbered one asks for the stats."},
+		{"ack", Client, "\"ack <seq>\"", utils.AckMessage(7, nil), "acks", "The tunnel connection of signal seq was opened."},
+		{"nack", Client, "\"nack <seq> <error>\"", utils.AckMessage(8, errExampleDial), "acks", "The tunnel connection of signal seq failed."},
+		{"stats-report", Client, "\"stats <json>\"", utils.ClientStatsMessage(exampleStats), "stats",
+			"Answers a numbered heartbeat; updated is set by the server."},
+		{"command", Server, "\"command <json>\"", utils.CommandMessage(exampleCommand), "commands",
+			"Actions: " + control.CommandReload + ", " + control.CommandForwarder + ", " + control.CommandLogLevel + ", " + control.CommandRestart + "."},
+		{"result", Client, "\"result <json>\"", utils.ResultMessage(control.ClientResult{ID: exampleCommand.ID}), "commands",
+			"Answers the command with the same id, error set if it failed."},
+	}
+
+	d.Headers = []Header{
+		{"Authorization", Client, "Bearer <signed token>", "On every WebSocket of the client."},
+		{utils.ClientIDHeader, Client, "<id>", "On every WebSocket of the client."},
+		{utils.VersionHeader, Either, "<version json>", "Sent by the client on /channel and by the server in its 101 answer."},
+		{utils.AcksHeader, Client, "1", "On /channel, asks for numbered channel signals."},
+		{utils.MetaHeader, Client, "1", "On /channel, asks for the metadata in stream headers."},
+		{utils.StatsHeader, Client, "1", "On /channel, offers stats reports."},
+		{utils.CommandsHeader, Client, "1", "On /channel, takes commands."},
+	}
+
+	d.Ports = []Port{
+		{utils.SpeedtestPort, "speedtest", Server, "Measures the tunnel for \"backhaul speedtest\"; the client echoes what it reads."},
+		{utils.MuxScalePort, "mux-scale", Server, "tcpmux: asks for one more session, followed by its slot as a port."},
+		{utils.MuxHalfClosePort, "mux-half-close", Either, "tcpmux: half-closes another stream, followed by its id as 4 bytes and the bytes written to it as 8, big-endian."},
+		{utils.MuxResetPort, "mux-reset", Either, "tcpmux: resets another stream, followed like mux-half-close."},
+		{utils.MuxClientIDPort, "client-id", Client, "tcpmux: the client ID and meta messages follow as strings."},
+		{utils.MuxGoAwayPort, "go-away", Server, "tcpmux: the session ends, followed by the seconds its streams get to finish as a port."},
+		{utils.MuxRetirePort, "retire", Server, "tcpmux: the idle session is closed, the client answers with a byte and doesn't reconnect it."},
+		{utils.StreamMetaPort, "stream-meta", Server, "Followed by the target port and the metadata of the public connection."},
+		{tun.Port, "tun", Server, "Carries the packets of tun mode."},
+		{dnsfwd.Port, "dns", Server, "Carries DNS queries for dns forwarding."},
+		{WSPingPort, "ws-ping", Server, "ws: keeps an idle tunnel connection alive."},
+		{exitnode.Port, "exit-node", Server, "Carries the connections of the exit node."},
+		{utils.MuxControlStreamPort, "control-stream", Client, "tcpmux: opens the control stream, frames follow."},
+	}
+
+	d.Frames = []Frame{
+		{utils.ControlHello, "hello", Server, "heartbeat seconds as a port", "Sent first, the client takes the session for gone after 3 heartbeats without a frame."},
+		{utils.ControlPing, "ping", Either, "8 bytes", "Answered by a pong with the same payload; the server's carry the time it sent them."},
+		{utils.ControlPong, "pong", Either, "the payload of the ping", ""},
+		{utils.ControlStats, "stats", Client, "stats report JSON", "Sent after each pong."},
+		{utils.ControlPorts, "ports", Server, "JSON array of {\"target\", \"name\"}", "The ports the server forwards to the client."},
+		{utils.ControlManaged, "managed", Client, "empty", "Takes commands, sent with remote_management only."},
+		{utils.ControlCommand, "command", Server, "command JSON", ""},
+		{utils.ControlResult, "result", Client, "result JSON", ""},
+		{utils.ControlVersion, "version", Either, "version JSON", "Sent first by the client, right after the hello by the server."},
+		{utils.ControlUpgrade, "upgrade-required", Server, "the reason as text", "Sent before the server closes the session of a client it refuses."},
+	}
+	return d
+}
+
+// values of the examples
+var (
+	errExampleUpgrade = errors.New("upgrade required: the client runs v0.1.0 (protocol 0), this server needs protocol 1 or newer, upgrade the client")
+	errExampleDial    = errors.New("dial tcp 127.0.0.1:8080: connect: connection refused")
+
+	exampleStats   = control.ClientStats{Relays: 12, Backends: 2, Dials: 40, CPU: 3.5, Memory: 41.2, Version: "v0.2.1"}
+	exampleCommand = control.ClientCommand{ID: 1, Action: control.CommandLogLevel, Level: "debug"}
+)
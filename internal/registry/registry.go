@@ -0,0 +1,320 @@
+// Package registry keeps the clients known to a server: each client ID it has
+// seen, when and from where, the version of backhaul it runs, and the port
+// ranges and quotas an operator assigned to it. The registry is saved to a
+// JSON file, so it outlives restarts of the server, and managed over the
+// control API. Servers of a cluster merge their registries.
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+)
+
+// how often the last seen times are saved, changes of the operator are saved
+// right away
+const saveInterval = time.Minute
+
+// how long a deleted client is kept, for the cluster peers to delete it too
+const deletedKeep = 30 * 24 * time.Hour
+
+// ErrPortsTaken is returned by Set for port ranges overlapping the ones of
+// another client.
+var ErrPortsTaken = errors.New("ports are assigned to another client")
+
+// Registry is the set of known clients, by ID.
+type Registry struct {
+	path   string
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	clients map[string]*control.KnownClient
+	dirty   bool // seen since the last save
+}
+
+// Open loads the registry saved at path, an empty one if the file doesn't
+// exist yet.
+func Open(path string, logger *logrus.Logger) (*Registry, error) {
+	r := &Registry{path: path, logger: logger, clients: make(map[string]*control.KnownClient)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		// find out now whether it can be written
+		return r, r.save()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var clients []control.KnownClient
+	if err := json.Unmarshal(data, &clients); err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	for i := range clients {
+		r.clients[clients[i].ID] = &clients[i]
+	}
+	r.record()
+	return r, nil
+}
+
+// Run saves the last seen times every minute until ctx is done, and once
+// more then.
+func (r *Registry) Run(ctx context.Context) {
+	ticker := time.NewTicker(saveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			r.flush()
+			return
+		case <-ticker.C:
+			r.flush()
+		}
+	}
+}
+
+// Seen records a tunnel connection of the client with id from addr, adding
+// the client if it is new.
+func (r *Registry) Seen(id, addr string) {
+	if r == nil || id == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := r.client(id)
+	client.Addr = addr
+	r.dirty = true
+}
+
+// Reported records a report of the client with id, which carries its
+// version since this one.
+func (r *Registry) Reported(id, version string) {
+	if r == nil || id == "" {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client := r.client(id)
+	if version != "" {
+		client.Version = version
+	}
+	r.dirty = true
+}
+
+// client returns the client with id, seen now. A deleted client is added
+// again.
+func (r *Registry) client(id string) *control.KnownClient {
+	now := time.Now()
+	client, ok := r.clients[id]
+	if !ok || client.Deleted {
+		client = &control.KnownClient{ID: id}
+		if ok {
+			client.Changed = now // over the deletion on the peers
+		}
+		r.clients[id] = client
+		r.logger.Infof("client %s added to the registry", id)
+		defer r.record()
+	}
+	if client.FirstSeen.IsZero() {
+		client.FirstSeen = now
+	}
+	client.LastSeen = now
+	return client
+}
+
+// List returns the known clients, sorted by ID.
+func (r *Registry) List() []control.KnownClient {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]control.KnownClient, 0, len(r.clients))
+	for _, client := range r.clients {
+		if !client.Deleted {
+			clients = append(clients, *client)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	return clients
+}
+
+// Get returns the client with id.
+func (r *Registry) Get(id string) (control.KnownClient, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	client, ok := r.clients[id]
+	if !ok || client.Deleted {
+		return control.KnownClient{}, false
+	}
+	return *client, true
+}
+
+// Set changes the name, ports and quota of the client with id to the ones
+// of update, adding the client if it is new, and saves the registry.
+func (r *Registry) Set(id string, update control.KnownClient) (control.KnownClient, error) {
+	ports, err := utils.ParsePortMappings(update.Ports)
+	if err != nil {
+		return control.KnownClient{}, err
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	wanted := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		wanted[port.LocalPort] = true
+	}
+	for _, other := range r.clients {
+		if other.ID == id || other.Deleted {
+			continue
+		}
+		taken, _ := utils.ParsePortMappings(other.Ports)
+		for _, port := range taken {
+			if wanted[port.LocalPort] {
+				return control.KnownClient{}, fmt.Errorf("%w: port %d to %s", ErrPortsTaken, port.LocalPort, other.ID)
+			}
+		}
+	}
+
+	client, ok := r.clients[id]
+	if !ok || client.Deleted {
+		client = &control.KnownClient{ID: id}
+		r.clients[id] = client
+		defer r.record()
+	}
+	client.Name, client.Ports, client.Quota = update.Name, update.Ports, update.Quota
+	client.Changed = time.Now()
+	return *client, r.save()
+}
+
+// Delete forgets the client with id and saves the registry. The client is
+// added again when it connects.
+func (r *Registry) Delete(id string) (bool, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if client, ok := r.clients[id]; !ok || client.Deleted {
+		return false, nil
+	}
+	r.clients[id] = &control.KnownClient{ID: id, Changed: time.Now(), Deleted: true}
+	r.record()
+	return true, r.save()
+}
+
+// Shared returns the clients for the cluster peers, the deleted ones
+// included, nil without a registry.
+func (r *Registry) Shared() []control.KnownClient {
+	if r == nil {
+		return nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clients := make([]control.KnownClient, 0, len(r.clients))
+	for _, client := range r.clients {
+		clients = append(clients, *client)
+	}
+	return clients
+}
+
+// Merge takes the clients a cluster peer shared: the names, ports, quotas and
+// deletions changed last by an operator on either server, and the last time
+// and place either server saw each client. The registry is saved right away
+// when an operator change came in.
+func (r *Registry) Merge(clients []control.KnownClient) {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	changed := false
+	for _, peer := range clients {
+		if peer.ID == "" {
+			continue
+		}
+		client, ok := r.clients[peer.ID]
+		if !ok {
+			client = &control.KnownClient{ID: peer.ID}
+			r.clients[peer.ID] = client
+		}
+		if !ok || peer.Changed.After(client.Changed) {
+			client.Name, client.Ports, client.Quota = peer.Name, peer.Ports, peer.Quota
+			client.Changed, client.Deleted = peer.Changed, peer.Deleted
+			changed = true
+		}
+		if !peer.FirstSeen.IsZero() && (client.FirstSeen.IsZero() || peer.FirstSeen.Before(client.FirstSeen)) {
+			client.FirstSeen = peer.FirstSeen
+			r.dirty = true
+		}
+		if peer.LastSeen.After(client.LastSeen) {
+			client.LastSeen, client.Addr = peer.LastSeen, peer.Addr
+			if peer.Version != "" {
+				client.Version = peer.Version
+			}
+			r.dirty = true
+		}
+	}
+	if !changed {
+		return
+	}
+	r.record()
+	if err := r.save(); err != nil {
+		r.logger.Warnf("failed to save the registry: %v", err)
+	}
+}
+
+// flush saves the registry if a client was seen since the last save.
+func (r *Registry) flush() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if !r.dirty {
+		return
+	}
+	if err := r.save(); err != nil {
+		r.logger.Warnf("failed to save the registry: %v", err)
+	}
+}
+
+// save writes the registry to its file, with r.mu held.
+func (r *Registry) save() error {
+	clients := make([]*control.KnownClient, 0, len(r.clients))
+	for id, client := range r.clients {
+		if client.Deleted && time.Since(client.Changed) > deletedKeep {
+			delete(r.clients, id)
+			continue
+		}
+		clients = append(clients, client)
+	}
+	sort.Slice(clients, func(i, j int) bool { return clients[i].ID < clients[j].ID })
+	data, err := json.MarshalIndent(clients, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	// replace the file in one step, a crash never leaves half of it behind
+	tmp := r.path + ".tmp"
+	if err := os.WriteFile(tmp, append(data, '\n'), 0o600); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, r.path); err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+// record shows the number of known clients on the dashboard.
+func (r *Registry) record() {
+	known := 0
+	for _, client := range r.clients {
+		if !client.Deleted {
+			known++
+		}
+	}
+	web.RecordRegistry(fmt.Sprintf("%d known clients", known))
+}
@@ -0,0 +1,139 @@
+package server
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"runtime"
+	"strconv"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/cluster"
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/registry"
+	"github.com/sahmadiut/backhaul/internal/server/transport"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+)
+
+// startCluster shares the state of this server with the cluster_peers, and
+// its registry if it keeps known clients, nil when clustering is off.
+func (s *Server) startCluster(tunnel transport.Tunnel, known *registry.Registry) *cluster.Cluster {
+	if len(s.config.ClusterPeers) == 0 {
+		return nil
+	}
+	if s.config.ClusterListen == "" {
+		s.logger.Fatalf("cluster_peers needs cluster_listen, the address the peers push their state to")
+	}
+	name := s.config.ClusterName
+	if name == "" {
+		name = s.config.BindAddr
+	}
+
+	peers := cluster.New(name, s.config.ClusterListen, s.config.ClusterPeers, s.config.Token,
+		time.Duration(s.config.ClusterInterval)*time.Second, func() control.ClusterNode { return s.clusterState(tunnel, known) }, s.logger)
+	if known != nil {
+		peers.HandleRegistry(known.Merge)
+	}
+	if tunnel != nil {
+		peers.HandleForwards(tunnel.Forwarded)
+		if s.config.ClusterForward {
+			s.forwardPorts(peers, tunnel)
+		}
+	}
+	go peers.Run(s.ctx)
+	return peers
+}
+
+// forwardPorts accepts on the public ports from the start, next to the
+// transport, so connections reaching this server while it has no tunnel go
+// to a peer that has one.
+func (s *Server) forwardPorts(peers *cluster.Cluster, tunnel transport.Tunnel) {
+	if runtime.GOOS == "windows" {
+		s.logger.Fatalf("cluster_forward is not supported on Windows")
+	}
+	mappings, _ := utils.ParsePorts(s.config.Ports, s.config.Forward)
+	for _, mapping := range mappings {
+		listener, err := utils.Listen(mapping.Addr(s.config.PortsAddr))
+		if err != nil {
+			s.logger.Fatalf("failed to start listener on port %d: %v", mapping.LocalPort, err)
+		}
+		go s.forwardPort(listener, mapping.LocalPort, peers, tunnel)
+	}
+}
+
+func (s *Server) forwardPort(listener net.Listener, port int, peers *cluster.Cluster, tunnel transport.Tunnel) {
+	go func() {
+		<-s.ctx.Done()
+		listener.Close()
+	}()
+
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			s.logger.Debugf("failed to accept connection on port %d: %v", port, err)
+			continue
+		}
+
+		// the transport accepts on the same socket, take its part while the
+		// tunnel is up
+		if len(tunnel.Sessions()) > 0 && tunnel.Forwarded(port, conn) == nil {
+			continue
+		}
+		go func() {
+			if err := peers.Forward(conn, port); err != nil {
+				s.logger.Debugf("closing connection from %s on port %d: %v", conn.RemoteAddr().String(), port, err)
+				conn.Close()
+			}
+		}()
+	}
+}
+
+// clusterState returns what this server shares with its peers: whether it
+// holds the tunnel, its clients, its port counters and its registry.
+func (s *Server) clusterState(tunnel transport.Tunnel, known *registry.Registry) control.ClusterNode {
+	node := control.ClusterNode{
+		Clients: make(map[string]int),
+		Ports:   make(map[int]control.Port),
+		Known:   known.Shared(),
+	}
+	if tunnel != nil {
+		sessions := tunnel.Sessions()
+		node.Active = len(sessions) > 0
+		for _, session := range sessions {
+			if session.Client != "" {
+				node.Clients[session.Client], _ = transport.ClientStats(session.Client)
+			}
+		}
+	}
+
+	mappings, _ := utils.ParsePorts(s.config.Ports, s.config.Forward) // checked at start
+	stats := web.PortStats()
+	for _, mapping := range mappings {
+		stat := stats[mapping.LocalPort]
+		node.Ports[mapping.LocalPort] = control.Port{
+			Port:   mapping.LocalPort,
+			Name:   mapping.Name,
+			Target: strconv.Itoa(mapping.RemotePort),
+			Active: stat.Active,
+			Total:  stat.Total,
+			Bytes:  stat.Bytes,
+		}
+	}
+	return node
+}
+
+// registerClusterHandlers adds GET /cluster to the control API, listing the
+// servers of the cluster, this one first.
+func (s *Server) registerClusterHandlers(ctrl *control.Server, peers *cluster.Cluster) {
+	ctrl.Handle("GET /cluster", func(w http.ResponseWriter, r *http.Request) {
+		if peers == nil {
+			control.WriteJSON(w, []control.ClusterNode{})
+			return
+		}
+		control.WriteJSON(w, peers.Nodes())
+	})
+}
@@ -0,0 +1,216 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/server/transport"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+)
+
+// registerHandlers adds the status endpoints to the control API:
+//
+//	GET /status    role, tunnel state and connection count
+//	GET /sessions  tunnel connections
+//	GET /ports     forwarded ports with their counters
+//	POST /speedtest?size=MB  measure the tunnel, 16 MB each way by default
+//	GET /attack    state of the attack mode
+//	PUT /attack?mode=on      switch the attack mode to on, off or auto
+//
+// Clients with remote_management take commands over the control channel:
+//
+//	PUT /clients/{client}/forwarder/{port}?target=ADDR[,ADDR]  point port to new targets
+//	DELETE /clients/{client}/forwarder/{port}                   dial 127.0.0.1:port again
+//	PUT /clients/{client}/log-level?level=debug                 switch the log level
+//	POST /clients/{client}/reload                               read the config file again
+//	POST /clients/{client}/restart                              reconnect the tunnel
+//
+// The forwarder changes take drain and persist like the ones of the control
+// API of the client.
+func (s *Server) registerHandlers(ctrl *control.Server, tunnel transport.Tunnel, attack *transport.AttackGuard) {
+	ctrl.Handle("GET /status", func(w http.ResponseWriter, r *http.Request) {
+		status := control.Status{
+			Role:        "server",
+			Transport:   string(s.config.Transport),
+			Addr:        s.config.BindAddr,
+			Started:     s.started,
+			Connections: utils.ActiveRelays(),
+		}
+		if tunnel != nil {
+			status.Tunnel = tunnel.TunnelStatus()
+			status.Sessions = len(tunnel.Sessions())
+		}
+		control.WriteJSON(w, status)
+	})
+
+	ctrl.Handle("GET /sessions", func(w http.ResponseWriter, r *http.Request) {
+		sessions := []control.Session{}
+		if tunnel != nil {
+			sessions = append(sessions, tunnel.Sessions()...)
+		}
+		for i := range sessions {
+			if sessions[i].Client != "" {
+				sessions[i].Connects, sessions[i].Flapping = transport.ClientStats(sessions[i].Client)
+			}
+		}
+		control.WriteJSON(w, sessions)
+	})
+
+	ctrl.Handle("GET /ports", func(w http.ResponseWriter, r *http.Request) {
+		mappings, err := utils.ParsePorts(s.config.Ports, s.config.Forward)
+		if err != nil {
+			control.WriteError(w, http.StatusInternalServerError, errors.New("invalid ports in the configuration"))
+			return
+		}
+
+		stats := web.PortStats()
+		ports := make([]control.Port, 0, len(mappings))
+		for _, mapping := range mappings {
+			stat := stats[mapping.LocalPort]
+			ports = append(ports, control.Port{
+				Port:   mapping.LocalPort,
+				Name:   mapping.Name,
+				Target: strconv.Itoa(mapping.RemotePort),
+				Active: stat.Active,
+				Total:  stat.Total,
+				Bytes:  stat.Bytes,
+			})
+		}
+		control.WriteJSON(w, ports)
+	})
+
+	var speedtest sync.Mutex
+	ctrl.Handle("POST /speedtest", func(w http.ResponseWriter, r *http.Request) {
+		size := int64(defaultSpeedtestSize)
+		if value := r.URL.Query().Get("size"); value != "" {
+			mb, err := strconv.Atoi(value)
+			if err != nil || mb < 1 || mb > maxSpeedtestSize {
+				control.WriteError(w, http.StatusBadRequest, fmt.Errorf("size must be between 1 and %d MB", maxSpeedtestSize))
+				return
+			}
+			size = int64(mb)
+		}
+
+		if tunnel == nil {
+			control.WriteError(w, http.StatusServiceUnavailable, errors.New("no tunnel"))
+			return
+		}
+		if !speedtest.TryLock() {
+			control.WriteError(w, http.StatusConflict, errors.New("a speedtest is already running"))
+			return
+		}
+		defer speedtest.Unlock()
+
+		s.logger.Infof("running a %d MB speedtest through the tunnel", size)
+		result, err := tunnel.Speedtest(size << 20)
+		if err != nil {
+			control.WriteError(w, http.StatusBadGateway, err)
+			return
+		}
+		s.logger.Infof("speedtest finished: %s", result)
+		control.Audit(r, "%d MB speedtest: %s", size, result)
+		web.RecordSpeedtest(result.String() + " at " + result.Finished.Format(time.TimeOnly))
+		control.WriteJSON(w, result)
+	})
+
+	command := func(w http.ResponseWriter, r *http.Request, command control.ClientCommand) {
+		if tunnel == nil {
+			control.WriteError(w, http.StatusServiceUnavailable, errors.New("no tunnel"))
+			return
+		}
+		client := r.PathValue("client")
+		result, err := tunnel.Command(client, command)
+		switch {
+		case errors.Is(err, transport.ErrClientNotConnected):
+			control.WriteError(w, http.StatusNotFound, fmt.Errorf("client %s is not connected", client))
+			return
+		case errors.Is(err, transport.ErrNotManaged):
+			control.WriteError(w, http.StatusConflict, err)
+			return
+		case errors.Is(err, transport.ErrCommandTimeout):
+			control.WriteError(w, http.StatusGatewayTimeout, err)
+			return
+		case err != nil:
+			control.WriteError(w, http.StatusBadGateway, err)
+			return
+		case result.Error != "":
+			control.WriteError(w, http.StatusBadRequest, fmt.Errorf("client %s: %s", client, result.Error))
+			return
+		}
+		s.logger.Infof("client %s: %s done", client, command.Action)
+		control.Audit(r, "%s of client %s", command.Action, client)
+		control.WriteJSON(w, result)
+	}
+
+	ctrl.HandleScope("PUT /clients/{client}/forwarder/{port}", control.ScopePorts, func(w http.ResponseWriter, r *http.Request) {
+		port, err := strconv.Atoi(r.PathValue("port"))
+		if err != nil {
+			control.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", r.PathValue("port")))
+			return
+		}
+		target := r.URL.Query().Get("target")
+		if target == "" {
+			control.WriteError(w, http.StatusBadRequest, errors.New("target is missing"))
+			return
+		}
+		command(w, r, control.ClientCommand{
+			Action:  control.CommandForwarder,
+			Port:    port,
+			Target:  target,
+			Drain:   r.URL.Query().Get("drain"),
+			Persist: r.URL.Query().Get("persist") == "true",
+		})
+	})
+
+	ctrl.HandleScope("DELETE /clients/{client}/forwarder/{port}", control.ScopePorts, func(w http.ResponseWriter, r *http.Request) {
+		port, err := strconv.Atoi(r.PathValue("port"))
+		if err != nil {
+			control.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid port %q", r.PathValue("port")))
+			return
+		}
+		command(w, r, control.ClientCommand{
+			Action:  control.CommandForwarder,
+			Port:    port,
+			Drain:   r.URL.Query().Get("drain"),
+			Persist: r.URL.Query().Get("persist") == "true",
+		})
+	})
+
+	ctrl.Handle("PUT /clients/{client}/log-level", func(w http.ResponseWriter, r *http.Request) {
+		command(w, r, control.ClientCommand{Action: control.CommandLogLevel, Level: r.URL.Query().Get("level")})
+	})
+
+	ctrl.Handle("POST /clients/{client}/reload", func(w http.ResponseWriter, r *http.Request) {
+		command(w, r, control.ClientCommand{Action: control.CommandReload})
+	})
+
+	ctrl.Handle("POST /clients/{client}/restart", func(w http.ResponseWriter, r *http.Request) {
+		command(w, r, control.ClientCommand{Action: control.CommandRestart})
+	})
+
+	ctrl.Handle("GET /attack", func(w http.ResponseWriter, r *http.Request) {
+		control.WriteJSON(w, attack.State())
+	})
+
+	ctrl.Handle("PUT /attack", func(w http.ResponseWriter, r *http.Request) {
+		mode := r.URL.Query().Get("mode")
+		if err := attack.SetMode(mode); err != nil {
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.logger.Infof("attack mode switched to %s", mode)
+		control.Audit(r, "attack mode switched to %s", mode)
+		control.WriteJSON(w, attack.State())
+	})
+}
+
+const (
+	defaultSpeedtestSize = 16   // MB
+	maxSpeedtestSize     = 1024 // MB
+)
@@ -0,0 +1,135 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"os/user"
+	"strconv"
+	"strings"
+	"syscall"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+const capNetBindService = 10 // bit of CAP_NET_BIND_SERVICE in the capability sets
+
+// dropPrivileges binds the tunnel and all public ports, then switches to the
+// configured user and group. The bound sockets are reused on every restart.
+func (s *Server) dropPrivileges() error {
+	if os.Geteuid() != 0 {
+		s.logger.Warnf("not running as root, ignoring user %q", s.config.User)
+		return nil
+	}
+
+	uid, gid, err := lookupIDs(s.config.User, s.config.Group)
+	if err != nil {
+		return err
+	}
+
+	addrs, err := s.listenAddrs()
+	if err != nil {
+		return err
+	}
+	for _, addr := range addrs {
+		if utils.HasListener(addr) { // e.g. passed by socket activation
+			continue
+		}
+		listener, err := net.Listen("tcp", addr)
+		if err != nil {
+			return fmt.Errorf("failed to bind %s before dropping privileges: %w", addr, err)
+		}
+		utils.AddListener(addr, listener.(*net.TCPListener))
+	}
+
+	if err := syscall.Setgroups([]int{}); err != nil {
+		return fmt.Errorf("failed to clear supplementary groups: %w", err)
+	}
+	if err := syscall.Setgid(gid); err != nil {
+		return fmt.Errorf("failed to set gid %d: %w", gid, err)
+	}
+	if err := syscall.Setuid(uid); err != nil {
+		return fmt.Errorf("failed to set uid %d: %w", uid, err)
+	}
+
+	s.logger.Infof("bound %d listeners, now running as uid %d gid %d", len(addrs), uid, gid)
+	return nil
+}
+
+// checkLowPorts warns about public ports below the unprivileged port range when
+// the process can't bind them.
+func (s *Server) checkLowPorts() {
+	if os.Geteuid() == 0 || hasBindCapability() {
+		return
+	}
+
+	mappings, err := utils.ParsePorts(s.config.Ports, s.config.Forward)
+	if err != nil {
+		return // reported by the transport
+	}
+
+	start := unprivilegedPortStart()
+	for _, mapping := range mappings {
+		if mapping.LocalPort < start {
+			s.logger.Warnf("port %d needs root or CAP_NET_BIND_SERVICE, grant it with: setcap 'cap_net_bind_service=+ep' %s", mapping.LocalPort, os.Args[0])
+		}
+	}
+}
+
+func lookupIDs(userName, groupName string) (int, int, error) {
+	u, err := user.Lookup(userName)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed to look up user %q: %w", userName, err)
+	}
+	gidStr := u.Gid
+	if groupName != "" {
+		g, err := user.LookupGroup(groupName)
+		if err != nil {
+			return 0, 0, fmt.Errorf("failed to look up group %q: %w", groupName, err)
+		}
+		gidStr = g.Gid
+	}
+
+	uid, err := strconv.Atoi(u.Uid)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid uid %q: %w", u.Uid, err)
+	}
+	gid, err := strconv.Atoi(gidStr)
+	if err != nil {
+		return 0, 0, fmt.Errorf("invalid gid %q: %w", gidStr, err)
+	}
+	return uid, gid, nil
+}
+
+// hasBindCapability reports whether CAP_NET_BIND_SERVICE is in the effective
+// capability set (e.g. granted with setcap). Always false outside Linux.
+func hasBindCapability() bool {
+	status, err := os.ReadFile("/proc/self/status")
+	if err != nil {
+		return false
+	}
+
+	for _, line := range strings.Split(string(status), "\n") {
+		if hex, ok := strings.CutPrefix(line, "CapEff:"); ok {
+			caps, err := strconv.ParseUint(strings.TrimSpace(hex), 16, 64)
+			return err == nil && caps&(1<<capNetBindService) != 0
+		}
+	}
+	return false
+}
+
+// unprivilegedPortStart returns the first port that can be bound without
+// privileges, 1024 unless lowered with net.ipv4.ip_unprivileged_port_start.
+func unprivilegedPortStart() int {
+	data, err := os.ReadFile("/proc/sys/net/ipv4/ip_unprivileged_port_start")
+	if err != nil {
+		return 1024
+	}
+	start, err := strconv.Atoi(strings.TrimSpace(string(data)))
+	if err != nil {
+		return 1024
+	}
+	return start
+}
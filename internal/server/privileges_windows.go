@@ -0,0 +1,10 @@
+package server
+
+// dropPrivileges is not supported on Windows.
+func (s *Server) dropPrivileges() error {
+	s.logger.Warnf("running as another user is not supported on windows, ignoring user %q", s.config.User)
+	return nil
+}
+
+// checkLowPorts is a no-op, Windows has no privileged ports.
+func (s *Server) checkLowPorts() {}
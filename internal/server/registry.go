@@ -0,0 +1,137 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/registry"
+	"github.com/sahmadiut/backhaul/internal/server/transport"
+)
+
+var errNoRegistry = errors.New("the server keeps no registry, set registry")
+
+// registerRegistryHandlers adds the client registry to the control API:
+//
+//	GET /clients                                           known clients
+//	GET /clients/{client}                                  a known client
+//	PUT /clients/{client}?ports=4000:4009&connections=100  assign ports and quotas
+//	DELETE /clients/{client}                               forget a client
+//
+// PUT takes name, ports (comma separated), connections, mbps and traffic_gb,
+// changes only the ones given and answers with the client, DELETE with the
+// clients left. Clients are added when they first connect or are assigned
+// something.
+func (s *Server) registerRegistryHandlers(ctrl *control.Server, tunnel transport.Tunnel, known *registry.Registry) {
+	// IDs of the clients with a tunnel connection now
+	connected := func() map[string]bool {
+		ids := make(map[string]bool)
+		if tunnel != nil {
+			for _, session := range tunnel.Sessions() {
+				ids[session.Client] = true
+			}
+		}
+		return ids
+	}
+
+	list := func(w http.ResponseWriter) {
+		if known == nil {
+			control.WriteJSON(w, []control.KnownClient{})
+			return
+		}
+		clients, ids := known.List(), connected()
+		for i := range clients {
+			clients[i].Connected = ids[clients[i].ID]
+		}
+		control.WriteJSON(w, clients)
+	}
+
+	ctrl.Handle("GET /clients", func(w http.ResponseWriter, r *http.Request) {
+		list(w)
+	})
+
+	ctrl.Handle("GET /clients/{client}", func(w http.ResponseWriter, r *http.Request) {
+		if known == nil {
+			control.WriteError(w, http.StatusNotFound, errNoRegistry)
+			return
+		}
+		client, ok := known.Get(r.PathValue("client"))
+		if !ok {
+			control.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown client %s", r.PathValue("client")))
+			return
+		}
+		client.Connected = connected()[client.ID]
+		control.WriteJSON(w, client)
+	})
+
+	ctrl.Handle("PUT /clients/{client}", func(w http.ResponseWriter, r *http.Request) {
+		if known == nil {
+			control.WriteError(w, http.StatusNotFound, errNoRegistry)
+			return
+		}
+		id := r.PathValue("client")
+		client, _ := known.Get(id)
+		query := r.URL.Query()
+		if query.Has("name") {
+			client.Name = query.Get("name")
+		}
+		if query.Has("ports") {
+			client.Ports = nil
+			if value := query.Get("ports"); value != "" {
+				client.Ports = strings.Split(value, ",")
+			}
+		}
+		for name, quota := range map[string]*int{
+			"connections": &client.Quota.Connections,
+			"mbps":        &client.Quota.Mbps,
+			"traffic_gb":  &client.Quota.TrafficGB,
+		} {
+			if !query.Has(name) {
+				continue
+			}
+			n, err := strconv.Atoi(query.Get(name))
+			if err != nil || n < 0 {
+				control.WriteError(w, http.StatusBadRequest, fmt.Errorf("invalid %s %q", name, query.Get(name)))
+				return
+			}
+			*quota = n
+		}
+
+		client, err := known.Set(id, client)
+		switch {
+		case errors.Is(err, registry.ErrPortsTaken):
+			control.WriteError(w, http.StatusConflict, err)
+			return
+		case err != nil:
+			control.WriteError(w, http.StatusBadRequest, err)
+			return
+		}
+		s.logger.Infof("client %s changed in the registry", id)
+		control.Audit(r, "client %s changed in the registry: ports %v, quota %+v", id, client.Ports, client.Quota)
+		client.Connected = connected()[id]
+		control.WriteJSON(w, client)
+	})
+
+	ctrl.Handle("DELETE /clients/{client}", func(w http.ResponseWriter, r *http.Request) {
+		if known == nil {
+			control.WriteError(w, http.StatusNotFound, errNoRegistry)
+			return
+		}
+		id := r.PathValue("client")
+		deleted, err := known.Delete(id)
+		switch {
+		case err != nil:
+			control.WriteError(w, http.StatusInternalServerError, err)
+			return
+		case !deleted:
+			control.WriteError(w, http.StatusNotFound, fmt.Errorf("unknown client %s", id))
+			return
+		}
+		s.logger.Infof("client %s removed from the registry", id)
+		control.Audit(r, "client %s removed from the registry", id)
+		list(w)
+	})
+}
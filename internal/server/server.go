@@ -2,22 +2,35 @@ package server
 
 import (
 	"context"
-	"net/http"
-	_ "net/http/pprof"
+	"crypto/ecdh"
+	"crypto/tls"
 	"time"
 
+	"github.com/sahmadiut/backhaul/internal/chaos"
 	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/geoip"
+	"github.com/sahmadiut/backhaul/internal/noise"
+	"github.com/sahmadiut/backhaul/internal/profiling"
+	"github.com/sahmadiut/backhaul/internal/registry"
 	"github.com/sahmadiut/backhaul/internal/server/transport"
+	"github.com/sahmadiut/backhaul/internal/synfilter"
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/tun"
 	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
 
 	"github.com/sirupsen/logrus"
 )
 
 type Server struct {
-	config *config.ServerConfig
-	ctx    context.Context
-	cancel context.CancelFunc
-	logger *logrus.Logger
+	config  *config.ServerConfig
+	ctx     context.Context
+	cancel  context.CancelFunc
+	logger  *logrus.Logger
+	started time.Time
 }
 
 func NewServer(cfg *config.ServerConfig, parentCtx context.Context) *Server {
@@ -26,46 +39,255 @@ func NewServer(cfg *config.ServerConfig, parentCtx context.Context) *Server {
 		config: cfg,
 		ctx:    ctx,
 		cancel: cancel,
-		logger: utils.NewLogger(cfg.LogLevel),
+		logger: utils.NewNamedLogger(cfg.LogLevel, cfg.Instance),
 	}
 }
 
 func (s *Server) Start() {
-	// for pprof and debugging
+	s.started = time.Now()
+
+	// pprof for debugging, only reachable from loopback
+	profiler := profiling.NewProfiler(s.config.PPROFPort, s.logger)
 	if s.config.PPROF {
-		go func() {
-			s.logger.Info("pprof started at port 6060")
-			http.ListenAndServe("0.0.0.0:6060", nil)
-		}()
+		if err := profiler.Enable(); err != nil {
+			s.logger.Errorf("failed to start pprof: %v", err)
+		}
+	}
+	go profiler.Run(s.ctx, s.config.PPROFDumpDir, s.config.PPROFHeapLimit, s.config.PPROFGoroutines)
+
+	// local control API, started once the transport is up
+	var ctrl *control.Server
+	if s.config.ControlSocket != "" || s.config.ControlAddr != "" {
+		ctrl = control.NewServer(s.config.ControlSocket, s.logger)
+		if s.config.ControlAddr != "" {
+			if err := ctrl.ListenTCP(s.config.ControlAddr, s.config.ControlKeys); err != nil {
+				s.logger.Fatalf("invalid control API keys: %v", err)
+			}
+		}
+		if s.config.AuditLog != "" {
+			if err := ctrl.AuditLog(s.config.AuditLog); err != nil {
+				s.logger.Fatalf("failed to open audit log: %v", err)
+			}
+		}
+		profiling.RegisterHandlers(ctrl, profiler)
+	}
+
+	// trace the tunnel lifecycle
+	if s.config.OTLPEndpoint != "" {
+		tracing.Init(s.ctx, s.config.OTLPEndpoint, "backhaul-server", s.logger)
+	}
+
+	// push metrics for users without Prometheus
+	if s.config.InfluxURL != "" {
+		exporter := web.NewInfluxExporter(s.config.InfluxURL, s.config.InfluxToken, time.Duration(s.config.InfluxInterval)*time.Second, "server", s.logger)
+		go exporter.Run(s.ctx)
+	}
+	web.SetLogRotation(web.LogRotation{
+		MaxSize:   int64(max(s.config.SnifferLogSize, 0)) << 20,
+		MaxAge:    time.Duration(max(s.config.SnifferLogAge, 0)) * time.Hour,
+		Retention: time.Duration(max(s.config.SnifferLogKeep, 0)) * 24 * time.Hour,
+	})
+	web.SetUsageHistory(time.Duration(max(s.config.SnifferHistory, 0)) * 24 * time.Hour)
+
+	// route a subnet over the tunnel, set up before dropping privileges
+	var tunLink *tun.Link
+	if s.config.TunAddr != "" {
+		tunConfig, err := tun.ParseConfig(s.config.TunName, s.config.TunAddr, s.config.TunMTU, s.config.TunRoutes)
+		if err != nil {
+			s.logger.Fatalf("%v", err)
+		}
+		if tunLink, err = tun.Start(s.ctx, tunConfig, s.logger); err != nil {
+			s.logger.Fatalf("%v", err)
+		}
+		go tunLink.Run(s.ctx)
+	}
+
+	// resolve the DNS queries of the client on this network
+	var dnsResolver *dnsfwd.Resolver
+	if s.config.DNSForward {
+		var err error
+		if dnsResolver, err = dnsfwd.NewResolver(s.config.DNSUpstream, s.logger); err != nil {
+			s.logger.Fatalf("failed to set up dns_forward, set dns_upstream: %v", err)
+		}
+		go dnsResolver.Run(s.ctx)
+	}
+
+	// dial the destinations of the client from this server
+	var exitNode *exitnode.Node
+	if s.config.ExitNode {
+		var allowed *utils.TargetACL
+		if len(s.config.ExitAllowed) > 0 {
+			var err error
+			if allowed, err = utils.ParseTargetACL(s.config.ExitAllowed); err != nil {
+				s.logger.Fatalf("invalid exit_allowed: %v", err)
+			}
+		}
+		exitNode = exitnode.NewNode(allowed, s.logger)
+		go exitNode.Run(s.ctx)
+	}
+
+	// drop floods of SYNs in the kernel, loaded before dropping privileges
+	var filter *synfilter.Filter
+	if s.config.KernelFilter {
+		var err error
+		if filter, err = synfilter.Load(s.ctx, s.config.SynRate, s.logger); err != nil {
+			s.logger.Warnf("kernel_filter is not available, filtering in backhaul only: %v", err)
+		}
+	}
+
+	// bind privileged ports and run as an unprivileged user
+	if s.config.User != "" {
+		if err := s.dropPrivileges(); err != nil {
+			s.logger.Fatalf("failed to drop privileges: %v", err)
+		}
+	} else {
+		s.checkLowPorts()
+	}
+
+	if s.config.WaitForTunnel && s.config.HoldTimeout > 0 {
+		s.logger.Warn("wait_for_tunnel has no effect with hold_timeout, which keeps the ports open on purpose")
+	}
+	if s.config.WaitForTunnel && s.config.ClusterForward {
+		s.logger.Warn("wait_for_tunnel has no effect with cluster_forward, which keeps the ports open for the peers")
+		s.config.WaitForTunnel = false
+	}
+
+	// signed tokens are taken once, plain ones from older clients unless rejected
+	auth := utils.NewTokenChecker(s.config.Token, time.Duration(s.config.AuthSkew)*time.Second, s.config.RejectPlainToken)
+	transport.SetFlapThreshold(s.config.FlapThreshold)
+
+	// known clients, opened after dropping privileges so the file stays writable
+	var known *registry.Registry
+	if s.config.Registry != "" {
+		var err error
+		if known, err = registry.Open(s.config.Registry, s.logger); err != nil {
+			s.logger.Fatalf("failed to open the registry: %v", err)
+		}
+		transport.SetRegistry(known)
+		go known.Run(s.ctx)
+	}
+
+	authLimit := transport.NewAuthLimiter(s.config.AuthAttempts, time.Duration(s.config.AuthWindow)*time.Second, time.Duration(s.config.AuthBan)*time.Second, s.logger)
+	authLimit.UseFilter(filter)
+	authLimit.UseTarpit(transport.NewTarpit(s.ctx, s.config.TarpitSlots, time.Duration(s.config.TarpitTime)*time.Second, s.logger))
+	attack := transport.NewAttackGuard(s.config.UnderAttack, s.config.AttackRate, s.config.AttackMinBytes,
+		time.Duration(s.config.AttackTimeout)*time.Second, s.config.AttackIPLimit, s.logger)
+	go attack.Run(s.ctx)
+	anomaly := transport.NewAnomalyDetector(s.config.Anomaly, s.config.AnomalyFactor, s.logger)
+	go anomaly.Run(s.ctx)
+	shaper, err := transport.NewShaper(s.config.Bandwidth, s.logger)
+	if err != nil {
+		s.logger.Fatalf("invalid bandwidth policy: %v", err)
+	}
+	go shaper.Run(s.ctx)
+	geo, err := geoip.Open(s.config.GeoIPDB, s.config.GeoIPASNDB)
+	if err != nil {
+		s.logger.Fatalf("failed to open GeoIP database: %v", err)
+	}
+	sources := transport.NewSourceTracker(s.config.TopSources, geo)
+	go sources.Run(s.ctx)
+
+	chaosMode, err := chaos.Parse(s.config.Chaos, s.logger)
+	if err != nil {
+		s.logger.Fatalf("%v", err)
+	}
+	if chaosMode != nil {
+		s.logger.Warnf("chaos mode is on, the tunnel will break on purpose: %s. Never use it in production", chaosMode)
 	}
 
+	keepalive := utils.Keepalive{
+		Mode:   s.config.KeepaliveMode,
+		Period: time.Duration(s.config.Keepalive) * time.Second,
+		Ping:   time.Duration(s.config.PingInterval) * time.Second,
+		Jitter: float64(s.config.KeepaliveJitter) / 100,
+	}
+
+	var tunnel transport.Tunnel
 	if s.config.Transport == config.TCP {
 		tcpConfig := &transport.TcpConfig{
-			BindAddr:       s.config.BindAddr,
-			Nodelay:        s.config.Nodelay,
-			KeepAlive:      time.Duration(s.config.Keepalive) * time.Second,
-			ConnectionPool: s.config.ConnectionPool,
-			Token:          s.config.Token,
-			ChannelSize:    s.config.ChannelSize,
-			Ports:          s.config.Ports,
-			Sniffer:        s.config.Sniffer,
-			WebPort:        s.config.WebPort,
-			SnifferLog:     s.config.SnifferLog,
-			Heartbeat:      s.config.Heartbeat,
+			BindAddr:         s.config.BindAddr,
+			Nodelay:          s.config.Nodelay,
+			AutoNodelay:      s.config.AutoNodelay,
+			Chaos:            chaosMode,
+			KeepAlive:        keepalive,
+			ConnectionPool:   s.config.ConnectionPool,
+			PoolPolicy:       s.config.PoolPolicy,
+			Token:            s.config.Token,
+			Auth:             auth,
+			AuthLimit:        authLimit,
+			ChannelSize:      s.config.ChannelSize,
+			Ports:            s.config.Ports,
+			Forward:          s.config.Forward,
+			PortsAddr:        s.config.PortsAddr,
+			TransparentAddr:  s.config.TransparentAddr,
+			Sniffer:          s.config.Sniffer,
+			WebPort:          s.config.WebPort,
+			SnifferLog:       s.config.SnifferLog,
+			Heartbeat:        s.config.Heartbeat,
+			PortOptions:      s.config.PortOptions,
+			OverflowPolicy:   s.config.OverflowPolicy,
+			OverflowTimeout:  time.Duration(s.config.OverflowTimeout) * time.Second,
+			HoldTimeout:      time.Duration(s.config.HoldTimeout) * time.Second,
+			FirstByteTimeout: time.Duration(s.config.FirstByteTimeout) * time.Second,
+			IdleCull:         time.Duration(s.config.IdleCull) * time.Minute,
+			WaitForTunnel:    s.config.WaitForTunnel,
+			Tun:              tunLink,
+			DNS:              dnsResolver,
+			Exit:             exitNode,
+			Filter:           filter,
+			Attack:           attack,
+			Anomaly:          anomaly,
+			Shaper:           shaper,
+			Sources:          sources,
 		}
 
 		tcpServer := transport.NewTCPServer(s.ctx, tcpConfig, s.logger)
 		go tcpServer.TunnelListener()
+		tunnel = tcpServer
 
 	} else if s.config.Transport == config.TCPMUX {
+		var tlsConfig *tls.Config
+		if s.config.MuxTLS {
+			var err error
+			if tlsConfig, err = s.muxTLSConfig(); err != nil {
+				s.logger.Fatalf("failed to set up TLS for the tunnel: %v", err)
+			}
+		}
+		var noiseKey *ecdh.PrivateKey
+		noisePeers := make(map[string]bool)
+		if s.config.NoisePrivateKey != "" {
+			if s.config.MuxTLS {
+				s.logger.Fatalf("mux_tls and noise_private_key can't be used together")
+			}
+			var err error
+			if noiseKey, err = noise.ParsePrivateKey(s.config.NoisePrivateKey); err != nil {
+				s.logger.Fatalf("invalid noise_private_key: %v", err)
+			}
+			for _, peer := range s.config.NoisePeers {
+				if _, err := noise.ParsePublicKey(peer); err != nil {
+					s.logger.Fatalf("invalid key %q in noise_peers: %v", peer, err)
+				}
+				noisePeers[peer] = true
+			}
+			public, _ := noise.PublicKey(s.config.NoisePrivateKey)
+			s.logger.Infof("noise public key of the server: %s", public)
+		}
+
 		tcpMuxConfig := &transport.TcpMuxConfig{
 			BindAddr:         s.config.BindAddr,
 			Nodelay:          s.config.Nodelay,
-			KeepAlive:        time.Duration(s.config.Keepalive) * time.Second,
+			AutoNodelay:      s.config.AutoNodelay,
+			Chaos:            chaosMode,
+			KeepAlive:        keepalive,
 			Token:            s.config.Token,
+			Auth:             auth,
+			AuthLimit:        authLimit,
 			MuxSession:       s.config.MuxSession,
 			ChannelSize:      s.config.ChannelSize,
 			Ports:            s.config.Ports,
+			Forward:          s.config.Forward,
+			PortsAddr:        s.config.PortsAddr,
+			TransparentAddr:  s.config.TransparentAddr,
 			MuxVersion:       s.config.MuxVersion,
 			MaxFrameSize:     s.config.MaxFrameSize,
 			MaxReceiveBuffer: s.config.MaxReceiveBuffer,
@@ -73,32 +295,101 @@ func (s *Server) Start() {
 			Sniffer:          s.config.Sniffer,
 			WebPort:          s.config.WebPort,
 			SnifferLog:       s.config.SnifferLog,
+			PortOptions:      s.config.PortOptions,
+			StickyRouting:    s.config.StickyRouting,
+			OverflowPolicy:   s.config.OverflowPolicy,
+			OverflowTimeout:  time.Duration(s.config.OverflowTimeout) * time.Second,
+			HoldTimeout:      time.Duration(s.config.HoldTimeout) * time.Second,
+			FirstByteTimeout: time.Duration(s.config.FirstByteTimeout) * time.Second,
+			IdleCull:         time.Duration(s.config.IdleCull) * time.Minute,
+			WaitForTunnel:    s.config.WaitForTunnel,
+			Tun:              tunLink,
+			DNS:              dnsResolver,
+			Exit:             exitNode,
+			Filter:           filter,
+			Attack:           attack,
+			Anomaly:          anomaly,
+			Shaper:           shaper,
+			Sources:          sources,
+			SessionDrain:     time.Duration(s.config.SessionDrain) * time.Second,
+			MuxSessionMax:    s.config.MuxSessionMax,
+			ScaleStreams:     s.config.MuxScaleStreams,
+			MaxStreams:       s.config.MuxMaxStreams,
+			Heartbeat:        time.Duration(s.config.Heartbeat) * time.Second,
+			ScaleMbps:        s.config.MuxScaleMbps,
+			TLSConfig:        tlsConfig,
+			NoiseKey:         noiseKey,
+			NoisePeers:       noisePeers,
 		}
 
 		tcpMuxServer := transport.NewTcpMuxServer(s.ctx, tcpMuxConfig, s.logger)
 		go tcpMuxServer.TunnelListener()
+		tunnel = tcpMuxServer
 
 	} else if s.config.Transport == config.WS || s.config.Transport == config.WSS {
+		masquerade, err := transport.NewMasquerade(s.config.Masquerade, s.logger)
+		if err != nil {
+			s.logger.Fatalf("invalid masquerade: %v", err)
+		}
+		fallback, err := transport.NewFallback(s.config.Fallback, s.logger)
+		if err != nil {
+			s.logger.Fatalf("%v", err)
+		}
 		wsConfig := &transport.WsConfig{
-			BindAddr:       s.config.BindAddr,
-			Nodelay:        s.config.Nodelay,
-			KeepAlive:      time.Duration(s.config.Keepalive) * time.Second,
-			ConnectionPool: s.config.ConnectionPool,
-			Token:          s.config.Token,
-			ChannelSize:    s.config.ChannelSize,
-			Ports:          s.config.Ports,
-			Sniffer:        s.config.Sniffer,
-			WebPort:        s.config.WebPort,
-			SnifferLog:     s.config.SnifferLog,
-			Mode:           s.config.Transport,
-			TLSCertFile:    s.config.TLSCertFile,
-			TLSKeyFile:     s.config.TLSKeyFile,
-			Heartbeat:      s.config.Heartbeat,
+			BindAddr:         s.config.BindAddr,
+			Nodelay:          s.config.Nodelay,
+			AutoNodelay:      s.config.AutoNodelay,
+			Chaos:            chaosMode,
+			KeepAlive:        keepalive,
+			ConnectionPool:   s.config.ConnectionPool,
+			Token:            s.config.Token,
+			Auth:             auth,
+			AuthLimit:        authLimit,
+			ChannelSize:      s.config.ChannelSize,
+			Ports:            s.config.Ports,
+			Forward:          s.config.Forward,
+			PortsAddr:        s.config.PortsAddr,
+			TransparentAddr:  s.config.TransparentAddr,
+			Sniffer:          s.config.Sniffer,
+			WebPort:          s.config.WebPort,
+			SnifferLog:       s.config.SnifferLog,
+			Mode:             s.config.Transport,
+			TLSCertFile:      s.config.TLSCertFile,
+			TLSKeyFile:       s.config.TLSKeyFile,
+			Heartbeat:        s.config.Heartbeat,
+			PortOptions:      s.config.PortOptions,
+			OverflowPolicy:   s.config.OverflowPolicy,
+			OverflowTimeout:  time.Duration(s.config.OverflowTimeout) * time.Second,
+			HoldTimeout:      time.Duration(s.config.HoldTimeout) * time.Second,
+			FirstByteTimeout: time.Duration(s.config.FirstByteTimeout) * time.Second,
+			IdleCull:         time.Duration(s.config.IdleCull) * time.Minute,
+			WaitForTunnel:    s.config.WaitForTunnel,
+			Tun:              tunLink,
+			DNS:              dnsResolver,
+			Exit:             exitNode,
+			Filter:           filter,
+			Attack:           attack,
+			Anomaly:          anomaly,
+			Shaper:           shaper,
+			Sources:          sources,
+			Masquerade:       masquerade,
+			Fallback:         fallback,
 		}
 
 		wsServer := transport.NewWSServer(s.ctx, wsConfig, s.logger)
 		go wsServer.TunnelListener()
+		tunnel = wsServer
+
+	}
+
+	// active-standby servers share their state
+	peers := s.startCluster(tunnel, known)
 
+	if ctrl != nil {
+		s.registerHandlers(ctrl, tunnel, attack)
+		s.registerClusterHandlers(ctrl, peers)
+		s.registerRegistryHandlers(ctrl, tunnel, known)
+		go ctrl.Run(s.ctx)
 	}
 
 	<-s.ctx.Done()
@@ -111,3 +402,43 @@ func (s *Server) Stop() {
 		s.cancel()
 	}
 }
+
+// muxTLSConfig loads tls_cert and tls_key for the tunnel, or makes up a
+// certificate for this run when they are not set.
+func (s *Server) muxTLSConfig() (*tls.Config, error) {
+	var cert tls.Certificate
+	if s.config.TLSCertFile != "" {
+		var err error
+		if cert, err = tls.LoadX509KeyPair(s.config.TLSCertFile, s.config.TLSKeyFile); err != nil {
+			return nil, err
+		}
+	} else {
+		certPEM, keyPEM, err := utils.SelfSigned("backhaul")
+		if err != nil {
+			return nil, err
+		}
+		if cert, err = tls.X509KeyPair(certPEM, keyPEM); err != nil {
+			return nil, err
+		}
+		s.logger.Warn("no tls_cert set, the tunnel uses a certificate made up for this run, its pin changes on restart")
+	}
+	s.logger.Infof("tunnel TLS certificate pin: %s", utils.CertPin(cert.Certificate[0]))
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
+}
+
+// listenAddrs returns the tunnel address and all public port addresses.
+func (s *Server) listenAddrs() ([]string, error) {
+	mappings, err := utils.ParsePorts(s.config.Ports, s.config.Forward)
+	if err != nil {
+		return nil, err
+	}
+
+	addrs := []string{s.config.BindAddr}
+	for _, mapping := range mappings {
+		addrs = append(addrs, mapping.Addr(s.config.PortsAddr))
+	}
+	if s.config.TransparentAddr != "" {
+		addrs = append(addrs, s.config.TransparentAddr)
+	}
+	return addrs, nil
+}
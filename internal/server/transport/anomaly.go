@@ -0,0 +1,270 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// Default of the anomaly_factor option.
+const defaultAnomalyFactor = 5
+
+const (
+	anomalyHalfLife = 10 * time.Minute // of the baseline
+	anomalyWarmup   = 5 * time.Minute  // of baseline before a port is judged
+	anomalyCalm     = time.Minute      // under half the limit before an anomaly ends
+	anomalyMinConns = 20               // connections per second a spike must reach
+	anomalyMinBytes = 1 << 20          // bytes per second a spike must reach
+)
+
+// AnomalyDetector learns the usual connection and byte rates of each public
+// port, and flags a port once either rises to anomaly_factor times its
+// baseline. With anomaly = "limit" the port is then held to that rate: the
+// connections over it in a second are reset and the connections of the port
+// are slowed down to its byte rate, until a minute passes under half of it.
+// The baseline keeps learning ten times slower meanwhile, so a lasting change
+// becomes the new normal in a few hours. A nil AnomalyDetector watches
+// nothing.
+type AnomalyDetector struct {
+	limit  bool // or only alert
+	factor float64
+	logger *logrus.Logger
+	usage  *web.Usage // nil, the metrics are kept per process
+
+	mu    sync.Mutex
+	ports map[int]*portRates
+}
+
+// portRates are the rates of a public port. The counters are updated by its
+// connections, the rest belongs to Run.
+type portRates struct {
+	conns     atomic.Int64 // accepted in the current second
+	bytes     atomic.Int64 // relayed in the current second, both ways
+	refused   atomic.Int64 // while limited
+	connLimit atomic.Int64 // per second while limited, 0 for none
+	bucket    atomic.Pointer[byteBucket]
+
+	samples   int // seconds of baseline
+	baseConns float64
+	baseBytes float64
+
+	anomaly  string // "connections" or "bytes" while the port is flagged
+	since    time.Time
+	spike    time.Time // last second over half the limit
+	maxConns float64   // limits from the baseline when it was flagged
+	maxBytes float64
+	last     [2]int64 // connections and bytes in the last second
+}
+
+func NewAnomalyDetector(mode string, factor float64, logger *logrus.Logger) *AnomalyDetector {
+	if mode == config.AnomalyOff || mode == "" {
+		return nil
+	}
+	if factor <= 1 {
+		factor = defaultAnomalyFactor
+	}
+	return &AnomalyDetector{
+		limit:  mode == config.AnomalyLimit,
+		factor: factor,
+		logger: logger,
+		ports:  make(map[int]*portRates),
+	}
+}
+
+// Watch counts conn, a public connection just accepted on port, towards the
+// rates of port. It returns nil for a connection refused while port is
+// limited.
+func (d *AnomalyDetector) Watch(conn net.Conn, port int) net.Conn {
+	if d == nil {
+		return conn
+	}
+	d.mu.Lock()
+	rates, ok := d.ports[port]
+	if !ok {
+		rates = &portRates{}
+		d.ports[port] = rates
+	}
+	d.mu.Unlock()
+
+	accepted := rates.conns.Add(1)
+	if limit := rates.connLimit.Load(); limit > 0 && accepted > limit {
+		rates.refused.Add(1)
+		d.usage.IncCounter("backhaul_anomaly_refused_total", "port", strconv.Itoa(port))
+		utils.ResetConn(conn)
+		return nil
+	}
+	return &watchedConn{Conn: conn, rates: rates}
+}
+
+// Run samples the rates of the ports each second, learning their baselines
+// and flagging and clearing anomalies.
+func (d *AnomalyDetector) Run(ctx context.Context) {
+	if d == nil {
+		return
+	}
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			d.mu.Lock()
+			for port, rates := range d.ports {
+				d.sample(port, rates, now)
+			}
+			d.record()
+			d.mu.Unlock()
+		}
+	}
+}
+
+// alpha weighs a second in the baseline, for a half-life of anomalyHalfLife
+var alpha = 1 - math.Exp(-math.Ln2/anomalyHalfLife.Seconds())
+
+// sample takes the last second of rates, the caller holds d.mu.
+func (d *AnomalyDetector) sample(port int, rates *portRates, now time.Time) {
+	conns, bytes := rates.conns.Swap(0), rates.bytes.Swap(0)
+	rates.last = [2]int64{conns, bytes}
+
+	if rates.anomaly != "" {
+		if float64(conns) > rates.maxConns/2 || float64(bytes) > rates.maxBytes/2 {
+			rates.spike = now
+		} else if now.Sub(rates.spike) > anomalyCalm {
+			d.clear(port, rates, now)
+		}
+	} else if rates.samples >= int(anomalyWarmup.Seconds()) {
+		maxConns := max(rates.baseConns*d.factor, anomalyMinConns)
+		maxBytes := max(rates.baseBytes*d.factor, anomalyMinBytes)
+		switch {
+		case float64(conns) > maxConns:
+			d.flag(port, rates, "connections", maxConns, maxBytes, now)
+		case float64(bytes) > maxBytes:
+			d.flag(port, rates, "bytes", maxConns, maxBytes, now)
+		}
+	}
+
+	weight := alpha
+	if rates.anomaly != "" {
+		weight /= 10
+	}
+	if rates.samples == 0 {
+		rates.baseConns, rates.baseBytes = float64(conns), float64(bytes)
+	} else {
+		rates.baseConns += weight * (float64(conns) - rates.baseConns)
+		rates.baseBytes += weight * (float64(bytes) - rates.baseBytes)
+	}
+	rates.samples++
+}
+
+// flag starts an anomaly on port, the caller holds d.mu.
+func (d *AnomalyDetector) flag(port int, rates *portRates, kind string, maxConns, maxBytes float64, now time.Time) {
+	rates.anomaly, rates.since, rates.spike = kind, now, now
+	rates.maxConns, rates.maxBytes = maxConns, maxBytes
+	rates.refused.Store(0)
+
+	label := strconv.Itoa(port)
+	d.usage.IncCounter("backhaul_anomalies_total", "port", label, "kind", kind)
+	d.usage.AddGauge("backhaul_port_anomaly", 1, "port", label)
+	seen := fmt.Sprintf("%d connections/s and %.1f Mbit/s, usually %.1f and %.1f", rates.last[0], mbps(float64(rates.last[1])), rates.baseConns, mbps(rates.baseBytes))
+	if !d.limit {
+		d.logger.Warnf("anomaly on port %d: %s", port, seen)
+		return
+	}
+	rates.connLimit.Store(int64(math.Ceil(maxConns)))
+	rates.bucket.Store(newByteBucket(maxBytes))
+	d.logger.Warnf("anomaly on port %d: %s, limiting it to %.0f connections/s and %.1f Mbit/s", port, seen, math.Ceil(maxConns), mbps(maxBytes))
+}
+
+// clear ends the anomaly on port, the caller holds d.mu.
+func (d *AnomalyDetector) clear(port int, rates *portRates, now time.Time) {
+	rates.connLimit.Store(0)
+	rates.bucket.Store(nil)
+	d.usage.AddGauge("backhaul_port_anomaly", -1, "port", strconv.Itoa(port))
+	d.logger.Infof("anomaly on port %d over (calm for %v) after %v, %d connections refused",
+		port, anomalyCalm, now.Sub(rates.since).Round(time.Second), rates.refused.Load())
+	rates.anomaly = ""
+}
+
+// record shows the anomalies on the dashboard, the caller holds d.mu.
+func (d *AnomalyDetector) record() {
+	mode := "alert"
+	if d.limit {
+		mode = "limit"
+	}
+	var flagged []string
+	for port, rates := range d.ports {
+		if rates.anomaly == "" {
+			continue
+		}
+		entry := fmt.Sprintf("port %d since %s, %d connections/s, %.1f Mbit/s", port, rates.since.Format(time.TimeOnly), rates.last[0], mbps(float64(rates.last[1])))
+		if d.limit {
+			entry += fmt.Sprintf(", %d refused", rates.refused.Load())
+		}
+		flagged = append(flagged, entry)
+	}
+	if len(flagged) == 0 {
+		web.RecordAnomalies(fmt.Sprintf("None (%s), %d ports watched", mode, len(d.ports)))
+		return
+	}
+	sort.Strings(flagged)
+	web.RecordAnomalies(fmt.Sprintf("%s (%s)", strings.Join(flagged, "; "), mode))
+}
+
+// mbps converts bytes per second to Mbit/s.
+func mbps(bytes float64) float64 {
+	return bytes * 8 / 1e6
+}
+
+// watchedConn is a public connection whose bytes count towards the rates of
+// its port, and which is slowed down while the port is limited.
+type watchedConn struct {
+	net.Conn
+	rates *portRates
+}
+
+func (c *watchedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.transferred(n)
+	return n, err
+}
+
+func (c *watchedConn) Write(p []byte) (int, error) {
+	c.transferred(len(p))
+	return c.Conn.Write(p)
+}
+
+func (c *watchedConn) transferred(n int) {
+	if n <= 0 {
+		return
+	}
+	c.rates.bytes.Add(int64(n))
+	if bucket := c.rates.bucket.Load(); bucket != nil {
+		if wait := bucket.take(n); wait > 0 {
+			time.Sleep(wait)
+		}
+	}
+}
+
+// Reset closes the connection with a reset, passed on to the wrapped one.
+func (c *watchedConn) Reset() error {
+	utils.ResetConn(c.Conn)
+	return nil
+}
+
+// NetConn returns the wrapped connection, for half-closing it.
+func (c *watchedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,297 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults of the attack_rate, attack_min_bytes, attack_timeout and
+// attack_ip_limit options.
+const (
+	defaultAttackRate     = 500
+	defaultAttackMinBytes = 1
+	defaultAttackTimeout  = 5 * time.Second
+	defaultAttackIPLimit  = 32
+)
+
+// how long the auto mode stays on after the last spike
+const attackCalm = time.Minute
+
+// AttackGuard guards the public ports against floods of connections while
+// the server is under attack: always with under_attack = "on", and with
+// "auto" while the accept rate is over attack_rate or the kernel sends SYN
+// cookies. Under attack, an address can't have more than attack_ip_limit
+// public connections, and a connection is forwarded only once it sent
+// attack_min_bytes within attack_timeout, so connections that never send
+// anything don't take up tunnel connections and streams. A nil AttackGuard
+// lets every connection through.
+type AttackGuard struct {
+	rate     int64 // accepts per second that start the auto mode
+	minBytes int   // to read before forwarding, 0 for no check
+	timeout  time.Duration
+	ipLimit  int // open connections per address, 0 for no limit
+	logger   *logrus.Logger
+	usage    *web.Usage // nil, the metrics are kept per process
+
+	accepts atomic.Int64 // in the current second
+	refused atomic.Int64
+
+	mu      sync.Mutex
+	mode    string
+	active  bool
+	since   time.Time // start of the attack
+	spike   time.Time // last second over the rate, or with SYN cookies
+	last    int64     // accepts in the last second
+	cookies uint64    // SYN cookies sent in the last second
+	ips     map[string]int
+}
+
+func NewAttackGuard(mode string, rate, minBytes int, timeout time.Duration, ipLimit int, logger *logrus.Logger) *AttackGuard {
+	if rate <= 0 {
+		rate = defaultAttackRate
+	}
+	if minBytes == 0 {
+		minBytes = defaultAttackMinBytes
+	}
+	if timeout <= 0 {
+		timeout = defaultAttackTimeout
+	}
+	if ipLimit == 0 {
+		ipLimit = defaultAttackIPLimit
+	}
+	g := &AttackGuard{
+		rate:     int64(rate),
+		minBytes: max(minBytes, 0),
+		timeout:  timeout,
+		ipLimit:  max(ipLimit, 0),
+		logger:   logger,
+		ips:      make(map[string]int),
+	}
+	if err := g.SetMode(mode); err != nil {
+		g.SetMode(config.AttackOff)
+	}
+	return g
+}
+
+// SetMode switches to mode, "off", "on" or "auto".
+func (g *AttackGuard) SetMode(mode string) error {
+	switch mode {
+	case config.AttackOff, config.AttackOn, config.AttackAuto:
+	default:
+		return fmt.Errorf("invalid mode %q, it must be %s, %s or %s", mode, config.AttackOff, config.AttackOn, config.AttackAuto)
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.mode = mode
+	if mode == config.AttackOff {
+		clear(g.ips) // connections open until now are no longer counted
+	}
+	g.setActive(mode == config.AttackOn || mode == config.AttackAuto && g.active, "switched to "+mode)
+	return nil
+}
+
+// State returns the mode and what it saw in the last second.
+func (g *AttackGuard) State() control.Attack {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	state := control.Attack{
+		Mode:       g.mode,
+		Active:     g.active,
+		Rate:       g.last,
+		SynCookies: g.cookies,
+		Refused:    g.refused.Load(),
+	}
+	if g.active {
+		state.Since = g.since
+	}
+	return state
+}
+
+// Run measures the accept rate and the SYN cookies each second, starting and
+// ending the attack in the auto mode.
+func (g *AttackGuard) Run(ctx context.Context) {
+	sent, enabled, err := utils.SynCookies()
+	if err != nil {
+		g.logger.Debugf("SYN cookies can't be watched: %v", err)
+	} else if !enabled {
+		g.logger.Warn("tcp_syncookies is off, a SYN flood can fill the backlog of the ports before under_attack sees it. Turn it on with: sysctl -w net.ipv4.tcp_syncookies=1")
+	}
+
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			accepts := g.accepts.Swap(0)
+			var cookies uint64
+			if err == nil {
+				var total uint64
+				if total, _, err = utils.SynCookies(); err == nil {
+					cookies, sent = total-sent, total
+					g.usage.AddCounter("backhaul_syncookies_sent_total", int64(cookies))
+				}
+			}
+
+			g.mu.Lock()
+			g.last, g.cookies = accepts, cookies
+			if accepts > g.rate || cookies > 0 {
+				g.spike = now
+				if g.mode == config.AttackAuto && !g.active {
+					g.setActive(true, fmt.Sprintf("%d connections and %d SYN cookies in the last second", accepts, cookies))
+				}
+			} else if g.mode == config.AttackAuto && g.active && now.Sub(g.spike) > attackCalm {
+				g.setActive(false, fmt.Sprintf("calm for %v", attackCalm))
+			}
+			g.record()
+			g.mu.Unlock()
+		}
+	}
+}
+
+// setActive starts or ends the attack, the caller holds g.mu.
+func (g *AttackGuard) setActive(active bool, why string) {
+	if active == g.active {
+		return
+	}
+	g.active = active
+	if active {
+		g.since = time.Now()
+		g.spike = g.since
+		g.usage.AddGauge("backhaul_under_attack", 1)
+		g.logger.Warnf("under attack (%s): public connections must send %d bytes within %v and an address may have %d open", why, g.minBytes, g.timeout, g.ipLimit)
+	} else {
+		g.usage.AddGauge("backhaul_under_attack", -1)
+		g.logger.Infof("attack over (%s) after %v, %d connections refused", why, time.Since(g.since).Round(time.Second), g.refused.Load())
+	}
+	g.record()
+}
+
+// record shows the state on the dashboard, the caller holds g.mu.
+func (g *AttackGuard) record() {
+	if !g.active {
+		web.RecordAttack(fmt.Sprintf("No (%s), %d connections/s", g.mode, g.last))
+		return
+	}
+	web.RecordAttack(fmt.Sprintf("Since %s, %d connections/s, %d SYN cookies/s, %d refused",
+		g.since.Format(time.TimeOnly), g.last, g.cookies, g.refused.Load()))
+}
+
+// Admit hands conn, a public connection just accepted, to push unless it is
+// refused under attack. It doesn't wait for the first bytes of conn, push is
+// then called from another goroutine.
+func (g *AttackGuard) Admit(conn net.Conn, push func(net.Conn)) {
+	if g == nil {
+		push(conn)
+		return
+	}
+	g.accepts.Add(1)
+
+	ip := addrIP(conn.RemoteAddr().String())
+	g.mu.Lock()
+	if g.mode == config.AttackOff {
+		g.mu.Unlock()
+		push(conn)
+		return
+	}
+	active := g.active
+	if active && g.ipLimit > 0 && g.ips[ip] >= g.ipLimit {
+		g.mu.Unlock()
+		g.refuse(conn, "ip_limit")
+		return
+	}
+	g.ips[ip]++
+	g.mu.Unlock()
+
+	guarded := &guardedConn{Conn: conn}
+	guarded.release = func() { g.release(ip) }
+	if !active || g.minBytes == 0 {
+		push(guarded)
+		return
+	}
+	go func() {
+		if err := guarded.readHead(g.minBytes, g.timeout); err != nil {
+			g.logger.Debugf("refusing connection from %s under attack, it sent no data: %v", conn.RemoteAddr().String(), err)
+			guarded.once.Do(guarded.release)
+			g.refuse(conn, "no_data")
+			return
+		}
+		push(guarded)
+	}()
+}
+
+func (g *AttackGuard) refuse(conn net.Conn, reason string) {
+	g.refused.Add(1)
+	g.usage.IncCounter("backhaul_attack_refused_total", "reason", reason)
+	utils.ResetConn(conn)
+}
+
+func (g *AttackGuard) release(ip string) {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if n, ok := g.ips[ip]; ok {
+		if n <= 1 {
+			delete(g.ips, ip)
+		} else {
+			g.ips[ip] = n - 1
+		}
+	}
+}
+
+// guardedConn is a public connection counted for its address by AttackGuard,
+// with the first bytes it read back in front.
+type guardedConn struct {
+	net.Conn
+	head    []byte
+	release func()
+	once    sync.Once
+}
+
+// readHead reads at least n bytes within timeout, to be read again first.
+func (c *guardedConn) readHead(n int, timeout time.Duration) error {
+	c.SetReadDeadline(time.Now().Add(timeout))
+	buf := make([]byte, max(n, 512))
+	read, err := io.ReadAtLeast(c.Conn, buf, n)
+	c.head = buf[:read]
+	c.SetReadDeadline(time.Time{})
+	return err
+}
+
+func (c *guardedConn) Read(p []byte) (int, error) {
+	if len(c.head) > 0 {
+		n := copy(p, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *guardedConn) Close() error {
+	c.once.Do(c.release)
+	return c.Conn.Close()
+}
+
+// Reset closes the connection with a reset, passed on to the wrapped one.
+func (c *guardedConn) Reset() error {
+	c.once.Do(c.release)
+	utils.ResetConn(c.Conn)
+	return nil
+}
+
+// NetConn returns the wrapped connection, for half-closing it.
+func (c *guardedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,164 @@
+package transport
+
+import (
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/synfilter"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// Defaults of the auth_attempts, auth_window and auth_ban options.
+const (
+	defaultAuthAttempts = 5
+	defaultAuthWindow   = time.Minute
+	defaultAuthBan      = 10 * time.Minute
+)
+
+// how long a failed handshake is held before it is closed, doubling with each
+// failure of its address in the window
+const (
+	authDelay    = 2 * time.Second
+	maxAuthDelay = 30 * time.Second
+)
+
+// AuthLimiter slows down addresses failing the handshake and bans them for a
+// while after too many failures, so the token can't be brute forced and the
+// tunnel slots aren't kept busy by failing handshakes.
+type AuthLimiter struct {
+	attempts int           // failures in the window before a ban, negative for no bans
+	window   time.Duration // failures older than this are forgotten
+	ban      time.Duration
+	filter   *synfilter.Filter // bans in the kernel as well, nil without kernel_filter
+	tarpit   *Tarpit           // holds the connections of banned addresses, nil without tarpit_slots
+	logger   *logrus.Logger
+
+	mu  sync.Mutex
+	ips map[string]*authFailures
+}
+
+type authFailures struct {
+	times       []time.Time // of the failures in the window
+	bannedUntil time.Time
+}
+
+func NewAuthLimiter(attempts int, window, ban time.Duration, logger *logrus.Logger) *AuthLimiter {
+	if attempts == 0 {
+		attempts = defaultAuthAttempts
+	}
+	if window <= 0 {
+		window = defaultAuthWindow
+	}
+	if ban <= 0 {
+		ban = defaultAuthBan
+	}
+	return &AuthLimiter{
+		attempts: attempts,
+		window:   window,
+		ban:      ban,
+		logger:   logger,
+		ips:      make(map[string]*authFailures),
+	}
+}
+
+func addrIP(addr string) string {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return addr
+	}
+	return host
+}
+
+// UseFilter has f drop the SYNs of banned addresses in the kernel, before
+// they get to the handshake.
+func (l *AuthLimiter) UseFilter(f *synfilter.Filter) {
+	l.filter = f
+}
+
+// UseTarpit has t hold the connections of banned addresses instead of
+// closing them.
+func (l *AuthLimiter) UseTarpit(t *Tarpit) {
+	l.tarpit = t
+}
+
+// Tarpitting reports whether connections of banned addresses may be held.
+func (l *AuthLimiter) Tarpitting() bool {
+	return l.tarpit != nil
+}
+
+// Refuse closes conn of a banned address, or holds it in the tarpit if it has
+// a free slot.
+func (l *AuthLimiter) Refuse(conn net.Conn, usage *web.Usage) {
+	if l.tarpit.Hold(conn, usage) {
+		l.logger.Debugf("tarpitting connection from banned address %s", conn.RemoteAddr().String())
+		return
+	}
+	conn.Close()
+}
+
+// Banned reports whether connections from addr are refused for now.
+func (l *AuthLimiter) Banned(addr string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	f, ok := l.ips[addrIP(addr)]
+	return ok && time.Now().Before(f.bannedUntil)
+}
+
+// Failed records a failed handshake from addr, bans it once it failed
+// auth_attempts times within auth_window, and returns how long to hold the
+// connection before closing it.
+func (l *AuthLimiter) Failed(addr string, usage *web.Usage) time.Duration {
+	ip := addrIP(addr)
+	now := time.Now()
+	usage.IncCounter("backhaul_auth_failures_total")
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.prune(now)
+	f, ok := l.ips[ip]
+	if !ok {
+		f = &authFailures{}
+		l.ips[ip] = f
+	}
+	f.times = append(f.times, now)
+
+	delay := authDelay
+	for i := 1; i < len(f.times) && delay < maxAuthDelay; i++ {
+		delay *= 2
+	}
+
+	if l.attempts > 0 && len(f.times) >= l.attempts {
+		f.bannedUntil = now.Add(l.ban)
+		f.times = nil
+		usage.IncCounter("backhaul_auth_bans_total")
+		l.filter.Ban(ip, l.ban)
+		l.logger.Warnf("banning %s for %v after %d failed handshakes within %v", ip, l.ban, l.attempts, l.window)
+	}
+	return min(delay, maxAuthDelay)
+}
+
+// Succeeded forgets the failures of addr.
+func (l *AuthLimiter) Succeeded(addr string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if f, ok := l.ips[addrIP(addr)]; ok && !time.Now().Before(f.bannedUntil) {
+		delete(l.ips, addrIP(addr))
+	}
+}
+
+// prune drops failures older than the window and bans that ended, the caller
+// holds l.mu.
+func (l *AuthLimiter) prune(now time.Time) {
+	for ip, f := range l.ips {
+		i := 0
+		for i < len(f.times) && now.Sub(f.times[i]) > l.window {
+			i++
+		}
+		f.times = f.times[i:]
+		if len(f.times) == 0 && !now.Before(f.bannedUntil) {
+			delete(l.ips, ip)
+		}
+	}
+}
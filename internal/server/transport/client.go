@@ -0,0 +1,114 @@
+package transport
+
+import (
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/registry"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// defaultFlapThreshold is how many connections of a client within an hour
+// make it count as flapping by default.
+const defaultFlapThreshold = 10
+
+var (
+	clientsMu     sync.Mutex
+	clients       = make(map[string]*clientRecord)
+	flapThreshold = defaultFlapThreshold
+	knownClients  *registry.Registry // nil without a registry
+)
+
+type clientRecord struct {
+	connects int         // tunnel connections since the server started
+	recent   []time.Time // of the tunnel connections within the last hour
+	flapping bool
+}
+
+// SetFlapThreshold sets how many connections of a client within an hour make
+// it count as flapping, negative to never flag a client.
+func SetFlapThreshold(n int) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	if n == 0 {
+		n = defaultFlapThreshold
+	}
+	flapThreshold = n
+}
+
+// SetRegistry has the clients that connect, and their reports, recorded in
+// known.
+func SetRegistry(known *registry.Registry) {
+	knownClients = known
+}
+
+// clientConnected records a tunnel connection of the client with id, so its
+// reconnects can be told apart from a new client, and flags the client as
+// flapping once it connected flap_threshold times within an hour. Older
+// clients send no ID.
+func clientConnected(id, peer string, usage *web.Usage, logger *logrus.Logger) {
+	if id == "" {
+		return
+	}
+
+	now := time.Now()
+	clientsMu.Lock()
+	client, ok := clients[id]
+	if !ok {
+		client = &clientRecord{}
+		clients[id] = client
+	}
+	client.connects++
+	client.recent = append(recentConnects(client.recent, now), now)
+	n, recent := client.connects, len(client.recent)
+	wasFlapping := client.flapping
+	flapping := flapThreshold > 0 && recent >= flapThreshold
+	client.flapping = flapping
+	clientsMu.Unlock()
+
+	usage.IncCounter("backhaul_client_connects_total", "client", id)
+	web.RecordClient(id)
+	knownClients.Seen(id, peer)
+	switch {
+	case n == 1:
+		logger.Infof("client %s connected from %s", id, peer)
+	case flapping:
+		usage.IncCounter("backhaul_client_flaps_total", "client", id)
+		if !wasFlapping {
+			logger.Warnf("client %s is flapping: %d connections within the last hour, last from %s", id, recent, peer)
+		} else {
+			logger.Infof("client %s connected again from %s, still flapping with %d connections within the last hour", id, peer, recent)
+		}
+	default:
+		if wasFlapping {
+			logger.Infof("client %s stopped flapping", id)
+		}
+		logger.Infof("client %s connected again from %s, %d connections since the server started", id, peer, n)
+	}
+}
+
+// ClientStats returns how often the client with id connected within the last
+// hour and whether it is flapping.
+func ClientStats(id string) (int, bool) {
+	clientsMu.Lock()
+	defer clientsMu.Unlock()
+	client, ok := clients[id]
+	if !ok {
+		return 0, false
+	}
+	client.recent = recentConnects(client.recent, time.Now())
+	if len(client.recent) < flapThreshold {
+		client.flapping = false
+	}
+	return len(client.recent), client.flapping
+}
+
+// recentConnects drops the connections older than an hour.
+func recentConnects(times []time.Time, now time.Time) []time.Time {
+	i := 0
+	for i < len(times) && now.Sub(times[i]) > time.Hour {
+		i++
+	}
+	return times[i:]
+}
@@ -0,0 +1,32 @@
+package transport
+
+import (
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// doctorEcho sends every message back until the doctor closes the stream or
+// the test limits are reached.
+func (s *WsTransport) doctorEcho(conn *websocket.Conn) {
+	defer utils.Recover(s.logger, s.state().usageMonitor, "doctor echo", conn)
+	defer conn.Close()
+
+	s.logger.Debugf("doctor echo stream from %s", conn.RemoteAddr().String())
+	conn.SetReadDeadline(time.Now().Add(utils.DoctorTimeout))
+	conn.SetReadLimit(utils.DoctorMaxMessage)
+
+	var total int64
+	for total < utils.DoctorMaxBytes {
+		kind, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if err := conn.WriteMessage(kind, msg); err != nil {
+			return
+		}
+		total += int64(len(msg))
+	}
+}
@@ -0,0 +1,263 @@
+package transport
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// expectTimeout is how long a connection to a port with expect may take to
+// send the first bytes of its protocol, without a first_byte_timeout.
+const expectTimeout = 10 * time.Second
+
+// expectHead is the most a connection is read for its protocol, more than
+// any signature takes.
+const expectHead = 64
+
+// verdicts of a signature on the first bytes of a connection
+const (
+	expectMore = iota // too few bytes to tell
+	expectMatch
+	expectMismatch
+)
+
+// httpStarts are the starts of HTTP/1 requests and the HTTP/2 preface.
+var httpStarts = []string{
+	"GET ", "HEAD ", "POST ", "PUT ", "DELETE ", "OPTIONS ", "PATCH ", "CONNECT ", "TRACE ",
+	"PRI * HTTP/2.0",
+}
+
+// expectSignatures tell by the first bytes of a connection whether it speaks
+// the protocol, all of them are ones where the client speaks first.
+var expectSignatures = map[string]func(head []byte) int{
+	config.ExpectSSH: func(head []byte) int {
+		return matchStart(head, "SSH-")
+	},
+	config.ExpectTLS: func(head []byte) int {
+		// a handshake record of TLS 1.0 to 1.3, SSL 3.0 being version 3.0
+		switch {
+		case len(head) < 3:
+			return matchStart(head, "\x16\x03")
+		case head[0] == 0x16 && head[1] == 0x03 && head[2] <= 0x04:
+			return expectMatch
+		default:
+			return expectMismatch
+		}
+	},
+	config.ExpectHTTP: func(head []byte) int {
+		return matchStart(head, httpStarts...)
+	},
+	config.ExpectRDP: func(head []byte) int {
+		// TPKT version 3, then a connection request of X.224 in its 6th byte
+		switch {
+		case len(head) < 6:
+			return matchStart(head, "\x03\x00")
+		case head[0] == 0x03 && head[1] == 0x00 && head[5]&0xf0 == 0xe0:
+			return expectMatch
+		default:
+			return expectMismatch
+		}
+	},
+}
+
+// anyBytes is the signature of ports with first_byte_timeout but no expect.
+func anyBytes(head []byte) int {
+	if len(head) == 0 {
+		return expectMore
+	}
+	return expectMatch
+}
+
+// matchStart tells whether head starts with one of starts.
+func matchStart(head []byte, starts ...string) int {
+	verdict := expectMismatch
+	for _, start := range starts {
+		switch {
+		case bytes.HasPrefix(head, []byte(start)):
+			return expectMatch
+		case bytes.HasPrefix([]byte(start), head):
+			verdict = expectMore
+		}
+	}
+	return verdict
+}
+
+// expectProtocol hands conn, a public connection admitted to be forwarded,
+// to push once it sent something within the first_byte_timeout of its port,
+// its first bytes match the expect of the port in port_options, and for sni
+// its TLS ClientHello asks for one of those names. Other connections are
+// dropped, so slow or silent peers and scanners of the port never take a
+// tunnel connection. It doesn't wait for the bytes, push is then called from
+// another goroutine.
+func expectProtocol(conn net.Conn, options map[string]config.PortOptions, firstByte time.Duration, logger *logrus.Logger, usage *web.Usage, push func(net.Conn)) {
+	port := strconv.Itoa(conn.LocalAddr().(*net.TCPAddr).Port)
+	opts := options[port]
+	timeout := firstByte
+	if opts.FirstByteTimeout > 0 {
+		timeout = time.Duration(opts.FirstByteTimeout) * time.Second
+	} else if opts.FirstByteTimeout < 0 {
+		timeout = 0
+	}
+	signature, ok := expectSignatures[opts.Expect]
+	switch {
+	case !ok && timeout == 0:
+		push(conn)
+		return
+	case !ok:
+		signature = anyBytes
+	case timeout == 0:
+		timeout = expectTimeout
+	}
+	go func() {
+		expected := &expectedConn{Conn: conn}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		err := expected.readHead(signature)
+		if err == nil && len(opts.SNI) > 0 {
+			var name string
+			name, err = expected.readServerName()
+			if err == nil && !sniAllowed(opts.SNI, name) {
+				err = fmt.Errorf("it asked for server name %q", name)
+			}
+		}
+		conn.SetReadDeadline(time.Time{})
+		if err != nil {
+			if opts.Expect == "" {
+				logger.Debugf("dropping connection from %s to port %s, it sent nothing: %v", conn.RemoteAddr().String(), port, err)
+				usage.IncCounter("backhaul_first_byte_dropped_total", "port", port)
+			} else {
+				logger.Debugf("dropping connection from %s to port %s, expecting %s: %v", conn.RemoteAddr().String(), port, opts.Expect, err)
+				usage.IncCounter("backhaul_expect_dropped_total", "port", port)
+			}
+			utils.ResetConn(conn) // releases it from AttackGuard
+			return
+		}
+		push(expected)
+	}()
+}
+
+// sniAllowed reports whether name is in names, where "*.example.com" stands
+// for any subdomain of example.com.
+func sniAllowed(names []string, name string) bool {
+	name = strings.TrimSuffix(strings.ToLower(name), ".")
+	for _, allowed := range names {
+		if name == allowed {
+			return true
+		}
+		if suffix, ok := strings.CutPrefix(allowed, "*"); ok && len(name) > len(suffix) && strings.HasSuffix(name, suffix) {
+			return true
+		}
+	}
+	return false
+}
+
+// errUnexpected is the error of a connection that started otherwise than its
+// port expects.
+type errUnexpected []byte
+
+func (e errUnexpected) Error() string {
+	return "it started with " + strconv.Quote(string(e))
+}
+
+// expectedConn is a public connection whose first bytes matched the expect of
+// its port, with them back in front.
+type expectedConn struct {
+	net.Conn
+	head []byte
+}
+
+// readHead reads until signature can tell.
+func (c *expectedConn) readHead(signature func(head []byte) int) error {
+	buf := make([]byte, 512)
+	read := 0
+	for {
+		n, err := c.Conn.Read(buf[read:])
+		read += n
+		c.head = buf[:read]
+		switch signature(c.head) {
+		case expectMatch:
+			return nil
+		case expectMismatch:
+			return errUnexpected(c.head[:min(read, 16)])
+		}
+		if err != nil {
+			return err
+		}
+		if read >= expectHead {
+			return errUnexpected(c.head[:16])
+		}
+	}
+}
+
+// readServerName reads the TLS ClientHello for the server name it asks for,
+// "" without one. crypto/tls parses it, and is stopped right after.
+func (c *expectedConn) readServerName() (string, error) {
+	hello := &helloConn{Conn: c.Conn, pending: c.head, taken: c.head}
+	var name string
+	read := false
+	err := tls.Server(hello, &tls.Config{
+		GetConfigForClient: func(info *tls.ClientHelloInfo) (*tls.Config, error) {
+			name, read = info.ServerName, true
+			return nil, errHelloRead
+		},
+	}).Handshake()
+	c.head = hello.taken
+	if !read {
+		return "", err
+	}
+	return name, nil
+}
+
+func (c *expectedConn) Read(p []byte) (int, error) {
+	if len(c.head) > 0 {
+		n := copy(p, c.head)
+		c.head = c.head[n:]
+		return n, nil
+	}
+	return c.Conn.Read(p)
+}
+
+// Reset closes the connection with a reset, passed on to the wrapped one.
+func (c *expectedConn) Reset() error {
+	utils.ResetConn(c.Conn)
+	return nil
+}
+
+// NetConn returns the wrapped connection, for half-closing it.
+func (c *expectedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+var errHelloRead = errors.New("ClientHello read")
+
+// helloConn lets crypto/tls read a ClientHello, keeping what it took to be
+// read again. Nothing is written, not even its alert.
+type helloConn struct {
+	net.Conn
+	pending []byte // read by expectedConn already
+	taken   []byte
+}
+
+func (c *helloConn) Read(p []byte) (int, error) {
+	if len(c.pending) > 0 {
+		n := copy(p, c.pending)
+		c.pending = c.pending[n:]
+		return n, nil
+	}
+	n, err := c.Conn.Read(p)
+	c.taken = append(c.taken, p[:n]...)
+	return n, err
+}
+
+func (c *helloConn) Write(p []byte) (int, error) {
+	return len(p), nil
+}
@@ -0,0 +1,22 @@
+package transport
+
+import (
+	"net"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// Forwarded queues a public connection to port that reached another server of
+// the cluster, or that the server accepted itself, as if this transport's own
+// listener had accepted it.
+func (s *TcpTransport) Forwarded(port int, conn net.Conn) error {
+	return s.held.forwarded(port, utils.TimeAccepted(portConn(conn, s.config.PortOptions), s.state().usageMonitor))
+}
+
+func (s *TcpMuxTransport) Forwarded(port int, conn net.Conn) error {
+	return s.held.forwarded(port, utils.TimeAccepted(portConn(conn, s.config.PortOptions), s.state().usageMonitor))
+}
+
+func (s *WsTransport) Forwarded(port int, conn net.Conn) error {
+	return s.held.forwarded(port, utils.TimeAccepted(portConn(conn, s.config.PortOptions), s.state().usageMonitor))
+}
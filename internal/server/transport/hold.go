@@ -0,0 +1,128 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// heldPorts keeps the public listeners and their queues across restarts when
+// hold_timeout is set, so connections that arrive while the tunnel reconnects
+// wait in the queue instead of being refused.
+type heldPorts struct {
+	timeout time.Duration // zero when holding is off
+	wait    bool          // wait_for_tunnel: unbind the public ports while the tunnel is down
+	mu      sync.Mutex
+	queues  map[string]*connQueue // by listen address
+	running map[int]*connQueue    // of the running listeners by port, for connections of cluster peers
+}
+
+func newHeldPorts(timeout time.Duration, wait bool) *heldPorts {
+	return &heldPorts{timeout: timeout, wait: wait, queues: make(map[string]*connQueue), running: make(map[int]*connQueue)}
+}
+
+// lifetime returns the context a public listener lives in: the current
+// tunnel's, or the whole server's when holding.
+func (h *heldPorts) lifetime(ctx, parent context.Context) context.Context {
+	if h.timeout > 0 {
+		return parent
+	}
+	return ctx
+}
+
+// release unbinds the socket of a public listener whose tunnel went away, with
+// wait_for_tunnel, so connections get refused until the tunnel is back instead
+// of piling up in the accept backlog. Held listeners and those of a server
+// shutting down are left alone.
+func (h *heldPorts) release(addr string, parent context.Context, logger *logrus.Logger) {
+	if !h.wait || h.timeout > 0 || parent.Err() != nil {
+		return
+	}
+	if !utils.Unlisten(addr) {
+		logger.Debugf("%s was bound ahead of time, it keeps accepting while the tunnel is down", addr)
+		return
+	}
+	logger.Debugf("closed %s until the tunnel is back", addr)
+}
+
+// queue returns the queue of a listener that kept running through a restart,
+// nil if there is none.
+func (h *heldPorts) queue(addr string) *connQueue {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.queues[addr]
+}
+
+// keep remembers the queue of a listener that keeps running through restarts.
+func (h *heldPorts) keep(addr string, queue *connQueue) {
+	if h.timeout <= 0 {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.queues[addr] = queue
+}
+
+// open registers the queue of a running listener, so connections forwarded
+// to its port by cluster peers join it.
+func (h *heldPorts) open(port int, queue *connQueue) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.running[port] = queue
+}
+
+// closed forgets the queue of a listener that stopped.
+func (h *heldPorts) closed(port int, queue *connQueue) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.running[port] == queue {
+		delete(h.running, port)
+	}
+}
+
+// forwarded queues a connection to port that was accepted elsewhere, by a
+// cluster peer or the server itself.
+func (h *heldPorts) forwarded(port int, conn net.Conn) error {
+	h.mu.Lock()
+	queue := h.running[port]
+	h.mu.Unlock()
+	if queue == nil {
+		return fmt.Errorf("no listener on port %d", port)
+	}
+	queue.push(conn)
+	return nil
+}
+
+// requeue puts back a connection the tunnel could not take, so the handler
+// started after the restart forwards it. Without holding, or when the queue is
+// full, the connection is closed.
+func (h *heldPorts) requeue(ch chan net.Conn, conn net.Conn) {
+	if h.timeout > 0 {
+		select {
+		case ch <- conn:
+			return
+		default:
+		}
+	}
+	conn.Close()
+}
+
+// expired closes a queued connection that waited longer than hold_timeout.
+func (h *heldPorts) expired(conn net.Conn, logger *logrus.Logger) bool {
+	if h.timeout <= 0 {
+		return false
+	}
+	accepted, ok := utils.AcceptedAt(conn)
+	if !ok || time.Since(accepted) <= h.timeout {
+		return false
+	}
+	logger.Debugf("connection from %s waited more than %s for the tunnel, closing it", conn.RemoteAddr().String(), h.timeout)
+	conn.Close()
+	return true
+}
@@ -0,0 +1,118 @@
+package transport
+
+import (
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/gorilla/websocket"
+)
+
+// how long a client has to answer a command
+const commandTimeout = 30 * time.Second
+
+var (
+	ErrClientNotConnected = errors.New("client is not connected")
+	ErrNotManaged         = errors.New("client doesn't take commands, it needs remote_management")
+	ErrCommandTimeout     = errors.New("client didn't answer the command in time")
+)
+
+// commands numbers the commands sent to clients and hands their results to
+// the callers waiting for them.
+type commands struct {
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]chan control.ClientResult
+}
+
+// run sends command numbered with send and waits for the result.
+func (c *commands) run(command control.ClientCommand, send func(command control.ClientCommand) error) (control.ClientResult, error) {
+	done := make(chan control.ClientResult, 1)
+	c.mu.Lock()
+	if c.pending == nil {
+		c.pending = make(map[uint64]chan control.ClientResult)
+	}
+	c.next++
+	command.ID = c.next
+	c.pending[command.ID] = done
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		delete(c.pending, command.ID)
+		c.mu.Unlock()
+	}()
+
+	if err := send(command); err != nil {
+		return control.ClientResult{}, err
+	}
+	select {
+	case result := <-done:
+		return result, nil
+	case <-time.After(commandTimeout):
+		return control.ClientResult{}, ErrCommandTimeout
+	}
+}
+
+// done hands result to the caller waiting for it, if any.
+func (c *commands) done(result control.ClientResult) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if done, ok := c.pending[result.ID]; ok {
+		done <- result
+	}
+}
+
+// Command sends command to client on the control channel and waits for the
+// result.
+func (s *TcpTransport) Command(client string, command control.ClientCommand) (control.ClientResult, error) {
+	conn := s.control()
+	if id, _ := s.clientID.Load().(string); conn == nil || id != client {
+		return control.ClientResult{}, ErrClientNotConnected
+	}
+	if !s.managed.Load() {
+		return control.ClientResult{}, ErrNotManaged
+	}
+	return s.commands.run(command, func(command control.ClientCommand) error {
+		return utils.SendBinaryString(conn, utils.CommandMessage(command))
+	})
+}
+
+// Command sends command to client on the control channel and waits for the
+// result.
+func (s *WsTransport) Command(client string, command control.ClientCommand) (control.ClientResult, error) {
+	conn := s.controlChannel.Load()
+	if id, _ := s.clientID.Load().(string); conn == nil || id != client {
+		return control.ClientResult{}, ErrClientNotConnected
+	}
+	if !s.managed.Load() {
+		return control.ClientResult{}, ErrNotManaged
+	}
+	return s.commands.run(command, func(command control.ClientCommand) error {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		return conn.WriteMessage(websocket.TextMessage, []byte(utils.CommandMessage(command)))
+	})
+}
+
+// Command sends command to client over the control stream of one of its
+// mux sessions and waits for the result.
+func (s *TcpMuxTransport) Command(client string, command control.ClientCommand) (control.ClientResult, error) {
+	err := ErrClientNotConnected
+	for _, session := range s.state().smuxSession {
+		if session == nil || session.IsClosed() || s.clientIDOf(session) != client {
+			continue
+		}
+		state := s.control(session)
+		if state == nil || !state.managed.Load() {
+			err = ErrNotManaged
+			continue
+		}
+		return s.commands.run(command, func(command control.ClientCommand) error {
+			return state.stream.WriteJSON(utils.ControlCommand, command)
+		})
+	}
+	return control.ClientResult{}, err
+}
@@ -0,0 +1,154 @@
+package transport
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/sirupsen/logrus"
+)
+
+// NewMasquerade returns the handler of the requests on the tunnel port of a
+// ws server that don't come from a client, so the port looks like a web
+// server to scanners and browsers. target is an http or https URL the
+// requests are proxied to, or a file served as the only page, or a
+// directory served as a site. It returns nil for an empty target.
+func NewMasquerade(target string, logger *logrus.Logger) (http.Handler, error) {
+	if target == "" {
+		return nil, nil
+	}
+
+	if strings.HasPrefix(target, "http://") || strings.HasPrefix(target, "https://") {
+		site, err := url.Parse(target)
+		if err != nil || site.Host == "" {
+			return nil, fmt.Errorf("invalid masquerade URL %q", target)
+		}
+		return &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(site) // with the host of the site, as a virtual host expects
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logger.Debugf("masquerade failed to reach %s: %v", site.Host, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		}, nil
+	}
+
+	info, err := os.Stat(target)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return http.FileServer(http.Dir(target)), nil
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" && r.URL.Path != "/index.html" {
+			http.NotFound(w, r)
+			return
+		}
+		page, err := os.Open(target)
+		if err != nil {
+			logger.Debugf("masquerade failed to open %s: %v", target, err)
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		defer page.Close()
+		info, err := page.Stat()
+		if err != nil {
+			http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			return
+		}
+		http.ServeContent(w, r, info.Name(), info.ModTime(), page)
+	}), nil
+}
+
+// how long the fallback may take to accept a connection
+const fallbackDialTimeout = 5 * time.Second
+
+// Fallback hands the requests a ws server refuses to a decoy web server, as
+// trojan does: the connection is piped to the decoy after the request, so
+// it answers that and everything after, and a prober can't tell the tunnel
+// port from the decoy.
+type Fallback struct {
+	addr   string
+	proxy  *httputil.ReverseProxy // for requests that can't be piped
+	logger *logrus.Logger
+}
+
+// NewFallback returns a fallback to the web server at addr, host:port,
+// which speaks plain HTTP. It returns nil for an empty addr.
+func NewFallback(addr string, logger *logrus.Logger) (*Fallback, error) {
+	if addr == "" {
+		return nil, nil
+	}
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		return nil, fmt.Errorf("invalid fallback %q: %w", addr, err)
+	}
+	decoy := &url.URL{Scheme: "http", Host: addr}
+	return &Fallback{
+		addr: addr,
+		proxy: &httputil.ReverseProxy{
+			Rewrite: func(r *httputil.ProxyRequest) {
+				r.SetURL(decoy)
+				r.Out.Host = r.In.Host // as the prober sent it
+			},
+			ErrorHandler: func(w http.ResponseWriter, r *http.Request, err error) {
+				logger.Debugf("fallback failed to reach %s: %v", addr, err)
+				w.WriteHeader(http.StatusBadGateway)
+			},
+		},
+		logger: logger,
+	}, nil
+}
+
+// ServeHTTP pipes the connection of r to the decoy. Requests with a body and
+// HTTP/2 requests, which can't be taken over, are proxied instead.
+func (f *Fallback) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok || r.ProtoMajor != 1 || r.ContentLength != 0 {
+		f.proxy.ServeHTTP(w, r)
+		return
+	}
+	upstream, err := net.DialTimeout("tcp", f.addr, fallbackDialTimeout)
+	if err != nil {
+		f.logger.Debugf("fallback failed to reach %s: %v", f.addr, err)
+		w.WriteHeader(http.StatusBadGateway)
+		return
+	}
+	defer upstream.Close()
+	conn, buffered, err := hijacker.Hijack()
+	if err != nil {
+		f.logger.Debugf("fallback failed to take over the connection of %s: %v", r.RemoteAddr, err)
+		return
+	}
+	defer conn.Close()
+
+	// Write adds a User-Agent of its own otherwise
+	if _, ok := r.Header["User-Agent"]; !ok {
+		r.Header["User-Agent"] = []string{""}
+	}
+	if err := r.Write(upstream); err != nil {
+		f.logger.Debugf("fallback failed to send the request of %s to %s: %v", r.RemoteAddr, f.addr, err)
+		return
+	}
+	go func() {
+		io.Copy(upstream, buffered) // with what was read ahead of the request
+		if tcp, ok := upstream.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+	}()
+	io.Copy(conn, upstream)
+}
+
+// fromClient reports whether r may come from a client: a WebSocket handshake
+// with a token. Anything else gets the masquerade or the fallback.
+func fromClient(r *http.Request) bool {
+	return websocket.IsWebSocketUpgrade(r) && strings.HasPrefix(r.Header.Get("Authorization"), "Bearer ")
+}
@@ -0,0 +1,161 @@
+package transport
+
+import (
+	"encoding/json"
+	"net"
+	"sort"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/xtaci/smux"
+)
+
+// controlState is what the control stream of a mux session measured and was
+// told by the client.
+type controlState struct {
+	stream  *utils.ControlStream
+	rtt     atomic.Int64 // of the last heartbeat, in nanoseconds
+	report  clientReport
+	managed atomic.Bool // the client takes commands
+}
+
+// serveControlStream runs the control stream the client opened on session
+// id: it sends the heartbeat interval, its version and the forwarded ports,
+// then pings the client every heartbeat. A client that can't work with this
+// server is told why and its session closed. A session whose client sent
+// nothing for utils.ControlMissed heartbeats, or whose control stream broke,
+// is closed, and the tunnel restarted for a mux_session slot, even if TCP
+// still takes it for alive.
+func (s *TcpMuxTransport) serveControlStream(id int, session *smux.Session, stream net.Conn) {
+	ctrl := utils.NewControlStream(session, stream)
+	defer ctrl.Close()
+	state := &controlState{stream: ctrl}
+	s.controls.Store(session, state)
+	defer s.controls.Delete(session)
+
+	if err := ctrl.Write(utils.ControlHello, utils.Hello(s.config.Heartbeat)); err != nil {
+		s.logger.Debugf("failed to open the control stream of mux session %d: %v", id, err)
+		return
+	}
+	if err := ctrl.Write(utils.ControlVersion, []byte(utils.LocalVersion().Encode())); err != nil {
+		s.logger.Debugf("failed to send the version over the control stream of mux session %d: %v", id, err)
+		return
+	}
+	if err := ctrl.WriteJSON(utils.ControlPorts, s.controlPorts()); err != nil {
+		s.logger.Debugf("failed to send the ports over the control stream of mux session %d: %v", id, err)
+		return
+	}
+
+	heard := make(chan struct{}, 1)
+	ended := make(chan struct{})
+	go func() {
+		defer close(ended)
+		for {
+			typ, payload, err := ctrl.Read()
+			if err != nil {
+				return
+			}
+			select {
+			case heard <- struct{}{}:
+			default:
+			}
+			switch typ {
+			case utils.ControlVersion:
+				version, err := utils.ParseVersion(string(payload))
+				if err != nil {
+					continue
+				}
+				if err := state.report.accept(s.clientIDOf(session), session.RemoteAddr().String(), version, s.logger); err != nil {
+					ctrl.Write(utils.ControlUpgrade, []byte(err.Error()))
+					session.Close()
+					if id < s.config.MuxSession {
+						go s.Restart()
+					}
+					return
+				}
+			case utils.ControlPing:
+				ctrl.Write(utils.ControlPong, payload)
+			case utils.ControlPong:
+				if rtt, err := utils.PongRTT(payload); err == nil {
+					state.rtt.Store(int64(rtt))
+				}
+			case utils.ControlManaged:
+				state.managed.Store(true)
+			case utils.ControlResult:
+				var result control.ClientResult
+				if err := json.Unmarshal(payload, &result); err == nil {
+					s.commands.done(result)
+				}
+			case utils.ControlStats:
+				var stats control.ClientStats
+				if err := json.Unmarshal(payload, &stats); err == nil {
+					state.report.store(s.clientIDOf(session), stats)
+				}
+			}
+		}
+	}()
+
+	ticker := time.NewTicker(s.config.Heartbeat)
+	defer ticker.Stop()
+	last := time.Now()
+	for {
+		select {
+		case <-heard:
+			last = time.Now()
+		case <-ticker.C:
+			if silent := time.Since(last); silent > utils.ControlMissed*s.config.Heartbeat {
+				s.logger.Warnf("client of mux session %d sent no heartbeat for %v, closing the session", id, silent.Round(time.Second))
+				s.state().usageMonitor.IncCounter("backhaul_heartbeat_timeouts_total")
+				session.Close()
+				if id < s.config.MuxSession {
+					go s.Restart()
+				}
+				return
+			}
+			if err := ctrl.Ping(); err != nil {
+				return
+			}
+		case <-ended:
+			if session.IsClosed() || s.state().ctx.Err() != nil {
+				return
+			}
+			// smux keeps a session whose connection failed open, the client
+			// would be locked out until a public connection found out
+			s.logger.Warnf("control stream of mux session %d broke, closing the session", id)
+			session.Close()
+			if id < s.config.MuxSession {
+				go s.Restart()
+			}
+			return
+		case <-session.CloseChan():
+			return
+		}
+	}
+}
+
+// controlPorts returns the target ports the client is sent, with the names
+// of their forward tables.
+func (s *TcpMuxTransport) controlPorts() []utils.ControlPort {
+	mappings, _ := utils.ParsePorts(s.config.Ports, s.config.Forward) // reported by portConfigReader
+	names := make(map[int]string)
+	for _, mapping := range mappings {
+		if _, ok := names[mapping.RemotePort]; !ok || mapping.Name != "" {
+			names[mapping.RemotePort] = mapping.Name
+		}
+	}
+	ports := make([]utils.ControlPort, 0, len(names))
+	for target, name := range names {
+		ports = append(ports, utils.ControlPort{Target: target, Name: name})
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Target < ports[j].Target })
+	return ports
+}
+
+// control returns what the control stream of session knows, nil without one.
+func (s *TcpMuxTransport) control(session *smux.Session) *controlState {
+	state, _ := s.controls.Load(session)
+	control, _ := state.(*controlState)
+	return control
+}
@@ -0,0 +1,101 @@
+package transport
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// how often idle mux sessions are looked for
+const cullInterval = 30 * time.Second
+
+// states of a mux_session slot with idle_cull
+const (
+	slotLive     = iota
+	slotCulled   // retired for being idle
+	slotReviving // the client was asked to open it again
+)
+
+// cullSessions retires the mux sessions past the first that carried no
+// streams for idle_cull. A connection that would go over a retired session
+// takes another one meanwhile and has the client open it again, see revive.
+func (s *TcpMuxTransport) cullSessions() {
+	ticker := time.NewTicker(cullInterval)
+	defer ticker.Stop()
+
+	idle := make([]time.Duration, s.config.MuxSession)
+	for {
+		select {
+		case <-s.state().ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for id := 1; id < s.config.MuxSession; id++ {
+			session := s.state().smuxSession[id]
+			if session == nil || session.IsClosed() || utils.Streams(session) > 0 {
+				idle[id] = 0
+				continue
+			}
+			idle[id] += cullInterval
+			if idle[id] < s.config.IdleCull {
+				continue
+			}
+			idle[id] = 0
+
+			if err := utils.SendMuxRetire(session, s.timeout); err != nil {
+				s.logger.Infof("the client can't retire idle mux sessions, keeping them: %v", err)
+				return
+			}
+			s.state().culled[id].Store(slotCulled)
+			s.state().smuxSession[id] = nil
+			s.state().usageMonitor.IncCounter("backhaul_idle_culled_total", "kind", "mux_session")
+			s.logger.Infof("retired mux session %d, it carried no streams for %v", id, s.config.IdleCull)
+
+			// a stream may have been opened before the slot was cleared
+			go func() {
+				if left := utils.DrainSession(session, s.config.SessionDrain); left > 0 {
+					s.logger.Warnf("closing retired mux session with %d streams left", left)
+				}
+				session.Close()
+			}()
+		}
+	}
+}
+
+// revive asks the client to open the retired session id again, once.
+func (s *TcpMuxTransport) revive(id int) {
+	if id >= len(s.state().culled) || !s.state().culled[id].CompareAndSwap(slotCulled, slotReviving) {
+		return
+	}
+	s.logger.Infof("asking the client to open retired mux session %d again", id)
+	if err := s.requestSession(id); err != nil {
+		s.logger.Warnf("failed to ask the client for mux session %d: %v", id, err)
+		s.state().culled[id].Store(slotCulled)
+		return
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go s.acceptStreamConn(s.listener, id, &wg)
+}
+
+// isCulled reports whether session id was retired for being idle and not
+// opened again yet.
+func (s *TcpMuxTransport) isCulled(id int) bool {
+	return id < len(s.state().culled) && s.state().culled[id].Load() != slotLive
+}
+
+// liveSession picks one of the shared sessions that was not retired, the
+// first one never is.
+func (s *TcpMuxTransport) liveSession() int {
+	var live []int
+	for id := 0; id < s.config.MuxSession-len(s.dedicated); id++ {
+		if !s.isCulled(id) {
+			live = append(live, id)
+		}
+	}
+	return live[rand.Intn(len(live))]
+}
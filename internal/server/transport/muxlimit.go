@@ -0,0 +1,42 @@
+package transport
+
+import (
+	"fmt"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// streamLimitError is the error of a public connection refused because its
+// mux session, and every other one it could go over, carries mux_max_streams
+// streams already.
+type streamLimitError struct {
+	session int // the session picked first
+	streams int
+}
+
+func (e *streamLimitError) Error() string {
+	return fmt.Sprintf("mux session %d carries %d streams, and no session it could go over is below mux_max_streams", e.session, e.streams)
+}
+
+// roomySession returns the session a connection to localPort goes over if
+// session id carries mux_max_streams already: the shared or extra session
+// with the fewest streams below it. Ports with a dedicated session don't
+// take another one.
+func (s *TcpMuxTransport) roomySession(id, localPort int) (int, bool) {
+	if _, ok := s.dedicated[localPort]; ok {
+		return id, false
+	}
+	best, fewest := -1, s.config.MaxStreams
+	for other, session := range s.state().smuxSession {
+		if other >= s.config.MuxSession-len(s.dedicated) && other < s.config.MuxSession {
+			continue // dedicated
+		}
+		if session == nil || session.IsClosed() || s.isCulled(other) {
+			continue
+		}
+		if streams := utils.Streams(session); streams < fewest {
+			best, fewest = other, streams
+		}
+	}
+	return best, best >= 0
+}
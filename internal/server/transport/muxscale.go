@@ -0,0 +1,199 @@
+package transport
+
+import (
+	"math/rand"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/xtaci/smux"
+)
+
+const (
+	scaleInterval = 5 * time.Second  // how often the load is checked
+	scaleWait     = 10 * time.Second // how long the client may take to open a session
+	retireAfter   = 60 * time.Second // how long an extra session may stay idle
+)
+
+// countedConn counts the bytes passing through a tunnel connection.
+type countedConn struct {
+	net.Conn
+	n *atomic.Int64
+
+	readFailed chan struct{} // closed when the peer went away, smux only notices on keepalive
+	failOnce   sync.Once
+}
+
+func newCountedConn(conn net.Conn, n *atomic.Int64) *countedConn {
+	return &countedConn{Conn: conn, n: n, readFailed: make(chan struct{})}
+}
+
+func (c *countedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.n.Add(int64(n))
+	if err != nil {
+		c.failOnce.Do(func() { close(c.readFailed) })
+	}
+	return n, err
+}
+
+func (c *countedConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.n.Add(int64(n))
+	return n, err
+}
+
+// scaleSessions asks the client for extra sessions, up to mux_session_max,
+// while the sessions carry more streams or traffic than the thresholds, and
+// retires extra sessions that stay idle.
+func (s *TcpMuxTransport) scaleSessions(listener net.Listener) {
+	ticker := time.NewTicker(scaleInterval)
+	defer ticker.Stop()
+
+	last := make([]int64, len(s.state().smuxSession))
+	idle := make([]time.Duration, len(s.state().smuxSession))
+	pending := -1 // slot waiting for the client
+	var asked time.Time
+	var retiring []*smux.Session // no longer picked, closed once their streams end
+
+	for {
+		select {
+		case <-s.state().ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		for i := 0; i < len(retiring); i++ {
+			if utils.Streams(retiring[i]) == 0 {
+				retiring[i].Close()
+				retiring = append(retiring[:i], retiring[i+1:]...)
+				i--
+			}
+		}
+
+		// load of the shared sessions, dedicated ones serve a single port
+		var live, streams int
+		var bytes int64
+		for id, session := range s.state().smuxSession {
+			traffic := s.state().traffic[id].Load()
+			delta := traffic - last[id]
+			last[id] = traffic
+			if s.isDedicated(id) || session == nil || session.IsClosed() {
+				continue
+			}
+			live++
+			streams += utils.Streams(session)
+			bytes += delta
+		}
+		if live == 0 {
+			continue
+		}
+		avgStreams := float64(streams) / float64(live)
+		avgMbps := float64(bytes) * 8 / scaleInterval.Seconds() / 1e6 / float64(live)
+
+		if pending >= 0 {
+			if session := s.state().smuxSession[pending]; session != nil && !session.IsClosed() {
+				pending = -1
+			} else if time.Since(asked) > scaleWait {
+				s.logger.Warn("the client did not open an extra mux session, it may not support mux_session_max. Adaptive scaling is disabled")
+				return
+			}
+			continue
+		}
+
+		busy := avgStreams > float64(s.config.ScaleStreams) || avgMbps > float64(s.config.ScaleMbps)
+		if busy {
+			slot := s.freeSlot()
+			if slot < 0 {
+				continue
+			}
+			if err := s.requestSession(slot); err != nil {
+				s.logger.Warnf("failed to ask the client for mux session %d: %v", slot, err)
+				continue
+			}
+			s.logger.Infof("mux sessions are busy (%.0f streams, %.1f Mbit/s each), asking the client for session %d", avgStreams, avgMbps, slot)
+			pending, asked = slot, time.Now()
+
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go s.acceptStreamConn(listener, slot, &wg)
+			continue
+		}
+
+		// retire one extra session at a time, once the load would fit in the others
+		quiet := avgStreams < float64(s.config.ScaleStreams)/2 && avgMbps < float64(s.config.ScaleMbps)/2
+		for id := s.config.MuxSession; id < len(s.state().smuxSession); id++ {
+			session := s.state().smuxSession[id]
+			if session == nil || session.IsClosed() || utils.Streams(session) > 0 {
+				idle[id] = 0
+				continue
+			}
+			idle[id] += scaleInterval
+			if quiet && idle[id] >= retireAfter {
+				s.logger.Infof("retiring idle mux session %d", id)
+				s.state().smuxSession[id] = nil
+				retiring = append(retiring, session)
+				idle[id] = 0
+				break
+			}
+		}
+	}
+}
+
+// requestSession asks the client over the first session to open one more
+// session for slot.
+func (s *TcpMuxTransport) requestSession(slot int) error {
+	session := s.state().smuxSession[0]
+	if session == nil || session.IsClosed() {
+		return errTunnelUnavailable
+	}
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := utils.SendBinaryInt(stream, utils.MuxScalePort); err != nil {
+		return err
+	}
+	return utils.SendBinaryInt(stream, uint16(slot))
+}
+
+// freeSlot returns a slot for an extra session, -1 if mux_session_max is
+// reached.
+func (s *TcpMuxTransport) freeSlot() int {
+	for id := s.config.MuxSession; id < len(s.state().smuxSession); id++ {
+		if session := s.state().smuxSession[id]; session == nil || session.IsClosed() {
+			return id
+		}
+	}
+	return -1
+}
+
+func (s *TcpMuxTransport) isDedicated(id int) bool {
+	for _, dedicated := range s.dedicated {
+		if dedicated == id {
+			return true
+		}
+	}
+	return false
+}
+
+// randomSession picks one of the shared sessions or a live extra one.
+func (s *TcpMuxTransport) randomSession(shared int) int {
+	var extra []int
+	for id := s.config.MuxSession; id < len(s.state().smuxSession); id++ {
+		if session := s.state().smuxSession[id]; session != nil && !session.IsClosed() {
+			extra = append(extra, id)
+		}
+	}
+
+	n := rand.Intn(shared + len(extra))
+	if n < shared {
+		return n
+	}
+	return extra[n-shared]
+}
@@ -0,0 +1,121 @@
+package transport
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+var (
+	errTunnelUnavailable = errors.New("tunnel connection unavailable")
+	errInvalidToken      = errors.New("invalid token")
+)
+
+// transparentPort is the remote port of the listener on transparent_addr,
+// whose connections each go to the port they were headed to.
+const transparentPort = 0
+
+// redirectedConn is a connection redirected to transparent_addr, its local
+// address is the one it was headed to.
+type redirectedConn struct {
+	*net.TCPConn
+	dst *net.TCPAddr
+}
+
+func (c *redirectedConn) LocalAddr() net.Addr {
+	return c.dst
+}
+
+// publicConn wraps a connection accepted by the listener of remotePort, on
+// listenPort: by its port_options, or for transparent_addr by where it was
+// headed. It returns nil for a connection that can't be forwarded, such as one
+// headed to a port the client would take for a message.
+func publicConn(conn *net.TCPConn, remotePort, listenPort int, options map[string]config.PortOptions, logger *logrus.Logger) net.Conn {
+	if remotePort != transparentPort {
+		return portConn(conn, options)
+	}
+	dst, err := utils.OriginalDst(conn)
+	if err == nil && dst.Port == listenPort {
+		err = errors.New("it was not redirected")
+	} else if err == nil && dst.Port <= utils.MaxReservedPort {
+		err = fmt.Errorf("port %d is reserved for messages to the client", dst.Port)
+	}
+	if err != nil {
+		logger.Warnf("refusing connection from %s to transparent_addr: %v", conn.RemoteAddr().String(), err)
+		conn.Close()
+		return nil
+	}
+	return &redirectedConn{TCPConn: conn, dst: dst}
+}
+
+// transparentListener lets the listener of remotePort take connections from
+// TPROXY, if it is the one on transparent_addr.
+func transparentListener(listener net.Listener, remotePort int, logger *logrus.Logger) {
+	if remotePort != transparentPort {
+		return
+	}
+	if err := utils.SetTransparent(listener); err != nil {
+		logger.Warnf("transparent_addr only takes REDIRECT, not TPROXY: %v", err)
+	}
+}
+
+// portConn wraps an accepted public connection according to the options
+// configured for its local port in the port_options table.
+func portConn(conn net.Conn, options map[string]config.PortOptions) net.Conn {
+	opts, ok := options[strconv.Itoa(conn.LocalAddr().(*net.TCPAddr).Port)]
+	if !ok {
+		return conn
+	}
+
+	switch opts.Protocol {
+	case config.ProtoHTTP:
+		return utils.NewHTTPConn(conn, opts.HTTPHost, opts.ErrorPage)
+	default:
+		return conn
+	}
+}
+
+// portNames returns the names of the forward tables by public port.
+func portNames(forwards []config.Forward) map[int]string {
+	names := make(map[int]string)
+	for _, forward := range forwards {
+		mappings, _ := utils.ParseForward(forward) // reported by portConfigReader
+		for _, mapping := range mappings {
+			if mapping.Name != "" {
+				names[mapping.LocalPort] = mapping.Name
+			}
+		}
+	}
+	return names
+}
+
+// streamMeta describes the public connection conn for a client that asked
+// for stream metadata, and is nil for others.
+func streamMeta(wanted bool, conn net.Conn, names map[int]string) *utils.StreamMeta {
+	if !wanted {
+		return nil
+	}
+	return utils.NewStreamMeta(conn, names[conn.LocalAddr().(*net.TCPAddr).Port])
+}
+
+// streamTarget returns the target port of conn, a public connection for
+// remotePort, and its stream metadata. A connection redirected to
+// transparent_addr goes to the port it was headed to, and the metadata tell
+// the client the host. Clients that didn't ask for them dial the target of
+// that port instead. publicConn refused those headed to a reserved port.
+func streamTarget(remotePort int, wanted bool, conn net.Conn, names map[int]string) (uint16, *utils.StreamMeta) {
+	meta := streamMeta(wanted, conn, names)
+	if remotePort != transparentPort {
+		return uint16(remotePort), meta
+	}
+	dst := conn.LocalAddr().(*net.TCPAddr)
+	if meta != nil {
+		meta.To = dst.String()
+	}
+	return uint16(dst.Port), meta
+}
@@ -0,0 +1,79 @@
+package transport
+
+import (
+	"math"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+)
+
+// smoothing of the arrival rate per tick of the pool checker, higher follows
+// bursts faster
+const arrivalSmoothing = 0.2
+
+// pool decides how many idle tunnel connections the tcp server keeps by
+// pool_policy: connection_pool of them with "fixed", none with "on_demand",
+// where each public connection asks for its own, and with "adaptive" as many
+// as public connections arrived per second lately, between 1 and
+// connection_pool. The ws server keeps a fixed pool. With idle_cull, none are
+// kept once no public connection came for that long, until one does.
+type pool struct {
+	policy  string
+	size    int           // connection_pool
+	idle    time.Duration // idle_cull, 0 for never
+	waiting atomic.Int64  // public connections waiting for a tunnel connection
+	arrived atomic.Int64  // public connections accepted since the last tick
+	last    atomic.Int64  // when the last public connection came, in unix nanoseconds
+	rate    atomic.Uint64 // arrivals per second, smoothed, as float64 bits
+}
+
+func newPool(policy string, size int, idle time.Duration) *pool {
+	p := &pool{policy: policy, size: size, idle: idle}
+	p.last.Store(time.Now().UnixNano())
+	return p
+}
+
+// fixedPool returns the pool of a server without pool_policy.
+func fixedPool(size int, idle time.Duration) *pool {
+	return newPool(config.PoolFixed, size, idle)
+}
+
+// accepted counts a public connection and reports whether to ask the client
+// for a tunnel connection right away, idle being those ready.
+func (p *pool) accepted(idle int) bool {
+	p.arrived.Add(1)
+	p.last.Store(time.Now().UnixNano())
+	if p.policy == config.PoolOnDemand {
+		return true
+	}
+	return idle < p.target()
+}
+
+// tick updates the arrival rate, called by the pool checker every interval.
+func (p *pool) tick(interval time.Duration) {
+	perSecond := float64(p.arrived.Swap(0)) / interval.Seconds()
+	rate := math.Float64frombits(p.rate.Load())
+	p.rate.Store(math.Float64bits(rate + arrivalSmoothing*(perSecond-rate)))
+}
+
+// culled reports whether no public connection came for idle_cull.
+func (p *pool) culled() bool {
+	return p.idle > 0 && time.Since(time.Unix(0, p.last.Load())) > p.idle
+}
+
+// target returns how many tunnel connections to keep ready or coming.
+func (p *pool) target() int {
+	if p.culled() {
+		return int(p.waiting.Load())
+	}
+	switch p.policy {
+	case config.PoolOnDemand:
+		return int(p.waiting.Load())
+	case config.PoolAdaptive:
+		rate := math.Float64frombits(p.rate.Load())
+		return max(1, min(p.size, int(math.Ceil(rate))))
+	default:
+		return p.size
+	}
+}
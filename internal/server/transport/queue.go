@@ -0,0 +1,174 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+)
+
+// maximum number of spilled connections per listener for the grow policy, as a
+// multiple of the channel size
+const growFactor = 8
+
+// connQueue hands accepted public connections to the session handler and
+// applies the overflow policy when the accept channel is full.
+type connQueue struct {
+	ch      chan net.Conn
+	policy  string
+	timeout time.Duration
+	port    string
+	usage   *web.Usage
+	logger  *logrus.Logger
+
+	mu    sync.Mutex
+	spill []net.Conn // only used by the grow policy
+	wake  chan struct{}
+}
+
+func newConnQueue(ctx context.Context, size int, policy string, timeout time.Duration, port int, usage *web.Usage, logger *logrus.Logger) *connQueue {
+	q := &connQueue{
+		ch:      make(chan net.Conn, size),
+		policy:  policy,
+		timeout: timeout,
+		port:    strconv.Itoa(port),
+		usage:   usage,
+		logger:  logger,
+		wake:    make(chan struct{}, 1),
+	}
+
+	if policy == config.OverflowGrow {
+		go q.drainSpill(ctx)
+	}
+
+	return q
+}
+
+// push queues the connection, or applies the overflow policy if the channel is full.
+func (q *connQueue) push(conn net.Conn) {
+	if q.policy == config.OverflowGrow {
+		q.grow(conn)
+		return
+	}
+
+	select {
+	case q.ch <- conn:
+		q.logger.Debugf("accepted incoming TCP connection from %s", conn.RemoteAddr().String())
+		return
+	default:
+	}
+
+	switch q.policy {
+	case config.OverflowBlock:
+		select {
+		case q.ch <- conn:
+			q.logger.Debugf("accepted incoming TCP connection from %s", conn.RemoteAddr().String())
+			return
+		case <-time.After(q.timeout):
+			q.overflow()
+			q.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", q.port, conn.RemoteAddr().String())
+			conn.Close()
+		}
+
+	case config.OverflowDropOldest:
+		q.overflow()
+		select {
+		case oldest := <-q.ch:
+			q.logger.Warnf("channel with listener %s is full, discarding oldest TCP connection from %s", q.port, oldest.RemoteAddr().String())
+			oldest.Close()
+		default:
+		}
+		select {
+		case q.ch <- conn:
+		default:
+			conn.Close()
+		}
+
+	case config.OverflowReject:
+		q.overflow()
+		q.logger.Warnf("channel with listener %s is full, rejecting TCP connection from %s", q.port, conn.RemoteAddr().String())
+		utils.ResetConn(conn)
+
+	default: // drop
+		q.overflow()
+		q.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", q.port, conn.RemoteAddr().String())
+		conn.Close()
+	}
+}
+
+// grow keeps the connection in the spill buffer while the channel is full, up to
+// growFactor times the channel size.
+func (q *connQueue) grow(conn net.Conn) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if len(q.spill) == 0 {
+		select {
+		case q.ch <- conn:
+			return
+		default:
+		}
+	}
+
+	if len(q.spill) >= growFactor*cap(q.ch) {
+		q.overflow()
+		q.logger.Warnf("channel with listener %s reached its maximum size, discarding TCP connection from %s", q.port, conn.RemoteAddr().String())
+		conn.Close()
+		return
+	}
+
+	if len(q.spill) == 0 {
+		q.overflow()
+		q.logger.Debugf("channel with listener %s is full, growing it", q.port)
+	}
+	q.spill = append(q.spill, conn)
+
+	select {
+	case q.wake <- struct{}{}:
+	default:
+	}
+}
+
+// drainSpill moves spilled connections into the channel in arrival order.
+func (q *connQueue) drainSpill(ctx context.Context) {
+	for {
+		q.mu.Lock()
+		if len(q.spill) == 0 {
+			q.mu.Unlock()
+			select {
+			case <-q.wake:
+				continue
+			case <-ctx.Done():
+				return
+			}
+		}
+		conn := q.spill[0]
+		q.mu.Unlock()
+
+		select {
+		case q.ch <- conn:
+			q.mu.Lock()
+			q.spill = q.spill[1:]
+			q.mu.Unlock()
+		case <-ctx.Done():
+			q.mu.Lock()
+			for _, c := range q.spill {
+				c.Close()
+			}
+			q.spill = nil
+			q.mu.Unlock()
+			return
+		}
+	}
+}
+
+func (q *connQueue) overflow() {
+	q.usage.IncCounter("backhaul_overflow_total", "port", q.port, "policy", q.policy)
+}
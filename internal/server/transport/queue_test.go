@@ -0,0 +1,49 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// TestRejectResets checks that the reject policy resets a public connection
+// wrapped like the transports wrap them, rather than closing it with a FIN.
+func TestRejectResets(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+
+	client, err := net.Dial("tcp", listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer client.Close()
+	accepted, err := listener.Accept()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	logger := logrus.New()
+	logger.SetOutput(io.Discard)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// no room in the queue, the connection is rejected at once
+	queue := newConnQueue(ctx, 0, config.OverflowReject, time.Second, 443, nil, logger)
+	queue.push(utils.TimeAccepted(&sourceConn{Conn: accepted}, nil))
+
+	client.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := client.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+		t.Fatalf("the rejected connection read %v, not a reset", err)
+	}
+}
@@ -0,0 +1,149 @@
+package transport
+
+import (
+	"math/rand"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/xtaci/smux"
+)
+
+const (
+	scheduleInterval = 5 * time.Second // how often the sessions are measured
+	peakDecay        = 0.8             // share of the peak throughput of a session kept each interval
+)
+
+// sessionScores is what the scheduler measured of each mux session slot.
+type sessionScores struct {
+	mu   sync.Mutex
+	rtt  []time.Duration // of the last ping, zero if unknown
+	peak []float64       // highest recent throughput in Mbit/s, decaying
+	last []int64         // traffic at the last measurement
+}
+
+func newSessionScores(n int) *sessionScores {
+	return &sessionScores{
+		rtt:  make([]time.Duration, n),
+		peak: make([]float64, n),
+		last: make([]int64, n),
+	}
+}
+
+// schedules returns the local ports with a schedule set in port_options.
+func schedules(options map[string]config.PortOptions) map[int]string {
+	scheduled := make(map[int]string)
+	for key, opts := range options {
+		if port, err := strconv.Atoi(key); err == nil && opts.Schedule != "" {
+			scheduled[port] = opts.Schedule
+		}
+	}
+	return scheduled
+}
+
+// measureSessions pings every live session and samples its throughput each
+// scheduleInterval, until the tunnel restarts.
+func (s *TcpMuxTransport) measureSessions(scores *sessionScores) {
+	ticker := time.NewTicker(scheduleInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.state().ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		scores.mu.Lock()
+		for id, session := range s.state().smuxSession {
+			traffic := s.state().traffic[id].Load()
+			mbps := float64(traffic-scores.last[id]) * 8 / scheduleInterval.Seconds() / 1e6
+			scores.last[id] = traffic
+			scores.peak[id] = max(mbps, scores.peak[id]*peakDecay)
+			if session == nil || session.IsClosed() {
+				scores.rtt[id], scores.peak[id] = 0, 0
+				continue
+			}
+
+			go func() {
+				rtt, err := s.ping(session)
+				if err != nil {
+					s.logger.Debugf("failed to ping mux session %d: %v", id, err)
+				}
+				scores.mu.Lock()
+				scores.rtt[id] = rtt
+				scores.mu.Unlock()
+			}()
+		}
+		scores.mu.Unlock()
+	}
+}
+
+// ping measures the round trip of session through a speedtest stream, which
+// waits behind the traffic the session carries like any other stream.
+func (s *TcpMuxTransport) ping(session *smux.Session) (time.Duration, error) {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return 0, err
+	}
+	defer stream.Close()
+
+	if err := utils.SendBinaryInt(stream, utils.SpeedtestPort); err != nil {
+		return 0, err
+	}
+	stream.SetDeadline(time.Now().Add(scheduleInterval))
+	return utils.SpeedtestPing(stream, 0)
+}
+
+// scheduledSession picks the session for a port with a schedule among the
+// live shared and extra sessions: the one with the lowest round trip for
+// "latency", and for "bulk" one at random weighted by its peak throughput,
+// with at least a quarter of the best one so the others keep being measured.
+// It returns false while nothing is measured yet.
+func (s *TcpMuxTransport) scheduledSession(schedule string) (int, bool) {
+	var live []int
+	for id, session := range s.state().smuxSession {
+		if (id < s.config.MuxSession && s.isDedicated(id)) || session == nil || session.IsClosed() {
+			continue
+		}
+		live = append(live, id)
+	}
+
+	scores := s.state().scores
+	scores.mu.Lock()
+	defer scores.mu.Unlock()
+
+	best := -1
+	switch schedule {
+	case config.ScheduleLatency:
+		for _, id := range live {
+			if rtt := scores.rtt[id]; rtt > 0 && (best < 0 || rtt < scores.rtt[best]) {
+				best = id
+			}
+		}
+
+	case config.ScheduleBulk:
+		var top float64
+		for _, id := range live {
+			top = max(top, scores.peak[id])
+		}
+		if top == 0 {
+			break
+		}
+		var total float64
+		for _, id := range live {
+			total += max(scores.peak[id], top/4)
+		}
+		n := rand.Float64() * total
+		for _, id := range live {
+			best = id
+			if n -= max(scores.peak[id], top/4); n < 0 {
+				break
+			}
+		}
+	}
+	return best, best >= 0
+}
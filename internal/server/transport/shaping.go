@@ -0,0 +1,263 @@
+package transport
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// how often the bandwidth policies are checked against the clock
+const shapeInterval = 10 * time.Second
+
+// Shaper caps the bandwidth of public ports by the bandwidth policies of the
+// server, each in force during its time of day. The connections of the ports
+// of a policy share its rate, each way, and a port in several policies in
+// force gets the lowest rate. Connections open when a policy starts are
+// capped as well. A nil Shaper leaves connections as they are.
+type Shaper struct {
+	policies []*bandwidthPolicy
+	logger   *logrus.Logger
+	usage    *web.Usage // nil, the metrics are kept per process
+
+	mu    sync.Mutex
+	ports map[int]*shapedPort
+}
+
+// bandwidthPolicy is a parsed [[server.bandwidth]] table.
+type bandwidthPolicy struct {
+	name     string
+	ports    utils.PortRanges
+	listed   string // the ports as configured
+	mbps     int
+	from, to int // minutes since midnight, the same for all day
+	in, out  *byteBucket
+	active   bool // in force, guarded by Shaper.mu
+}
+
+// shapedPort holds the policy a public port is capped by.
+type shapedPort struct {
+	policy atomic.Pointer[bandwidthPolicy] // nil while none is in force
+}
+
+// NewShaper returns a shaper for the bandwidth tables of the server, nil for
+// none.
+func NewShaper(tables []config.Bandwidth, logger *logrus.Logger) (*Shaper, error) {
+	if len(tables) == 0 {
+		return nil, nil
+	}
+	s := &Shaper{logger: logger, ports: make(map[int]*shapedPort)}
+	for i, table := range tables {
+		name := table.Name
+		if name == "" {
+			name = strconv.Itoa(i + 1)
+		}
+		ports, err := utils.ParsePortRanges(table.Ports)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth %s: %w", name, err)
+		}
+		if len(ports) == 0 {
+			return nil, fmt.Errorf("bandwidth %s: no ports", name)
+		}
+		if table.Mbps <= 0 {
+			return nil, fmt.Errorf("bandwidth %s: mbps must be over 0", name)
+		}
+		from, err := parseClock(table.From, 0)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth %s: from: %w", name, err)
+		}
+		to, err := parseClock(table.To, 24*60)
+		if err != nil {
+			return nil, fmt.Errorf("bandwidth %s: to: %w", name, err)
+		}
+		rate := float64(table.Mbps) * 1e6 / 8
+		s.policies = append(s.policies, &bandwidthPolicy{
+			name:   name,
+			ports:  ports,
+			listed: fmt.Sprint(table.Ports),
+			mbps:   table.Mbps,
+			from:   from % (24 * 60),
+			to:     to % (24 * 60),
+			in:     newByteBucket(rate),
+			out:    newByteBucket(rate),
+		})
+	}
+	s.check(time.Now())
+	return s, nil
+}
+
+// parseClock parses a time of day as "15:04" into minutes since midnight,
+// "24:00" included. An empty value is def.
+func parseClock(value string, def int) (int, error) {
+	if value == "" {
+		return def, nil
+	}
+	hours, minutes, ok := strings.Cut(value, ":")
+	h, err1 := strconv.Atoi(hours)
+	m, err2 := strconv.Atoi(minutes)
+	if !ok || err1 != nil || err2 != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("invalid time of day %q, it must be like \"18:00\"", value)
+	}
+	return h*60 + m, nil
+}
+
+// inForce reports whether p is in force at minute, since midnight.
+func (p *bandwidthPolicy) inForce(minute int) bool {
+	switch {
+	case p.from == p.to:
+		return true
+	case p.from < p.to:
+		return minute >= p.from && minute < p.to
+	default: // past midnight
+		return minute >= p.from || minute < p.to
+	}
+}
+
+// Shape wraps conn, a public connection just accepted on port, so it is
+// capped while a policy of port is in force.
+func (s *Shaper) Shape(conn net.Conn, port int) net.Conn {
+	if s == nil {
+		return conn
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	shaped, ok := s.ports[port]
+	if !ok {
+		covered := false
+		for _, policy := range s.policies {
+			covered = covered || policy.ports.Contains(port)
+		}
+		if !covered {
+			return conn
+		}
+		shaped = &shapedPort{}
+		shaped.policy.Store(s.pick(port))
+		s.ports[port] = shaped
+	}
+	return &shapedConn{Conn: conn, port: shaped}
+}
+
+// Run checks the policies against the clock, starting and ending them.
+func (s *Shaper) Run(ctx context.Context) {
+	if s == nil {
+		return
+	}
+	ticker := time.NewTicker(shapeInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case now := <-ticker.C:
+			s.check(now)
+		}
+	}
+}
+
+// check starts and ends the policies by the time of day at now.
+func (s *Shaper) check(now time.Time) {
+	minute := now.Hour()*60 + now.Minute()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	changed := false
+	for _, policy := range s.policies {
+		active := policy.inForce(minute)
+		if active == policy.active {
+			continue
+		}
+		policy.active, changed = active, true
+		if active {
+			s.usage.AddGauge("backhaul_bandwidth_policy", 1, "policy", policy.name)
+			s.logger.Infof("bandwidth policy %s in force until %02d:%02d, ports %s capped to %d Mbit/s", policy.name, policy.to/60, policy.to%60, policy.listed, policy.mbps)
+		} else {
+			s.usage.AddGauge("backhaul_bandwidth_policy", -1, "policy", policy.name)
+			s.logger.Infof("bandwidth policy %s over until %02d:%02d", policy.name, policy.from/60, policy.from%60)
+		}
+	}
+	if !changed {
+		return
+	}
+	for port, shaped := range s.ports {
+		shaped.policy.Store(s.pick(port))
+	}
+}
+
+// pick returns the policy in force with the lowest rate for port, nil for
+// none. The caller holds s.mu.
+func (s *Shaper) pick(port int) *bandwidthPolicy {
+	var picked *bandwidthPolicy
+	for _, policy := range s.policies {
+		if policy.active && policy.ports.Contains(port) && (picked == nil || policy.mbps < picked.mbps) {
+			picked = policy
+		}
+	}
+	return picked
+}
+
+// shapedConn is a public connection held to the rate of the policy of its
+// port.
+type shapedConn struct {
+	net.Conn
+	port *shapedPort
+}
+
+func (c *shapedConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if policy := c.port.policy.Load(); policy != nil && n > 0 {
+		time.Sleep(policy.in.take(n))
+	}
+	return n, err
+}
+
+func (c *shapedConn) Write(p []byte) (int, error) {
+	if policy := c.port.policy.Load(); policy != nil && len(p) > 0 {
+		time.Sleep(policy.out.take(len(p)))
+	}
+	return c.Conn.Write(p)
+}
+
+// Reset closes the connection with a reset, passed on to the wrapped one.
+func (c *shapedConn) Reset() error {
+	utils.ResetConn(c.Conn)
+	return nil
+}
+
+// NetConn returns the wrapped connection, for half-closing it.
+func (c *shapedConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+// byteBucket holds the connections sharing it to a byte rate, letting a
+// second of it through at once.
+type byteBucket struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+func newByteBucket(rate float64) *byteBucket {
+	return &byteBucket{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// take takes n bytes and returns how long to wait before passing them on.
+func (b *byteBucket) take(n int) time.Duration {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	now := time.Now()
+	b.tokens = min(b.rate, b.tokens+now.Sub(b.last).Seconds()*b.rate) - float64(n)
+	b.last = now
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
@@ -0,0 +1,109 @@
+package transport
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// nackLimit is how many tunnel connections in a row the client must fail to
+// open before the public connections waiting for one are refused.
+const nackLimit = 3
+
+// signals numbers the channel signals sent to a client that acknowledges
+// them. The server then knows how many tunnel connections are still coming,
+// asks again for those not acknowledged in time, and refuses the public
+// connections at once while the client can't open any instead of letting
+// them wait.
+type signals struct {
+	acks   atomic.Bool // the client acknowledges signals
+	usage  *web.Usage
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	next    uint64
+	pending map[uint64]time.Time // sent and not acknowledged yet
+	nacks   int                  // failed in a row
+	failed  chan struct{}        // closed while nackLimit or more failed in a row
+}
+
+func newSignals(usage *web.Usage, logger *logrus.Logger) *signals {
+	return &signals{
+		usage:   usage,
+		logger:  logger,
+		pending: make(map[uint64]time.Time),
+		failed:  make(chan struct{}),
+	}
+}
+
+// message returns sig to send, numbered if the client acknowledges it.
+func (s *signals) message(sig string) string {
+	if !s.acks.Load() {
+		return sig
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.next++
+	s.pending[s.next] = time.Now()
+	return utils.SignalMessage(sig, s.next)
+}
+
+// outstanding returns how many tunnel connections asked for are still to
+// come. Those not acknowledged within timeout are given up on, so the pool
+// checker asks for them again.
+func (s *signals) outstanding(timeout time.Duration) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for seq, sent := range s.pending {
+		if time.Since(sent) > timeout {
+			delete(s.pending, seq)
+			s.usage.IncCounter("backhaul_signal_timeouts_total")
+			s.logger.Debugf("tunnel connection %d was not acknowledged within %v, asking again", seq, timeout)
+		}
+	}
+	return len(s.pending)
+}
+
+// ack records the answer of the client to signal seq, failure is empty if it
+// opened the tunnel connection.
+func (s *signals) ack(seq uint64, failure string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.pending[seq]; !ok {
+		return // given up on already
+	}
+	delete(s.pending, seq)
+
+	if failure == "" {
+		if s.nacks >= nackLimit {
+			s.logger.Info("client opens tunnel connections again")
+			s.failed = make(chan struct{})
+		}
+		s.nacks = 0
+		return
+	}
+
+	s.nacks++
+	s.usage.IncCounter("backhaul_signal_failures_total")
+	if s.nacks > nackLimit {
+		s.logger.Debugf("client failed to open tunnel connection %d: %s", seq, failure)
+		return
+	}
+	s.logger.Warnf("client failed to open tunnel connection %d: %s", seq, failure)
+	if s.nacks == nackLimit {
+		s.logger.Errorf("client failed to open %d tunnel connections in a row, refusing the public connections waiting for one", nackLimit)
+		close(s.failed)
+	}
+}
+
+// failures returns a channel that is closed while the client fails to open
+// tunnel connections.
+func (s *signals) failures() <-chan struct{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.failed
+}
@@ -0,0 +1,275 @@
+package transport
+
+import (
+	"context"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/geoip"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+)
+
+const (
+	sourceCounters = 10              // counters of a port for each source shown
+	sourceInterval = 5 * time.Second // how often the top sources are shown
+	unknownCountry = "unknown"       // of the addresses not in the GeoIP databases
+)
+
+// SourceTracker keeps the top source addresses of each public port by the
+// bytes they relay, both ways, since the start. Each port counts at most
+// sourceCounters times top addresses, however many connect: an address not
+// counted yet takes over the counter of the lightest one, from its count, so
+// it may be counted over by up to that much. The heaviest addresses are
+// counted right as long as the rest is spread out. With GeoIP databases the
+// addresses are shown with their country and autonomous system, and the
+// traffic of all the ports is also added up by country. A nil SourceTracker
+// tracks nothing.
+type SourceTracker struct {
+	top   int        // addresses shown by port, 0 for only the countries
+	geo   *geoip.DB  // nil without GeoIP
+	usage *web.Usage // nil, the metrics are kept per process
+
+	mu        sync.Mutex
+	ports     map[int]*sourceSketch
+	countries map[string]*countryCounter // by ISO code
+}
+
+// sourceSketch counts the heaviest source addresses of a port, by the
+// Space-Saving algorithm.
+type sourceSketch struct {
+	mu       sync.Mutex
+	capacity int
+	counters map[string]*sourceCounter
+}
+
+// sourceCounter is what an address is counted for, since it took the counter.
+type sourceCounter struct {
+	bytes    uint64
+	over     uint64 // bytes of the address it took the counter from
+	conns    int64
+	location *geoip.Location
+}
+
+// countryCounter is the traffic of a country over all the ports.
+type countryCounter struct {
+	code  string
+	name  string
+	bytes atomic.Int64
+	conns atomic.Int64
+}
+
+// NewSourceTracker returns a tracker of the top sources of each public port,
+// and of the countries with geo. It returns nil for top <= 0 without geo.
+func NewSourceTracker(top int, geo *geoip.DB) *SourceTracker {
+	if top <= 0 && geo == nil {
+		return nil
+	}
+	return &SourceTracker{
+		top:       max(top, 0),
+		geo:       geo,
+		ports:     make(map[int]*sourceSketch),
+		countries: make(map[string]*countryCounter),
+	}
+}
+
+// Track counts conn, a public connection just accepted on port, and the
+// bytes it relays towards its source address.
+func (t *SourceTracker) Track(conn net.Conn, port int) net.Conn {
+	if t == nil {
+		return conn
+	}
+	source := conn.RemoteAddr().String()
+	if host, _, err := net.SplitHostPort(source); err == nil {
+		source = host
+	}
+	tracked := &sourceConn{Conn: conn, source: source, usage: t.usage}
+
+	t.mu.Lock()
+	if t.top > 0 {
+		sketch, ok := t.ports[port]
+		if !ok {
+			sketch = &sourceSketch{capacity: t.top * sourceCounters, counters: make(map[string]*sourceCounter)}
+			t.ports[port] = sketch
+		}
+		tracked.sketch = sketch
+	}
+	if t.geo != nil {
+		location := t.geo.Lookup(net.ParseIP(source))
+		code := location.Country
+		if code == "" {
+			code = unknownCountry
+		}
+		country, ok := t.countries[code]
+		if !ok {
+			country = &countryCounter{code: code, name: location.Name}
+			t.countries[code] = country
+		}
+		tracked.location, tracked.country = &location, country
+	}
+	t.mu.Unlock()
+
+	tracked.count(0, 1)
+	return tracked
+}
+
+// Run shows the top sources of the ports on the dashboard and /api/sources.
+func (t *SourceTracker) Run(ctx context.Context) {
+	if t == nil {
+		return
+	}
+	t.record()
+	ticker := time.NewTicker(sourceInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			t.record()
+		}
+	}
+}
+
+// record shows the top sources, and the countries with GeoIP.
+func (t *SourceTracker) record() {
+	if t.top > 0 {
+		web.RecordSources(t.snapshot())
+	}
+	if t.geo != nil {
+		web.RecordCountries(t.byCountry())
+	}
+}
+
+// snapshot returns the top sources of each port, the heaviest first.
+func (t *SourceTracker) snapshot() []web.PortSources {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	ports := make([]web.PortSources, 0, len(t.ports))
+	for port, sketch := range t.ports {
+		ports = append(ports, web.PortSources{Port: port, Sources: sketch.top(t.top)})
+	}
+	sort.Slice(ports, func(i, j int) bool { return ports[i].Port < ports[j].Port })
+	return ports
+}
+
+// byCountry returns the traffic of each country, the heaviest first.
+func (t *SourceTracker) byCountry() []web.CountryUsage {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	countries := make([]web.CountryUsage, 0, len(t.countries))
+	for _, c := range t.countries {
+		countries = append(countries, web.CountryUsage{Country: c.code, Name: c.name, Bytes: uint64(c.bytes.Load()), Connections: c.conns.Load()})
+	}
+	sort.Slice(countries, func(i, j int) bool {
+		if countries[i].Bytes != countries[j].Bytes {
+			return countries[i].Bytes > countries[j].Bytes
+		}
+		return countries[i].Country < countries[j].Country
+	})
+	return countries
+}
+
+// add counts bytes and conns towards source, at location.
+func (s *sourceSketch) add(source string, location *geoip.Location, bytes uint64, conns int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	counter, ok := s.counters[source]
+	if !ok {
+		counter = &sourceCounter{location: location}
+		if len(s.counters) >= s.capacity {
+			lightest := ""
+			for other, c := range s.counters {
+				if lightest == "" || c.bytes < s.counters[lightest].bytes {
+					lightest = other
+				}
+			}
+			counter.bytes = s.counters[lightest].bytes
+			counter.over = counter.bytes
+			delete(s.counters, lightest)
+		}
+		s.counters[source] = counter
+	}
+	counter.bytes += bytes
+	counter.conns += conns
+}
+
+// top returns the n heaviest sources.
+func (s *sourceSketch) top(n int) []web.SourceUsage {
+	s.mu.Lock()
+	sources := make([]web.SourceUsage, 0, len(s.counters))
+	for source, c := range s.counters {
+		usage := web.SourceUsage{Address: source, Bytes: c.bytes, Over: c.over, Connections: c.conns}
+		if c.location != nil {
+			usage.Country, usage.ASN, usage.Org = c.location.Country, c.location.ASN, c.location.Org
+		}
+		sources = append(sources, usage)
+	}
+	s.mu.Unlock()
+	sort.Slice(sources, func(i, j int) bool {
+		if sources[i].Bytes != sources[j].Bytes {
+			return sources[i].Bytes > sources[j].Bytes
+		}
+		return sources[i].Address < sources[j].Address
+	})
+	return sources[:min(n, len(sources))]
+}
+
+// sourceConn is a public connection whose bytes count towards its source,
+// and its country.
+type sourceConn struct {
+	net.Conn
+	source   string
+	location *geoip.Location // nil without GeoIP
+	sketch   *sourceSketch   // nil without top sources
+	country  *countryCounter // nil without GeoIP
+	usage    *web.Usage
+}
+
+func (c *sourceConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	if n > 0 {
+		c.count(n, 0)
+	}
+	return n, err
+}
+
+func (c *sourceConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	if n > 0 {
+		c.count(n, 0)
+	}
+	return n, err
+}
+
+// count counts bytes and conns towards the source and the country.
+func (c *sourceConn) count(bytes int, conns int64) {
+	if c.sketch != nil {
+		c.sketch.add(c.source, c.location, uint64(bytes), conns)
+	}
+	if c.country == nil {
+		return
+	}
+	if bytes > 0 {
+		c.country.bytes.Add(int64(bytes))
+		c.usage.AddCounter("backhaul_country_bytes_total", int64(bytes), "country", c.country.code)
+	}
+	if conns > 0 {
+		c.country.conns.Add(conns)
+		c.usage.IncCounter("backhaul_country_connections_total", "country", c.country.code)
+	}
+}
+
+// Reset closes the connection with a reset, passed on to the wrapped one.
+func (c *sourceConn) Reset() error {
+	utils.ResetConn(c.Conn)
+	return nil
+}
+
+// NetConn returns the wrapped connection, for half-closing it.
+func (c *sourceConn) NetConn() net.Conn {
+	return c.Conn
+}
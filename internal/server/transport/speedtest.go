@@ -0,0 +1,68 @@
+package transport
+
+import (
+	"math/rand"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+// upper bound for a speedtest, slow links still finish small ones
+const speedtestTimeout = 2 * time.Minute
+
+// Speedtest measures the tunnel with a pooled connection the client answers
+// instead of dialing a target.
+func (s *TcpTransport) Speedtest(size int64) (utils.SpeedtestResult, error) {
+	select {
+	case conn := <-s.state().tunnelChannel:
+		defer conn.Close()
+		if err := utils.SendBinaryInt(conn, utils.SpeedtestPort); err != nil {
+			return utils.SpeedtestResult{}, err
+		}
+		conn.SetDeadline(time.Now().Add(speedtestTimeout))
+		return utils.RunSpeedtest(conn, size)
+
+	case <-time.After(s.timeout):
+		return utils.SpeedtestResult{}, errTunnelUnavailable
+	}
+}
+
+// Speedtest measures the tunnel with a pooled connection the client answers
+// instead of dialing a target.
+func (s *WsTransport) Speedtest(size int64) (utils.SpeedtestResult, error) {
+	select {
+	case tunnel := <-s.state().tunnelChannel:
+		defer tunnel.conn.Close()
+		close(tunnel.ping)
+		tunnel.mu.Lock()
+		if err := utils.SendWebSocketInt(tunnel.conn, utils.SpeedtestPort); err != nil {
+			return utils.SpeedtestResult{}, err
+		}
+		tunnel.conn.SetReadDeadline(time.Now().Add(speedtestTimeout))
+		tunnel.conn.SetWriteDeadline(time.Now().Add(speedtestTimeout))
+		return utils.RunSpeedtest(&utils.WSStream{Conn: tunnel.conn}, size)
+
+	case <-time.After(s.timeout):
+		return utils.SpeedtestResult{}, errTunnelUnavailable
+	}
+}
+
+// Speedtest measures the tunnel with a new stream on a random session.
+func (s *TcpMuxTransport) Speedtest(size int64) (utils.SpeedtestResult, error) {
+	session := s.state().smuxSession[rand.Intn(s.config.MuxSession)]
+	if session == nil || session.IsClosed() {
+		return utils.SpeedtestResult{}, errTunnelUnavailable
+	}
+
+	stream, err := session.OpenStream()
+	if err != nil {
+		return utils.SpeedtestResult{}, err
+	}
+	defer stream.Close()
+
+	if err := utils.SendBinaryInt(stream, utils.SpeedtestPort); err != nil {
+		return utils.SpeedtestResult{}, err
+	}
+	stream.SetDeadline(time.Now().Add(speedtestTimeout))
+	return utils.RunSpeedtest(stream, size)
+}
@@ -0,0 +1,67 @@
+package transport
+
+import (
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sahmadiut/backhaul/internal/web"
+
+	"github.com/sirupsen/logrus"
+)
+
+// clientReport keeps what a client reports of its end of the tunnel with
+// each heartbeat, and the version it sent in the handshake.
+type clientReport struct {
+	offered atomic.Bool // the client reports its stats if asked to
+	last    atomic.Pointer[control.ClientStats]
+	version atomic.Pointer[utils.PeerVersion] // nil from older clients
+}
+
+// reset forgets the client of the last control channel.
+func (r *clientReport) reset() {
+	r.offered.Store(false)
+	r.last.Store(nil)
+	r.version.Store(nil)
+}
+
+// accept checks the version the client with id sent from addr and keeps it,
+// logging the features the client lacks. It returns an ErrUpgradeRequired
+// error for a client this server can't work with.
+func (r *clientReport) accept(id, addr string, version utils.PeerVersion, logger *logrus.Logger) error {
+	if err := version.Check("client"); err != nil {
+		logger.Errorf("refused client %s from %s: %v", id, addr, err)
+		return err
+	}
+	r.version.Store(&version)
+	knownClients.Reported(id, version.Version)
+	if missing := version.Missing(); len(missing) > 0 {
+		logger.Infof("client %s runs %s without %s, upgrade it to use them", id, version, strings.Join(missing, ", "))
+	} else {
+		logger.Debugf("client %s runs %s", id, version)
+	}
+	return nil
+}
+
+// store keeps stats as the last report of the client with id, shows it on
+// the dashboard and notes the client as seen in the registry.
+func (r *clientReport) store(id string, stats control.ClientStats) {
+	stats.Updated = time.Now()
+	r.last.Store(&stats)
+	web.RecordClientStats(stats.String())
+	knownClients.Reported(id, stats.Version)
+}
+
+// session adds the last report to session.
+func (r *clientReport) session(session control.Session) control.Session {
+	if stats := r.last.Load(); stats != nil {
+		session.Stats = stats
+		session.Relays = stats.Relays
+	}
+	if version := r.version.Load(); version != nil {
+		session.Version = version.Version
+	}
+	return session
+}
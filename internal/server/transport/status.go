@@ -0,0 +1,93 @@
+package transport
+
+import (
+	"net"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/xtaci/smux"
+)
+
+// Tunnel is what the control API and the cluster see of a running transport.
+type Tunnel interface {
+	TunnelStatus() string
+	Sessions() []control.Session
+	Speedtest(size int64) (utils.SpeedtestResult, error)
+	Forwarded(port int, conn net.Conn) error
+	Command(client string, command control.ClientCommand) (control.ClientResult, error)
+}
+
+func (s *TcpTransport) TunnelStatus() string { return s.config.TunnelStatus.String() }
+
+// Sessions lists the control channel with the number of idle pooled
+// connections and the last report of the client.
+func (s *TcpTransport) Sessions() []control.Session {
+	conn := s.control()
+	if conn == nil {
+		return nil
+	}
+	id, _ := s.clientID.Load().(string)
+	return []control.Session{s.report.session(control.Session{
+		RemoteAddr: conn.RemoteAddr().String(),
+		Pool:       len(s.state().tunnelChannel),
+		Client:     id,
+	})}
+}
+
+func (s *WsTransport) TunnelStatus() string { return s.config.TunnelStatus.String() }
+
+// Sessions lists the control channel with the number of idle pooled
+// connections and the last report of the client.
+func (s *WsTransport) Sessions() []control.Session {
+	conn := s.controlChannel.Load()
+	if conn == nil {
+		return nil
+	}
+	id, _ := s.clientID.Load().(string)
+	return []control.Session{s.report.session(control.Session{
+		RemoteAddr: conn.RemoteAddr().String(),
+		Pool:       len(s.state().tunnelChannel),
+		Client:     id,
+	})}
+}
+
+func (s *TcpMuxTransport) TunnelStatus() string { return s.config.TunnelStatus.String() }
+
+// Sessions lists the open mux sessions with their stream counts, and their
+// measurements when ports have a schedule or the client a control stream,
+// and the last report of the client.
+func (s *TcpMuxTransport) Sessions() []control.Session {
+	var sessions []control.Session
+	scores := s.state().scores
+	scores.mu.Lock()
+	defer scores.mu.Unlock()
+	for id, session := range s.state().smuxSession {
+		if session == nil || session.IsClosed() {
+			continue
+		}
+		rtt := scores.rtt[id]
+		listed := control.Session{
+			ID:         id,
+			RemoteAddr: session.RemoteAddr().String(),
+			Streams:    utils.Streams(session),
+			Client:     s.clientIDOf(session),
+			Mbps:       scores.peak[id],
+		}
+		if state := s.control(session); state != nil {
+			if rtt == 0 {
+				rtt = time.Duration(state.rtt.Load())
+			}
+			listed = state.report.session(listed)
+		}
+		listed.RTT = float64(rtt.Microseconds()) / 1000
+		sessions = append(sessions, listed)
+	}
+	return sessions
+}
+
+func (s *TcpMuxTransport) clientIDOf(session *smux.Session) string {
+	id, _ := s.clientIDs.Load(session)
+	client, _ := id.(string)
+	return client
+}
@@ -0,0 +1,117 @@
+package transport
+
+import (
+	"context"
+	"errors"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// Default of the tarpit_time option.
+const defaultTarpitTime = 5 * time.Minute
+
+// how a held connection is read: a byte every tarpitInterval from a receive
+// buffer as small as the kernel allows, so the window of the sender stays
+// shut and its writes hang
+const (
+	tarpitInterval = 10 * time.Second
+	tarpitPerIP    = 4 // slots one address can take, so a single scanner can't fill them
+)
+
+// Tarpit holds the connections of banned addresses open without ever
+// answering, so scanners and brute forcers wait on them instead of moving on
+// at once. It holds at most tarpit_slots connections, the next ones are
+// closed as they would be without it. A nil Tarpit holds nothing.
+type Tarpit struct {
+	ctx    context.Context
+	slots  int
+	hold   time.Duration
+	logger *logrus.Logger
+
+	mu   sync.Mutex
+	held int
+	ips  map[string]int
+}
+
+// NewTarpit returns a tarpit of slots connections held for up to hold each,
+// or nil if slots is not positive. The held connections are closed with ctx.
+func NewTarpit(ctx context.Context, slots int, hold time.Duration, logger *logrus.Logger) *Tarpit {
+	if slots <= 0 {
+		return nil
+	}
+	if hold <= 0 {
+		hold = defaultTarpitTime
+	}
+	return &Tarpit{ctx: ctx, slots: slots, hold: hold, logger: logger, ips: make(map[string]int)}
+}
+
+// Hold takes conn into a free slot and returns true, or false without
+// touching it if the slots are full.
+func (t *Tarpit) Hold(conn net.Conn, usage *web.Usage) bool {
+	if t == nil {
+		return false
+	}
+	ip := addrIP(conn.RemoteAddr().String())
+	t.mu.Lock()
+	if t.held >= t.slots || t.ips[ip] >= tarpitPerIP {
+		t.mu.Unlock()
+		return false
+	}
+	t.held++
+	t.ips[ip]++
+	t.mu.Unlock()
+
+	usage.IncCounter("backhaul_tarpit_total")
+	usage.AddGauge("backhaul_tarpit_connections", 1)
+	go func() {
+		start := time.Now()
+		t.drip(conn)
+		conn.Close()
+		t.logger.Debugf("released tarpitted connection from %s after %v", conn.RemoteAddr().String(), time.Since(start).Round(time.Second))
+
+		usage.AddGauge("backhaul_tarpit_connections", -1)
+		t.mu.Lock()
+		defer t.mu.Unlock()
+		t.held--
+		if t.ips[ip] <= 1 {
+			delete(t.ips, ip)
+		} else {
+			t.ips[ip]--
+		}
+	}()
+	return true
+}
+
+// drip reads conn a byte at a time until it is closed by its peer, the hold
+// time is up or the tarpit is stopped.
+func (t *Tarpit) drip(conn net.Conn) {
+	if tcpConn, ok := conn.(*net.TCPConn); ok {
+		tcpConn.SetReadBuffer(1) // raised to the smallest size by the kernel
+	}
+	deadline := time.NewTimer(t.hold)
+	defer deadline.Stop()
+	ticker := time.NewTicker(tarpitInterval)
+	defer ticker.Stop()
+
+	var b [1]byte
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-deadline.C:
+			return
+		case <-ticker.C:
+		}
+		// a short deadline, only to take a byte that is already there or
+		// see that the peer is gone
+		conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+		if _, err := conn.Read(b[:]); err != nil && !errors.Is(err, os.ErrDeadlineExceeded) {
+			return
+		}
+	}
+}
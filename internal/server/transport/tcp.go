@@ -2,14 +2,21 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
-	"regexp"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sahmadiut/backhaul/internal/chaos"
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/synfilter"
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/tun"
 	"github.com/sahmadiut/backhaul/internal/utils"
 	"github.com/sahmadiut/backhaul/internal/web"
 
@@ -18,58 +25,125 @@ import (
 
 type TcpTransport struct {
 	config            *TcpConfig
-	ctx               context.Context
-	cancel            context.CancelFunc
+	parentctx         context.Context
+	current           atomic.Pointer[tcpState] // replaced by each Restart
 	logger            *logrus.Logger
-	tunnelChannel     chan net.Conn
-	getNewConnChan    chan struct{}
-	controlChannel    net.Conn
+	controlMu         sync.Mutex
+	controlChannel    net.Conn // nil until the client opens one, see control
 	restartMutex      sync.Mutex
 	timeout           time.Duration
 	heartbeatDuration time.Duration
 	heartbeatSig      string
 	chanSignal        string
-	usageMonitor      *web.Usage
+	held              *heldPorts     // public listeners kept through restarts, with hold_timeout
+	clientID          atomic.Value   // of the client on the control channel
+	pool              *pool          // how many tunnel connections to keep ready
+	meta              atomic.Bool    // the client wants stream metadata
+	report            clientReport   // of the client on the control channel
+	managed           atomic.Bool    // the client takes commands
+	commands          commands       // sent to the client, waiting for their results
+	names             map[int]string // of the forward tables by public port
 }
 
-type TcpConfig struct {
-	BindAddr       string
-	Nodelay        bool
-	KeepAlive      time.Duration
-	ConnectionPool int
-	Token          string
-	ChannelSize    int
-	Ports          []string
-	Sniffer        bool
-	WebPort        int
-	SnifferLog     string
-	Heartbeat      int // in seconds
-	TunnelStatus   string
+// tcpState is what a TcpTransport starts over with on Restart. It is replaced
+// whole, as the goroutines of the transport read it at any time.
+type tcpState struct {
+	ctx            context.Context
+	cancel         context.CancelFunc
+	tunnelChannel  chan net.Conn
+	getNewConnChan chan struct{}
+	usageMonitor   *web.Usage
+	signals        *signals // sent on the control channel
 }
 
-func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
-	// Create a derived context from the parent context
+func newTCPState(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *tcpState {
 	ctx, cancel := context.WithCancel(parentCtx)
+	usageMonitor := web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger)
+	return &tcpState{
+		ctx:            ctx,
+		cancel:         cancel,
+		tunnelChannel:  make(chan net.Conn, config.ChannelSize),
+		getNewConnChan: make(chan struct{}, config.ChannelSize),
+		usageMonitor:   usageMonitor,
+		signals:        newSignals(usageMonitor, logger),
+	}
+}
 
+type TcpConfig struct {
+	BindAddr         string
+	Nodelay          bool
+	AutoNodelay      bool
+	Chaos            *chaos.Chaos
+	KeepAlive        utils.Keepalive
+	ConnectionPool   int
+	PoolPolicy       string // how tunnel connections are supplied, see pool
+	Token            string
+	Auth             *utils.TokenChecker // checks the token of handshakes
+	AuthLimit        *AuthLimiter        // slows down and bans addresses failing the handshake
+	ChannelSize      int
+	Ports            []string
+	Forward          []config.Forward
+	PortsAddr        string // host the public ports listen on, empty for all addresses
+	TransparentAddr  string // takes connections redirected by iptables, empty for none
+	Sniffer          bool
+	WebPort          int
+	SnifferLog       string
+	Heartbeat        int // in seconds
+	TunnelStatus     web.Status
+	PortOptions      map[string]config.PortOptions
+	OverflowPolicy   string
+	OverflowTimeout  time.Duration
+	HoldTimeout      time.Duration     // how long public connections wait for the tunnel to come back
+	FirstByteTimeout time.Duration     // how long a public connection may take to send something, 0 for ever
+	IdleCull         time.Duration     // how long without public connections before the pool is emptied, 0 for ever
+	WaitForTunnel    bool              // refuse public connections while the tunnel is down
+	Tun              *tun.Link         // carries the packets of a TUN device, nil without tun_addr
+	DNS              *dnsfwd.Resolver  // resolves the DNS queries of the client, nil without dns_forward
+	Exit             *exitnode.Node    // dials the destinations of the client, nil without exit_node
+	Filter           *synfilter.Filter // drops floods of SYNs in the kernel, nil without kernel_filter
+	Attack           *AttackGuard      // refuses public connections while under attack
+	Anomaly          *AnomalyDetector  // flags and limits the ports whose traffic spikes, nil without anomaly
+	Shaper           *Shaper           // caps the bandwidth of public ports by time of day, nil without bandwidth policies
+	Sources          *SourceTracker    // keeps the top sources of public ports by traffic, nil without top_sources
+}
+
+func NewTCPServer(parentCtx context.Context, config *TcpConfig, logger *logrus.Logger) *TcpTransport {
 	// Initialize the TcpTransport struct
 	server := &TcpTransport{
 		config:            config,
-		ctx:               ctx,
-		cancel:            cancel,
+		parentctx:         parentCtx,
 		logger:            logger,
-		tunnelChannel:     make(chan net.Conn, config.ChannelSize),
-		getNewConnChan:    make(chan struct{}, config.ChannelSize),
-		controlChannel:    nil,                                           // will be set when a control connection is established
 		timeout:           3 * time.Second,                               // Default timeout
 		heartbeatDuration: time.Duration(config.Heartbeat) * time.Second, // Heartbeat duration
 		heartbeatSig:      "0",                                           // Default heartbeat signal
 		chanSignal:        "1",                                           // Default channel signal
-		usageMonitor:      web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		held:              newHeldPorts(config.HoldTimeout, config.WaitForTunnel),
 	}
+	server.current.Store(newTCPState(parentCtx, config, logger))
+	server.pool = newPool(config.PoolPolicy, config.ConnectionPool, config.IdleCull)
+	server.names = portNames(config.Forward)
 
 	return server
 }
 
+// state returns what the transport runs with since the last Restart.
+func (s *TcpTransport) state() *tcpState {
+	return s.current.Load()
+}
+
+// control returns the control channel, nil while there is none.
+func (s *TcpTransport) control() net.Conn {
+	s.controlMu.Lock()
+	defer s.controlMu.Unlock()
+	return s.controlChannel
+}
+
+func (s *TcpTransport) setControl(conn net.Conn) {
+	s.controlMu.Lock()
+	s.controlChannel = conn
+	s.controlMu.Unlock()
+}
+
 func (s *TcpTransport) Restart() {
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
@@ -78,22 +152,17 @@ func (s *TcpTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
-	if s.cancel != nil {
-		s.cancel()
-	}
+	s.state().cancel()
 
 	time.Sleep(2 * time.Second)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	s.ctx = ctx
-	s.cancel = cancel
-
 	// Re-initialize variables
-	s.tunnelChannel = make(chan net.Conn, s.config.ChannelSize)
-	s.getNewConnChan = make(chan struct{}, s.config.ChannelSize)
-	s.controlChannel = nil
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.current.Store(newTCPState(s.parentctx, s.config, s.logger))
+	s.setControl(nil)
+	s.meta.Store(false)
+	s.report.reset()
+	s.managed.Store(false)
+	s.config.TunnelStatus.Set("")
 
 	go s.TunnelListener()
 
@@ -101,60 +170,41 @@ func (s *TcpTransport) Restart() {
 
 func (s *TcpTransport) portConfigReader() {
 	// port mapping for listening on each local port
-	for _, portMapping := range s.config.Ports {
-		var re = regexp.MustCompile(`(?m)^(?:(?:\[(\d+):(\d+)\](?:=(\d+))?)|(?:(\d+)(?::(\d+))?(?:=(\d+))?))$`)
-		if !re.MatchString(portMapping) {
-			s.logger.Fatalf("invalid port mapping format: %s", portMapping)
-			continue
-		}
-		var groups = re.FindStringSubmatch(portMapping)
-		var validGroups []int
-		for i := 1; i < len(groups); i++ {
-			if groups[i] != "" {
-				var num, _ = strconv.Atoi(groups[i])
-				validGroups = append(validGroups, num)
-			}
-		}
-		var remotePort = -1
-		var startRange = validGroups[0]
-		var endRange = startRange
-		if strings.Contains(portMapping, "=") {
-			remotePort = validGroups[len(validGroups)-1]
-			if len(validGroups) == 3 {
-				endRange = validGroups[1]
-			}
-		} else {
-			if len(validGroups) == 2 {
-				endRange = validGroups[1]
-			}
-		}
-		if startRange > endRange {
-			s.logger.Fatalf("Invalid range: %d %d", startRange, endRange)
-		} else {
-			for i := startRange; i <= endRange; i++ {
-				var localAddr = ":" + strconv.Itoa(i)
-				if remotePort == -1 {
-					go s.localListener(localAddr, i)
-				} else {
-					go s.localListener(localAddr, remotePort)
-				}
-			}
-		}
+	mappings, err := utils.ParsePorts(s.config.Ports, s.config.Forward)
+	if err != nil {
+		s.logger.Fatalf("%v", err)
+		return
+	}
+	for _, mapping := range mappings {
+		go s.localListener(mapping.Addr(s.config.PortsAddr), mapping.RemotePort)
+	}
+	if s.config.TransparentAddr != "" {
+		go s.localListener(s.config.TransparentAddr, transparentPort)
+	}
+	if s.config.Tun != nil {
+		go s.handleTCPSession(tun.Port, s.linkQueue(s.config.Tun.Conns()))
+	}
+	if s.config.DNS != nil {
+		go s.handleTCPSession(dnsfwd.Port, s.linkQueue(s.config.DNS.Conns()))
+	}
+	if s.config.Exit != nil {
+		go s.handleTCPSession(exitnode.Port, s.linkQueue(s.config.Exit.Conns()))
 	}
 }
 
 func (s *TcpTransport) TunnelListener() {
 	// for  webui
 	if s.config.WebPort > 0 {
-		go s.usageMonitor.Monitor()
+		go s.state().usageMonitor.Monitor()
 	}
-	s.config.TunnelStatus = "Disconnected (TCP)"
+	s.config.TunnelStatus.Set("Disconnected (TCP)")
 
-	listener, err := net.Listen("tcp", s.config.BindAddr)
+	listener, err := utils.Listen(s.config.BindAddr)
 	if err != nil {
 		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
 		return
 	}
+	s.config.Filter.Attach(listener, true)
 
 	// close the tun listener after context cancellation
 	defer listener.Close()
@@ -162,19 +212,22 @@ func (s *TcpTransport) TunnelListener() {
 	s.logger.Infof("server started successfully, listening on address: %s", listener.Addr().String())
 
 	// try to establish a new channel
-	if s.controlChannel == nil {
+	if s.control() == nil {
 		go s.channelListener()
 	}
 
 	go func() {
 		for {
 			select {
-			case <-s.ctx.Done():
+			case <-s.state().ctx.Done():
 				return
 			default:
 				s.logger.Debugf("waiting for accept incoming tunnel connection on %s", listener.Addr().String())
 				conn, err := listener.Accept()
 				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
 					s.logger.Debugf("failed to accept tunnel connection on %s: %v", listener.Addr().String(), err)
 					continue
 				}
@@ -187,10 +240,15 @@ func (s *TcpTransport) TunnelListener() {
 					continue
 				}
 
-				// new idea to drop all illegal packets
-				if s.controlChannel != nil && s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String() != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
-					s.logger.Warnf("suspicious packet from %v. expected address: %v. discarding packet...", tcpConn.RemoteAddr().(*net.TCPAddr).IP.String(), s.controlChannel.RemoteAddr().(*net.TCPAddr).IP.String())
-					tcpConn.Close()
+				if s.config.AuthLimit.Banned(conn.RemoteAddr().String()) {
+					s.logger.Debugf("refused tunnel connection from banned address %s", conn.RemoteAddr().String())
+					s.config.AuthLimit.Refuse(conn, s.state().usageMonitor)
+					continue
+				}
+
+				// new idea to drop all illegal packets, unless the client moved
+				if control := s.control(); control != nil && control.RemoteAddr().(*net.TCPAddr).IP.String() != tcpConn.RemoteAddr().(*net.TCPAddr).IP.String() {
+					go s.takeover(tcpConn, control)
 					continue
 				}
 
@@ -204,17 +262,13 @@ func (s *TcpTransport) TunnelListener() {
 				}
 
 				// Set keep-alive settings
-				if err := tcpConn.SetKeepAlive(true); err != nil {
-					s.logger.Warnf("failed to enable TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
-				} else {
-					s.logger.Tracef("TCP keep-alive enabled for %s", tcpConn.RemoteAddr().String())
-				}
-				if err := tcpConn.SetKeepAlivePeriod(s.config.KeepAlive); err != nil {
-					s.logger.Warnf("failed to set TCP keep-alive period for %s: %v", tcpConn.RemoteAddr().String(), err)
+				if err := s.config.KeepAlive.Apply(tcpConn); err != nil {
+					s.logger.Warnf("failed to set TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
 				}
 
+				conn = s.config.Chaos.Conn(conn)
 				select {
-				case s.tunnelChannel <- conn:
+				case s.state().tunnelChannel <- conn:
 					s.logger.Debugf("accepted incoming TCP tunnel connection from %s", tcpConn.RemoteAddr().String())
 
 				default: // Tunnel channel is full, discard the connection
@@ -225,36 +279,57 @@ func (s *TcpTransport) TunnelListener() {
 		}
 	}()
 
-	<-s.ctx.Done()
+	<-s.state().ctx.Done()
+
+	// let the client reconnect right away, e.g. to the process that took over on upgrade
+	if control := s.control(); control != nil {
+		control.Close()
+	}
 }
 
 func (s *TcpTransport) channelListener() {
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 
 		default:
 			s.logger.Info("control channel not found, attempting to establish a new session")
-			incomingConnection := <-s.tunnelChannel
+			incomingConnection := <-s.state().tunnelChannel
+			span := tracing.Start("auth", "peer", incomingConnection.RemoteAddr().String())
 			msg, err := utils.ReceiveBinaryString(incomingConnection)
 			if err != nil {
 				s.logger.Errorf("Failed to receive channel signal: %v", err)
+				span.End(err)
 				continue
 			}
 
-			if msg != s.config.Token {
-				s.logger.Warnf("invalid security token received: %s", msg)
+			nonce, err := s.config.Auth.Check(msg)
+			if err != nil {
+				s.logger.Warnf("handshake from %s rejected: %v", incomingConnection.RemoteAddr().String(), err)
+				span.End(errInvalidToken)
+				delay := s.config.AuthLimit.Failed(incomingConnection.RemoteAddr().String(), s.state().usageMonitor)
+				time.AfterFunc(delay, func() { incomingConnection.Close() })
 				continue
 			}
+			s.config.AuthLimit.Succeeded(incomingConnection.RemoteAddr().String())
 
-			err = utils.SendBinaryString(incomingConnection, s.config.Token)
+			// older clients expect the token back
+			reply := s.config.Token
+			if nonce != "" {
+				reply = utils.TokenReply(s.config.Token, nonce)
+			}
+			err = utils.SendBinaryString(incomingConnection, reply)
 			if err != nil {
 				s.logger.Errorf("Failed to send security token: %v", err)
+				span.End(err)
 				continue
 			}
+			span.End(nil)
 
-			s.controlChannel = incomingConnection
+			s.setControl(incomingConnection)
+			s.clientID.Store("")
+			go s.readControl(incomingConnection)
 
 			s.logger.Info("control channel successfully established.")
 
@@ -264,10 +339,95 @@ func (s *TcpTransport) channelListener() {
 			go s.poolChecker()
 			go s.portConfigReader()
 
-			s.config.TunnelStatus = "Connected (TCP)"
+			s.config.TunnelStatus.Set("Connected (TCP)")
+
+			return
+		}
+	}
+}
+
+// takeover reads the handshake of a client that connects from a new address
+// while its control channel is up, e.g. after its IP address changed, and
+// restarts the server to let it in. The old control channel may take many
+// minutes to time out otherwise. Anything else is dropped.
+func (s *TcpTransport) takeover(conn net.Conn, control net.Conn) {
+	defer utils.Recover(s.logger, s.state().usageMonitor, "takeover", conn)
+	defer conn.Close()
+	newIP := conn.RemoteAddr().(*net.TCPAddr).IP.String()
+	oldIP := control.RemoteAddr().(*net.TCPAddr).IP.String()
+
+	conn.SetReadDeadline(time.Now().Add(s.timeout))
+	msg, err := utils.ReceiveBinaryString(conn)
+	if err == nil {
+		_, err = s.config.Auth.Check(msg)
+	}
+	if err != nil {
+		s.logger.Warnf("suspicious packet from %v. expected address: %v. discarding packet...", newIP, oldIP)
+		return
+	}
+
+	s.logger.Warnf("client connected again from %s while its control channel from %s is up, restarting to let it in", newIP, oldIP)
+	go s.Restart()
+}
 
+// readControl reads what newer clients send on the control channel: their ID
+// and version after the token, whether they acknowledge channel signals,
+// report their stats and take commands, the acknowledgments, the stats and
+// the results of commands. A client sending its version gets the one of the
+// server back, or the reason it is refused.
+func (s *TcpTransport) readControl(conn net.Conn) {
+	defer utils.Recover(s.logger, s.state().usageMonitor, "control channel", conn)
+	for {
+		msg, err := utils.ReceiveBinaryString(conn)
+		if err != nil {
 			return
 		}
+		if id, ok := utils.ParseClientID(msg); ok {
+			s.clientID.Store(id)
+			clientConnected(id, conn.RemoteAddr().String(), s.state().usageMonitor, s.logger)
+			continue
+		}
+		if version, ok := utils.ParseVersionMessage(msg); ok {
+			id, _ := s.clientID.Load().(string)
+			if err := s.report.accept(id, conn.RemoteAddr().String(), version, s.logger); err != nil {
+				utils.SendBinaryString(conn, utils.UpgradeMessage(err))
+				conn.Close()
+				go s.Restart()
+				return
+			}
+			if err := utils.SendBinaryString(conn, utils.VersionMessage(utils.LocalVersion())); err != nil {
+				s.logger.Debugf("failed to send the version: %v", err)
+			}
+			continue
+		}
+		if msg == utils.AcksMessage {
+			s.state().signals.acks.Store(true)
+			continue
+		}
+		if msg == utils.MetaMessage {
+			s.meta.Store(true)
+			continue
+		}
+		if msg == utils.StatsMessage {
+			s.report.offered.Store(true)
+			continue
+		}
+		if msg == utils.CommandsMessage {
+			s.managed.Store(true)
+			continue
+		}
+		if stats, ok := utils.ParseClientStats(msg); ok {
+			id, _ := s.clientID.Load().(string)
+			s.report.store(id, stats)
+			continue
+		}
+		if result, ok := utils.ParseResult(msg); ok {
+			s.commands.done(result)
+			continue
+		}
+		if seq, failure, ok := utils.ParseAck(msg); ok {
+			s.state().signals.ack(seq, failure)
+		}
 	}
 }
 
@@ -277,15 +437,16 @@ func (s *TcpTransport) heartbeat() {
 
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 		case <-ticker.C:
-			if s.controlChannel == nil {
+			control := s.control()
+			if control == nil {
 				s.logger.Warn("control channel is nil, attempting to restart server...")
 				go s.Restart()
 				return
 			}
-			err := utils.SendBinaryString(s.controlChannel, s.heartbeatSig)
+			err := utils.SendBinaryString(control, s.config.Chaos.Heartbeat(utils.HeartbeatMessage(s.heartbeatSig, s.report.offered.Load())))
 			if err != nil {
 				s.logger.Error("failed to send heartbeat signal, attempting to restart server...")
 				go s.Restart()
@@ -297,24 +458,38 @@ func (s *TcpTransport) heartbeat() {
 }
 
 func (s *TcpTransport) poolChecker() {
-	ticker := time.NewTicker(time.Millisecond * 500)
+	interval := time.Millisecond * 500
+	ticker := time.NewTicker(interval)
 	defer ticker.Stop()
 
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 
 		case <-ticker.C:
-			currentPoolSize := len(s.tunnelChannel)
-			if currentPoolSize < s.config.ConnectionPool {
-				neededConnections := s.config.ConnectionPool - currentPoolSize
+			s.pool.tick(interval)
+			target := s.pool.target()
+			if idle := len(s.state().tunnelChannel); idle > target && s.pool.culled() {
+				s.logger.Infof("no public connections for %v, closing %d idle tunnel connections", s.config.IdleCull, idle-target)
+				s.state().usageMonitor.AddCounter("backhaul_idle_culled_total", int64(idle-target), "kind", "pool")
+				for i := 0; i < idle-target; i++ {
+					select {
+					case conn := <-s.state().tunnelChannel:
+						conn.Close()
+					default:
+					}
+				}
+			}
+			currentPoolSize := len(s.state().tunnelChannel) + s.state().signals.outstanding(s.timeout)
+			if currentPoolSize < target {
+				neededConnections := target - currentPoolSize
 				s.logger.Tracef("pool size is %d, adding %d new connections", currentPoolSize, neededConnections)
 
 			loop:
 				for i := 0; i < neededConnections; i++ {
 					select {
-					case s.getNewConnChan <- struct{}{}:
+					case s.state().getNewConnChan <- struct{}{}:
 					default:
 						s.logger.Trace("getNewConnChan is full, skipping new connection")
 						break loop
@@ -328,11 +503,11 @@ func (s *TcpTransport) poolChecker() {
 func (s *TcpTransport) getNewConnection() {
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 
-		case <-s.getNewConnChan:
-			err := utils.SendBinaryString(s.controlChannel, s.chanSignal)
+		case <-s.state().getNewConnChan:
+			err := utils.SendBinaryString(s.control(), s.state().signals.message(s.chanSignal))
 			if err != nil {
 				s.logger.Error("error sending channel signal, attempting to restart server...")
 				go s.Restart()
@@ -342,33 +517,78 @@ func (s *TcpTransport) getNewConnection() {
 	}
 }
 
+// linkQueue passes on the connections of conns, for the packets of the TUN
+// device, the DNS queries or the exit node, asking the client for a tunnel connection for
+// each like localListener does for public connections.
+func (s *TcpTransport) linkQueue(conns chan net.Conn) chan net.Conn {
+	queue := make(chan net.Conn)
+	go func() {
+		for {
+			select {
+			case conn := <-conns:
+				if s.pool.accepted(len(s.state().tunnelChannel)) {
+					select {
+					case s.state().getNewConnChan <- struct{}{}:
+					default:
+						s.logger.Warn("getNewConnChan is full, cannot request a new connection")
+					}
+				}
+				select {
+				case queue <- conn:
+				case <-s.state().ctx.Done():
+					conn.Close()
+					return
+				}
+			case <-s.state().ctx.Done():
+				return
+			}
+		}
+	}()
+	return queue
+}
+
 func (s *TcpTransport) localListener(localAddr string, remotePort int) {
 	s.logger.Debugf("starting listener on local port %s -> remote port %d", localAddr, remotePort)
-	listener, err := net.Listen("tcp", localAddr)
+	if queue := s.held.queue(localAddr); queue != nil {
+		// the listener kept accepting while the tunnel reconnected
+		s.handleTCPSession(remotePort, queue.ch)
+		return
+	}
+	listener, err := utils.Listen(localAddr)
 	if err != nil {
 		s.logger.Fatalf("failed to listen on %s: %v", localAddr, err)
 		return
 	}
+	transparentListener(listener, remotePort, s.logger)
+	s.config.Filter.Attach(listener, false)
 
 	//close local listener after context cancellation
 	defer listener.Close()
 
 	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
 
-	// make a channel and run the handler
-	acceptChan := make(chan net.Conn, s.config.ChannelSize)
-	go s.handleTCPSession(remotePort, acceptChan)
+	// make a queue and run the handler
+	lifetime := s.held.lifetime(s.state().ctx, s.parentctx)
+	queue := newConnQueue(lifetime, s.config.ChannelSize, s.config.OverflowPolicy, s.config.OverflowTimeout, listener.Addr().(*net.TCPAddr).Port, s.state().usageMonitor, s.logger)
+	s.held.keep(localAddr, queue)
+	port := listener.Addr().(*net.TCPAddr).Port
+	s.held.open(port, queue)
+	defer s.held.closed(port, queue)
+	go s.handleTCPSession(remotePort, queue.ch)
 
 	go func() {
 		for {
 			select {
-			case <-s.ctx.Done():
+			case <-lifetime.Done():
 				return
 
 			default:
 				s.logger.Debugf("waiting for accept incoming connection on %s", listener.Addr().String())
 				conn, err := listener.Accept()
 				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
 					s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
 					continue
 				}
@@ -380,6 +600,16 @@ func (s *TcpTransport) localListener(localAddr string, remotePort int) {
 					conn.Close()
 					continue
 				}
+				public := publicConn(tcpConn, remotePort, port, s.config.PortOptions, s.logger)
+				if public == nil {
+					continue
+				}
+				public = s.config.Anomaly.Watch(public, port)
+				if public == nil {
+					continue
+				}
+				public = s.config.Shaper.Shape(public, port)
+				public = s.config.Sources.Track(public, port)
 
 				// trying to enable tcpnodelay
 				if s.config.Nodelay {
@@ -392,60 +622,94 @@ func (s *TcpTransport) localListener(localAddr string, remotePort int) {
 
 				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
 
-				if len(s.tunnelChannel) < s.config.ConnectionPool {
-					select {
-					case s.getNewConnChan <- struct{}{}:
-						// Successfully requested a new connection
-					default:
-						// The channel is full, do nothing
-						s.logger.Warn("getNewConnChan is full, cannot request a new connection")
-					}
-				}
-
-				select {
-				case acceptChan <- tcpConn:
-					s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
-
-				default: // channel is full, discard the connection
-					s.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", listener.Addr().String(), tcpConn.LocalAddr().String())
-					tcpConn.Close()
-				}
+				s.config.Attack.Admit(public, func(conn net.Conn) {
+					// a tunnel connection is asked for once it passed expect and first_byte_timeout
+					expectProtocol(conn, s.config.PortOptions, s.config.FirstByteTimeout, s.logger, s.state().usageMonitor, func(conn net.Conn) {
+						if s.pool.accepted(len(s.state().tunnelChannel)) {
+							select {
+							case s.state().getNewConnChan <- struct{}{}:
+								// Successfully requested a new connection
+							default:
+								// The channel is full, do nothing
+								s.logger.Warn("getNewConnChan is full, cannot request a new connection")
+							}
+						}
+						queue.push(utils.TimeAccepted(conn, s.state().usageMonitor))
+					})
+				})
 			}
 		}
 	}()
 
-	<-s.ctx.Done()
+	<-lifetime.Done()
+	s.held.release(localAddr, s.parentctx, s.logger)
 }
 
 func (s *TcpTransport) handleTCPSession(remotePort int, acceptChan chan net.Conn) {
 	for {
 		select {
 		case incomingConn := <-acceptChan:
+			if s.held.expired(incomingConn, s.logger) {
+				continue
+			}
+			span := tracing.Start("forward", "port", strconv.Itoa(remotePort), "peer", incomingConn.RemoteAddr().String())
+			open := span.Child("stream_open")
+			failed := s.state().signals.failures()
+			localPort := strconv.Itoa(incomingConn.LocalAddr().(*net.TCPAddr).Port)
+			if len(s.state().tunnelChannel) > 0 {
+				s.state().usageMonitor.IncCounter("backhaul_pool_hits_total", "port", localPort)
+			} else {
+				s.state().usageMonitor.IncCounter("backhaul_pool_misses_total", "port", localPort)
+			}
+			s.pool.waiting.Add(1)
 		innerloop:
 			for {
 				select {
-				case tunnelConnection := <-s.tunnelChannel:
+				case tunnelConnection := <-s.state().tunnelChannel:
 					// Send the target port over the connection
-					if err := utils.SendBinaryInt(tunnelConnection, uint16(remotePort)); err != nil {
+					port, meta := streamTarget(remotePort, s.meta.Load(), incomingConn, s.names)
+					if err := utils.SendStreamHeader(tunnelConnection, port, meta); err != nil {
 						s.logger.Warnf("%v", err) // failed to send port number
 						tunnelConnection.Close()
 						continue innerloop
 					}
+					open.End(nil)
+					utils.ObserveSetup(incomingConn)
 					// Handle data exchange between connections
-					go utils.ConnectionHandler(incomingConn, tunnelConnection, s.logger, s.usageMonitor, incomingConn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					go span.Relay(func() string {
+						return utils.ConnectionHandler(utils.AutoNodelay(incomingConn, s.config.AutoNodelay), utils.AutoNodelay(tunnelConnection, s.config.AutoNodelay), s.logger, s.state().usageMonitor, incomingConn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					})
 					break innerloop
 
 				case <-time.After(s.timeout):
 					s.logger.Warn("tunnel connection unavailable, attempting to restart server...")
-					incomingConn.Close()
+					s.held.requeue(acceptChan, incomingConn)
+					open.End(errTunnelUnavailable)
+					span.End(errTunnelUnavailable)
+					s.pool.waiting.Add(-1)
 					go s.Restart()
 					return
 
-				case <-s.ctx.Done():
+				case <-failed:
+					if len(s.state().tunnelChannel) > 0 {
+						failed = nil // one came after all
+						continue innerloop
+					}
+					s.logger.Warnf("refusing connection from %s, the client can't open tunnel connections", incomingConn.RemoteAddr().String())
+					utils.ResetConn(incomingConn)
+					open.End(errTunnelUnavailable)
+					span.End(errTunnelUnavailable)
+					break innerloop
+
+				case <-s.state().ctx.Done():
+					s.held.requeue(acceptChan, incomingConn)
+					span.End(s.state().ctx.Err())
+					s.pool.waiting.Add(-1)
 					return
 				}
 			}
-		case <-s.ctx.Done():
+			s.pool.waiting.Add(-1)
+		case <-s.state().ctx.Done():
 			return
 		}
 
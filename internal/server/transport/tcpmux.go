@@ -2,15 +2,26 @@ package transport
 
 import (
 	"context"
+	"crypto/ecdh"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"math/rand"
+	"hash/fnv"
 	"net"
-	"regexp"
+	"sort"
 	"strconv"
-	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sahmadiut/backhaul/internal/chaos"
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/noise"
+	"github.com/sahmadiut/backhaul/internal/synfilter"
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/tun"
 	"github.com/sahmadiut/backhaul/internal/utils"
 	"github.com/sahmadiut/backhaul/internal/web"
 
@@ -18,25 +29,42 @@ import (
 	"github.com/xtaci/smux"
 )
 
+// how long a client has for the noise handshake
+const noiseHandshakeTimeout = 10 * time.Second
+
 type TcpMuxTransport struct {
 	config       *TcpMuxConfig
-	ctx          context.Context
-	cancel       context.CancelFunc
+	parentctx    context.Context
+	current      atomic.Pointer[tcpMuxState] // replaced by each Restart
 	logger       *logrus.Logger
-	smuxSession  []*smux.Session
+	listener     net.Listener // of the tunnel, for sessions opened later
 	restartMutex sync.Mutex
 	timeout      time.Duration
-	usageMonitor *web.Usage
+	dedicated    map[int]int    // local port -> reserved session ID
+	schedules    map[int]string // local port -> schedule picking its session
+	held         *heldPorts     // public listeners kept through restarts, with hold_timeout
+	clientIDs    sync.Map       // *smux.Session -> ID of its client
+	meta         sync.Map       // *smux.Session whose client wants stream metadata -> true
+	controls     sync.Map       // *smux.Session -> *controlState of its control stream
+	commands     commands       // sent to clients, waiting for their results
+	names        map[int]string // of the forward tables by public port
 }
 
 type TcpMuxConfig struct {
 	BindAddr         string
 	Nodelay          bool
-	KeepAlive        time.Duration
+	AutoNodelay      bool
+	Chaos            *chaos.Chaos
+	KeepAlive        utils.Keepalive
 	Token            string
+	Auth             *utils.TokenChecker // checks the token of handshakes
+	AuthLimit        *AuthLimiter        // slows down and bans addresses failing the handshake
 	MuxSession       int
 	ChannelSize      int
 	Ports            []string
+	Forward          []config.Forward
+	PortsAddr        string // host the public ports listen on, empty for all addresses
+	TransparentAddr  string // takes connections redirected by iptables, empty for none
 	MuxVersion       int
 	MaxFrameSize     int
 	MaxReceiveBuffer int
@@ -44,27 +72,100 @@ type TcpMuxConfig struct {
 	Sniffer          bool
 	WebPort          int
 	SnifferLog       string
-	TunnelStatus     string
+	TunnelStatus     web.Status
+	PortOptions      map[string]config.PortOptions
+	StickyRouting    string
+	OverflowPolicy   string
+	OverflowTimeout  time.Duration
+	MuxSessionMax    int               // extra sessions are added up to this when the others are busy
+	ScaleStreams     int               // average streams per session that count as busy
+	ScaleMbps        int               // average Mbit/s per session that count as busy
+	Heartbeat        time.Duration     // ping interval of the control streams
+	MaxStreams       int               // streams a session carries at once, 0 for any
+	TLSConfig        *tls.Config       // wraps tunnel connections, nil for plain TCP
+	NoiseKey         *ecdh.PrivateKey  // secures tunnel connections with Noise_IK, nil for none
+	NoisePeers       map[string]bool   // public keys of the clients let in with NoiseKey
+	HoldTimeout      time.Duration     // how long public connections wait for the tunnel to come back
+	FirstByteTimeout time.Duration     // how long a public connection may take to send something, 0 for ever
+	IdleCull         time.Duration     // how long a mux session past the first may carry no streams, 0 for ever
+	WaitForTunnel    bool              // refuse public connections while the tunnel is down
+	Tun              *tun.Link         // carries the packets of a TUN device, nil without tun_addr
+	DNS              *dnsfwd.Resolver  // resolves the DNS queries of the client, nil without dns_forward
+	Exit             *exitnode.Node    // dials the destinations of the client, nil without exit_node
+	Filter           *synfilter.Filter // drops floods of SYNs in the kernel, nil without kernel_filter
+	Attack           *AttackGuard      // refuses public connections while under attack
+	Anomaly          *AnomalyDetector  // flags and limits the ports whose traffic spikes, nil without anomaly
+	Shaper           *Shaper           // caps the bandwidth of public ports by time of day, nil without bandwidth policies
+	Sources          *SourceTracker    // keeps the top sources of public ports by traffic, nil without top_sources
+	SessionDrain     time.Duration     // how long streams get to finish once their session goes away
 }
 
-func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *TcpMuxTransport {
-	// Create a derived context from the parent context
-	ctx, cancel := context.WithCancel(parentCtx)
+// tcpMuxState is what a TcpMuxTransport starts over with on Restart. It is
+// replaced whole, as the goroutines of the transport read it at any time.
+type tcpMuxState struct {
+	ctx          context.Context
+	cancel       context.CancelFunc
+	smuxSession  []*smux.Session // mux_session slots, then the extra ones up to mux_session_max
+	traffic      []atomic.Int64  // bytes through each session slot
+	culled       []atomic.Int32  // state of each mux_session slot with idle_cull, see cullSessions
+	scores       *sessionScores  // measurements of the sessions, for the schedules
+	usageMonitor *web.Usage
+}
 
-	// Initialize the TcpTransport struct
-	server := &TcpMuxTransport{
-		config:       config,
+func newTcpMuxState(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *tcpMuxState {
+	ctx, cancel := context.WithCancel(parentCtx)
+	return &tcpMuxState{
 		ctx:          ctx,
 		cancel:       cancel,
-		logger:       logger,
-		timeout:      2 * time.Second, // Default timeout
-		smuxSession:  make([]*smux.Session, config.MuxSession),
+		smuxSession:  make([]*smux.Session, max(config.MuxSession, config.MuxSessionMax)),
+		traffic:      make([]atomic.Int64, max(config.MuxSession, config.MuxSessionMax)),
+		culled:       make([]atomic.Int32, config.MuxSession),
+		scores:       newSessionScores(max(config.MuxSession, config.MuxSessionMax)),
 		usageMonitor: web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
 	}
+}
+
+func NewTcpMuxServer(parentCtx context.Context, config *TcpMuxConfig, logger *logrus.Logger) *TcpMuxTransport {
+	// Initialize the TcpTransport struct
+	server := &TcpMuxTransport{
+		config:    config,
+		parentctx: parentCtx,
+		logger:    logger,
+		timeout:   2 * time.Second, // Default timeout
+		held:      newHeldPorts(config.HoldTimeout, config.WaitForTunnel),
+		dedicated: dedicatedSessions(config.PortOptions, config.MuxSession),
+		schedules: schedules(config.PortOptions),
+		names:     portNames(config.Forward),
+	}
+	server.current.Store(newTcpMuxState(parentCtx, config, logger))
 
 	return server
 }
 
+// state returns what the transport runs with since the last Restart.
+func (s *TcpMuxTransport) state() *tcpMuxState {
+	return s.current.Load()
+}
+
+// dedicatedSessions reserves the last mux sessions for the ports with
+// dedicated_session set, in port order, so their traffic never waits behind
+// other ports.
+func dedicatedSessions(options map[string]config.PortOptions, muxSession int) map[int]int {
+	var ports []int
+	for key, opts := range options {
+		if port, err := strconv.Atoi(key); err == nil && opts.DedicatedSession {
+			ports = append(ports, port)
+		}
+	}
+	sort.Ints(ports)
+
+	dedicated := make(map[int]int, len(ports))
+	for i, port := range ports {
+		dedicated[port] = muxSession - 1 - i
+	}
+	return dedicated
+}
+
 func (s *TcpMuxTransport) Restart() {
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
@@ -73,20 +174,13 @@ func (s *TcpMuxTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
-	if s.cancel != nil {
-		s.cancel()
-	}
+	s.state().cancel()
 
 	time.Sleep(2 * time.Second)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	s.ctx = ctx
-	s.cancel = cancel
-
 	// Re-initialize variables
-	s.smuxSession = make([]*smux.Session, s.config.MuxSession)
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.current.Store(newTcpMuxState(s.parentctx, s.config, s.logger))
+	s.config.TunnelStatus.Set("")
 
 	go s.TunnelListener()
 
@@ -94,62 +188,44 @@ func (s *TcpMuxTransport) Restart() {
 
 func (s *TcpMuxTransport) portConfigReader() {
 	// port mapping for listening on each local port
-	for _, portMapping := range s.config.Ports {
-		var re = regexp.MustCompile(`(?m)^(?:(?:\[(\d+):(\d+)\](?:=(\d+))?)|(?:(\d+)(?::(\d+))?(?:=(\d+))?))$`)
-		if !re.MatchString(portMapping) {
-			s.logger.Fatalf("invalid port mapping: %s", portMapping)
-			continue
-		}
-		var groups = re.FindStringSubmatch(portMapping)
-		var validGroups []int
-		for i := 1; i < len(groups); i++ {
-			if groups[i] != "" {
-				var num, _ = strconv.Atoi(groups[i])
-				validGroups = append(validGroups, num)
-			}
-		}
-		var remotePort = -1
-		var startRange = validGroups[0]
-		var endRange = startRange
-		if strings.Contains(portMapping, "=") {
-			remotePort = validGroups[len(validGroups)-1]
-			if len(validGroups) == 3 {
-				endRange = validGroups[1]
-			}
-		} else {
-			if len(validGroups) == 2 {
-				endRange = validGroups[1]
-			}
-		}
-		if startRange > endRange {
-			s.logger.Fatalf("Invalid range: %d %d", startRange, endRange)
-		} else {
-			for i := startRange; i <= endRange; i++ {
-				var localAddr = ":" + strconv.Itoa(i)
-				if remotePort == -1 {
-					go s.localListener(localAddr, i)
-				} else {
-					go s.localListener(localAddr, remotePort)
-				}
-			}
-		}
+	mappings, err := utils.ParsePorts(s.config.Ports, s.config.Forward)
+	if err != nil {
+		s.logger.Fatalf("%v", err)
+		return
+	}
+	for _, mapping := range mappings {
+		go s.localListener(mapping.Addr(s.config.PortsAddr), mapping.RemotePort)
+	}
+	if s.config.TransparentAddr != "" {
+		go s.localListener(s.config.TransparentAddr, transparentPort)
+	}
+	if s.config.Tun != nil {
+		go s.handleMUXSession(s.config.Tun.Conns(), tun.Port)
+	}
+	if s.config.DNS != nil {
+		go s.handleMUXSession(s.config.DNS.Conns(), dnsfwd.Port)
+	}
+	if s.config.Exit != nil {
+		go s.handleMUXSession(s.config.Exit.Conns(), exitnode.Port)
 	}
 }
 
 func (s *TcpMuxTransport) TunnelListener() { // for  webui
 	if s.config.WebPort > 0 {
-		go s.usageMonitor.Monitor()
+		go s.state().usageMonitor.Monitor()
 	}
-	s.config.TunnelStatus = "Disconnected (TCPMux)"
+	s.config.TunnelStatus.Set("Disconnected (TCPMux)")
 
-	tunnelListener, err := net.Listen("tcp", s.config.BindAddr)
+	tunnelListener, err := utils.Listen(s.config.BindAddr)
 	if err != nil {
 		s.logger.Fatalf("failed to start listener on %s: %v", s.config.BindAddr, err)
 		return
 	}
+	s.config.Filter.Attach(tunnelListener, true)
 
 	// close the tun listener after context cancellation
 	defer tunnelListener.Close()
+	s.listener = tunnelListener
 
 	s.logger.Infof("server started successfully, listening on address: %s", tunnelListener.Addr().String())
 
@@ -160,22 +236,35 @@ func (s *TcpMuxTransport) TunnelListener() { // for  webui
 	}
 	wg.Wait()
 
-	s.config.TunnelStatus = "Connected (TCPMux)"
+	s.config.TunnelStatus.Set("Connected (TCPMux)")
 
 	go s.portConfigReader()
 
-	<-s.ctx.Done()
+	if s.config.MuxSessionMax > s.config.MuxSession {
+		go s.scaleSessions(tunnelListener)
+	}
+	if len(s.schedules) > 0 {
+		go s.measureSessions(s.state().scores)
+	}
+	if s.config.IdleCull > 0 && s.config.MuxSession > 1 {
+		go s.cullSessions()
+	}
+
+	<-s.state().ctx.Done()
 }
 
 func (s *TcpMuxTransport) acceptStreamConn(listener net.Listener, id int, wg *sync.WaitGroup) {
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 		default:
 			s.logger.Debugf("waiting for accept incoming tunnel connection on %s", listener.Addr().String())
 			conn, err := listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				s.logger.Debugf("failed to accept tunnel connection on %s: %v", listener.Addr().String(), err)
 				continue
 			}
@@ -188,6 +277,12 @@ func (s *TcpMuxTransport) acceptStreamConn(listener net.Listener, id int, wg *sy
 				continue
 			}
 
+			if s.config.AuthLimit.Banned(conn.RemoteAddr().String()) {
+				s.logger.Debugf("refused tunnel connection from banned address %s", conn.RemoteAddr().String())
+				s.config.AuthLimit.Refuse(conn, s.state().usageMonitor)
+				continue
+			}
+
 			// trying to enable tcpnodelay
 			if s.config.Nodelay {
 				if err := tcpConn.SetNoDelay(s.config.Nodelay); err != nil {
@@ -196,21 +291,45 @@ func (s *TcpMuxTransport) acceptStreamConn(listener net.Listener, id int, wg *sy
 					s.logger.Tracef("TCP_NODELAY enabled for %s", tcpConn.RemoteAddr().String())
 				}
 			}
+			if err := s.config.KeepAlive.Apply(tcpConn); err != nil {
+				s.logger.Warnf("failed to set TCP keep-alive for %s: %v", tcpConn.RemoteAddr().String(), err)
+			}
+
+			conn = s.config.Chaos.Conn(conn)
+			if s.config.TLSConfig != nil {
+				conn = tls.Server(conn, s.config.TLSConfig)
+			}
+			if s.config.NoiseKey != nil {
+				conn.SetDeadline(time.Now().Add(noiseHandshakeTimeout))
+				noiseConn, err := noise.Server(conn, s.config.NoiseKey, func(key string) bool { return s.config.NoisePeers[key] })
+				if err != nil {
+					s.logger.Warnf("noise handshake with %s failed: %v", conn.RemoteAddr().String(), err)
+					delay := s.config.AuthLimit.Failed(conn.RemoteAddr().String(), s.state().usageMonitor)
+					time.AfterFunc(delay, func() { conn.Close() })
+					continue
+				}
+				conn.SetDeadline(time.Time{})
+				s.logger.Debugf("noise peer %s connected from %s", noiseConn.PeerKey(), conn.RemoteAddr().String())
+				conn = noiseConn
+			}
+
+			span := tracing.Start("auth", "peer", conn.RemoteAddr().String(), "session", strconv.Itoa(id))
 
 			// config fot smux
 			config := smux.Config{
-				Version:           s.config.MuxVersion, // Smux protocol version
-				KeepAliveInterval: 10 * time.Second,    // Shorter keep-alive interval to quickly detect dead peers
-				KeepAliveTimeout:  30 * time.Second,    // Aggressive timeout to handle unresponsive connections
-				MaxFrameSize:      s.config.MaxFrameSize,
-				MaxReceiveBuffer:  s.config.MaxReceiveBuffer,
-				MaxStreamBuffer:   s.config.MaxStreamBuffer,
+				Version:          s.config.MuxVersion, // Smux protocol version
+				MaxFrameSize:     s.config.MaxFrameSize,
+				MaxReceiveBuffer: s.config.MaxReceiveBuffer,
+				MaxStreamBuffer:  s.config.MaxStreamBuffer,
 			}
+			s.config.KeepAlive.Mux(&config)
 			// smux server
-			session, err := smux.Client(conn, &config)
+			counted := newCountedConn(conn, &s.state().traffic[id])
+			session, err := smux.Client(counted, &config)
 			if err != nil {
 				s.logger.Errorf("failed to create SMUX session for connection %s: %v", conn.RemoteAddr().String(), err)
 				conn.Close()
+				span.End(err)
 				continue
 			}
 
@@ -219,6 +338,7 @@ func (s *TcpMuxTransport) acceptStreamConn(listener net.Listener, id int, wg *sy
 			if err != nil {
 				s.logger.Errorf("failed to accept mux stream for authentication from session %v: %v", session, err)
 				session.Close()
+				span.End(err)
 				continue
 
 			}
@@ -226,20 +346,36 @@ func (s *TcpMuxTransport) acceptStreamConn(listener net.Listener, id int, wg *sy
 			if err != nil {
 				s.logger.Errorf("failed to receive token from stream %v: %v", stream, err)
 				session.Close()
+				span.End(err)
 				continue
 			}
-			if token == s.config.Token {
-				err = utils.SendBinaryString(stream, "ok")
+			nonce, authErr := s.config.Auth.Check(token)
+			if authErr == nil {
+				reply := "ok"
+				if nonce != "" {
+					reply = utils.TokenReply(s.config.Token, nonce)
+				}
+				err = utils.SendBinaryString(stream, reply)
 				if err != nil {
 					s.logger.Errorf("failed to send acknowledgment for token to stream %v: %v", stream, err)
 					session.Close()
+					span.End(err)
 					continue
 				}
-				s.smuxSession[id] = session
+				span.End(nil)
+				s.config.AuthLimit.Succeeded(conn.RemoteAddr().String())
+				stream.Close() // so idle sessions count no streams
+				s.state().smuxSession[id] = session
+				if id < len(s.state().culled) {
+					s.state().culled[id].Store(slotLive)
+				}
 				s.logger.Infof("successfully established SMUX session with ID %d for connection %s", id, conn.RemoteAddr().String())
 
 				// Graceful shutdown
 				defer func() {
+					if session.IsClosed() {
+						return // retired or lost, handled elsewhere
+					}
 					if err := session.Close(); err != nil {
 						s.logger.Warnf("failed to close SMUX session with ID %d: %v", id, err)
 					} else {
@@ -247,55 +383,155 @@ func (s *TcpMuxTransport) acceptStreamConn(listener net.Listener, id int, wg *sy
 					}
 				}()
 
+				go s.acceptControlStreams(id, session)
+				defer s.clientIDs.Delete(session)
+				defer s.meta.Delete(session)
+
 				wg.Done()
-				<-s.ctx.Done()
+				var lost <-chan struct{}
+				if s.config.WaitForTunnel && id < s.config.MuxSession {
+					lost = counted.readFailed
+				}
+				select {
+				case <-s.state().ctx.Done():
+					s.goAway(id, session)
+				case <-session.CloseChan():
+				case <-lost:
+					// restart right away rather than on the next public connection,
+					// so the ports refuse connections until the client is back
+					s.logger.Warnf("MUX session with ID %d was lost, restarting", id)
+					session.Close()
+					go s.Restart()
+				}
 				return
 
 			} else {
-				err = utils.SendBinaryString(stream, "error")
-				if err != nil {
-					s.logger.Errorf("failed to send error response to stream %v: %v", stream, err)
-				}
+				s.logger.Errorf("failed to establish a new session with %s: %v", conn.RemoteAddr().String(), authErr)
+				span.End(errInvalidToken)
+
+				// answered late, without keeping this session slot from the client
+				delay := s.config.AuthLimit.Failed(conn.RemoteAddr().String(), s.state().usageMonitor)
+				time.AfterFunc(delay, func() {
+					if err := utils.SendBinaryString(stream, "error"); err != nil {
+						s.logger.Debugf("failed to send error response to stream %v: %v", stream, err)
+					}
+					session.Close()
+				})
+			}
+		}
+	}
+}
 
-				s.logger.Errorf("failed to establish a new session. Token mismatch: received %s, expected %s", token, s.config.Token)
-				session.Close()
+// goAway tells the client that session ends, so it reconnects right away, and
+// waits until the streams relayed over session finished or session_drain
+// passed. They are reset otherwise.
+func (s *TcpMuxTransport) goAway(id int, session *smux.Session) {
+	if err := utils.SendMuxGoAway(session, s.config.SessionDrain); err != nil {
+		s.logger.Debugf("failed to tell the client that MUX session %d goes away: %v", id, err)
+		return
+	}
+	if streams := utils.Streams(session); streams > 0 {
+		s.logger.Infof("MUX session with ID %d goes away, waiting up to %v for its %d streams", id, s.config.SessionDrain, streams)
+	}
+	if left := utils.DrainSession(session, s.config.SessionDrain); left > 0 {
+		s.logger.Warnf("closing MUX session with ID %d with %d streams left", id, left)
+	}
+}
 
-				// For safety
-				time.Sleep(2 * time.Second)
-			}
+// acceptControlStreams handles the streams the client opens on session id
+// to half-close or reset a relayed stream, to send its ID, or to open the
+// control stream.
+func (s *TcpMuxTransport) acceptControlStreams(id int, session *smux.Session) {
+	defer utils.Recover(s.logger, s.state().usageMonitor, "control streams", session)
+	for {
+		stream, err := session.AcceptStream()
+		if err != nil {
+			return
 		}
+		go func() {
+			defer utils.Recover(s.logger, s.state().usageMonitor, "control stream", stream)
+			port, err := utils.ReceiveBinaryInt(stream)
+			if err == nil && port == utils.MuxClientIDPort {
+				s.receiveClientID(session, stream)
+				return
+			}
+			if err == nil && port == utils.MuxControlStreamPort {
+				s.serveControlStream(id, session, stream)
+				return
+			}
+			if err != nil || !utils.IsMuxControl(port) {
+				stream.Close()
+				return
+			}
+			if err := utils.ReceiveMuxControl(session, port, stream); err != nil {
+				s.logger.Debugf("failed to control a mux stream: %v", err)
+			}
+		}()
+	}
+}
+
+// receiveClientID reads the ID of the client that opened session.
+func (s *TcpMuxTransport) receiveClientID(session *smux.Session, stream net.Conn) {
+	defer stream.Close()
+	msg, err := utils.ReceiveBinaryString(stream)
+	if err != nil {
+		s.logger.Debugf("failed to read the client ID: %v", err)
+		return
+	}
+	if id, ok := utils.ParseClientID(msg); ok {
+		s.clientIDs.Store(session, id)
+		clientConnected(id, session.RemoteAddr().String(), s.state().usageMonitor, s.logger)
+	}
+	// older clients close the stream after their ID
+	if msg, err := utils.ReceiveBinaryString(stream); err == nil && msg == utils.MetaMessage {
+		s.meta.Store(session, true)
 	}
 }
 
 func (s *TcpMuxTransport) localListener(localAddr string, remotePort int) {
 	s.logger.Debugf("starting listener on local port %s -> remote port %d", localAddr, remotePort)
-	listener, err := net.Listen("tcp", localAddr)
+	if queue := s.held.queue(localAddr); queue != nil {
+		// the listener kept accepting while the tunnel reconnected
+		s.handleMUXSession(queue.ch, remotePort)
+		return
+	}
+	listener, err := utils.Listen(localAddr)
 	if err != nil {
 		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
 		return
 	}
+	transparentListener(listener, remotePort, s.logger)
+	s.config.Filter.Attach(listener, false)
 
 	//close local listener after context cancellation
 	defer listener.Close()
 
 	s.logger.Infof("listener started successfully, listening on address: %s", listener.Addr().String())
 
-	// channel
-	acceptChan := make(chan net.Conn, s.config.ChannelSize)
+	// queue
+	lifetime := s.held.lifetime(s.state().ctx, s.parentctx)
+	queue := newConnQueue(lifetime, s.config.ChannelSize, s.config.OverflowPolicy, s.config.OverflowTimeout, listener.Addr().(*net.TCPAddr).Port, s.state().usageMonitor, s.logger)
+	s.held.keep(localAddr, queue)
+	port := listener.Addr().(*net.TCPAddr).Port
+	s.held.open(port, queue)
+	defer s.held.closed(port, queue)
 
-	// handle channel connections
-	go s.handleMUXSession(acceptChan, remotePort)
+	// handle queued connections
+	go s.handleMUXSession(queue.ch, remotePort)
 
 	go func() {
 		for {
 			select {
-			case <-s.ctx.Done():
+			case <-lifetime.Done():
 				return
 
 			default:
 				s.logger.Debugf("waiting to accept incoming connection on %s", listener.Addr().String())
 				conn, err := listener.Accept()
 				if err != nil {
+					if errors.Is(err, net.ErrClosed) {
+						return
+					}
 					s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
 					continue
 				}
@@ -307,6 +543,16 @@ func (s *TcpMuxTransport) localListener(localAddr string, remotePort int) {
 					conn.Close()
 					continue
 				}
+				public := publicConn(tcpConn, remotePort, port, s.config.PortOptions, s.logger)
+				if public == nil {
+					continue
+				}
+				public = s.config.Anomaly.Watch(public, port)
+				if public == nil {
+					continue
+				}
+				public = s.config.Shaper.Shape(public, port)
+				public = s.config.Sources.Track(public, port)
 
 				// trying to enable tcpnodelay
 				if s.config.Nodelay {
@@ -318,56 +564,122 @@ func (s *TcpMuxTransport) localListener(localAddr string, remotePort int) {
 				}
 
 				tcpConn.SetKeepAlive(true)
-				tcpConn.SetKeepAlivePeriod(s.config.KeepAlive)
-
-				select {
-				case acceptChan <- tcpConn:
-					s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
-
-				case <-time.After(s.timeout): // channel is full, discard the connection
-					s.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", listener.Addr().String(), tcpConn.LocalAddr().String())
-					tcpConn.Close()
-				}
+				tcpConn.SetKeepAlivePeriod(s.config.KeepAlive.Period)
 
+				s.config.Attack.Admit(public, func(conn net.Conn) {
+					expectProtocol(conn, s.config.PortOptions, s.config.FirstByteTimeout, s.logger, s.state().usageMonitor, func(conn net.Conn) {
+						queue.push(utils.TimeAccepted(conn, s.state().usageMonitor))
+					})
+				})
 			}
 		}
 	}()
 
-	<-s.ctx.Done()
+	<-lifetime.Done()
+	s.held.release(localAddr, s.parentctx, s.logger)
 }
 
 func (s *TcpMuxTransport) handleMUXSession(acceptChan chan net.Conn, remotePort int) {
 	for {
 		select {
 		case incomingConn := <-acceptChan:
-			id := rand.Intn(s.config.MuxSession)
-			if s.smuxSession[id] == nil || s.smuxSession[id].IsClosed() {
+			if s.held.expired(incomingConn, s.logger) {
+				continue
+			}
+			id := s.sessionID(incomingConn)
+			session := s.state().smuxSession[id]
+			if (id >= s.config.MuxSession || s.isCulled(id)) && (session == nil || session.IsClosed()) {
+				// the session was retired meanwhile, for being idle
+				s.revive(id)
+				id = s.liveSession()
+				session = s.state().smuxSession[id]
+			}
+			span := tracing.Start("forward", "port", strconv.Itoa(remotePort), "peer", incomingConn.RemoteAddr().String(), "session", strconv.Itoa(id))
+			if session == nil || session.IsClosed() {
 				s.logger.Errorf("MUX session with ID %d is closed or nil. Discarding incoming connection from %s.", id, incomingConn.RemoteAddr().String())
-				incomingConn.Close()
+				s.held.requeue(acceptChan, incomingConn)
+				span.End(errTunnelUnavailable)
 				s.logger.Info("attempting to restart server...")
 				go s.Restart()
 				return
 			}
 
-			stream, err := s.smuxSession[id].OpenStream()
+			if s.config.MaxStreams > 0 && utils.Streams(session) >= s.config.MaxStreams {
+				localPort := incomingConn.LocalAddr().(*net.TCPAddr).Port
+				other, ok := s.roomySession(id, localPort)
+				if !ok {
+					err := &streamLimitError{session: id, streams: utils.Streams(session)}
+					s.logger.Warnf("refusing connection from %s: %v, raise mux_session, mux_session_max or mux_max_streams", incomingConn.RemoteAddr().String(), err)
+					s.state().usageMonitor.IncCounter("backhaul_stream_rejects_total", "port", strconv.Itoa(localPort))
+					incomingConn.Close()
+					span.End(err)
+					continue
+				}
+				id, session = other, s.state().smuxSession[other]
+			}
+
+			open := span.Child("stream_open")
+			stream, err := session.OpenStream()
 			if err != nil {
 				s.logger.Errorf("failed to open a new mux stream for session ID %d: %v", id, err)
-				incomingConn.Close()
+				s.held.requeue(acceptChan, incomingConn)
+				open.End(err)
+				span.End(err)
 				s.logger.Info("attempting to restart server...")
 				go s.Restart()
 				return
 			}
 			// Send the target port over the connection
-			if err := utils.SendBinaryInt(stream, uint16(remotePort)); err != nil {
-				s.logger.Warnf("Failed to send port %d over stream for session ID %d: %v", remotePort, id, err)
+			_, wanted := s.meta.Load(session)
+			port, meta := streamTarget(remotePort, wanted, incomingConn, s.names)
+			if err := utils.SendStreamHeader(stream, port, meta); err != nil {
+				s.logger.Warnf("Failed to send port %d over stream for session ID %d: %v", port, id, err)
 				incomingConn.Close()
+				open.End(err)
+				span.End(err)
 				continue
 			}
+			open.End(nil)
+			utils.ObserveSetup(incomingConn)
+			tunnelConn := utils.NewMuxStream(session, stream)
 
-			go utils.ConnectionHandler(stream, incomingConn, s.logger, s.usageMonitor, incomingConn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+			go span.Relay(func() string {
+				return utils.ConnectionHandler(tunnelConn, utils.AutoNodelay(incomingConn, s.config.AutoNodelay), s.logger, s.state().usageMonitor, incomingConn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+			})
 
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 		}
 	}
 }
+
+// sessionID picks the mux session for an incoming connection. Ports with a
+// dedicated session always use it, ports with a schedule the session it
+// picks, and others are spread over the shared sessions according to the
+// sticky routing strategy.
+func (s *TcpMuxTransport) sessionID(conn net.Conn) int {
+	localPort := conn.LocalAddr().(*net.TCPAddr).Port
+	if id, ok := s.dedicated[localPort]; ok {
+		return id
+	}
+	if schedule, ok := s.schedules[localPort]; ok {
+		if id, ok := s.scheduledSession(schedule); ok {
+			return id
+		}
+	}
+	shared := s.config.MuxSession - len(s.dedicated)
+
+	var key string
+	switch s.config.StickyRouting {
+	case config.StickySourceIP:
+		key, _, _ = net.SplitHostPort(conn.RemoteAddr().String())
+	case config.StickyPort:
+		key = strconv.Itoa(localPort)
+	default:
+		return s.randomSession(shared)
+	}
+
+	hash := fnv.New32a()
+	hash.Write([]byte(key))
+	return int(hash.Sum32() % uint32(shared))
+}
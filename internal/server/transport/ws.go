@@ -2,16 +2,23 @@ package transport
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"net"
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/sahmadiut/backhaul/internal/chaos"
 	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/sahmadiut/backhaul/internal/dnsfwd"
+	"github.com/sahmadiut/backhaul/internal/exitnode"
+	"github.com/sahmadiut/backhaul/internal/synfilter"
+	"github.com/sahmadiut/backhaul/internal/tracing"
+	"github.com/sahmadiut/backhaul/internal/tun"
 	"github.com/sahmadiut/backhaul/internal/utils"
 	"github.com/sahmadiut/backhaul/internal/web"
 
@@ -21,37 +28,90 @@ import (
 
 type WsTransport struct {
 	config            *WsConfig
-	ctx               context.Context
-	cancel            context.CancelFunc
+	parentctx         context.Context
+	current           atomic.Pointer[wsState] // replaced by each Restart
 	logger            *logrus.Logger
-	tunnelChannel     chan TunnelChannel
-	getNewConnChan    chan struct{}
-	controlChannel    *websocket.Conn
+	controlChannel    atomic.Pointer[websocket.Conn] // nil until the client opens one
 	restartMutex      sync.Mutex
 	timeout           time.Duration
 	heartbeatDuration time.Duration
 	heartbeatSig      string
 	chanSignal        string
 	mu                sync.Mutex
-	usageMonitor      *web.Usage
+	held              *heldPorts     // public listeners kept through restarts, with hold_timeout
+	clientID          atomic.Value   // of the client on the control channel
+	pool              *pool          // how many tunnel connections to keep ready
+	meta              atomic.Bool    // the client wants stream metadata
+	report            clientReport   // of the client on the control channel
+	managed           atomic.Bool    // the client takes commands
+	commands          commands       // sent to the client, waiting for their results
+	names             map[int]string // of the forward tables by public port
 }
 
 type WsConfig struct {
-	BindAddr       string
-	Nodelay        bool
-	KeepAlive      time.Duration
-	ConnectionPool int
-	Token          string
-	ChannelSize    int
-	Ports          []string
-	Sniffer        bool
-	WebPort        int
-	SnifferLog     string
-	TLSCertFile    string               // Path to the TLS certificate file
-	TLSKeyFile     string               // Path to the TLS key file
-	Mode           config.TransportType // ws or wss
-	Heartbeat      int                  // in seconds
-	TunnelStatus   string
+	BindAddr         string
+	Nodelay          bool
+	AutoNodelay      bool
+	Chaos            *chaos.Chaos
+	KeepAlive        utils.Keepalive
+	ConnectionPool   int
+	Token            string
+	Auth             *utils.TokenChecker // checks the token of handshakes
+	AuthLimit        *AuthLimiter        // slows down and bans addresses failing the handshake
+	ChannelSize      int
+	Ports            []string
+	Forward          []config.Forward
+	PortsAddr        string // host the public ports listen on, empty for all addresses
+	TransparentAddr  string // takes connections redirected by iptables, empty for none
+	Sniffer          bool
+	WebPort          int
+	SnifferLog       string
+	TLSCertFile      string               // Path to the TLS certificate file
+	TLSKeyFile       string               // Path to the TLS key file
+	Mode             config.TransportType // ws or wss
+	Heartbeat        int                  // in seconds
+	TunnelStatus     web.Status
+	PortOptions      map[string]config.PortOptions
+	OverflowPolicy   string
+	OverflowTimeout  time.Duration
+	HoldTimeout      time.Duration     // how long public connections wait for the tunnel to come back
+	FirstByteTimeout time.Duration     // how long a public connection may take to send something, 0 for ever
+	IdleCull         time.Duration     // how long without public connections before the pool is emptied, 0 for ever
+	WaitForTunnel    bool              // refuse public connections while the tunnel is down
+	Tun              *tun.Link         // carries the packets of a TUN device, nil without tun_addr
+	DNS              *dnsfwd.Resolver  // resolves the DNS queries of the client, nil without dns_forward
+	Exit             *exitnode.Node    // dials the destinations of the client, nil without exit_node
+	Filter           *synfilter.Filter // drops floods of SYNs in the kernel, nil without kernel_filter
+	Attack           *AttackGuard      // refuses public connections while under attack
+	Anomaly          *AnomalyDetector  // flags and limits the ports whose traffic spikes, nil without anomaly
+	Shaper           *Shaper           // caps the bandwidth of public ports by time of day, nil without bandwidth policies
+	Sources          *SourceTracker    // keeps the top sources of public ports by traffic, nil without top_sources
+	Masquerade       http.Handler      // answers requests that don't come from a client, nil to refuse them
+	Fallback         *Fallback         // takes the requests refused for their token or address, nil to refuse them
+}
+
+// wsState is what a WsTransport starts over with on Restart. It is replaced
+// whole, as the goroutines of the transport read it at any time.
+type wsState struct {
+	ctx            context.Context
+	cancel         context.CancelFunc
+	tunnelChannel  chan TunnelChannel
+	getNewConnChan chan struct{}
+	usageMonitor   *web.Usage
+	signals        *signals // sent on the control channel
+}
+
+func newWSState(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *wsState {
+	ctx, cancel := context.WithCancel(parentCtx)
+	usageMonitor := web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger)
+	return &wsState{
+		ctx:            ctx,
+		cancel:         cancel,
+		tunnelChannel:  make(chan TunnelChannel, config.ChannelSize),
+		getNewConnChan: make(chan struct{}, config.ChannelSize),
+		usageMonitor:   usageMonitor,
+		signals:        newSignals(usageMonitor, logger),
+	}
 }
 
 type TunnelChannel struct {
@@ -61,27 +121,29 @@ type TunnelChannel struct {
 }
 
 func NewWSServer(parentCtx context.Context, config *WsConfig, logger *logrus.Logger) *WsTransport {
-	// Create a derived context from the parent context
-	ctx, cancel := context.WithCancel(parentCtx)
-
 	// Initialize the TcpTransport struct
 	server := &WsTransport{
 		config:            config,
-		ctx:               ctx,
-		cancel:            cancel,
+		parentctx:         parentCtx,
 		logger:            logger,
-		tunnelChannel:     make(chan TunnelChannel, config.ChannelSize),
-		getNewConnChan:    make(chan struct{}, config.ChannelSize),
-		controlChannel:    nil,                                           // will be set when a control connection is established
 		timeout:           2 * time.Second,                               // Default timeout
 		heartbeatDuration: time.Duration(config.Heartbeat) * time.Second, // Default heartbeat duration
 		heartbeatSig:      "0",                                           // Default heartbeat signal
 		chanSignal:        "1",                                           // Default channel signal
-		usageMonitor:      web.NewDataStore(fmt.Sprintf(":%v", config.WebPort), ctx, config.SnifferLog, config.Sniffer, &config.TunnelStatus, logger),
+		held:              newHeldPorts(config.HoldTimeout, config.WaitForTunnel),
 	}
+	server.current.Store(newWSState(parentCtx, config, logger))
+	server.pool = fixedPool(config.ConnectionPool, config.IdleCull)
+	server.names = portNames(config.Forward)
 
 	return server
 }
+
+// state returns what the transport runs with since the last Restart.
+func (s *WsTransport) state() *wsState {
+	return s.current.Load()
+}
+
 func (s *WsTransport) Restart() {
 	if !s.restartMutex.TryLock() {
 		s.logger.Warn("server restart already in progress, skipping restart attempt")
@@ -90,67 +152,42 @@ func (s *WsTransport) Restart() {
 	defer s.restartMutex.Unlock()
 
 	s.logger.Info("restarting server...")
-	if s.cancel != nil {
-		s.cancel()
-	}
+	s.state().cancel()
 
 	time.Sleep(2 * time.Second)
 
-	ctx, cancel := context.WithCancel(context.Background())
-	s.ctx = ctx
-	s.cancel = cancel
-
 	// Re-initialize variables
-	s.tunnelChannel = make(chan TunnelChannel, s.config.ChannelSize)
-	s.getNewConnChan = make(chan struct{}, s.config.ChannelSize)
-	s.controlChannel = nil
-	s.usageMonitor = web.NewDataStore(fmt.Sprintf(":%v", s.config.WebPort), ctx, s.config.SnifferLog, s.config.Sniffer, &s.config.TunnelStatus, s.logger)
-	s.config.TunnelStatus = ""
+	s.current.Store(newWSState(s.parentctx, s.config, s.logger))
+	s.controlChannel.Store(nil)
+	s.meta.Store(false)
+	s.report.reset()
+	s.managed.Store(false)
+	s.config.TunnelStatus.Set("")
 
 	go s.TunnelListener()
 
 }
 func (s *WsTransport) portConfigReader() {
 	// port mapping for listening on each local port
-	for _, portMapping := range s.config.Ports {
-		var re = regexp.MustCompile(`(?m)^(?:(?:\[(\d+):(\d+)\](?:=(\d+))?)|(?:(\d+)(?::(\d+))?(?:=(\d+))?))$`)
-		if !re.MatchString(portMapping) {
-			s.logger.Fatalf("invalid port mapping: %s", portMapping)
-			continue
-		}
-		var groups = re.FindStringSubmatch(portMapping)
-		var validGroups []int
-		for i := 1; i < len(groups); i++ {
-			if groups[i] != "" {
-				var num, _ = strconv.Atoi(groups[i])
-				validGroups = append(validGroups, num)
-			}
-		}
-		var remotePort = -1
-		var startRange = validGroups[0]
-		var endRange = startRange
-		if strings.Contains(portMapping, "=") {
-			remotePort = validGroups[len(validGroups)-1]
-			if len(validGroups) == 3 {
-				endRange = validGroups[1]
-			}
-		} else {
-			if len(validGroups) == 2 {
-				endRange = validGroups[1]
-			}
-		}
-		if startRange > endRange {
-			s.logger.Fatalf("Invalid range: %d %d", startRange, endRange)
-		} else {
-			for i := startRange; i <= endRange; i++ {
-				var localAddr = ":" + strconv.Itoa(i)
-				if remotePort == -1 {
-					go s.localListener(localAddr, i)
-				} else {
-					go s.localListener(localAddr, remotePort)
-				}
-			}
-		}
+	mappings, err := utils.ParsePorts(s.config.Ports, s.config.Forward)
+	if err != nil {
+		s.logger.Fatalf("%v", err)
+		return
+	}
+	for _, mapping := range mappings {
+		go s.localListener(mapping.Addr(s.config.PortsAddr), mapping.RemotePort)
+	}
+	if s.config.TransparentAddr != "" {
+		go s.localListener(s.config.TransparentAddr, transparentPort)
+	}
+	if s.config.Tun != nil {
+		go s.handleWSSession(tun.Port, s.config.Tun.Conns())
+	}
+	if s.config.DNS != nil {
+		go s.handleWSSession(dnsfwd.Port, s.config.DNS.Conns())
+	}
+	if s.config.Exit != nil {
+		go s.handleWSSession(exitnode.Port, s.config.Exit.Conns())
 	}
 }
 
@@ -160,16 +197,17 @@ func (s *WsTransport) heartbeat() {
 
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 		case <-ticker.C:
-			if s.controlChannel == nil {
+			control := s.controlChannel.Load()
+			if control == nil {
 				s.logger.Warn("control channel is nil. Restarting server to re-establish connection...")
 				go s.Restart()
 				return
 			}
 			s.mu.Lock()
-			err := s.controlChannel.WriteMessage(websocket.TextMessage, []byte(s.heartbeatSig))
+			err := control.WriteMessage(websocket.TextMessage, []byte(s.config.Chaos.Heartbeat(utils.HeartbeatMessage(s.heartbeatSig, s.report.offered.Load()))))
 			s.mu.Unlock()
 			if err != nil {
 				s.logger.Errorf("Failed to send heartbeat signal. Error: %v. Restarting server...", err)
@@ -187,19 +225,32 @@ func (s *WsTransport) poolChecker() {
 
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 
 		case <-ticker.C:
-			currentPoolSize := len(s.tunnelChannel)
-			if currentPoolSize < s.config.ConnectionPool {
-				neededConnections := s.config.ConnectionPool - currentPoolSize
+			target := s.pool.target()
+			if idle := len(s.state().tunnelChannel); idle > target && s.pool.culled() {
+				s.logger.Infof("no public connections for %v, closing %d idle tunnel connections", s.config.IdleCull, idle-target)
+				s.state().usageMonitor.AddCounter("backhaul_idle_culled_total", int64(idle-target), "kind", "pool")
+				for i := 0; i < idle-target; i++ {
+					select {
+					case tunnelConnection := <-s.state().tunnelChannel:
+						close(tunnelConnection.ping)
+						tunnelConnection.conn.Close()
+					default:
+					}
+				}
+			}
+			currentPoolSize := len(s.state().tunnelChannel) + s.state().signals.outstanding(s.timeout)
+			if currentPoolSize < target {
+				neededConnections := target - currentPoolSize
 				s.logger.Tracef("pool size is %d, adding %d new connections", currentPoolSize, neededConnections)
 
 			loop:
 				for i := 0; i < neededConnections; i++ {
 					select {
-					case s.getNewConnChan <- struct{}{}:
+					case s.state().getNewConnChan <- struct{}{}:
 					default:
 						s.logger.Trace("getNewConnChan is full, skipping new connection")
 						break loop
@@ -210,15 +261,39 @@ func (s *WsTransport) poolChecker() {
 	}
 }
 
+// readControl reads the acknowledgments of channel signals, the stats and the
+// results of commands the client sends on the control channel.
+func (s *WsTransport) readControl(conn *websocket.Conn) {
+	defer utils.Recover(s.logger, s.state().usageMonitor, "control channel", conn)
+	for {
+		_, msg, err := conn.ReadMessage()
+		if err != nil {
+			return
+		}
+		if seq, failure, ok := utils.ParseAck(string(msg)); ok {
+			s.state().signals.ack(seq, failure)
+			continue
+		}
+		if stats, ok := utils.ParseClientStats(string(msg)); ok {
+			id, _ := s.clientID.Load().(string)
+			s.report.store(id, stats)
+			continue
+		}
+		if result, ok := utils.ParseResult(string(msg)); ok {
+			s.commands.done(result)
+		}
+	}
+}
+
 func (s *WsTransport) getNewConnection() {
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 
-		case <-s.getNewConnChan:
+		case <-s.state().getNewConnChan:
 			s.mu.Lock()
-			err := s.controlChannel.WriteMessage(websocket.TextMessage, []byte(s.chanSignal))
+			err := s.controlChannel.Load().WriteMessage(websocket.TextMessage, []byte(s.state().signals.message(s.chanSignal)))
 			s.mu.Unlock()
 			if err != nil {
 				s.logger.Error("error sending channel signal, attempting to restart server...")
@@ -232,10 +307,10 @@ func (s *WsTransport) getNewConnection() {
 func (s *WsTransport) TunnelListener() {
 	// for  webui
 	if s.config.WebPort > 0 {
-		go s.usageMonitor.Monitor()
+		go s.state().usageMonitor.Monitor()
 	}
 
-	s.config.TunnelStatus = "Disconnected (Websocket)"
+	s.config.TunnelStatus.Set("Disconnected (Websocket)")
 
 	addr := s.config.BindAddr
 	upgrader := websocket.Upgrader{
@@ -258,22 +333,107 @@ func (s *WsTransport) TunnelListener() {
 		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 			s.logger.Tracef("received http request from %s", r.RemoteAddr)
 
+			if s.config.AuthLimit.Banned(r.RemoteAddr) {
+				s.logger.Debugf("refused request from banned address %s", r.RemoteAddr)
+				if s.config.Fallback != nil {
+					s.config.Fallback.ServeHTTP(w, r)
+					return
+				}
+				if hijacker, ok := w.(http.Hijacker); ok && s.config.AuthLimit.Tarpitting() {
+					if conn, _, err := hijacker.Hijack(); err == nil {
+						s.config.AuthLimit.Refuse(conn, s.state().usageMonitor)
+						return
+					}
+				}
+				http.Error(w, "too many failed attempts", http.StatusTooManyRequests)
+				return
+			}
+
+			// scanners and browsers see a web server
+			if s.config.Masquerade != nil && !fromClient(r) {
+				s.logger.Debugf("serving %s %s from %s with the masquerade", r.Method, r.URL.Path, r.RemoteAddr)
+				s.state().usageMonitor.IncCounter("backhaul_masquerade_requests_total")
+				s.config.Masquerade.ServeHTTP(w, r)
+				return
+			}
+			if s.config.Fallback != nil && !fromClient(r) {
+				s.logger.Debugf("handing %s %s from %s to the fallback", r.Method, r.URL.Path, r.RemoteAddr)
+				s.state().usageMonitor.IncCounter("backhaul_fallback_requests_total")
+				s.config.Fallback.ServeHTTP(w, r)
+				return
+			}
+
+			var span *tracing.Span
+			if r.URL.Path == "/channel" {
+				span = tracing.Start("auth", "peer", r.RemoteAddr)
+			}
+
 			// Read the "Authorization" header
-			authHeader := r.Header.Get("Authorization")
-			if authHeader != fmt.Sprintf("Bearer %v", s.config.Token) {
-				s.logger.Warnf("unauthorized request from %s, closing connection", r.RemoteAddr)
+			token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+			if _, err := s.config.Auth.Check(token); err != nil {
+				s.logger.Warnf("unauthorized request from %s, closing connection: %v", r.RemoteAddr, err)
+				span.End(errInvalidToken)
+				if s.config.Fallback != nil {
+					// counted, but answered at once like the decoy would
+					s.config.AuthLimit.Failed(r.RemoteAddr, s.state().usageMonitor)
+					s.state().usageMonitor.IncCounter("backhaul_fallback_requests_total")
+					s.config.Fallback.ServeHTTP(w, r)
+					return
+				}
+				time.Sleep(s.config.AuthLimit.Failed(r.RemoteAddr, s.state().usageMonitor))
 				http.Error(w, "unauthorized", http.StatusUnauthorized) // Send 401 Unauthorized response
 				return
 			}
+			s.config.AuthLimit.Succeeded(r.RemoteAddr)
+
+			// newer clients send their version on the control channel and
+			// get the one of the server back
+			var version *utils.PeerVersion
+			var header http.Header
+			if value := r.Header.Get(utils.VersionHeader); value != "" && r.URL.Path == "/channel" {
+				if v, err := utils.ParseVersion(value); err == nil {
+					if err := v.Check("client"); err != nil {
+						s.logger.Errorf("refused client %s from %s: %v", r.Header.Get(utils.ClientIDHeader), r.RemoteAddr, err)
+						span.End(err)
+						http.Error(w, err.Error(), http.StatusUpgradeRequired)
+						return
+					}
+					version = &v
+					header = http.Header{utils.VersionHeader: {utils.LocalVersion().Encode()}}
+				}
+			}
 
-			conn, err := upgrader.Upgrade(w, r, nil)
+			conn, err := upgrader.Upgrade(w, r, header)
 			if err != nil {
 				s.logger.Errorf("failed to upgrade connection from %s: %v", r.RemoteAddr, err)
+				span.End(err)
 				return
 			}
+			span.End(nil)
+			if err := s.config.KeepAlive.Apply(conn.NetConn()); err != nil {
+				s.logger.Warnf("failed to set TCP keep-alive for %s: %v", r.RemoteAddr, err)
+			}
 
-			if r.URL.Path == "/channel" && s.controlChannel == nil {
-				s.controlChannel = conn
+			// echo stream for "backhaul doctor", kept out of the pool
+			if r.URL.Path == utils.DoctorPath {
+				go s.doctorEcho(conn)
+				return
+			}
+
+			if r.URL.Path == "/channel" && s.controlChannel.CompareAndSwap(nil, conn) {
+				id := r.Header.Get(utils.ClientIDHeader)
+				s.clientID.Store(id)
+				clientConnected(id, r.RemoteAddr, s.state().usageMonitor, s.logger)
+				s.state().signals.acks.Store(r.Header.Get(utils.AcksHeader) != "")
+				s.report.offered.Store(r.Header.Get(utils.StatsHeader) != "")
+				s.managed.Store(r.Header.Get(utils.CommandsHeader) != "")
+				if s.state().signals.acks.Load() || s.report.offered.Load() || s.managed.Load() {
+					go s.readControl(conn)
+				}
+				s.meta.Store(r.Header.Get(utils.MetaHeader) != "")
+				if version != nil {
+					s.report.accept(id, r.RemoteAddr, *version, s.logger)
+				}
 
 				s.logger.Info("control channel established successfully")
 
@@ -282,19 +442,30 @@ func (s *WsTransport) TunnelListener() {
 				go s.poolChecker()
 				go s.portConfigReader()
 
-				s.config.TunnelStatus = "Connected (Websocket)"
+				s.config.TunnelStatus.Set("Connected (Websocket)")
 
 				return
 			}
 
+			// the client connected again, e.g. from a new address, while its
+			// old control channel may take many minutes to time out
+			if control := s.controlChannel.Load(); r.URL.Path == "/channel" && control != nil {
+				s.logger.Warnf("client connected again from %s while its control channel from %s is up, restarting to let it in", r.RemoteAddr, control.RemoteAddr())
+				conn.Close()
+				go s.Restart()
+				return
+			}
+
 			wsConn := TunnelChannel{
 				conn: conn,
 				ping: make(chan struct{}),
 				mu:   &sync.Mutex{},
 			}
 			select {
-			case s.tunnelChannel <- wsConn:
-				go s.pingSender(&wsConn)
+			case s.state().tunnelChannel <- wsConn:
+				if s.config.KeepAlive.Pings() {
+					go s.pingSender(&wsConn)
+				}
 				s.logger.Debugf("websocket connection accepted from %s", conn.RemoteAddr().String())
 			default:
 				s.logger.Warnf("websocket tunnel channel is full, closing connection from %s", conn.RemoteAddr().String())
@@ -303,23 +474,36 @@ func (s *WsTransport) TunnelListener() {
 		}),
 	}
 
+	listener, err := utils.Listen(addr)
+	if err != nil {
+		s.logger.Fatalf("failed to listen on %s: %v", addr, err)
+		return
+	}
+	s.config.Filter.Attach(listener, true)
+	listener = s.config.Chaos.Listener(listener)
+
 	if s.config.Mode == config.WS {
 		go func() {
 			s.logger.Infof("websocket server starting, listening on %s", addr)
-			if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
 			}
 		}()
 	} else {
 		go func() {
 			s.logger.Infof("wss server starting, listening on %s", addr)
-			if err := server.ListenAndServeTLS(s.config.TLSCertFile, s.config.TLSKeyFile); err != nil && err != http.ErrServerClosed {
+			if err := server.ServeTLS(listener, s.config.TLSCertFile, s.config.TLSKeyFile); err != nil && err != http.ErrServerClosed {
 				s.logger.Fatalf("failed to listen on %s: %v", addr, err)
 			}
 		}()
 	}
 
-	<-s.ctx.Done()
+	<-s.state().ctx.Done()
+
+	// let the client reconnect right away, e.g. to the process that took over on upgrade
+	if control := s.controlChannel.Load(); control != nil {
+		control.Close()
+	}
 
 	// Gracefully shutdown the server
 	s.logger.Infof("shutting down the webSocket server on %s", addr)
@@ -330,37 +514,54 @@ func (s *WsTransport) TunnelListener() {
 
 func (s *WsTransport) localListener(localAddr string, remotePort int) {
 	s.logger.Debugf("starting listener on local port %s -> remote port %d", localAddr, remotePort)
-	portListener, err := net.Listen("tcp", localAddr)
+	if queue := s.held.queue(localAddr); queue != nil {
+		// the listener kept accepting while the tunnel reconnected
+		s.handleWSSession(remotePort, queue.ch)
+		return
+	}
+	portListener, err := utils.Listen(localAddr)
 	if err != nil {
 		s.logger.Fatalf("failed to start listener on %s: %v", localAddr, err)
 		return
 	}
+	transparentListener(portListener, remotePort, s.logger)
+	s.config.Filter.Attach(portListener, false)
 
 	//close local listener after context cancellation
 	defer portListener.Close()
 
 	s.logger.Infof("listener started successfully, listening on address: %s", portListener.Addr().String())
 
-	// make a channel
-	acceptChan := make(chan net.Conn, s.config.ChannelSize)
+	// make a queue
+	lifetime := s.held.lifetime(s.state().ctx, s.parentctx)
+	queue := newConnQueue(lifetime, s.config.ChannelSize, s.config.OverflowPolicy, s.config.OverflowTimeout, portListener.Addr().(*net.TCPAddr).Port, s.state().usageMonitor, s.logger)
+	s.held.keep(localAddr, queue)
+	port := portListener.Addr().(*net.TCPAddr).Port
+	s.held.open(port, queue)
+	defer s.held.closed(port, queue)
 
 	// start accepting incoming connections
-	go s.acceptLocConn(portListener, acceptChan)
-	go s.handleWSSession(remotePort, acceptChan)
+	go s.acceptLocConn(lifetime, portListener, queue, remotePort)
+	go s.handleWSSession(remotePort, queue.ch)
 
-	<-s.ctx.Done()
+	<-lifetime.Done()
+	s.held.release(localAddr, s.parentctx, s.logger)
 }
 
-func (s *WsTransport) acceptLocConn(listener net.Listener, acceptChan chan net.Conn) {
+func (s *WsTransport) acceptLocConn(lifetime context.Context, listener net.Listener, queue *connQueue, remotePort int) {
+	port := listener.Addr().(*net.TCPAddr).Port
 	for {
 		select {
-		case <-s.ctx.Done():
+		case <-lifetime.Done():
 			return
 
 		default:
 			s.logger.Debugf("waiting to accept incoming connection on %s", listener.Addr().String())
 			conn, err := listener.Accept()
 			if err != nil {
+				if errors.Is(err, net.ErrClosed) {
+					return
+				}
 				s.logger.Debugf("failed to accept connection on %s: %v", listener.Addr().String(), err)
 				continue
 			}
@@ -372,6 +573,16 @@ func (s *WsTransport) acceptLocConn(listener net.Listener, acceptChan chan net.C
 				conn.Close()
 				continue
 			}
+			public := publicConn(tcpConn, remotePort, port, s.config.PortOptions, s.logger)
+			if public == nil {
+				continue
+			}
+			public = s.config.Anomaly.Watch(public, port)
+			if public == nil {
+				continue
+			}
+			public = s.config.Shaper.Shape(public, port)
+			public = s.config.Sources.Track(public, port)
 
 			// trying to enable tcpnodelay
 			if s.config.Nodelay {
@@ -382,26 +593,23 @@ func (s *WsTransport) acceptLocConn(listener net.Listener, acceptChan chan net.C
 				}
 			}
 			tcpConn.SetKeepAlive(true)
-			tcpConn.SetKeepAlivePeriod(s.config.KeepAlive)
-
-			if len(s.tunnelChannel) < s.config.ConnectionPool {
-				select {
-				case s.getNewConnChan <- struct{}{}:
-					// Successfully requested a new connection
-				default:
-					// The channel is full, do nothing
-					s.logger.Warn("getNewConnChan is full, cannot request a new connection")
-				}
-			}
-
-			select {
-			case acceptChan <- tcpConn:
-				s.logger.Debugf("accepted incoming TCP connection from %s", tcpConn.RemoteAddr().String())
-
-			default: // channel is full, discard the connection
-				s.logger.Warnf("channel with listener %s is full, discarding TCP connection from %s", listener.Addr().String(), tcpConn.LocalAddr().String())
-				tcpConn.Close()
-			}
+			tcpConn.SetKeepAlivePeriod(s.config.KeepAlive.Period)
+
+			s.config.Attack.Admit(public, func(conn net.Conn) {
+				// a tunnel connection is asked for once it passed expect and first_byte_timeout
+				expectProtocol(conn, s.config.PortOptions, s.config.FirstByteTimeout, s.logger, s.state().usageMonitor, func(conn net.Conn) {
+					if s.pool.accepted(len(s.state().tunnelChannel)) {
+						select {
+						case s.state().getNewConnChan <- struct{}{}:
+							// Successfully requested a new connection
+						default:
+							// The channel is full, do nothing
+							s.logger.Warn("getNewConnChan is full, cannot request a new connection")
+						}
+					}
+					queue.push(utils.TimeAccepted(conn, s.state().usageMonitor))
+				})
+			})
 		}
 	}
 }
@@ -410,39 +618,65 @@ func (s *WsTransport) handleWSSession(remotePort int, acceptChan chan net.Conn)
 	for {
 		select {
 		case incomingConn := <-acceptChan:
+			if s.held.expired(incomingConn, s.logger) {
+				continue
+			}
+			span := tracing.Start("forward", "port", strconv.Itoa(remotePort), "peer", incomingConn.RemoteAddr().String())
+			open := span.Child("stream_open")
+			failed := s.state().signals.failures()
 		innerloop:
 			for {
 				select {
-				case tunnelConnection := <-s.tunnelChannel:
+				case tunnelConnection := <-s.state().tunnelChannel:
 					close(tunnelConnection.ping)
 					tunnelConnection.mu.Lock()
-					if err := utils.SendWebSocketInt(tunnelConnection.conn, uint16(remotePort)); err != nil {
+					port, meta := streamTarget(remotePort, s.meta.Load(), incomingConn, s.names)
+					if err := utils.SendWebSocketStreamHeader(tunnelConnection.conn, port, meta); err != nil {
 						s.logger.Debugf("%v", err) // failed to send port number
 						tunnelConnection.conn.Close()
 						continue innerloop
 					}
+					open.End(nil)
+					utils.ObserveSetup(incomingConn)
 					// Handle data exchange between connections
-					go utils.WSToTCPConnHandler(tunnelConnection.conn, incomingConn, s.logger, s.usageMonitor, incomingConn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					go span.Relay(func() string {
+						return utils.WSToTCPConnHandler(tunnelConnection.conn, utils.AutoNodelay(incomingConn, s.config.AutoNodelay), s.logger, s.state().usageMonitor, incomingConn.LocalAddr().(*net.TCPAddr).Port, s.config.Sniffer)
+					})
 					break innerloop
 
 				case <-time.After(s.timeout):
 					s.logger.Warn("tunnel connection unavailable, attempting to restart server...")
-					incomingConn.Close()
+					s.held.requeue(acceptChan, incomingConn)
+					open.End(errTunnelUnavailable)
+					span.End(errTunnelUnavailable)
 					go s.Restart()
 					return
 
-				case <-s.ctx.Done():
+				case <-failed:
+					if len(s.state().tunnelChannel) > 0 {
+						failed = nil // one came after all
+						continue innerloop
+					}
+					s.logger.Warnf("refusing connection from %s, the client can't open tunnel connections", incomingConn.RemoteAddr().String())
+					utils.ResetConn(incomingConn)
+					open.End(errTunnelUnavailable)
+					span.End(errTunnelUnavailable)
+					break innerloop
+
+				case <-s.state().ctx.Done():
+					s.held.requeue(acceptChan, incomingConn)
+					span.End(s.state().ctx.Err())
 					return
 				}
 			}
-		case <-s.ctx.Done():
+		case <-s.state().ctx.Done():
 			return
 		}
 	}
 }
 
 func (s *WsTransport) pingSender(conn *TunnelChannel) {
-	ticker := time.NewTicker(s.heartbeatDuration) // Send periodic pings to the client
+	ticker := time.NewTicker(s.config.KeepAlive.PingInterval(s.heartbeatDuration)) // Send periodic pings to the client
 
 	defer ticker.Stop()
 
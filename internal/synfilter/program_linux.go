@@ -0,0 +1,243 @@
+//go:build linux
+
+package synfilter
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// eBPF opcodes, from linux/bpf.h and linux/bpf_common.h
+const (
+	opMovImm  = 0xb7 // BPF_ALU64 | BPF_MOV | BPF_K
+	opMovReg  = 0xbf // BPF_ALU64 | BPF_MOV | BPF_X
+	opAddImm  = 0x07 // BPF_ALU64 | BPF_ADD | BPF_K
+	opSubReg  = 0x1f // BPF_ALU64 | BPF_SUB | BPF_X
+	opAndImm  = 0x57 // BPF_ALU64 | BPF_AND | BPF_K
+	opRshImm  = 0x77 // BPF_ALU64 | BPF_RSH | BPF_K
+	opLdxB    = 0x71 // BPF_LDX | BPF_MEM | BPF_B
+	opLdxDW   = 0x79 // BPF_LDX | BPF_MEM | BPF_DW
+	opStH     = 0x6a // BPF_ST | BPF_MEM | BPF_H
+	opStW     = 0x62 // BPF_ST | BPF_MEM | BPF_W
+	opStDW    = 0x7a // BPF_ST | BPF_MEM | BPF_DW
+	opStxDW   = 0x7b // BPF_STX | BPF_MEM | BPF_DW
+	opXaddDW  = 0xdb // BPF_STX | BPF_ATOMIC | BPF_DW, an atomic add
+	opLdImm64 = 0x18 // BPF_LD | BPF_IMM | BPF_DW, takes two instructions
+	opJa      = 0x05 // BPF_JMP | BPF_JA
+	opJeqImm  = 0x15 // BPF_JMP | BPF_JEQ | BPF_K
+	opJgtImm  = 0x25 // BPF_JMP | BPF_JGT | BPF_K
+	opJneImm  = 0x55 // BPF_JMP | BPF_JNE | BPF_K
+	opCall    = 0x85 // BPF_JMP | BPF_CALL
+	opExit    = 0x95 // BPF_JMP | BPF_EXIT
+
+	pseudoMapFD = 1 // BPF_PSEUDO_MAP_FD, the source register of a map load
+)
+
+// registers, r1 to r5 pass the arguments of helpers and r0 their result
+const (
+	r0 = iota
+	r1
+	r2
+	r3
+	r4
+	r5
+	r6
+	r7
+	r8
+	r9
+	r10 // the frame pointer, read only
+)
+
+// helpers callable from socket filters
+const (
+	fnMapLookupElem        = 1
+	fnMapUpdateElem        = 2
+	fnKtimeGetNs           = 5
+	fnSkbLoadBytes         = 26
+	fnSkbLoadBytesRelative = 68
+
+	hdrStartNet = 1 // BPF_HDR_START_NET
+)
+
+// the stack of the program, below r10
+const (
+	stackByte  = -8  // a byte read from the packet
+	stackKey   = -24 // the 16 byte source address, IPv4 mapped to IPv6
+	stackValue = -40 // a new entry of the rate map
+	stackIndex = -44 // the index of the drop counter
+)
+
+type insn struct {
+	op       uint8
+	dst, src uint8
+	off      int16
+	imm      int32
+	label    string // the target of a jump, resolved into off
+}
+
+// asm assembles an eBPF program with jumps to named labels.
+type asm struct {
+	insns  []insn
+	labels map[string]int
+}
+
+func (a *asm) emit(op, dst, src uint8, off int16, imm int32) {
+	a.insns = append(a.insns, insn{op: op, dst: dst, src: src, off: off, imm: imm})
+}
+
+func (a *asm) jump(op, dst uint8, imm int32, label string) {
+	a.insns = append(a.insns, insn{op: op, dst: dst, imm: imm, label: label})
+}
+
+func (a *asm) label(name string) {
+	if a.labels == nil {
+		a.labels = make(map[string]int)
+	}
+	a.labels[name] = len(a.insns)
+}
+
+func (a *asm) call(fn int32) {
+	a.emit(opCall, 0, 0, 0, fn)
+}
+
+func (a *asm) loadMap(dst uint8, fd int) {
+	a.emit(opLdImm64, dst, pseudoMapFD, 0, int32(fd))
+	a.emit(0, 0, 0, 0, 0)
+}
+
+// loadBytes copies size bytes at offset of the packet to the stack, from the
+// TCP header or with relative from the IP header, and jumps to fail if they
+// aren't there.
+func (a *asm) loadBytes(relative bool, offset, stack, size int32, fail string) {
+	a.emit(opMovReg, r1, r6, 0, 0)
+	a.emit(opMovImm, r2, 0, 0, offset)
+	a.emit(opMovReg, r3, r10, 0, 0)
+	a.emit(opAddImm, r3, 0, 0, stack)
+	a.emit(opMovImm, r4, 0, 0, size)
+	if relative {
+		a.emit(opMovImm, r5, 0, 0, hdrStartNet)
+		a.call(fnSkbLoadBytesRelative)
+	} else {
+		a.call(fnSkbLoadBytes)
+	}
+	a.jump(opJneImm, r0, 0, fail)
+}
+
+// bytes resolves the jumps and encodes the program in the byte order of the
+// host, which the register nibbles follow as well.
+func (a *asm) bytes() ([]byte, error) {
+	little := binary.NativeEndian.Uint16([]byte{1, 0}) == 1
+	buf := make([]byte, 0, 8*len(a.insns))
+	for i, in := range a.insns {
+		if in.label != "" {
+			target, ok := a.labels[in.label]
+			if !ok {
+				return nil, fmt.Errorf("unknown label %q", in.label)
+			}
+			in.off = int16(target - i - 1)
+		}
+		regs := in.dst | in.src<<4
+		if !little {
+			regs = in.dst<<4 | in.src
+		}
+		buf = append(buf, in.op, regs)
+		buf = binary.NativeEndian.AppendUint16(buf, uint16(in.off))
+		buf = binary.NativeEndian.AppendUint32(buf, uint32(in.imm))
+	}
+	return buf, nil
+}
+
+// program builds the socket filter, which drops a SYN if its source address
+// is in the bans map, if given, or sent more than rate SYNs within the last
+// second by the rates map, if rate is set. It counts the drops in dropped.
+// Everything else passes untouched, the packets of accepted connections too.
+func program(bans, rates, dropped, rate int) ([]byte, error) {
+	a := &asm{}
+	a.emit(opMovReg, r6, r1, 0, 0) // the skb
+
+	// only a SYN without ACK opens a connection, the filter sees the TCP header
+	a.loadBytes(false, 13, stackByte, 1, "pass")
+	a.emit(opLdxB, r1, r10, stackByte, 0)
+	a.emit(opAndImm, r1, 0, 0, 0x12)
+	a.jump(opJneImm, r1, 0x02, "pass")
+
+	// the source address, by the version in the IP header
+	a.emit(opStDW, r10, 0, stackKey, 0)
+	a.emit(opStDW, r10, 0, stackKey+8, 0)
+	a.loadBytes(true, 0, stackByte, 1, "pass")
+	a.emit(opLdxB, r1, r10, stackByte, 0)
+	a.emit(opRshImm, r1, 0, 0, 4)
+	a.jump(opJeqImm, r1, 6, "ipv6")
+	a.jump(opJneImm, r1, 4, "pass")
+	a.emit(opStH, r10, 0, stackKey+10, 0xffff) // ::ffff:a.b.c.d
+	a.loadBytes(true, 12, stackKey+12, 4, "pass")
+	a.jump(opJa, 0, 0, "check")
+	a.label("ipv6")
+	a.loadBytes(true, 8, stackKey, 16, "pass")
+	a.label("check")
+
+	if bans >= 0 {
+		a.loadMap(r1, bans)
+		a.emit(opMovReg, r2, r10, 0, 0)
+		a.emit(opAddImm, r2, 0, 0, stackKey)
+		a.call(fnMapLookupElem)
+		a.jump(opJneImm, r0, 0, "drop")
+	}
+
+	if rate > 0 {
+		a.call(fnKtimeGetNs)
+		a.emit(opMovReg, r7, r0, 0, 0)
+		a.loadMap(r1, rates)
+		a.emit(opMovReg, r2, r10, 0, 0)
+		a.emit(opAddImm, r2, 0, 0, stackKey)
+		a.call(fnMapLookupElem)
+		a.jump(opJeqImm, r0, 0, "new")
+
+		// the entry holds the start of its second and the SYNs since
+		a.emit(opLdxDW, r1, r0, 0, 0)
+		a.emit(opMovReg, r2, r7, 0, 0)
+		a.emit(opSubReg, r2, r1, 0, 0)
+		a.jump(opJgtImm, r2, 1e9, "reset")
+		a.emit(opMovImm, r1, 0, 0, 1)
+		a.emit(opXaddDW, r0, r1, 8, 0)
+		a.emit(opLdxDW, r1, r0, 8, 0)
+		a.jump(opJgtImm, r1, int32(rate), "drop")
+		a.jump(opJa, 0, 0, "pass")
+
+		a.label("reset")
+		a.emit(opStxDW, r0, r7, 0, 0)
+		a.emit(opStDW, r0, 0, 8, 1)
+		a.jump(opJa, 0, 0, "pass")
+
+		a.label("new")
+		a.emit(opStxDW, r10, r7, stackValue, 0)
+		a.emit(opStDW, r10, 0, stackValue+8, 1)
+		a.loadMap(r1, rates)
+		a.emit(opMovReg, r2, r10, 0, 0)
+		a.emit(opAddImm, r2, 0, 0, stackKey)
+		a.emit(opMovReg, r3, r10, 0, 0)
+		a.emit(opAddImm, r3, 0, 0, stackValue)
+		a.emit(opMovImm, r4, 0, 0, 0) // BPF_ANY
+		a.call(fnMapUpdateElem)
+	}
+
+	// a socket filter returns how much of the packet to keep
+	a.label("pass")
+	a.emit(opMovImm, r0, 0, 0, -1)
+	a.emit(opExit, 0, 0, 0, 0)
+
+	a.label("drop")
+	a.emit(opStW, r10, 0, stackIndex, 0)
+	a.loadMap(r1, dropped)
+	a.emit(opMovReg, r2, r10, 0, 0)
+	a.emit(opAddImm, r2, 0, 0, stackIndex)
+	a.call(fnMapLookupElem)
+	a.jump(opJeqImm, r0, 0, "out")
+	a.emit(opMovImm, r1, 0, 0, 1)
+	a.emit(opXaddDW, r0, r1, 0, 0)
+	a.label("out")
+	a.emit(opMovImm, r0, 0, 0, 0)
+	a.emit(opExit, 0, 0, 0, 0)
+
+	return a.bytes()
+}
@@ -0,0 +1,340 @@
+//go:build linux
+
+package synfilter
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"runtime"
+	"sync"
+	"syscall"
+	"time"
+	"unsafe"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+	"github.com/sirupsen/logrus"
+)
+
+// the bpf system call, missing from package syscall on most architectures
+var sysBPF = map[string]uintptr{
+	"386":      357,
+	"amd64":    321,
+	"arm":      386,
+	"arm64":    280,
+	"loong64":  280,
+	"mips":     4355,
+	"mipsle":   4355,
+	"mips64":   5315,
+	"mips64le": 5315,
+	"ppc64":    361,
+	"ppc64le":  361,
+	"riscv64":  280,
+	"s390x":    351,
+}[runtime.GOARCH]
+
+// from linux/bpf.h
+const (
+	cmdMapCreate     = 0 // BPF_MAP_CREATE
+	cmdMapLookupElem = 1 // BPF_MAP_LOOKUP_ELEM
+	cmdMapUpdateElem = 2 // BPF_MAP_UPDATE_ELEM
+	cmdMapDeleteElem = 3 // BPF_MAP_DELETE_ELEM
+	cmdProgLoad      = 5 // BPF_PROG_LOAD
+
+	mapTypeArray    = 2 // BPF_MAP_TYPE_ARRAY
+	mapTypeLRUHash  = 9 // BPF_MAP_TYPE_LRU_HASH
+	progTypeSocket  = 1 // BPF_PROG_TYPE_SOCKET_FILTER
+	soAttachBPF     = 50
+	maxAddresses    = 65536 // in the maps, the least recently used go first when full
+	verifierLogSize = 1 << 16
+)
+
+// the program is part of backhaul, it uses no helpers reserved to the GPL
+var license = []byte("AGPL-3.0\x00")
+
+type mapCreateAttr struct {
+	mapType    uint32
+	keySize    uint32
+	valueSize  uint32
+	maxEntries uint32
+	mapFlags   uint32
+}
+
+type mapElemAttr struct {
+	mapFD uint32
+	_     uint32
+	key   uint64
+	value uint64
+	flags uint64
+}
+
+type progLoadAttr struct {
+	progType    uint32
+	insnCnt     uint32
+	insns       uint64
+	license     uint64
+	logLevel    uint32
+	logSize     uint32
+	logBuf      uint64
+	kernVersion uint32
+}
+
+// Filter drops new connections in the kernel before they are accepted: SYNs
+// of addresses over the SYN rate, and on the tunnel port those of banned
+// addresses. It is attached to listening sockets with SO_ATTACH_BPF. A nil
+// Filter does nothing.
+type Filter struct {
+	logger *logrus.Logger
+
+	tunnel  int // programs
+	public  int
+	bans    int // maps
+	rates   int
+	dropped int
+
+	mu     sync.Mutex
+	until  map[[16]byte]time.Time // when the bans in the kernel end
+	closed bool
+}
+
+// Load loads the programs of a filter, with at most rate SYNs per second
+// from an address or no limit if 0. The filter is closed with ctx, listeners
+// it is attached to keep it until they are closed.
+func Load(ctx context.Context, rate int, logger *logrus.Logger) (*Filter, error) {
+	if sysBPF == 0 {
+		return nil, fmt.Errorf("eBPF is not supported on %s", runtime.GOARCH)
+	}
+	f := &Filter{logger: logger, tunnel: -1, public: -1, bans: -1, rates: -1, dropped: -1, until: make(map[[16]byte]time.Time)}
+	var err error
+	if f.bans, err = createMap(mapTypeLRUHash, 16, 1, maxAddresses); err != nil {
+		return nil, err
+	}
+	if f.rates, err = createMap(mapTypeLRUHash, 16, 16, maxAddresses); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if f.dropped, err = createMap(mapTypeArray, 4, 8, 1); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if f.tunnel, err = loadProgram(f.bans, f.rates, f.dropped, rate); err != nil {
+		f.Close()
+		return nil, err
+	}
+	if rate > 0 { // without it, the public ports have nothing to filter
+		if f.public, err = loadProgram(-1, f.rates, f.dropped, rate); err != nil {
+			f.Close()
+			return nil, err
+		}
+	}
+
+	go f.report(ctx)
+	return f, nil
+}
+
+// Attach attaches the filter to listener, the tunnel one with the bans.
+// Failures are logged, the listener then accepts as it would without it.
+func (f *Filter) Attach(listener net.Listener, tunnel bool) {
+	if f == nil {
+		return
+	}
+	prog := f.public
+	if tunnel {
+		prog = f.tunnel
+	}
+	if prog < 0 {
+		return
+	}
+	tcpListener, ok := utils.TCPListener(listener)
+	if !ok {
+		f.logger.Warnf("kernel_filter can't be attached to %s, not a TCP listener", listener.Addr().String())
+		return
+	}
+	raw, err := tcpListener.SyscallConn()
+	if err != nil {
+		f.logger.Warnf("kernel_filter can't be attached to %s: %v", listener.Addr().String(), err)
+		return
+	}
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, soAttachBPF, prog)
+	})
+	if err == nil && sockErr != nil {
+		err = os.NewSyscallError("setsockopt SO_ATTACH_BPF", sockErr)
+	}
+	if err != nil {
+		f.logger.Warnf("kernel_filter can't be attached to %s: %v", listener.Addr().String(), err)
+		return
+	}
+	f.logger.Debugf("kernel_filter attached to %s", listener.Addr().String())
+}
+
+// Ban drops the SYNs of the address of addr on the tunnel port for d.
+func (f *Filter) Ban(addr string, d time.Duration) {
+	if f == nil {
+		return
+	}
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		host = addr
+	}
+	ip := net.ParseIP(host)
+	if ip == nil {
+		return
+	}
+	key := [16]byte(ip.To16())
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	if err := updateElem(f.bans, key[:], []byte{1}); err != nil {
+		f.logger.Warnf("failed to ban %s in kernel_filter: %v", host, err)
+		return
+	}
+	f.until[key] = time.Now().Add(d)
+	time.AfterFunc(d, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if until, ok := f.until[key]; f.closed || !ok || time.Now().Before(until) {
+			return // banned again in the meantime
+		}
+		delete(f.until, key)
+		deleteElem(f.bans, key[:])
+	})
+}
+
+// Close closes the programs and maps of the filter.
+func (f *Filter) Close() {
+	if f == nil {
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		return
+	}
+	f.closed = true
+	for _, fd := range []int{f.tunnel, f.public, f.bans, f.rates, f.dropped} {
+		if fd >= 0 {
+			syscall.Close(fd)
+		}
+	}
+}
+
+// report logs the SYNs dropped in each minute, and closes the filter with ctx.
+func (f *Filter) report(ctx context.Context) {
+	ticker := time.NewTicker(time.Minute)
+	defer ticker.Stop()
+	var last uint64
+	for {
+		select {
+		case <-ctx.Done():
+			f.Close()
+			return
+		case <-ticker.C:
+			value := make([]byte, 8)
+			f.mu.Lock()
+			err := lookupElem(f.dropped, make([]byte, 4), value)
+			f.mu.Unlock()
+			if err != nil {
+				continue
+			}
+			dropped := binary.NativeEndian.Uint64(value)
+			if dropped > last {
+				f.logger.Warnf("kernel_filter dropped %d SYNs in the last minute", dropped-last)
+			}
+			last = dropped
+		}
+	}
+}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (int, error) {
+	r, _, errno := syscall.Syscall(sysBPF, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return 0, errno
+	}
+	return int(r), nil
+}
+
+// address returns where b starts for an attribute of the bpf call, and pins
+// it there until pinner is unpinned.
+func address(pinner *runtime.Pinner, b []byte) uint64 {
+	pinner.Pin(&b[0])
+	return uint64(uintptr(unsafe.Pointer(&b[0])))
+}
+
+func createMap(mapType, keySize, valueSize, maxEntries uint32) (int, error) {
+	attr := mapCreateAttr{mapType: mapType, keySize: keySize, valueSize: valueSize, maxEntries: maxEntries}
+	fd, err := bpf(cmdMapCreate, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	if err != nil {
+		return -1, os.NewSyscallError("bpf BPF_MAP_CREATE", err)
+	}
+	return fd, nil
+}
+
+func loadProgram(bans, rates, dropped, rate int) (int, error) {
+	insns, err := program(bans, rates, dropped, rate)
+	if err != nil {
+		return -1, err
+	}
+	fd, err := loadInsns(insns, nil)
+	if errors.Is(err, syscall.EACCES) || errors.Is(err, syscall.EINVAL) {
+		// rejected by the verifier, load it again for its log telling why
+		logBuf := make([]byte, verifierLogSize)
+		if _, err := loadInsns(insns, logBuf); err != nil {
+			if n := bytes.IndexByte(logBuf, 0); n > 0 {
+				return -1, fmt.Errorf("bpf BPF_PROG_LOAD: %w: %s", err, bytes.TrimSpace(logBuf[:n]))
+			}
+		}
+	}
+	if err != nil {
+		return -1, os.NewSyscallError("bpf BPF_PROG_LOAD", err)
+	}
+	return fd, nil
+}
+
+func loadInsns(insns, logBuf []byte) (int, error) {
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	attr := progLoadAttr{
+		progType: progTypeSocket,
+		insnCnt:  uint32(len(insns) / 8),
+		insns:    address(&pinner, insns),
+		license:  address(&pinner, license),
+	}
+	if logBuf != nil {
+		attr.logLevel = 1
+		attr.logSize = uint32(len(logBuf))
+		attr.logBuf = address(&pinner, logBuf)
+	}
+	return bpf(cmdProgLoad, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+}
+
+func elem(cmd uintptr, mapFD int, key, value []byte) error {
+	var pinner runtime.Pinner
+	defer pinner.Unpin()
+	attr := mapElemAttr{mapFD: uint32(mapFD), key: address(&pinner, key)}
+	if value != nil {
+		attr.value = address(&pinner, value)
+	}
+	_, err := bpf(cmd, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	return err
+}
+
+func lookupElem(mapFD int, key, value []byte) error {
+	return elem(cmdMapLookupElem, mapFD, key, value)
+}
+
+func updateElem(mapFD int, key, value []byte) error {
+	return elem(cmdMapUpdateElem, mapFD, key, value)
+}
+
+func deleteElem(mapFD int, key []byte) error {
+	return elem(cmdMapDeleteElem, mapFD, key, nil)
+}
@@ -0,0 +1,27 @@
+//go:build !linux
+
+package synfilter
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"runtime"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Filter drops new connections in the kernel on Linux, elsewhere it can't be
+// loaded. A nil Filter does nothing.
+type Filter struct{}
+
+func Load(ctx context.Context, rate int, logger *logrus.Logger) (*Filter, error) {
+	return nil, fmt.Errorf("kernel_filter is not supported on %s", runtime.GOOS)
+}
+
+func (f *Filter) Attach(listener net.Listener, tunnel bool) {}
+
+func (f *Filter) Ban(addr string, d time.Duration) {}
+
+func (f *Filter) Close() {}
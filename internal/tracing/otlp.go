@@ -0,0 +1,142 @@
+package tracing
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	batchSize     = 512             // spans per request
+	queueSize     = 8 * batchSize   // spans waiting for export, more are dropped
+	flushInterval = 5 * time.Second // export partial batches after this long
+)
+
+// otlpExporter sends ended spans in batches as OTLP/HTTP JSON.
+type otlpExporter struct {
+	url     string
+	service string
+	queue   chan spanRecord
+	client  *http.Client
+	logger  *logrus.Logger
+}
+
+// spanRecord is a span in the OTLP JSON encoding.
+type spanRecord struct {
+	TraceID      string         `json:"traceId"`
+	SpanID       string         `json:"spanId"`
+	ParentSpanID string         `json:"parentSpanId,omitempty"`
+	Name         string         `json:"name"`
+	Kind         int            `json:"kind"`
+	Start        string         `json:"startTimeUnixNano"`
+	End          string         `json:"endTimeUnixNano"`
+	Attributes   []keyValue     `json:"attributes,omitempty"`
+	Status       map[string]any `json:"status,omitempty"`
+}
+
+type keyValue struct {
+	Key   string            `json:"key"`
+	Value map[string]string `json:"value"`
+}
+
+func newExporter(endpoint, service string, logger *logrus.Logger) *otlpExporter {
+	return &otlpExporter{
+		url:     strings.TrimSuffix(endpoint, "/") + "/v1/traces",
+		service: service,
+		queue:   make(chan spanRecord, queueSize),
+		client:  &http.Client{Timeout: 10 * time.Second},
+		logger:  logger,
+	}
+}
+
+func (s *Span) record(end time.Time, err error) spanRecord {
+	r := spanRecord{
+		TraceID: hex.EncodeToString(s.traceID[:]),
+		SpanID:  hex.EncodeToString(s.spanID[:]),
+		Name:    s.name,
+		Kind:    1, // internal
+		Start:   strconv.FormatInt(s.start.UnixNano(), 10),
+		End:     strconv.FormatInt(end.UnixNano(), 10),
+	}
+	if s.parentID != [8]byte{} {
+		r.ParentSpanID = hex.EncodeToString(s.parentID[:])
+	}
+	for i := 0; i+1 < len(s.attrs); i += 2 {
+		r.Attributes = append(r.Attributes, keyValue{Key: s.attrs[i], Value: map[string]string{"stringValue": s.attrs[i+1]}})
+	}
+	if err != nil {
+		r.Status = map[string]any{"code": 2, "message": err.Error()}
+	}
+	return r
+}
+
+func (e *otlpExporter) add(r spanRecord) {
+	select {
+	case e.queue <- r:
+	default: // the collector can't keep up, tracing must never block relaying
+	}
+}
+
+func (e *otlpExporter) run(ctx context.Context) {
+	e.logger.Infof("exporting traces to %s", e.url)
+
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+
+	var batch []spanRecord
+	for {
+		select {
+		case r := <-e.queue:
+			batch = append(batch, r)
+			if len(batch) < batchSize {
+				continue
+			}
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+
+		if len(batch) > 0 {
+			if err := e.export(batch); err != nil {
+				e.logger.Debugf("failed to export %d spans: %v", len(batch), err)
+			}
+			batch = nil
+		}
+	}
+}
+
+func (e *otlpExporter) export(spans []spanRecord) error {
+	body, err := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []keyValue{{Key: "service.name", Value: map[string]string{"stringValue": e.service}}},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "backhaul"},
+				"spans": spans,
+			}},
+		}},
+	})
+	if err != nil {
+		return err
+	}
+
+	resp, err := e.client.Post(e.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	if resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status %s", resp.Status)
+	}
+	return nil
+}
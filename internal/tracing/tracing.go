@@ -0,0 +1,86 @@
+// Package tracing records spans of the tunnel lifecycle and exports them with
+// OTLP over HTTP. Without an endpoint it is disabled and all spans are nil.
+package tracing
+
+import (
+	"context"
+	"crypto/rand"
+	"sync/atomic"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+var exporter atomic.Pointer[otlpExporter]
+
+// Init enables tracing and exports the ended spans to the OTLP/HTTP endpoint
+// (e.g. "http://127.0.0.1:4318") until ctx is done.
+func Init(ctx context.Context, endpoint, service string, logger *logrus.Logger) {
+	e := newExporter(endpoint, service, logger)
+	exporter.Store(e)
+	go e.run(ctx)
+}
+
+// Span is a timed operation, nil when tracing is disabled. All methods are
+// safe to call on a nil span.
+type Span struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte
+	name     string
+	start    time.Time
+	attrs    []string // key, value pairs
+	ended    atomic.Bool
+}
+
+// Start begins a new trace with a root span. Attributes are given as key,
+// value pairs.
+func Start(name string, attrs ...string) *Span {
+	if exporter.Load() == nil {
+		return nil
+	}
+
+	s := &Span{name: name, start: time.Now(), attrs: attrs}
+	rand.Read(s.traceID[:])
+	rand.Read(s.spanID[:])
+	return s
+}
+
+// Child begins a span within the trace of s.
+func (s *Span) Child(name string, attrs ...string) *Span {
+	if s == nil {
+		return nil
+	}
+
+	child := &Span{traceID: s.traceID, parentID: s.spanID, name: name, start: time.Now(), attrs: attrs}
+	rand.Read(child.spanID[:])
+	return child
+}
+
+// SetAttr adds an attribute to the span.
+func (s *Span) SetAttr(key, value string) {
+	if s == nil {
+		return
+	}
+	s.attrs = append(s.attrs, key, value)
+}
+
+// End finishes the span, marking it failed if err is not nil. Only the first
+// call has an effect.
+func (s *Span) End(err error) {
+	if s == nil || s.ended.Swap(true) {
+		return
+	}
+	if e := exporter.Load(); e != nil {
+		e.add(s.record(time.Now(), err))
+	}
+}
+
+// Relay runs fn, which relays a forwarded connection and returns why it ended,
+// in a "relay" child span and ends s when it returns.
+func (s *Span) Relay(fn func() string) {
+	relay := s.Child("relay")
+	relay.SetAttr("close_reason", fn())
+	relay.End(nil)
+	s.End(nil)
+}
@@ -0,0 +1,152 @@
+//go:build darwin
+
+package tun
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// from sys/kern_control.h and net/if_utun.h
+const (
+	afSystem        = 32         // AF_SYSTEM
+	afSysControl    = 2          // AF_SYS_CONTROL
+	sysprotoControl = 2          // SYSPROTO_CONTROL
+	ctlIOCGInfo     = 0xc0644e03 // CTLIOCGINFO
+	utunOptIfname   = 2          // UTUN_OPT_IFNAME
+	utunControlName = "com.apple.net.utun_control"
+)
+
+type ctlInfo struct {
+	id   uint32
+	name [96]byte
+}
+
+type sockaddrCtl struct {
+	len      uint8
+	family   uint8
+	sysaddr  uint16
+	id       uint32
+	unit     uint32
+	reserved [5]uint32
+}
+
+// darwinDevice is a utun interface, whose packets start with the address
+// family in 4 bytes.
+type darwinDevice struct {
+	*os.File
+	name string
+}
+
+func (d *darwinDevice) Name() string {
+	return d.name
+}
+
+func (d *darwinDevice) Read(p []byte) (int, error) {
+	buf := make([]byte, len(p)+4)
+	n, err := d.File.Read(buf)
+	if n < 4 {
+		return 0, err
+	}
+	return copy(p, buf[4:n]), err
+}
+
+func (d *darwinDevice) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	family := uint32(syscall.AF_INET)
+	if p[0]>>4 == 6 {
+		family = syscall.AF_INET6
+	}
+	buf := binary.BigEndian.AppendUint32(make([]byte, 0, len(p)+4), family)
+	if _, err := d.File.Write(append(buf, p...)); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// openDevice creates a utun interface, utunN if name is one, the next free
+// one if empty.
+func openDevice(name string) (Device, error) {
+	var unit uint32
+	if name != "" {
+		n, err := strconv.Atoi(strings.TrimPrefix(name, "utun"))
+		if err != nil || !strings.HasPrefix(name, "utun") || n < 0 {
+			return nil, errors.New("tun_name must be utunN on macOS")
+		}
+		unit = uint32(n) + 1
+	}
+
+	fd, err := syscall.Socket(afSystem, syscall.SOCK_DGRAM, sysprotoControl)
+	if err != nil {
+		return nil, os.NewSyscallError("socket", err)
+	}
+	info := ctlInfo{}
+	copy(info.name[:], utunControlName)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), ctlIOCGInfo, uintptr(unsafe.Pointer(&info))); errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("CTLIOCGINFO", errno)
+	}
+	addr := sockaddrCtl{family: afSystem, sysaddr: afSysControl, id: info.id, unit: unit}
+	addr.len = uint8(unsafe.Sizeof(addr))
+	if _, _, errno := syscall.Syscall(syscall.SYS_CONNECT, uintptr(fd), uintptr(unsafe.Pointer(&addr)), unsafe.Sizeof(addr)); errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("connect", errno)
+	}
+
+	ifname := make([]byte, 16)
+	size := uint32(len(ifname))
+	if _, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), sysprotoControl, utunOptIfname, uintptr(unsafe.Pointer(&ifname[0])), uintptr(unsafe.Pointer(&size)), 0); errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("getsockopt", errno)
+	}
+	// non-blocking, so the runtime poller serves it and Close interrupts a Read
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+
+	name = string(ifname[:bytes.IndexByte(ifname, 0)])
+	return &darwinDevice{File: os.NewFile(uintptr(fd), name), name: name}, nil
+}
+
+func configure(name string, cfg Config, logger *logrus.Logger) error {
+	addr := cfg.Addr.Addr()
+	if addr.Is4() {
+		mask := net.IP(net.CIDRMask(cfg.Addr.Bits(), 32)).String()
+		if err := run(logger, "ifconfig", name, "inet", addr.String(), addr.String(), "netmask", mask, "mtu", strconv.Itoa(cfg.MTU), "up"); err != nil {
+			return err
+		}
+	} else {
+		if err := run(logger, "ifconfig", name, "inet6", addr.String(), "prefixlen", strconv.Itoa(cfg.Addr.Bits()), "mtu", strconv.Itoa(cfg.MTU), "up"); err != nil {
+			return err
+		}
+	}
+	routes := slices.Clip(cfg.Routes)
+	if addr.Is4() {
+		// a point-to-point interface, the subnet needs a route of its own
+		routes = append(routes, cfg.Addr.Masked())
+	}
+	for _, route := range routes {
+		family := "-inet"
+		if route.Addr().Is6() {
+			family = "-inet6"
+		}
+		if err := run(logger, "route", "-q", "-n", "add", family, route.String(), "-interface", name); err != nil {
+			return fmt.Errorf("failed to route %s: %w", route, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,69 @@
+//go:build linux
+
+package tun
+
+import (
+	"bytes"
+	"os"
+	"strconv"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// from linux/if_tun.h
+const (
+	tunSetIff = 0x400454ca // TUNSETIFF
+	iffTun    = 0x0001     // IFF_TUN
+	iffNoPi   = 0x1000     // IFF_NO_PI, packets without the 4 byte header
+)
+
+type linuxDevice struct {
+	*os.File
+	name string
+}
+
+func (d *linuxDevice) Name() string {
+	return d.name
+}
+
+// openDevice creates a TUN interface named name, tunN if empty.
+func openDevice(name string) (Device, error) {
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, &os.PathError{Op: "open", Path: "/dev/net/tun", Err: err}
+	}
+
+	// struct ifreq: the name, then the flags
+	var ifr [40]byte
+	copy(ifr[:syscall.IFNAMSIZ-1], name)
+	*(*uint16)(unsafe.Pointer(&ifr[syscall.IFNAMSIZ])) = iffTun | iffNoPi
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&ifr[0]))); errno != 0 {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("TUNSETIFF", errno)
+	}
+	// non-blocking, so the runtime poller serves it and Close interrupts a Read
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		syscall.Close(fd)
+		return nil, os.NewSyscallError("setnonblock", err)
+	}
+
+	name = string(ifr[:bytes.IndexByte(ifr[:syscall.IFNAMSIZ], 0)])
+	return &linuxDevice{File: os.NewFile(uintptr(fd), "/dev/net/tun"), name: name}, nil
+}
+
+func configure(name string, cfg Config, logger *logrus.Logger) error {
+	if err := run(logger, "ip", "address", "add", cfg.Addr.String(), "dev", name); err != nil {
+		return err
+	}
+	if err := run(logger, "ip", "link", "set", "dev", name, "mtu", strconv.Itoa(cfg.MTU), "up"); err != nil {
+		return err
+	}
+	for _, route := range cfg.Routes {
+		if err := run(logger, "ip", "route", "replace", route.String(), "dev", name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
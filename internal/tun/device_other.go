@@ -0,0 +1,18 @@
+//go:build !linux && !darwin && !windows
+
+package tun
+
+import (
+	"fmt"
+	"runtime"
+
+	"github.com/sirupsen/logrus"
+)
+
+func openDevice(name string) (Device, error) {
+	return nil, fmt.Errorf("TUN devices are not supported on %s", runtime.GOOS)
+}
+
+func configure(name string, cfg Config, logger *logrus.Logger) error {
+	return nil
+}
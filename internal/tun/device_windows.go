@@ -0,0 +1,148 @@
+//go:build windows
+
+package tun
+
+import (
+	"errors"
+	"net"
+	"os"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+
+	"github.com/sirupsen/logrus"
+)
+
+// the TUN driver of WireGuard, wintun.dll next to the binary or in the path
+var (
+	wintun                   = syscall.NewLazyDLL("wintun.dll")
+	procCreateAdapter        = wintun.NewProc("WintunCreateAdapter")
+	procCloseAdapter         = wintun.NewProc("WintunCloseAdapter")
+	procStartSession         = wintun.NewProc("WintunStartSession")
+	procEndSession           = wintun.NewProc("WintunEndSession")
+	procGetReadWaitEvent     = wintun.NewProc("WintunGetReadWaitEvent")
+	procReceivePacket        = wintun.NewProc("WintunReceivePacket")
+	procReleaseReceivePacket = wintun.NewProc("WintunReleaseReceivePacket")
+	procAllocateSendPacket   = wintun.NewProc("WintunAllocateSendPacket")
+	procSendPacket           = wintun.NewProc("WintunSendPacket")
+)
+
+const (
+	errorNoMoreItems    = syscall.Errno(259) // ERROR_NO_MORE_ITEMS, nothing to read
+	errorBufferOverflow = syscall.Errno(111) // ERROR_BUFFER_OVERFLOW, the ring is full
+	ringCapacity        = 0x400000           // bytes of the rings of a session
+	readPoll            = 250                // milliseconds a Read waits before it looks for Close
+)
+
+type windowsDevice struct {
+	name    string
+	adapter uintptr
+	session uintptr
+	event   syscall.Handle
+	closed  atomic.Bool
+}
+
+func (d *windowsDevice) Name() string {
+	return d.name
+}
+
+func (d *windowsDevice) Read(p []byte) (int, error) {
+	for !d.closed.Load() {
+		var size uint32
+		r1, _, err := procReceivePacket.Call(d.session, uintptr(unsafe.Pointer(&size)))
+		if r1 == 0 {
+			if err != errorNoMoreItems {
+				return 0, os.NewSyscallError("WintunReceivePacket", err)
+			}
+			syscall.WaitForSingleObject(d.event, readPoll)
+			continue
+		}
+		packet := unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&r1))), size)
+		n := copy(p, packet)
+		procReleaseReceivePacket.Call(d.session, r1)
+		return n, nil
+	}
+	return 0, os.ErrClosed
+}
+
+func (d *windowsDevice) Write(p []byte) (int, error) {
+	if d.closed.Load() {
+		return 0, os.ErrClosed
+	}
+	r1, _, err := procAllocateSendPacket.Call(d.session, uintptr(len(p)))
+	if r1 == 0 {
+		if err == errorBufferOverflow {
+			return 0, nil // the ring is full, the packet is dropped
+		}
+		return 0, os.NewSyscallError("WintunAllocateSendPacket", err)
+	}
+	copy(unsafe.Slice((*byte)(*(*unsafe.Pointer)(unsafe.Pointer(&r1))), len(p)), p)
+	procSendPacket.Call(d.session, r1)
+	return len(p), nil
+}
+
+func (d *windowsDevice) Close() error {
+	if d.closed.Swap(true) {
+		return nil
+	}
+	procEndSession.Call(d.session)
+	procCloseAdapter.Call(d.adapter)
+	return nil
+}
+
+// openDevice creates a wintun adapter named name, backhaul if empty.
+func openDevice(name string) (Device, error) {
+	if err := wintun.Load(); err != nil {
+		return nil, errors.New("wintun.dll was not found, download it from https://www.wintun.net and put it next to backhaul.exe")
+	}
+	if name == "" {
+		name = "backhaul"
+	}
+	name16, err := syscall.UTF16PtrFromString(name)
+	if err != nil {
+		return nil, err
+	}
+	type16, _ := syscall.UTF16PtrFromString("Backhaul")
+
+	adapter, _, err := procCreateAdapter.Call(uintptr(unsafe.Pointer(name16)), uintptr(unsafe.Pointer(type16)), 0)
+	if adapter == 0 {
+		return nil, os.NewSyscallError("WintunCreateAdapter", err)
+	}
+	session, _, err := procStartSession.Call(adapter, ringCapacity)
+	if session == 0 {
+		procCloseAdapter.Call(adapter)
+		return nil, os.NewSyscallError("WintunStartSession", err)
+	}
+	event, _, _ := procGetReadWaitEvent.Call(session)
+	return &windowsDevice{name: name, adapter: adapter, session: session, event: syscall.Handle(event)}, nil
+}
+
+func configure(name string, cfg Config, logger *logrus.Logger) error {
+	addr := cfg.Addr.Addr()
+	family := "ipv4"
+	if addr.Is4() {
+		mask := net.IP(net.CIDRMask(cfg.Addr.Bits(), 32)).String()
+		if err := run(logger, "netsh", "interface", "ipv4", "set", "address", "name="+name, "source=static", "address="+addr.String(), "mask="+mask, "gateway=none"); err != nil {
+			return err
+		}
+	} else {
+		family = "ipv6"
+		if err := run(logger, "netsh", "interface", "ipv6", "add", "address", "interface="+name, "address="+cfg.Addr.String(), "store=active"); err != nil {
+			return err
+		}
+	}
+	if err := run(logger, "netsh", "interface", family, "set", "subinterface", name, "mtu="+strconv.Itoa(cfg.MTU), "store=active"); err != nil {
+		return err
+	}
+	for _, route := range cfg.Routes {
+		family := "ipv4"
+		if route.Addr().Is6() {
+			family = "ipv6"
+		}
+		if err := run(logger, "netsh", "interface", family, "add", "route", "prefix="+route.String(), "interface="+name, "store=active"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+// Package tun moves the IP packets of a TUN device over the tunnel, so a
+// client exposes a whole subnet instead of single ports, like a site-to-site
+// VPN. Both ends open a device. The server hands its transport a connection
+// that carries the packets as if a public connection came for Port, and the
+// client takes the tunnel connections for Port to its own device.
+package tun
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/netip"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+// Port is the target port the server sends the packets of its device to. The
+// ports below it are taken by SpeedtestPort, the mux control ports and
+// StreamMetaPort. Like the others up to utils.MaxReservedPort, no public port
+// can target it.
+const Port = 8
+
+// DefaultMTU of a device without tun_mtu, leaving room for the headers of the
+// tunnel connection on a 1500 byte path.
+const DefaultMTU = 1400
+
+// queued is how many packets read from the device may wait for the tunnel
+// before more are dropped, as a router with a full queue would.
+const queued = 512
+
+// Config of a TUN device.
+type Config struct {
+	Name   string         // of the interface, picked by the system when empty
+	Addr   netip.Prefix   // address of this end, in the subnet of the link
+	MTU    int            // DefaultMTU when 0
+	Routes []netip.Prefix // subnets behind the other end
+}
+
+// ParseConfig returns the Config of tun_name, tun_addr, tun_mtu and tun_routes.
+func ParseConfig(name, addr string, mtu int, routes []string) (Config, error) {
+	prefix, err := netip.ParsePrefix(addr)
+	if err != nil {
+		return Config{}, fmt.Errorf("invalid tun_addr %q, it takes the length of the subnet like 10.8.0.1/24: %w", addr, err)
+	}
+	cfg := Config{Name: name, Addr: prefix, MTU: mtu}
+	for _, route := range routes {
+		prefix, err := netip.ParsePrefix(route)
+		if err != nil {
+			return Config{}, fmt.Errorf("invalid route %q in tun_routes: %w", route, err)
+		}
+		cfg.Routes = append(cfg.Routes, prefix.Masked())
+	}
+	return cfg, nil
+}
+
+// Device is an open TUN device, each Read and Write is one IP packet.
+type Device interface {
+	io.ReadWriteCloser
+	Name() string
+}
+
+// Open creates the TUN device of cfg and sets its address, MTU and routes.
+// It needs root, or CAP_NET_ADMIN on Linux. Closing the device removes it.
+func Open(cfg Config, logger *logrus.Logger) (Device, error) {
+	if cfg.MTU <= 0 {
+		cfg.MTU = DefaultMTU
+	}
+	dev, err := openDevice(cfg.Name)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open TUN device: %w", err)
+	}
+	if err := configure(dev.Name(), cfg, logger); err != nil {
+		dev.Close()
+		return nil, fmt.Errorf("failed to configure TUN device %s: %w", dev.Name(), err)
+	}
+	logger.Infof("TUN device %s is up with address %s", dev.Name(), cfg.Addr)
+	return dev, nil
+}
+
+// run runs a command that configures a device.
+func run(logger *logrus.Logger, name string, args ...string) error {
+	command := name + " " + strings.Join(args, " ")
+	logger.Debugf("running %s", command)
+	if out, err := exec.Command(name, args...).CombinedOutput(); err != nil {
+		return fmt.Errorf("%s: %v: %s", command, err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
+
+// Link carries the packets of a device over one tunnel connection at a time,
+// each as its length in two bytes and the packet.
+type Link struct {
+	dev     Device
+	addr    net.IP // of the device, the connections handed to the server transport come from it
+	logger  *logrus.Logger
+	out     chan []byte   // read from the device and framed, waiting for the tunnel
+	conns   chan net.Conn // taken by the server transport
+	dropped atomic.Int64
+
+	mu     sync.Mutex
+	active io.Closer // of the client, the tunnel connection in use
+}
+
+// NewLink starts reading packets from dev, opened with cfg.
+func NewLink(dev Device, cfg Config, logger *logrus.Logger) *Link {
+	l := &Link{
+		dev:    dev,
+		addr:   cfg.Addr.Addr().AsSlice(),
+		logger: logger,
+		out:    make(chan []byte, queued),
+		conns:  make(chan net.Conn),
+	}
+	mtu := cfg.MTU
+	if mtu <= 0 {
+		mtu = DefaultMTU
+	}
+	go l.readDevice(mtu)
+	return l
+}
+
+// Start opens the device of cfg and returns its Link, which is closed with
+// ctx.
+func Start(ctx context.Context, cfg Config, logger *logrus.Logger) (*Link, error) {
+	dev, err := Open(cfg, logger)
+	if err != nil {
+		return nil, err
+	}
+	l := NewLink(dev, cfg, logger)
+	context.AfterFunc(ctx, func() { l.Close() })
+	return l, nil
+}
+
+// Conns returns the channel the server transport takes the connections for
+// the packets from, like the queue of a public port.
+func (l *Link) Conns() chan net.Conn {
+	return l.conns
+}
+
+// Run hands the server transport a connection for the packets, and another
+// one whenever it ended, until ctx is done.
+func (l *Link) Run(ctx context.Context) {
+	utils.ServePipes(ctx, l.conns, 1, Port, l.addr, func(conn net.Conn, release func()) {
+		l.logger.Debugf("carrying the packets of %s over the tunnel", l.dev.Name())
+		err := l.carry(conn)
+		if ctx.Err() == nil {
+			l.logger.Debugf("tunnel connection for the packets of %s ended: %v", l.dev.Name(), err)
+		}
+	})
+}
+
+// Serve carries the packets over conn, a tunnel connection the server opened
+// for Port, until it breaks. It takes over from the connection before, which
+// the server gave up on.
+func (l *Link) Serve(conn io.ReadWriteCloser) {
+	l.mu.Lock()
+	if l.active != nil {
+		l.active.Close()
+	}
+	l.active = conn
+	l.mu.Unlock()
+
+	l.logger.Infof("TUN device %s is linked to the server", l.dev.Name())
+	err := l.carry(conn)
+
+	l.mu.Lock()
+	if l.active == conn {
+		l.active = nil
+		l.logger.Infof("TUN device %s lost the server: %v", l.dev.Name(), err)
+	}
+	l.mu.Unlock()
+}
+
+// carry moves packets between the device and conn until conn breaks. Those
+// read from the device meanwhile are sent over the next one.
+func (l *Link) carry(conn io.ReadWriteCloser) error {
+	defer conn.Close()
+	done := make(chan struct{})
+	defer close(done)
+
+	go func() {
+		defer conn.Close()
+		w := bufio.NewWriterSize(conn, 64<<10)
+		for {
+			select {
+			case packet := <-l.out:
+				w.Write(packet)
+				// send the packets that queued up meanwhile in one go
+				for len(l.out) > 0 && w.Buffered() < 32<<10 {
+					w.Write(<-l.out)
+				}
+				if err := w.Flush(); err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+
+	r := bufio.NewReaderSize(conn, 64<<10)
+	packet := make([]byte, 0xffff)
+	for {
+		var size [2]byte
+		if _, err := io.ReadFull(r, size[:]); err != nil {
+			return err
+		}
+		n := binary.BigEndian.Uint16(size[:])
+		if _, err := io.ReadFull(r, packet[:n]); err != nil {
+			return err
+		}
+		if _, err := l.dev.Write(packet[:n]); err != nil {
+			l.logger.Debugf("failed to write a packet to %s: %v", l.dev.Name(), err)
+		}
+	}
+}
+
+// readDevice frames the packets read from the device until it is closed.
+func (l *Link) readDevice(mtu int) {
+	for {
+		buf := make([]byte, 2+mtu)
+		n, err := l.dev.Read(buf[2:])
+		if err != nil {
+			if !errors.Is(err, os.ErrClosed) {
+				l.logger.Errorf("failed to read from TUN device %s: %v", l.dev.Name(), err)
+			}
+			return
+		}
+		if n == 0 {
+			continue
+		}
+		binary.BigEndian.PutUint16(buf, uint16(n))
+		select {
+		case l.out <- buf[:2+n]:
+		default:
+			if l.dropped.Add(1)%1000 == 1 {
+				l.logger.Warnf("dropping packets of %s, the tunnel is down or doesn't keep up", l.dev.Name())
+			}
+		}
+	}
+}
+
+// Close closes the device, which removes it.
+func (l *Link) Close() error {
+	return l.dev.Close()
+}
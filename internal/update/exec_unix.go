@@ -0,0 +1,30 @@
+//go:build unix
+
+package update
+
+import (
+	"os"
+	"strings"
+	"syscall"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+)
+
+const canExec = true
+
+// Exec replaces the process with the installed release, run with the same
+// arguments. The new process takes over clientID, so the server sees the
+// client reconnect rather than a new one.
+func Exec(clientID string) error {
+	executable, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	env := []string{utils.ClientIDEnv + "=" + clientID}
+	for _, v := range os.Environ() {
+		if !strings.HasPrefix(v, utils.ClientIDEnv+"=") {
+			env = append(env, v)
+		}
+	}
+	return syscall.Exec(executable, os.Args, env)
+}
@@ -0,0 +1,11 @@
+package update
+
+import "errors"
+
+// a running executable can't replace itself on Windows
+const canExec = false
+
+// Exec fails, see canExec.
+func Exec(clientID string) error {
+	return errors.New("not supported on Windows")
+}
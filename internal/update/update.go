@@ -0,0 +1,354 @@
+// Package update replaces the binary of a client with the release named by a
+// signed manifest and runs the new one. The manifest lists a version and the
+// binaries built for it, each with its SHA-256, and is signed with ed25519:
+// the signature is served next to it with ".sig" appended to its URL. A
+// client only trusts a manifest signed with its update_key, and a binary
+// with the hash the manifest gives.
+package update
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/utils"
+
+	"github.com/sirupsen/logrus"
+)
+
+const (
+	maxManifest = 1 << 20   // bytes
+	maxBinary   = 256 << 20 // bytes
+
+	manifestTimeout = 30 * time.Second
+	binaryTimeout   = 10 * time.Minute
+)
+
+// Manifest describes a release.
+type Manifest struct {
+	Version  string            `json:"version"`
+	Binaries map[string]Binary `json:"binaries"` // by GOOS/GOARCH, e.g. "linux/amd64"
+}
+
+// Binary is the executable of a release for one platform.
+type Binary struct {
+	URL    string `json:"url"`    // absolute, or relative to the manifest
+	SHA256 string `json:"sha256"` // hex
+}
+
+// GenerateKey returns a new base64 encoded private key for signing manifests
+// and the public key for update_key.
+func GenerateKey() (string, string, error) {
+	public, private, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.StdEncoding.EncodeToString(private.Seed()), base64.StdEncoding.EncodeToString(public), nil
+}
+
+// Sign returns the base64 encoded signature of manifest, as served at its
+// URL with ".sig" appended.
+func Sign(private string, manifest []byte) (string, error) {
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(private))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return "", errors.New("invalid private key")
+	}
+	if err := json.Unmarshal(manifest, &Manifest{}); err != nil {
+		return "", fmt.Errorf("invalid manifest: %w", err)
+	}
+	return base64.StdEncoding.EncodeToString(ed25519.Sign(ed25519.NewKeyFromSeed(seed), manifest)), nil
+}
+
+// ParseKey decodes update_key.
+func ParseKey(key string) (ed25519.PublicKey, error) {
+	public, err := base64.StdEncoding.DecodeString(key)
+	if err != nil || len(public) != ed25519.PublicKeySize {
+		return nil, errors.New("invalid update_key, it must be the base64 public key printed by \"backhaul update-key\"")
+	}
+	return public, nil
+}
+
+// Updater checks the manifest now and then and installs a newer release.
+type Updater struct {
+	url      string
+	key      ed25519.PublicKey
+	interval time.Duration
+	logger   *logrus.Logger
+	done     chan struct{}
+}
+
+// New returns an updater for the manifest at manifestURL signed with key,
+// checked every interval.
+func New(manifestURL, key string, interval time.Duration, logger *logrus.Logger) (*Updater, error) {
+	if !canExec {
+		return nil, fmt.Errorf("update_url is not supported on %s", runtime.GOOS)
+	}
+	if _, err := url.Parse(manifestURL); err != nil {
+		return nil, fmt.Errorf("invalid update_url: %w", err)
+	}
+	public, err := ParseKey(key)
+	if err != nil {
+		return nil, err
+	}
+	return &Updater{url: manifestURL, key: public, interval: interval, logger: logger, done: make(chan struct{})}, nil
+}
+
+// Done is closed once a new release was installed, to be run with Exec.
+func (u *Updater) Done() <-chan struct{} {
+	return u.done
+}
+
+// Run checks for a release once a minute after the start and every interval
+// after that, until one was installed or ctx is done.
+func (u *Updater) Run(ctx context.Context) {
+	timer := time.NewTimer(time.Minute)
+	defer timer.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-timer.C:
+		}
+
+		installed, err := u.check(ctx)
+		if err != nil {
+			u.logger.Warnf("update check failed: %v", err)
+		}
+		if installed {
+			close(u.done)
+			return
+		}
+		timer.Reset(u.interval)
+	}
+}
+
+// check fetches the manifest and installs its release if it is newer than the
+// one running.
+func (u *Updater) check(ctx context.Context) (bool, error) {
+	manifest, err := u.manifest(ctx)
+	if err != nil {
+		return false, err
+	}
+	release, ok := parseVersion(manifest.Version)
+	if !ok {
+		return false, fmt.Errorf("the manifest names %q, not a semantic version like v1.2.3", manifest.Version)
+	}
+	current, ok := parseVersion(utils.Version)
+	if !ok {
+		u.logger.Debugf("no update, %s isn't a release", utils.Version)
+		return false, nil
+	}
+	if release.compare(current) <= 0 {
+		u.logger.Debugf("no update, %s is current and the manifest names %s", utils.Version, manifest.Version)
+		return false, nil
+	}
+	platform := runtime.GOOS + "/" + runtime.GOARCH
+	binary, ok := manifest.Binaries[platform]
+	if !ok {
+		return false, fmt.Errorf("release %s has no binary for %s", manifest.Version, platform)
+	}
+
+	u.logger.Infof("updating from %s to %s", utils.Version, manifest.Version)
+	if err := u.install(ctx, manifest.Version, binary); err != nil {
+		return false, fmt.Errorf("failed to install %s: %w", manifest.Version, err)
+	}
+	u.logger.Infof("installed %s", manifest.Version)
+	return true, nil
+}
+
+// version is a semantic version, as in https://semver.org.
+type version struct {
+	core [3]int   // major, minor and patch
+	pre  []string // identifiers of a pre-release, none for a release
+}
+
+// parseVersion parses a semantic version, with or without a "v" prefix. The
+// build metadata after "+" is ignored.
+func parseVersion(s string) (version, bool) {
+	var v version
+	s = strings.TrimPrefix(s, "v")
+	s, _, _ = strings.Cut(s, "+")
+	s, pre, hasPre := strings.Cut(s, "-")
+	parts := strings.Split(s, ".")
+	if len(parts) != 3 {
+		return v, false
+	}
+	for i, part := range parts {
+		n, ok := versionNumber(part)
+		if !ok {
+			return v, false
+		}
+		v.core[i] = n
+	}
+	if hasPre {
+		v.pre = strings.Split(pre, ".")
+		for _, id := range v.pre {
+			if id == "" {
+				return v, false
+			}
+		}
+	}
+	return v, true
+}
+
+// versionNumber parses a numeric identifier, which has no leading zeros.
+func versionNumber(s string) (int, bool) {
+	if s == "" || len(s) > 1 && s[0] == '0' || strings.Trim(s, "0123456789") != "" {
+		return 0, false
+	}
+	n, err := strconv.Atoi(s)
+	return n, err == nil
+}
+
+// compare returns -1, 0 or 1 as v is older than, the same as or newer than
+// other. A pre-release is older than its release, and its identifiers are
+// compared in turn, the numeric ones as numbers and before the others.
+func (v version) compare(other version) int {
+	if c := slices.Compare(v.core[:], other.core[:]); c != 0 {
+		return c
+	}
+	switch {
+	case len(v.pre) == 0 && len(other.pre) == 0:
+		return 0
+	case len(v.pre) == 0:
+		return 1
+	case len(other.pre) == 0:
+		return -1
+	}
+	for i := 0; i < len(v.pre) && i < len(other.pre); i++ {
+		a, aNumeric := versionNumber(v.pre[i])
+		b, bNumeric := versionNumber(other.pre[i])
+		var c int
+		switch {
+		case aNumeric && bNumeric:
+			c = cmp.Compare(a, b)
+		case aNumeric:
+			c = -1
+		case bNumeric:
+			c = 1
+		default:
+			c = strings.Compare(v.pre[i], other.pre[i])
+		}
+		if c != 0 {
+			return c
+		}
+	}
+	return cmp.Compare(len(v.pre), len(other.pre))
+}
+
+// manifest fetches the manifest and checks its signature.
+func (u *Updater) manifest(ctx context.Context) (Manifest, error) {
+	var manifest Manifest
+	data, err := fetch(ctx, u.url, maxManifest, manifestTimeout)
+	if err != nil {
+		return manifest, err
+	}
+	encoded, err := fetch(ctx, u.url+".sig", maxManifest, manifestTimeout)
+	if err != nil {
+		return manifest, err
+	}
+	signature, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(encoded)))
+	if err != nil || !ed25519.Verify(u.key, data, signature) {
+		return manifest, errors.New("the signature of the manifest doesn't match update_key")
+	}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return manifest, fmt.Errorf("invalid manifest: %w", err)
+	}
+	return manifest, nil
+}
+
+// install downloads binary, checks it and puts it in place of the running
+// executable, which is kept with ".old" appended.
+func (u *Updater) install(ctx context.Context, version string, binary Binary) error {
+	base, err := url.Parse(u.url)
+	if err != nil {
+		return err
+	}
+	ref, err := url.Parse(binary.URL)
+	if err != nil {
+		return err
+	}
+	data, err := fetch(ctx, base.ResolveReference(ref).String(), maxBinary, binaryTimeout)
+	if err != nil {
+		return err
+	}
+	sum := sha256.Sum256(data)
+	if !strings.EqualFold(hex.EncodeToString(sum[:]), binary.SHA256) {
+		return errors.New("the binary doesn't match the SHA-256 of the manifest")
+	}
+
+	current, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	if current, err = filepath.EvalSymlinks(current); err != nil {
+		return err
+	}
+	// next to the executable, so it can be renamed over it in one step
+	next := current + ".new"
+	if err := os.WriteFile(next, data, 0o755); err != nil {
+		return err
+	}
+	out, err := exec.CommandContext(ctx, next, "-v").Output()
+	if got := strings.TrimSpace(string(out)); err != nil || got != version {
+		os.Remove(next)
+		return fmt.Errorf("the new binary reports version %q instead of %s: %v", got, version, err)
+	}
+
+	old := current + ".old"
+	os.Remove(old)
+	if err := os.Link(current, old); err != nil {
+		u.logger.Debugf("failed to keep the old binary as %s: %v", old, err)
+	}
+	if err := os.Rename(next, current); err != nil {
+		os.Remove(next)
+		return err
+	}
+	return nil
+}
+
+// fetch returns the body of rawURL, up to limit bytes.
+func fetch(ctx context.Context, rawURL string, limit int64, timeout time.Duration) ([]byte, error) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, rawURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("User-Agent", "backhaul/"+utils.Version)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("%s: %s", rawURL, resp.Status)
+	}
+
+	var body bytes.Buffer
+	if n, err := io.Copy(&body, io.LimitReader(resp.Body, limit+1)); err != nil {
+		return nil, err
+	} else if n > limit {
+		return nil, fmt.Errorf("%s: larger than %d bytes", rawURL, limit)
+	}
+	return body.Bytes(), nil
+}
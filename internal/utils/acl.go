@@ -0,0 +1,98 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+)
+
+// TargetACL is an allowlist of IP addresses, CIDRs and host names.
+type TargetACL struct {
+	mu    sync.RWMutex
+	nets  []*net.IPNet
+	hosts map[string]struct{}
+}
+
+// ParseTargetACL parses allowlist entries, each an IP address ("10.0.0.5"), a
+// CIDR ("192.168.1.0/24") or a host name ("backend.local").
+func ParseTargetACL(entries []string) (*TargetACL, error) {
+	acl := &TargetACL{hosts: make(map[string]struct{})}
+	for _, entry := range entries {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			return nil, fmt.Errorf("empty target")
+		}
+
+		if strings.Contains(entry, "/") {
+			_, ipNet, err := net.ParseCIDR(entry)
+			if err != nil {
+				return nil, fmt.Errorf("invalid target %q: %w", entry, err)
+			}
+			acl.nets = append(acl.nets, ipNet)
+		} else if ip := net.ParseIP(entry); ip != nil {
+			acl.nets = append(acl.nets, &net.IPNet{IP: ip, Mask: net.CIDRMask(len(ip)*8, len(ip)*8)})
+		} else {
+			acl.hosts[strings.ToLower(entry)] = struct{}{}
+		}
+	}
+	return acl, nil
+}
+
+// Allows reports whether a target given as host and resolved to ip is in the
+// allowlist, either by its host name or by its address.
+func (a *TargetACL) Allows(host string, ip net.IP) bool {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	if _, ok := a.hosts[strings.ToLower(host)]; ok {
+		return true
+	}
+	for _, ipNet := range a.nets {
+		if ipNet.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Replace swaps the entries of the allowlist for those of other, for the
+// connections checked from now on.
+func (a *TargetACL) Replace(other *TargetACL) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.nets, a.hosts = other.nets, other.hosts
+}
+
+// ResolveTarget resolves address and checks it against the allowlist. It
+// returns the resolved addresses that are allowed, so the dial can't resolve
+// to another IP. Host names may have several, to be tried in turn.
+func ResolveTarget(address string, acl *TargetACL) ([]string, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" { // no host, dialed on the local system
+		if !acl.Allows(host, net.IPv4(127, 0, 0, 1)) {
+			return nil, fmt.Errorf("%s is not in allowed_targets", net.IPv4(127, 0, 0, 1))
+		}
+		return []string{address}, nil
+	}
+
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = targetResolver.lookup(host); err != nil {
+			return nil, err
+		}
+	}
+
+	var addresses []string
+	for _, ip := range ips {
+		if acl.Allows(host, ip) {
+			addresses = append(addresses, net.JoinHostPort(ip.String(), port))
+		}
+	}
+	if len(addresses) == 0 {
+		return nil, fmt.Errorf("%s is not in allowed_targets", ips[0])
+	}
+	return addresses, nil
+}
@@ -0,0 +1,51 @@
+//go:build unix
+
+package utils
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+)
+
+const listenFdsStart = 3 // first file descriptor passed by systemd
+
+// RegisterActivationListeners registers the listening sockets passed by systemd
+// socket activation (LISTEN_PID/LISTEN_FDS) and returns how many were found.
+func RegisterActivationListeners() (int, error) {
+	pid, err := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	if err != nil || pid != os.Getpid() {
+		return 0, nil
+	}
+
+	count, err := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	if err != nil || count <= 0 {
+		return 0, nil
+	}
+
+	// don't pass them on to child processes
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+
+	for fd := listenFdsStart; fd < listenFdsStart+count; fd++ {
+		syscall.CloseOnExec(fd)
+
+		file := os.NewFile(uintptr(fd), "LISTEN_FD_"+strconv.Itoa(fd))
+		listener, err := net.FileListener(file)
+		file.Close()
+		if err != nil {
+			return 0, fmt.Errorf("socket activation fd %d is not a listening socket: %w", fd, err)
+		}
+
+		tcpListener, ok := listener.(*net.TCPListener)
+		if !ok {
+			listener.Close()
+			return 0, fmt.Errorf("socket activation fd %d is not a TCP socket", fd)
+		}
+		AddListener(tcpListener.Addr().String(), tcpListener)
+	}
+	return count, nil
+}
@@ -0,0 +1,6 @@
+package utils
+
+// RegisterActivationListeners is a no-op, socket activation is systemd only.
+func RegisterActivationListeners() (int, error) {
+	return 0, nil
+}
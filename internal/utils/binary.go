@@ -4,6 +4,7 @@ import (
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"net"
 
 	"github.com/gorilla/websocket"
@@ -32,11 +33,8 @@ func ReceiveBinaryString(conn net.Conn) (string, error) {
 		return "", fmt.Errorf("failed to read message length: %w", err)
 	}
 
-	// Decode the length of the message from the 2-byte buffer
-	messageLength := binary.BigEndian.Uint16(lenBuf)
-
 	// Create a buffer of the appropriate size to hold the message
-	messageBuf := make([]byte, messageLength)
+	messageBuf := make([]byte, binary.BigEndian.Uint16(lenBuf))
 
 	// Read the message data into the buffer
 	if _, err := io.ReadFull(conn, messageBuf); err != nil {
@@ -48,14 +46,8 @@ func ReceiveBinaryString(conn net.Conn) (string, error) {
 
 // SendPort sends the port number as a 2-byte big-endian unsigned integer.
 func SendBinaryInt(conn net.Conn, port uint16) error {
-	// Create a 2-byte slice to hold the port number
-	buf := make([]byte, 2)
-
-	// Encode the port number as a big-endian 2-byte unsigned integer
-	binary.BigEndian.PutUint16(buf, port)
-
 	// Send the 2-byte buffer over the connection
-	if _, err := conn.Write(buf); err != nil {
+	if _, err := conn.Write(EncodeBinaryInt(port)); err != nil {
 		return fmt.Errorf("failed to send port number %d: %w", port, err)
 	}
 
@@ -64,14 +56,10 @@ func SendBinaryInt(conn net.Conn, port uint16) error {
 }
 
 func SendBinaryString(conn net.Conn, message string) error {
-	// Create a buffer with the appropriate size for the message
-	buf := make([]byte, 2+len(message))
-
-	// Encode the length of the message as a big-endian 2-byte unsigned integer
-	binary.BigEndian.PutUint16(buf[:2], uint16(len(message)))
-
-	// Copy the message into the buffer after the length
-	copy(buf[2:], message)
+	buf, err := EncodeBinaryString(message)
+	if err != nil {
+		return err
+	}
 
 	// Send the buffer over the connection
 	if _, err := conn.Write(buf); err != nil {
@@ -84,30 +72,57 @@ func SendBinaryString(conn net.Conn, message string) error {
 
 // ReceiveWebSocketInt reads a 2-byte big-endian unsigned integer from the WebSocket connection.
 func ReceiveWebSocketInt(conn *websocket.Conn) (uint16, error) {
-	var port uint16
-
 	_, message, err := conn.ReadMessage()
 	if err != nil {
 		return 0, fmt.Errorf("failed to read message: %w", err)
 	}
 
-	if len(message) < 2 {
-		return 0, fmt.Errorf("message too short to contain a valid port number")
-	}
-
-	port = binary.BigEndian.Uint16(message[:2])
-	return port, nil
+	return DecodeBinaryInt(message)
 }
 
 // SendWebSocketInt sends the port number as a 2-byte big-endian unsigned integer over a WebSocket connection.
 func SendWebSocketInt(conn *websocket.Conn, port uint16) error {
-	buf := make([]byte, 2)
-	binary.BigEndian.PutUint16(buf, port)
-
-	err := conn.WriteMessage(websocket.BinaryMessage, buf)
+	err := conn.WriteMessage(websocket.BinaryMessage, EncodeBinaryInt(port))
 	if err != nil {
 		return fmt.Errorf("failed to send port number %d: %w", port, err)
 	}
 
 	return nil
 }
+
+// EncodeBinaryInt returns port as a 2-byte big-endian unsigned integer.
+func EncodeBinaryInt(port uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, port)
+}
+
+// DecodeBinaryInt reads a 2-byte big-endian unsigned integer from the start of
+// b, as sent by the peer.
+func DecodeBinaryInt(b []byte) (uint16, error) {
+	if len(b) < 2 {
+		return 0, fmt.Errorf("message too short to contain a valid port number")
+	}
+	return binary.BigEndian.Uint16(b), nil
+}
+
+// EncodeBinaryString returns message prefixed with its 2-byte big-endian
+// length. Longer messages than the prefix can tell are refused rather than cut.
+func EncodeBinaryString(message string) ([]byte, error) {
+	if len(message) > math.MaxUint16 {
+		return nil, fmt.Errorf("message of %d bytes is too long to send", len(message))
+	}
+	buf := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(message)), uint16(len(message)))
+	return append(buf, message...), nil
+}
+
+// DecodeBinaryString reads a length-prefixed message from the start of b, as
+// sent by the peer, and returns it with the number of bytes it took.
+func DecodeBinaryString(b []byte) (string, int, error) {
+	if len(b) < 2 {
+		return "", 0, fmt.Errorf("failed to read message length: %w", io.ErrUnexpectedEOF)
+	}
+	n := 2 + int(binary.BigEndian.Uint16(b))
+	if len(b) < n {
+		return "", 0, fmt.Errorf("failed to read message: %w", io.ErrUnexpectedEOF)
+	}
+	return string(b[2:n]), n, nil
+}
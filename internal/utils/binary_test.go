@@ -0,0 +1,52 @@
+package utils
+
+import (
+	"bytes"
+	"testing"
+)
+
+func FuzzDecodeBinaryInt(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x01})
+	f.Add([]byte{0x1f, 0x90})
+	f.Add([]byte{0xff, 0xff, 0x00})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		port, err := DecodeBinaryInt(b)
+		if len(b) < 2 {
+			if err == nil {
+				t.Fatalf("decoded %d from %d bytes", port, len(b))
+			}
+			return
+		}
+		if err != nil {
+			t.Fatalf("failed to decode %x: %v", b, err)
+		}
+		if encoded := EncodeBinaryInt(port); !bytes.Equal(encoded, b[:2]) {
+			t.Fatalf("decoded %d from %x, encoded back as %x", port, b[:2], encoded)
+		}
+	})
+}
+
+func FuzzDecodeBinaryString(f *testing.F) {
+	f.Add([]byte{})
+	f.Add([]byte{0x00, 0x00})
+	f.Add([]byte{0x00, 0x05, 'h', 'e', 'l', 'l', 'o'})
+	f.Add([]byte{0x00, 0x05, 'h', 'e'})
+	f.Add([]byte{0x00, 0x02, 'h', 'i', 'x'})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		message, n, err := DecodeBinaryString(b)
+		if err != nil {
+			return
+		}
+		if n != 2+len(message) || n > len(b) {
+			t.Fatalf("decoded %q taking %d of %d bytes", message, n, len(b))
+		}
+		encoded, err := EncodeBinaryString(message)
+		if err != nil {
+			t.Fatalf("failed to encode %q back: %v", message, err)
+		}
+		if !bytes.Equal(encoded, b[:n]) {
+			t.Fatalf("decoded %q from %x, encoded back as %x", message, b[:n], encoded)
+		}
+	})
+}
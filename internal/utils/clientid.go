@@ -0,0 +1,37 @@
+package utils
+
+import (
+	"crypto/rand"
+	"fmt"
+	"strings"
+)
+
+// ClientIDHeader carries the client ID on WebSocket handshakes.
+const ClientIDHeader = "X-Backhaul-Client"
+
+// ClientIDEnv hands the client ID to the new process after a self-update.
+const ClientIDEnv = "BACKHAUL_CLIENT_ID"
+
+// the control channel message of a tcp client with its ID, sent after the token
+const clientIDPrefix = "client-id "
+
+// NewClientID returns a random version 4 UUID for a client that has no
+// client_id configured.
+func NewClientID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// ClientIDMessage returns the control channel message announcing id.
+func ClientIDMessage(id string) string {
+	return clientIDPrefix + id
+}
+
+// ParseClientID returns the ID announced by msg, if it is a ClientIDMessage.
+func ParseClientID(msg string) (string, bool) {
+	id, ok := strings.CutPrefix(msg, clientIDPrefix)
+	return id, ok && id != ""
+}
@@ -0,0 +1,91 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"strconv"
+	"syscall"
+
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// Why a relay ended, as logged, traced and counted in backhaul_port_closes_total.
+const (
+	closeFin     = "fin"     // closed normally
+	closePeer    = "peer"    // torn down by the other end of the tunnel
+	closeError   = "error"   // a read or write failed
+	closeTimeout = "timeout" // nothing read within the read timeout
+	closeReset   = "reset"   // reset by either side
+	closePanic   = "panic"   // the relay panicked, see Recover
+)
+
+// the more telling reason wins when the two directions disagree
+var reasonRank = map[string]int{"": 0, closeFin: 1, closePeer: 2, closeError: 3, closeTimeout: 4, closeReset: 5, closePanic: 6}
+
+func worseReason(a, b string) string {
+	if reasonRank[b] > reasonRank[a] {
+		a = b
+	}
+	if a == "" {
+		return closeFin
+	}
+	return a
+}
+
+func readReason(err error) string {
+	switch {
+	case errors.Is(err, io.EOF):
+		return closeFin
+	case errors.Is(err, net.ErrClosed):
+		return ""
+	case errors.Is(err, errMuxStreamClosed):
+		return closePeer
+	case errors.Is(err, os.ErrDeadlineExceeded):
+		return closeTimeout
+	default:
+		return closeError
+	}
+}
+
+func writeReason(err error) string {
+	if errors.Is(err, net.ErrClosed) {
+		return ""
+	}
+	return closeError
+}
+
+// isReset reports whether err comes from a connection reset by its peer.
+func isReset(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET)
+}
+
+// ResetConn closes conn with a reset instead of a FIN, so a reset on one side
+// of the relay reaches the other: TCP connections get SO_LINGER 0, mux streams
+// pass it on to the peer.
+func ResetConn(conn net.Conn) {
+	for {
+		switch c := conn.(type) {
+		case *net.TCPConn:
+			c.SetLinger(0)
+			c.Close()
+			return
+		case interface{ Reset() error }:
+			c.Reset()
+			return
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			conn.Close()
+			return
+		}
+	}
+}
+
+func logRelayEnd(logger *logrus.Logger, usage *web.Usage, remotePort int, reason string) {
+	port := strconv.Itoa(remotePort)
+	usage.IncCounter("backhaul_port_closes_total", "port", port, "reason", reason)
+	logger.Debugf("relay on port %d ended: %s", remotePort, reason)
+}
@@ -0,0 +1,56 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+)
+
+// CommandsMessage is sent by a tcp client with remote_management on the
+// control channel after its ID. The server may then send it commands on the
+// control channel, which older clients take for a broken channel.
+const CommandsMessage = "commands"
+
+// CommandsHeader is set on the WebSocket handshake of the control channel by
+// a client with remote_management.
+const CommandsHeader = "X-Backhaul-Commands"
+
+// the control channel messages with a command of the server and the result
+// of the client, as JSON
+const (
+	commandPrefix = "command "
+	resultPrefix  = "result "
+)
+
+// CommandMessage returns the control channel message sending command.
+func CommandMessage(command control.ClientCommand) string {
+	payload, _ := json.Marshal(command)
+	return commandPrefix + string(payload)
+}
+
+// ParseCommand returns the command sent by msg, if it is a CommandMessage.
+func ParseCommand(msg string) (control.ClientCommand, bool) {
+	var command control.ClientCommand
+	payload, ok := strings.CutPrefix(msg, commandPrefix)
+	if !ok || json.Unmarshal([]byte(payload), &command) != nil {
+		return command, false
+	}
+	return command, true
+}
+
+// ResultMessage returns the control channel message answering a command.
+func ResultMessage(result control.ClientResult) string {
+	payload, _ := json.Marshal(result)
+	return resultPrefix + string(payload)
+}
+
+// ParseResult returns the result sent by msg, if it is a ResultMessage.
+func ParseResult(msg string) (control.ClientResult, bool) {
+	var result control.ClientResult
+	payload, ok := strings.CutPrefix(msg, resultPrefix)
+	if !ok || json.Unmarshal([]byte(payload), &result) != nil {
+		return result, false
+	}
+	return result, true
+}
@@ -0,0 +1,148 @@
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// MuxControlStreamPort is sent by a tcpmux client on a new stream after its
+// ID, to open the control stream of the session. It stays open as long as
+// the session, carrying frames both ways. Older servers close the stream.
+const MuxControlStreamPort = 12
+
+// frames of the control stream
+const (
+	ControlHello = 1 // server: the heartbeat interval in seconds, as 2 bytes
+	ControlPing  = 2 // either side, answered by a ControlPong with the same payload
+	ControlPong  = 3
+	ControlStats = 4 // client: control.ClientStats as JSON, after each pong
+	ControlPorts = 5 // server: the ports it forwards, []ControlPort as JSON
+
+	ControlManaged = 6 // client: takes ControlCommand frames, empty, sent with remote_management only
+	ControlCommand = 7 // server: control.ClientCommand as JSON
+	ControlResult  = 8 // client: control.ClientResult as JSON
+
+	ControlVersion = 9  // either side: its PeerVersion as JSON, sent first
+	ControlUpgrade = 10 // server: why it refuses the client, before closing the session
+)
+
+// ControlMissed is how many heartbeat intervals may pass without a frame
+// before a side takes its peer for gone and closes the session.
+const ControlMissed = 3
+
+var errControlFrame = errors.New("control frame too large")
+
+// ControlPort is a port a server forwards to the client.
+type ControlPort struct {
+	Target int    `json:"target"` // port the client dials
+	Name   string `json:"name,omitempty"`
+}
+
+// controlStreams holds the sessions with an open control stream, which
+// Streams doesn't count.
+var controlStreams sync.Map // *smux.Session -> struct{}
+
+// ControlStream frames the control stream of a mux session. Frames may be
+// written from several goroutines, and read from one.
+type ControlStream struct {
+	session *smux.Session
+	rw      io.ReadWriteCloser
+	writeMu sync.Mutex
+}
+
+// NewControlStream frames stream, the control stream of session, until it
+// is closed by Close.
+func NewControlStream(session *smux.Session, stream io.ReadWriteCloser) *ControlStream {
+	controlStreams.Store(session, struct{}{})
+	return &ControlStream{session: session, rw: stream}
+}
+
+func (c *ControlStream) Close() error {
+	controlStreams.Delete(c.session)
+	return c.rw.Close()
+}
+
+// Streams returns the streams open on session but its control stream, those
+// relaying connections or about to.
+func Streams(session *smux.Session) int {
+	n := session.NumStreams()
+	if _, ok := controlStreams.Load(session); ok {
+		n--
+	}
+	return max(n, 0)
+}
+
+// Write sends a frame: its type, the length of payload as 2 bytes, payload.
+func (c *ControlStream) Write(typ byte, payload []byte) error {
+	if len(payload) > 0xffff {
+		return errControlFrame
+	}
+	frame := make([]byte, 3+len(payload))
+	frame[0] = typ
+	binary.BigEndian.PutUint16(frame[1:], uint16(len(payload)))
+	copy(frame[3:], payload)
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_, err := c.rw.Write(frame)
+	return err
+}
+
+// WriteJSON sends v as the payload of a frame.
+func (c *ControlStream) WriteJSON(typ byte, v any) error {
+	payload, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return c.Write(typ, payload)
+}
+
+// Read reads the next frame.
+func (c *ControlStream) Read() (byte, []byte, error) {
+	var head [3]byte
+	if _, err := io.ReadFull(c.rw, head[:]); err != nil {
+		return 0, nil, err
+	}
+	payload := make([]byte, binary.BigEndian.Uint16(head[1:]))
+	if _, err := io.ReadFull(c.rw, payload); err != nil {
+		return 0, nil, err
+	}
+	return head[0], payload, nil
+}
+
+// Ping sends a ping stamped with the current time, whose pong tells the
+// round trip by PongRTT.
+func (c *ControlStream) Ping() error {
+	var stamp [8]byte
+	binary.BigEndian.PutUint64(stamp[:], uint64(time.Now().UnixNano()))
+	return c.Write(ControlPing, stamp[:])
+}
+
+// PongRTT returns the round trip of a ping from the payload of its pong.
+func PongRTT(payload []byte) (time.Duration, error) {
+	if len(payload) != 8 {
+		return 0, fmt.Errorf("pong of %d bytes", len(payload))
+	}
+	return time.Since(time.Unix(0, int64(binary.BigEndian.Uint64(payload)))), nil
+}
+
+// HelloHeartbeat returns the heartbeat interval of a hello frame.
+func HelloHeartbeat(payload []byte) (time.Duration, error) {
+	if len(payload) < 2 {
+		return 0, fmt.Errorf("hello of %d bytes", len(payload))
+	}
+	return time.Duration(binary.BigEndian.Uint16(payload)) * time.Second, nil
+}
+
+// Hello returns the payload of a hello frame for heartbeat.
+func Hello(heartbeat time.Duration) []byte {
+	payload := make([]byte, 2)
+	binary.BigEndian.PutUint16(payload, uint16(min(heartbeat/time.Second, 0xffff)))
+	return payload
+}
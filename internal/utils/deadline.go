@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"net"
+	"time"
+)
+
+// readTimeoutConn fails a Read that waits longer than timeout for data.
+type readTimeoutConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+// WithReadTimeout closes the relay over conn once it sends nothing for timeout,
+// conn is returned as is if timeout is not positive.
+func WithReadTimeout(conn net.Conn, timeout time.Duration) net.Conn {
+	if timeout <= 0 {
+		return conn
+	}
+	return &readTimeoutConn{Conn: conn, timeout: timeout}
+}
+
+func (c *readTimeoutConn) Read(b []byte) (int, error) {
+	c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	return c.Conn.Read(b)
+}
+
+// NetConn returns the underlying connection.
+func (c *readTimeoutConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,11 @@
+package utils
+
+import "time"
+
+// Limits of the echo stream the ws server offers to "backhaul doctor".
+const (
+	DoctorPath       = "/doctor"
+	DoctorTimeout    = 60 * time.Second
+	DoctorMaxMessage = 64 * 1024
+	DoctorMaxBytes   = 64 * 1024 * 1024
+)
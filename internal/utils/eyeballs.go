@@ -0,0 +1,145 @@
+package utils
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"slices"
+	"sync"
+	"time"
+)
+
+// raceDelay is how long a dial has before the next address is dialed along
+// with it, as recommended by RFC 8305.
+const raceDelay = 250 * time.Millisecond
+
+// dialScores counts the failed dials of each address since it last
+// connected, so addresses that are down or null-routed are dialed last.
+var dialScores = struct {
+	mu    sync.Mutex
+	fails map[string]int
+}{fails: make(map[string]int)}
+
+type raceResult struct {
+	conn    net.Conn
+	address string
+	err     error
+}
+
+// DialRace dials address over TCP with dialer. When its host name has
+// several addresses, they are raced like RFC 8305 does: address families
+// alternate, addresses that failed before come last, and every raceDelay or
+// failed dial the next one is dialed along with the others. The first to
+// connect wins and the rest are called off. IP addresses are dialed as they
+// are.
+func DialRace(dialer *net.Dialer, address string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	if host == "" || net.ParseIP(host) != nil {
+		return dialer.Dial("tcp", address)
+	}
+	ips, err := targetResolver.lookup(host)
+	if err != nil {
+		return nil, err
+	}
+	addresses := raceOrder(ips, port)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	results := make(chan raceResult, len(addresses))
+	dial := func(address string) {
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		results <- raceResult{conn, address, err}
+	}
+
+	next, running := 1, 1
+	go dial(addresses[0])
+	timer := time.NewTimer(raceDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	for running > 0 {
+		select {
+		case result := <-results:
+			running--
+			if result.err == nil {
+				scoreDial(result.address, true)
+				go closeLosers(results, running)
+				return result.conn, nil
+			}
+			scoreDial(result.address, false)
+			if firstErr == nil {
+				firstErr = result.err
+			}
+		case <-timer.C:
+		}
+
+		// a failed dial doesn't wait for the delay either
+		if next < len(addresses) {
+			go dial(addresses[next])
+			next++
+			running++
+			timer.Reset(raceDelay)
+		}
+	}
+
+	ExpireTarget(address)
+	if len(addresses) == 1 {
+		return nil, firstErr
+	}
+	return nil, fmt.Errorf("none of the %d addresses of %s answered: %w", len(addresses), host, firstErr)
+}
+
+// raceOrder returns the addresses to dial in order: families alternating,
+// starting with the family of the first, then stably sorted by their failed
+// dials.
+func raceOrder(ips []net.IP, port string) []string {
+	var first, other []string
+	for _, ip := range ips {
+		address := net.JoinHostPort(ip.String(), port)
+		if (ip.To4() != nil) == (ips[0].To4() != nil) {
+			first = append(first, address)
+		} else {
+			other = append(other, address)
+		}
+	}
+	addresses := make([]string, 0, len(ips))
+	for i := 0; i < max(len(first), len(other)); i++ {
+		if i < len(first) {
+			addresses = append(addresses, first[i])
+		}
+		if i < len(other) {
+			addresses = append(addresses, other[i])
+		}
+	}
+
+	dialScores.mu.Lock()
+	defer dialScores.mu.Unlock()
+	slices.SortStableFunc(addresses, func(a, b string) int {
+		return dialScores.fails[a] - dialScores.fails[b]
+	})
+	return addresses
+}
+
+// scoreDial records how a dial of address went.
+func scoreDial(address string, ok bool) {
+	dialScores.mu.Lock()
+	defer dialScores.mu.Unlock()
+	if ok {
+		delete(dialScores.fails, address)
+	} else {
+		dialScores.fails[address]++
+	}
+}
+
+// closeLosers closes the connections of the dials still running once the
+// race was won, they are called off but may have connected already.
+func closeLosers(results <-chan raceResult, running int) {
+	for ; running > 0; running-- {
+		if result := <-results; result.conn != nil {
+			result.conn.Close()
+		}
+	}
+}
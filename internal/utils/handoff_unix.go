@@ -0,0 +1,190 @@
+//go:build unix
+
+package utils
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"syscall"
+
+	"github.com/sirupsen/logrus"
+)
+
+// file descriptors per message, the kernel limit (SCM_MAX_FD) is 253
+const handoffBatchSize = 200
+
+// ServeHandoff waits on the unix socket at path for a new process started with
+// "backhaul upgrade" and passes it all registered listeners. The returned
+// channel is closed once the new process has taken them over.
+func ServeHandoff(path string, logger *logrus.Logger) (<-chan struct{}, error) {
+	listener, err := listenUnix(path)
+	if err != nil {
+		return nil, err
+	}
+
+	done := make(chan struct{})
+	go func() {
+		for {
+			conn, err := listener.AcceptUnix()
+			// removes the socket file, the new process creates its own
+			listener.Close()
+			if err != nil {
+				logger.Errorf("upgrade socket %s stopped: %v", path, err)
+				return
+			}
+
+			err = sendListeners(conn)
+			conn.Close()
+			if err == nil {
+				close(done)
+				return
+			}
+
+			// still holding every listener, wait for another attempt
+			logger.Errorf("failed to hand over listeners: %v", err)
+			if listener, err = listenUnix(path); err != nil {
+				logger.Errorf("failed to recreate upgrade socket %s: %v", path, err)
+				return
+			}
+		}
+	}()
+	return done, nil
+}
+
+func listenUnix(path string) (*net.UnixListener, error) {
+	os.Remove(path) // stale socket of a process that didn't exit cleanly
+
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// sendListeners writes the registered listeners in batches of a length-prefixed
+// JSON list of addresses with their file descriptors attached, then waits for
+// the receiver to acknowledge.
+func sendListeners(conn *net.UnixConn) error {
+	var addrs []string
+	var files []*os.File
+	defer func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}()
+
+	for address, listener := range Listeners() {
+		file, err := listener.File()
+		if err != nil {
+			return fmt.Errorf("failed to duplicate listener %s: %w", address, err)
+		}
+		addrs = append(addrs, address)
+		files = append(files, file)
+	}
+
+	for start := 0; start < len(files); start += handoffBatchSize {
+		end := min(start+handoffBatchSize, len(files))
+
+		payload, err := json.Marshal(addrs[start:end])
+		if err != nil {
+			return err
+		}
+		fds := make([]int, 0, end-start)
+		for _, file := range files[start:end] {
+			fds = append(fds, int(file.Fd()))
+		}
+
+		msg := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+		msg = append(msg, payload...)
+		if _, _, err := conn.WriteMsgUnix(msg, syscall.UnixRights(fds...), nil); err != nil {
+			return err
+		}
+	}
+	conn.CloseWrite()
+
+	ack := make([]byte, 1)
+	if _, err := io.ReadFull(conn, ack); err != nil {
+		return fmt.Errorf("no acknowledgement from the new process: %w", err)
+	}
+	return nil
+}
+
+// ReceiveHandoff connects to the upgrade socket of the running process at path,
+// registers the listeners it passes and returns how many were received.
+func ReceiveHandoff(path string) (int, error) {
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: path, Net: "unix"})
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+
+	count := 0
+	header := make([]byte, 4)
+	oob := make([]byte, syscall.CmsgSpace(handoffBatchSize*4))
+	for {
+		n, oobn, _, _, err := conn.ReadMsgUnix(header, oob)
+		if err == io.EOF || (err == nil && n == 0) {
+			break
+		}
+		if err != nil {
+			return count, err
+		}
+		fds, err := parseRights(oob[:oobn])
+		if err != nil {
+			return count, err
+		}
+		if _, err := io.ReadFull(conn, header[n:]); err != nil {
+			return count, err
+		}
+
+		payload := make([]byte, binary.BigEndian.Uint32(header))
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return count, err
+		}
+		var addrs []string
+		if err := json.Unmarshal(payload, &addrs); err != nil {
+			return count, err
+		}
+		if len(addrs) != len(fds) {
+			return count, fmt.Errorf("got %d addresses for %d file descriptors", len(addrs), len(fds))
+		}
+
+		for i, fd := range fds {
+			syscall.CloseOnExec(fd)
+
+			file := os.NewFile(uintptr(fd), addrs[i])
+			listener, err := net.FileListener(file)
+			file.Close()
+			if err != nil {
+				return count, fmt.Errorf("listener %s: %w", addrs[i], err)
+			}
+			AddListener(addrs[i], listener.(*net.TCPListener))
+			count++
+		}
+	}
+
+	if _, err := conn.Write([]byte{1}); err != nil {
+		return count, err
+	}
+	return count, nil
+}
+
+func parseRights(oob []byte) ([]int, error) {
+	msgs, err := syscall.ParseSocketControlMessage(oob)
+	if err != nil {
+		return nil, err
+	}
+	if len(msgs) != 1 {
+		return nil, errors.New("missing file descriptors")
+	}
+	return syscall.ParseUnixRights(&msgs[0])
+}
@@ -0,0 +1,19 @@
+package utils
+
+import (
+	"errors"
+
+	"github.com/sirupsen/logrus"
+)
+
+var errHandoffUnsupported = errors.New("passing listeners is not supported on windows")
+
+// ServeHandoff is not supported on Windows.
+func ServeHandoff(path string, logger *logrus.Logger) (<-chan struct{}, error) {
+	return nil, errHandoffUnsupported
+}
+
+// ReceiveHandoff is not supported on Windows.
+func ReceiveHandoff(path string) (int, error) {
+	return 0, errHandoffUnsupported
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A signed token proves the client knows the token without sending it:
+// "v1 <unix time> <nonce> <HMAC-SHA256 of the time and nonce keyed by the
+// token>". The server takes each nonce once while its time is within the
+// allowed clock skew, so a captured handshake can't be sent again.
+const signedTokenPrefix = "v1 "
+
+// DefaultAuthSkew is how far the clocks of client and server may be apart by
+// default.
+const DefaultAuthSkew = 60 * time.Second
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrPlainToken   = errors.New("plain token not accepted")
+	ErrTokenReplay  = errors.New("handshake replayed")
+)
+
+// TokenSkewError is returned for a signed token whose time is too far from
+// the server's clock.
+type TokenSkewError struct {
+	Offset time.Duration // of the client's clock from the server's
+}
+
+func (e *TokenSkewError) Error() string {
+	if e.Offset < 0 {
+		return fmt.Sprintf("client clock is %v behind, more than auth_skew", -e.Offset)
+	}
+	return fmt.Sprintf("client clock is %v ahead, more than auth_skew", e.Offset)
+}
+
+// SignToken returns a signed token for one handshake, and the nonce to check
+// the server's reply with.
+func SignToken(token string) (string, string) {
+	b := make([]byte, 16)
+	rand.Read(b)
+	nonce := hex.EncodeToString(b)
+	ts := strconv.FormatInt(time.Now().Unix(), 10)
+	return signedTokenPrefix + ts + " " + nonce + " " + tokenMAC(token, ts, nonce), nonce
+}
+
+// HandshakeToken returns what the client sends for token, signed unless
+// plain, and the nonce of the signed token.
+func HandshakeToken(token string, plain bool) (string, string) {
+	if plain {
+		return token, ""
+	}
+	return SignToken(token)
+}
+
+// TokenReply is what the server answers a signed token with, proving it
+// knows the token as well.
+func TokenReply(token, nonce string) string {
+	return "ok " + tokenMAC(token, "ok", nonce)
+}
+
+func tokenMAC(token string, fields ...string) string {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(strings.Join(fields, " ")))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// TokenChecker checks the tokens of handshakes on the server, remembering
+// the nonces of signed tokens until their time is out of the skew.
+type TokenChecker struct {
+	token       string
+	skew        time.Duration
+	rejectPlain bool
+
+	mu      sync.Mutex
+	seen    map[string]struct{} // nonces of the tokens still in the skew
+	expires []seenNonce         // the same nonces, in the order they can be forgotten
+}
+
+// seenNonce is a nonce that can be forgotten after until.
+type seenNonce struct {
+	nonce string
+	until time.Time
+}
+
+// NewTokenChecker accepts signed tokens whose time is within skew of the
+// server's clock, and the token itself from older clients unless rejectPlain.
+func NewTokenChecker(token string, skew time.Duration, rejectPlain bool) *TokenChecker {
+	if skew <= 0 {
+		skew = DefaultAuthSkew
+	}
+	return &TokenChecker{
+		token:       token,
+		skew:        skew,
+		rejectPlain: rejectPlain,
+		seen:        make(map[string]struct{}),
+	}
+}
+
+// Check checks the token a client sent, and returns the nonce to reply with,
+// empty for a plain token.
+func (c *TokenChecker) Check(msg string) (string, error) {
+	if !strings.HasPrefix(msg, signedTokenPrefix) {
+		switch {
+		case !hmac.Equal([]byte(msg), []byte(c.token)):
+			return "", ErrInvalidToken
+		case c.rejectPlain:
+			return "", ErrPlainToken
+		}
+		return "", nil
+	}
+
+	fields := strings.Fields(strings.TrimPrefix(msg, signedTokenPrefix))
+	if len(fields) != 3 {
+		return "", ErrInvalidToken
+	}
+	ts, nonce, mac := fields[0], fields[1], fields[2]
+	if !hmac.Equal([]byte(mac), []byte(tokenMAC(c.token, ts, nonce))) {
+		return "", ErrInvalidToken
+	}
+	sec, err := strconv.ParseInt(ts, 10, 64)
+	if err != nil {
+		return "", ErrInvalidToken
+	}
+	now := time.Now()
+	sent := time.Unix(sec, 0)
+	if offset := sent.Sub(now); offset > c.skew || offset < -c.skew {
+		return "", &TokenSkewError{Offset: offset.Round(time.Second)}
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for len(c.expires) > 0 && now.After(c.expires[0].until) {
+		delete(c.seen, c.expires[0].nonce)
+		c.expires = c.expires[1:]
+	}
+	if _, ok := c.seen[nonce]; ok {
+		return "", ErrTokenReplay
+	}
+	// a token sent up to skew ahead stays valid until skew after, so twice the
+	// skew from now, taken under the lock, outlasts it and keeps the nonces in
+	// the order they expire
+	c.seen[nonce] = struct{}{}
+	c.expires = append(c.expires, seenNonce{nonce: nonce, until: time.Now().Add(2 * c.skew)})
+	return nonce, nil
+}
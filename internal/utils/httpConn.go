@@ -0,0 +1,311 @@
+package utils
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// hop-by-hop headers, these are meaningful only for a single transport-level connection.
+// Transfer-Encoding is kept because the body is passed through in its original framing.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Upgrade",
+}
+
+// HTTPConn wraps a public connection carrying HTTP/1.x requests and rewrites
+// the request headers on the fly while the relay reads from it.
+// Bodies are never buffered: fixed-length and chunked bodies are passed through
+// as they arrive, and after a protocol upgrade (WebSocket) the connection turns
+// into a raw byte stream. Responses are not touched at all, so streamed
+// responses like SSE are flushed to the visitor as soon as they arrive.
+type HTTPConn struct {
+	net.Conn
+	reader   *bufio.Reader
+	pending  bytes.Buffer // rewritten request head waiting to be read
+	remain   int64        // body bytes left in the current request or chunk
+	chunked  bool         // the current request body uses chunked encoding
+	raw      bool         // stop parsing and pass everything through
+	clientIP string
+	host     string
+
+	errorPage string      // sent if the connection ends before a response, empty for none
+	forwarded atomic.Bool // the tunnel took the connection, see ObserveSetup
+	answered  atomic.Bool // something was written back, or the error page
+}
+
+// NewHTTPConn returns a connection that sets X-Forwarded-For and X-Forwarded-Proto,
+// replaces the Host header (if host is not empty) and strips hop-by-hop headers.
+// With an errorPage, a visitor the tunnel never answers gets it in a 503 response
+// if the tunnel never took the connection, or a 502 if it got no response.
+func NewHTTPConn(conn net.Conn, host string, errorPage string) *HTTPConn {
+	clientIP := conn.RemoteAddr().String()
+	if tcpAddr, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		clientIP = tcpAddr.IP.String()
+	}
+
+	return &HTTPConn{
+		Conn:      conn,
+		reader:    bufio.NewReaderSize(conn, 16*1024),
+		clientIP:  clientIP,
+		host:      host,
+		errorPage: errorPage,
+	}
+}
+
+// NetConn returns the underlying connection.
+func (c *HTTPConn) NetConn() net.Conn {
+	return c.Conn
+}
+
+func (c *HTTPConn) Write(p []byte) (int, error) {
+	if len(p) > 0 {
+		c.answered.Store(true)
+	}
+	return c.Conn.Write(p)
+}
+
+// Close sends the error page first if the visitor got no response.
+func (c *HTTPConn) Close() error {
+	c.sendErrorPage()
+	return c.Conn.Close()
+}
+
+// CloseWrite sends the error page first if the visitor got no response, e.g.
+// the client could not reach the backend.
+func (c *HTTPConn) CloseWrite() error {
+	c.sendErrorPage()
+	if !CloseWrite(c.Conn) {
+		return fmt.Errorf("can't half-close %s", c.Conn.RemoteAddr())
+	}
+	return nil
+}
+
+// Reset closes the connection with a reset, or with the error page if the
+// visitor got no response, as a reset could discard it.
+func (c *HTTPConn) Reset() error {
+	if c.sendErrorPage() {
+		return c.Conn.Close()
+	}
+	ResetConn(c.Conn)
+	return nil
+}
+
+// sendErrorPage writes the error page once if nothing else was written, and
+// reports whether it did.
+func (c *HTTPConn) sendErrorPage() bool {
+	if c.errorPage == "" || !c.answered.CompareAndSwap(false, true) {
+		return false
+	}
+	status := 503
+	if c.forwarded.Load() {
+		status = 502
+	}
+	c.SetWriteDeadline(time.Now().Add(time.Second))
+	_, err := c.Conn.Write(errorResponse(status, c.errorPage))
+	return err == nil
+}
+
+// errorResponse returns a minimal HTTP response with status and message as
+// a plain text body, closing the connection.
+func errorResponse(status int, message string) []byte {
+	body := message + "\n"
+	return []byte(fmt.Sprintf("HTTP/1.1 %d %s\r\nContent-Type: text/plain; charset=utf-8\r\nContent-Length: %d\r\nCache-Control: no-store\r\nConnection: close\r\n\r\n%s",
+		status, http.StatusText(status), len(body), body))
+}
+
+func (c *HTTPConn) Read(p []byte) (int, error) {
+	for {
+		if c.pending.Len() > 0 {
+			return c.pending.Read(p)
+		}
+
+		if c.raw {
+			return c.reader.Read(p)
+		}
+
+		if c.remain > 0 {
+			if int64(len(p)) > c.remain {
+				p = p[:c.remain]
+			}
+			n, err := c.reader.Read(p)
+			c.remain -= int64(n)
+			return n, err
+		}
+
+		if c.chunked {
+			if err := c.readChunkHead(); err != nil {
+				return 0, err
+			}
+			continue
+		}
+
+		if err := c.readRequestHead(); err != nil {
+			return 0, err
+		}
+	}
+}
+
+// readChunkHead queues the next chunk size line unchanged and sets the number of
+// bytes to pass through. The last chunk is followed by the trailer section.
+func (c *HTTPConn) readChunkHead() error {
+	line, err := c.reader.ReadString('\n')
+	if err != nil {
+		return err
+	}
+	c.pending.WriteString(line)
+
+	sizeStr := strings.TrimSpace(line)
+	if i := strings.IndexByte(sizeStr, ';'); i >= 0 { // chunk extensions
+		sizeStr = strings.TrimSpace(sizeStr[:i])
+	}
+	size, err := strconv.ParseInt(sizeStr, 16, 64)
+	if err != nil || size < 0 {
+		return fmt.Errorf("invalid chunk size: %q", sizeStr)
+	}
+
+	if size > 0 {
+		c.remain = size + 2 // chunk data and its CRLF
+		return nil
+	}
+
+	// last chunk, copy the trailer up to the empty line
+	for {
+		line, err := c.reader.ReadString('\n')
+		if err != nil {
+			return err
+		}
+		c.pending.WriteString(line)
+		if line == "\r\n" || line == "\n" {
+			break
+		}
+	}
+	c.chunked = false
+	return nil
+}
+
+// readRequestHead parses the next request line and headers, rewrites them and
+// queues the result in the pending buffer.
+func (c *HTTPConn) readRequestHead() error {
+	tp := textproto.NewReader(c.reader)
+
+	requestLine, err := tp.ReadLine()
+	if err != nil {
+		return err
+	}
+	if len(strings.Fields(requestLine)) != 3 {
+		return fmt.Errorf("malformed HTTP request line: %q", requestLine)
+	}
+
+	header, err := tp.ReadMIMEHeader()
+	if err != nil {
+		return fmt.Errorf("failed to read HTTP headers: %w", err)
+	}
+
+	upgrade := isUpgrade(header)
+	c.rewriteHeader(header)
+
+	if upgrade != "" {
+		// keep the handshake intact, everything after it is not HTTP anymore
+		header.Set("Connection", "Upgrade")
+		header.Set("Upgrade", upgrade)
+		c.raw = true
+	} else if te := header.Get("Transfer-Encoding"); te != "" {
+		encodings := strings.Split(te, ",")
+		if strings.EqualFold(strings.TrimSpace(encodings[len(encodings)-1]), "chunked") {
+			c.chunked = true
+		} else {
+			// unknown framing, the body lasts until the connection is closed
+			c.raw = true
+		}
+	} else if cl := header.Get("Content-Length"); cl != "" {
+		length, err := strconv.ParseInt(cl, 10, 64)
+		if err != nil || length < 0 {
+			return fmt.Errorf("invalid Content-Length: %q", cl)
+		}
+		c.remain = length
+	}
+
+	c.pending.WriteString(requestLine + "\r\n")
+	writeHeader(&c.pending, header)
+	return nil
+}
+
+// isUpgrade returns the requested protocol if the request asks for a
+// protocol upgrade (e.g. "websocket"), or an empty string otherwise.
+func isUpgrade(header textproto.MIMEHeader) string {
+	upgrade := header.Get("Upgrade")
+	if upgrade == "" {
+		return ""
+	}
+
+	for _, value := range header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return upgrade
+			}
+		}
+	}
+	return ""
+}
+
+func (c *HTTPConn) rewriteHeader(header textproto.MIMEHeader) {
+	// headers listed in the Connection header are hop-by-hop as well
+	for _, value := range header.Values("Connection") {
+		for _, name := range strings.Split(value, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				header.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		header.Del(name)
+	}
+
+	if prior := header.Values("X-Forwarded-For"); len(prior) > 0 {
+		header.Set("X-Forwarded-For", strings.Join(prior, ", ")+", "+c.clientIP)
+	} else {
+		header.Set("X-Forwarded-For", c.clientIP)
+	}
+	header.Set("X-Forwarded-Proto", "http")
+
+	if c.host != "" {
+		header.Set("Host", c.host)
+	}
+}
+
+// writeHeader writes the header block in a stable order, Host first.
+func writeHeader(buf *bytes.Buffer, header textproto.MIMEHeader) {
+	for _, value := range header.Values("Host") {
+		buf.WriteString("Host: " + value + "\r\n")
+	}
+
+	keys := make([]string, 0, len(header))
+	for key := range header {
+		if key != "Host" {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	for _, key := range keys {
+		for _, value := range header[key] {
+			buf.WriteString(key + ": " + value + "\r\n")
+		}
+	}
+	buf.WriteString("\r\n")
+}
@@ -0,0 +1,106 @@
+package utils
+
+import (
+	"crypto/tls"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+	"github.com/xtaci/smux"
+)
+
+// tcpProbes is how many unanswered TCP keepalive probes drop a connection
+// with keepalive_mode "tcp", where nothing else notices a dead peer.
+const tcpProbes = 3
+
+// muxPingsLost is how many smux pings may go unanswered before a session is
+// dropped.
+const muxPingsLost = 3
+
+// Keepalive is how tunnel connections are kept alive, so the NAT and
+// conntrack entries of routers on the way don't expire while they idle.
+type Keepalive struct {
+	Mode   string        // keepalive_mode
+	Period time.Duration // keepalive_period, between TCP keepalive probes
+	Ping   time.Duration // ping_interval, 0 for the default of the transport
+	Jitter float64       // keepalive_jitter, the share an interval varies by
+}
+
+// TCP reports whether tunnel connections send TCP keepalive probes.
+func (k Keepalive) TCP() bool {
+	return k.Mode != config.KeepalivePing
+}
+
+// Pings reports whether tunnel connections send application pings.
+func (k Keepalive) Pings() bool {
+	return k.Mode != config.KeepaliveTCP
+}
+
+// Jittered returns d varied by up to the jitter either way, so the
+// connections opened together don't all send their probes at once.
+func (k Keepalive) Jittered(d time.Duration) time.Duration {
+	if k.Jitter <= 0 || d <= 0 {
+		return d
+	}
+	return d + time.Duration((rand.Float64()*2-1)*k.Jitter*float64(d))
+}
+
+// PingInterval returns the ping interval, fallback if ping_interval is unset.
+func (k Keepalive) PingInterval(fallback time.Duration) time.Duration {
+	if k.Ping > 0 {
+		return k.Jittered(k.Ping)
+	}
+	return k.Jittered(fallback)
+}
+
+// Config returns the TCP keepalive settings of a new tunnel connection.
+func (k Keepalive) Config() net.KeepAliveConfig {
+	if !k.TCP() {
+		return net.KeepAliveConfig{Enable: false, Idle: -1, Interval: -1, Count: -1}
+	}
+	period := k.Jittered(k.Period)
+	cfg := net.KeepAliveConfig{Enable: true, Idle: period, Interval: period, Count: -1}
+	if !k.Pings() {
+		cfg.Count = tcpProbes
+	}
+	return cfg
+}
+
+// Dialer returns a dialer whose connections are kept alive by k.
+func (k Keepalive) Dialer(timeout time.Duration) *net.Dialer {
+	dialer := &net.Dialer{Timeout: timeout, KeepAliveConfig: k.Config()}
+	if !k.TCP() {
+		dialer.KeepAlive = -1
+	}
+	return dialer
+}
+
+// Apply sets the TCP keepalive of conn, which may be wrapped in TLS.
+func (k Keepalive) Apply(conn net.Conn) error {
+	if tlsConn, ok := conn.(*tls.Conn); ok {
+		conn = tlsConn.NetConn()
+	}
+	tcpConn, ok := conn.(*net.TCPConn)
+	if !ok {
+		return nil
+	}
+	return tcpConn.SetKeepAliveConfig(k.Config())
+}
+
+// Mux sets the keepalive of a smux session: a ping every ping_interval, 10
+// seconds by default, and the session is dropped when none was answered
+// within three of them. A session only hears the pings of the other end, so
+// both need the same settings. With keepalive_mode "tcp" smux sends no pings.
+func (k Keepalive) Mux(cfg *smux.Config) {
+	if !k.Pings() {
+		cfg.KeepAliveDisabled = true
+		return
+	}
+	interval := k.Ping
+	if interval <= 0 {
+		interval = 10 * time.Second
+	}
+	cfg.KeepAliveInterval = k.Jittered(interval)
+	cfg.KeepAliveTimeout = time.Duration(muxPingsLost * (1 + k.Jitter) * float64(interval))
+}
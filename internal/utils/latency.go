@@ -0,0 +1,94 @@
+package utils
+
+import (
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sahmadiut/backhaul/internal/web"
+)
+
+// timedConn measures the latency of a forwarded connection: the time to set it
+// up, and the time until the first byte of the response passes through it.
+type timedConn struct {
+	net.Conn
+	start     time.Time
+	port      string
+	usage     *web.Usage
+	onWrite   bool // the response is written to the connection, not read from it
+	firstByte sync.Once
+}
+
+// TimeAccepted wraps a public connection the server just accepted. The first
+// byte written back to it is its time to first byte, and ObserveSetup records
+// when the tunnel carries it.
+func TimeAccepted(conn net.Conn, usage *web.Usage) net.Conn {
+	port := strconv.Itoa(conn.LocalAddr().(*net.TCPAddr).Port)
+	return &timedConn{Conn: conn, start: time.Now(), port: port, usage: usage, onWrite: true}
+}
+
+// TimeDialed wraps a connection the client dialed to a target for port,
+// starting at start. The dial is its setup time, and the first byte read from
+// it is its time to first byte.
+func TimeDialed(conn net.Conn, port int, usage *web.Usage, start time.Time) net.Conn {
+	c := &timedConn{Conn: conn, start: start, port: strconv.Itoa(port), usage: usage}
+	c.usage.ObserveHistogram("backhaul_port_setup_seconds", time.Since(start).Seconds(), "port", c.port)
+	return c
+}
+
+// ObserveSetup records the setup time of a connection wrapped by TimeAccepted,
+// once the tunnel carries it. An HTTP connection gets a 502 rather than a 503
+// error page from then on.
+func ObserveSetup(conn net.Conn) {
+	c, ok := conn.(*timedConn)
+	if !ok {
+		return
+	}
+	c.usage.ObserveHistogram("backhaul_port_setup_seconds", time.Since(c.start).Seconds(), "port", c.port)
+	for inner := c.Conn; ; {
+		if h, ok := inner.(*HTTPConn); ok {
+			h.forwarded.Store(true)
+			return
+		}
+		wrapped, ok := inner.(interface{ NetConn() net.Conn })
+		if !ok {
+			return
+		}
+		inner = wrapped.NetConn()
+	}
+}
+
+// AcceptedAt returns when a connection wrapped by TimeAccepted was accepted.
+func AcceptedAt(conn net.Conn) (time.Time, bool) {
+	if c, ok := conn.(*timedConn); ok && c.onWrite {
+		return c.start, true
+	}
+	return time.Time{}, false
+}
+
+func (c *timedConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	if n > 0 && !c.onWrite {
+		c.observeFirstByte()
+	}
+	return n, err
+}
+
+func (c *timedConn) Write(b []byte) (int, error) {
+	if len(b) > 0 && c.onWrite {
+		c.observeFirstByte()
+	}
+	return c.Conn.Write(b)
+}
+
+func (c *timedConn) observeFirstByte() {
+	c.firstByte.Do(func() {
+		c.usage.ObserveHistogram("backhaul_port_ttfb_seconds", time.Since(c.start).Seconds(), "port", c.port)
+	})
+}
+
+// NetConn returns the underlying connection.
+func (c *timedConn) NetConn() net.Conn {
+	return c.Conn
+}
@@ -0,0 +1,169 @@
+package utils
+
+import (
+	"net"
+	"runtime"
+	"strconv"
+	"sync"
+)
+
+var (
+	listenersMu sync.Mutex
+	listeners   = make(map[string]*net.TCPListener) // bound ahead of time, by listen address
+	duplicates  = make(map[*dupListener]struct{})   // handed out by Listen and still open
+	bound       = make(map[string]bool)             // registered by Listen itself, so it can bind them again
+)
+
+// AddListener registers an already bound listener. Later Listen calls for the
+// same address get a duplicate of it instead of binding again, so the socket
+// survives restarts and privilege drops.
+func AddListener(address string, listener *net.TCPListener) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	listeners[address] = listener
+}
+
+// HasListener reports whether a registered listener covers address.
+func HasListener(address string) bool {
+	_, ok := lookupListener(address)
+	return ok
+}
+
+// Listeners returns a snapshot of the registered listeners by address.
+func Listeners() map[string]*net.TCPListener {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	snapshot := make(map[string]*net.TCPListener, len(listeners))
+	for address, listener := range listeners {
+		snapshot[address] = listener
+	}
+	return snapshot
+}
+
+// CloseListeners closes the registered listeners and every duplicate handed out
+// by Listen, so this process stops accepting on all of them.
+func CloseListeners() {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	for address, listener := range listeners {
+		listener.Close()
+		delete(listeners, address)
+		delete(bound, address)
+	}
+	for listener := range duplicates {
+		listener.Listener.Close()
+		delete(duplicates, listener)
+	}
+}
+
+// lookupListener finds the registered listener for address. Besides an exact
+// match, a listener bound to the same port matches if it listens on the same
+// IP or both addresses are wildcards (e.g. ":3080" and "[::]:3080").
+func lookupListener(address string) (*net.TCPListener, bool) {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	if listener, ok := listeners[address]; ok {
+		return listener, true
+	}
+
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, false
+	}
+	ip := net.ParseIP(host)
+
+	for _, listener := range listeners {
+		tcpAddr := listener.Addr().(*net.TCPAddr)
+		if strconv.Itoa(tcpAddr.Port) != port {
+			continue
+		}
+		if (host == "" || ip.IsUnspecified()) && tcpAddr.IP.IsUnspecified() || ip.Equal(tcpAddr.IP) {
+			return listener, true
+		}
+	}
+	return nil, false
+}
+
+// Listen returns a TCP listener for address. The socket is registered on first
+// use and later calls get a duplicate of it, so it stays bound across restarts
+// and can be handed to a new process on upgrade. Closing the returned listener
+// leaves the registered one open. On Windows, sockets are not registered.
+func Listen(address string) (net.Listener, error) {
+	registered, ok := lookupListener(address)
+	if !ok {
+		listener, err := net.Listen("tcp", address)
+		if err != nil || runtime.GOOS == "windows" {
+			return listener, err
+		}
+		registered = listener.(*net.TCPListener)
+		AddListener(address, registered)
+		listenersMu.Lock()
+		bound[address] = true
+		listenersMu.Unlock()
+	}
+
+	file, err := registered.File()
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, err
+	}
+
+	dup := &dupListener{Listener: listener}
+	listenersMu.Lock()
+	duplicates[dup] = struct{}{}
+	listenersMu.Unlock()
+	return dup, nil
+}
+
+// Unlisten closes the registered listener of address if Listen bound it, so
+// connections to it are refused until Listen binds it again. Sockets bound
+// ahead of time stay open, as binding them may take privileges this process
+// no longer has; it reports false for those.
+func Unlisten(address string) bool {
+	listenersMu.Lock()
+	defer listenersMu.Unlock()
+
+	listener, ok := listeners[address]
+	if !ok {
+		return true
+	}
+	if !bound[address] {
+		return false
+	}
+	listener.Close()
+	delete(listeners, address)
+	delete(bound, address)
+	return true
+}
+
+// dupListener is a duplicate of a registered listener handed out by Listen.
+type dupListener struct {
+	net.Listener
+}
+
+// TCPListener returns the TCP listener behind listener, one from Listen or
+// net.Listen, for setting socket options on it.
+func TCPListener(listener net.Listener) (*net.TCPListener, bool) {
+	if dup, ok := listener.(*dupListener); ok {
+		listener = dup.Listener
+	}
+	tcpListener, ok := listener.(*net.TCPListener)
+	return tcpListener, ok
+}
+
+func (l *dupListener) Close() error {
+	listenersMu.Lock()
+	delete(duplicates, l)
+	listenersMu.Unlock()
+
+	return l.Listener.Close()
+}
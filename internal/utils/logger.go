@@ -8,7 +8,9 @@ import (
 	"github.com/sirupsen/logrus"
 )
 
-type CustomFormatter struct{}
+type CustomFormatter struct {
+	Name string // of the tunnel, when a process runs several
+}
 
 func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	timestamp := entry.Time.Format("02-Jan 15:04:05")
@@ -16,7 +18,12 @@ func (f *CustomFormatter) Format(entry *logrus.Entry) ([]byte, error) {
 	level := strings.ToUpper(entry.Level.String())
 	coloredLevel := f.colorize(entry.Level, level)
 
-	logMessage := fmt.Sprintf("%s [%s] %s\n", timestamp, coloredLevel, entry.Message)
+	name := ""
+	if f.Name != "" {
+		name = "[" + f.Name + "] "
+	}
+
+	logMessage := fmt.Sprintf("%s [%s] %s%s\n", timestamp, coloredLevel, name, entry.Message)
 
 	return []byte(logMessage), nil
 }
@@ -58,3 +65,11 @@ func NewLogger(logLevel string) *logrus.Logger {
 
 	return log
 }
+
+// NewNamedLogger returns a logger like NewLogger whose lines carry the name
+// of a tunnel, empty for none.
+func NewNamedLogger(logLevel, name string) *logrus.Logger {
+	log := NewLogger(logLevel)
+	log.SetFormatter(&CustomFormatter{Name: name})
+	return log
+}
@@ -0,0 +1,154 @@
+package utils
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// StreamMetaPort is sent instead of a target port to clients that asked for
+// stream metadata, followed by the target port and the StreamMeta of the
+// public connection as a length-prefixed string. The ports below it are taken
+// by SpeedtestPort and the mux control ports, so target port 7 can't be
+// forwarded by clients that understand it.
+const StreamMetaPort = 7
+
+// MetaMessage is sent by a tcp client on the control channel, and by a tcpmux
+// client after its ID, to get stream metadata. Older servers never read it.
+const MetaMessage = "meta"
+
+// MetaHeader is set on the WebSocket handshake of the control channel by a
+// client that wants stream metadata.
+const MetaHeader = "X-Backhaul-Meta"
+
+// StreamMeta describes the public connection behind a tunnel connection or
+// stream. Keys a client doesn't know are skipped, so more can be added.
+type StreamMeta struct {
+	Src      string    // address of the visitor, host:port
+	Dst      int       // public port it connected to
+	Accepted time.Time // when the server accepted it, by the clock of the server
+	Name     string    // of the forward table of the port, if any
+	To       string    // host:port a connection redirected to transparent_addr was headed to
+}
+
+// NewStreamMeta describes the public connection conn, whose port is named
+// name.
+func NewStreamMeta(conn net.Conn, name string) *StreamMeta {
+	meta := &StreamMeta{Src: conn.RemoteAddr().String(), Name: name}
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		meta.Dst = addr.Port
+	}
+	var ok bool
+	if meta.Accepted, ok = AcceptedAt(conn); !ok {
+		meta.Accepted = time.Now()
+	}
+	return meta
+}
+
+func (m *StreamMeta) encode() string {
+	values := url.Values{}
+	values.Set("src", m.Src)
+	values.Set("dst", strconv.Itoa(m.Dst))
+	values.Set("ts", strconv.FormatInt(m.Accepted.UnixMilli(), 10))
+	if m.Name != "" {
+		values.Set("name", m.Name)
+	}
+	if m.To != "" {
+		values.Set("to", m.To)
+	}
+	return values.Encode()
+}
+
+func parseStreamMeta(s string) (*StreamMeta, error) {
+	values, err := url.ParseQuery(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid stream metadata: %w", err)
+	}
+	meta := &StreamMeta{Src: values.Get("src"), Name: values.Get("name"), To: values.Get("to")}
+	meta.Dst, _ = strconv.Atoi(values.Get("dst"))
+	if ms, err := strconv.ParseInt(values.Get("ts"), 10, 64); err == nil {
+		meta.Accepted = time.UnixMilli(ms)
+	}
+	return meta, nil
+}
+
+// EncodeStreamHeader returns what a tunnel connection or stream starts with:
+// the target port, or with meta StreamMetaPort, the port and meta.
+func EncodeStreamHeader(port uint16, meta *StreamMeta) ([]byte, error) {
+	if meta == nil {
+		return EncodeBinaryInt(port), nil
+	}
+	encoded, err := EncodeBinaryString(meta.encode())
+	if err != nil {
+		return nil, err
+	}
+	buf := binary.BigEndian.AppendUint16(EncodeBinaryInt(StreamMetaPort), port)
+	return append(buf, encoded...), nil
+}
+
+// SendStreamHeader sends the target port, and meta unless it is nil, in one
+// write.
+func SendStreamHeader(conn net.Conn, port uint16, meta *StreamMeta) error {
+	buf, err := EncodeStreamHeader(port, meta)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(buf); err != nil {
+		return fmt.Errorf("failed to send port number %d: %w", port, err)
+	}
+	return nil
+}
+
+// ReceiveStreamHeader reads the target port and, if the server sent it, the
+// metadata of the stream. meta is nil otherwise.
+func ReceiveStreamHeader(conn net.Conn) (port uint16, meta *StreamMeta, err error) {
+	port, err = ReceiveBinaryInt(conn)
+	if err != nil || port != StreamMetaPort {
+		return port, nil, err
+	}
+	if port, err = ReceiveBinaryInt(conn); err != nil {
+		return 0, nil, err
+	}
+	encoded, err := ReceiveBinaryString(conn)
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read stream metadata: %w", err)
+	}
+	meta, err = parseStreamMeta(encoded)
+	return port, meta, err
+}
+
+// DecodeStreamHeader reads what ReceiveStreamHeader does from a WebSocket
+// message.
+func DecodeStreamHeader(b []byte) (port uint16, meta *StreamMeta, err error) {
+	port, err = DecodeBinaryInt(b)
+	if err != nil || port != StreamMetaPort {
+		return port, nil, err
+	}
+	if port, err = DecodeBinaryInt(b[2:]); err != nil {
+		return 0, nil, err
+	}
+	encoded, _, err := DecodeBinaryString(b[4:])
+	if err != nil {
+		return 0, nil, fmt.Errorf("failed to read stream metadata: %w", err)
+	}
+	meta, err = parseStreamMeta(encoded)
+	return port, meta, err
+}
+
+// SendWebSocketStreamHeader sends what SendStreamHeader does as one WebSocket
+// message.
+func SendWebSocketStreamHeader(conn *websocket.Conn, port uint16, meta *StreamMeta) error {
+	buf, err := EncodeStreamHeader(port, meta)
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteMessage(websocket.BinaryMessage, buf); err != nil {
+		return fmt.Errorf("failed to send port number %d: %w", port, err)
+	}
+	return nil
+}
@@ -0,0 +1,276 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/xtaci/smux"
+)
+
+// MuxScalePort is sent instead of a target port to ask a tcpmux client for one
+// more session, followed by the slot of the new session. Older clients fail
+// to dial port 1 and just close the stream.
+const MuxScalePort = 1
+
+// MuxHalfClosePort is sent instead of a target port on a new stream to
+// half-close another stream of the same session, followed by its id and the
+// number of bytes written to it. smux has no half-close of its own: closing a
+// stream drops whatever the peer still sends on it.
+const MuxHalfClosePort = 2
+
+// MuxResetPort is sent like MuxHalfClosePort to reset another stream, the
+// connection behind it was reset.
+const MuxResetPort = 3
+
+// MuxClientIDPort is sent by the client on a new stream after the token,
+// followed by its ID. Older servers close the stream.
+const MuxClientIDPort = 4
+
+// MuxGoAwayPort is sent by the server on a new stream before it closes a
+// session on restart or shutdown, followed by the seconds the streams of the
+// session get to finish. Older clients fail to dial port 5 and just close the
+// stream.
+const MuxGoAwayPort = 5
+
+// MuxRetirePort is sent by the server on a new stream of a session it closes
+// for being idle, so the client lets it go without reconnecting. The client
+// answers with a byte. Older clients fail to dial port 6 and just close the
+// stream, the server keeps the session then.
+const MuxRetirePort = 6
+
+// drainPoll is how often DrainSession checks for streams left.
+const drainPoll = 100 * time.Millisecond
+
+var (
+	errMuxStreamClosed = errors.New("mux stream closed by peer")
+	errMuxStreamReset  = fmt.Errorf("mux stream reset by peer: %w", syscall.ECONNRESET)
+)
+
+type muxStreamKey struct {
+	session *smux.Session
+	id      uint32
+}
+
+var muxStreams sync.Map // muxStreamKey -> *MuxStream
+
+// MuxStream is a relayed smux stream that can be half-closed and reset.
+type MuxStream struct {
+	net.Conn
+	session *smux.Session
+	stream  *smux.Stream
+	read    int64 // bytes read, by the relay only
+	written atomic.Int64
+	eof     atomic.Int64 // bytes the peer wrote before it half-closed, -1 until then
+	reset   atomic.Bool
+}
+
+// NewMuxStream wraps stream of session for the relay.
+func NewMuxStream(session *smux.Session, stream *smux.Stream) *MuxStream {
+	s := &MuxStream{Conn: stream, session: session, stream: stream}
+	s.eof.Store(-1)
+	muxStreams.Store(muxStreamKey{session, stream.ID()}, s)
+	return s
+}
+
+// Read returns io.EOF once everything the peer wrote before half-closing was
+// read. A stream closed by the peer is not an EOF but the end of the relay.
+func (s *MuxStream) Read(b []byte) (int, error) {
+	if s.reset.Load() {
+		return 0, errMuxStreamReset
+	}
+	eof := s.eof.Load()
+	if eof >= 0 {
+		if s.read >= eof {
+			return 0, io.EOF
+		}
+		if rest := eof - s.read; int64(len(b)) > rest {
+			b = b[:rest]
+		}
+	}
+
+	n, err := s.stream.Read(b)
+	s.read += int64(n)
+	if err == nil {
+		return n, nil
+	}
+	if s.reset.Load() {
+		return n, errMuxStreamReset
+	}
+	if errors.Is(err, io.EOF) {
+		return n, errMuxStreamClosed
+	}
+	if eof = s.eof.Load(); eof >= 0 && s.read >= eof {
+		// woken up by the half-close
+		return n, io.EOF
+	}
+	return n, err
+}
+
+// ReadBuffered reads the frames the stream holds already into b without
+// waiting for more, so the relay passes several small frames on in one write.
+// It leaves a half-close or reset to Read.
+func (s *MuxStream) ReadBuffered(b []byte) int {
+	if s.reset.Load() || s.eof.Load() >= 0 {
+		return 0
+	}
+	s.stream.SetReadDeadline(time.Now())
+	n, _ := s.stream.Read(b)
+	// a half-close or reset coming in meanwhile is flagged before its wakeup,
+	// so Read checks it before waiting again
+	s.stream.SetReadDeadline(time.Time{})
+	s.read += int64(n)
+	return n
+}
+
+func (s *MuxStream) Write(b []byte) (int, error) {
+	n, err := s.stream.Write(b)
+	s.written.Add(int64(n))
+	return n, err
+}
+
+// CloseWrite tells the peer there is nothing more to read after the bytes
+// written so far.
+func (s *MuxStream) CloseWrite() error {
+	return s.control(MuxHalfClosePort)
+}
+
+// Reset tells the peer to reset its connection. The stream is closed as usual
+// once the peer closes its end.
+func (s *MuxStream) Reset() error {
+	return s.control(MuxResetPort)
+}
+
+// control sends port, the stream id and the bytes written so far to the peer
+// over a new stream.
+func (s *MuxStream) control(port uint16) error {
+	ctl, err := s.session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer ctl.Close()
+
+	buf := make([]byte, 14)
+	binary.BigEndian.PutUint16(buf, port)
+	binary.BigEndian.PutUint32(buf[2:], s.stream.ID())
+	binary.BigEndian.PutUint64(buf[6:], uint64(s.written.Load()))
+	if _, err := ctl.Write(buf); err != nil {
+		return fmt.Errorf("failed to send control %d of stream %d: %w", port, s.stream.ID(), err)
+	}
+	return nil
+}
+
+func (s *MuxStream) Close() error {
+	muxStreams.Delete(muxStreamKey{s.session, s.stream.ID()})
+	return s.stream.Close()
+}
+
+// IsMuxControl reports whether port is sent on a stream controlling another.
+func IsMuxControl(port uint16) bool {
+	return port == MuxHalfClosePort || port == MuxResetPort
+}
+
+// ReceiveMuxControl reads a half-close or reset sent by the peer over ctl,
+// after its port, and passes it on to the stream of session it is meant for.
+func ReceiveMuxControl(session *smux.Session, port uint16, ctl net.Conn) error {
+	defer ctl.Close()
+
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(ctl, buf); err != nil {
+		return fmt.Errorf("failed to read control %d: %w", port, err)
+	}
+	id := binary.BigEndian.Uint32(buf)
+	v, ok := muxStreams.Load(muxStreamKey{session, id})
+	if !ok {
+		return nil // already gone
+	}
+
+	s := v.(*MuxStream)
+	if port == MuxResetPort {
+		s.reset.Store(true)
+	} else {
+		s.eof.Store(int64(binary.BigEndian.Uint64(buf[4:])))
+	}
+	// the data came in before the control stream, so a reader still blocked
+	// has read it all and only waits for the EOF
+	return s.stream.SetReadDeadline(time.Now())
+}
+
+// SendMuxGoAway tells the peer over a new stream of session that session ends
+// once its streams finished, at most after drain.
+func SendMuxGoAway(session *smux.Session, drain time.Duration) error {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := SendBinaryInt(stream, MuxGoAwayPort); err != nil {
+		return err
+	}
+	return SendBinaryInt(stream, uint16(min(drain/time.Second, math.MaxUint16)))
+}
+
+// ReceiveMuxGoAway reads how long the streams of a session going away get to
+// finish, sent after MuxGoAwayPort over ctl.
+func ReceiveMuxGoAway(ctl net.Conn) (time.Duration, error) {
+	defer ctl.Close()
+
+	seconds, err := ReceiveBinaryInt(ctl)
+	if err != nil {
+		return 0, err
+	}
+	return time.Duration(seconds) * time.Second, nil
+}
+
+// SendMuxRetire tells the peer over a new stream of session that session is
+// retired, and waits up to timeout for its answer.
+func SendMuxRetire(session *smux.Session, timeout time.Duration) error {
+	stream, err := session.OpenStream()
+	if err != nil {
+		return err
+	}
+	defer stream.Close()
+
+	if err := SendBinaryInt(stream, MuxRetirePort); err != nil {
+		return err
+	}
+	stream.SetReadDeadline(time.Now().Add(timeout))
+	if _, err := io.ReadFull(stream, make([]byte, 1)); err != nil {
+		return fmt.Errorf("no answer to retiring the session: %w", err)
+	}
+	return nil
+}
+
+// AckMuxRetire answers the server over ctl that it may close the session.
+func AckMuxRetire(ctl net.Conn) error {
+	defer ctl.Close()
+	_, err := ctl.Write([]byte{1})
+	return err
+}
+
+// DrainSession waits until the streams of session finished or drain passed,
+// and returns how many are left.
+func DrainSession(session *smux.Session, drain time.Duration) int {
+	ticker := time.NewTicker(drainPoll)
+	defer ticker.Stop()
+
+	deadline := time.After(drain)
+	for Streams(session) > 0 {
+		select {
+		case <-ticker.C:
+		case <-deadline:
+			return Streams(session)
+		case <-session.CloseChan():
+			return 0
+		}
+	}
+	return 0
+}
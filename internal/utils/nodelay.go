@@ -0,0 +1,72 @@
+package utils
+
+import (
+	"net"
+)
+
+// Writes of at least bulkWrite bytes look like a bulk transfer, writes below
+// smallWrite like an interactive one. A few in a row are needed to switch, so
+// the odd large or small write doesn't flip a stream back and forth.
+const (
+	bulkWrite  = 8 * 1024
+	smallWrite = 1024
+	bulkAfter  = 4
+	smallAfter = 2
+)
+
+// nodelayConn switches TCP_NODELAY of a connection by what is written to it.
+type nodelayConn struct {
+	net.Conn
+	tcp     *net.TCPConn
+	nodelay bool
+	streak  int // writes in a row that point the other way
+}
+
+// AutoNodelay wraps conn so that TCP_NODELAY follows what is written to it
+// when auto is on: on while the writes are small, so interactive traffic such
+// as SSH keystrokes goes out at once, and off once they fill the buffer, so
+// Nagle's algorithm batches a download into full segments. conn is returned
+// as is when auto is off or there is no TCP connection underneath, e.g. for a
+// mux stream.
+func AutoNodelay(conn net.Conn, auto bool) net.Conn {
+	if !auto {
+		return conn
+	}
+	for inner := conn; ; {
+		switch c := inner.(type) {
+		case *net.TCPConn:
+			c.SetNoDelay(true)
+			return &nodelayConn{Conn: conn, tcp: c, nodelay: true}
+		case interface{ NetConn() net.Conn }:
+			inner = c.NetConn()
+		default:
+			return conn
+		}
+	}
+}
+
+func (c *nodelayConn) Write(b []byte) (int, error) {
+	switch {
+	case c.nodelay && len(b) >= bulkWrite, !c.nodelay && len(b) < smallWrite:
+		c.streak++
+	default:
+		c.streak = 0
+	}
+	after := bulkAfter
+	if !c.nodelay {
+		after = smallAfter
+	}
+	if c.streak >= after {
+		// turning it back on sends what Nagle holds right away
+		if c.tcp.SetNoDelay(!c.nodelay) == nil {
+			c.nodelay = !c.nodelay
+		}
+		c.streak = 0
+	}
+	return c.Conn.Write(b)
+}
+
+// NetConn returns the underlying connection.
+func (c *nodelayConn) NetConn() net.Conn {
+	return c.Conn
+}
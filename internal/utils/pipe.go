@@ -0,0 +1,85 @@
+package utils
+
+import (
+	"context"
+	"net"
+	"time"
+)
+
+// PipeRetryDelay is how long ServePipes waits to hand the server transport
+// another connection after one ended right away, so a client that can't take
+// them doesn't make it spin.
+const PipeRetryDelay = time.Second
+
+// pipeConn is the end of a pipe handed to the server transport, which expects
+// the addresses of a TCP connection.
+type pipeConn struct {
+	net.Conn
+	local, remote *net.TCPAddr
+}
+
+func (c *pipeConn) LocalAddr() net.Addr {
+	return c.local
+}
+
+func (c *pipeConn) RemoteAddr() net.Addr {
+	return c.remote
+}
+
+// PipeConn returns the ends of a pipe: one for a service of the server, and
+// one to hand to the server transport as a connection for the target port
+// from the address from, 127.0.0.1 if nil.
+func PipeConn(port int, from net.IP) (net.Conn, net.Conn) {
+	if from == nil {
+		from = net.IPv4(127, 0, 0, 1)
+	}
+	local, remote := net.Pipe()
+	return local, &pipeConn{Conn: remote, local: &net.TCPAddr{IP: from, Port: port}, remote: &net.TCPAddr{IP: from}}
+}
+
+// ServePipes keeps n connections from PipeConn handed to the server
+// transport over conns until ctx is done, and serves the other end of each in
+// a goroutine of its own. serve calls release, in its goroutine, once the
+// transport may get another connection in place of its own, or returns. The
+// other end is closed after serve, and with ctx.
+func ServePipes(ctx context.Context, conns chan<- net.Conn, n, port int, from net.IP, serve func(conn net.Conn, release func())) {
+	slots := make(chan struct{}, n)
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+			return
+		}
+		local, remote := PipeConn(port, from)
+		select {
+		case conns <- remote:
+		case <-ctx.Done():
+			local.Close()
+			remote.Close()
+			return
+		}
+
+		go func() {
+			released := false
+			release := func() {
+				if !released {
+					released = true
+					<-slots
+				}
+			}
+			start := time.Now()
+			stop := context.AfterFunc(ctx, func() { local.Close() })
+			serve(local, release)
+			stop()
+			local.Close()
+
+			if !released && ctx.Err() == nil && time.Since(start) < PipeRetryDelay {
+				select {
+				case <-time.After(PipeRetryDelay):
+				case <-ctx.Done():
+				}
+			}
+			release()
+		}()
+	}
+}
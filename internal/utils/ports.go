@@ -0,0 +1,223 @@
+package utils
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/config"
+)
+
+// MaxReservedPort is the highest of the target ports sent in place of one for
+// a message to the client, from SpeedtestPort and MuxScalePort up to
+// MuxControlStreamPort, the tun, DNS and exit node ports among them. A public
+// port can't target them, the client would take its connections for the
+// messages.
+const MaxReservedPort = 12
+
+// checkTarget returns an error for a reserved target port, in mapping.
+func checkTarget(port int, mapping string) error {
+	if port <= MaxReservedPort {
+		return fmt.Errorf("target port %d in %s is reserved for messages to the client, use a port over %d", port, mapping, MaxReservedPort)
+	}
+	return nil
+}
+
+var portMappingRegex = regexp.MustCompile(`^(?:(?:\[(\d+):(\d+)\](?:=(\d+))?)|(?:(\d+)(?::(\d+))?(?:=(\d+))?))$`)
+
+// PortMapping maps a local listen port to the port the client dials.
+type PortMapping struct {
+	LocalPort  int
+	RemotePort int
+	Name       string // of the forward table
+	Bind       string // IP address to listen on, empty for ports_addr
+}
+
+// Addr returns the address to listen on, on host unless the mapping has an
+// address of its own.
+func (m PortMapping) Addr(host string) string {
+	if m.Bind != "" {
+		host = m.Bind
+	}
+	return net.JoinHostPort(host, strconv.Itoa(m.LocalPort))
+}
+
+// ParsePorts expands the ports entries and the forward tables of a server
+// into single port mappings.
+func ParsePorts(ports []string, forwards []config.Forward) ([]PortMapping, error) {
+	mappings, err := ParsePortMappings(ports)
+	if err != nil {
+		return nil, err
+	}
+	for _, forward := range forwards {
+		expanded, err := ParseForward(forward)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, expanded...)
+	}
+	return mappings, nil
+}
+
+// ParseForward expands a forward table into single port mappings.
+func ParseForward(forward config.Forward) ([]PortMapping, error) {
+	name := forward.Name
+	if name == "" {
+		name = "listen=" + strconv.Itoa(forward.Listen)
+	}
+	end := forward.ListenEnd
+	if end == 0 {
+		end = forward.Listen
+	}
+	for _, port := range []int{forward.Listen, end} {
+		if port < 1 || port > 65535 {
+			return nil, fmt.Errorf("invalid port %d in forward %s", port, name)
+		}
+	}
+	if forward.Listen > end {
+		return nil, fmt.Errorf("invalid range: %d %d in forward %s", forward.Listen, end, name)
+	}
+	if forward.TargetPort < 0 || forward.TargetPort > 65535 {
+		return nil, fmt.Errorf("invalid target_port %d in forward %s", forward.TargetPort, name)
+	}
+	switch forward.Proto {
+	case "", config.ProtoTCP, config.ProtoHTTP:
+	default:
+		return nil, fmt.Errorf("unsupported proto %q in forward %s, use %q or %q", forward.Proto, name, config.ProtoTCP, config.ProtoHTTP)
+	}
+	if forward.Bind != "" && net.ParseIP(forward.Bind) == nil {
+		return nil, fmt.Errorf("bind %q in forward %s is not an IP address", forward.Bind, name)
+	}
+
+	mappings := make([]PortMapping, 0, end-forward.Listen+1)
+	for port := forward.Listen; port <= end; port++ {
+		target := forward.TargetPort
+		if target == 0 {
+			target = port
+		}
+		if err := checkTarget(target, "forward "+name); err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, PortMapping{LocalPort: port, RemotePort: target, Name: forward.Name, Bind: forward.Bind})
+	}
+	return mappings, nil
+}
+
+// ParsePortMappings expands the port mapping strings ("4000=5000", "4000",
+// "[4000:4005]", "4000:4005=5000") into single port mappings.
+func ParsePortMappings(ports []string) ([]PortMapping, error) {
+	var mappings []PortMapping
+	for _, portMapping := range ports {
+		expanded, err := ParsePortMapping(portMapping)
+		if err != nil {
+			return nil, err
+		}
+		mappings = append(mappings, expanded...)
+	}
+	return mappings, nil
+}
+
+// ParsePortMapping expands a single port mapping string.
+func ParsePortMapping(portMapping string) ([]PortMapping, error) {
+	var groups = portMappingRegex.FindStringSubmatch(portMapping)
+	if groups == nil {
+		return nil, fmt.Errorf("invalid port mapping format: %s", portMapping)
+	}
+	var validGroups []int
+	for i := 1; i < len(groups); i++ {
+		if groups[i] != "" {
+			var num, err = strconv.Atoi(groups[i])
+			if err != nil || num < 1 || num > 65535 {
+				return nil, fmt.Errorf("invalid port %s in port mapping: %s", groups[i], portMapping)
+			}
+			validGroups = append(validGroups, num)
+		}
+	}
+	var remotePort = -1
+	var startRange = validGroups[0]
+	var endRange = startRange
+	if strings.Contains(portMapping, "=") {
+		remotePort = validGroups[len(validGroups)-1]
+		if len(validGroups) == 3 {
+			endRange = validGroups[1]
+		}
+	} else {
+		if len(validGroups) == 2 {
+			endRange = validGroups[1]
+		}
+	}
+	if startRange > endRange {
+		return nil, fmt.Errorf("invalid range: %d %d", startRange, endRange)
+	}
+	var mappings = make([]PortMapping, 0, endRange-startRange+1)
+	for i := startRange; i <= endRange; i++ {
+		target := remotePort
+		if target == -1 {
+			target = i
+		}
+		if err := checkTarget(target, "port mapping "+portMapping); err != nil {
+			return nil, err
+		}
+		if remotePort == -1 {
+			mappings = append(mappings, PortMapping{LocalPort: i, RemotePort: i})
+		} else {
+			mappings = append(mappings, PortMapping{LocalPort: i, RemotePort: remotePort})
+		}
+	}
+	return mappings, nil
+}
+
+// PortRange is an inclusive range of ports.
+type PortRange struct {
+	Start int
+	End   int
+}
+
+// PortRanges is a set of port ranges.
+type PortRanges []PortRange
+
+// Contains reports whether port is in one of the ranges.
+func (r PortRanges) Contains(port int) bool {
+	for _, portRange := range r {
+		if port >= portRange.Start && port <= portRange.End {
+			return true
+		}
+	}
+	return false
+}
+
+// ParsePortRanges parses a list of ports and port ranges as decoded from the
+// configuration, e.g. [80, 443, "8000-8100"].
+func ParsePortRanges(values []any) (PortRanges, error) {
+	var ranges PortRanges
+	for _, value := range values {
+		var portRange PortRange
+		switch v := value.(type) {
+		case int64:
+			portRange = PortRange{Start: int(v), End: int(v)}
+		case string:
+			start, end, isRange := strings.Cut(strings.TrimSpace(v), "-")
+			first, err := strconv.Atoi(strings.TrimSpace(start))
+			if err != nil {
+				return nil, fmt.Errorf("invalid port %q", v)
+			}
+			last := first
+			if isRange {
+				if last, err = strconv.Atoi(strings.TrimSpace(end)); err != nil {
+					return nil, fmt.Errorf("invalid port range %q", v)
+				}
+			}
+			portRange = PortRange{Start: first, End: last}
+		default:
+			return nil, fmt.Errorf("invalid port %v", value)
+		}
+
+		if portRange.Start < 1 || portRange.End > 65535 || portRange.Start > portRange.End {
+			return nil, fmt.Errorf("invalid port range: %d %d", portRange.Start, portRange.End)
+		}
+		ranges = append(ranges, portRange)
+	}
+	return ranges, nil
+}
@@ -0,0 +1,29 @@
+package utils
+
+import "testing"
+
+func FuzzParsePortMapping(f *testing.F) {
+	for _, seed := range []string{
+		"4000", "4000=5000", "[4000:4005]", "4000:4005=5000", "[4000:4005]=5000",
+		"4000=5", "0", "70000", "[1:999999999]", "4005:4000", "4000\n5000", "",
+	} {
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, portMapping string) {
+		mappings, err := ParsePortMapping(portMapping)
+		if err != nil {
+			return
+		}
+		if len(mappings) == 0 {
+			t.Fatalf("%q parsed into no mapping", portMapping)
+		}
+		for _, mapping := range mappings {
+			if mapping.LocalPort < 1 || mapping.LocalPort > 65535 {
+				t.Fatalf("%q parsed into local port %d", portMapping, mapping.LocalPort)
+			}
+			if mapping.RemotePort <= MaxReservedPort || mapping.RemotePort > 65535 {
+				t.Fatalf("%q parsed into target port %d", portMapping, mapping.RemotePort)
+			}
+		}
+	})
+}
@@ -0,0 +1,41 @@
+package utils
+
+import (
+	"errors"
+	"io"
+	"runtime/debug"
+
+	"github.com/sahmadiut/backhaul/internal/web"
+	"github.com/sirupsen/logrus"
+)
+
+// errRelayPanic ends the other direction of a relay whose reading panicked.
+var errRelayPanic = errors.New("relay panicked")
+
+// Recover keeps a panic in the goroutine it is deferred in from taking the
+// whole process down. The panic is logged with its stack and counted in
+// backhaul_panics_total, then conns, those the goroutine handled, are closed
+// so their peers notice. It must be deferred directly:
+//
+//	defer utils.Recover(s.logger, s.usageMonitor, "tcp session", conn)
+func Recover(logger *logrus.Logger, usage *web.Usage, where string, conns ...io.Closer) {
+	r := recover()
+	if r == nil {
+		return
+	}
+	logger.Errorf("recovered from a panic in %s, closing its connections: %v\n%s", where, r, debug.Stack())
+	usage.IncCounter("backhaul_panics_total", "where", where)
+	for _, conn := range conns {
+		if conn != nil {
+			conn.Close()
+		}
+	}
+}
+
+// guardRelay runs one direction of a relay, a panic in it closes conns and
+// ends the direction with closePanic.
+func guardRelay(logger *logrus.Logger, usage *web.Usage, transfer func() string, conns ...io.Closer) (reason string) {
+	reason = closePanic
+	defer Recover(logger, usage, "relay", conns...)
+	return transfer()
+}
@@ -0,0 +1,282 @@
+package utils
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"net"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// TTL bounds of cached target addresses. The fallback is used when the name
+// server can't be asked directly, e.g. for names from /etc/hosts.
+const (
+	minDNSTTL      = 5 * time.Second
+	maxDNSTTL      = time.Hour
+	fallbackDNSTTL = 30 * time.Second
+)
+
+// resolver caches the addresses of target host names for as long as their
+// DNS records live. Expired names are looked up again in the background while
+// the last addresses are still used, and kept when the lookup fails, so a
+// dial neither waits for DNS nor fails while the name server is away.
+type resolver struct {
+	mu    sync.Mutex
+	ttl   time.Duration // overrides the TTL of the records, 0 to use them
+	names map[string]*resolvedName
+}
+
+type resolvedName struct {
+	ips        []net.IP
+	expires    time.Time
+	refreshing bool
+}
+
+var targetResolver = &resolver{names: make(map[string]*resolvedName)}
+
+// SetDNSTTL makes target host names be looked up again every ttl instead of
+// when their records expire, 0 to follow the records.
+func SetDNSTTL(ttl time.Duration) {
+	targetResolver.mu.Lock()
+	defer targetResolver.mu.Unlock()
+	targetResolver.ttl = ttl
+}
+
+// ExpireTarget makes the next dial of address look its host name up again in
+// the background, after none of its addresses answered.
+func ExpireTarget(address string) {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return
+	}
+	targetResolver.mu.Lock()
+	defer targetResolver.mu.Unlock()
+	if name, ok := targetResolver.names[host]; ok {
+		name.expires = time.Time{}
+	}
+}
+
+// lookup returns the addresses of host.
+func (r *resolver) lookup(host string) ([]net.IP, error) {
+	r.mu.Lock()
+	name, ok := r.names[host]
+	if ok && len(name.ips) > 0 {
+		if time.Now().After(name.expires) && !name.refreshing {
+			name.refreshing = true
+			go r.refresh(host)
+		}
+		ips := name.ips
+		r.mu.Unlock()
+		return ips, nil
+	}
+	r.mu.Unlock()
+
+	return r.refresh(host)
+}
+
+// refresh looks host up and caches the result, keeping the last addresses
+// when it fails.
+func (r *resolver) refresh(host string) ([]net.IP, error) {
+	ips, ttl, err := queryHost(host)
+	if err != nil {
+		// not known to the name server, or no name server to ask
+		var addrs []net.IPAddr
+		addrs, err = net.DefaultResolver.LookupIPAddr(context.Background(), host)
+		ips, ttl = nil, fallbackDNSTTL
+		for _, addr := range addrs {
+			ips = append(ips, addr.IP)
+		}
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	name, ok := r.names[host]
+	if !ok {
+		name = &resolvedName{}
+		r.names[host] = name
+	}
+	name.refreshing = false
+	if err != nil {
+		if len(name.ips) > 0 {
+			// try again soon, with the addresses we had until then
+			name.expires = time.Now().Add(minDNSTTL)
+			return name.ips, nil
+		}
+		delete(r.names, host)
+		return nil, err
+	}
+
+	if r.ttl > 0 {
+		ttl = r.ttl
+	}
+	name.ips = ips
+	name.expires = time.Now().Add(min(max(ttl, minDNSTTL), maxDNSTTL))
+	return ips, nil
+}
+
+// queryHost asks the first name server of /etc/resolv.conf for the A and
+// AAAA records of host, and returns the addresses with the lowest TTL among
+// the records.
+func queryHost(host string) ([]net.IP, time.Duration, error) {
+	server, err := nameServer()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var ips []net.IP
+	ttl := maxDNSTTL
+	for _, qtype := range []uint16{dnsTypeA, dnsTypeAAAA} {
+		found, foundTTL, err := queryDNS(server, host, qtype)
+		if err != nil {
+			return nil, 0, err
+		}
+		ips = append(ips, found...)
+		if len(found) > 0 {
+			ttl = min(ttl, foundTTL)
+		}
+	}
+	if len(ips) == 0 {
+		return nil, 0, fmt.Errorf("no address for %s", host)
+	}
+	return ips, ttl, nil
+}
+
+func nameServer() (string, error) {
+	f, err := os.Open("/etc/resolv.conf")
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "nameserver" {
+			return net.JoinHostPort(fields[1], "53"), nil
+		}
+	}
+	return "", errors.New("no nameserver in /etc/resolv.conf")
+}
+
+const (
+	dnsTypeA     = 1
+	dnsTypeCNAME = 5
+	dnsTypeAAAA  = 28
+)
+
+var errDNSMessage = errors.New("malformed DNS response")
+
+// queryDNS sends a single question over UDP and returns the addresses of the
+// answer with the lowest TTL among its records, CNAMEs included.
+func queryDNS(server, host string, qtype uint16) ([]net.IP, time.Duration, error) {
+	query := make([]byte, 12, 512)
+	id := uint16(rand.Uint32())
+	binary.BigEndian.PutUint16(query, id)
+	binary.BigEndian.PutUint16(query[2:], 0x0100) // recursion desired
+	binary.BigEndian.PutUint16(query[4:], 1)      // one question
+	for _, label := range strings.Split(strings.TrimSuffix(host, "."), ".") {
+		if len(label) == 0 || len(label) > 63 {
+			return nil, 0, fmt.Errorf("invalid host name %q", host)
+		}
+		query = append(query, byte(len(label)))
+		query = append(query, label...)
+	}
+	query = append(query, 0)
+	query = binary.BigEndian.AppendUint16(query, qtype)
+	query = binary.BigEndian.AppendUint16(query, 1) // IN
+
+	conn, err := net.DialTimeout("udp", server, 2*time.Second)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(2 * time.Second))
+	if _, err := conn.Write(query); err != nil {
+		return nil, 0, err
+	}
+
+	msg := make([]byte, 1500)
+	for {
+		n, err := conn.Read(msg)
+		if err != nil {
+			return nil, 0, err
+		}
+		if n >= 12 && binary.BigEndian.Uint16(msg) == id {
+			msg = msg[:n]
+			break
+		}
+	}
+
+	flags := binary.BigEndian.Uint16(msg[2:])
+	if flags&0x0200 != 0 {
+		return nil, 0, errors.New("truncated DNS response")
+	}
+	if rcode := flags & 0x000f; rcode != 0 {
+		return nil, 0, fmt.Errorf("DNS lookup of %s failed with rcode %d", host, rcode)
+	}
+
+	questions := int(binary.BigEndian.Uint16(msg[4:]))
+	answers := int(binary.BigEndian.Uint16(msg[6:]))
+	off := 12
+	for i := 0; i < questions; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		off += 4
+	}
+
+	var ips []net.IP
+	ttl := maxDNSTTL
+	for i := 0; i < answers; i++ {
+		if off, err = skipDNSName(msg, off); err != nil {
+			return nil, 0, err
+		}
+		if off+10 > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		rtype := binary.BigEndian.Uint16(msg[off:])
+		rttl := time.Duration(binary.BigEndian.Uint32(msg[off+4:])) * time.Second
+		length := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+length > len(msg) {
+			return nil, 0, errDNSMessage
+		}
+		data := msg[off : off+length]
+		off += length
+
+		switch {
+		case rtype == qtype && rtype == dnsTypeA && length == net.IPv4len,
+			rtype == qtype && rtype == dnsTypeAAAA && length == net.IPv6len:
+			ips = append(ips, net.IP(append([]byte(nil), data...)))
+		case rtype == dnsTypeCNAME:
+		default:
+			continue
+		}
+		ttl = min(ttl, rttl)
+	}
+	return ips, ttl, nil
+}
+
+// skipDNSName returns the offset after the (possibly compressed) name at off.
+func skipDNSName(msg []byte, off int) (int, error) {
+	for {
+		if off >= len(msg) {
+			return 0, errDNSMessage
+		}
+		length := int(msg[off])
+		switch {
+		case length == 0:
+			return off + 1, nil
+		case length&0xc0 == 0xc0: // pointer, the name ends here
+			return off + 2, nil
+		default:
+			off += 1 + length
+		}
+	}
+}
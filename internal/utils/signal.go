@@ -0,0 +1,70 @@
+package utils
+
+import (
+	"strconv"
+	"strings"
+)
+
+// AcksMessage is sent by a tcp client on the control channel after its ID to
+// acknowledge the channel signals from then on. Older servers never read it.
+const AcksMessage = "acks"
+
+// AcksHeader is set on the WebSocket handshake of the control channel by a
+// client that acknowledges channel signals.
+const AcksHeader = "X-Backhaul-Acks"
+
+// the control channel messages of a client about a tunnel connection it was
+// asked for
+const (
+	ackPrefix  = "ack "
+	nackPrefix = "nack "
+)
+
+// SignalMessage returns sig numbered seq, for a client that acknowledges
+// signals.
+func SignalMessage(sig string, seq uint64) string {
+	return sig + " " + strconv.FormatUint(seq, 10)
+}
+
+// ParseSignal splits a channel signal into the signal and its sequence
+// number, 0 for a signal without one.
+func ParseSignal(msg string) (string, uint64) {
+	sig, number, ok := strings.Cut(msg, " ")
+	if !ok {
+		return msg, 0
+	}
+	seq, err := strconv.ParseUint(number, 10, 64)
+	if err != nil {
+		return msg, 0
+	}
+	return sig, seq
+}
+
+// AckMessage returns the acknowledgment of signal seq: the tunnel connection
+// was opened, or it failed with err.
+func AckMessage(seq uint64, err error) string {
+	if err != nil {
+		return nackPrefix + strconv.FormatUint(seq, 10) + " " + err.Error()
+	}
+	return ackPrefix + strconv.FormatUint(seq, 10)
+}
+
+// ParseAck returns the signal msg acknowledges and why the tunnel connection
+// failed, empty if it was opened. ok is false if msg is no acknowledgment.
+func ParseAck(msg string) (seq uint64, failure string, ok bool) {
+	rest, nack := strings.CutPrefix(msg, nackPrefix)
+	if !nack {
+		if rest, ok = strings.CutPrefix(msg, ackPrefix); !ok {
+			return 0, "", false
+		}
+	}
+	number, failure, _ := strings.Cut(rest, " ")
+	seq, err := strconv.ParseUint(number, 10, 64)
+	if err != nil || seq == 0 {
+		return 0, "", false
+	}
+	if nack && failure == "" {
+		failure = "unknown error"
+	}
+	return seq, failure, true
+}
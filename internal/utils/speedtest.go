@@ -0,0 +1,196 @@
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+// SpeedtestPort is sent instead of a target port to open a speedtest stream.
+// Port 0 can never be dialed, so older clients just close the stream.
+const SpeedtestPort = 0
+
+// speedtest commands, each followed by an 8-byte argument
+const (
+	speedtestPing     = 'p' // echoed back as is
+	speedtestUpload   = 'u' // the argument is the number of bytes that follow, acked when read
+	speedtestDownload = 'd' // the responder sends back the number of bytes in the argument
+)
+
+const speedtestPings = 10
+
+// SpeedtestResult is the outcome of a speedtest through the tunnel.
+type SpeedtestResult struct {
+	Bytes    int64     `json:"bytes"`    // sent each way
+	Latency  float64   `json:"latency"`  // average round trip in milliseconds
+	Upload   float64   `json:"upload"`   // server to client goodput in Mbit/s
+	Download float64   `json:"download"` // client to server goodput in Mbit/s
+	Finished time.Time `json:"finished"`
+}
+
+func (r SpeedtestResult) String() string {
+	return fmt.Sprintf("latency %.2f ms, upload %.1f Mbit/s, download %.1f Mbit/s", r.Latency, r.Upload, r.Download)
+}
+
+// RunSpeedtest measures latency and goodput in both directions through a
+// stream the other side answers with ServeSpeedtest.
+func RunSpeedtest(rw io.ReadWriter, size int64) (SpeedtestResult, error) {
+	result := SpeedtestResult{Bytes: size}
+	cmd := make([]byte, 9)
+
+	// latency
+	var total time.Duration
+	for i := 0; i < speedtestPings; i++ {
+		rtt, err := SpeedtestPing(rw, uint64(i))
+		if err != nil {
+			return result, err
+		}
+		total += rtt
+	}
+	result.Latency = float64(total.Microseconds()) / speedtestPings / 1000
+
+	// upload, until the client acks the last byte
+	start := time.Now()
+	if err := writeCommand(rw, speedtestUpload, uint64(size)); err != nil {
+		return result, err
+	}
+	if err := writeZeros(rw, size); err != nil {
+		return result, err
+	}
+	if _, err := io.ReadFull(rw, cmd); err != nil {
+		return result, err
+	}
+	result.Upload = mbits(size, time.Since(start))
+
+	// download
+	start = time.Now()
+	if err := writeCommand(rw, speedtestDownload, uint64(size)); err != nil {
+		return result, err
+	}
+	if _, err := io.CopyN(io.Discard, rw, size); err != nil {
+		return result, err
+	}
+	result.Download = mbits(size, time.Since(start))
+
+	result.Finished = time.Now()
+	return result, nil
+}
+
+// SpeedtestPing sends one ping through a stream the other side answers with
+// ServeSpeedtest and returns its round trip.
+func SpeedtestPing(rw io.ReadWriter, seq uint64) (time.Duration, error) {
+	cmd := make([]byte, 9)
+	start := time.Now()
+	if err := writeCommand(rw, speedtestPing, seq); err != nil {
+		return 0, err
+	}
+	if _, err := io.ReadFull(rw, cmd); err != nil {
+		return 0, fmt.Errorf("no answer from the client, it may not support speedtests: %w", err)
+	}
+	if cmd[0] != speedtestPing || binary.BigEndian.Uint64(cmd[1:]) != seq {
+		return 0, errors.New("unexpected answer to a speedtest ping")
+	}
+	return time.Since(start), nil
+}
+
+// ServeSpeedtest answers speedtest commands until the stream is closed.
+func ServeSpeedtest(rw io.ReadWriter) error {
+	cmd := make([]byte, 9)
+	for {
+		if _, err := io.ReadFull(rw, cmd); err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil
+			}
+			return err
+		}
+		arg := binary.BigEndian.Uint64(cmd[1:])
+
+		switch cmd[0] {
+		case speedtestPing:
+			if _, err := rw.Write(cmd); err != nil {
+				return err
+			}
+		case speedtestUpload:
+			if _, err := io.CopyN(io.Discard, rw, int64(arg)); err != nil {
+				return err
+			}
+			if _, err := rw.Write(cmd); err != nil {
+				return err
+			}
+		case speedtestDownload:
+			if err := writeZeros(rw, int64(arg)); err != nil {
+				return err
+			}
+		default:
+			return fmt.Errorf("unknown speedtest command %q", cmd[0])
+		}
+	}
+}
+
+func writeCommand(w io.Writer, op byte, arg uint64) error {
+	cmd := make([]byte, 9)
+	cmd[0] = op
+	binary.BigEndian.PutUint64(cmd[1:], arg)
+	_, err := w.Write(cmd)
+	return err
+}
+
+func writeZeros(w io.Writer, n int64) error {
+	buf := make([]byte, 32*1024)
+	for n > 0 {
+		chunk := min(n, int64(len(buf)))
+		if _, err := w.Write(buf[:chunk]); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+func mbits(bytes int64, elapsed time.Duration) float64 {
+	return float64(bytes) * 8 / elapsed.Seconds() / 1e6
+}
+
+// WSStream reads and writes a websocket connection as a byte stream, one
+// binary message per write.
+type WSStream struct {
+	Conn   *websocket.Conn
+	reader io.Reader
+}
+
+func (s *WSStream) Read(p []byte) (int, error) {
+	for {
+		if s.reader == nil {
+			_, reader, err := s.Conn.NextReader()
+			if err != nil {
+				return 0, err
+			}
+			s.reader = reader
+		}
+
+		n, err := s.reader.Read(p)
+		if errors.Is(err, io.EOF) {
+			s.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (s *WSStream) Write(p []byte) (int, error) {
+	if err := s.Conn.WriteMessage(websocket.BinaryMessage, p); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *WSStream) Close() error {
+	return s.Conn.Close()
+}
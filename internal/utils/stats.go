@@ -0,0 +1,48 @@
+package utils
+
+import (
+	"encoding/json"
+	"strings"
+
+	"github.com/sahmadiut/backhaul/internal/control"
+)
+
+// StatsMessage is sent by a tcp client on the control channel after its ID
+// to report its stats. A server that reads them numbers its heartbeats from
+// then on, and the client answers each numbered heartbeat with a
+// ClientStatsMessage. Older servers never read it.
+const StatsMessage = "stats"
+
+// StatsHeader is set on the WebSocket handshake of the control channel by a
+// client that reports its stats.
+const StatsHeader = "X-Backhaul-Stats"
+
+// the control channel message of a client with its stats as JSON
+const statsPrefix = "stats "
+
+// HeartbeatMessage returns the heartbeat sig, numbered to ask the client for
+// its stats if stats is set. Clients that parse signals ignore the number
+// otherwise.
+func HeartbeatMessage(sig string, stats bool) string {
+	if !stats {
+		return sig
+	}
+	return SignalMessage(sig, 1)
+}
+
+// ClientStatsMessage returns the control channel message reporting stats.
+func ClientStatsMessage(stats control.ClientStats) string {
+	payload, _ := json.Marshal(stats)
+	return statsPrefix + string(payload)
+}
+
+// ParseClientStats returns the stats reported by msg, if it is a
+// ClientStatsMessage.
+func ParseClientStats(msg string) (control.ClientStats, bool) {
+	var stats control.ClientStats
+	payload, ok := strings.CutPrefix(msg, statsPrefix)
+	if !ok || json.Unmarshal([]byte(payload), &stats) != nil {
+		return stats, false
+	}
+	return stats, true
+}
@@ -0,0 +1,51 @@
+//go:build linux
+
+package utils
+
+import (
+	"bufio"
+	"errors"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// SynCookies reports how many SYN cookies the kernel sent since boot, which
+// it does when the SYN backlog of a port overflows, and whether they are
+// enabled by net.ipv4.tcp_syncookies.
+func SynCookies() (sent uint64, enabled bool, err error) {
+	value, err := os.ReadFile("/proc/sys/net/ipv4/tcp_syncookies")
+	if err != nil {
+		return 0, false, err
+	}
+	enabled = strings.TrimSpace(string(value)) != "0"
+
+	file, err := os.Open("/proc/net/netstat")
+	if err != nil {
+		return 0, enabled, err
+	}
+	defer file.Close()
+
+	// pairs of lines, the names of a group's counters and then their values
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		names := strings.Fields(scanner.Text())
+		if !scanner.Scan() {
+			break
+		}
+		values := strings.Fields(scanner.Text())
+		if len(names) == 0 || names[0] != "TcpExt:" || len(values) != len(names) {
+			continue
+		}
+		for i, name := range names {
+			if name == "SyncookiesSent" {
+				sent, err = strconv.ParseUint(values[i], 10, 64)
+				return sent, enabled, err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return 0, enabled, err
+	}
+	return 0, enabled, errors.New("SyncookiesSent not found in /proc/net/netstat")
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+
+package utils
+
+import "errors"
+
+// SynCookies reports the SYN cookies sent by the kernel, only on Linux.
+func SynCookies() (sent uint64, enabled bool, err error) {
+	return 0, false, errors.New("SYN cookies can only be read on Linux")
+}
@@ -4,34 +4,78 @@ import (
 	"errors"
 	"io"
 	"net"
+	"strconv"
+	"sync/atomic"
 
 	"github.com/sahmadiut/backhaul/internal/web"
 	"github.com/sirupsen/logrus"
 )
 
-func ConnectionHandler(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	done := make(chan struct{})
+var activeRelays atomic.Int64 // connection pairs being relayed
+
+// ActiveRelays returns the number of connection pairs currently being relayed.
+func ActiveRelays() int64 {
+	return activeRelays.Load()
+}
+
+// trackRelay counts a relayed connection pair until the returned function is called.
+func trackRelay(usage *web.Usage, remotePort int) func() {
+	port := strconv.Itoa(remotePort)
+
+	activeRelays.Add(1)
+	usage.IncCounter("backhaul_port_connections_total", "port", port)
+	usage.AddGauge("backhaul_port_connections", 1, "port", port)
+
+	return func() {
+		activeRelays.Add(-1)
+		usage.AddGauge("backhaul_port_connections", -1, "port", port)
+	}
+}
+
+// ConnectionHandler relays between two connections until both directions
+// ended and returns why the relay ended.
+func ConnectionHandler(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) string {
+	defer trackRelay(usage, remotePort)()
+
+	done := make(chan string, 1)
 
 	go func() {
-		defer close(done)
-		transferData(from, to, logger, usage, remotePort, sniffer)
+		done <- guardRelay(logger, usage, func() string {
+			return transferData(from, to, logger, usage, remotePort, sniffer)
+		}, from, to)
 	}()
 
-	transferData(to, from, logger, usage, remotePort, sniffer)
-
-	<-done
+	reason := guardRelay(logger, usage, func() string {
+		return transferData(to, from, logger, usage, remotePort, sniffer)
+	}, from, to)
+	reason = worseReason(reason, <-done)
 
 	from.Close()
 	to.Close()
+
+	logRelayEnd(logger, usage, remotePort, reason)
+	return reason
 }
 
-// Using direct Read and Write for transferring data
-func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// Using direct Read and Write for transferring data. It returns why the
+// direction ended, empty if the connections were closed by the other one.
+func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) string {
 	buf := make([]byte, 16*1024) // 16K
 	for {
 		// Read data from the source connection
 		r, err := from.Read(buf)
 		if err != nil {
+			if errors.Is(err, io.EOF) && CloseWrite(to) {
+				// keep relaying the other direction until it ends too
+				logger.Trace("EOF received, half-closed the writer stream")
+				return closeFin
+			}
+			if isReset(err) {
+				logger.Trace("reader stream reset, resetting the writer stream")
+				from.Close()
+				ResetConn(to)
+				return closeReset
+			}
 			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				logger.Trace("reader stream closed or EOF received")
 			} else {
@@ -40,7 +84,18 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 
 			from.Close()
 			to.Close()
-			return
+			return readReason(err)
+		}
+
+		// pass on what else a mux stream holds in the same write
+		if stream, ok := from.(interface{ ReadBuffered([]byte) int }); ok {
+			for r < len(buf) {
+				n := stream.ReadBuffered(buf[r:])
+				if n == 0 {
+					break
+				}
+				r += n
+			}
 		}
 
 		totalWritten := 0
@@ -48,6 +103,12 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 			// Write data to the destination connection
 			w, err := to.Write(buf[totalWritten:r])
 			if err != nil {
+				if isReset(err) {
+					logger.Trace("writer stream reset, resetting the reader stream")
+					to.Close()
+					ResetConn(from)
+					return closeReset
+				}
 				if errors.Is(err, net.ErrClosed) {
 					logger.Trace("writer stream closed or EOF received")
 				} else {
@@ -55,7 +116,7 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 				}
 				from.Close()
 				to.Close()
-				break
+				return writeReason(err)
 			}
 			totalWritten += w
 		}
@@ -67,3 +128,19 @@ func transferData(from net.Conn, to net.Conn, logger *logrus.Logger, usage *web.
 	}
 
 }
+
+// CloseWrite shuts down the writing side of conn so its peer sees EOF while
+// the other direction keeps flowing. It reports false if conn can't be
+// half-closed, then the caller tears the relay down as a whole.
+func CloseWrite(conn net.Conn) bool {
+	for {
+		switch c := conn.(type) {
+		case interface{ CloseWrite() error }:
+			return c.CloseWrite() == nil
+		case interface{ NetConn() net.Conn }:
+			conn = c.NetConn()
+		default:
+			return false
+		}
+	}
+}
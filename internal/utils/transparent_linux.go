@@ -0,0 +1,93 @@
+//go:build linux
+
+package utils
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"unsafe"
+)
+
+// from linux/netfilter_ipv4.h, linux/netfilter_ipv6/ip6_tables.h and linux/in6.h
+const (
+	soOriginalDst     = 80 // SO_ORIGINAL_DST
+	ip6tSoOriginalDst = 80 // IP6T_SO_ORIGINAL_DST
+	ipv6Transparent   = 75 // IPV6_TRANSPARENT
+)
+
+// OriginalDst returns the address a connection redirected to this host by
+// iptables was headed to: the one REDIRECT rewrote, or its local address,
+// which TPROXY leaves as it was.
+func OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	local := conn.LocalAddr().(*net.TCPAddr)
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return nil, err
+	}
+
+	var dst *net.TCPAddr
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		if local.IP.To4() != nil {
+			// the address comes as a sockaddr_in, in a struct big enough for it
+			mreq, err := syscall.GetsockoptIPv6Mreq(int(fd), syscall.SOL_IP, soOriginalDst)
+			if err != nil {
+				sockErr = err
+				return
+			}
+			dst = &net.TCPAddr{IP: net.IP(mreq.Multiaddr[4:8]).To16(), Port: int(binary.BigEndian.Uint16(mreq.Multiaddr[2:4]))}
+			return
+		}
+		info, err := syscall.GetsockoptIPv6MTUInfo(int(fd), syscall.SOL_IPV6, ip6tSoOriginalDst)
+		if err != nil {
+			sockErr = err
+			return
+		}
+		port := (*[2]byte)(unsafe.Pointer(&info.Addr.Port)) // in network order
+		dst = &net.TCPAddr{IP: net.IP(info.Addr.Addr[:]), Port: int(binary.BigEndian.Uint16(port[:]))}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if errors.Is(sockErr, syscall.ENOENT) {
+		return local, nil // not rewritten, TPROXY or no NAT at all
+	}
+	if sockErr != nil {
+		return nil, os.NewSyscallError("getsockopt SO_ORIGINAL_DST", sockErr)
+	}
+	return dst, nil
+}
+
+// SetTransparent lets listener accept the connections TPROXY hands it for
+// any address. It needs CAP_NET_ADMIN, REDIRECT works without it.
+func SetTransparent(listener net.Listener) error {
+	tcpListener, ok := TCPListener(listener)
+	if !ok {
+		return errors.New("not a TCP listener")
+	}
+	raw, err := tcpListener.SyscallConn()
+	if err != nil {
+		return err
+	}
+
+	var sockErr error
+	err = raw.Control(func(fd uintptr) {
+		sockErr = syscall.SetsockoptInt(int(fd), syscall.SOL_IP, syscall.IP_TRANSPARENT, 1)
+		if tcpListener.Addr().(*net.TCPAddr).IP.To4() == nil {
+			// an IPv6 socket, dual-stack ones take both
+			if err := syscall.SetsockoptInt(int(fd), syscall.SOL_IPV6, ipv6Transparent, 1); err != nil && sockErr == nil {
+				sockErr = err
+			}
+		}
+	})
+	if err != nil {
+		return err
+	}
+	if sockErr != nil {
+		return os.NewSyscallError("setsockopt IP_TRANSPARENT", sockErr)
+	}
+	return nil
+}
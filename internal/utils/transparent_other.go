@@ -0,0 +1,22 @@
+//go:build !linux
+
+package utils
+
+import (
+	"errors"
+	"net"
+)
+
+var errNoTransparent = errors.New("transparent_addr is only supported on Linux")
+
+// OriginalDst returns the address a connection redirected to this host by
+// iptables was headed to, only on Linux.
+func OriginalDst(conn *net.TCPConn) (*net.TCPAddr, error) {
+	return nil, errNoTransparent
+}
+
+// SetTransparent lets listener accept the connections TPROXY hands it, only
+// on Linux.
+func SetTransparent(listener net.Listener) error {
+	return errNoTransparent
+}
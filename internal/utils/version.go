@@ -0,0 +1,131 @@
+package utils
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+)
+
+// Version of backhaul, set by main. Clients report it to the server.
+var Version = "dev"
+
+// Protocol is the version of the tunnel protocol this build speaks. It goes
+// up with changes older peers can't follow, and MinProtocol with the older
+// peers it can't serve any more. Peers that send no version speak protocol 0.
+const (
+	Protocol    = 1
+	MinProtocol = 0
+)
+
+// Features of the protocol this build supports. Both ends use the ones they
+// have in common, each announced on its own as well for older peers.
+var Features = []string{
+	"client-id",      // the client sends its ID after the token
+	"acks",           // channel signals are numbered and acknowledged
+	"meta",           // streams carry the address of the public connection
+	"stats",          // the client reports its stats with the heartbeats
+	"commands",       // the server manages clients with remote_management
+	"control-stream", // tcpmux sessions carry heartbeats on a stream of their own
+}
+
+// VersionHeader carries the version of each end on WebSocket handshakes.
+const VersionHeader = "X-Backhaul-Version"
+
+// the control channel messages of tcp with the version of an end, and with
+// the reason the server refused the client
+const (
+	versionPrefix = "version "
+	upgradePrefix = "upgrade-required "
+)
+
+// ErrUpgradeRequired is returned by PeerVersion.Check for a peer that can't
+// work with this build.
+var ErrUpgradeRequired = errors.New("upgrade required")
+
+// PeerVersion is what an end tells the other about itself in the handshake.
+type PeerVersion struct {
+	Version     string   `json:"version"`
+	Protocol    int      `json:"protocol"`
+	MinProtocol int      `json:"min_protocol"` // of the peers it works with
+	Features    []string `json:"features"`
+}
+
+// LocalVersion returns the version of this build.
+func LocalVersion() PeerVersion {
+	return PeerVersion{Version: Version, Protocol: Protocol, MinProtocol: MinProtocol, Features: Features}
+}
+
+// String sums v up for the log.
+func (v PeerVersion) String() string {
+	return fmt.Sprintf("%s (protocol %d)", v.Version, v.Protocol)
+}
+
+// Check returns an ErrUpgradeRequired error naming the end to upgrade if
+// this build and the peer v, the "client" or "server", can't work together.
+func (v PeerVersion) Check(peer string) error {
+	local := "server"
+	if peer == local {
+		local = "client"
+	}
+	if v.Protocol < MinProtocol {
+		return fmt.Errorf("%w: the %s runs %s, this %s needs protocol %d or newer, upgrade the %s",
+			ErrUpgradeRequired, peer, v, local, MinProtocol, peer)
+	}
+	if Protocol < v.MinProtocol {
+		return fmt.Errorf("%w: this %s runs %s, the %s needs protocol %d or newer, upgrade the %s",
+			ErrUpgradeRequired, local, LocalVersion(), peer, v.MinProtocol, local)
+	}
+	return nil
+}
+
+// Missing returns the features of this build the peer v lacks.
+func (v PeerVersion) Missing() []string {
+	var missing []string
+	for _, feature := range Features {
+		if !slices.Contains(v.Features, feature) {
+			missing = append(missing, feature)
+		}
+	}
+	return missing
+}
+
+// Encode returns v as JSON, for VersionHeader and the control stream.
+func (v PeerVersion) Encode() string {
+	data, _ := json.Marshal(v)
+	return string(data)
+}
+
+// ParseVersion decodes a version sent by Encode.
+func ParseVersion(value string) (PeerVersion, error) {
+	var v PeerVersion
+	err := json.Unmarshal([]byte(value), &v)
+	return v, err
+}
+
+// VersionMessage returns the control channel message with v.
+func VersionMessage(v PeerVersion) string {
+	return versionPrefix + v.Encode()
+}
+
+// ParseVersionMessage returns the version in msg, if it is a VersionMessage.
+func ParseVersionMessage(msg string) (PeerVersion, bool) {
+	value, ok := strings.CutPrefix(msg, versionPrefix)
+	if !ok {
+		return PeerVersion{}, false
+	}
+	v, err := ParseVersion(value)
+	return v, err == nil
+}
+
+// UpgradeMessage returns the control channel message refusing a client for
+// reason.
+func UpgradeMessage(reason error) string {
+	return upgradePrefix + reason.Error()
+}
+
+// ParseUpgrade returns the reason in msg, if it is an UpgradeMessage.
+func ParseUpgrade(msg string) (string, bool) {
+	return strings.CutPrefix(msg, upgradePrefix)
+}
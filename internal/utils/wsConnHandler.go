@@ -4,34 +4,124 @@ import (
 	"errors"
 	"io"
 	"net"
+	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/sahmadiut/backhaul/internal/web"
 	"github.com/sirupsen/logrus"
 )
 
-// WebSocketToTCPConnectionHandler handles data transfer between a WebSocket and a TCP connection
-func WSToTCPConnHandler(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
-	done := make(chan struct{})
+// WebSocketToTCPConnectionHandler handles data transfer between a WebSocket and a TCP connection.
+// Data is sent as binary messages, an empty text message marks EOF so a half-close
+// is passed on across the tunnel. Older peers write it as zero bytes. A reset
+// is passed on as a close frame with closeCodeReset. It returns why the relay ended.
+func WSToTCPConnHandler(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) string {
+	defer trackRelay(usage, remotePort)()
+
+	done := make(chan string, 1)
 
 	go func() {
-		defer close(done)
-		transferWebSocketToTCP(wsConn, tcpConn, logger, usage, remotePort, sniffer)
+		done <- guardRelay(logger, usage, func() string {
+			return transferWebSocketToTCP(wsConn, tcpConn, logger, usage, remotePort, sniffer)
+		}, wsConn, tcpConn)
 	}()
 
-	transferTCPToWebSocket(tcpConn, wsConn, logger, usage, remotePort, sniffer)
-
-	<-done
+	reason := guardRelay(logger, usage, func() string {
+		return transferTCPToWebSocket(tcpConn, wsConn, logger, usage, remotePort, sniffer)
+	}, wsConn, tcpConn)
+	reason = worseReason(reason, <-done)
 
 	wsConn.Close()
 	tcpConn.Close()
+
+	logRelayEnd(logger, usage, remotePort, reason)
+	return reason
+}
+
+// closeCodeReset is the WebSocket close code (from the private range) sent when
+// the TCP connection was reset.
+const closeCodeReset = 4000
+
+// resetWebSocket closes wsConn telling the peer to reset its TCP connection.
+func resetWebSocket(wsConn *websocket.Conn) {
+	msg := websocket.FormatCloseMessage(closeCodeReset, "reset")
+	wsConn.WriteControl(websocket.CloseMessage, msg, time.Now().Add(time.Second))
+	wsConn.Close()
+}
+
+// wsMessage is a message read from a WebSocket, or the error that ended the
+// reading.
+type wsMessage struct {
+	messageType int
+	data        []byte
+	err         error
 }
 
-// transferWebSocketToTCP transfers data from a WebSocket connection to a TCP connection
-func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+// wsBacklog is how many messages are read ahead while a write to the TCP
+// connection is under way, and up to wsCoalesce bytes of them are written at
+// once.
+const (
+	wsBacklog  = 32
+	wsCoalesce = 64 * 1024
+)
+
+// readMessages reads the messages of wsConn into messages until it fails or
+// done is closed.
+func readMessages(wsConn *websocket.Conn, messages chan<- wsMessage, done <-chan struct{}) {
 	for {
-		// Read message from the WebSocket connection
-		messageType, message, err := wsConn.ReadMessage()
+		messageType, data, err := wsConn.ReadMessage()
+		select {
+		case messages <- wsMessage{messageType, data, err}:
+		case <-done:
+			return
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isData reports whether m carries data, not an error, EOF or control message.
+func (m wsMessage) isData() bool {
+	return m.err == nil && len(m.data) > 0 && (m.messageType == websocket.TextMessage || m.messageType == websocket.BinaryMessage)
+}
+
+// transferWebSocketToTCP transfers data from a WebSocket connection to a TCP
+// connection. Messages read while a write is under way are passed on together
+// in the next write, so a stream of small messages costs fewer syscalls.
+func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) string {
+	messages := make(chan wsMessage, wsBacklog)
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		reading := func() string {
+			readMessages(wsConn, messages, done)
+			return ""
+		}
+		if guardRelay(logger, usage, reading, wsConn, tcpConn) == closePanic {
+			select {
+			case messages <- wsMessage{err: errRelayPanic}:
+			case <-done:
+			}
+		}
+	}()
+
+	buf := make([]byte, 0, wsCoalesce)
+	var next *wsMessage // read while coalescing, handled next
+	for {
+		var m wsMessage
+		if next != nil {
+			m, next = *next, nil
+		} else {
+			m = <-messages
+		}
+		messageType, message, err := m.messageType, m.data, m.err
+		if websocket.IsCloseError(err, closeCodeReset) {
+			logger.Trace("WebSocket reset received, resetting the TCP connection")
+			wsConn.Close()
+			ResetConn(tcpConn)
+			return closeReset
+		}
 		if err != nil {
 			if errors.Is(err, websocket.ErrCloseSent) || errors.Is(err, io.EOF) {
 				logger.Trace("WebSocket reader stream closed or EOF received")
@@ -40,18 +130,54 @@ func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *lo
 			}
 			wsConn.Close()
 			tcpConn.Close()
-			return
+			return wsReadReason(err)
+		}
+
+		if messageType == websocket.TextMessage && len(message) == 0 {
+			if CloseWrite(tcpConn) {
+				logger.Trace("WebSocket EOF received, half-closed the TCP connection")
+				return closeFin
+			}
+			wsConn.Close()
+			tcpConn.Close()
+			return closeFin
 		}
 
 		// Only handle text or binary messages (ignore control messages like pings)
 		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+			// add the data messages waiting already
+		coalesce:
+			for len(message) < wsCoalesce {
+				select {
+				case more := <-messages:
+					if !more.isData() {
+						next = &more
+						break coalesce
+					}
+					if len(buf) == 0 {
+						buf = append(buf, message...)
+					}
+					buf = append(buf, more.data...)
+					message = buf
+				default:
+					break coalesce
+				}
+			}
+			buf = buf[:0]
+
 			// Write the message to the TCP connection
 			w, err := tcpConn.Write(message)
+			if isReset(err) {
+				logger.Trace("TCP connection reset, resetting the WebSocket")
+				tcpConn.Close()
+				resetWebSocket(wsConn)
+				return closeReset
+			}
 			if err != nil {
 				logger.Trace("unable to write to the TCP connection: ", err)
 				wsConn.Close()
 				tcpConn.Close()
-				return
+				return writeReason(err)
 			}
 			logger.Tracef("transferred data from WebSocket to TCP: %d bytes", w)
 			if sniffer {
@@ -62,11 +188,24 @@ func transferWebSocketToTCP(wsConn *websocket.Conn, tcpConn net.Conn, logger *lo
 }
 
 // transferTCPToWebSocket transfers data from a TCP connection to a WebSocket connection
-func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) {
+func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *logrus.Logger, usage *web.Usage, remotePort int, sniffer bool) string {
 	buf := make([]byte, 16*1024) // 16K buffer size
 	for {
 		// Read data from the TCP connection
 		n, err := tcpConn.Read(buf)
+		if errors.Is(err, io.EOF) {
+			// tell the peer to half-close its side, the other direction keeps flowing
+			if err := wsConn.WriteMessage(websocket.TextMessage, nil); err == nil {
+				logger.Trace("TCP EOF received, sent WebSocket EOF")
+				return closeFin
+			}
+		}
+		if isReset(err) {
+			logger.Trace("TCP connection reset, resetting the WebSocket")
+			tcpConn.Close()
+			resetWebSocket(wsConn)
+			return closeReset
+		}
 		if err != nil {
 			if errors.Is(err, io.EOF) || errors.Is(err, net.ErrClosed) {
 				logger.Trace("TCP reader stream closed or EOF received")
@@ -75,7 +214,7 @@ func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *lo
 			}
 			tcpConn.Close()
 			wsConn.Close()
-			return
+			return readReason(err)
 		}
 
 		// Write the data to the WebSocket connection as a binary message
@@ -88,7 +227,10 @@ func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *lo
 			}
 			tcpConn.Close()
 			wsConn.Close()
-			return
+			if errors.Is(err, websocket.ErrCloseSent) {
+				return ""
+			}
+			return writeReason(err)
 		}
 
 		logger.Tracef("transferred data from TCP to WebSocket: %d bytes", n)
@@ -97,3 +239,17 @@ func transferTCPToWebSocket(tcpConn net.Conn, wsConn *websocket.Conn, logger *lo
 		}
 	}
 }
+
+func wsReadReason(err error) string {
+	var closeErr *websocket.CloseError
+	switch {
+	case errors.Is(err, errRelayPanic):
+		return closePanic
+	case errors.Is(err, net.ErrClosed), errors.Is(err, websocket.ErrCloseSent):
+		return ""
+	case errors.As(err, &closeErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return closePeer
+	default:
+		return closeError
+	}
+}
@@ -0,0 +1,332 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// how long a bucket of the usage history covers
+const historyResolution = 5 * time.Minute
+
+var (
+	historyKeepMu sync.Mutex
+	historyKeep   time.Duration
+)
+
+// SetUsageHistory sets how long the usage history of the sniffer logs of the
+// process is kept, 0 for no history. It applies to the logs opened after.
+func SetUsageHistory(keep time.Duration) {
+	historyKeepMu.Lock()
+	defer historyKeepMu.Unlock()
+	historyKeep = keep
+}
+
+func usageHistoryKeep() time.Duration {
+	historyKeepMu.Lock()
+	defer historyKeepMu.Unlock()
+	return historyKeep
+}
+
+// historyRecord is a line of a usage history: bytes relayed for a port in
+// the bucket starting at Time. A bucket cut short by a restart is continued
+// in a line of its own, the lines of a bucket add up.
+type historyRecord struct {
+	Time  time.Time `json:"time"`
+	Port  int       `json:"port"`
+	Bytes uint64    `json:"bytes"`
+}
+
+// HistoryPoint is a bucket of the usage history.
+type HistoryPoint struct {
+	Time  time.Time `json:"time"`
+	Bytes uint64    `json:"bytes"`
+}
+
+// usageHistory is the bytes relayed by port in buckets of historyResolution,
+// kept in JSON lines at the path of the sniffer log plus ".history". Its
+// methods are called with the mutex of the sniffer log held.
+type usageHistory struct {
+	path   string
+	keep   time.Duration
+	logger *logrus.Logger
+
+	buckets map[int]map[int64]uint64 // by port and unix start of bucket
+	current time.Time                // start of the bucket being filled
+	pending map[int]uint64           // bytes of the current bucket not written yet
+	oldest  time.Time                // of the lines in the file
+}
+
+// newUsageHistory returns the usage history of the sniffer log at path,
+// reading what is kept of it. It returns nil when no history is kept.
+func newUsageHistory(path string, logger *logrus.Logger) *usageHistory {
+	keep := usageHistoryKeep()
+	if keep <= 0 {
+		return nil
+	}
+	h := &usageHistory{
+		path:    path + ".history",
+		keep:    keep,
+		logger:  logger,
+		buckets: make(map[int]map[int64]uint64),
+		pending: make(map[int]uint64),
+	}
+	if err := h.load(time.Now()); err != nil {
+		logger.Errorf("failed to read the usage history %s: %v", h.path, err)
+	}
+	return h
+}
+
+// load reads the buckets of the file kept at now, and compacts it if it holds
+// others.
+func (h *usageHistory) load(now time.Time) error {
+	data, err := os.ReadFile(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	cutoff := now.Add(-h.keep)
+	lines, kept := 0, 0
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record historyRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue // cut short by a crash
+		}
+		lines++
+		if record.Time.Before(cutoff) {
+			continue
+		}
+		if h.buckets[record.Port] == nil {
+			h.buckets[record.Port] = make(map[int64]uint64)
+		}
+		start := record.Time.Unix()
+		if _, ok := h.buckets[record.Port][start]; !ok {
+			kept++
+		}
+		h.buckets[record.Port][start] += record.Bytes
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	if kept < lines {
+		return h.compact()
+	}
+	h.oldest = cutoff
+	return nil
+}
+
+// add adds the bytes relayed by port at now, writing the buckets before once
+// a new one starts.
+func (h *usageHistory) add(now time.Time, usage []PortUsage) {
+	if h == nil {
+		return
+	}
+	start := now.Truncate(historyResolution)
+	if !start.Equal(h.current) {
+		h.flush(now)
+		h.current = start
+	}
+	for _, port := range usage {
+		if port.Usage == 0 {
+			continue
+		}
+		if h.buckets[port.Port] == nil {
+			h.buckets[port.Port] = make(map[int64]uint64)
+		}
+		h.buckets[port.Port][start.Unix()] += port.Usage
+		h.pending[port.Port] += port.Usage
+	}
+}
+
+// flush writes the bytes of the current bucket not written yet, and drops the
+// buckets older than the history kept at now.
+func (h *usageHistory) flush(now time.Time) {
+	if h == nil {
+		return
+	}
+	if len(h.pending) > 0 {
+		var lines bytes.Buffer
+		encoder := json.NewEncoder(&lines)
+		for _, port := range sortedPorts(h.pending) {
+			encoder.Encode(historyRecord{Time: h.current, Port: port, Bytes: h.pending[port]})
+		}
+		clear(h.pending)
+		if err := appendFile(h.path, lines.Bytes()); err != nil {
+			h.logger.Errorf("failed to write the usage history %s: %v", h.path, err)
+		}
+	}
+
+	cutoff := now.Add(-h.keep).Unix()
+	for port, buckets := range h.buckets {
+		for start := range buckets {
+			if start < cutoff {
+				delete(buckets, start)
+			}
+		}
+		if len(buckets) == 0 {
+			delete(h.buckets, port)
+		}
+	}
+	// the file is rewritten once a day of it is out of the history
+	if h.oldest.IsZero() {
+		h.oldest = now
+	} else if now.Sub(h.oldest) > h.keep+24*time.Hour {
+		if err := h.compact(); err != nil {
+			h.logger.Errorf("failed to compact the usage history %s: %v", h.path, err)
+		}
+	}
+}
+
+// compact rewrites the file with a line by bucket kept.
+func (h *usageHistory) compact() error {
+	var records []historyRecord
+	for port, buckets := range h.buckets {
+		for start, n := range buckets {
+			records = append(records, historyRecord{Time: time.Unix(start, 0), Port: port, Bytes: n})
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		if !records[i].Time.Equal(records[j].Time) {
+			return records[i].Time.Before(records[j].Time)
+		}
+		return records[i].Port < records[j].Port
+	})
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, record := range records {
+		encoder.Encode(record)
+	}
+
+	tmp := h.path + ".tmp"
+	if err := os.WriteFile(tmp, lines.Bytes(), 0644); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, h.path); err != nil {
+		return err
+	}
+	h.oldest = time.Now().Add(-h.keep)
+	return nil
+}
+
+// span narrows from and to to the buckets kept, from the start of a bucket.
+func (h *usageHistory) span(from, to time.Time) (time.Time, time.Time) {
+	now := time.Now()
+	if cutoff := now.Add(-h.keep); from.Before(cutoff) {
+		from = cutoff
+	}
+	if to.After(now) {
+		to = now
+	}
+	return from.Truncate(historyResolution), to
+}
+
+// series returns the buckets of port from from to to, every bucket of the
+// range included, or the buckets of all the ports added up for port 0.
+func (h *usageHistory) series(port int, from, to time.Time) []HistoryPoint {
+	points := []HistoryPoint{}
+	for start := from; start.Before(to); start = start.Add(historyResolution) {
+		var n uint64
+		if port == 0 {
+			for _, buckets := range h.buckets {
+				n += buckets[start.Unix()]
+			}
+		} else {
+			n = h.buckets[port][start.Unix()]
+		}
+		points = append(points, HistoryPoint{Time: start, Bytes: n})
+	}
+	return points
+}
+
+// appendFile appends data to the file at path, creating it.
+func appendFile(path string, data []byte) error {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
+
+// handleUsageHistory serves the usage history of a port, or of all of them
+// without a port, from from to to: unix seconds or RFC 3339 times, the last
+// day by default.
+func (m *Usage) handleUsageHistory(w http.ResponseWriter, r *http.Request) {
+	if m.log == nil || m.log.history == nil {
+		http.Error(w, "usage history is off, it needs sniffer and sniffer_history_keep", http.StatusNotFound)
+		return
+	}
+	query := r.URL.Query()
+	port := 0
+	if value := query.Get("port"); value != "" {
+		var err error
+		if port, err = strconv.Atoi(value); err != nil || port < 1 || port > 65535 {
+			http.Error(w, fmt.Sprintf("invalid port %q", value), http.StatusBadRequest)
+			return
+		}
+	}
+	to, err := parseHistoryTime(query.Get("to"), time.Now())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	from, err := parseHistoryTime(query.Get("from"), to.Add(-24*time.Hour))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !from.Before(to) {
+		http.Error(w, "from must be before to", http.StatusBadRequest)
+		return
+	}
+	from, to = m.log.history.span(from, to)
+
+	points := m.log.series(port, from, to)
+	var total uint64
+	for _, point := range points {
+		total += point.Bytes
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(struct {
+		Port       int            `json:"port"`
+		Resolution int            `json:"resolution"` // seconds
+		From       time.Time      `json:"from"`
+		To         time.Time      `json:"to"`
+		Total      uint64         `json:"total"`
+		Buckets    []HistoryPoint `json:"buckets"`
+	}{port, int(historyResolution.Seconds()), from, to, total, points}); err != nil {
+		m.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
+
+// parseHistoryTime parses unix seconds or an RFC 3339 time, def if empty.
+func parseHistoryTime(value string, def time.Time) (time.Time, error) {
+	if value == "" {
+		return def, nil
+	}
+	if seconds, err := strconv.ParseInt(value, 10, 64); err == nil {
+		return time.Unix(seconds, 0), nil
+	}
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, fmt.Errorf("invalid time %q, it must be unix seconds or like \"2006-01-02T15:04:05Z\"", value)
+	}
+	return t, nil
+}
@@ -0,0 +1,132 @@
+package web
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// batches kept while the endpoint is unreachable, older ones are dropped
+const maxPendingBatches = 60
+
+var tagEscaper = strings.NewReplacer(",", `\,`, " ", `\ `, "=", `\=`)
+
+// InfluxExporter periodically pushes all metrics to an endpoint accepting the
+// InfluxDB line protocol, e.g. InfluxDB's /api/v2/write or VictoriaMetrics' /write.
+type InfluxExporter struct {
+	url      string
+	token    string
+	interval time.Duration
+	tags     string // common tags of every line
+	client   *http.Client
+	logger   *logrus.Logger
+	pending  [][]byte
+}
+
+func NewInfluxExporter(url, token string, interval time.Duration, role string, logger *logrus.Logger) *InfluxExporter {
+	host, _ := os.Hostname()
+	return &InfluxExporter{
+		url:      url,
+		token:    token,
+		interval: interval,
+		tags:     ",role=" + tagEscaper.Replace(role) + ",host=" + tagEscaper.Replace(host),
+		client:   &http.Client{Timeout: 10 * time.Second},
+		logger:   logger,
+	}
+}
+
+// Run pushes the metrics every interval until ctx is done.
+func (e *InfluxExporter) Run(ctx context.Context) {
+	e.logger.Infof("pushing metrics to %s every %s", e.url, e.interval)
+
+	ticker := time.NewTicker(e.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case now := <-ticker.C:
+			e.push(now)
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// push queues a batch of the current values and sends all queued batches in
+// order. Batches that fail with a temporary error are retried on the next push.
+func (e *InfluxExporter) push(now time.Time) {
+	e.pending = append(e.pending, e.batch(now))
+	if len(e.pending) > maxPendingBatches {
+		e.logger.Warnf("metrics endpoint %s unreachable, dropping the oldest batch", e.url)
+		e.pending = e.pending[1:]
+	}
+
+	for len(e.pending) > 0 {
+		retry, err := e.write(e.pending[0])
+		if err != nil && retry {
+			e.logger.Debugf("failed to push metrics, retrying later: %v", err)
+			return
+		}
+		if err != nil {
+			e.logger.Errorf("failed to push metrics, dropping batch: %v", err)
+		}
+		e.pending = e.pending[1:]
+	}
+}
+
+// batch renders all metrics in line protocol with a nanosecond timestamp.
+func (e *InfluxExporter) batch(now time.Time) []byte {
+	var buf bytes.Buffer
+	for _, s := range snapshotMetrics() {
+		buf.WriteString(tagEscaper.Replace(s.name))
+		buf.WriteString(e.tags)
+		for i := 0; i+1 < len(s.labels); i += 2 {
+			fmt.Fprintf(&buf, ",%s=%s", tagEscaper.Replace(s.labels[i]), tagEscaper.Replace(s.labels[i+1]))
+		}
+		if s.hist != nil {
+			// histograms are pushed summed up, in seconds
+			fmt.Fprintf(&buf, " count=%di,sum=%g,p50=%g,p95=%g %d\n",
+				s.hist.count, s.hist.sum, s.hist.quantile(0.5), s.hist.quantile(0.95), now.UnixNano())
+			continue
+		}
+		fmt.Fprintf(&buf, " value=%di %d\n", s.value, now.UnixNano())
+	}
+	return buf.Bytes()
+}
+
+// write sends one batch and reports whether a failure is worth retrying.
+func (e *InfluxExporter) write(batch []byte) (bool, error) {
+	if len(batch) == 0 {
+		return false, nil
+	}
+
+	req, err := http.NewRequest(http.MethodPost, e.url, bytes.NewReader(batch))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if e.token != "" {
+		req.Header.Set("Authorization", "Token "+e.token)
+	}
+
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return true, err
+	}
+	resp.Body.Close()
+
+	switch {
+	case resp.StatusCode < 300:
+		return false, nil
+	case resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500:
+		return true, fmt.Errorf("unexpected status %s", resp.Status)
+	default:
+		return false, fmt.Errorf("unexpected status %s", resp.Status)
+	}
+}
@@ -0,0 +1,314 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// help texts of the exported metrics, in Prometheus text format
+var metricHelp = map[string]string{
+	"backhaul_attack_refused_total":     "Public connections refused under attack, for the attack_ip_limit (reason ip_limit) or for sending no data (reason no_data).",
+	"backhaul_auth_bans_total":          "Addresses banned for failing the handshake auth_attempts times.",
+	"backhaul_auth_failures_total":      "Failed tunnel handshakes.",
+	"backhaul_client_flaps_total":       "Tunnel connections per client ID while it was flapping, connecting flap_threshold times within an hour.",
+	"backhaul_client_connects_total":    "Tunnel connections per client ID, each reconnect counts.",
+	"backhaul_exit_connections_total":   "Connections the exit node dialed for the SOCKS5 listener of the client, by result: ok or failed.",
+	"backhaul_expect_dropped_total":     "Connections per port dropped for not starting with the protocol of its expect, or for asking for a server name not in its sni.",
+	"backhaul_first_byte_dropped_total": "Connections per port closed for sending nothing within first_byte_timeout.",
+	"backhaul_heartbeat_timeouts_total": "Mux sessions closed because the client sent nothing over the control stream for 3 heartbeats.",
+	"backhaul_idle_culled_total":        "Idle pooled tunnel connections (kind pool) and mux sessions (kind mux_session) closed by idle_cull.",
+	"backhaul_overflow_total":           "Connections handled by the overflow policy because the accept channel was full.",
+	"backhaul_panics_total":             "Panics recovered per goroutine kind, each closed only the connections it handled.",
+	"backhaul_pool_hits_total":          "Connections per port that found a tunnel connection ready in the pool, tcp only.",
+	"backhaul_pool_misses_total":        "Connections per port that had to wait for a tunnel connection to be opened, tcp only.",
+	"backhaul_port_bytes_total":         "Bytes relayed per port, only counted with the sniffer enabled.",
+	"backhaul_port_closes_total":        "Relayed connections per port by how they ended: fin, reset, peer (torn down across the tunnel), timeout, error or panic.",
+	"backhaul_port_connections_total":   "Connections relayed per port.",
+	"backhaul_port_connections":         "Connections currently relayed per port.",
+	"backhaul_port_setup_seconds":       "Time from accepting a connection until the tunnel carries it (server), or to dial the target (client), per port.",
+	"backhaul_port_ttfb_seconds":        "Time from accepting (server) or dialing (client) a connection until the first byte of the response, per port.",
+	"backhaul_signal_failures_total":    "Tunnel connections the client was asked for and reported it failed to open.",
+	"backhaul_signal_timeouts_total":    "Tunnel connections the client was asked for and did not acknowledge in time, asked for again.",
+	"backhaul_stream_rejects_total":     "Connections per port refused because the mux sessions carried mux_max_streams streams each, raise mux_session or mux_session_max.",
+	"backhaul_syncookies_sent_total":    "SYN cookies sent by the kernel since the server started, for all ports of the host, with under_attack on Linux.",
+	"backhaul_tarpit_connections":       "Connections of banned addresses held in the tarpit.",
+	"backhaul_tarpit_total":             "Connections of banned addresses taken into the tarpit.",
+	"backhaul_under_attack":             "1 while the public ports are guarded by under_attack, 0 otherwise.",
+}
+
+const (
+	kindCounter   = "counter"
+	kindGauge     = "gauge"
+	kindHistogram = "histogram"
+)
+
+// upper bounds of the latency histogram buckets, in seconds
+var latencyBuckets = []float64{0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+// series is a single metric with its labels.
+type series struct {
+	name   string
+	labels []string // name, value pairs
+	kind   string
+	value  int64
+	hist   *histogram // histograms only
+}
+
+// histogram counts observations in latencyBuckets.
+type histogram struct {
+	counts []int64 // per bucket, not cumulative, the last one is +Inf
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(v float64) {
+	i, _ := slices.BinarySearch(latencyBuckets, v)
+	h.counts[i]++
+	h.count++
+	h.sum += v
+}
+
+// quantile estimates the q-quantile by interpolating within its bucket, like
+// Prometheus' histogram_quantile.
+func (h *histogram) quantile(q float64) float64 {
+	if h.count == 0 {
+		return 0
+	}
+	rank := q * float64(h.count)
+	var seen int64
+	for i, n := range h.counts {
+		if float64(seen+n) < rank || n == 0 {
+			seen += n
+			continue
+		}
+		if i == len(latencyBuckets) {
+			return latencyBuckets[i-1] // beyond the last bound
+		}
+		lower := 0.0
+		if i > 0 {
+			lower = latencyBuckets[i-1]
+		}
+		return lower + (latencyBuckets[i]-lower)*(rank-float64(seen))/float64(n)
+	}
+	return latencyBuckets[len(latencyBuckets)-1]
+}
+
+// the metrics are kept for the whole process, so they survive restarts of the
+// transports that recreate their Usage
+var (
+	metricsMu sync.Mutex
+	metrics   = make(map[string]*series) // by name and rendered labels
+)
+
+// IncCounter increments a counter exported on /metrics. Labels are given as
+// name, value pairs.
+func (m *Usage) IncCounter(name string, labels ...string) {
+	m.AddCounter(name, 1, labels...)
+}
+
+// AddCounter adds delta to a counter exported on /metrics.
+func (m *Usage) AddCounter(name string, delta int64, labels ...string) {
+	addMetric(kindCounter, name, delta, labels)
+}
+
+// AddGauge adds delta, which may be negative, to a gauge exported on /metrics.
+func (m *Usage) AddGauge(name string, delta int64, labels ...string) {
+	addMetric(kindGauge, name, delta, labels)
+}
+
+// ObserveHistogram records a latency in seconds in a histogram exported on
+// /metrics.
+func (m *Usage) ObserveHistogram(name string, seconds float64, labels ...string) {
+	key := name + renderLabels(labels)
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	s, ok := metrics[key]
+	if !ok {
+		s = &series{name: name, labels: labels, kind: kindHistogram, hist: &histogram{counts: make([]int64, len(latencyBuckets)+1)}}
+		metrics[key] = s
+	}
+	s.hist.observe(seconds)
+}
+
+func addMetric(kind, name string, delta int64, labels []string) {
+	key := name + renderLabels(labels)
+
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	s, ok := metrics[key]
+	if !ok {
+		s = &series{name: name, labels: labels, kind: kind}
+		metrics[key] = s
+	}
+	s.value += delta
+}
+
+// snapshotMetrics returns a copy of all series sorted by name and labels.
+func snapshotMetrics() []series {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+
+	keys := make([]string, 0, len(metrics))
+	for key := range metrics {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	snapshot := make([]series, 0, len(keys))
+	for _, key := range keys {
+		s := *metrics[key]
+		if s.hist != nil {
+			hist := *s.hist
+			hist.counts = slices.Clone(hist.counts)
+			s.hist = &hist
+		}
+		snapshot = append(snapshot, s)
+	}
+	return snapshot
+}
+
+func renderLabels(labels []string) string {
+	if len(labels) < 2 {
+		return ""
+	}
+
+	pairs := make([]string, 0, len(labels)/2)
+	for i := 0; i+1 < len(labels); i += 2 {
+		pairs = append(pairs, fmt.Sprintf("%s=%q", labels[i], labels[i+1]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+func (m *Usage) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	var sb strings.Builder
+	lastName := ""
+	for _, s := range snapshotMetrics() {
+		if s.name != lastName {
+			fmt.Fprintf(&sb, "# HELP %s %s\n# TYPE %s %s\n", s.name, metricHelp[s.name], s.name, s.kind)
+			lastName = s.name
+		}
+		if s.hist != nil {
+			writeHistogram(&sb, s)
+			continue
+		}
+		fmt.Fprintf(&sb, "%s%s %d\n", s.name, renderLabels(s.labels), s.value)
+	}
+
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	fmt.Fprint(w, sb.String())
+}
+
+func writeHistogram(sb *strings.Builder, s series) {
+	var cumulative int64
+	for i, n := range s.hist.counts {
+		cumulative += n
+		le := "+Inf"
+		if i < len(latencyBuckets) {
+			le = strconv.FormatFloat(latencyBuckets[i], 'g', -1, 64)
+		}
+		fmt.Fprintf(sb, "%s_bucket%s %d\n", s.name, renderLabels(append(slices.Clone(s.labels), "le", le)), cumulative)
+	}
+	fmt.Fprintf(sb, "%s_sum%s %g\n", s.name, renderLabels(s.labels), s.hist.sum)
+	fmt.Fprintf(sb, "%s_count%s %d\n", s.name, renderLabels(s.labels), s.hist.count)
+}
+
+// PortStat sums up the relayed connections of one port.
+type PortStat struct {
+	Active int64
+	Total  int64
+	Bytes  int64
+}
+
+// PortStats returns the connection counters of every port that relayed
+// anything, by port.
+func PortStats() map[int]PortStat {
+	stats := make(map[int]PortStat)
+	for _, s := range snapshotMetrics() {
+		if len(s.labels) != 2 || s.labels[0] != "port" {
+			continue
+		}
+		port, err := strconv.Atoi(s.labels[1])
+		if err != nil {
+			continue
+		}
+
+		stat := stats[port]
+		switch s.name {
+		case "backhaul_port_connections":
+			stat.Active = s.value
+		case "backhaul_port_connections_total":
+			stat.Total = s.value
+		case "backhaul_port_bytes_total":
+			stat.Bytes = s.value
+		default:
+			continue
+		}
+		stats[port] = stat
+	}
+	return stats
+}
+
+// Latency sums up a latency histogram, in milliseconds.
+type Latency struct {
+	Count int64   `json:"count"`
+	P50   float64 `json:"p50"`
+	P95   float64 `json:"p95"`
+}
+
+// PortLatency is the connection setup and time to first byte of one port.
+type PortLatency struct {
+	Port  int     `json:"port"`
+	Setup Latency `json:"setup"`
+	TTFB  Latency `json:"ttfb"`
+}
+
+// PortLatencies returns the latency histograms of every port that relayed
+// anything, sorted by port.
+func PortLatencies() []PortLatency {
+	byPort := make(map[int]*PortLatency)
+	for _, s := range snapshotMetrics() {
+		if s.hist == nil || len(s.labels) != 2 || s.labels[0] != "port" {
+			continue
+		}
+		port, err := strconv.Atoi(s.labels[1])
+		if err != nil {
+			continue
+		}
+
+		l, ok := byPort[port]
+		if !ok {
+			l = &PortLatency{Port: port}
+			byPort[port] = l
+		}
+		stat := Latency{Count: s.hist.count, P50: s.hist.quantile(0.5) * 1000, P95: s.hist.quantile(0.95) * 1000}
+		switch s.name {
+		case "backhaul_port_setup_seconds":
+			l.Setup = stat
+		case "backhaul_port_ttfb_seconds":
+			l.TTFB = stat
+		}
+	}
+
+	latencies := make([]PortLatency, 0, len(byPort))
+	for _, l := range byPort {
+		latencies = append(latencies, *l)
+	}
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i].Port < latencies[j].Port })
+	return latencies
+}
+
+func (m *Usage) handleLatency(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(PortLatencies()); err != nil {
+		m.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
@@ -4,12 +4,14 @@ import (
 	"context"
 	"embed"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"net/http"
-	"os"
-	"sort"
+	"strconv"
 	"sync"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/shirou/gopsutil/v4/cpu"
@@ -30,8 +32,8 @@ type Usage struct {
 	sniffer      bool
 	snifferLog   string
 	mu           sync.Mutex
-	totalTraffic uint64
-	tunnelStatus *string
+	log          *snifferLog // nil without the sniffer
+	tunnelStatus *Status
 }
 
 type PortUsage struct {
@@ -51,9 +53,82 @@ type SystemStats struct {
 	BackhaulTraffic string `json:"backhaulTraffic"`
 	Sniffer         string `json:"sniffer"`
 	AllConnections  string `json:"allConnections"`
+	Speedtest       string `json:"speedtest"`
+	Client          string `json:"client"`
+	ClientStats     string `json:"clientStats"`
+	Registry        string `json:"registry"`
+	Attack          string `json:"attack"`
+	Anomalies       string `json:"anomalies"`
 }
 
-func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog string, sniffer bool, tunnelStatus *string, logger *logrus.Logger) *Usage {
+// Status is the state of a tunnel shown on the dashboard, set by the
+// transport and read by the dashboard and the control API at any time.
+type Status struct {
+	value atomic.Pointer[string]
+}
+
+// Set changes the state of the tunnel.
+func (s *Status) Set(status string) {
+	s.value.Store(&status)
+}
+
+// String returns the state of the tunnel, empty before it is set.
+func (s *Status) String() string {
+	if status := s.value.Load(); status != nil {
+		return *status
+	}
+	return ""
+}
+
+// last speedtest result, shown on the dashboard
+var lastSpeedtest atomic.Value
+
+// RecordSpeedtest shows the result of a speedtest on the dashboard.
+func RecordSpeedtest(summary string) {
+	lastSpeedtest.Store(summary)
+}
+
+// ID of this client, or of the last client connected to this server
+var lastClient atomic.Value
+
+// RecordClient shows a client ID on the dashboard.
+func RecordClient(id string) {
+	lastClient.Store(id)
+}
+
+// last report of this client, or of a client connected to this server
+var lastClientStats atomic.Value
+
+// RecordClientStats shows the report of a client on the dashboard.
+func RecordClientStats(summary string) {
+	lastClientStats.Store(summary)
+}
+
+// size of the client registry of this server, empty without one
+var lastRegistry atomic.Value
+
+// RecordRegistry shows the size of the client registry on the dashboard.
+func RecordRegistry(summary string) {
+	lastRegistry.Store(summary)
+}
+
+// state of the attack mode of this server, empty on clients
+var lastAttack atomic.Value
+
+// RecordAttack shows the state of the attack mode on the dashboard.
+func RecordAttack(summary string) {
+	lastAttack.Store(summary)
+}
+
+// anomalies on the ports of this server, empty without anomaly detection
+var lastAnomalies atomic.Value
+
+// RecordAnomalies shows the anomalies on the ports on the dashboard.
+func RecordAnomalies(summary string) {
+	lastAnomalies.Store(summary)
+}
+
+func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog string, sniffer bool, tunnelStatus *Status, logger *logrus.Logger) *Usage {
 	ctx, cancel := context.WithCancel(shutdownCtx)
 	u := &Usage{
 		listenAddr:   listenAddr,
@@ -64,7 +139,9 @@ func NewDataStore(listenAddr string, shutdownCtx context.Context, snifferLog str
 		snifferLog:   snifferLog,
 		tunnelStatus: tunnelStatus,
 		mu:           sync.Mutex{},
-		totalTraffic: 0,
+	}
+	if sniffer {
+		u.log = openSnifferLog(snifferLog, logger)
 	}
 	return u
 }
@@ -74,6 +151,11 @@ func (m *Usage) Monitor() {
 	mux.HandleFunc("/", m.handleIndex)    // handle index
 	mux.HandleFunc("/data", m.handleData) // New route for JSON data
 	mux.HandleFunc("/stats", m.statsHandler)
+	mux.HandleFunc("/metrics", m.handleMetrics)
+	mux.HandleFunc("/latency", m.handleLatency)
+	mux.HandleFunc("/api/usage", m.handleUsageHistory)
+	mux.HandleFunc("/api/sources", m.handleSources)
+	mux.HandleFunc("/api/countries", m.handleCountries)
 
 	m.server = &http.Server{
 		Addr:    m.listenAddr,
@@ -88,7 +170,7 @@ func (m *Usage) Monitor() {
 
 		// Attempt to gracefully shut down the server
 		if err := m.server.Shutdown(shutdownCtx); err != nil {
-			m.logger.Error("sniffer server shutdown error: %v", err)
+			m.logger.Errorf("sniffer server shutdown error: %v", err)
 		}
 	}()
 
@@ -103,6 +185,8 @@ func (m *Usage) Monitor() {
 				case <-ticker.C:
 					go m.saveUsageData()
 				case <-m.shutdownCtx.Done():
+					m.saveUsageData()
+					m.log.flush()
 					return
 				}
 			}
@@ -110,8 +194,23 @@ func (m *Usage) Monitor() {
 	}
 	// Start the server
 	m.logger.Info("sniffer service listening on port: ", m.listenAddr)
-	if err := m.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-		m.logger.Error("sniffer server error: %v", err)
+	for {
+		err := m.server.ListenAndServe()
+		if err == nil || err == http.ErrServerClosed {
+			return
+		}
+		if !errors.Is(err, syscall.EADDRINUSE) {
+			m.logger.Errorf("sniffer server error: %v", err)
+			return
+		}
+
+		// still held by a previous instance, e.g. during restart or upgrade
+		m.logger.Debugf("sniffer port %s is in use, retrying", m.listenAddr)
+		select {
+		case <-time.After(2 * time.Second):
+		case <-m.shutdownCtx.Done():
+			return
+		}
 	}
 }
 
@@ -119,23 +218,23 @@ func (m *Usage) Monitor() {
 var indexHTML embed.FS
 
 func (m *Usage) handleIndex(w http.ResponseWriter, r *http.Request) {
-	usageData := m.getUsageFromFile()
+	usageData, _ := m.getUsage()
 	readableData := m.usageDataWithReadableUsage(usageData)
 
 	tmpl, err := template.ParseFS(indexHTML, "index.html")
 	if err != nil {
-		m.logger.Error("error parsing template: %v", err)
+		m.logger.Errorf("error parsing template: %v", err)
 		return
 	}
 
 	err = tmpl.Execute(w, readableData)
 	if err != nil {
-		m.logger.Error("error executing template: %v", err)
+		m.logger.Errorf("error executing template: %v", err)
 	}
 }
 
 func (m *Usage) handleData(w http.ResponseWriter, r *http.Request) {
-	usageData := m.getUsageFromFile()
+	usageData, _ := m.getUsage()
 	readableData := m.usageDataWithReadableUsage(usageData)
 
 	w.Header().Set("Content-Type", "application/json")
@@ -158,6 +257,8 @@ func (m *Usage) statsHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func (m *Usage) AddOrUpdatePort(port int, usage uint64) {
+	m.AddCounter("backhaul_port_bytes_total", int64(usage), "port", strconv.Itoa(port))
+
 	m.mu.Lock()
 	defer m.mu.Unlock()
 
@@ -174,94 +275,19 @@ func (m *Usage) AddOrUpdatePort(port int, usage uint64) {
 	}
 }
 
+// saveUsageData appends the bytes relayed by port since the last call to the
+// sniffer log.
 func (m *Usage) saveUsageData() {
-	// Step 1: Load existing usage data from the JSON file
-	var existingUsageData []PortUsage
-	file, err := os.Open(m.snifferLog)
-	if err == nil {
-		// If the file exists, decode the JSON data into existingUsageData
-		defer file.Close()
-		err = json.NewDecoder(file).Decode(&existingUsageData)
-		if err != nil {
-			m.logger.Errorf("error decoding JSON data: %v", err)
-			return
-		}
-	} else if !os.IsNotExist(err) {
-		// Log any error except file not existing
-		m.logger.Errorf("error opening JSON file: %v", err)
-		return
-	}
-
-	// Step 2: Get current usage data from sync.Map
-	currentUsageData := m.collectUsageDataFromSyncMap()
-
-	// Step 3: Merge the existing and current usage data into a map to avoid duplicates
-	usageMap := make(map[int]PortUsage)
-
-	// Add existing usage data to the map
-	for _, usage := range existingUsageData {
-		usageMap[usage.Port] = usage
-	}
-
-	// Append or update current usage data in the map
-	for _, usage := range currentUsageData {
-		if existing, exists := usageMap[usage.Port]; exists {
-			// Update existing port usage
-			existing.Usage += usage.Usage
-			usageMap[usage.Port] = existing
-		} else {
-			// Add new port usage
-			usageMap[usage.Port] = usage
-		}
-	}
-
-	m.totalTraffic = 0
-
-	// Step 4: Convert the map back to a slice
-	var mergedUsageData []PortUsage
-	for _, usage := range usageMap {
-		mergedUsageData = append(mergedUsageData, usage)
-		m.totalTraffic += usage.Usage
-	}
-
-	// Step 5: Convert merged data to JSON
-	data, err := json.MarshalIndent(mergedUsageData, "", "  ")
-	if err != nil {
-		m.logger.Errorf("error marshalling usage data: %v", err)
-		return
-	}
-
-	// Step 6: Write JSON data to file
-	err = os.WriteFile(m.snifferLog, data, 0644)
-	if err != nil {
-		m.logger.Errorf("error writing usage data to file: %v", err)
-	}
+	m.log.add(m.collectUsageDataFromSyncMap())
 }
 
-func (m *Usage) getUsageFromFile() []PortUsage {
-	var usageData []PortUsage
-
-	// Open the JSON file
-	file, err := os.Open(m.snifferLog)
-	if err != nil {
-		m.logger.Error("error opening JSON file: %v", err)
-		return nil
+// getUsage returns the totals by port in the sniffer log, sorted by port,
+// and their sum.
+func (m *Usage) getUsage() ([]PortUsage, uint64) {
+	if m.log == nil {
+		return nil, 0
 	}
-	defer file.Close()
-
-	// Decode the JSON file into the usageData slice
-	err = json.NewDecoder(file).Decode(&usageData)
-	if err != nil {
-		m.logger.Error("error decoding JSON data: %v", err)
-		return nil
-	}
-
-	// Sort usageData by Port in ascending order
-	sort.Slice(usageData, func(i, j int) bool {
-		return usageData[i].Port < usageData[j].Port
-	})
-
-	return usageData
+	return m.log.usage()
 }
 
 // converts the byte usage to a human-readable format
@@ -383,8 +409,9 @@ func (m *Usage) getSystemStats() (*SystemStats, error) {
 	uploadSpeed := float64(finalStats.BytesSent - initialStats.BytesSent)
 	downloadSpeed := float64(finalStats.BytesRecv - initialStats.BytesRecv)
 
+	_, total := m.getUsage()
 	stats := &SystemStats{
-		TunnelStatus:    *m.tunnelStatus,
+		TunnelStatus:    m.tunnelStatus.String(),
 		CPUUsage:        m.formatFloat(cpuPercent[0]),
 		RAMUsage:        m.convertBytesToReadable(memStats.Used),
 		DiskUsage:       m.convertBytesToReadable(diskStats.Used),
@@ -392,9 +419,33 @@ func (m *Usage) getSystemStats() (*SystemStats, error) {
 		NetworkTraffic:  m.convertBytesToReadable(netStats[0].BytesSent + netStats[0].BytesRecv),
 		DownloadSpeed:   m.formatSpeed(downloadSpeed),
 		UploadSpeed:     m.formatSpeed(uploadSpeed),
-		BackhaulTraffic: m.convertBytesToReadable(m.totalTraffic),
+		BackhaulTraffic: m.convertBytesToReadable(total),
 		Sniffer:         map[bool]string{true: "Running", false: "Not running"}[m.sniffer],
 		AllConnections:  fmt.Sprintf("%d", len(connections)),
+		Speedtest:       "Not run",
+	}
+	if summary, ok := lastSpeedtest.Load().(string); ok {
+		stats.Speedtest = summary
+	}
+	stats.Client = "Unknown"
+	if id, ok := lastClient.Load().(string); ok {
+		stats.Client = id
+	}
+	stats.ClientStats = "Not reported"
+	if summary, ok := lastClientStats.Load().(string); ok {
+		stats.ClientStats = summary
+	}
+	stats.Registry = "Off"
+	if summary, ok := lastRegistry.Load().(string); ok {
+		stats.Registry = summary
+	}
+	stats.Attack = "Not guarded"
+	if summary, ok := lastAttack.Load().(string); ok {
+		stats.Attack = summary
+	}
+	stats.Anomalies = "Off"
+	if summary, ok := lastAnomalies.Load().(string); ok {
+		stats.Anomalies = summary
 	}
 
 	return stats, nil
@@ -0,0 +1,298 @@
+package web
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/sirupsen/logrus"
+)
+
+// how rotated sniffer logs are named, after the path of the log
+const rotatedLayout = "20060102-150405"
+
+// LogRotation tells when the sniffer logs are rotated and how long the
+// rotated ones are kept.
+type LogRotation struct {
+	MaxSize   int64         // bytes before a log is rotated, 0 for no limit
+	MaxAge    time.Duration // since its first line before it is rotated, 0 for no limit
+	Retention time.Duration // a rotated log is kept, 0 for ever
+}
+
+var (
+	rotationMu sync.Mutex
+	rotation   LogRotation
+
+	snifferLogsMu sync.Mutex
+	snifferLogs   = make(map[string]*snifferLog) // by path, shared by the tunnels of the process
+)
+
+// SetLogRotation sets the rotation of the sniffer logs of the process.
+func SetLogRotation(r LogRotation) {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	rotation = r
+}
+
+func logRotation() LogRotation {
+	rotationMu.Lock()
+	defer rotationMu.Unlock()
+	return rotation
+}
+
+// snifferRecord is a line of a sniffer log: the bytes relayed for a port
+// since its line before, and its total since the first log. Each log starts
+// with a line of every total, with no bytes, so its last lines hold them.
+type snifferRecord struct {
+	Time  time.Time `json:"time"`
+	Port  int       `json:"port"`
+	Bytes uint64    `json:"bytes"`
+	Total uint64    `json:"total"`
+}
+
+// snifferLog is a sniffer log in JSON lines, appended to every few seconds,
+// with the totals by port it holds.
+type snifferLog struct {
+	path   string
+	logger *logrus.Logger
+
+	mu      sync.Mutex
+	totals  map[int]uint64
+	file    *os.File // nil until the next write
+	size    int64
+	started time.Time     // of its first line
+	history *usageHistory // nil when no history is kept
+}
+
+// openSnifferLog returns the sniffer log at path, reading its totals the
+// first time.
+func openSnifferLog(path string, logger *logrus.Logger) *snifferLog {
+	snifferLogsMu.Lock()
+	defer snifferLogsMu.Unlock()
+	if l, ok := snifferLogs[path]; ok {
+		return l
+	}
+	l := &snifferLog{path: path, logger: logger, totals: make(map[int]uint64)}
+	if err := l.load(); err != nil {
+		logger.Errorf("failed to read the sniffer log %s: %v", path, err)
+	}
+	l.history = newUsageHistory(path, logger)
+	snifferLogs[path] = l
+	return l
+}
+
+// load reads the totals of the log. A log of older versions, one JSON array
+// of totals, is moved aside to path.v1 and its totals carried over.
+func (l *snifferLog) load() error {
+	data, err := os.ReadFile(l.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if trimmed := bytes.TrimSpace(data); len(trimmed) > 0 && trimmed[0] == '[' {
+		var usage []PortUsage
+		if err := json.Unmarshal(trimmed, &usage); err != nil {
+			return err
+		}
+		for _, port := range usage {
+			l.totals[port.Port] += port.Usage
+		}
+		if err := os.Rename(l.path, l.path+".v1"); err != nil {
+			return err
+		}
+		l.logger.Infof("sniffer log %s is now written as JSON lines, the old one is kept as %s.v1", l.path, l.path)
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var record snifferRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			continue // cut short by a crash
+		}
+		if l.started.IsZero() {
+			l.started = record.Time
+		}
+		l.totals[record.Port] = record.Total
+	}
+	return scanner.Err()
+}
+
+// add adds the bytes relayed by port since the last call and appends them
+// to the log, rotating it first if it is due.
+func (l *snifferLog) add(usage []PortUsage) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(usage) == 0 {
+		return
+	}
+	now := time.Now()
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	if err := l.open(now); err != nil {
+		l.logger.Errorf("failed to open the sniffer log %s: %v", l.path, err)
+	}
+	for _, port := range usage {
+		l.totals[port.Port] += port.Usage
+		encoder.Encode(snifferRecord{Time: now, Port: port.Port, Bytes: port.Usage, Total: l.totals[port.Port]})
+	}
+	l.write(lines.Bytes())
+	l.history.add(now, usage)
+}
+
+// flush writes what the usage history holds and the file doesn't yet, as on
+// shutdown.
+func (l *snifferLog) flush() {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.history.flush(time.Now())
+}
+
+// series returns the usage history of port, see usageHistory.series.
+func (l *snifferLog) series(port int, from, to time.Time) []HistoryPoint {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.history.series(port, from, to)
+}
+
+// open opens the log for appending if it isn't yet, and rotates it if it is
+// due, starting the new one with the totals. The caller holds l.mu.
+func (l *snifferLog) open(now time.Time) error {
+	if l.file == nil {
+		if err := l.reopen(now); err != nil {
+			return err
+		}
+	}
+	r := logRotation()
+	if l.size == 0 || !(r.MaxSize > 0 && l.size >= r.MaxSize || r.MaxAge > 0 && now.Sub(l.started) >= r.MaxAge) {
+		return nil
+	}
+
+	l.file.Close()
+	l.file = nil
+	rotated := l.path + "." + now.Format(rotatedLayout)
+	if err := os.Rename(l.path, rotated); err != nil {
+		return err
+	}
+	go compressLog(rotated, l.path, r.Retention, l.logger)
+	return l.reopen(now)
+}
+
+// reopen opens the file of the log, writing the totals first to an empty
+// one. The caller holds l.mu.
+func (l *snifferLog) reopen(now time.Time) error {
+	file, err := os.OpenFile(l.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	l.file, l.size = file, info.Size()
+	if l.size > 0 && !l.started.IsZero() {
+		return nil
+	}
+
+	l.started = now
+	var lines bytes.Buffer
+	encoder := json.NewEncoder(&lines)
+	for _, port := range sortedPorts(l.totals) {
+		encoder.Encode(snifferRecord{Time: now, Port: port, Total: l.totals[port]})
+	}
+	l.write(lines.Bytes())
+	return nil
+}
+
+// write appends lines to the log, the caller holds l.mu.
+func (l *snifferLog) write(lines []byte) {
+	if l.file == nil || len(lines) == 0 {
+		return
+	}
+	n, err := l.file.Write(lines)
+	l.size += int64(n)
+	if err != nil {
+		l.logger.Errorf("failed to write the sniffer log %s: %v", l.path, err)
+	}
+}
+
+// usage returns the totals by port, sorted by port.
+func (l *snifferLog) usage() ([]PortUsage, uint64) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	var usage []PortUsage
+	var total uint64
+	for _, port := range sortedPorts(l.totals) {
+		usage = append(usage, PortUsage{Port: port, Usage: l.totals[port]})
+		total += l.totals[port]
+	}
+	return usage, total
+}
+
+func sortedPorts(totals map[int]uint64) []int {
+	ports := make([]int, 0, len(totals))
+	for port := range totals {
+		ports = append(ports, port)
+	}
+	sort.Ints(ports)
+	return ports
+}
+
+// compressLog gzips the rotated log at rotated and deletes the rotated logs
+// of path older than retention.
+func compressLog(rotated, path string, retention time.Duration, logger *logrus.Logger) {
+	if err := gzipFile(rotated); err != nil {
+		logger.Errorf("failed to compress the sniffer log %s: %v", rotated, err)
+	}
+	if retention <= 0 {
+		return
+	}
+	old, _ := filepath.Glob(path + ".[0-9]*")
+	for _, file := range old {
+		if info, err := os.Stat(file); err == nil && time.Since(info.ModTime()) > retention {
+			if err := os.Remove(file); err != nil {
+				logger.Errorf("failed to delete the sniffer log %s: %v", file, err)
+				continue
+			}
+			logger.Debugf("deleted the sniffer log %s, older than %v", file, retention)
+		}
+	}
+}
+
+// gzipFile replaces the file at path with path.gz.
+func gzipFile(path string) error {
+	in, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.Create(path + ".gz")
+	if err != nil {
+		return err
+	}
+	zw := gzip.NewWriter(out)
+	_, err = io.Copy(zw, in)
+	if err == nil {
+		err = zw.Close()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(path + ".gz")
+		return err
+	}
+	return os.Remove(path)
+}
@@ -0,0 +1,93 @@
+package web
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+)
+
+// SourceUsage is the traffic of a source address on a public port.
+type SourceUsage struct {
+	Address     string `json:"address"`
+	Bytes       uint64 `json:"bytes"`
+	Over        uint64 `json:"over"` // Bytes may be counted over by up to this much
+	Connections int64  `json:"connections"`
+	Country     string `json:"country,omitempty"` // ISO 3166-1 code, with GeoIP
+	ASN         uint   `json:"asn,omitempty"`
+	Org         string `json:"org,omitempty"` // holding the autonomous system
+}
+
+// PortSources is the top source addresses of a public port by traffic.
+type PortSources struct {
+	Port    int           `json:"port"`
+	Sources []SourceUsage `json:"sources"`
+}
+
+// top sources of the public ports of this server, nil without top_sources
+var lastSources atomic.Pointer[[]PortSources]
+
+// RecordSources shows the top sources of the public ports on the dashboard
+// and /api/sources.
+func RecordSources(ports []PortSources) {
+	lastSources.Store(&ports)
+}
+
+// CountryUsage is the traffic of a country over the public ports.
+type CountryUsage struct {
+	Country     string `json:"country"` // ISO 3166-1 code, "unknown" for the addresses not in the databases
+	Name        string `json:"name"`
+	Bytes       uint64 `json:"bytes"`
+	Connections int64  `json:"connections"`
+}
+
+// traffic by country of the public ports of this server, nil without GeoIP
+var lastCountries atomic.Pointer[[]CountryUsage]
+
+// RecordCountries shows the traffic by country on the dashboard and
+// /api/countries.
+func RecordCountries(countries []CountryUsage) {
+	lastCountries.Store(&countries)
+}
+
+// handleSources serves the top sources of each public port, or of one port.
+func (m *Usage) handleSources(w http.ResponseWriter, r *http.Request) {
+	recorded := lastSources.Load()
+	if recorded == nil {
+		http.Error(w, "source tracking is off, it needs top_sources on the server", http.StatusNotFound)
+		return
+	}
+	ports := *recorded
+	if value := r.URL.Query().Get("port"); value != "" {
+		port, err := strconv.Atoi(value)
+		if err != nil || port < 1 || port > 65535 {
+			http.Error(w, fmt.Sprintf("invalid port %q", value), http.StatusBadRequest)
+			return
+		}
+		ports = []PortSources{}
+		for _, sources := range *recorded {
+			if sources.Port == port {
+				ports = append(ports, sources)
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(ports); err != nil {
+		m.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
+
+// handleCountries serves the traffic by country.
+func (m *Usage) handleCountries(w http.ResponseWriter, r *http.Request) {
+	recorded := lastCountries.Load()
+	if recorded == nil {
+		http.Error(w, "GeoIP is off, it needs geoip_db on the server", http.StatusNotFound)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if err := json.NewEncoder(w).Encode(*recorded); err != nil {
+		m.logger.Errorf("error encoding JSON response: %v", err)
+	}
+}
@@ -7,14 +7,70 @@ import (
 	"os"
 
 	"github.com/sahmadiut/backhaul/cmd"
+	"github.com/sahmadiut/backhaul/internal/utils"
 )
 
 // Define the version of the application
 const version = "v0.2.1-s7"
 
 func main() {
-	configPath := flag.String("c", "", "path to the configuration file (TOML format)")
+	utils.Version = version
+
+	// subcommands
+	if len(os.Args) > 1 {
+		switch os.Args[1] {
+		case "upgrade":
+			cmd.Upgrade(os.Args[2:])
+			return
+		case "init":
+			cmd.Init(os.Args[2:])
+			return
+		case "status", "sessions", "paths", "ports", "cluster":
+			cmd.Status(os.Args[1], os.Args[2:])
+			return
+		case "bench":
+			cmd.Bench(os.Args[2:])
+			return
+		case "speedtest":
+			cmd.Speedtest(os.Args[2:])
+			return
+		case "attack":
+			cmd.Attack(os.Args[2:])
+			return
+		case "forwarder":
+			cmd.Forwarder(os.Args[2:])
+			return
+		case "doctor":
+			cmd.Doctor(os.Args[2:])
+			return
+		case "quick":
+			cmd.Quick(os.Args[2:])
+			return
+		case "noise-key":
+			cmd.NoiseKey(os.Args[2:])
+			return
+		case "api-key":
+			cmd.APIKey(os.Args[2:])
+			return
+		case "update-key":
+			cmd.UpdateKey(os.Args[2:])
+			return
+		case "protocol":
+			cmd.Protocol(os.Args[2:])
+			return
+		case "conformance":
+			cmd.Conformance(os.Args[2:])
+			return
+		case "server", "client":
+			cmd.Role(os.Args[1], os.Args[2:])
+			return
+		}
+	}
+
+	configPath := flag.String("c", "", "path to the configuration file (TOML, YAML or JSON)")
+	profile := flag.String("p", "", "named profile of the configuration file")
 	showVersion := flag.Bool("v", false, "print the version and exit")
+	overrides := cmd.RegisterFlags(flag.CommandLine, "")
 
 	flag.Parse()
 
@@ -29,5 +85,5 @@ func main() {
 		log.Fatalf("Usage: %s -c /path/to/config.toml", flag.CommandLine.Name())
 	}
 
-	cmd.Run(*configPath)
+	cmd.Run(*configPath, *profile, overrides)
 }